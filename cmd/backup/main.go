@@ -0,0 +1,148 @@
+// Command backup creates, lists, verifies and restores database backups, for disaster recovery.
+//
+// Usage:
+//
+//	backup create
+//	backup list
+//	backup verify <backup_id>
+//	backup restore [-allow-missing] <backup_id>
+//
+// It reads the same configuration and secrets as the web server. Stop every web server replica before restoring,
+// as restoring replaces the backed up collections.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+
+	"github.com/joho/godotenv"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/backup"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/pagination"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/secrets"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/services"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/storage"
+)
+
+const usage = `usage:
+  backup create
+  backup list
+  backup verify <backup_id>
+  backup restore [-allow-missing] <backup_id>`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	command, args := os.Args[1], os.Args[2:]
+
+	restoreFlags := flag.NewFlagSet("restore", flag.ExitOnError)
+	allowMissing := restoreFlags.Bool("allow-missing", false, "restore even if files referenced by the backup are missing")
+	if command == "restore" {
+		restoreFlags.Parse(args)
+		args = restoreFlags.Args()
+	}
+
+	// The .env file is optional when secrets come from the file or vault providers
+	err := godotenv.Load("secrets/.env")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		panic(fmt.Sprintf("Error loading .env file: %s", err))
+	}
+
+	logger, err := log.NewLogger(true, false)
+	if err != nil {
+		panic(err)
+	}
+	defer logger.Sync()
+
+	cfg, err := config.Load()
+	if err != nil {
+		logger.Fatal("Error loading configuration:", err)
+	}
+	logger.SetRedaction(!cfg.LogUnredacted)
+	if cfg.LogUnredacted {
+		logger.Warn("Log redaction disabled, personal data and tokens will be logged")
+	}
+	ctx := context.Background()
+
+	backupService, err := newBackupService(ctx, cfg, logger)
+	if err != nil {
+		logger.Fatal("Error initializing backup service:", err)
+	}
+
+	var result interface{}
+	switch {
+	case command == "create" && len(args) == 0:
+		result, err = backupService.CreateBackup(ctx)
+	case command == "list" && len(args) == 0:
+		// Every backup is listed at once
+		result, _, err = backupService.ListBackups(ctx, pagination.Page{})
+	case command == "verify" && len(args) == 1:
+		result, err = backupService.VerifyBackup(ctx, args[0])
+	case command == "restore" && len(args) == 1:
+		result, err = backupService.RestoreBackup(ctx, args[0], *allowMissing)
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	// Print the result even on failure, i.e the files missing when a restore was refused
+	if result != nil {
+		out, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Println(string(out))
+	}
+	if err != nil {
+		logger.Fatal("Backup ", command, " failed: ", err)
+	}
+}
+
+// newBackupService connects to MongoDB and the storages like the web server, and creates the BackupService.
+func newBackupService(ctx context.Context, cfg *config.Config, logger *log.Logger) (*services.BackupService, error) {
+	secretsProvider, err := secrets.NewProvider(cfg)
+	if err != nil {
+		return nil, err
+	}
+	mongoUsername, err := secretsProvider.GetSecret(ctx, secrets.MongoUsername)
+	if err != nil {
+		return nil, err
+	}
+	mongoPassword, err := secretsProvider.GetSecret(ctx, secrets.MongoPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	mongoURI := fmt.Sprintf("mongodb://%s:%s@%s:27017",
+		url.QueryEscape(mongoUsername),
+		url.QueryEscape(mongoPassword),
+		os.Getenv("MONGO_IP"))
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoURI))
+	if err != nil {
+		return nil, err
+	}
+
+	artifactStorage, err := storage.New(ctx, cfg, secretsProvider)
+	if err != nil {
+		return nil, err
+	}
+	coldStorage, err := storage.NewArchive(ctx, cfg, secretsProvider)
+	if err != nil {
+		return nil, err
+	}
+	backupStorage, err := storage.NewBackup(ctx, cfg, secretsProvider)
+	if err != nil {
+		return nil, err
+	}
+
+	return services.NewBackupService(backup.NewBackupManager(client, logger, false), artifactStorage, coldStorage, backupStorage, logger), nil
+}
@@ -2,25 +2,51 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
+	"net/url"
 	"os"
+	"time"
+	_ "time/tzdata" // Embed the timezone database, so user timezone preferences work in minimal containers
 
 	"github.com/joho/godotenv"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
+	"github.com/NeRF-or-Nothing/go-web-server/internal/broker"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
 	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/mail"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/announcement"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/audit"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/backup"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/deadletter"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/event"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/integrity"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/lease"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/notification"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/processedoutput"
 	"github.com/NeRF-or-Nothing/go-web-server/internal/models/queue"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/ratelimit"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/refreshtoken"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/replay"
 	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/upload"
 	"github.com/NeRF-or-Nothing/go-web-server/internal/models/user"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/worker"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/secrets"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/selfcheck"
 	"github.com/NeRF-or-Nothing/go-web-server/internal/services"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/storage"
 	"github.com/NeRF-or-Nothing/go-web-server/internal/web"
 )
 
 func main() {
-	// Load environment variables from .env file (should be redundant, as docker-compose should load these)
-	err := godotenv.Load("secrets/.env")
-	if err != nil {
+	// Load environment variables from .env file (should be redundant, as docker-compose should load these).
+	// The file is optional when secrets come from the file or vault providers.
+	err := godotenv.Load(config.EnvFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		panic(fmt.Sprintf("Error loading .env file: %s", err))
 	}
 
@@ -31,34 +57,248 @@ func main() {
 	}
 	defer logger.Sync()
 
+	// Load runtime configuration
+	cfg, err := config.Load()
+	if err != nil {
+		logger.Fatal("Error loading configuration:", err)
+	}
+	logger.SetRedaction(!cfg.LogUnredacted)
+	if err := logger.SetLevel(cfg.Tunables().LogLevel); err != nil {
+		logger.Fatal("Error setting log level:", err)
+	}
+	if cfg.LogUnredacted {
+		logger.Warn("Log redaction disabled, personal data and tokens will be logged")
+	}
+	if len(cfg.WorkerAllowedHosts) == 0 {
+		logger.Warn("WORKER_ALLOWED_HOSTS is empty, worker artifacts may be downloaded from any host but loopback and link-local addresses")
+	}
+
 	rabbitMQIP := os.Getenv("RABBITMQ_IP")
 	webserverIP := os.Getenv("WEBSERVER_IP")
 
+	// Create the secrets provider used for all credentials and signing keys
+	secretsProvider, err := secrets.NewProvider(cfg)
+	if err != nil {
+		logger.Fatal("Error creating secrets provider:", err)
+	}
+	mongoUsername, err := secretsProvider.GetSecret(context.Background(), secrets.MongoUsername)
+	if err != nil {
+		logger.Fatal("Error getting MongoDB username:", err)
+	}
+	mongoPassword, err := secretsProvider.GetSecret(context.Background(), secrets.MongoPassword)
+	if err != nil {
+		logger.Fatal("Error getting MongoDB password:", err)
+	}
+
 	// Create a MongoDB client
 	mongoURI := fmt.Sprintf("mongodb://%s:%s@%s:27017",
-        os.Getenv("MONGO_INITDB_ROOT_USERNAME"),
-        os.Getenv("MONGO_INITDB_ROOT_PASSWORD"),
-        os.Getenv("MONGO_IP"))
+		url.QueryEscape(mongoUsername),
+		url.QueryEscape(mongoPassword),
+		os.Getenv("MONGO_IP"))
 	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(mongoURI))
 	if err != nil {
 		logger.Fatal("Error creating MongoDB client:", err)
 	}
 
+	// Create the artifact storage shared by every replica
+	artifactStorage, err := storage.New(context.Background(), cfg, secretsProvider)
+	if err != nil {
+		logger.Fatal("Error creating artifact storage:", err)
+	}
+	coldStorage, err := storage.NewArchive(context.Background(), cfg, secretsProvider)
+	if err != nil {
+		logger.Fatal("Error creating archive storage:", err)
+	}
+
+	// Encrypt the artifacts of scenes at rest, if enabled
+	artifactStorage, err = storage.WithEncryption(context.Background(), artifactStorage, cfg, secretsProvider)
+	if err != nil {
+		logger.Fatal("Error enabling artifact storage encryption:", err)
+	}
+	coldStorage, err = storage.WithEncryption(context.Background(), coldStorage, cfg, secretsProvider)
+	if err != nil {
+		logger.Fatal("Error enabling archive storage encryption:", err)
+	}
+
+	// Create the backup storage, kept apart from the artifact storage for disaster recovery
+	backupStorage, err := storage.NewBackup(context.Background(), cfg, secretsProvider)
+	if err != nil {
+		logger.Fatal("Error creating backup storage:", err)
+	}
+
+	// Sign the URLs workers download the inputs of their jobs from
+	workerURLs, err := storage.NewWorkerURLSigner(context.Background(), cfg, secretsProvider)
+	if err != nil {
+		logger.Fatal("Error creating the worker data URL signer:", err)
+	}
+
+	// Load the JWT keyring, and keep it reloading so the secret can be rotated without a restart
+	jwtKeyring, err := secrets.NewJWTKeyring(context.Background(), secretsProvider, cfg.JWTAlgorithm, logger)
+	if err != nil {
+		logger.Fatal("Error loading JWT keyring:", err)
+	}
+	go jwtKeyring.Watch(context.Background(), cfg.SecretsReloadInterval)
+
+	// Verify the dependencies before starting any service, and refuse to start if a critical check fails
+	checks := []selfcheck.Check{
+		selfcheck.Mongo(client),
+		{
+			Name:     "broker queues",
+			Critical: true,
+			Run: func(ctx context.Context) error {
+				return broker.Check(ctx, cfg, secretsProvider, rabbitMQIP, services.BrokerTopology(cfg), logger)
+			},
+		},
+		selfcheck.Storage("artifact storage", artifactStorage),
+		selfcheck.Storage("backup storage", backupStorage),
+		selfcheck.TempDir(),
+		selfcheck.JWTKeys(jwtKeyring),
+	}
+	if coldStorage != nil {
+		checks = append(checks, selfcheck.Storage("archive storage", coldStorage))
+	}
+	results := selfcheck.Run(context.Background(), cfg.StartupCheckTimeout, checks...)
+	selfcheck.Report(os.Stdout, results)
+	if selfcheck.Failed(results) > 0 {
+		logger.Fatal("Startup self-check failed")
+	}
+
+	// Fire the configured hooks for artifacts created or deleted by this server
+	hooks := storage.NewHooks(context.Background(), cfg, secretsProvider, logger)
+	artifactStorage = storage.WithHooks(artifactStorage, storage.StoreArtifacts, hooks)
+	coldStorage = storage.WithHooks(coldStorage, storage.StoreArchive, hooks)
+
 	// Create separate managers with the MongoDB client
 	sceneManager := scene.NewSceneManager(client, logger, false)
 	queueManager := queue.NewQueueListManager(client, logger, false)
 	userManager := user.NewUserManager(client, logger, false)
+	announcementManager := announcement.NewAnnouncementManager(client, logger, false)
+	leaseManager := lease.NewLeaseManager(client, logger, false)
+	eventManager := event.NewEventManager(client, logger, false)
+	if err := eventManager.EnsureIndexes(context.Background()); err != nil {
+		logger.Fatal("Error creating event indexes:", err)
+	}
+	refreshTokenManager := refreshtoken.NewRefreshTokenManager(client, logger, false)
+	if err := refreshTokenManager.EnsureIndexes(context.Background()); err != nil {
+		logger.Fatal("Error creating refresh token indexes:", err)
+	}
+	uploadSessionManager := upload.NewUploadSessionManager(client, logger, false)
+	if err := uploadSessionManager.EnsureIndexes(context.Background()); err != nil {
+		logger.Fatal("Error creating upload session indexes:", err)
+	}
+	uploadProgressManager := upload.NewUploadProgressManager(client, logger, false)
+	if err := uploadProgressManager.EnsureIndexes(context.Background()); err != nil {
+		logger.Fatal("Error creating upload progress indexes:", err)
+	}
+	auditManager := audit.NewAuditManager(client, logger, false)
+	if err := auditManager.EnsureIndexes(context.Background()); err != nil {
+		logger.Fatal("Error creating audit indexes:", err)
+	}
+	notificationManager := notification.NewNotificationManager(client, logger, false)
+	if err := notificationManager.EnsureIndexes(context.Background()); err != nil {
+		logger.Fatal("Error creating notification indexes:", err)
+	}
+
+	// Count the login and registration requests in memory, or in MongoDB to share the limits between replicas
+	rateLimitStore := web.NewMemoryRateLimitStore()
+	if cfg.RateLimitBackend == "mongo" {
+		rateLimitManager := ratelimit.NewRateLimitManager(client, logger, false)
+		if err := rateLimitManager.EnsureIndexes(context.Background()); err != nil {
+			logger.Fatal("Error creating rate limit indexes:", err)
+		}
+		rateLimitStore = rateLimitManager
+	}
 
 	// Initialize services
-	mqService, err := services.NewAMPQService(rabbitMQIP, sceneManager, queueManager, logger)
+	sceneCallbacks := services.NewSceneCallbacks(sceneManager, cfg, logger)
+	deadLetterManager := deadletter.NewDeadLetterManager(client, logger, false)
+	workerManager := worker.NewWorkerManager(client, logger, false)
+	if err := workerManager.EnsureIndexes(context.Background()); err != nil {
+		logger.Fatal("Error creating worker indexes:", err)
+	}
+	processedOutputManager := processedoutput.NewProcessedOutputManager(client, logger, false)
+	if err := processedOutputManager.EnsureIndexes(context.Background()); err != nil {
+		logger.Fatal("Error creating processed output indexes:", err)
+	}
+	messageBroker, err := broker.New(context.Background(), cfg, secretsProvider, rabbitMQIP, services.BrokerTopology(cfg), logger)
+	if err != nil {
+		logger.Panic("Error connecting to the message broker:", err)
+	}
+	mqService, err := services.NewAMPQService(messageBroker, sceneManager, queueManager, leaseManager, eventManager, deadLetterManager, workerManager, processedOutputManager, artifactStorage, workerURLs, sceneCallbacks, cfg, logger)
 	if err != nil {
 		logger.Panic("Error initializing AMPQ service:", err)
 	}
-	clientService := services.NewClientService(mqService, sceneManager, userManager, queueManager, logger)
+	auditService := services.NewAuditService(auditManager, logger)
+	authProvider, err := services.NewAuthProvider(cfg, userManager, logger)
+	if err != nil {
+		logger.Fatal("Error creating auth provider:", err)
+	}
+	uploadScanner, err := services.NewScanner(cfg)
+	if err != nil {
+		logger.Fatal("Error creating upload scanner:", err)
+	}
+	clientService := services.NewClientService(mqService, sceneManager, userManager, queueManager, refreshTokenManager, eventManager, artifactStorage, coldStorage, auditService, authProvider, cfg, logger)
+	quotas := services.NewQuotas(sceneManager, queueManager, artifactStorage, coldStorage, cfg)
+	uploadService := services.NewUploadService(mqService, sceneManager, userManager, eventManager, uploadSessionManager, uploadProgressManager, artifactStorage, sceneCallbacks, quotas, uploadScanner, cfg, logger)
+	// Remove abandoned resumable uploads and their chunks
+	go uploadService.RunUploadCleanup(context.Background(), time.Hour)
+	// Archive old scenes, and resume archives / restores interrupted by a restart
+	go clientService.RunArchivePolicy(context.Background(), time.Hour)
+	// Remove deleted accounts once their grace period passed
+	go clientService.RunAccountDeletion(context.Background(), 10*time.Minute)
+	// Remove the scenes whose trash retention passed
+	go clientService.RunTrashPurge(context.Background(), time.Hour)
+
+	// Start the replay scheduler, only the replica holding the replay lease starts replayed scenes
+	replayService := services.NewReplayService(mqService, sceneManager, queueManager, replay.NewReplayManager(client, logger, false), leaseManager, artifactStorage, cfg, logger)
+	go replayService.Run(context.Background())
+
+	// Start the integrity scheduler, only the replica holding the integrity lease verifies the stored scene files
+	integrityService := services.NewIntegrityService(integrity.NewIntegrityManager(client, logger, false), sceneManager, leaseManager, artifactStorage, cfg, logger)
+	go integrityService.Run(context.Background())
+
+	adminService := services.NewAdminService(announcementManager, eventManager, userManager, queueManager, sceneManager, mqService, cfg, logger)
+
+	// Grant the configured admins their role, and create the bootstrap admin of a fresh deployment
+	if err := adminService.GrantAdmins(context.Background(), cfg.AdminUserIDs); err != nil {
+		logger.Fatal("Error granting admin roles:", err)
+	}
+	if cfg.BootstrapAdminUsername != "" {
+		password, err := secretsProvider.GetSecret(context.Background(), secrets.BootstrapAdminPassword)
+		if err != nil && !errors.Is(err, secrets.ErrSecretNotFound) {
+			logger.Fatal("Error getting bootstrap admin password:", err)
+		}
+		if err := adminService.BootstrapAdmin(context.Background(), cfg.BootstrapAdminUsername, password); err != nil {
+			logger.Fatal("Error creating bootstrap admin:", err)
+		}
+	}
+
+	backupService := services.NewBackupService(backup.NewBackupManager(client, logger, false), artifactStorage, coldStorage, backupStorage, logger)
+
+	// Start the digest scheduler, only the replica holding the digest lease sends emails
+	mailer, err := mail.New(context.Background(), cfg, secretsProvider, logger)
+	if err != nil {
+		logger.Fatal("Error creating mailer:", err)
+	}
+	digestService := services.NewDigestService(userManager, eventManager, leaseManager, mailer, cfg, logger)
+	go digestService.Run(context.Background())
+
+	// Start the retention scheduler, only the replica holding the retention lease deletes outputs
+	retentionService := services.NewRetentionService(userManager, sceneManager, leaseManager, artifactStorage, coldStorage, mailer, cfg, logger)
+	go retentionService.Run(context.Background())
+
+	// Start the queue notification scheduler, only the replica holding the notification lease notifies queue positions
+	notificationService := services.NewNotificationService(notificationManager, queueManager, userManager, leaseManager, cfg, logger)
+	go notificationService.Run(context.Background())
+
+	// Create the enabled social login providers
+	oauthProviders, err := web.NewOAuthProviders(context.Background(), cfg, secretsProvider)
+	if err != nil {
+		logger.Fatal("Error creating social login providers:", err)
+	}
 
 	// Initialize web server
-	jwtSecret := os.Getenv("JWT_SECRET_KEY")
-	server := web.NewWebServer(jwtSecret, clientService, logger)
+	server := web.NewWebServer(jwtKeyring, clientService, uploadService, adminService, backupService, replayService, integrityService, auditService, notificationService, rateLimitStore, artifactStorage, workerURLs, oauthProviders, cfg, logger)
 
 	fmt.Println("Starting server...")
 
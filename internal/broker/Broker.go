@@ -0,0 +1,238 @@
+// This file contains the Broker interface, the messages exchanged through it, and the constructor selecting the configured backend.
+
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"time"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/secrets"
+)
+
+// Custom errors
+var (
+	// ErrUnknownBackend is returned when the configured broker backend is not supported.
+	ErrUnknownBackend = errors.New("unknown broker backend")
+	// ErrNotConfirmed is returned when the broker did not confirm a published message in time, or refused it.
+	ErrNotConfirmed = errors.New("message was not confirmed by the broker")
+)
+
+// Declarations for valid backends
+const (
+	BackendRabbitMQ = "rabbitmq"
+	BackendNATS     = "nats"
+	BackendKafka    = "kafka"
+)
+
+// notBeforeHeader is the header delayed messages carry the time (unix milliseconds) they may be consumed at, on backends
+// without native delayed delivery
+const notBeforeHeader = "x-not-before"
+
+// retryQueue returns the name of the queue (or topic) delayed messages of the given queue wait in, on backends without
+// native delayed delivery per message.
+func retryQueue(queueName string) string {
+	return queueName + ".retry"
+}
+
+// consumerTimeout is how long a consumer may take to ack a message before the broker delivers it again
+const consumerTimeout = time.Hour
+
+// Message represents a message published to, or consumed from, the broker
+type Message struct {
+	// ID optionally identifies the message, so consumers can detect duplicate deliveries
+	ID          string
+	ContentType string
+	// Headers are string or integer values. Backends without typed headers deliver every value as a string.
+	Headers map[string]interface{}
+	Body    []byte
+	// Priority is the priority of a job, only honoured by RabbitMQ priority queues
+	Priority uint8
+}
+
+// Delivery represents a consumed message, which must be acked once processed, or nacked
+type Delivery struct {
+	Message
+	// Redelivered is set if the message was delivered before without being acked
+	Redelivered bool
+	ack         func() error
+	nack        func(requeue bool) error
+}
+
+// Ack acknowledges the delivery, so the message is not delivered again.
+func (d Delivery) Ack() error {
+	return d.ack()
+}
+
+// Nack rejects the delivery. The message is delivered again if requeue is set, and dropped otherwise.
+func (d Delivery) Nack(requeue bool) error {
+	return d.nack(requeue)
+}
+
+// Subscription represents the consumption of a queue, see Broker.Consume
+type Subscription struct {
+	deliveries chan Delivery
+	err        error
+}
+
+// newSubscription creates a subscription whose deliveries are sent by the backend, which closes it once consumption ends.
+func newSubscription() *Subscription {
+	return &Subscription{deliveries: make(chan Delivery)}
+}
+
+// close ends the subscription with the given error, nil if its context was cancelled.
+func (s *Subscription) close(err error) {
+	s.err = err
+	close(s.deliveries)
+}
+
+// Deliveries returns the channel messages are delivered on, closed once consumption ended.
+func (s *Subscription) Deliveries() <-chan Delivery {
+	return s.deliveries
+}
+
+// Err returns why consumption ended, once Deliveries is closed. Returns nil if the context of the subscription was cancelled.
+func (s *Subscription) Err() error {
+	return s.err
+}
+
+// QueueConfig represents a queue (or topic) of the Topology
+type QueueConfig struct {
+	Name string
+	// MaxPriority declares the queue as a priority queue of priorities up to it (RabbitMQ with AMQP_PRIORITY_QUEUES only),
+	// 0 for a regular queue
+	MaxPriority uint8
+	// Delayed allows publishing delayed messages to the queue
+	Delayed bool
+	// MessageTTL discards the messages not consumed within it, 0 keeps them until they are consumed
+	MessageTTL time.Duration
+}
+
+// Topology represents the queues and topics created on the broker on connect
+type Topology struct {
+	// Queues deliver every message to a single consumer
+	Queues []QueueConfig
+	// Topics deliver every message to every subscriber (i.e every worker)
+	Topics []QueueConfig
+}
+
+// Broker is implemented by every message broker backend.
+type Broker interface {
+	// Publish publishes a message to the given queue, and returns once the broker confirmed it, within PUBLISH_CONFIRM_TIMEOUT.
+	// Returns ErrNotConfirmed if the message was refused or not confirmed in time.
+	Publish(ctx context.Context, queue string, msg Message) error
+	// PublishDelayed publishes a message to the given Delayed queue, which is delivered once the delay passed.
+	PublishDelayed(ctx context.Context, queue string, msg Message, delay time.Duration) error
+	// Broadcast publishes a message to the given topic, which is delivered to every subscriber.
+	Broadcast(ctx context.Context, topic string, msg Message) error
+	// Consume consumes the given queue until the context is cancelled, or consumption fails. Deliveries that are not
+	// acked once consumption ended are delivered again.
+	Consume(ctx context.Context, queue string) (*Subscription, error)
+	// Connected returns whether the connection to the broker is up.
+	Connected() bool
+	// Close closes the connection to the broker.
+	Close() error
+	// Backend returns the name of the backend (rabbitmq, nats, kafka).
+	Backend() string
+}
+
+// New connects to the broker backend selected by the configuration, and creates the queues and topics of the topology.
+// The RabbitMQ broker is reached on rabbitMQDomain. Credentials are read from the secrets provider.
+//
+// Returns ErrUnknownBackend if the configured backend is not supported.
+func New(ctx context.Context, cfg *config.Config, secretsProvider secrets.Provider, rabbitMQDomain string, topology Topology, logger *log.Logger) (Broker, error) {
+	switch cfg.BrokerBackend {
+	case BackendRabbitMQ:
+		return NewRabbitMQBroker(ctx, rabbitMQDomain, secretsProvider, topology, cfg, logger)
+	case BackendNATS:
+		return NewNATSBroker(ctx, cfg.NATSURL, secretsProvider, topology, cfg, logger)
+	case BackendKafka:
+		return NewKafkaBroker(ctx, cfg.KafkaBrokers, secretsProvider, topology, cfg, logger)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownBackend, cfg.BrokerBackend)
+	}
+}
+
+// Check verifies the broker accepts the credentials of the secrets provider and the queue settings of the configuration,
+// by creating the topology on a short-lived connection. Connecting is retried until the context is done, as the broker may
+// still be starting. Used by the startup self-check.
+func Check(ctx context.Context, cfg *config.Config, secretsProvider secrets.Provider, rabbitMQDomain string, topology Topology, logger *log.Logger) error {
+	for {
+		b, err := New(ctx, cfg, secretsProvider, rabbitMQDomain, topology, logger)
+		if err == nil {
+			return b.Close()
+		}
+		if errors.Is(err, ErrUnknownBackend) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// optionalSecret returns the secret with the given name, or "" if the secrets provider does not have it.
+func optionalSecret(ctx context.Context, secretsProvider secrets.Provider, name string) (string, error) {
+	value, err := secretsProvider.GetSecret(ctx, name)
+	if errors.Is(err, secrets.ErrSecretNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get %s: %v", name, err)
+	}
+	return value, nil
+}
+
+// notBefore returns the time the message with the given headers may be consumed at, the zero time if it is not delayed.
+func notBefore(headers map[string]interface{}) time.Time {
+	value, ok := headers[notBeforeHeader].(string)
+	if !ok {
+		return time.Time{}
+	}
+	millis, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(millis)
+}
+
+// withNotBefore returns a copy of the message, delayed until the given delay passed.
+func withNotBefore(msg Message, delay time.Duration) Message {
+	headers := make(map[string]interface{}, len(msg.Headers)+1)
+	for key, value := range msg.Headers {
+		headers[key] = value
+	}
+	headers[notBeforeHeader] = strconv.FormatInt(time.Now().Add(delay).UnixMilli(), 10)
+	msg.Headers = headers
+	return msg
+}
+
+// Backoff bounds of reconnections to the broker and of restarting consumers
+const (
+	reconnectMinDelay = 500 * time.Millisecond
+	reconnectMaxDelay = 30 * time.Second
+)
+
+// Backoff computes jittered exponential delays between reconnection attempts, so replicas do not reconnect in lockstep
+type Backoff struct {
+	attempt int
+}
+
+// Next returns the delay before the next attempt: a random duration between half and all of the exponential delay.
+func (b *Backoff) Next() time.Duration {
+	delay := min(reconnectMinDelay<<min(b.attempt, 16), reconnectMaxDelay)
+	b.attempt++
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// Reset restarts the delays from reconnectMinDelay, once an attempt succeeded.
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
@@ -0,0 +1,372 @@
+// This file contains the Kafka backend of the broker.
+//
+// Every queue and topic is a Kafka topic of the same name, created with the partitions and replication factor defaults of the
+// cluster, and a retention of its message TTL (Kafka expires whole log segments, so messages may outlive it). The web server
+// consumes its queues in the KAFKA_CONSUMER_GROUP consumer group, while every worker consumes the topics in a group of its own.
+//
+// Delayed messages are written to the retry topic of their queue (i.e 'sfm-out.retry'), consumed alongside the queue in a consumer
+// group of its own (KAFKA_CONSUMER_GROUP with a '-retry' suffix), which forwards every message to the queue once it is due. The
+// queue is therefore never held up by a delayed message, but a message of a retry topic may wait for the longer delay of one
+// written before it, as in the RabbitMQ retry queues.
+//
+// Kafka has no per-message acknowledgements: the offset of a message is committed once it is acked (or nacked without
+// requeueing), and a message nacked for requeueing is written again to the end of its topic before it is committed, so the
+// messages after it are consumed meanwhile. Messages are consumed one at a time, so no offset is committed past an unsettled
+// message.
+
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/secrets"
+)
+
+// Headers the message properties without a Kafka equivalent are kept in
+const (
+	kafkaContentTypeHeader = "content-type"
+	kafkaPriorityHeader    = "priority"
+)
+
+// kafkaRetryGroupSuffix is appended to KAFKA_CONSUMER_GROUP to name the consumer group of the retry topics
+const kafkaRetryGroupSuffix = "-retry"
+
+// KafkaBroker exchanges messages through a Kafka cluster
+type KafkaBroker struct {
+	brokers  []string
+	dialer   *kafka.Dialer
+	writer   *kafka.Writer
+	topology Topology
+	config   *config.Config
+	logger   *log.Logger
+	// connected is set by the outcome of the last request to the cluster
+	connected atomic.Bool
+}
+
+// NewKafkaBroker connects to the Kafka cluster of the given bootstrap brokers and creates the topics of the topology. The
+// KAFKA_USERNAME and KAFKA_PASSWORD secrets are used for SASL/PLAIN authentication if the secrets provider has them.
+func NewKafkaBroker(ctx context.Context, brokers []string, secretsProvider secrets.Provider, topology Topology, cfg *config.Config, logger *log.Logger) (*KafkaBroker, error) {
+	username, err := optionalSecret(ctx, secretsProvider, secrets.KafkaUsername)
+	if err != nil {
+		return nil, err
+	}
+	password, err := optionalSecret(ctx, secretsProvider, secrets.KafkaPassword)
+	if err != nil {
+		return nil, err
+	}
+	var mechanism sasl.Mechanism
+	if username != "" {
+		mechanism = plain.Mechanism{Username: username, Password: password}
+	}
+
+	logger.Info("Connecting to Kafka...")
+	transport := &kafka.Transport{SASL: mechanism, ClientID: cfg.InstanceID}
+	b := &KafkaBroker{
+		brokers: brokers,
+		dialer:  &kafka.Dialer{Timeout: 10 * time.Second, DualStack: true, SASLMechanism: mechanism, ClientID: cfg.InstanceID},
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			BatchTimeout: 10 * time.Millisecond,
+			WriteTimeout: cfg.PublishConfirmTimeout,
+			Transport:    transport,
+		},
+		topology: topology,
+		config:   cfg,
+		logger:   logger,
+	}
+
+	client := &kafka.Client{Addr: kafka.TCP(brokers...), Transport: transport, Timeout: 10 * time.Second}
+	if err := b.createTopics(ctx, client); err != nil {
+		b.writer.Close()
+		return nil, err
+	}
+	b.connected.Store(true)
+	return b, nil
+}
+
+// createTopics creates the topics of the queues and topics of the topology that do not exist yet.
+func (b *KafkaBroker) createTopics(ctx context.Context, client *kafka.Client) error {
+	var topics []kafka.TopicConfig
+	for _, queue := range slices.Concat(b.topology.Queues, b.topology.Topics) {
+		topics = append(topics, kafkaTopic(queue.Name, queue.MessageTTL))
+		if queue.Delayed {
+			topics = append(topics, kafkaTopic(retryQueue(queue.Name), queue.MessageTTL))
+		}
+	}
+
+	resp, err := client.CreateTopics(ctx, &kafka.CreateTopicsRequest{Topics: topics})
+	if err != nil {
+		return fmt.Errorf("failed to connect to Kafka: %v", err)
+	}
+	for topic, err := range resp.Errors {
+		if err != nil && !errors.Is(err, kafka.TopicAlreadyExists) {
+			return fmt.Errorf("failed to create topic %s: %v", topic, err)
+		}
+	}
+	return nil
+}
+
+// kafkaTopic returns the config of the topic with the given name and message TTL.
+func kafkaTopic(name string, messageTTL time.Duration) kafka.TopicConfig {
+	topic := kafka.TopicConfig{Topic: name, NumPartitions: -1, ReplicationFactor: -1}
+	if messageTTL > 0 {
+		topic.ConfigEntries = []kafka.ConfigEntry{{
+			ConfigName:  "retention.ms",
+			ConfigValue: strconv.FormatInt(messageTTL.Milliseconds(), 10),
+		}}
+	}
+	return topic
+}
+
+// Publish writes a message to the topic of the given queue, and waits for every in-sync replica to acknowledge it.
+func (b *KafkaBroker) Publish(ctx context.Context, queue string, msg Message) error {
+	kafkaMsg := kafka.Message{Topic: queue, Value: msg.Body}
+	if msg.ID != "" {
+		kafkaMsg.Key = []byte(msg.ID)
+	}
+	for key, value := range msg.Headers {
+		kafkaMsg.Headers = append(kafkaMsg.Headers, kafka.Header{Key: key, Value: []byte(fmt.Sprint(value))})
+	}
+	if msg.ContentType != "" {
+		kafkaMsg.Headers = append(kafkaMsg.Headers, kafka.Header{Key: kafkaContentTypeHeader, Value: []byte(msg.ContentType)})
+	}
+	if msg.Priority > 0 {
+		kafkaMsg.Headers = append(kafkaMsg.Headers, kafka.Header{Key: kafkaPriorityHeader, Value: []byte(strconv.Itoa(int(msg.Priority)))})
+	}
+
+	err := b.writer.WriteMessages(ctx, kafkaMsg)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		b.connected.Store(false)
+		return fmt.Errorf("%w: %v", ErrNotConfirmed, err)
+	}
+	b.connected.Store(true)
+	return nil
+}
+
+// PublishDelayed writes a message to the retry topic of the given queue, which forwards it to the queue once the delay passed.
+func (b *KafkaBroker) PublishDelayed(ctx context.Context, queue string, msg Message, delay time.Duration) error {
+	return b.Publish(ctx, retryQueue(queue), withNotBefore(msg, delay))
+}
+
+// Broadcast writes a message to the given topic, which every subscriber consumes in a consumer group of its own.
+func (b *KafkaBroker) Broadcast(ctx context.Context, topic string, msg Message) error {
+	return b.Publish(ctx, topic, msg)
+}
+
+// Consume consumes the topic of the given queue in the KAFKA_CONSUMER_GROUP consumer group, one message at a time.
+// The retry topic of a Delayed queue is forwarded to it as long as the subscription lasts, so consuming the queue again
+// after the subscription ended never leaves a second forwarder running.
+func (b *KafkaBroker) Consume(ctx context.Context, queue string) (*Subscription, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	forwarding := make(chan struct{})
+	if slices.ContainsFunc(b.topology.Queues, func(q QueueConfig) bool { return q.Name == queue && q.Delayed }) {
+		go func() {
+			defer close(forwarding)
+			b.forwardDelayed(ctx, queue)
+		}()
+	} else {
+		close(forwarding)
+	}
+
+	sub := newSubscription()
+	go func() {
+		err := b.consume(ctx, queue, sub)
+		cancelled := ctx.Err() != nil
+		cancel()
+		<-forwarding
+		if cancelled {
+			sub.close(nil)
+			return
+		}
+		b.connected.Store(false)
+		sub.close(err)
+	}()
+	return sub, nil
+}
+
+// consume consumes the topic of the given queue, until consumption fails or a message nacked for requeueing can not be
+// written again. The message is then consumed again from the last committed offset once the queue is consumed again.
+func (b *KafkaBroker) consume(ctx context.Context, queue string, sub *Subscription) error {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: b.brokers,
+		GroupID: b.config.KafkaConsumerGroup,
+		Topic:   queue,
+		Dialer:  b.dialer,
+		MaxWait: time.Second,
+	})
+	defer reader.Close()
+
+	for {
+		msg, err := reader.FetchMessage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to fetch message: %v", err)
+		}
+		b.connected.Store(true)
+
+		delivery, settled := b.delivery(ctx, reader, msg)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case sub.deliveries <- delivery:
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-settled:
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// forwardDelayed forwards the messages of the retry topic of the given queue to the queue once they are due, until the
+// context of the subscription of the queue is cancelled. Forwarding is restarted after a backoff if it fails.
+func (b *KafkaBroker) forwardDelayed(ctx context.Context, queue string) {
+	var backoff Backoff
+	for {
+		err := b.forwardDue(ctx, queue, &backoff)
+		if ctx.Err() != nil {
+			return
+		}
+		b.logger.Errorf("Failed to forward delayed messages of %s: %v", queue, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff.Next()):
+		}
+	}
+}
+
+// forwardDue forwards the messages of the retry topic of the given queue in order, each once it is due. A message is committed
+// once it was written to the queue, so a message forwarded right before a failure is forwarded again, and processed as a
+// duplicate delivery by the consumer.
+func (b *KafkaBroker) forwardDue(ctx context.Context, queue string, backoff *Backoff) error {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: b.brokers,
+		GroupID: b.config.KafkaConsumerGroup + kafkaRetryGroupSuffix,
+		Topic:   retryQueue(queue),
+		Dialer:  b.dialer,
+		MaxWait: time.Second,
+	})
+	defer reader.Close()
+
+	for {
+		msg, err := reader.FetchMessage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to fetch message: %v", err)
+		}
+		backoff.Reset()
+
+		var due time.Time
+		headers := make([]kafka.Header, 0, len(msg.Headers))
+		for _, header := range msg.Headers {
+			if header.Key == notBeforeHeader {
+				due = notBefore(map[string]interface{}{notBeforeHeader: string(header.Value)})
+				continue
+			}
+			headers = append(headers, header)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Until(due)):
+		}
+
+		err = b.writer.WriteMessages(ctx, kafka.Message{Topic: queue, Key: msg.Key, Value: msg.Value, Headers: headers})
+		if err != nil {
+			b.connected.Store(false)
+			return fmt.Errorf("failed to forward message: %v", err)
+		}
+		if err := reader.CommitMessages(ctx, msg); err != nil {
+			return fmt.Errorf("failed to commit message: %v", err)
+		}
+	}
+}
+
+// delivery returns the delivery of the given Kafka message. Once it is settled, the error writing it again if it was nacked
+// for requeueing is sent on the returned channel, nil otherwise.
+func (b *KafkaBroker) delivery(ctx context.Context, reader *kafka.Reader, msg kafka.Message) (Delivery, <-chan error) {
+	settled := make(chan error, 1)
+	delivery := Delivery{
+		Message: Message{
+			ID:      string(msg.Key),
+			Headers: make(map[string]interface{}, len(msg.Headers)),
+			Body:    msg.Value,
+		},
+		ack: func() error {
+			err := reader.CommitMessages(ctx, msg)
+			settled <- nil
+			return err
+		},
+		nack: func(requeue bool) error {
+			if !requeue {
+				err := reader.CommitMessages(ctx, msg)
+				settled <- nil
+				return err
+			}
+			err := b.requeue(ctx, reader, msg)
+			settled <- err
+			return err
+		},
+	}
+	for _, header := range msg.Headers {
+		switch header.Key {
+		case kafkaContentTypeHeader:
+			delivery.ContentType = string(header.Value)
+		case kafkaPriorityHeader:
+			if priority, err := strconv.ParseUint(string(header.Value), 10, 8); err == nil {
+				delivery.Priority = uint8(priority)
+			}
+		default:
+			delivery.Headers[header.Key] = string(header.Value)
+		}
+	}
+	return delivery, settled
+}
+
+// requeue writes the given message, consumed by the given reader, again to the end of its topic, then commits it.
+// A message committed after a failure is consumed twice, and processed as a duplicate delivery by the consumer.
+func (b *KafkaBroker) requeue(ctx context.Context, reader *kafka.Reader, msg kafka.Message) error {
+	err := b.writer.WriteMessages(ctx, kafka.Message{Topic: msg.Topic, Key: msg.Key, Value: msg.Value, Headers: msg.Headers})
+	if err != nil {
+		b.connected.Store(false)
+		return fmt.Errorf("failed to requeue message: %v", err)
+	}
+	if err := reader.CommitMessages(ctx, msg); err != nil {
+		return fmt.Errorf("failed to commit requeued message: %v", err)
+	}
+	return nil
+}
+
+// Connected returns whether the last request to the cluster succeeded.
+func (b *KafkaBroker) Connected() bool {
+	return b.connected.Load()
+}
+
+// Close flushes and closes the writer.
+func (b *KafkaBroker) Close() error {
+	return b.writer.Close()
+}
+
+// Backend returns the name of the backend.
+func (b *KafkaBroker) Backend() string {
+	return BackendKafka
+}
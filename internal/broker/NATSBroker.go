@@ -0,0 +1,274 @@
+// This file contains the NATS JetStream backend of the broker.
+//
+// Every queue is a work queue stream of the same name (dots replaced, i.e 'nerf-in.canary' is the 'nerf-in_canary' stream),
+// whose subject is the queue name, so workers publish to the queue name as with RabbitMQ. The web server consumes its queues
+// with a durable consumer each. Topics are limits streams, every subscriber (worker) creates a consumer of its own on them.
+// Streams are stored on disk. Reconnections are handled by the NATS client, which buffers publications in the meantime.
+
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/secrets"
+)
+
+// Headers the message properties without a NATS equivalent are kept in
+const (
+	natsMessageIDHeader   = "Message-Id"
+	natsContentTypeHeader = "Content-Type"
+)
+
+// NATSBroker exchanges messages through a NATS server with JetStream enabled
+type NATSBroker struct {
+	conn     *nats.Conn
+	js       jetstream.JetStream
+	topology Topology
+	config   *config.Config
+	logger   *log.Logger
+}
+
+// streamName returns the name of the stream of the given queue or topic, stream names can not contain dots.
+func streamName(queueName string) string {
+	return strings.ReplaceAll(queueName, ".", "_")
+}
+
+// NewNATSBroker connects to the NATS server at the given URL and creates the streams of the topology. The NATS_USER and
+// NATS_PASSWORD secrets are used if the secrets provider has them.
+func NewNATSBroker(ctx context.Context, url string, secretsProvider secrets.Provider, topology Topology, cfg *config.Config, logger *log.Logger) (*NATSBroker, error) {
+	username, err := optionalSecret(ctx, secretsProvider, secrets.NATSUsername)
+	if err != nil {
+		return nil, err
+	}
+	password, err := optionalSecret(ctx, secretsProvider, secrets.NATSPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("Connecting to NATS...")
+	opts := []nats.Option{
+		nats.Name(cfg.InstanceID),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				logger.Errorf("NATS connection lost: %v", err)
+			}
+		}),
+		nats.ReconnectHandler(func(_ *nats.Conn) {
+			logger.Info("Reconnected to NATS")
+		}),
+	}
+	if username != "" {
+		opts = append(opts, nats.UserInfo(username, password))
+	}
+	conn, err := nats.Connect(url, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %v", err)
+	}
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create JetStream context: %v", err)
+	}
+
+	b := &NATSBroker{
+		conn:     conn,
+		js:       js,
+		topology: topology,
+		config:   cfg,
+		logger:   logger,
+	}
+	if err := b.createStreams(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// createStreams creates (or updates) the work queue streams of the queues, and the limits streams of the topics of the topology.
+func (b *NATSBroker) createStreams(ctx context.Context) error {
+	create := func(queue QueueConfig, retention jetstream.RetentionPolicy) error {
+		_, err := b.js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+			Name:      streamName(queue.Name),
+			Subjects:  []string{queue.Name},
+			Retention: retention,
+			Storage:   jetstream.FileStorage,
+			MaxAge:    queue.MessageTTL,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create stream %s: %v", streamName(queue.Name), err)
+		}
+		return nil
+	}
+
+	for _, queue := range b.topology.Queues {
+		if err := create(queue, jetstream.WorkQueuePolicy); err != nil {
+			return err
+		}
+	}
+	for _, topic := range b.topology.Topics {
+		if err := create(topic, jetstream.LimitsPolicy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Publish publishes a message to the subject of the given queue, and waits for JetStream to acknowledge it.
+func (b *NATSBroker) Publish(ctx context.Context, queue string, msg Message) error {
+	natsMsg := nats.NewMsg(queue)
+	natsMsg.Data = msg.Body
+	for key, value := range msg.Headers {
+		natsMsg.Header.Set(key, fmt.Sprint(value))
+	}
+	if msg.ID != "" {
+		natsMsg.Header.Set(natsMessageIDHeader, msg.ID)
+	}
+	if msg.ContentType != "" {
+		natsMsg.Header.Set(natsContentTypeHeader, msg.ContentType)
+	}
+
+	publishCtx, cancel := context.WithTimeout(ctx, b.config.PublishConfirmTimeout)
+	defer cancel()
+	_, err := b.js.PublishMsg(publishCtx, natsMsg)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w within %s", ErrNotConfirmed, b.config.PublishConfirmTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNotConfirmed, err)
+	}
+	return nil
+}
+
+// PublishDelayed publishes a message to the given queue straight away. The consumer negatively acknowledges it with the
+// remaining delay if it is consumed before the delay passed.
+func (b *NATSBroker) PublishDelayed(ctx context.Context, queue string, msg Message, delay time.Duration) error {
+	return b.Publish(ctx, queue, withNotBefore(msg, delay))
+}
+
+// Broadcast publishes a message to the stream of the given topic, which every subscriber consumes.
+func (b *NATSBroker) Broadcast(ctx context.Context, topic string, msg Message) error {
+	return b.Publish(ctx, topic, msg)
+}
+
+// Consume consumes the stream of the given queue with the durable consumer of the queue. Messages that are not acked within
+// an hour are delivered again.
+func (b *NATSBroker) Consume(ctx context.Context, queue string) (*Subscription, error) {
+	consumer, err := b.js.CreateOrUpdateConsumer(ctx, streamName(queue), jetstream.ConsumerConfig{
+		Durable:   streamName(queue),
+		AckPolicy: jetstream.AckExplicitPolicy,
+		AckWait:   consumerTimeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a consumer: %v", err)
+	}
+	messages, err := consumer.Messages(jetstream.PullMaxMessages(1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to register a consumer: %v", err)
+	}
+
+	sub := newSubscription()
+	go func() {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				messages.Stop()
+			case <-done:
+			}
+		}()
+
+		for {
+			msg, err := messages.Next()
+			if err != nil {
+				messages.Stop()
+				if ctx.Err() != nil {
+					sub.close(nil)
+				} else {
+					sub.close(fmt.Errorf("consumer stopped: %v", err))
+				}
+				return
+			}
+
+			delivery := b.delivery(msg)
+			if delay := time.Until(notBefore(delivery.Headers)); delay > 0 {
+				// Redelivered after AckWait if the negative acknowledgement is lost
+				if err := msg.NakWithDelay(delay); err != nil {
+					b.logger.Warnf("Failed to delay message of %s: %v", queue, err)
+				}
+				continue
+			}
+			delete(delivery.Headers, notBeforeHeader)
+
+			select {
+			case <-ctx.Done():
+				// Not acked, so JetStream delivers it again
+				messages.Stop()
+				sub.close(nil)
+				return
+			case sub.deliveries <- delivery:
+			}
+		}
+	}()
+	return sub, nil
+}
+
+// delivery returns the delivery of the given JetStream message.
+func (b *NATSBroker) delivery(msg jetstream.Msg) Delivery {
+	headers := make(map[string]interface{}, len(msg.Headers()))
+	for key := range msg.Headers() {
+		if key != natsMessageIDHeader && key != natsContentTypeHeader {
+			headers[key] = msg.Headers().Get(key)
+		}
+	}
+	redelivered := false
+	if metadata, err := msg.Metadata(); err == nil {
+		redelivered = metadata.NumDelivered > 1
+	}
+
+	return Delivery{
+		Message: Message{
+			ID:          msg.Headers().Get(natsMessageIDHeader),
+			ContentType: msg.Headers().Get(natsContentTypeHeader),
+			Headers:     headers,
+			Body:        msg.Data(),
+		},
+		Redelivered: redelivered,
+		ack:         msg.Ack,
+		nack: func(requeue bool) error {
+			if requeue {
+				return msg.Nak()
+			}
+			return msg.Term()
+		},
+	}
+}
+
+// Connected returns whether the connection to the NATS server is up.
+func (b *NATSBroker) Connected() bool {
+	return b.conn.IsConnected()
+}
+
+// Close closes the connection to the NATS server.
+func (b *NATSBroker) Close() error {
+	b.conn.Close()
+	return nil
+}
+
+// Backend returns the name of the backend.
+func (b *NATSBroker) Backend() string {
+	return BackendNATS
+}
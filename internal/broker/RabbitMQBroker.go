@@ -0,0 +1,421 @@
+// This file contains the RabbitMQ (AMQP 0.9.1) backend of the broker.
+//
+// Connection and channel failures are recovered at the level they occurred: the broker notifies closed channels and connections,
+// and a closed channel is reopened on the existing connection, while only a closed connection is redialed. Queues are redeclared on
+// every new channel. Recovery attempts are spaced by a jittered exponential backoff, so a single channel error only briefly pauses
+// publishing. Every consumer has a channel of its own, and consumption ends when it closes.
+
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/secrets"
+)
+
+// RabbitMQBroker exchanges messages through a RabbitMQ broker
+type RabbitMQBroker struct {
+	domain     string
+	secrets    secrets.Provider
+	topology   Topology
+	config     *config.Config
+	logger     *log.Logger
+	connection *amqp.Connection
+	channel    *amqp.Channel
+	// mu guards connection and channel, which are replaced on recovery. reconnectMu serializes recoveries.
+	mu          sync.RWMutex
+	reconnectMu sync.Mutex
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+// NewRabbitMQBroker connects to the RabbitMQ broker on the given domain, opens the publishing channel and declares the topology.
+func NewRabbitMQBroker(ctx context.Context, domain string, secretsProvider secrets.Provider, topology Topology, cfg *config.Config, logger *log.Logger) (*RabbitMQBroker, error) {
+	b := &RabbitMQBroker{
+		domain:   domain,
+		secrets:  secretsProvider,
+		topology: topology,
+		config:   cfg,
+		logger:   logger,
+		closed:   make(chan struct{}),
+	}
+	if err := b.ensureConnection(ctx); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// connect establishes a connection to the broker, opens the publishing channel and declares the topology.
+// The caller must hold reconnectMu.
+//
+// Credentials are read from the secrets provider on every connect, so rotated credentials are used on reconnection.
+func (b *RabbitMQBroker) connect(ctx context.Context) error {
+	b.logger.Info("Connecting to RabbitMQ...")
+	timeout := time.Now().Add(time.Minute / 4)
+
+	username, err := b.secrets.GetSecret(ctx, secrets.RabbitMQUsername)
+	if err != nil {
+		return fmt.Errorf("failed to get RabbitMQ username: %v", err)
+	}
+	password, err := b.secrets.GetSecret(ctx, secrets.RabbitMQPassword)
+	if err != nil {
+		return fmt.Errorf("failed to get RabbitMQ password: %v", err)
+	}
+
+	var connection *amqp.Connection
+	for time.Now().Before(timeout) && ctx.Err() == nil {
+		connection, err = amqp.Dial(fmt.Sprintf("amqp://%s:%s@%s:5672/",
+			url.QueryEscape(username),
+			url.QueryEscape(password),
+			b.domain))
+		if err == nil {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+
+	if connection == nil {
+		if err == nil {
+			err = ctx.Err()
+		}
+		return fmt.Errorf("failed to connect to RabbitMQ: %v", err)
+	}
+
+	b.mu.Lock()
+	b.connection = connection
+	b.mu.Unlock()
+	go b.watchConnection(connection)
+
+	return b.openChannel(connection)
+}
+
+// openChannel opens the publishing channel on the given connection in confirm mode, and (re)declares the topology, so queues
+// deleted on the broker are recreated. The caller must hold reconnectMu.
+func (b *RabbitMQBroker) openChannel(connection *amqp.Connection) error {
+	channel, err := connection.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open a channel: %v", err)
+	}
+	if err := channel.Confirm(false); err != nil {
+		channel.Close()
+		return fmt.Errorf("failed to enable publisher confirms: %v", err)
+	}
+	if err := b.declareTopology(channel); err != nil {
+		channel.Close()
+		return err
+	}
+
+	b.mu.Lock()
+	b.channel = channel
+	b.mu.Unlock()
+	go b.watchChannel(channel)
+	return nil
+}
+
+// declareTopology declares the topics of the topology as fanout exchanges, and its queues, durable and / or lazy as configured,
+// with the retry queues of its Delayed queues. Declaring is idempotent, so it is safe on every (re)opened channel.
+func (b *RabbitMQBroker) declareTopology(channel *amqp.Channel) error {
+	var amqpErr *amqp.Error
+	for _, topic := range b.topology.Topics {
+		err := channel.ExchangeDeclare(topic.Name, amqp.ExchangeFanout, b.config.AMQPDurableQueues, false, false, false, nil)
+		if errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed {
+			return fmt.Errorf("exchange %s already exists with different settings, delete it to apply AMQP_DURABLE_QUEUES: %v", topic.Name, err)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to declare exchange %s: %v", topic.Name, err)
+		}
+	}
+
+	for _, queue := range b.topology.Queues {
+		args := amqp.Table{
+			"x-consumer-timeout": int64(consumerTimeout.Milliseconds()),
+		}
+		if queue.MessageTTL > 0 {
+			args["x-message-ttl"] = int64(queue.MessageTTL.Milliseconds())
+		}
+		if b.config.AMQPPriorityQueues && queue.MaxPriority > 0 {
+			args["x-max-priority"] = int64(queue.MaxPriority)
+		}
+		if err := b.declareQueue(channel, queue.Name, args); err != nil {
+			return err
+		}
+
+		if queue.Delayed {
+			// Retry queues are not consumed, expired messages go back to their queue
+			err := b.declareQueue(channel, retryQueue(queue.Name), amqp.Table{
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": queue.Name,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// declareQueue declares the queue with the given name and arguments, lazy if configured.
+func (b *RabbitMQBroker) declareQueue(channel *amqp.Channel, name string, args amqp.Table) error {
+	if b.config.AMQPLazyQueues {
+		args["x-queue-mode"] = "lazy"
+	}
+	_, err := channel.QueueDeclare(name, b.config.AMQPDurableQueues, false, false, false, args)
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed {
+		return fmt.Errorf("queue %s already exists with different settings, delete it once drained to apply "+
+			"AMQP_DURABLE_QUEUES / AMQP_LAZY_QUEUES / AMQP_PRIORITY_QUEUES: %v", name, err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to declare queue %s: %v", name, err)
+	}
+	return nil
+}
+
+// deliveryMode returns the delivery mode messages are published with, persistent unless disabled.
+func (b *RabbitMQBroker) deliveryMode() uint8 {
+	if b.config.AMQPPersistentMessages {
+		return amqp.Persistent
+	}
+	return amqp.Transient
+}
+
+// watchConnection recovers the connection once the broker closes it unexpectedly, retrying with jittered backoff.
+// Closing the connection on Close ends the watch.
+func (b *RabbitMQBroker) watchConnection(connection *amqp.Connection) {
+	amqpErr, ok := <-connection.NotifyClose(make(chan *amqp.Error, 1))
+	if !ok || amqpErr == nil {
+		return
+	}
+	b.logger.Errorf("RabbitMQ connection closed: %v", amqpErr)
+	b.recover()
+}
+
+// watchChannel reopens the publishing channel once the broker closes it (i.e after a channel-level error), without
+// reconnecting as long as the connection is still open.
+func (b *RabbitMQBroker) watchChannel(channel *amqp.Channel) {
+	amqpErr, ok := <-channel.NotifyClose(make(chan *amqp.Error, 1))
+	if !ok || amqpErr == nil {
+		return
+	}
+	b.logger.Errorf("RabbitMQ publishing channel closed: %v", amqpErr)
+	b.recover()
+}
+
+// recover calls ensureConnection until the connection and publishing channel are open again, or the broker is closed.
+func (b *RabbitMQBroker) recover() {
+	var backoff Backoff
+	for {
+		err := b.ensureConnection(context.Background())
+		if err == nil {
+			return
+		}
+		b.logger.Errorf("Failed to recover RabbitMQ connection: %v", err)
+		select {
+		case <-b.closed:
+			return
+		case <-time.After(backoff.Next()):
+		}
+	}
+}
+
+// ensureConnection ensures that the connection and publishing channel are open. If only the channel was closed,
+// it is reopened on the existing connection. Concurrent callers wait for a single recovery.
+func (b *RabbitMQBroker) ensureConnection(ctx context.Context) error {
+	b.reconnectMu.Lock()
+	defer b.reconnectMu.Unlock()
+
+	select {
+	case <-b.closed:
+		return errors.New("broker connection closed")
+	default:
+	}
+
+	b.mu.RLock()
+	connection, channel := b.connection, b.channel
+	b.mu.RUnlock()
+
+	if connection != nil && !connection.IsClosed() {
+		if channel != nil && !channel.IsClosed() {
+			return nil
+		}
+		b.logger.Info("Reopening RabbitMQ publishing channel...")
+		return b.openChannel(connection)
+	}
+
+	if connection != nil {
+		b.logger.Info("Reconnecting to RabbitMQ...")
+	}
+	return b.connect(ctx)
+}
+
+// Publish publishes a message to the given queue on the publishing channel, recovering the channel (or connection) first
+// if it was closed, and waits for the broker to confirm it.
+func (b *RabbitMQBroker) Publish(ctx context.Context, queue string, msg Message) error {
+	return b.publish(ctx, "", queue, b.publishing(msg))
+}
+
+// PublishDelayed publishes a message to the retry queue of the given queue, which it expires from after the delay.
+// Messages only expire at the head of their retry queue, so a message may wait for the longer delay of one queued before it.
+func (b *RabbitMQBroker) PublishDelayed(ctx context.Context, queue string, msg Message, delay time.Duration) error {
+	publishing := b.publishing(msg)
+	publishing.Expiration = fmt.Sprint(delay.Milliseconds())
+	return b.publish(ctx, "", retryQueue(queue), publishing)
+}
+
+// Broadcast publishes a message to the fanout exchange of the given topic, expiring after the message TTL of the topic.
+func (b *RabbitMQBroker) Broadcast(ctx context.Context, topic string, msg Message) error {
+	publishing := b.publishing(msg)
+	for _, t := range b.topology.Topics {
+		if t.Name == topic && t.MessageTTL > 0 {
+			publishing.Expiration = fmt.Sprint(t.MessageTTL.Milliseconds())
+		}
+	}
+	return b.publish(ctx, topic, "", publishing)
+}
+
+// publishing returns the AMQP publishing of the given message.
+func (b *RabbitMQBroker) publishing(msg Message) amqp.Publishing {
+	var headers amqp.Table
+	if len(msg.Headers) > 0 {
+		headers = amqp.Table(msg.Headers)
+	}
+	return amqp.Publishing{
+		MessageId:    msg.ID,
+		ContentType:  msg.ContentType,
+		DeliveryMode: b.deliveryMode(),
+		Priority:     msg.Priority,
+		Headers:      headers,
+		Body:         msg.Body,
+	}
+}
+
+// publish publishes a message once on the publishing channel, and waits for the broker to confirm it.
+func (b *RabbitMQBroker) publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	if err := b.ensureConnection(ctx); err != nil {
+		return err
+	}
+
+	b.mu.RLock()
+	channel := b.channel
+	b.mu.RUnlock()
+	confirmation, err := channel.PublishWithDeferredConfirmWithContext(ctx, exchange, key, false, false, msg)
+	if err != nil {
+		return err
+	}
+
+	// The confirmation is nacked if the channel closes in the meantime
+	waitCtx, cancel := context.WithTimeout(ctx, b.config.PublishConfirmTimeout)
+	defer cancel()
+	acked, err := confirmation.WaitContext(waitCtx)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("%w within %s", ErrNotConfirmed, b.config.PublishConfirmTimeout)
+	}
+	if !acked {
+		return fmt.Errorf("%w: nacked by the broker", ErrNotConfirmed)
+	}
+	return nil
+}
+
+// Consume consumes the given queue on a channel of its own, closed when the context is cancelled, which requeues any
+// unacked messages.
+func (b *RabbitMQBroker) Consume(ctx context.Context, queue string) (*Subscription, error) {
+	if err := b.ensureConnection(ctx); err != nil {
+		return nil, fmt.Errorf("failed to ensure connection: %v", err)
+	}
+
+	b.mu.RLock()
+	connection := b.connection
+	b.mu.RUnlock()
+	ch, err := connection.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open a channel: %v", err)
+	}
+	if err := b.declareTopology(ch); err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	messages, err := ch.Consume(
+		queue, "", false, false, false, false, nil,
+	)
+	if err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("failed to register a consumer: %v", err)
+	}
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	sub := newSubscription()
+	go func() {
+		// Closing the channel ends the range below
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				ch.Close()
+			case <-done:
+			}
+		}()
+
+		for msg := range messages {
+			sub.deliveries <- Delivery{
+				Message: Message{
+					ID:          msg.MessageId,
+					ContentType: msg.ContentType,
+					Headers:     msg.Headers,
+					Body:        msg.Body,
+					Priority:    msg.Priority,
+				},
+				Redelivered: msg.Redelivered,
+				ack:         func() error { return msg.Ack(false) },
+				nack:        func(requeue bool) error { return msg.Nack(false, requeue) },
+			}
+		}
+
+		if ctx.Err() != nil {
+			sub.close(nil)
+		} else if amqpErr, ok := <-closed; ok && amqpErr != nil {
+			sub.close(fmt.Errorf("consumer channel closed: %v", amqpErr))
+		} else {
+			sub.close(errors.New("consumer channel closed"))
+		}
+	}()
+	return sub, nil
+}
+
+// Connected returns whether the connection to the broker is open.
+func (b *RabbitMQBroker) Connected() bool {
+	b.mu.RLock()
+	connection := b.connection
+	b.mu.RUnlock()
+	return connection != nil && !connection.IsClosed()
+}
+
+// Close closes the connection to the broker, and stops recovering it.
+func (b *RabbitMQBroker) Close() error {
+	b.closeOnce.Do(func() { close(b.closed) })
+	b.mu.RLock()
+	connection := b.connection
+	b.mu.RUnlock()
+	if connection != nil && !connection.IsClosed() {
+		return connection.Close()
+	}
+	return nil
+}
+
+// Backend returns the name of the backend.
+func (b *RabbitMQBroker) Backend() string {
+	return BackendRabbitMQ
+}
@@ -0,0 +1,23 @@
+// Package broker contains the message broker abstraction the AMPQService exchanges jobs, worker output, heartbeats and
+// control messages with the workers through.
+//
+// Workers and the web server only rely on queues (each message is consumed once, and acked once processed), delayed
+// publishing (retries of worker output), and topics (each message is delivered to every subscriber, i.e every worker).
+// Every backend maps these onto its own primitives, and creates the queues and topics of the Topology on connect.
+//
+// Current backends include:
+//   - RabbitMQBroker:
+//     Queues are AMQP queues, topics fanout exchanges. Delayed messages wait in the retry queue of their queue (i.e
+//     'sfm-out.retry') until they expire, and are dead-lettered back to their queue. Only RabbitMQ honours job priorities.
+//   - NATSBroker:
+//     Queues are JetStream work queue streams consumed by a durable consumer, topics are streams every worker creates a
+//     consumer of its own on. Delayed messages are published straight away, and negatively acked with the remaining delay
+//     when consumed early.
+//   - KafkaBroker:
+//     Queues are topics consumed by a consumer group, topics are topics every worker consumes with a group of its own.
+//     Offsets are committed once a message is acked, and a message nacked for requeueing restarts the consumer from the
+//     last committed offset. Delayed messages wait in the retry topic of their queue (i.e 'sfm-out.retry'), which is
+//     forwarded to the queue as its messages are due.
+//
+// Every backend confirms published messages: Publish only returns once the broker stored the message.
+package broker
@@ -0,0 +1,134 @@
+// This file contains the Branding of tenants, which lets differently branded frontends be backed by the same server.
+//
+// Brandings are read at startup from the JSON file BRANDING_FILE, an object of brandings by tenant, where the "default"
+// entry is the branding of the default tenant and the fallback of every field other tenants leave empty:
+//
+//	{
+//	    "default": {
+//	        "name": "NeRF or Nothing",
+//	        "logo_url": "https://cdn.example.com/logo.svg",
+//	        "primary_color": "#1f6feb",
+//	        "terms_url": "https://example.com/terms",
+//	        "features": {"gallery": true}
+//	    },
+//	    "section-a": {"name": "CS 101 - Section A", "features": {"gallery": false}}
+//	}
+//
+// Feature toggles are free-form flags for the frontend, merged key by key with those of the default entry.
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// DefaultBrandingKey is the key of the branding of the default tenant in BRANDING_FILE
+const DefaultBrandingKey = "default"
+
+// Branding represents the names, logos, legal links and feature toggles a frontend is branded with
+type Branding struct {
+	Name         string          `json:"name,omitempty"`
+	LogoURL      string          `json:"logo_url,omitempty"`
+	FaviconURL   string          `json:"favicon_url,omitempty"`
+	PrimaryColor string          `json:"primary_color,omitempty"`
+	SupportEmail string          `json:"support_email,omitempty"`
+	TermsURL     string          `json:"terms_url,omitempty"`
+	PrivacyURL   string          `json:"privacy_url,omitempty"`
+	ImprintURL   string          `json:"imprint_url,omitempty"`
+	Features     map[string]bool `json:"features,omitempty"`
+}
+
+// colorPattern matches hex colors, i.e "#1f6feb"
+var colorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// BrandingFor returns the branding of the given tenant, with the fields it leaves empty taken from the default branding.
+// Tenants without a branding get the default branding, which is empty if BRANDING_FILE is not set.
+func (c *Config) BrandingFor(tenant string) Branding {
+	base := c.brandings[DefaultBrandingKey]
+	own := Branding{}
+	if tenant != "" {
+		own = c.brandings[tenant]
+	}
+
+	branding := own
+	branding.merge(base)
+	branding.Features = make(map[string]bool)
+	for key, enabled := range base.Features {
+		branding.Features[key] = enabled
+	}
+	for key, enabled := range own.Features {
+		branding.Features[key] = enabled
+	}
+	return branding
+}
+
+// merge fills the empty fields of b with those of other. Feature toggles are left unchanged.
+func (b *Branding) merge(other Branding) {
+	fill := func(field *string, value string) {
+		if *field == "" {
+			*field = value
+		}
+	}
+	fill(&b.Name, other.Name)
+	fill(&b.LogoURL, other.LogoURL)
+	fill(&b.FaviconURL, other.FaviconURL)
+	fill(&b.PrimaryColor, other.PrimaryColor)
+	fill(&b.SupportEmail, other.SupportEmail)
+	fill(&b.TermsURL, other.TermsURL)
+	fill(&b.PrivacyURL, other.PrivacyURL)
+	fill(&b.ImprintURL, other.ImprintURL)
+}
+
+// validate checks that the links of the branding are http(s) URLs or absolute paths, and that its color is a hex color.
+func (b *Branding) validate() error {
+	links := map[string]string{
+		"logo_url":    b.LogoURL,
+		"favicon_url": b.FaviconURL,
+		"terms_url":   b.TermsURL,
+		"privacy_url": b.PrivacyURL,
+		"imprint_url": b.ImprintURL,
+	}
+	for field, link := range links {
+		if link == "" {
+			continue
+		}
+		u, err := url.Parse(link)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %v", field, link, err)
+		}
+		absolutePath := u.Scheme == "" && u.Host == "" && strings.HasPrefix(u.Path, "/")
+		if u.Scheme != "http" && u.Scheme != "https" && !absolutePath {
+			return fmt.Errorf("invalid %s %q: expected an http(s) URL or an absolute path", field, link)
+		}
+	}
+	if b.PrimaryColor != "" && !colorPattern.MatchString(b.PrimaryColor) {
+		return fmt.Errorf("invalid primary_color %q: expected a hex color, i.e \"#1f6feb\"", b.PrimaryColor)
+	}
+	return nil
+}
+
+// loadBrandings reads the brandings by tenant from the given JSON file. An empty path returns no brandings.
+func loadBrandings(path string) (map[string]Branding, error) {
+	brandings := make(map[string]Branding)
+	if path == "" {
+		return brandings, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &brandings); err != nil {
+		return nil, err
+	}
+	for key, branding := range brandings {
+		if err := branding.validate(); err != nil {
+			return nil, fmt.Errorf("branding %s: %v", key, err)
+		}
+	}
+	return brandings, nil
+}
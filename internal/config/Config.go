@@ -0,0 +1,1286 @@
+// This file contains the Config struct and the functions used to load it from the environment.
+//
+// Every field should be documented with the environment variable it is read from and its default value.
+// Parsing and validation errors should be returned from Load so that the server refuses to start with a bad configuration.
+
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+)
+
+// Config represents the runtime configuration of the web server
+type Config struct {
+	// AdminUserIDs are existing users granted the admin role at startup. (ADMIN_USER_IDS, comma-separated, default none)
+	AdminUserIDs []primitive.ObjectID
+	// BootstrapAdminUsername is an admin account created at startup if it does not exist, with the BOOTSTRAP_ADMIN_PASSWORD secret
+	// as password. (BOOTSTRAP_ADMIN_USERNAME, default "" = none)
+	BootstrapAdminUsername string
+	// TermsVersion is the current terms-of-service version users must accept. (TOS_VERSION, default "" = not enforced)
+	TermsVersion string
+	// PrivacyVersion is the current privacy-policy version users must accept. (PRIVACY_POLICY_VERSION, default "" = not enforced)
+	PrivacyVersion string
+
+	// LoginLockoutThreshold is the number of consecutive failed logins that lock an account. (LOGIN_LOCKOUT_THRESHOLD, default 5, 0 = never)
+	LoginLockoutThreshold int
+	// LoginLockoutCooldown is how long an account stays locked. (LOGIN_LOCKOUT_COOLDOWN, default 15m)
+	LoginLockoutCooldown time.Duration
+	// AccountDeletionGrace is how long a deleted account is kept before it is removed with its scenes. Logging in during
+	// the grace period cancels the deletion. (ACCOUNT_DELETION_GRACE, default 0 = removed immediately)
+	AccountDeletionGrace time.Duration
+	// SceneTrashRetention is how long a deleted scene stays in the trash, from which it can be restored, before it is removed
+	// with its files. (SCENE_TRASH_RETENTION, default 720h, 0 = deleted scenes are removed immediately)
+	SceneTrashRetention time.Duration
+	// GuestEnabled allows anonymous trial sessions, backed by ephemeral guest users. (GUEST_ENABLED, default false)
+	GuestEnabled bool
+	// GuestSessionTTL is how long a guest session lasts, after which the guest user is removed with its scene. (GUEST_SESSION_TTL, default 24h)
+	GuestSessionTTL time.Duration
+	// GuestMaxIterations is the maximum total iterations of the single scene a guest can submit. (GUEST_MAX_ITERATIONS, default 7000)
+	GuestMaxIterations int
+	// ShareLinkTTL is how long public share links of scene outputs last, unless their creator asks otherwise. (SHARE_LINK_TTL, default 24h)
+	ShareLinkTTL time.Duration
+	// ShareLinkMaxTTL is the longest a public share link may last. (SHARE_LINK_MAX_TTL, default 168h)
+	ShareLinkMaxTTL time.Duration
+	// ManifestURLTTL is how long the signed output URLs of scene download manifests last. (MANIFEST_URL_TTL, default 1h)
+	ManifestURLTTL time.Duration
+	// RateLimitBackend is the store of the login and registration rate limits: memory (per replica) or mongo (shared by every replica).
+	// (RATE_LIMIT_BACKEND, default "memory")
+	RateLimitBackend string
+	// TenantHosts maps hostnames to the tenant they serve. The users, scenes, queue messages and files of each tenant are isolated,
+	// and requests to other hostnames use the tenant of their access token, or the default tenant.
+	// (TENANTS, i.e "section-a=a.example.com|a.example.org,section-b=b.example.com", default "" = single tenant)
+	TenantHosts map[string]string
+	// BrandingFile is the JSON file of the brandings of tenants served at /config/branding, see Branding.go.
+	// (BRANDING_FILE, default "" = no branding)
+	BrandingFile string
+
+	// AccessTokenTTL is the lifetime of the access tokens (JWTs) issued on login and refresh. (ACCESS_TOKEN_TTL, default 15m)
+	AccessTokenTTL time.Duration
+	// JWTClockSkew is the leeway allowed when validating the exp / iat claims of access tokens,
+	// to tolerate clocks drifting between replicas. (JWT_CLOCK_SKEW, default 30s)
+	JWTClockSkew time.Duration
+	// JWTAlgorithm is the algorithm access tokens are signed with: HS256 (JWT_SECRET_KEY), or RS256 / EdDSA (JWT_PRIVATE_KEY),
+	// whose public keys are published at /.well-known/jwks.json. (JWT_ALGORITHM, default "HS256")
+	JWTAlgorithm string
+	// RefreshTokenTTL is how long a refresh token can be exchanged for a new access token. (REFRESH_TOKEN_TTL, default 720h)
+	RefreshTokenTTL time.Duration
+
+	// OAuthGoogleClientID enables Google social login. (OAUTH_GOOGLE_CLIENT_ID, default "" = disabled)
+	OAuthGoogleClientID string
+	// OAuthGitHubClientID enables GitHub social login. (OAUTH_GITHUB_CLIENT_ID, default "" = disabled)
+	OAuthGitHubClientID string
+	// OAuthOIDCIssuer and OAuthOIDCClientID enable single sign-on through any OpenID Connect provider, whose endpoints are
+	// discovered from the issuer at startup. (OAUTH_OIDC_ISSUER, OAUTH_OIDC_CLIENT_ID, default "" = disabled)
+	OAuthOIDCIssuer   string
+	OAuthOIDCClientID string
+	// OAuthRedirectBaseURL is the public URL of this service, which OAuth providers redirect back to.
+	// (OAUTH_REDIRECT_BASE_URL, required if a social login provider is enabled)
+	OAuthRedirectBaseURL string
+	// OAuthFrontendRedirectURL is where users are sent after social login, with the tokens in the URL fragment.
+	// (OAUTH_FRONTEND_REDIRECT_URL, default "" = respond with the tokens as JSON)
+	OAuthFrontendRedirectURL string
+
+	// AuthProvider verifies password logins: "local" accounts registered on this server, an "ldap" directory, or "oidc",
+	// where users log in through the single sign-on provider only. Local accounts with a password (i.e the bootstrap admin)
+	// keep logging in with it under every provider. (AUTH_PROVIDER, default "local")
+	AuthProvider string
+	// LDAPURL is the directory passwords are verified against, over TLS (ldaps://) or StartTLS (ldap://).
+	// (LDAP_URL, required if AUTH_PROVIDER is ldap)
+	LDAPURL string
+	// LDAPUserDNTemplate is the DN users bind as, with %s replaced by the escaped username, i.e "uid=%s,ou=people,dc=example,dc=org".
+	// (LDAP_USER_DN_TEMPLATE, required if AUTH_PROVIDER is ldap)
+	LDAPUserDNTemplate string
+	// LDAPTimeout bounds each bind against the directory. (LDAP_TIMEOUT, default 5s)
+	LDAPTimeout time.Duration
+
+	// SMTPHost is the SMTP server emails are sent through. (SMTP_HOST, default "" = emails are only logged)
+	SMTPHost string
+	// SMTPPort is the port of the SMTP server. (SMTP_PORT, default 587)
+	SMTPPort int
+	// SMTPUsername is the username used to authenticate with the SMTP server. (SMTP_USERNAME, default "" = no authentication)
+	SMTPUsername string
+	// SMTPFrom is the sender address of emails. (SMTP_FROM, required if SMTP_HOST is set)
+	SMTPFrom string
+	// DigestEnabled enables the weekly digest emails. (DIGEST_ENABLED, default false)
+	DigestEnabled bool
+	// DigestInterval is how long users wait between two digests, and the period each digest summarizes. (DIGEST_INTERVAL, default 168h)
+	DigestInterval time.Duration
+	// QueueNotifyTop notifies users of every advance of their scenes within the first positions of the queue. (QUEUE_NOTIFY_TOP, default 3, 0 = never)
+	QueueNotifyTop int
+	// QueueNotifyStep notifies users when their scenes advanced this many positions since their last notification.
+	// (QUEUE_NOTIFY_STEP, default 10, 0 = never)
+	QueueNotifyStep int
+	// QueueNotifyInterval is how often queue positions are checked for notifications. (QUEUE_NOTIFY_INTERVAL, default 10s)
+	QueueNotifyInterval time.Duration
+
+	// RetentionRules maps user tiers to how long their users may be inactive before the outputs of their scenes are deleted.
+	// 0 keeps outputs forever, and users of tiers without a rule are never affected.
+	// (RETENTION_RULES, comma-separated <tier>=<duration>, i.e "free=720h,pro=0", default none)
+	RetentionRules map[string]time.Duration
+	// RetentionWarning is how long before deleting outputs users are warned by email. (RETENTION_WARNING, default 72h)
+	RetentionWarning time.Duration
+	// PriorityTiers maps user tiers to the highest job priority their users may request. Users of tiers without an entry
+	// only submit normal priority jobs, admins may request any priority.
+	// (PRIORITY_TIERS, comma-separated <tier>=<priority>, i.e "pro=1,enterprise=2", default none)
+	PriorityTiers map[string]int
+
+	// SecretsProvider is the backend secrets are read from: env, file or vault. (SECRETS_PROVIDER, default "env")
+	SecretsProvider string
+	// SecretsDir is the directory read by the file secrets provider. (SECRETS_DIR, default "/run/secrets")
+	SecretsDir string
+	// VaultAddr is the address of the vault server used by the vault secrets provider. (VAULT_ADDR)
+	VaultAddr string
+	// VaultSecretPath is the API path of the vault secret holding all keys. (VAULT_SECRET_PATH, default "secret/data/go-web-server")
+	VaultSecretPath string
+	// SecretsReloadInterval is how often rotating secrets (the JWT keyring) are reloaded. (SECRETS_RELOAD_INTERVAL, default 5m)
+	SecretsReloadInterval time.Duration
+
+	// InstanceID uniquely identifies this replica when several web servers share a database. (INSTANCE_ID, default hostname)
+	InstanceID string
+	// StartupCheckTimeout bounds every check of the startup self-check, which waits up to this long for MongoDB and
+	// RabbitMQ to come up. (STARTUP_CHECK_TIMEOUT, default 30s)
+	StartupCheckTimeout time.Duration
+	// ConsumerLeaseTTL is how long the elected consumer instance holds the consumer lease without renewing it.
+	// Another replica takes over consuming worker output at most this long after the consumer instance dies. (CONSUMER_LEASE_TTL, default 15s)
+	ConsumerLeaseTTL time.Duration
+	// BrokerBackend is the message broker jobs and worker output are exchanged through: rabbitmq (reached on RABBITMQ_IP),
+	// nats (JetStream) or kafka. (BROKER_BACKEND, default "rabbitmq")
+	BrokerBackend string
+	// NATSURL is the URL of the NATS server used with BROKER_BACKEND=nats. (NATS_URL, default "nats://localhost:4222")
+	NATSURL string
+	// KafkaBrokers are the bootstrap brokers of the Kafka cluster used with BROKER_BACKEND=kafka. (KAFKA_BROKERS, default "localhost:9092")
+	KafkaBrokers []string
+	// KafkaConsumerGroup is the consumer group the web server consumes worker output in with BROKER_BACKEND=kafka, and the
+	// prefix of the group its delayed retries are consumed in. (KAFKA_CONSUMER_GROUP, default "nerf-web-server")
+	KafkaConsumerGroup string
+	// PublishConfirmTimeout is how long the broker may take to confirm a published message before publishing it is retried.
+	// (PUBLISH_CONFIRM_TIMEOUT, default 5s)
+	PublishConfirmTimeout time.Duration
+	// PublishRetries is how many times a message that was not confirmed by the broker is published again before publishing
+	// fails. (PUBLISH_RETRIES, default 2)
+	PublishRetries int
+	// AMQPDurableQueues declares the worker queues durable, so they survive a broker restart. (AMQP_DURABLE_QUEUES, default true)
+	AMQPDurableQueues bool
+	// AMQPPersistentMessages publishes jobs as persistent messages, so queued jobs of durable queues survive a broker restart.
+	// (AMQP_PERSISTENT_MESSAGES, default true)
+	AMQPPersistentMessages bool
+	// AMQPLazyQueues declares the worker queues in lazy mode, keeping queued jobs on disk instead of in memory.
+	// (AMQP_LAZY_QUEUES, default false)
+	AMQPLazyQueues bool
+	// AMQPPriorityQueues declares the worker job queues as priority queues, so the broker delivers jobs of a higher priority
+	// first. Otherwise priorities only order the queue lists. (AMQP_PRIORITY_QUEUES, default false)
+	AMQPPriorityQueues bool
+	// WorkerRetryMax is the number of times the processing of a worker output message is retried before the message is
+	// dead-lettered. (WORKER_RETRY_MAX, default 5)
+	WorkerRetryMax int
+	// WorkerRetryBackoff is the delay before the first retry of a worker output message, doubled on every further retry up
+	// to an hour. (WORKER_RETRY_BACKOFF, default 10s)
+	WorkerRetryBackoff time.Duration
+	// WorkerHeartbeatTimeout is how long after its last heartbeat a worker is considered offline. Workers are expected to
+	// send a heartbeat at least every third of it. (WORKER_HEARTBEAT_TIMEOUT, default 90s)
+	WorkerHeartbeatTimeout time.Duration
+	// StageTimeout is how long a worker may process the job of a pipeline stage, from its first heartbeat reporting the scene,
+	// before the job times out. Time spent queued is not counted, and jobs of workers that do not report their scene never
+	// time out this way. (STAGE_TIMEOUT, default 24h, 0 disables it)
+	StageTimeout time.Duration
+	// StageQueueTimeout is how long the job of a pipeline stage may go without a worker reporting its scene, from when it was
+	// published, before its scene fails. Counts time spent queued, such jobs are never published again.
+	// (STAGE_QUEUE_TIMEOUT, default 0 = never)
+	StageQueueTimeout time.Duration
+	// StageTimeoutRepublishes is how many times a timed out job is published again before its scene fails.
+	// (STAGE_TIMEOUT_REPUBLISHES, default 0)
+	StageTimeoutRepublishes int
+	// MetricsEnabled serves Prometheus metrics (i.e of the storage operations) at /metrics, without authentication.
+	// (METRICS_ENABLED, default false)
+	MetricsEnabled bool
+	// LogUnredacted disables the redaction of personal data, tokens and bodies from the logs. For local debugging only.
+	// (LOG_UNREDACTED, default false)
+	LogUnredacted bool
+
+	// StorageBackend is where artifacts are stored: local or s3. (STORAGE_BACKEND, default "local")
+	StorageBackend string
+	// StorageLocalRoot is the root directory of the local storage backend. (STORAGE_LOCAL_ROOT, default "data")
+	StorageLocalRoot string
+	// S3Endpoint is the host[:port] of the S3 compatible server. (S3_ENDPOINT)
+	S3Endpoint string
+	// S3PublicEndpoint is the host[:port] clients reach the S3 compatible server at, used in presigned upload URLs,
+	// if it differs from S3Endpoint (i.e S3Endpoint is a host of the internal network). (S3_PUBLIC_ENDPOINT, default S3_ENDPOINT)
+	S3PublicEndpoint string
+	// S3Region is the region of the bucket. (S3_REGION, default "us-east-1")
+	S3Region string
+	// S3Bucket is the bucket artifacts are stored in. (S3_BUCKET, default "nerf-artifacts")
+	S3Bucket string
+	// S3UseSSL selects https for the S3 endpoint. (S3_USE_SSL, default true)
+	S3UseSSL bool
+	// S3PartSize is the size of the parts streamed uploads of an unknown size are sent to S3 in, and so the memory each of them
+	// buffers. Objects of unknown size are limited to 10000 parts. (S3_PART_SIZE, default 16MiB, 5MiB to 5GiB)
+	S3PartSize int64
+	// ArchiveBackend is the cold storage archived scene outputs are moved to: local, s3 or "" to disable archival. (ARCHIVE_BACKEND, default "")
+	ArchiveBackend string
+	// ArchiveLocalRoot is the root directory of the local cold storage. (ARCHIVE_LOCAL_ROOT, default "archive")
+	ArchiveLocalRoot string
+	// ArchiveS3Bucket is the bucket of the s3 cold storage, on the S3 server of the artifact storage. (ARCHIVE_S3_BUCKET, default "nerf-archive")
+	ArchiveS3Bucket string
+	// ArchiveAfter is the age after which completed scenes are archived automatically. (ARCHIVE_AFTER, default 0 = manual only)
+	ArchiveAfter time.Duration
+	// BackupBackend is the storage backups of the database are written to: local or s3. (BACKUP_BACKEND, default "local")
+	BackupBackend string
+	// BackupLocalRoot is the root directory of the local backup storage. (BACKUP_LOCAL_ROOT, default "backups")
+	BackupLocalRoot string
+	// BackupS3Bucket is the bucket of the s3 backup storage, on the S3 server of the artifact storage. (BACKUP_S3_BUCKET, default "nerf-backups")
+	BackupS3Bucket string
+	// WorkerDataBaseURL is the URL workers use to reach this service's /worker-data routes.
+	// It should point at the load balancer when running several replicas. (WORKER_DATA_BASE_URL, default "http://web-server:5000/")
+	WorkerDataBaseURL string
+	// WorkerDataURLTTL is how long the signed /worker-data URLs of the inputs of a job stay valid after it is published.
+	// (WORKER_DATA_URL_TTL, default 72h)
+	WorkerDataURLTTL time.Duration
+	// WorkerAllowedHosts are the hosts (i.e "sfm-worker" or "nerf-worker:5100") the artifacts reported by workers may be downloaded from.
+	// (WORKER_ALLOWED_HOSTS, comma-separated, default none = any host but loopback and link-local addresses)
+	WorkerAllowedHosts []string
+	// ArtifactMaxSize is the maximum size in bytes of a single artifact downloaded from a worker. (ARTIFACT_MAX_SIZE, default 2GiB)
+	ArtifactMaxSize int64
+	// ArtifactDownloadBandwidth is the bandwidth in bytes per second shared by every artifact download of this instance.
+	// (ARTIFACT_DOWNLOAD_BANDWIDTH, default 0 = unlimited)
+	ArtifactDownloadBandwidth int64
+	// ArtifactHookURL is a webhook receiving a JSON event whenever an artifact is created or deleted. (ARTIFACT_HOOK_URL, default "" = none)
+	ArtifactHookURL string
+	// ArtifactHookCommand is a shell command run whenever an artifact is created or deleted, with the event in its environment.
+	// (ARTIFACT_HOOK_COMMAND, default "" = none)
+	ArtifactHookCommand string
+	// ArtifactHookTimeout bounds a single webhook request or command run. (ARTIFACT_HOOK_TIMEOUT, default 10s)
+	ArtifactHookTimeout time.Duration
+	// SceneCallbackTimeout bounds a single request to the webhook attached to a scene. (SCENE_CALLBACK_TIMEOUT, default 10s)
+	SceneCallbackTimeout time.Duration
+	// SceneCallbackAllowPrivate allows scene webhooks on loopback, private and link-local addresses, i.e for automation
+	// running inside the deployment. Never enable when untrusted users can submit scenes. (SCENE_CALLBACK_ALLOW_PRIVATE, default false)
+	SceneCallbackAllowPrivate bool
+	// StorageEncryption encrypts the artifacts of scenes at rest, with keys derived from the STORAGE_ENCRYPTION_KEY secret.
+	// (STORAGE_ENCRYPTION, default false)
+	StorageEncryption bool
+
+	// DefaultSceneName is the name of scenes submitted without one. (DEFAULT_SCENE_NAME, default "Untitled Scene")
+	DefaultSceneName string
+	// DefaultTrainingMode is the training mode of scenes submitted without one. (DEFAULT_TRAINING_MODE, default "gaussian")
+	DefaultTrainingMode string
+	// DefaultOutputTypes are the output types of scenes submitted without any. (DEFAULT_OUTPUT_TYPES, comma-separated, default "video")
+	DefaultOutputTypes []string
+	// DefaultSaveIterations are the iterations outputs are saved at for scenes submitted without any.
+	// (DEFAULT_SAVE_ITERATIONS, comma-separated, default "1000,7000,30000")
+	DefaultSaveIterations []int
+	// DefaultTotalIterations is the number of training iterations of scenes submitted without one. (DEFAULT_TOTAL_ITERATIONS, default 30000)
+	DefaultTotalIterations int
+
+	// WorkerConcurrency is the number of scenes the worker fleet processes in parallel, used for queue estimates. (WORKER_CONCURRENCY, default 1)
+	WorkerConcurrency int
+	// EstimatedJobDuration is the processing time assumed per scene until enough scenes completed to measure it. (ESTIMATED_JOB_DURATION, default 30m)
+	EstimatedJobDuration time.Duration
+	// PollIntervalMin is the poll interval suggested to clients of a scene about to progress. (POLL_INTERVAL_MIN, default 2s)
+	PollIntervalMin time.Duration
+	// PollIntervalMax is the poll interval suggested to clients of a scene far back in the queue. (POLL_INTERVAL_MAX, default 60s)
+	PollIntervalMax time.Duration
+	// QueueSoftLimit is the queue length above which uploads are still accepted, but flagged as delayed. (QUEUE_SOFT_LIMIT, default 0 = none)
+	QueueSoftLimit int
+	// ReplayConcurrency is the number of scenes of admin pipeline replays processed at once, so replays do not starve user jobs.
+	// (REPLAY_CONCURRENCY, default 1)
+	ReplayConcurrency int
+	// PipelineStages are the processing stages scenes go through, in order. Every stage has its own worker queues
+	// (<stage>-in and <stage>-out) and queue list (<stage>_list), and must have a stage definition. The sfm and nerf stages are
+	// required, in this order. (PIPELINE_STAGES, default "sfm,nerf")
+	PipelineStages []string
+	// CanaryPercent is the percentage of nerf jobs routed to the nerf-in.canary queue, served by a new worker build,
+	// instead of nerf-in. Routed scenes are tagged canary. (CANARY_PERCENT, default 0 = none)
+	CanaryPercent int
+	// SyntheticEnabled serves /admin/synthetic/scene, creating synthetic scenes whose worker results are fabricated by the
+	// server instead of GPU workers, for load tests in staging. (SYNTHETIC_ENABLED, default false)
+	SyntheticEnabled bool
+	// SyntheticStageDelay is the processing time simulated for each stage of a synthetic scene. (SYNTHETIC_STAGE_DELAY, default 5s)
+	SyntheticStageDelay time.Duration
+	// IntegrityCheckInterval is how often the stored files of every scene are verified against their recorded sizes and checksums,
+	// in addition to the checks requested by admins. (INTEGRITY_CHECK_INTERVAL, default 168h, 0 = only on request)
+	IntegrityCheckInterval time.Duration
+
+	// RequestBodyLimit is the maximum size in bytes of a request body buffered in memory. Larger bodies (i.e uploads) are
+	// streamed to their handler instead, where they are capped by the maximum upload size. (REQUEST_BODY_LIMIT, default 16MiB)
+	RequestBodyLimit int64
+	// UploadMaxDuration is the maximum duration of an uploaded video. (UPLOAD_MAX_DURATION, default 0 = unlimited)
+	UploadMaxDuration time.Duration
+	// UploadMaxWidth and UploadMaxHeight bound the resolution of an uploaded video, regardless of orientation.
+	// (UPLOAD_MAX_RESOLUTION, i.e "1920x1080", default "" = unlimited)
+	UploadMaxWidth  int
+	UploadMaxHeight int
+	// UploadMinFrames is the minimum number of frames of an uploaded video. (UPLOAD_MIN_FRAMES, default 0 = unlimited)
+	UploadMinFrames int
+	// UploadBannedCodecs are the codecs (mp4 sample entry fourcc, i.e "hvc1,hev1") rejected at ingest. (UPLOAD_BANNED_CODECS, comma-separated, default none)
+	UploadBannedCodecs []string
+	// UploadMaxConcurrent is the number of uploads (and chunks of resumable uploads) streamed to storage at once, so the memory
+	// buffered by uploads stays bounded. Further uploads are rejected until one finished. (UPLOAD_MAX_CONCURRENT, default 64, 0 = unlimited)
+	UploadMaxConcurrent int
+	// UploadSessionTTL is how long a resumable upload session is kept after its last chunk. (UPLOAD_SESSION_TTL, default 24h)
+	UploadSessionTTL time.Duration
+	// SceneMaxVideos is the maximum number of videos uploaded together as the inputs of a single scene, i.e several passes
+	// around an object. (SCENE_MAX_VIDEOS, default 4)
+	SceneMaxVideos int
+	// RemoteUploadTimeout bounds the download of a video submitted by URL, including the time to receive its body.
+	// (REMOTE_UPLOAD_TIMEOUT, default 30m)
+	RemoteUploadTimeout time.Duration
+	// RemoteUploadAllowPrivate allows videos submitted by URL to be downloaded from loopback, private and link-local
+	// addresses, i.e from a file server of the same network. (REMOTE_UPLOAD_ALLOW_PRIVATE, default false)
+	RemoteUploadAllowPrivate bool
+	// UploadScanner scans uploads for malware before their scene is created: "clamav" streams them to the clamd daemon at
+	// UploadScanClamdAddr, "command" runs UploadScanCommand with the upload on its stdin. (UPLOAD_SCANNER, default "" = none)
+	UploadScanner string
+	// UploadScanClamdAddr is the TCP address of clamd. (UPLOAD_SCAN_CLAMD_ADDR, i.e "clamav:3310", required if UPLOAD_SCANNER is clamav)
+	UploadScanClamdAddr string
+	// UploadScanCommand is a shell command scanning the upload on its stdin, exiting 0 if it is clean and 1 if it is not,
+	// like clamdscan. Its output is the name of the threat. (UPLOAD_SCAN_COMMAND, required if UPLOAD_SCANNER is command)
+	UploadScanCommand string
+	// UploadScanTimeout bounds the scan of a single upload. (UPLOAD_SCAN_TIMEOUT, default 5m)
+	UploadScanTimeout time.Duration
+	// UploadScanOnThreat is what happens to uploads flagged by the scanner: "block" rejects them, "allow" only logs the
+	// threat, i.e to evaluate a scanner. (UPLOAD_SCAN_ON_THREAT, default "block")
+	UploadScanOnThreat string
+	// UploadScanOnError is what happens to uploads the scanner failed to scan (unavailable, upload too large for the scanner):
+	// "block" rejects them, "allow" accepts them unscanned. (UPLOAD_SCAN_ON_ERROR, default "block")
+	UploadScanOnError string
+	// FFmpegPath is the ffmpeg binary generating the thumbnail of a scene from its video at ingest.
+	// (FFMPEG_PATH, i.e "ffmpeg", default "" = thumbnails only from sfm frames)
+	FFmpegPath string
+	// UploadTranscode transcodes uploaded videos that are not H.264 mp4 videos to H.264 mp4 with FFmpegPath before their
+	// sfm job, and enables the mkv, webm and avi containers, which can only be probed once transcoded. (UPLOAD_TRANSCODE, default false)
+	UploadTranscode bool
+	// ThumbnailMaxSize is the maximum size in bytes of a thumbnail uploaded by a user. (THUMBNAIL_MAX_SIZE, default 2MiB)
+	ThumbnailMaxSize int64
+
+	// brandings are the brandings by tenant read from BrandingFile, see BrandingFor.
+	brandings map[string]Branding
+	// tunables holds the settings that can be reloaded at runtime, see Tunables.
+	tunables atomic.Pointer[Tunables]
+}
+
+// Load reads the configuration from environment variables.
+//
+// Returns the Config if successful, error if any variable is malformed.
+func Load() (*Config, error) {
+	cfg := &Config{
+		TermsVersion:   strings.TrimSpace(os.Getenv("TOS_VERSION")),
+		PrivacyVersion: strings.TrimSpace(os.Getenv("PRIVACY_POLICY_VERSION")),
+	}
+
+	cfg.BootstrapAdminUsername = getEnv("BOOTSTRAP_ADMIN_USERNAME", "")
+
+	cfg.OAuthGoogleClientID = getEnv("OAUTH_GOOGLE_CLIENT_ID", "")
+	cfg.OAuthGitHubClientID = getEnv("OAUTH_GITHUB_CLIENT_ID", "")
+	cfg.OAuthOIDCIssuer = strings.TrimSuffix(getEnv("OAUTH_OIDC_ISSUER", ""), "/")
+	cfg.OAuthOIDCClientID = getEnv("OAUTH_OIDC_CLIENT_ID", "")
+	cfg.OAuthRedirectBaseURL = getEnv("OAUTH_REDIRECT_BASE_URL", "")
+	if cfg.OAuthRedirectBaseURL != "" && !strings.HasSuffix(cfg.OAuthRedirectBaseURL, "/") {
+		cfg.OAuthRedirectBaseURL += "/"
+	}
+	cfg.OAuthFrontendRedirectURL = getEnv("OAUTH_FRONTEND_REDIRECT_URL", "")
+
+	cfg.AuthProvider = getEnv("AUTH_PROVIDER", "local")
+	cfg.LDAPURL = getEnv("LDAP_URL", "")
+	cfg.LDAPUserDNTemplate = getEnv("LDAP_USER_DN_TEMPLATE", "")
+
+	cfg.SMTPHost = getEnv("SMTP_HOST", "")
+	cfg.SMTPUsername = getEnv("SMTP_USERNAME", "")
+	cfg.SMTPFrom = getEnv("SMTP_FROM", "")
+
+	cfg.SecretsProvider = getEnv("SECRETS_PROVIDER", "env")
+	cfg.SecretsDir = getEnv("SECRETS_DIR", "/run/secrets")
+	cfg.VaultAddr = getEnv("VAULT_ADDR", "")
+	cfg.VaultSecretPath = getEnv("VAULT_SECRET_PATH", "secret/data/go-web-server")
+
+	var err error
+	cfg.AdminUserIDs, err = parseObjectIDList(os.Getenv("ADMIN_USER_IDS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ADMIN_USER_IDS: %v", err)
+	}
+	cfg.TenantHosts, err = parseTenantHosts(os.Getenv("TENANTS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid TENANTS: %v", err)
+	}
+	cfg.BrandingFile = getEnv("BRANDING_FILE", "")
+	cfg.brandings, err = loadBrandings(cfg.BrandingFile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid BRANDING_FILE: %v", err)
+	}
+
+	loginLockoutThreshold, err := getEnvInt("LOGIN_LOCKOUT_THRESHOLD", 5)
+	if err != nil {
+		return nil, err
+	}
+	cfg.LoginLockoutThreshold = int(loginLockoutThreshold)
+	cfg.LoginLockoutCooldown, err = getEnvDuration("LOGIN_LOCKOUT_COOLDOWN", 15*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	cfg.LDAPTimeout, err = getEnvDuration("LDAP_TIMEOUT", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	cfg.AccountDeletionGrace, err = getEnvDuration("ACCOUNT_DELETION_GRACE", 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.SceneTrashRetention, err = getEnvDuration("SCENE_TRASH_RETENTION", 30*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	cfg.GuestEnabled, err = getEnvBool("GUEST_ENABLED", false)
+	if err != nil {
+		return nil, err
+	}
+	cfg.GuestSessionTTL, err = getEnvDuration("GUEST_SESSION_TTL", 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	guestMaxIterations, err := getEnvInt("GUEST_MAX_ITERATIONS", 7000)
+	if err != nil {
+		return nil, err
+	}
+	cfg.GuestMaxIterations = int(guestMaxIterations)
+	cfg.ShareLinkTTL, err = getEnvDuration("SHARE_LINK_TTL", 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ShareLinkMaxTTL, err = getEnvDuration("SHARE_LINK_MAX_TTL", 7*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ManifestURLTTL, err = getEnvDuration("MANIFEST_URL_TTL", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	cfg.RateLimitBackend = getEnv("RATE_LIMIT_BACKEND", "memory")
+
+	cfg.AccessTokenTTL, err = getEnvDuration("ACCESS_TOKEN_TTL", 15*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	cfg.JWTClockSkew, err = getEnvDuration("JWT_CLOCK_SKEW", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	cfg.JWTAlgorithm = getEnv("JWT_ALGORITHM", "HS256")
+	cfg.RefreshTokenTTL, err = getEnvDuration("REFRESH_TOKEN_TTL", 720*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.SecretsReloadInterval, err = getEnvDuration("SECRETS_RELOAD_INTERVAL", 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	smtpPort, err := getEnvInt("SMTP_PORT", 587)
+	if err != nil {
+		return nil, err
+	}
+	cfg.SMTPPort = int(smtpPort)
+	cfg.DigestEnabled, err = getEnvBool("DIGEST_ENABLED", false)
+	if err != nil {
+		return nil, err
+	}
+	cfg.DigestInterval, err = getEnvDuration("DIGEST_INTERVAL", 7*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	queueNotifyTop, err := getEnvInt("QUEUE_NOTIFY_TOP", 3)
+	if err != nil {
+		return nil, err
+	}
+	cfg.QueueNotifyTop = int(queueNotifyTop)
+	queueNotifyStep, err := getEnvInt("QUEUE_NOTIFY_STEP", 10)
+	if err != nil {
+		return nil, err
+	}
+	cfg.QueueNotifyStep = int(queueNotifyStep)
+	cfg.QueueNotifyInterval, err = getEnvDuration("QUEUE_NOTIFY_INTERVAL", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	cfg.RetentionRules, err = parseDurationMap(os.Getenv("RETENTION_RULES"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid RETENTION_RULES: %v", err)
+	}
+	cfg.PriorityTiers, err = parseIntMap(os.Getenv("PRIORITY_TIERS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid PRIORITY_TIERS: %v", err)
+	}
+	cfg.RetentionWarning, err = getEnvDuration("RETENTION_WARNING", 72*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.StorageBackend = getEnv("STORAGE_BACKEND", "local")
+	cfg.StorageLocalRoot = getEnv("STORAGE_LOCAL_ROOT", "data")
+	cfg.S3Endpoint = getEnv("S3_ENDPOINT", "")
+	cfg.S3PublicEndpoint = getEnv("S3_PUBLIC_ENDPOINT", cfg.S3Endpoint)
+	cfg.S3Region = getEnv("S3_REGION", "us-east-1")
+	cfg.S3Bucket = getEnv("S3_BUCKET", "nerf-artifacts")
+	cfg.S3UseSSL, err = getEnvBool("S3_USE_SSL", true)
+	if err != nil {
+		return nil, err
+	}
+	cfg.S3PartSize, err = getEnvInt("S3_PART_SIZE", 16*1024*1024)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ArchiveBackend = getEnv("ARCHIVE_BACKEND", "")
+	cfg.ArchiveLocalRoot = getEnv("ARCHIVE_LOCAL_ROOT", "archive")
+	cfg.ArchiveS3Bucket = getEnv("ARCHIVE_S3_BUCKET", "nerf-archive")
+	cfg.ArchiveAfter, err = getEnvDuration("ARCHIVE_AFTER", 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.BackupBackend = getEnv("BACKUP_BACKEND", "local")
+	cfg.BackupLocalRoot = getEnv("BACKUP_LOCAL_ROOT", "backups")
+	cfg.BackupS3Bucket = getEnv("BACKUP_S3_BUCKET", "nerf-backups")
+	cfg.WorkerDataBaseURL = getEnv("WORKER_DATA_BASE_URL", "http://web-server:5000/")
+	if !strings.HasSuffix(cfg.WorkerDataBaseURL, "/") {
+		cfg.WorkerDataBaseURL += "/"
+	}
+	cfg.WorkerDataURLTTL, err = getEnvDuration("WORKER_DATA_URL_TTL", 72*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	cfg.WorkerAllowedHosts = parseList(os.Getenv("WORKER_ALLOWED_HOSTS"))
+	cfg.ArtifactMaxSize, err = getEnvInt("ARTIFACT_MAX_SIZE", 2*1024*1024*1024)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ArtifactDownloadBandwidth, err = getEnvInt("ARTIFACT_DOWNLOAD_BANDWIDTH", 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ArtifactHookURL = getEnv("ARTIFACT_HOOK_URL", "")
+	cfg.ArtifactHookCommand = getEnv("ARTIFACT_HOOK_COMMAND", "")
+	cfg.ArtifactHookTimeout, err = getEnvDuration("ARTIFACT_HOOK_TIMEOUT", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	cfg.SceneCallbackTimeout, err = getEnvDuration("SCENE_CALLBACK_TIMEOUT", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	cfg.SceneCallbackAllowPrivate, err = getEnvBool("SCENE_CALLBACK_ALLOW_PRIVATE", false)
+	if err != nil {
+		return nil, err
+	}
+	cfg.StorageEncryption, err = getEnvBool("STORAGE_ENCRYPTION", false)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.DefaultSceneName = getEnv("DEFAULT_SCENE_NAME", "Untitled Scene")
+	cfg.DefaultTrainingMode = getEnv("DEFAULT_TRAINING_MODE", scene.TrainingModeGaussian)
+	cfg.DefaultOutputTypes = parseList(getEnv("DEFAULT_OUTPUT_TYPES", "video"))
+	cfg.DefaultSaveIterations, err = parseIntList(getEnv("DEFAULT_SAVE_ITERATIONS", "1000,7000,30000"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DEFAULT_SAVE_ITERATIONS: %v", err)
+	}
+	defaultTotalIterations, err := getEnvInt("DEFAULT_TOTAL_ITERATIONS", 30000)
+	if err != nil {
+		return nil, err
+	}
+	cfg.DefaultTotalIterations = int(defaultTotalIterations)
+
+	workerConcurrency, err := getEnvInt("WORKER_CONCURRENCY", 1)
+	if err != nil {
+		return nil, err
+	}
+	cfg.WorkerConcurrency = int(workerConcurrency)
+	cfg.EstimatedJobDuration, err = getEnvDuration("ESTIMATED_JOB_DURATION", 30*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	cfg.PollIntervalMin, err = getEnvDuration("POLL_INTERVAL_MIN", 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	cfg.PollIntervalMax, err = getEnvDuration("POLL_INTERVAL_MAX", 60*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	queueSoftLimit, err := getEnvInt("QUEUE_SOFT_LIMIT", 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.QueueSoftLimit = int(queueSoftLimit)
+	replayConcurrency, err := getEnvInt("REPLAY_CONCURRENCY", 1)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ReplayConcurrency = int(replayConcurrency)
+	cfg.PipelineStages = parseList(getEnv("PIPELINE_STAGES", "sfm,nerf"))
+	canaryPercent, err := getEnvInt("CANARY_PERCENT", 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.CanaryPercent = int(canaryPercent)
+	cfg.SyntheticEnabled, err = getEnvBool("SYNTHETIC_ENABLED", false)
+	if err != nil {
+		return nil, err
+	}
+	cfg.SyntheticStageDelay, err = getEnvDuration("SYNTHETIC_STAGE_DELAY", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	cfg.IntegrityCheckInterval, err = getEnvDuration("INTEGRITY_CHECK_INTERVAL", 7*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.RequestBodyLimit, err = getEnvInt("REQUEST_BODY_LIMIT", 16*1024*1024)
+	if err != nil {
+		return nil, err
+	}
+	cfg.UploadMaxDuration, err = getEnvDuration("UPLOAD_MAX_DURATION", 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.UploadMaxWidth, cfg.UploadMaxHeight, err = parseResolution(os.Getenv("UPLOAD_MAX_RESOLUTION"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid UPLOAD_MAX_RESOLUTION: %v", err)
+	}
+	minFrames, err := getEnvInt("UPLOAD_MIN_FRAMES", 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.UploadMinFrames = int(minFrames)
+	cfg.UploadBannedCodecs = parseList(os.Getenv("UPLOAD_BANNED_CODECS"))
+	uploadMaxConcurrent, err := getEnvInt("UPLOAD_MAX_CONCURRENT", 64)
+	if err != nil {
+		return nil, err
+	}
+	cfg.UploadMaxConcurrent = int(uploadMaxConcurrent)
+	cfg.UploadSessionTTL, err = getEnvDuration("UPLOAD_SESSION_TTL", 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	sceneMaxVideos, err := getEnvInt("SCENE_MAX_VIDEOS", 4)
+	if err != nil {
+		return nil, err
+	}
+	cfg.SceneMaxVideos = int(sceneMaxVideos)
+	cfg.RemoteUploadTimeout, err = getEnvDuration("REMOTE_UPLOAD_TIMEOUT", 30*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	cfg.RemoteUploadAllowPrivate, err = getEnvBool("REMOTE_UPLOAD_ALLOW_PRIVATE", false)
+	if err != nil {
+		return nil, err
+	}
+	cfg.UploadScanner = getEnv("UPLOAD_SCANNER", "")
+	cfg.UploadScanClamdAddr = getEnv("UPLOAD_SCAN_CLAMD_ADDR", "")
+	cfg.UploadScanCommand = getEnv("UPLOAD_SCAN_COMMAND", "")
+	cfg.UploadScanTimeout, err = getEnvDuration("UPLOAD_SCAN_TIMEOUT", 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	cfg.UploadScanOnThreat = getEnv("UPLOAD_SCAN_ON_THREAT", "block")
+	cfg.UploadScanOnError = getEnv("UPLOAD_SCAN_ON_ERROR", "block")
+	cfg.FFmpegPath = getEnv("FFMPEG_PATH", "")
+	cfg.UploadTranscode, err = getEnvBool("UPLOAD_TRANSCODE", false)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.UploadTranscode && cfg.FFmpegPath == "" {
+		return nil, fmt.Errorf("invalid UPLOAD_TRANSCODE: FFMPEG_PATH is required to transcode uploads")
+	}
+	cfg.ThumbnailMaxSize, err = getEnvInt("THUMBNAIL_MAX_SIZE", 2*1024*1024)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	cfg.InstanceID = getEnv("INSTANCE_ID", hostname)
+	cfg.StartupCheckTimeout, err = getEnvDuration("STARTUP_CHECK_TIMEOUT", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ConsumerLeaseTTL, err = getEnvDuration("CONSUMER_LEASE_TTL", 15*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	cfg.PublishConfirmTimeout, err = getEnvDuration("PUBLISH_CONFIRM_TIMEOUT", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	publishRetries, err := getEnvInt("PUBLISH_RETRIES", 2)
+	if err != nil {
+		return nil, err
+	}
+	cfg.PublishRetries = int(publishRetries)
+	cfg.StageTimeout, err = getEnvDuration("STAGE_TIMEOUT", 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	cfg.StageQueueTimeout, err = getEnvDuration("STAGE_QUEUE_TIMEOUT", 0)
+	if err != nil {
+		return nil, err
+	}
+	stageTimeoutRepublishes, err := getEnvInt("STAGE_TIMEOUT_REPUBLISHES", 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.StageTimeoutRepublishes = int(stageTimeoutRepublishes)
+	cfg.BrokerBackend = getEnv("BROKER_BACKEND", "rabbitmq")
+	cfg.NATSURL = getEnv("NATS_URL", "nats://localhost:4222")
+	cfg.KafkaBrokers = parseList(getEnv("KAFKA_BROKERS", "localhost:9092"))
+	cfg.KafkaConsumerGroup = getEnv("KAFKA_CONSUMER_GROUP", "nerf-web-server")
+	cfg.AMQPDurableQueues, err = getEnvBool("AMQP_DURABLE_QUEUES", true)
+	if err != nil {
+		return nil, err
+	}
+	cfg.AMQPPersistentMessages, err = getEnvBool("AMQP_PERSISTENT_MESSAGES", true)
+	if err != nil {
+		return nil, err
+	}
+	cfg.AMQPLazyQueues, err = getEnvBool("AMQP_LAZY_QUEUES", false)
+	if err != nil {
+		return nil, err
+	}
+	cfg.AMQPPriorityQueues, err = getEnvBool("AMQP_PRIORITY_QUEUES", false)
+	if err != nil {
+		return nil, err
+	}
+	workerRetryMax, err := getEnvInt("WORKER_RETRY_MAX", 5)
+	if err != nil {
+		return nil, err
+	}
+	cfg.WorkerRetryMax = int(workerRetryMax)
+	cfg.WorkerRetryBackoff, err = getEnvDuration("WORKER_RETRY_BACKOFF", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	cfg.WorkerHeartbeatTimeout, err = getEnvDuration("WORKER_HEARTBEAT_TIMEOUT", 90*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	cfg.MetricsEnabled, err = getEnvBool("METRICS_ENABLED", false)
+	if err != nil {
+		return nil, err
+	}
+	cfg.LogUnredacted, err = getEnvBool("LOG_UNREDACTED", false)
+	if err != nil {
+		return nil, err
+	}
+
+	tunables, err := loadTunables()
+	if err != nil {
+		return nil, err
+	}
+	cfg.tunables.Store(tunables)
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Validate checks the configuration for values that would prevent the server from working.
+func (c *Config) Validate() error {
+	if err := c.Tunables().validate(); err != nil {
+		return err
+	}
+	switch c.SecretsProvider {
+	case "env", "file":
+	case "vault":
+		if c.VaultAddr == "" {
+			return fmt.Errorf("VAULT_ADDR is required when SECRETS_PROVIDER=vault")
+		}
+	default:
+		return fmt.Errorf("invalid SECRETS_PROVIDER %q: expected env, file or vault", c.SecretsProvider)
+	}
+	if (c.OAuthGoogleClientID != "" || c.OAuthGitHubClientID != "" || c.OAuthOIDCClientID != "") && c.OAuthRedirectBaseURL == "" {
+		return fmt.Errorf("OAUTH_REDIRECT_BASE_URL is required when a social login provider is enabled")
+	}
+	if (c.OAuthOIDCIssuer == "") != (c.OAuthOIDCClientID == "") {
+		return fmt.Errorf("OAUTH_OIDC_ISSUER and OAUTH_OIDC_CLIENT_ID must be set together")
+	}
+	switch c.AuthProvider {
+	case "local":
+	case "ldap":
+		if !strings.HasPrefix(c.LDAPURL, "ldap://") && !strings.HasPrefix(c.LDAPURL, "ldaps://") {
+			return fmt.Errorf("LDAP_URL must be an ldap:// or ldaps:// URL when AUTH_PROVIDER is ldap")
+		}
+		if strings.Count(c.LDAPUserDNTemplate, "%s") != 1 {
+			return fmt.Errorf("LDAP_USER_DN_TEMPLATE must contain %%s once when AUTH_PROVIDER is ldap")
+		}
+		if c.LDAPTimeout <= 0 {
+			return fmt.Errorf("LDAP_TIMEOUT must be positive")
+		}
+	case "oidc":
+		if c.OAuthOIDCClientID == "" {
+			return fmt.Errorf("OAUTH_OIDC_ISSUER and OAUTH_OIDC_CLIENT_ID are required when AUTH_PROVIDER is oidc")
+		}
+	default:
+		return fmt.Errorf("invalid AUTH_PROVIDER %q: expected local, ldap or oidc", c.AuthProvider)
+	}
+	if c.RequestBodyLimit <= 0 {
+		return fmt.Errorf("REQUEST_BODY_LIMIT must be positive")
+	}
+	if c.SMTPHost != "" && (c.SMTPFrom == "" || c.SMTPPort < 1 || c.SMTPPort > 65535) {
+		return fmt.Errorf("SMTP_FROM and a valid SMTP_PORT are required when SMTP_HOST is set")
+	}
+	if c.DigestInterval < 24*time.Hour {
+		return fmt.Errorf("DIGEST_INTERVAL must be at least 24h")
+	}
+	if c.QueueNotifyTop < 0 || c.QueueNotifyStep < 0 || c.QueueNotifyInterval <= 0 {
+		return fmt.Errorf("QUEUE_NOTIFY_TOP and QUEUE_NOTIFY_STEP must not be negative, and QUEUE_NOTIFY_INTERVAL must be positive")
+	}
+	if c.RetentionWarning <= 0 {
+		return fmt.Errorf("RETENTION_WARNING must be positive")
+	}
+	if c.LoginLockoutThreshold < 0 || (c.LoginLockoutThreshold > 0 && c.LoginLockoutCooldown <= 0) {
+		return fmt.Errorf("LOGIN_LOCKOUT_THRESHOLD must not be negative, and LOGIN_LOCKOUT_COOLDOWN must be positive when it is set")
+	}
+	if c.AccountDeletionGrace < 0 {
+		return fmt.Errorf("ACCOUNT_DELETION_GRACE must not be negative")
+	}
+	if c.SceneTrashRetention < 0 {
+		return fmt.Errorf("SCENE_TRASH_RETENTION must not be negative")
+	}
+	if c.GuestSessionTTL <= 0 || c.GuestMaxIterations <= 0 {
+		return fmt.Errorf("GUEST_SESSION_TTL and GUEST_MAX_ITERATIONS must be positive")
+	}
+	if c.ShareLinkTTL <= 0 || c.ShareLinkMaxTTL < c.ShareLinkTTL {
+		return fmt.Errorf("SHARE_LINK_TTL must be positive, and at most SHARE_LINK_MAX_TTL")
+	}
+	if c.ManifestURLTTL <= 0 || c.ManifestURLTTL > c.ShareLinkMaxTTL {
+		return fmt.Errorf("MANIFEST_URL_TTL must be positive, and at most SHARE_LINK_MAX_TTL")
+	}
+	if c.RateLimitBackend != "memory" && c.RateLimitBackend != "mongo" {
+		return fmt.Errorf("invalid RATE_LIMIT_BACKEND %q: expected memory or mongo", c.RateLimitBackend)
+	}
+	if c.AccessTokenTTL <= 0 {
+		return fmt.Errorf("ACCESS_TOKEN_TTL must be positive")
+	}
+	if c.JWTClockSkew < 0 || c.JWTClockSkew >= c.AccessTokenTTL {
+		return fmt.Errorf("JWT_CLOCK_SKEW must not be negative, and must be shorter than ACCESS_TOKEN_TTL")
+	}
+	if !slices.Contains([]string{"HS256", "RS256", "EdDSA"}, c.JWTAlgorithm) {
+		return fmt.Errorf("JWT_ALGORITHM must be HS256, RS256 or EdDSA")
+	}
+	if c.RefreshTokenTTL <= 0 {
+		return fmt.Errorf("REFRESH_TOKEN_TTL must be positive")
+	}
+	if c.SecretsReloadInterval <= 0 {
+		return fmt.Errorf("SECRETS_RELOAD_INTERVAL must be positive")
+	}
+	if c.InstanceID == "" {
+		return fmt.Errorf("INSTANCE_ID is required when the hostname is unavailable")
+	}
+	if c.StartupCheckTimeout <= 0 {
+		return fmt.Errorf("STARTUP_CHECK_TIMEOUT must be positive")
+	}
+	if c.ConsumerLeaseTTL < 3*time.Second {
+		return fmt.Errorf("CONSUMER_LEASE_TTL must be at least 3s")
+	}
+	switch c.BrokerBackend {
+	case "rabbitmq":
+	case "nats":
+		if c.NATSURL == "" {
+			return fmt.Errorf("NATS_URL is required when BROKER_BACKEND=nats")
+		}
+	case "kafka":
+		if len(c.KafkaBrokers) == 0 || c.KafkaConsumerGroup == "" {
+			return fmt.Errorf("KAFKA_BROKERS and KAFKA_CONSUMER_GROUP are required when BROKER_BACKEND=kafka")
+		}
+	default:
+		return fmt.Errorf("invalid BROKER_BACKEND %q: expected rabbitmq, nats or kafka", c.BrokerBackend)
+	}
+	if c.PublishConfirmTimeout <= 0 || c.PublishRetries < 0 {
+		return fmt.Errorf("PUBLISH_CONFIRM_TIMEOUT must be positive, and PUBLISH_RETRIES must not be negative")
+	}
+	if c.StageTimeout < 0 || c.StageQueueTimeout < 0 || c.StageTimeoutRepublishes < 0 {
+		return fmt.Errorf("STAGE_TIMEOUT, STAGE_QUEUE_TIMEOUT and STAGE_TIMEOUT_REPUBLISHES must not be negative")
+	}
+	for tier, priority := range c.PriorityTiers {
+		if priority > scene.MaxPriority {
+			return fmt.Errorf("PRIORITY_TIERS: priority of tier %s must be at most %d", tier, scene.MaxPriority)
+		}
+	}
+	if c.WorkerRetryMax < 0 {
+		return fmt.Errorf("WORKER_RETRY_MAX must be non-negative")
+	}
+	if c.WorkerRetryBackoff < time.Second {
+		return fmt.Errorf("WORKER_RETRY_BACKOFF must be at least 1s")
+	}
+	if c.WorkerHeartbeatTimeout < 3*time.Second {
+		return fmt.Errorf("WORKER_HEARTBEAT_TIMEOUT must be at least 3s")
+	}
+	if err := c.validateTrainingDefaults(); err != nil {
+		return err
+	}
+	if c.WorkerConcurrency < 1 {
+		return fmt.Errorf("WORKER_CONCURRENCY must be at least 1")
+	}
+	if c.EstimatedJobDuration <= 0 || c.QueueSoftLimit < 0 {
+		return fmt.Errorf("ESTIMATED_JOB_DURATION must be positive, and QUEUE_SOFT_LIMIT must not be negative")
+	}
+	if c.PollIntervalMin < time.Second || c.PollIntervalMax < c.PollIntervalMin {
+		return fmt.Errorf("POLL_INTERVAL_MIN must be at least 1s, and POLL_INTERVAL_MAX must not be less than POLL_INTERVAL_MIN")
+	}
+	if c.ReplayConcurrency < 1 {
+		return fmt.Errorf("REPLAY_CONCURRENCY must be at least 1")
+	}
+	if len(c.PipelineStages) == 0 {
+		return fmt.Errorf("PIPELINE_STAGES must not be empty")
+	}
+	for i, stage := range c.PipelineStages {
+		if !stageNamePattern.MatchString(stage) {
+			return fmt.Errorf("invalid stage %q in PIPELINE_STAGES: expected lowercase letters and digits", stage)
+		}
+		if slices.Contains(c.PipelineStages[:i], stage) {
+			return fmt.Errorf("stage %q appears several times in PIPELINE_STAGES", stage)
+		}
+	}
+	if c.CanaryPercent < 0 || c.CanaryPercent > 100 {
+		return fmt.Errorf("CANARY_PERCENT must be between 0 and 100")
+	}
+	if c.SyntheticStageDelay < 0 {
+		return fmt.Errorf("SYNTHETIC_STAGE_DELAY must not be negative")
+	}
+	if c.IntegrityCheckInterval < 0 {
+		return fmt.Errorf("INTEGRITY_CHECK_INTERVAL must not be negative")
+	}
+	if c.WorkerDataURLTTL <= 0 {
+		return fmt.Errorf("WORKER_DATA_URL_TTL must be positive")
+	}
+	if c.ArtifactMaxSize <= 0 || c.ArtifactDownloadBandwidth < 0 {
+		return fmt.Errorf("ARTIFACT_MAX_SIZE must be positive, and ARTIFACT_DOWNLOAD_BANDWIDTH must not be negative")
+	}
+	if c.ArtifactHookTimeout <= 0 {
+		return fmt.Errorf("ARTIFACT_HOOK_TIMEOUT must be positive")
+	}
+	if c.SceneCallbackTimeout <= 0 {
+		return fmt.Errorf("SCENE_CALLBACK_TIMEOUT must be positive")
+	}
+	if c.UploadMaxDuration < 0 || c.UploadMinFrames < 0 {
+		return fmt.Errorf("UPLOAD_MAX_DURATION and UPLOAD_MIN_FRAMES must not be negative")
+	}
+	if c.ThumbnailMaxSize <= 0 {
+		return fmt.Errorf("THUMBNAIL_MAX_SIZE must be positive")
+	}
+	if c.UploadMaxConcurrent < 0 {
+		return fmt.Errorf("UPLOAD_MAX_CONCURRENT must not be negative")
+	}
+	if c.UploadSessionTTL <= 0 {
+		return fmt.Errorf("UPLOAD_SESSION_TTL must be positive")
+	}
+	if c.SceneMaxVideos < 1 {
+		return fmt.Errorf("SCENE_MAX_VIDEOS must be at least 1")
+	}
+	if c.RemoteUploadTimeout <= 0 {
+		return fmt.Errorf("REMOTE_UPLOAD_TIMEOUT must be positive")
+	}
+	switch c.UploadScanner {
+	case "":
+	case "clamav":
+		if c.UploadScanClamdAddr == "" {
+			return fmt.Errorf("UPLOAD_SCAN_CLAMD_ADDR is required when UPLOAD_SCANNER is clamav")
+		}
+	case "command":
+		if c.UploadScanCommand == "" {
+			return fmt.Errorf("UPLOAD_SCAN_COMMAND is required when UPLOAD_SCANNER is command")
+		}
+	default:
+		return fmt.Errorf("invalid UPLOAD_SCANNER %q: expected clamav, command or empty", c.UploadScanner)
+	}
+	if c.UploadScanTimeout <= 0 {
+		return fmt.Errorf("UPLOAD_SCAN_TIMEOUT must be positive")
+	}
+	for name, action := range map[string]string{"UPLOAD_SCAN_ON_THREAT": c.UploadScanOnThreat, "UPLOAD_SCAN_ON_ERROR": c.UploadScanOnError} {
+		if action != "block" && action != "allow" {
+			return fmt.Errorf("invalid %s %q: expected block or allow", name, action)
+		}
+	}
+	if c.S3PartSize < 5*1024*1024 || c.S3PartSize > 5*1024*1024*1024 {
+		return fmt.Errorf("S3_PART_SIZE must be between 5MiB and 5GiB")
+	}
+	switch c.StorageBackend {
+	case "local":
+	case "s3":
+		if c.S3Endpoint == "" || c.S3Bucket == "" {
+			return fmt.Errorf("S3_ENDPOINT and S3_BUCKET are required when STORAGE_BACKEND=s3")
+		}
+	default:
+		return fmt.Errorf("invalid STORAGE_BACKEND %q: expected local or s3", c.StorageBackend)
+	}
+	switch c.ArchiveBackend {
+	case "", "local":
+	case "s3":
+		if c.S3Endpoint == "" || c.ArchiveS3Bucket == "" {
+			return fmt.Errorf("S3_ENDPOINT and ARCHIVE_S3_BUCKET are required when ARCHIVE_BACKEND=s3")
+		}
+	default:
+		return fmt.Errorf("invalid ARCHIVE_BACKEND %q: expected local, s3 or empty", c.ArchiveBackend)
+	}
+	if c.ArchiveAfter < 0 || (c.ArchiveAfter > 0 && c.ArchiveBackend == "") {
+		return fmt.Errorf("ARCHIVE_AFTER must not be negative, and requires ARCHIVE_BACKEND")
+	}
+	switch c.BackupBackend {
+	case "local":
+	case "s3":
+		if c.S3Endpoint == "" || c.BackupS3Bucket == "" {
+			return fmt.Errorf("S3_ENDPOINT and BACKUP_S3_BUCKET are required when BACKUP_BACKEND=s3")
+		}
+	default:
+		return fmt.Errorf("invalid BACKUP_BACKEND %q: expected local or s3", c.BackupBackend)
+	}
+	for tenant := range c.brandings {
+		if tenant != DefaultBrandingKey && (tenant == "" || !c.HasTenant(tenant)) {
+			return fmt.Errorf("BRANDING_FILE has a branding for %q, which is not a tenant of TENANTS", tenant)
+		}
+	}
+	return nil
+}
+
+// TenantForHost returns the tenant served at the given hostname, and whether the hostname is mapped to a tenant.
+// A port in host is ignored.
+func (c *Config) TenantForHost(host string) (string, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	tenant, ok := c.TenantHosts[strings.ToLower(host)]
+	return tenant, ok
+}
+
+// HasTenant checks if the given tenant is configured. The default tenant ("") always exists.
+func (c *Config) HasTenant(tenant string) bool {
+	if tenant == "" {
+		return true
+	}
+	for _, t := range c.TenantHosts {
+		if t == tenant {
+			return true
+		}
+	}
+	return false
+}
+
+// validateTrainingDefaults checks that the default training values form a valid training config,
+// so scenes submitted without them are not rejected by the workers.
+func (c *Config) validateTrainingDefaults() error {
+	if !(scene.Nerf{}).IsValidTrainingMode(c.DefaultTrainingMode) {
+		return fmt.Errorf("invalid DEFAULT_TRAINING_MODE %q: expected one of %v", c.DefaultTrainingMode, scene.ValidTrainingModes)
+	}
+	if c.DefaultTrainingMode == scene.TrainingModeTensorf {
+		return fmt.Errorf("DEFAULT_TRAINING_MODE %s is deprecated", scene.TrainingModeTensorf)
+	}
+	if len(c.DefaultOutputTypes) == 0 {
+		return fmt.Errorf("DEFAULT_OUTPUT_TYPES must not be empty")
+	}
+	for _, outputType := range c.DefaultOutputTypes {
+		if !(scene.Nerf{}).IsValidOutputType(c.DefaultTrainingMode, outputType) {
+			return fmt.Errorf("invalid DEFAULT_OUTPUT_TYPES entry %q for training mode %s", outputType, c.DefaultTrainingMode)
+		}
+	}
+	if c.DefaultTotalIterations < 1 || c.DefaultTotalIterations > scene.MaxIterations {
+		return fmt.Errorf("DEFAULT_TOTAL_ITERATIONS must be between 1 and %d", scene.MaxIterations)
+	}
+	if len(c.DefaultSaveIterations) == 0 {
+		return fmt.Errorf("DEFAULT_SAVE_ITERATIONS must not be empty")
+	}
+	for _, iteration := range c.DefaultSaveIterations {
+		if iteration < 1 || iteration > c.DefaultTotalIterations {
+			return fmt.Errorf("DEFAULT_SAVE_ITERATIONS entry %d must be between 1 and DEFAULT_TOTAL_ITERATIONS", iteration)
+		}
+	}
+	return nil
+}
+
+// getEnv returns the trimmed value of the environment variable, or def if it is unset or empty.
+func getEnv(key, def string) string {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+// getEnvBool parses the environment variable as a bool (i.e "true", "0"), or returns def if it is unset or empty.
+func getEnvBool(key string, def bool) (bool, error) {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return b, nil
+}
+
+// getEnvInt parses the environment variable as an integer, or returns def if it is unset or empty.
+func getEnvInt(key string, def int64) (int64, error) {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return def, nil
+	}
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return i, nil
+}
+
+// getEnvDuration parses the environment variable as a time.Duration (i.e "30s", "5m"), or returns def if it is unset or empty.
+func getEnvDuration(key string, def time.Duration) (time.Duration, error) {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return d, nil
+}
+
+// parseObjectIDList parses a comma-separated list of hex object IDs. Empty entries are ignored.
+func parseObjectIDList(value string) ([]primitive.ObjectID, error) {
+	ids := make([]primitive.ObjectID, 0)
+	for _, hex := range strings.Split(value, ",") {
+		hex = strings.TrimSpace(hex)
+		if hex == "" {
+			continue
+		}
+		id, err := primitive.ObjectIDFromHex(hex)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// parseList parses a comma-separated list of strings. Entries are trimmed and empty entries are ignored.
+func parseList(value string) []string {
+	list := make([]string, 0)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		list = append(list, entry)
+	}
+	return list
+}
+
+// parseIntList parses a comma-separated list of integers. Empty entries are ignored.
+func parseIntList(value string) ([]int, error) {
+	list := make([]int, 0)
+	for _, entry := range parseList(value) {
+		i, err := strconv.Atoi(entry)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, i)
+	}
+	return list, nil
+}
+
+// parseDurationMap parses a comma-separated list of <key>=<duration> entries. Durations must not be negative.
+func parseDurationMap(value string) (map[string]time.Duration, error) {
+	m := make(map[string]time.Duration)
+	for _, entry := range parseList(value) {
+		key, d, ok := strings.Cut(entry, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("expected <key>=<duration>, got %q", entry)
+		}
+		duration, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil || duration < 0 {
+			return nil, fmt.Errorf("invalid duration %q for %s", d, key)
+		}
+		m[key] = duration
+	}
+	return m, nil
+}
+
+// parseIntMap parses a comma-separated list of <key>=<int> entries. Values must not be negative.
+func parseIntMap(value string) (map[string]int, error) {
+	m := make(map[string]int)
+	for _, entry := range parseList(value) {
+		key, v, ok := strings.Cut(entry, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("expected <key>=<int>, got %q", entry)
+		}
+		i, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || i < 0 {
+			return nil, fmt.Errorf("invalid value %q for %s", v, key)
+		}
+		m[key] = i
+	}
+	return m, nil
+}
+
+// stageNamePattern matches valid pipeline stage names, which are used in queue names
+var stageNamePattern = regexp.MustCompile(`^[a-z][a-z0-9]{0,31}$`)
+
+// tenantIDPattern matches valid tenant IDs, which are used in storage keys
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// parseTenantHosts parses a comma-separated list of <tenant>=<host>|<host>... entries into a map of hostnames to tenants.
+// Hostnames are lowercased, and must not be mapped to several tenants.
+func parseTenantHosts(value string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, entry := range parseList(value) {
+		tenant, hosts, ok := strings.Cut(entry, "=")
+		tenant = strings.TrimSpace(tenant)
+		if !ok || !tenantIDPattern.MatchString(tenant) {
+			return nil, fmt.Errorf("expected <tenant>=<host>|<host>... with a lowercase alphanumeric tenant, got %q", entry)
+		}
+		for _, host := range strings.Split(hosts, "|") {
+			host = strings.ToLower(strings.TrimSpace(host))
+			if host == "" {
+				return nil, fmt.Errorf("empty host for tenant %s", tenant)
+			}
+			if other, ok := m[host]; ok && other != tenant {
+				return nil, fmt.Errorf("host %s is mapped to tenants %s and %s", host, other, tenant)
+			}
+			m[host] = tenant
+		}
+	}
+	return m, nil
+}
+
+// parseResolution parses a resolution in the form "<width>x<height>". An empty value returns 0, 0.
+func parseResolution(value string) (int, int, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, 0, nil
+	}
+	w, h, ok := strings.Cut(strings.ToLower(value), "x")
+	if !ok {
+		return 0, 0, fmt.Errorf("expected <width>x<height>, got %q", value)
+	}
+	width, err := strconv.Atoi(w)
+	if err != nil || width <= 0 {
+		return 0, 0, fmt.Errorf("invalid width %q", w)
+	}
+	height, err := strconv.Atoi(h)
+	if err != nil || height <= 0 {
+		return 0, 0, fmt.Errorf("invalid height %q", h)
+	}
+	return width, height, nil
+}
@@ -0,0 +1,195 @@
+// This file contains the Tunables, the settings that can be changed at runtime without restarting the server (and dropping
+// the active queue consumers), and the Reload function applying them.
+//
+// Reload re-reads EnvFile, with its values taking precedence over the environment the server was started with, then re-reads
+// the tunables from the environment. Other settings are only read at startup, and changing them still requires a restart.
+// Tunables are swapped atomically as a whole, so readers should get them once per use through Config.Tunables.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// EnvFile is the optional file environment variables are loaded from at startup, and re-read from on Reload.
+const EnvFile = "secrets/.env"
+
+// Tunables represents the settings of the web server that can be reloaded at runtime. They must not be modified once loaded.
+type Tunables struct {
+	// RateLimitWindow is the window login and registration requests are counted over. (RATE_LIMIT_WINDOW, default 15m)
+	RateLimitWindow time.Duration
+	// RateLimitPerIP is the number of login and registration requests a client IP can make per window. (RATE_LIMIT_PER_IP, default 50, 0 = unlimited)
+	RateLimitPerIP int
+	// RateLimitPerUsername is the number of login and registration requests for a single username per window.
+	// (RATE_LIMIT_PER_USERNAME, default 10, 0 = unlimited)
+	RateLimitPerUsername int
+	// UploadMaxSize is the maximum size of an uploaded video in bytes, unless the user has their own limit set by an admin.
+	// (UPLOAD_MAX_SIZE, default 16MiB)
+	UploadMaxSize int64
+	// CORSAllowOrigins are the origins browsers may call the API from. (CORS_ALLOW_ORIGINS, comma-separated, default "*" = any)
+	CORSAllowOrigins []string
+	// LogLevel is the minimum level of logged entries: debug, info, warn or error. (LOG_LEVEL, default "debug")
+	LogLevel string
+	// LoadShedMaxInFlight is the number of requests in progress above which low priority requests are rejected.
+	// (LOAD_SHED_MAX_IN_FLIGHT, default 512, 0 = never)
+	LoadShedMaxInFlight int
+	// LoadShedMaxLag is the scheduling lag above which low priority requests are rejected. (LOAD_SHED_MAX_LAG, default 100ms, 0 = never)
+	LoadShedMaxLag time.Duration
+	// QuotaMaxStorageBytes is the number of bytes the scenes of a user may use in storage before new scenes are rejected.
+	// (QUOTA_MAX_STORAGE_BYTES, default 0 = unlimited)
+	QuotaMaxStorageBytes int64
+	// QuotaMaxActiveScenes is the number of scenes of a user that may be queued or processing at once. (QUOTA_MAX_ACTIVE_SCENES, default 0 = unlimited)
+	QuotaMaxActiveScenes int
+	// QuotaMaxScenesPerDay is the number of scenes a user may create per UTC day. (QUOTA_MAX_SCENES_PER_DAY, default 0 = unlimited)
+	QuotaMaxScenesPerDay int
+}
+
+// Tunables returns the current tunables.
+func (c *Config) Tunables() *Tunables {
+	return c.tunables.Load()
+}
+
+// Reload re-reads EnvFile and the tunables from the environment, and applies them if they are valid.
+//
+// Returns the environment variables of the tunables that changed, error if the file or a variable is malformed,
+// in which case the current tunables are kept.
+func (c *Config) Reload() ([]string, error) {
+	if err := godotenv.Overload(EnvFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read %s: %v", EnvFile, err)
+	}
+	tunables, err := loadTunables()
+	if err != nil {
+		return nil, err
+	}
+	if err := tunables.validate(); err != nil {
+		return nil, err
+	}
+
+	previous := c.tunables.Swap(tunables)
+	return previous.changes(tunables), nil
+}
+
+// loadTunables reads the tunables from environment variables.
+func loadTunables() (*Tunables, error) {
+	t := &Tunables{
+		CORSAllowOrigins: parseList(getEnv("CORS_ALLOW_ORIGINS", "*")),
+		LogLevel:         getEnv("LOG_LEVEL", "debug"),
+	}
+
+	var err error
+	t.RateLimitWindow, err = getEnvDuration("RATE_LIMIT_WINDOW", 15*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	rateLimitPerIP, err := getEnvInt("RATE_LIMIT_PER_IP", 50)
+	if err != nil {
+		return nil, err
+	}
+	t.RateLimitPerIP = int(rateLimitPerIP)
+	rateLimitPerUsername, err := getEnvInt("RATE_LIMIT_PER_USERNAME", 10)
+	if err != nil {
+		return nil, err
+	}
+	t.RateLimitPerUsername = int(rateLimitPerUsername)
+	t.UploadMaxSize, err = getEnvInt("UPLOAD_MAX_SIZE", 16*1024*1024)
+	if err != nil {
+		return nil, err
+	}
+	loadShedMaxInFlight, err := getEnvInt("LOAD_SHED_MAX_IN_FLIGHT", 512)
+	if err != nil {
+		return nil, err
+	}
+	t.LoadShedMaxInFlight = int(loadShedMaxInFlight)
+	t.LoadShedMaxLag, err = getEnvDuration("LOAD_SHED_MAX_LAG", 100*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	t.QuotaMaxStorageBytes, err = getEnvInt("QUOTA_MAX_STORAGE_BYTES", 0)
+	if err != nil {
+		return nil, err
+	}
+	quotaMaxActiveScenes, err := getEnvInt("QUOTA_MAX_ACTIVE_SCENES", 0)
+	if err != nil {
+		return nil, err
+	}
+	t.QuotaMaxActiveScenes = int(quotaMaxActiveScenes)
+	quotaMaxScenesPerDay, err := getEnvInt("QUOTA_MAX_SCENES_PER_DAY", 0)
+	if err != nil {
+		return nil, err
+	}
+	t.QuotaMaxScenesPerDay = int(quotaMaxScenesPerDay)
+	return t, nil
+}
+
+// validate checks the tunables for values that would prevent the server from working.
+func (t *Tunables) validate() error {
+	if t.RateLimitWindow <= 0 || t.RateLimitPerIP < 0 || t.RateLimitPerUsername < 0 {
+		return fmt.Errorf("RATE_LIMIT_WINDOW must be positive, and RATE_LIMIT_PER_IP / RATE_LIMIT_PER_USERNAME must not be negative")
+	}
+	if t.UploadMaxSize <= 0 {
+		return fmt.Errorf("UPLOAD_MAX_SIZE must be positive")
+	}
+	if len(t.CORSAllowOrigins) == 0 {
+		return fmt.Errorf("CORS_ALLOW_ORIGINS must not be empty, use \"*\" to allow any origin")
+	}
+	if !slices.Contains([]string{"debug", "info", "warn", "error"}, t.LogLevel) {
+		return fmt.Errorf("LOG_LEVEL must be debug, info, warn or error")
+	}
+	if t.LoadShedMaxInFlight < 0 || t.LoadShedMaxLag < 0 {
+		return fmt.Errorf("LOAD_SHED_MAX_IN_FLIGHT and LOAD_SHED_MAX_LAG must not be negative")
+	}
+	if t.QuotaMaxStorageBytes < 0 || t.QuotaMaxActiveScenes < 0 || t.QuotaMaxScenesPerDay < 0 {
+		return fmt.Errorf("QUOTA_MAX_STORAGE_BYTES, QUOTA_MAX_ACTIVE_SCENES and QUOTA_MAX_SCENES_PER_DAY must not be negative")
+	}
+	return nil
+}
+
+// AllowsOrigin checks if browsers may call the API from the given origin.
+func (t *Tunables) AllowsOrigin(origin string) bool {
+	return slices.Contains(t.CORSAllowOrigins, "*") || slices.Contains(t.CORSAllowOrigins, origin)
+}
+
+// changes returns the environment variables of the tunables that differ between t and other.
+func (t *Tunables) changes(other *Tunables) []string {
+	changed := make([]string, 0)
+	if t.RateLimitWindow != other.RateLimitWindow {
+		changed = append(changed, "RATE_LIMIT_WINDOW")
+	}
+	if t.RateLimitPerIP != other.RateLimitPerIP {
+		changed = append(changed, "RATE_LIMIT_PER_IP")
+	}
+	if t.RateLimitPerUsername != other.RateLimitPerUsername {
+		changed = append(changed, "RATE_LIMIT_PER_USERNAME")
+	}
+	if t.UploadMaxSize != other.UploadMaxSize {
+		changed = append(changed, "UPLOAD_MAX_SIZE")
+	}
+	if !slices.Equal(t.CORSAllowOrigins, other.CORSAllowOrigins) {
+		changed = append(changed, "CORS_ALLOW_ORIGINS")
+	}
+	if t.LogLevel != other.LogLevel {
+		changed = append(changed, "LOG_LEVEL")
+	}
+	if t.LoadShedMaxInFlight != other.LoadShedMaxInFlight {
+		changed = append(changed, "LOAD_SHED_MAX_IN_FLIGHT")
+	}
+	if t.LoadShedMaxLag != other.LoadShedMaxLag {
+		changed = append(changed, "LOAD_SHED_MAX_LAG")
+	}
+	if t.QuotaMaxStorageBytes != other.QuotaMaxStorageBytes {
+		changed = append(changed, "QUOTA_MAX_STORAGE_BYTES")
+	}
+	if t.QuotaMaxActiveScenes != other.QuotaMaxActiveScenes {
+		changed = append(changed, "QUOTA_MAX_ACTIVE_SCENES")
+	}
+	if t.QuotaMaxScenesPerDay != other.QuotaMaxScenesPerDay {
+		changed = append(changed, "QUOTA_MAX_SCENES_PER_DAY")
+	}
+	return changed
+}
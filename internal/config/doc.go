@@ -0,0 +1,5 @@
+// Package config contains the runtime configuration of the web server.
+// Configuration is read once at startup from environment variables (which may come from secrets/.env or docker compose),
+// validated, and then injected into any struct that needs it. Only the Tunables can be reloaded at runtime.
+// Secrets (credentials, signing keys) do not belong here, and should be read through the secrets package instead.
+package config
@@ -0,0 +1,289 @@
+// This file contains the simple bind of a DN, and the BER encoding of the few LDAP messages it exchanges (RFC 4511).
+
+package ldap
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Custom errors
+var (
+	// ErrInvalidCredentials is returned when the directory rejects the DN or password of a bind.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrUnsupportedURL is returned when the directory URL is not an ldap:// or ldaps:// URL.
+	ErrUnsupportedURL = errors.New("directory URL must be an ldap:// or ldaps:// URL")
+)
+
+// ResultError is returned when the directory answers an operation with a result code other than success
+type ResultError struct {
+	Code    int
+	Message string
+}
+
+func (e *ResultError) Error() string {
+	return fmt.Sprintf("ldap result code %d: %s", e.Code, e.Message)
+}
+
+// Result codes and BER tags of the messages exchanged
+const (
+	resultSuccess            = 0
+	resultInvalidCredentials = 49
+
+	tagInteger         = 0x02
+	tagOctetString     = 0x04
+	tagEnumerated      = 0x0a
+	tagSequence        = 0x30
+	tagBindRequest     = 0x60
+	tagBindResponse    = 0x61
+	tagUnbindRequest   = 0x42
+	tagExtendedRequest = 0x77
+	tagExtendedResp    = 0x78
+	tagSimpleAuth      = 0x80
+	tagRequestName     = 0x80
+
+	// startTLSOID is the name of the StartTLS extended operation
+	startTLSOID = "1.3.6.1.4.1.1466.20037"
+	// maxMessageSize bounds the responses read, which are small for the operations used
+	maxMessageSize = 1 << 20
+)
+
+// Bind verifies the password of the given DN with a simple bind against the directory at the given URL, then unbinds.
+// The deadline of ctx bounds the whole exchange. Empty passwords are rejected without contacting the directory, as
+// directories accept them as unauthenticated binds.
+//
+// Returns nil if the directory accepted the credentials, ErrInvalidCredentials if it rejected them, error otherwise.
+func Bind(ctx context.Context, rawURL, dn, password string, tlsConfig *tls.Config) error {
+	if dn == "" || password == "" {
+		return ErrInvalidCredentials
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Hostname() == "" {
+		return ErrUnsupportedURL
+	}
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = "389"
+		if u.Scheme == "ldaps" {
+			port = "636"
+		}
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if tlsConfig != nil {
+		config = tlsConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+
+	if u.Scheme == "ldap" {
+		// The password must not be sent before the connection is encrypted
+		request := tlv(tagExtendedRequest, tlv(tagRequestName, []byte(startTLSOID)))
+		if err := exchange(conn, bufio.NewReader(conn), 1, request, tagExtendedResp); err != nil {
+			return fmt.Errorf("starttls: %w", err)
+		}
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return err
+	}
+
+	request := tlv(tagBindRequest, concat(
+		tlv(tagInteger, []byte{3}),
+		tlv(tagOctetString, []byte(dn)),
+		tlv(tagSimpleAuth, []byte(password)),
+	))
+	err = exchange(tlsConn, bufio.NewReader(tlsConn), 2, request, tagBindResponse)
+	var resultErr *ResultError
+	if errors.As(err, &resultErr) && resultErr.Code == resultInvalidCredentials {
+		return ErrInvalidCredentials
+	}
+	if err != nil {
+		return err
+	}
+
+	// The unbind request has no response
+	tlsConn.Write(message(3, tlv(tagUnbindRequest, nil)))
+	return nil
+}
+
+// EscapeDN escapes the special characters of an attribute value, so it can be placed in a DN (RFC 4514).
+func EscapeDN(value string) string {
+	var b strings.Builder
+	for i, r := range value {
+		switch {
+		case strings.ContainsRune(",+\"\\<>;=", r),
+			r == ' ' && (i == 0 || i == len(value)-1),
+			r == '#' && i == 0:
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == 0:
+			b.WriteString("\\00")
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// exchange sends the given operation as the message with the given ID, and reads the response, which must be an
+// LDAPResult of the given tag.
+//
+// Returns nil if the result is success, ResultError otherwise.
+func exchange(w io.Writer, r *bufio.Reader, messageID int, operation []byte, responseTag byte) error {
+	if _, err := w.Write(message(messageID, operation)); err != nil {
+		return err
+	}
+
+	response, err := readMessage(r)
+	if err != nil {
+		return err
+	}
+	tag, id, rest, err := element(response)
+	if err != nil || tag != tagInteger || decodeInt(id) != messageID {
+		return fmt.Errorf("unexpected response to message %d", messageID)
+	}
+	tag, result, _, err := element(rest)
+	if err != nil || tag != responseTag {
+		return fmt.Errorf("unexpected response to message %d", messageID)
+	}
+
+	// LDAPResult ::= resultCode ENUMERATED, matchedDN LDAPDN, diagnosticMessage LDAPString, ...
+	tag, code, rest, err := element(result)
+	if err != nil || tag != tagEnumerated {
+		return fmt.Errorf("malformed result of message %d", messageID)
+	}
+	diagnostic := ""
+	if _, _, rest, err := element(rest); err == nil {
+		if _, value, _, err := element(rest); err == nil {
+			diagnostic = string(value)
+		}
+	}
+	if c := decodeInt(code); c != resultSuccess {
+		return &ResultError{Code: c, Message: diagnostic}
+	}
+	return nil
+}
+
+// message wraps an operation into an LDAPMessage with the given ID. IDs must be below 128.
+func message(messageID int, operation []byte) []byte {
+	return tlv(tagSequence, concat(tlv(tagInteger, []byte{byte(messageID)}), operation))
+}
+
+// readMessage reads a whole LDAPMessage, and returns its content.
+func readMessage(r *bufio.Reader) ([]byte, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if tag != tagSequence {
+		return nil, fmt.Errorf("unexpected message tag 0x%02x", tag)
+	}
+
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length := int(first)
+	if first&0x80 != 0 {
+		numBytes := int(first & 0x7f)
+		if numBytes == 0 || numBytes > 4 {
+			return nil, errors.New("unsupported message length")
+		}
+		length = 0
+		for range numBytes {
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length > maxMessageSize {
+		return nil, errors.New("message too large")
+	}
+
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// element splits the first BER element off b.
+//
+// Returns its tag, its content and the bytes following it, error if b does not start with a whole element.
+func element(b []byte) (byte, []byte, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	tag, length, offset := b[0], int(b[1]), 2
+	if b[1]&0x80 != 0 {
+		numBytes := int(b[1] & 0x7f)
+		if numBytes == 0 || numBytes > 4 || len(b) < 2+numBytes {
+			return 0, nil, nil, io.ErrUnexpectedEOF
+		}
+		length = 0
+		for _, lb := range b[2 : 2+numBytes] {
+			length = length<<8 | int(lb)
+		}
+		offset += numBytes
+	}
+	if length < 0 || len(b)-offset < length {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	return tag, b[offset : offset+length], b[offset+length:], nil
+}
+
+// tlv encodes a BER element with the given tag and content.
+func tlv(tag byte, content []byte) []byte {
+	return concat([]byte{tag}, encodeLength(len(content)), content)
+}
+
+// encodeLength encodes a BER length, in the short form below 128 and in the long form otherwise.
+func encodeLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+// decodeInt decodes the content of a non-negative BER integer or enumerated value.
+func decodeInt(b []byte) int {
+	n := 0
+	for _, v := range b {
+		n = n<<8 | int(v)
+	}
+	return n
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, part := range parts {
+		b = append(b, part...)
+	}
+	return b
+}
@@ -0,0 +1,6 @@
+// Package ldap contains a minimal, dependency free LDAP client verifying passwords against a directory.
+//
+// Only the simple bind operation is supported, which is all password logins need: a user is authenticated by binding with
+// their DN and password. Passwords are never sent in clear text, ldaps:// URLs connect over TLS, and ldap:// URLs upgrade
+// the connection with StartTLS before binding.
+package ldap
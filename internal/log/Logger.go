@@ -1,6 +1,8 @@
 package log
 
 import (
+	"sync/atomic"
+
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -8,9 +10,11 @@ import (
 // Logger is a wrapper around zap.SugaredLogger
 type Logger struct {
 	*zap.SugaredLogger
+	redact *atomic.Bool
+	level  zap.AtomicLevel
 }
 
-// NewLogger creates a new Logger instance
+// NewLogger creates a new Logger instance, redacting personal data and credentials until SetRedaction disables it
 func NewLogger(development, debug bool) (*Logger, error) {
 	var config zap.Config
 	if development {
@@ -28,13 +32,27 @@ func NewLogger(development, debug bool) (*Logger, error) {
 	config.OutputPaths = []string{"web-server.log"}
 	config.ErrorOutputPaths = []string{"web-server.log"}
 
-	zapLogger, err := config.Build()
+	redact := &atomic.Bool{}
+	redact.Store(true)
+	zapLogger, err := config.Build(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return &redactingCore{Core: core, redact: redact}
+	}))
 	if err != nil {
 		return nil, err
 	}
 
 	sugar := zapLogger.Sugar()
-	return &Logger{sugar}, nil
+	return &Logger{SugaredLogger: sugar, redact: redact, level: config.Level}, nil
+}
+
+// SetLevel changes the minimum level of logged entries at runtime: debug, info, warn or error.
+func (l *Logger) SetLevel(level string) error {
+	parsed, err := zapcore.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	l.level.SetLevel(parsed)
+	return nil
 }
 
 // Sync flushes any buffered log entries
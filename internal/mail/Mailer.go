@@ -0,0 +1,112 @@
+// This file contains the Mailer interface, the SMTP and log mailers, and the constructor selecting between them.
+
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/secrets"
+)
+
+// Custom errors
+var (
+	// ErrInvalidRecipient is returned when a recipient address is empty or contains a line break.
+	ErrInvalidRecipient = errors.New("invalid email recipient")
+)
+
+// Mailer is implemented by every mail backend.
+type Mailer interface {
+	// Send sends a plain text email with the given subject and body to a single recipient.
+	Send(ctx context.Context, to, subject, body string) error
+}
+
+// New creates the mailer selected by the configuration: an SMTPMailer if SMTP_HOST is set, a LogMailer otherwise.
+// The SMTP password is read from the secrets provider, and may be missing for servers without authentication.
+func New(ctx context.Context, cfg *config.Config, secretsProvider secrets.Provider, logger *log.Logger) (Mailer, error) {
+	if cfg.SMTPHost == "" {
+		return NewLogMailer(logger), nil
+	}
+
+	password := ""
+	if cfg.SMTPUsername != "" {
+		var err error
+		password, err = secretsProvider.GetSecret(ctx, secrets.SMTPPassword)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get SMTP password: %v", err)
+		}
+	}
+	return NewSMTPMailer(cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUsername, password, cfg.SMTPFrom), nil
+}
+
+// SMTPMailer sends emails through an SMTP server. STARTTLS is used whenever the server supports it.
+type SMTPMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+// NewSMTPMailer creates a new SMTPMailer. Authentication is disabled if username is empty.
+func NewSMTPMailer(host string, port int, username, password, from string) *SMTPMailer {
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &SMTPMailer{
+		addr: net.JoinHostPort(host, strconv.Itoa(port)),
+		auth: auth,
+		from: from,
+	}
+}
+
+// Send sends the email. The context is only checked before sending, as net/smtp does not support cancellation.
+func (m *SMTPMailer) Send(ctx context.Context, to, subject, body string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if to == "" || strings.ContainsAny(to, "\r\n") {
+		return ErrInvalidRecipient
+	}
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, buildMessage(m.from, to, subject, body))
+}
+
+// buildMessage formats a plain text email with the headers required by most servers.
+func buildMessage(from, to, subject, body string) []byte {
+	var b strings.Builder
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: " + to + "\r\n")
+	b.WriteString("Subject: " + strings.NewReplacer("\r", "", "\n", " ").Replace(subject) + "\r\n")
+	b.WriteString("Date: " + time.Now().UTC().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// LogMailer logs emails instead of sending them.
+type LogMailer struct {
+	logger *log.Logger
+}
+
+// NewLogMailer creates a new LogMailer.
+func NewLogMailer(logger *log.Logger) *LogMailer {
+	return &LogMailer{logger: logger}
+}
+
+// Send logs the recipient and subject of the email at debug level.
+func (m *LogMailer) Send(ctx context.Context, to, subject, body string) error {
+	if to == "" || strings.ContainsAny(to, "\r\n") {
+		return ErrInvalidRecipient
+	}
+	m.logger.Debugf("SMTP not configured, not sending email %q to %s", subject, m.logger.Redact(to))
+	return nil
+}
@@ -0,0 +1,8 @@
+// Package mail contains the Mailer abstraction used to send emails (i.e weekly digests) to users.
+//
+// Current mailers include:
+//   - SMTPMailer:
+//     Sends plain text emails through an SMTP server, authenticating with PLAIN auth when a username is configured
+//   - LogMailer:
+//     Logs emails instead of sending them, used when no SMTP server is configured (i.e development)
+package mail
@@ -0,0 +1,66 @@
+// This file contains the Announcement struct and its members.
+// Announcement is used to represent an admin broadcast that the frontend displays to every user.
+// An announcement is active when the current time falls inside its (optional) StartsAt/EndsAt window.
+
+package announcement
+
+import (
+	"errors"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Custom errors
+var (
+	// ErrInvalidLevel is returned when an announcement is given an unknown level.
+	ErrInvalidLevel = errors.New("invalid announcement level")
+	// ErrInvalidWindow is returned when an announcement ends before it starts.
+	ErrInvalidWindow = errors.New("announcement ends before it starts")
+)
+
+// Declarations for valid announcement levels
+const (
+	LevelInfo        = "info"
+	LevelWarning     = "warning"
+	LevelMaintenance = "maintenance"
+)
+
+var ValidLevels = []string{LevelInfo, LevelWarning, LevelMaintenance}
+
+// Announcement represents a broadcast message shown to users
+type Announcement struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Title     string             `bson:"title" json:"title"`
+	Body      string             `bson:"body" json:"body"`
+	Level     string             `bson:"level" json:"level"`
+	StartsAt  *time.Time         `bson:"starts_at,omitempty" json:"starts_at,omitempty"`
+	EndsAt    *time.Time         `bson:"ends_at,omitempty" json:"ends_at,omitempty"`
+	CreatedBy primitive.ObjectID `bson:"created_by" json:"created_by"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// Validate checks the level and display window of the announcement.
+// Returns nil if valid, ErrInvalidLevel or ErrInvalidWindow otherwise.
+func (a *Announcement) Validate() error {
+	if !slices.Contains(ValidLevels, a.Level) {
+		return ErrInvalidLevel
+	}
+	if a.StartsAt != nil && a.EndsAt != nil && a.EndsAt.Before(*a.StartsAt) {
+		return ErrInvalidWindow
+	}
+	return nil
+}
+
+// IsActiveAt checks if the announcement should be displayed at the given time.
+func (a *Announcement) IsActiveAt(t time.Time) bool {
+	if a.StartsAt != nil && t.Before(*a.StartsAt) {
+		return false
+	}
+	if a.EndsAt != nil && !t.Before(*a.EndsAt) {
+		return false
+	}
+	return true
+}
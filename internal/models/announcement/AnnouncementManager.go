@@ -0,0 +1,151 @@
+// This file contains the AnnouncementManager implementation, which is responsible for interacting with the MongoDB announcements collection.
+// The AnnouncementManager struct contains a pointer to the nerfdb.announcements MongoDB collection and a logger. It provides methods to
+// create, get, update, list and delete announcements. Interaction with announcements is almost always by ID.
+
+package announcement
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/pagination"
+)
+
+// Custom errors
+var (
+	// ErrAnnouncementNotFound is returned when a requested announcement is not found in the database.
+	ErrAnnouncementNotFound = errors.New("announcement not found")
+)
+
+type AnnouncementManager struct {
+	collection *mongo.Collection
+	logger     *log.Logger
+}
+
+// NewAnnouncementManager creates a new AnnouncementManager with the given MongoDB client and logger.
+func NewAnnouncementManager(client *mongo.Client, logger *log.Logger, unittest bool) *AnnouncementManager {
+	return &AnnouncementManager{
+		collection: client.Database("nerfdb").Collection("announcements"),
+		logger:     logger,
+	}
+}
+
+// CreateAnnouncement validates and inserts a new announcement into the database.
+// The ID, CreatedAt and UpdatedAt fields are set by this function.
+func (am *AnnouncementManager) CreateAnnouncement(ctx context.Context, a *Announcement) error {
+	if err := a.Validate(); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	a.ID = primitive.NewObjectID()
+	a.CreatedAt = now
+	a.UpdatedAt = now
+
+	_, err := am.collection.InsertOne(ctx, a)
+	return err
+}
+
+// GetAnnouncement retrieves an announcement from the database by its ID.
+func (am *AnnouncementManager) GetAnnouncement(ctx context.Context, id primitive.ObjectID) (*Announcement, error) {
+	var a Announcement
+	err := am.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&a)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrAnnouncementNotFound
+		}
+		return nil, err
+	}
+	return &a, nil
+}
+
+// UpdateAnnouncement validates and replaces an existing announcement in the database.
+// CreatedAt and CreatedBy are preserved, UpdatedAt is set by this function.
+func (am *AnnouncementManager) UpdateAnnouncement(ctx context.Context, a *Announcement) error {
+	if err := a.Validate(); err != nil {
+		return err
+	}
+
+	a.UpdatedAt = time.Now().UTC()
+	result, err := am.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": a.ID},
+		bson.M{"$set": bson.M{
+			"title":      a.Title,
+			"body":       a.Body,
+			"level":      a.Level,
+			"starts_at":  a.StartsAt,
+			"ends_at":    a.EndsAt,
+			"updated_at": a.UpdatedAt,
+		}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrAnnouncementNotFound
+	}
+	return nil
+}
+
+// DeleteAnnouncement deletes an announcement from the database by its ID.
+func (am *AnnouncementManager) DeleteAnnouncement(ctx context.Context, id primitive.ObjectID) error {
+	result, err := am.collection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrAnnouncementNotFound
+	}
+	return nil
+}
+
+// ListAnnouncements returns the given page of all announcements, newest first, and the cursor of the next page.
+func (am *AnnouncementManager) ListAnnouncements(ctx context.Context, page pagination.Page) ([]*Announcement, string, error) {
+	cursor, err := am.collection.Find(ctx, page.Filter(bson.M{}), page.FindOptions())
+	if err != nil {
+		return nil, "", err
+	}
+
+	announcements := make([]*Announcement, 0)
+	if err := cursor.All(ctx, &announcements); err != nil {
+		return nil, "", err
+	}
+	announcements, next := pagination.Paginate(announcements, page, func(a *Announcement) primitive.ObjectID { return a.ID })
+	return announcements, next, nil
+}
+
+// ListActiveAnnouncements returns the announcements whose display window contains the given time, newest first.
+// A nil filter value matches both null and missing fields, so open-ended windows are included.
+func (am *AnnouncementManager) ListActiveAnnouncements(ctx context.Context, at time.Time) ([]*Announcement, error) {
+	filter := bson.M{
+		"$and": bson.A{
+			bson.M{"$or": bson.A{
+				bson.M{"starts_at": nil},
+				bson.M{"starts_at": bson.M{"$lte": at}},
+			}},
+			bson.M{"$or": bson.A{
+				bson.M{"ends_at": nil},
+				bson.M{"ends_at": bson.M{"$gt": at}},
+			}},
+		},
+	}
+
+	cursor, err := am.collection.Find(ctx, filter, options.Find().SetSort(bson.M{"created_at": -1}))
+	if err != nil {
+		return nil, err
+	}
+
+	announcements := make([]*Announcement, 0)
+	if err := cursor.All(ctx, &announcements); err != nil {
+		return nil, err
+	}
+	return announcements, nil
+}
@@ -0,0 +1,5 @@
+// Package announcement contains the implementation of interacting with the MongoDB announcements collection.
+// The AnnouncementManager struct is responsible for interacting with the MongoDB announcements collection. It is CRUD for the announcements collection.
+// The Announcement struct is used to represent a broadcast message (maintenance windows, new features, etc.) shown to users in-app.
+// Interaction is primarily by ID, as the ID will (almost always) be unique. BSON is used to interact with the database.
+package announcement
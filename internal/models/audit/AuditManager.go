@@ -0,0 +1,69 @@
+// This file contains the AuditManager implementation, which is responsible for interacting with the MongoDB audit collection.
+// The AuditManager struct contains a pointer to the nerfdb.audit MongoDB collection and a logger. It provides methods to
+// record entries, and to list the audit trail of a user.
+
+package audit
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/pagination"
+)
+
+type AuditManager struct {
+	collection *mongo.Collection
+	logger     *log.Logger
+}
+
+// NewAuditManager creates a new AuditManager with the given MongoDB client and logger.
+func NewAuditManager(client *mongo.Client, logger *log.Logger, unittest bool) *AuditManager {
+	return &AuditManager{
+		collection: client.Database("nerfdb").Collection("audit"),
+		logger:     logger,
+	}
+}
+
+// EnsureIndexes creates the indexes used to list the audit trail of a user.
+func (am *AuditManager) EnsureIndexes(ctx context.Context) error {
+	_, err := am.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "actor_id", Value: 1}, {Key: "_id", Value: -1}}},
+	})
+	return err
+}
+
+// RecordEntry inserts the given entry, with a new ID and timestamped now.
+func (am *AuditManager) RecordEntry(ctx context.Context, entry Entry) error {
+	entry.ID = primitive.NewObjectID()
+	entry.Timestamp = time.Now().UTC()
+	_, err := am.collection.InsertOne(ctx, &entry)
+	return err
+}
+
+// ListUserTrail returns the given page of entries concerning the given user, or performed by them, recorded before the given time,
+// newest first, and the cursor of the next page. A zero before lists the most recent entries.
+func (am *AuditManager) ListUserTrail(ctx context.Context, userID primitive.ObjectID, before time.Time, page pagination.Page) ([]Entry, string, error) {
+	filter := bson.M{"$or": bson.A{bson.M{"user_id": userID}, bson.M{"actor_id": userID}}}
+	if !before.IsZero() {
+		filter["timestamp"] = bson.M{"$lt": before}
+	}
+
+	cursor, err := am.collection.Find(ctx, page.Filter(filter), page.FindOptions())
+	if err != nil {
+		return nil, "", err
+	}
+	defer cursor.Close(ctx)
+
+	entries := make([]Entry, 0)
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, "", err
+	}
+	entries, next := pagination.Paginate(entries, page, func(e Entry) primitive.ObjectID { return e.ID })
+	return entries, next, nil
+}
@@ -0,0 +1,52 @@
+// This file contains the Entry struct and the declarations of the audited actions.
+
+package audit
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Declarations for audited actions
+const (
+	// ActionLogin is recorded when a user logs in. Details contain the login method (password or the OAuth provider).
+	ActionLogin = "login"
+	// ActionOAuthLinked is recorded when a user links an external (social login) account.
+	ActionOAuthLinked = "oauth_linked"
+	// ActionUsernameChanged is recorded when a user changes their username.
+	ActionUsernameChanged = "username_changed"
+	// ActionPasswordChanged is recorded when a user changes their password.
+	ActionPasswordChanged = "password_changed"
+	// ActionAccountDeletionRequested is recorded when a user deletes their account, whether it is removed now or scheduled.
+	ActionAccountDeletionRequested = "account_deletion_requested"
+	// ActionSceneCreated is recorded when a user submits a new scene.
+	ActionSceneCreated = "scene_created"
+	// ActionSceneDeleted is recorded when a scene is removed with all its files.
+	ActionSceneDeleted = "scene_deleted"
+	// ActionSceneTrashed is recorded when a user moves a scene to the trash.
+	ActionSceneTrashed = "scene_trashed"
+	// ActionSceneRestored is recorded when a user restores a scene from the trash.
+	ActionSceneRestored = "scene_restored"
+	// ActionSceneCancelled is recorded when a user cancels the processing of a scene.
+	ActionSceneCancelled = "scene_cancelled"
+	// ActionSceneShared is recorded when a user creates a public share link of a scene output. Details contain the output type and expiry.
+	ActionSceneShared = "scene_shared"
+	// ActionSceneVisibilityChanged is recorded when a user changes who can see a scene. Details contain the new visibility.
+	ActionSceneVisibilityChanged = "scene_visibility_changed"
+	// ActionAdmin is recorded when an admin changes anything through the admin routes. Details contain the operation.
+	ActionAdmin = "admin_action"
+)
+
+// Entry represents a single audited action.
+// ActorID is the user who performed the action (zero for actions of the server itself), UserID the account it concerns.
+type Entry struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	Action    string             `bson:"action" json:"action"`
+	ActorID   primitive.ObjectID `bson:"actor_id,omitempty" json:"actor_id,omitempty"`
+	UserID    primitive.ObjectID `bson:"user_id,omitempty" json:"user_id,omitempty"`
+	SceneID   primitive.ObjectID `bson:"scene_id,omitempty" json:"scene_id,omitempty"`
+	IP        string             `bson:"ip,omitempty" json:"ip,omitempty"`
+	Details   map[string]string  `bson:"details,omitempty" json:"details,omitempty"`
+	Timestamp time.Time          `bson:"timestamp" json:"timestamp"`
+}
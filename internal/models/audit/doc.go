@@ -0,0 +1,5 @@
+// Package audit contains the implementation of the audit log stored in the MongoDB audit collection.
+// The AuditManager struct is responsible for interacting with the MongoDB audit collection.
+// The Entry struct is used to represent a single security relevant action (i.e a login, a password change, a scene deletion,
+// or an admin action), who performed it, on which account, when and from which IP. Entries are never updated.
+package audit
@@ -0,0 +1,44 @@
+// This file contains the Manifest struct and its members.
+// A Manifest is written last, so a backup without one is incomplete and is never restored.
+
+package backup
+
+import "time"
+
+// Manifest describes a complete backup
+type Manifest struct {
+	ID          string       `json:"id"`
+	CreatedAt   time.Time    `json:"created_at"`
+	Collections []Collection `json:"collections"`
+	// Files are the artifact files referenced by the backed up scenes, and where they were found when backing up
+	Files []File `json:"files"`
+	// Missing are the referenced files that were already missing when backing up
+	Missing []string `json:"missing,omitempty"`
+}
+
+// Collection describes the dump of a single collection
+type Collection struct {
+	Name      string `json:"name"`
+	Key       string `json:"key"`
+	Documents int    `json:"documents"`
+	Bytes     int64  `json:"bytes"`
+	// SHA256 is the hex encoded checksum of the dump, verified before restoring it
+	SHA256 string `json:"sha256"`
+}
+
+// File is an artifact file referenced by a backed up scene
+type File struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+	// Storage is the storage the file is in: hot (artifact storage) or cold (archive storage)
+	Storage string `json:"storage"`
+}
+
+// Declarations for the storages a referenced file can be in
+const (
+	StorageHot  = "hot"
+	StorageCold = "cold"
+)
+
+// ManifestFileName is the name of the manifest in the backup storage, next to the dumps
+const ManifestFileName = "manifest.json"
@@ -0,0 +1,163 @@
+// This file contains the BackupManager implementation, which is responsible for exporting and restoring the backed up
+// MongoDB collections. Dumps are the raw BSON documents of a collection, concatenated in _id order (the mongodump format).
+//
+// Restoring loads a dump into a staging collection, then renames it over the live collection, so readers see either
+// the old or the restored documents, never a partially restored collection. Only the _id index survives the rename,
+// which is every index the backed up collections have.
+
+package backup
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+)
+
+// Custom errors
+var (
+	// ErrInvalidDump is returned when a dump is truncated or contains an invalid document.
+	ErrInvalidDump = errors.New("invalid collection dump")
+)
+
+// Collections are the collections included in every backup
+var Collections = []string{"users", "scenes", "queues"}
+
+// databaseName is the database of the backed up collections
+const databaseName = "nerfdb"
+
+// restoreBatch is the number of documents inserted at once while restoring
+const restoreBatch = 500
+
+// maxDocumentSize is the largest document MongoDB accepts, used to reject corrupt length prefixes
+const maxDocumentSize = 16 * 1024 * 1024
+
+type BackupManager struct {
+	client *mongo.Client
+	db     *mongo.Database
+	logger *log.Logger
+}
+
+// NewBackupManager creates a new BackupManager with the given MongoDB client and logger.
+func NewBackupManager(client *mongo.Client, logger *log.Logger, unittest bool) *BackupManager {
+	return &BackupManager{
+		client: client,
+		db:     client.Database(databaseName),
+		logger: logger,
+	}
+}
+
+// Export writes every document of the named collection to w.
+//
+// Returns the number of documents written, error otherwise.
+func (bm *BackupManager) Export(ctx context.Context, name string, w io.Writer) (int, error) {
+	cursor, err := bm.db.Collection(name).Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	count := 0
+	for cursor.Next(ctx) {
+		if _, err := w.Write(cursor.Current); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, cursor.Err()
+}
+
+// Import replaces the documents of the named collection with the documents of the dump read from r.
+// The live collection is only replaced once the whole dump was loaded.
+//
+// Returns the number of restored documents, ErrInvalidDump if the dump is corrupt, error otherwise.
+func (bm *BackupManager) Import(ctx context.Context, name string, r io.Reader) (int, error) {
+	staging := bm.db.Collection(name + "_restore")
+	if err := staging.Drop(ctx); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	batch := make([]interface{}, 0, restoreBatch)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if _, err := staging.InsertMany(ctx, batch); err != nil {
+			return err
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	err := ReadDump(r, func(doc bson.Raw) error {
+		batch = append(batch, doc)
+		count++
+		if len(batch) == restoreBatch {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err == nil && count == 0 {
+		// Renaming requires the staging collection to exist
+		err = bm.db.CreateCollection(ctx, staging.Name())
+	}
+	if err != nil {
+		if dropErr := staging.Drop(ctx); dropErr != nil {
+			bm.logger.Warnf("Failed to drop staging collection %s: %v", staging.Name(), dropErr)
+		}
+		return 0, err
+	}
+
+	err = bm.client.Database("admin").RunCommand(ctx, bson.D{
+		{Key: "renameCollection", Value: databaseName + "." + staging.Name()},
+		{Key: "to", Value: databaseName + "." + name},
+		{Key: "dropTarget", Value: true},
+	}).Err()
+	if err != nil {
+		return 0, fmt.Errorf("failed to replace collection %s: %w", name, err)
+	}
+	return count, nil
+}
+
+// ReadDump calls fn with every document of the dump read from r, in order, stopping at the first error.
+//
+// Returns ErrInvalidDump if the dump is truncated or contains an invalid document.
+func ReadDump(r io.Reader, fn func(doc bson.Raw) error) error {
+	var prefix [4]byte
+	for {
+		if _, err := io.ReadFull(r, prefix[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("%w: %v", ErrInvalidDump, err)
+		}
+
+		size := binary.LittleEndian.Uint32(prefix[:])
+		if size < 5 || size > maxDocumentSize {
+			return fmt.Errorf("%w: document size %d", ErrInvalidDump, size)
+		}
+		doc := make([]byte, size)
+		copy(doc, prefix[:])
+		if _, err := io.ReadFull(r, doc[4:]); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidDump, err)
+		}
+		if err := bson.Raw(doc).Validate(); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidDump, err)
+		}
+
+		if err := fn(doc); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,6 @@
+// Package backup contains the implementation of database backups, used for disaster recovery.
+// The BackupManager struct is responsible for exporting and restoring the documents of the backed up MongoDB collections.
+// The Manifest struct describes a backup: the collection dumps it contains, and the artifact files referenced by its scenes,
+// so a restore can verify that every file its documents point at is still present.
+// The dumps and the manifest themselves are stored in the backup storage, not in MongoDB.
+package backup
@@ -0,0 +1,30 @@
+// This file contains the DeadLetter struct and its members.
+// A dead letter holds everything needed to republish its message as the worker published it.
+
+package deadletter
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// DeadLetter represents a worker output message that was given up on
+type DeadLetter struct {
+	ID primitive.ObjectID `bson:"_id" json:"id"`
+	// Queue is the queue the message was consumed from, and is replayed to
+	Queue string `bson:"queue" json:"queue"`
+	// SceneID is the scene the message is about, if its body could be decoded
+	SceneID string `bson:"scene_id,omitempty" json:"scene_id,omitempty"`
+	// Error describes the last failure to process the message
+	Error string `bson:"error" json:"error"`
+	// Reason and Field are set if the message was rejected by schema validation: why, and the invalid field of its body
+	Reason string `bson:"reason,omitempty" json:"reason,omitempty"`
+	Field  string `bson:"field,omitempty" json:"field,omitempty"`
+	// Attempts is the number of times the message was processed
+	Attempts    int               `bson:"attempts" json:"attempts"`
+	ContentType string            `bson:"content_type,omitempty" json:"content_type,omitempty"`
+	Headers     map[string]string `bson:"headers,omitempty" json:"headers,omitempty"`
+	Body        string            `bson:"body" json:"body"`
+	CreatedAt   time.Time         `bson:"created_at" json:"created_at"`
+}
@@ -0,0 +1,99 @@
+// This file contains the DeadLetterManager implementation, which is responsible for interacting with the MongoDB dead_letters collection.
+// The DeadLetterManager struct contains a pointer to the nerfdb.dead_letters MongoDB collection and a logger. Dead letters are
+// taken out of the collection atomically, so a dead letter is never replayed twice.
+
+package deadletter
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/pagination"
+)
+
+// Custom errors
+var (
+	// ErrDeadLetterNotFound is returned when a dead letter does not exist, or was already replayed or discarded.
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+)
+
+type DeadLetterManager struct {
+	collection *mongo.Collection
+	logger     *log.Logger
+}
+
+// NewDeadLetterManager creates a new DeadLetterManager with the given MongoDB client and logger.
+func NewDeadLetterManager(client *mongo.Client, logger *log.Logger, unittest bool) *DeadLetterManager {
+	return &DeadLetterManager{
+		collection: client.Database("nerfdb").Collection("dead_letters"),
+		logger:     logger,
+	}
+}
+
+// CreateDeadLetter inserts the given dead letter, with a new ID and timestamped now.
+//
+// Returns the created DeadLetter if successful, error otherwise.
+func (dm *DeadLetterManager) CreateDeadLetter(ctx context.Context, dl DeadLetter) (*DeadLetter, error) {
+	dl.ID = primitive.NewObjectID()
+	dl.CreatedAt = time.Now().UTC()
+	if _, err := dm.collection.InsertOne(ctx, &dl); err != nil {
+		return nil, err
+	}
+	return &dl, nil
+}
+
+// RestoreDeadLetter inserts a dead letter taken out of the collection back, keeping its ID, i.e when it could not be replayed.
+func (dm *DeadLetterManager) RestoreDeadLetter(ctx context.Context, dl *DeadLetter) error {
+	_, err := dm.collection.InsertOne(ctx, dl)
+	return err
+}
+
+// GetDeadLetter retrieves a dead letter by its ID.
+//
+// Returns the DeadLetter if found, ErrDeadLetterNotFound if not, error otherwise.
+func (dm *DeadLetterManager) GetDeadLetter(ctx context.Context, id primitive.ObjectID) (*DeadLetter, error) {
+	var dl DeadLetter
+	if err := dm.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&dl); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrDeadLetterNotFound
+		}
+		return nil, err
+	}
+	return &dl, nil
+}
+
+// TakeDeadLetter removes a dead letter from the collection, and returns it.
+//
+// Returns the DeadLetter if found, ErrDeadLetterNotFound if not, error otherwise.
+func (dm *DeadLetterManager) TakeDeadLetter(ctx context.Context, id primitive.ObjectID) (*DeadLetter, error) {
+	var dl DeadLetter
+	if err := dm.collection.FindOneAndDelete(ctx, bson.M{"_id": id}).Decode(&dl); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrDeadLetterNotFound
+		}
+		return nil, err
+	}
+	return &dl, nil
+}
+
+// ListDeadLetters returns the given page of dead letters, newest first, and the cursor of the next page.
+func (dm *DeadLetterManager) ListDeadLetters(ctx context.Context, page pagination.Page) ([]*DeadLetter, string, error) {
+	cursor, err := dm.collection.Find(ctx, page.Filter(bson.M{}), page.FindOptions())
+	if err != nil {
+		return nil, "", err
+	}
+	defer cursor.Close(ctx)
+
+	deadLetters := make([]*DeadLetter, 0)
+	if err := cursor.All(ctx, &deadLetters); err != nil {
+		return nil, "", err
+	}
+	deadLetters, next := pagination.Paginate(deadLetters, page, func(dl *DeadLetter) primitive.ObjectID { return dl.ID })
+	return deadLetters, next, nil
+}
@@ -0,0 +1,5 @@
+// Package deadletter contains the implementation of dead letters stored in the MongoDB dead_letters collection.
+// The DeadLetterManager struct is responsible for interacting with the MongoDB dead_letters collection.
+// The DeadLetter struct is used to represent a worker output message whose processing failed permanently, kept with the
+// error that failed it, so admins can inspect it, and replay it once the cause is fixed, or discard it.
+package deadletter
@@ -0,0 +1,50 @@
+// This file contains the Event struct and the declarations of the event types.
+
+package event
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Declarations for event types
+const (
+	// TypeJobSubmitted is recorded when a user submits a new scene.
+	TypeJobSubmitted = "job_submitted"
+	// TypeJobCompleted is recorded when the last worker stage of a scene finished.
+	TypeJobCompleted = "job_completed"
+	// TypeJobFailed is recorded when a worker reports a failed stage.
+	TypeJobFailed = "job_failed"
+	// TypeArtifactStored is recorded when an artifact (video, frame, output) is written to storage. Bytes is the artifact size.
+	TypeArtifactStored = "artifact_stored"
+	// TypeSceneViewed is recorded when a shared output of a scene is loaded by a viewer.
+	TypeSceneViewed = "scene_viewed"
+	// TypeSceneDownloaded is recorded when a shared output of a scene is downloaded as a file.
+	TypeSceneDownloaded = "scene_downloaded"
+	// TypeScenePlayed is recorded when the shared video of a scene is played, i.e by an embedded player.
+	TypeScenePlayed = "scene_played"
+)
+
+// Event represents a single usage event
+type Event struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	Type      string             `bson:"type" json:"type"`
+	SceneID   primitive.ObjectID `bson:"scene_id,omitempty" json:"scene_id,omitempty"`
+	Bytes     int64              `bson:"bytes,omitempty" json:"bytes,omitempty"`
+	Timestamp time.Time          `bson:"timestamp" json:"timestamp"`
+}
+
+// DailyAggregate represents the number of events, and their summed bytes, of a single UTC day
+type DailyAggregate struct {
+	Day   string `bson:"_id" json:"day"`
+	Count int64  `bson:"count" json:"count"`
+	Bytes int64  `bson:"bytes" json:"bytes"`
+}
+
+// DailyTypeCount represents the number of events of a single type in a single UTC day
+type DailyTypeCount struct {
+	Day   string `bson:"day" json:"day"`
+	Type  string `bson:"type" json:"type"`
+	Count int64  `bson:"count" json:"count"`
+}
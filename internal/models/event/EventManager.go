@@ -0,0 +1,181 @@
+// This file contains the EventManager implementation, which is responsible for interacting with the MongoDB events collection.
+// The EventManager struct contains a pointer to the nerfdb.events MongoDB collection and a logger. It provides methods to
+// record events, and to aggregate them per day or per set of scenes.
+
+package event
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+)
+
+// DayFormat and mongoDayFormat are the format of DailyAggregate.Day, in Go and MongoDB $dateToString notation
+const (
+	DayFormat      = "2006-01-02"
+	mongoDayFormat = "%Y-%m-%d"
+)
+
+type EventManager struct {
+	collection *mongo.Collection
+	logger     *log.Logger
+}
+
+// NewEventManager creates a new EventManager with the given MongoDB client and logger.
+func NewEventManager(client *mongo.Client, logger *log.Logger, unittest bool) *EventManager {
+	return &EventManager{
+		collection: client.Database("nerfdb").Collection("events"),
+		logger:     logger,
+	}
+}
+
+// EnsureIndexes creates the indexes used by the daily and per scene aggregations.
+func (em *EventManager) EnsureIndexes(ctx context.Context) error {
+	_, err := em.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "type", Value: 1}, {Key: "timestamp", Value: 1}}},
+		{Keys: bson.D{{Key: "scene_id", Value: 1}, {Key: "type", Value: 1}}},
+	})
+	return err
+}
+
+// RecordEvent inserts a new event of the given type, timestamped now.
+func (em *EventManager) RecordEvent(ctx context.Context, eventType string, sceneID primitive.ObjectID, bytes int64) error {
+	_, err := em.collection.InsertOne(ctx, &Event{
+		ID:        primitive.NewObjectID(),
+		Type:      eventType,
+		SceneID:   sceneID,
+		Bytes:     bytes,
+		Timestamp: time.Now().UTC(),
+	})
+	return err
+}
+
+// GetRecentEvents retrieves the most recent events of the given type, newest first.
+func (em *EventManager) GetRecentEvents(ctx context.Context, eventType string, limit int64) ([]Event, error) {
+	cursor, err := em.collection.Find(
+		ctx,
+		bson.M{"type": eventType},
+		options.Find().SetSort(bson.M{"timestamp": -1}).SetLimit(limit),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	events := make([]Event, 0)
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// GetDailyAggregates counts the events of the given types per UTC day, starting at since.
+// Days without events are omitted.
+//
+// Returns the aggregates sorted by day.
+func (em *EventManager) GetDailyAggregates(ctx context.Context, eventTypes []string, since time.Time) ([]DailyAggregate, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"type":      bson.M{"$in": eventTypes},
+			"timestamp": bson.M{"$gte": since},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"$dateToString": bson.M{"format": mongoDayFormat, "date": "$timestamp"}},
+			"count": bson.M{"$sum": 1},
+			"bytes": bson.M{"$sum": "$bytes"},
+		}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	}
+
+	cursor, err := em.collection.Aggregate(ctx, pipeline, options.Aggregate())
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	aggregates := make([]DailyAggregate, 0)
+	if err := cursor.All(ctx, &aggregates); err != nil {
+		return nil, err
+	}
+	return aggregates, nil
+}
+
+// GetSceneDailyCounts counts the events of the given types recorded for the given scene per UTC day and type, starting at since.
+// Days without events are omitted.
+//
+// Returns the counts sorted by day.
+func (em *EventManager) GetSceneDailyCounts(ctx context.Context, sceneID primitive.ObjectID, eventTypes []string, since time.Time) ([]DailyTypeCount, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"scene_id":  sceneID,
+			"type":      bson.M{"$in": eventTypes},
+			"timestamp": bson.M{"$gte": since},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.M{
+				"day":  bson.M{"$dateToString": bson.M{"format": mongoDayFormat, "date": "$timestamp"}},
+				"type": "$type",
+			},
+			"count": bson.M{"$sum": 1},
+		}}},
+		{{Key: "$project", Value: bson.M{"_id": 0, "day": "$_id.day", "type": "$_id.type", "count": 1}}},
+		{{Key: "$sort", Value: bson.M{"day": 1}}},
+	}
+
+	cursor, err := em.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	counts := make([]DailyTypeCount, 0)
+	if err := cursor.All(ctx, &counts); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// GetSceneTotals counts the events of the given type recorded for any of the given scenes since the given time,
+// and sums their bytes. A zero since includes every event.
+func (em *EventManager) GetSceneTotals(ctx context.Context, eventType string, sceneIDs []primitive.ObjectID, since time.Time) (int64, int64, error) {
+	if len(sceneIDs) == 0 {
+		return 0, 0, nil
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"scene_id":  bson.M{"$in": sceneIDs},
+			"type":      eventType,
+			"timestamp": bson.M{"$gte": since},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   nil,
+			"count": bson.M{"$sum": 1},
+			"bytes": bson.M{"$sum": "$bytes"},
+		}}},
+	}
+
+	cursor, err := em.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var totals []struct {
+		Count int64 `bson:"count"`
+		Bytes int64 `bson:"bytes"`
+	}
+	if err := cursor.All(ctx, &totals); err != nil {
+		return 0, 0, err
+	}
+	if len(totals) == 0 {
+		return 0, 0, nil
+	}
+	return totals[0].Count, totals[0].Bytes, nil
+}
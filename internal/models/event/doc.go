@@ -0,0 +1,7 @@
+// Package event contains the implementation of usage events stored in the MongoDB events collection.
+// The EventManager struct is responsible for interacting with the MongoDB events collection.
+// The Event struct is used to represent a single, append-only record of something that happened in the processing pipeline
+// (a job was submitted, failed, completed, or an artifact was stored), which is aggregated for capacity planning, or of an
+// access to a shared scene, which is aggregated for the owner of the scene. Events record no user or client.
+// Events are never updated, and are only queried in aggregate.
+package event
@@ -0,0 +1,44 @@
+// This file contains the IntegrityCheck struct and its members.
+// A check moves from pending to running once the scheduler starts it, then to completed once every scene was checked,
+// or to failed if it was interrupted.
+
+package integrity
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Declarations for valid check statuses
+const (
+	StatusPending   = "pending"
+	StatusRunning   = "running"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+)
+
+// MaxReportedScenes is the maximum number of scenes with issues listed in a check, so the check document stays bounded.
+// ScenesWithIssues counts every scene.
+const MaxReportedScenes = 1000
+
+// IntegrityCheck represents a verification of the stored files of every scene
+type IntegrityCheck struct {
+	ID primitive.ObjectID `bson:"_id" json:"id"`
+	// RequestedBy is the admin who requested the check, NilObjectID for scheduled checks
+	RequestedBy primitive.ObjectID `bson:"requested_by" json:"requested_by,omitempty"`
+	Status      string             `bson:"status" json:"status"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+	StartedAt   *time.Time         `bson:"started_at,omitempty" json:"started_at,omitempty"`
+	// UpdatedAt is when the progress of a running check was last recorded, checks making no progress are failed
+	UpdatedAt  *time.Time `bson:"updated_at,omitempty" json:"updated_at,omitempty"`
+	FinishedAt *time.Time `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+	Error      string     `bson:"error,omitempty" json:"error,omitempty"`
+	// LastSceneID is the last scene checked, in ID order
+	LastSceneID      primitive.ObjectID   `bson:"last_scene_id" json:"-"`
+	ScenesChecked    int                  `bson:"scenes_checked" json:"scenes_checked"`
+	FilesChecked     int                  `bson:"files_checked" json:"files_checked"`
+	ScenesWithIssues int                  `bson:"scenes_with_issues" json:"scenes_with_issues"`
+	Issues           int                  `bson:"issues" json:"issues"`
+	IssueScenes      []primitive.ObjectID `bson:"issue_scenes" json:"issue_scenes"`
+}
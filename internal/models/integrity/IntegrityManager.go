@@ -0,0 +1,174 @@
+// This file contains the IntegrityManager implementation, which is responsible for interacting with the MongoDB integrity_checks collection.
+// The IntegrityManager struct contains a pointer to the nerfdb.integrity_checks MongoDB collection and a logger. Status transitions
+// are conditional on the current status of the check, so a check is never started or finished twice.
+
+package integrity
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/pagination"
+)
+
+// Custom errors
+var (
+	// ErrCheckNotFound is returned when an integrity check does not exist.
+	ErrCheckNotFound = errors.New("integrity check not found")
+)
+
+type IntegrityManager struct {
+	collection *mongo.Collection
+	logger     *log.Logger
+}
+
+// NewIntegrityManager creates a new IntegrityManager with the given MongoDB client and logger.
+func NewIntegrityManager(client *mongo.Client, logger *log.Logger, unittest bool) *IntegrityManager {
+	return &IntegrityManager{
+		collection: client.Database("nerfdb").Collection("integrity_checks"),
+		logger:     logger,
+	}
+}
+
+// CreateCheck inserts a new pending check, requested by the given admin (NilObjectID if scheduled).
+//
+// Returns the created IntegrityCheck if successful, error otherwise.
+func (im *IntegrityManager) CreateCheck(ctx context.Context, requestedBy primitive.ObjectID) (*IntegrityCheck, error) {
+	check := &IntegrityCheck{
+		ID:          primitive.NewObjectID(),
+		RequestedBy: requestedBy,
+		Status:      StatusPending,
+		CreatedAt:   time.Now().UTC(),
+		IssueScenes: make([]primitive.ObjectID, 0),
+	}
+	if _, err := im.collection.InsertOne(ctx, check); err != nil {
+		return nil, err
+	}
+	return check, nil
+}
+
+// GetCheck retrieves an integrity check by its ID.
+//
+// Returns the IntegrityCheck if found, ErrCheckNotFound if not, error otherwise.
+func (im *IntegrityManager) GetCheck(ctx context.Context, id primitive.ObjectID) (*IntegrityCheck, error) {
+	var check IntegrityCheck
+	if err := im.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&check); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrCheckNotFound
+		}
+		return nil, err
+	}
+	return &check, nil
+}
+
+// GetLatestCheck returns the most recently created check, nil if there is none.
+func (im *IntegrityManager) GetLatestCheck(ctx context.Context) (*IntegrityCheck, error) {
+	var check IntegrityCheck
+	err := im.collection.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.M{"_id": -1})).Decode(&check)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &check, nil
+}
+
+// ListChecks returns the given page of checks, newest first, and the cursor of the next page.
+func (im *IntegrityManager) ListChecks(ctx context.Context, page pagination.Page) ([]*IntegrityCheck, string, error) {
+	cursor, err := im.collection.Find(ctx, page.Filter(bson.M{}), page.FindOptions())
+	if err != nil {
+		return nil, "", err
+	}
+	defer cursor.Close(ctx)
+
+	checks := make([]*IntegrityCheck, 0)
+	if err := cursor.All(ctx, &checks); err != nil {
+		return nil, "", err
+	}
+	checks, next := pagination.Paginate(checks, page, func(c *IntegrityCheck) primitive.ObjectID { return c.ID })
+	return checks, next, nil
+}
+
+// HasActiveCheck checks if a check is pending or running.
+func (im *IntegrityManager) HasActiveCheck(ctx context.Context) (bool, error) {
+	count, err := im.collection.CountDocuments(ctx, bson.M{"status": bson.M{"$in": bson.A{StatusPending, StatusRunning}}}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// StartNextCheck moves the oldest pending check to running.
+//
+// Returns the started check, nil if no check is pending.
+func (im *IntegrityManager) StartNextCheck(ctx context.Context) (*IntegrityCheck, error) {
+	now := time.Now().UTC()
+	opts := options.FindOneAndUpdate().SetSort(bson.M{"_id": 1}).SetReturnDocument(options.After)
+	var check IntegrityCheck
+	err := im.collection.FindOneAndUpdate(
+		ctx,
+		bson.M{"status": StatusPending},
+		bson.M{"$set": bson.M{"status": StatusRunning, "started_at": now, "updated_at": now}},
+		opts,
+	).Decode(&check)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &check, nil
+}
+
+// UpdateProgress records the progress of a running check.
+func (im *IntegrityManager) UpdateProgress(ctx context.Context, check *IntegrityCheck) error {
+	_, err := im.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": check.ID, "status": StatusRunning},
+		bson.M{"$set": bson.M{
+			"updated_at":         time.Now().UTC(),
+			"last_scene_id":      check.LastSceneID,
+			"scenes_checked":     check.ScenesChecked,
+			"files_checked":      check.FilesChecked,
+			"scenes_with_issues": check.ScenesWithIssues,
+			"issues":             check.Issues,
+			"issue_scenes":       check.IssueScenes,
+		}},
+	)
+	return err
+}
+
+// FinishCheck records the final progress of a running check, and moves it to completed, or to failed if reason is not empty.
+func (im *IntegrityManager) FinishCheck(ctx context.Context, check *IntegrityCheck, reason string) error {
+	if err := im.UpdateProgress(ctx, check); err != nil {
+		return err
+	}
+	status := StatusCompleted
+	if reason != "" {
+		status = StatusFailed
+	}
+	_, err := im.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": check.ID, "status": StatusRunning},
+		bson.M{"$set": bson.M{"status": status, "error": reason, "finished_at": time.Now().UTC()}},
+	)
+	return err
+}
+
+// FailStaleChecks fails the running checks whose progress was last recorded before the given time, i.e whose instance stopped.
+func (im *IntegrityManager) FailStaleChecks(ctx context.Context, before time.Time) error {
+	_, err := im.collection.UpdateMany(
+		ctx,
+		bson.M{"status": StatusRunning, "updated_at": bson.M{"$lt": before}},
+		bson.M{"$set": bson.M{"status": StatusFailed, "error": "interrupted", "finished_at": time.Now().UTC()}},
+	)
+	return err
+}
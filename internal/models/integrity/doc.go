@@ -0,0 +1,5 @@
+// Package integrity contains the implementation of integrity checks stored in the MongoDB integrity_checks collection.
+// The IntegrityManager struct is responsible for interacting with the MongoDB integrity_checks collection.
+// The IntegrityCheck struct is used to represent a walk over every scene verifying that the files it references are stored with
+// the recorded size and checksum, requested by an admin or scheduled, and the summary of the discrepancies found.
+package integrity
@@ -0,0 +1,15 @@
+// This file contains the Lease struct and its members.
+// A Lease is held by HolderID until ExpiresAt. Holders are expected to renew the lease well before it expires;
+// an expired lease may be taken over by any other instance.
+
+package lease
+
+import "time"
+
+// Lease represents a named lock held by one instance until it expires
+type Lease struct {
+	Name       string    `bson:"_id"`
+	HolderID   string    `bson:"holder_id"`
+	AcquiredAt time.Time `bson:"acquired_at"`
+	ExpiresAt  time.Time `bson:"expires_at"`
+}
@@ -0,0 +1,103 @@
+// This file contains the LeaseManager implementation, which is responsible for interacting with the MongoDB leases collection.
+// The LeaseManager struct contains a pointer to the nerfdb.leases MongoDB collection and a logger. It provides methods to
+// acquire, renew and release leases. Acquisition relies on the unique _id index, so only one holder can win an expired lease.
+
+package lease
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+)
+
+// Custom errors
+var (
+	// ErrLeaseNotHeld is returned when an operation requires the caller to hold a lease it does not hold.
+	ErrLeaseNotHeld = errors.New("lease not held")
+)
+
+type LeaseManager struct {
+	collection *mongo.Collection
+	logger     *log.Logger
+}
+
+// NewLeaseManager creates a new LeaseManager with the given MongoDB client and logger.
+func NewLeaseManager(client *mongo.Client, logger *log.Logger, unittest bool) *LeaseManager {
+	return &LeaseManager{
+		collection: client.Database("nerfdb").Collection("leases"),
+		logger:     logger,
+	}
+}
+
+// TryAcquire acquires or renews the named lease for holderID for the given ttl.
+//
+// Returns true if holderID holds the lease after the call, false if another holder has an unexpired lease.
+func (lm *LeaseManager) TryAcquire(ctx context.Context, name, holderID string, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC()
+
+	// Matches if we already hold the lease, or the current holder let it expire
+	filter := bson.M{
+		"_id": name,
+		"$or": bson.A{
+			bson.M{"holder_id": holderID},
+			bson.M{"expires_at": bson.M{"$lte": now}},
+		},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"holder_id":  holderID,
+			"expires_at": now.Add(ttl),
+		},
+		"$setOnInsert": bson.M{"acquired_at": now},
+	}
+
+	var result Lease
+	err := lm.collection.FindOneAndUpdate(
+		ctx,
+		filter,
+		update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&result)
+	if err != nil {
+		// The upsert collides with the unexpired lease of another holder
+		if mongo.IsDuplicateKeyError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return result.HolderID == holderID, nil
+}
+
+// Release releases the named lease if it is held by holderID, so another instance can take over immediately.
+//
+// Returns ErrLeaseNotHeld if holderID does not hold the lease.
+func (lm *LeaseManager) Release(ctx context.Context, name, holderID string) error {
+	result, err := lm.collection.DeleteOne(ctx, bson.M{"_id": name, "holder_id": holderID})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrLeaseNotHeld
+	}
+	return nil
+}
+
+// GetLease retrieves the named lease, or ErrLeaseNotHeld if nobody holds it.
+func (lm *LeaseManager) GetLease(ctx context.Context, name string) (*Lease, error) {
+	var l Lease
+	err := lm.collection.FindOne(ctx, bson.M{"_id": name}).Decode(&l)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrLeaseNotHeld
+		}
+		return nil, err
+	}
+	return &l, nil
+}
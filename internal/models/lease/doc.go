@@ -0,0 +1,6 @@
+// Package lease contains the implementation of distributed leases stored in the MongoDB leases collection.
+// The LeaseManager struct is responsible for interacting with the MongoDB leases collection.
+// The Lease struct is used to represent a named, time-limited lock held by a single web-server instance,
+// which is used to elect a single instance for work that must not be done by several replicas at once (i.e consuming worker output).
+// Interaction is by lease name, which is used as the document ID.
+package lease
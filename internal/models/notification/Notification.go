@@ -0,0 +1,32 @@
+// This file contains the Notification struct and its members.
+
+package notification
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Declarations for valid notification types
+const (
+	// TypeQueuePosition is sent when a scene of the user advanced in the processing queue
+	TypeQueuePosition = "queue_position"
+)
+
+// Retention is how long notifications are kept before they expire
+const Retention = 7 * 24 * time.Hour
+
+// Notification represents an event of interest to a user. IDs increase in creation order, so they are used as stream cursors.
+type Notification struct {
+	ID      primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID  primitive.ObjectID `bson:"user_id" json:"-"`
+	Type    string             `bson:"type" json:"type"`
+	SceneID primitive.ObjectID `bson:"scene_id,omitempty" json:"scene_id,omitempty"`
+	// Position and QueueSize are the 0-based position of the scene in the processing queue and the size of the queue,
+	// for TypeQueuePosition
+	Position  int       `bson:"position" json:"position"`
+	QueueSize int       `bson:"queue_size" json:"queue_size"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	ExpiresAt time.Time `bson:"expires_at" json:"-"`
+}
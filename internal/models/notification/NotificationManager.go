@@ -0,0 +1,72 @@
+// This file contains the NotificationManager implementation, which is responsible for interacting with the MongoDB notifications collection.
+// The NotificationManager struct contains a pointer to the nerfdb.notifications MongoDB collection and a logger. It provides methods to
+// create notifications and list those of a user after a cursor. Expired notifications are removed by a TTL index.
+
+package notification
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+)
+
+type NotificationManager struct {
+	collection *mongo.Collection
+	logger     *log.Logger
+}
+
+// NewNotificationManager creates a new NotificationManager with the given MongoDB client and logger.
+func NewNotificationManager(client *mongo.Client, logger *log.Logger, unittest bool) *NotificationManager {
+	return &NotificationManager{
+		collection: client.Database("nerfdb").Collection("notifications"),
+		logger:     logger,
+	}
+}
+
+// EnsureIndexes creates the index listing the notifications of a user, and the TTL index removing expired notifications.
+func (nm *NotificationManager) EnsureIndexes(ctx context.Context) error {
+	_, err := nm.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "_id", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+// CreateNotification inserts a new notification into the database.
+// The ID, CreatedAt and ExpiresAt fields are set by this function.
+func (nm *NotificationManager) CreateNotification(ctx context.Context, n *Notification) error {
+	n.ID = primitive.NewObjectID()
+	n.CreatedAt = time.Now().UTC()
+	n.ExpiresAt = n.CreatedAt.Add(Retention)
+	_, err := nm.collection.InsertOne(ctx, n)
+	return err
+}
+
+// ListNotifications returns at most limit notifications of the given user created after the notification with the given ID
+// (from the oldest kept one if after is nil), oldest first.
+func (nm *NotificationManager) ListNotifications(ctx context.Context, userID, after primitive.ObjectID, limit int64) ([]Notification, error) {
+	filter := bson.M{"user_id": userID}
+	if !after.IsZero() {
+		filter["_id"] = bson.M{"$gt": after}
+	}
+	cursor, err := nm.collection.Find(ctx, filter, options.Find().SetSort(bson.M{"_id": 1}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	notifications := make([]Notification, 0)
+	if err := cursor.All(ctx, &notifications); err != nil {
+		return nil, err
+	}
+	return notifications, nil
+}
@@ -0,0 +1,6 @@
+// Package notification contains the implementation of the notification center, stored in the MongoDB notifications collection.
+// The NotificationManager struct is responsible for interacting with the MongoDB notifications collection.
+// The Notification struct is used to represent a single event of interest to a user (i.e their scene advancing in the queue),
+// which clients list or stream without polling the state of every scene. Notifications expire after a retention period.
+// Interaction is by user, in the order notifications were created.
+package notification
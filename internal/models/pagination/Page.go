@@ -0,0 +1,95 @@
+// This file contains the Page struct, and the encoding of the cursors of pages.
+
+package pagination
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Declarations for page sizes
+const (
+	DefaultLimit = 50
+	MaxLimit     = 200
+)
+
+// Custom errors
+var (
+	// ErrInvalidCursor is returned when a cursor was not returned by a previous page.
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// Page selects up to Limit items with an ID below After, newest first.
+// A zero After selects the first page, a zero Limit selects every item.
+type Page struct {
+	After primitive.ObjectID
+	Limit int64
+}
+
+// New creates the page selected by the cursor (empty for the first page) and limit (0 for the default limit) of a request.
+//
+// Returns ErrInvalidCursor if the cursor can not be decoded.
+func New(cursor string, limit int) (Page, error) {
+	page := Page{Limit: DefaultLimit}
+	if limit > 0 {
+		page.Limit = int64(min(limit, MaxLimit))
+	}
+	if cursor == "" {
+		return page, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(raw) != len(page.After) {
+		return Page{}, ErrInvalidCursor
+	}
+	copy(page.After[:], raw)
+	return page, nil
+}
+
+// EncodeCursor returns the cursor of the page following the item with the given ID.
+func EncodeCursor(id primitive.ObjectID) string {
+	return base64.RawURLEncoding.EncodeToString(id[:])
+}
+
+// Filter returns the given query filter restricted to the items of the page.
+func (p Page) Filter(filter bson.M) bson.M {
+	if !p.After.IsZero() {
+		filter["_id"] = bson.M{"$lt": p.After}
+	}
+	return filter
+}
+
+// FindOptions returns the options of a query for the items of the page: sorted newest first, with one item more than
+// the page holds, so Paginate can tell whether a next page exists.
+func (p Page) FindOptions() *options.FindOptions {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}})
+	if p.Limit > 0 {
+		opts.SetLimit(p.Limit + 1)
+	}
+	return opts
+}
+
+// Includes returns whether the item with the given ID may be on the page, i.e when paging a list already in memory.
+func (p Page) Includes(id primitive.ObjectID) bool {
+	return p.After.IsZero() || bytes.Compare(id[:], p.After[:]) < 0
+}
+
+// Full returns whether the given number of items is more than the page holds.
+func (p Page) Full(n int) bool {
+	return p.Limit > 0 && int64(n) > p.Limit
+}
+
+// Paginate trims items, fetched newest first with FindOptions (or Includes), to the page, and returns the cursor of the
+// next page, or "" if this page is the last one.
+func Paginate[T any](items []T, p Page, id func(T) primitive.ObjectID) ([]T, string) {
+	if !p.Full(len(items)) {
+		return items, ""
+	}
+	items = items[:p.Limit]
+	return items, EncodeCursor(id(items[len(items)-1]))
+}
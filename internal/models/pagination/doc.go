@@ -0,0 +1,5 @@
+// Package pagination contains the cursor-based pagination shared by every list endpoint.
+// Lists are ordered by ObjectID, newest first, and paged with an opaque cursor: the ID of the last item of the previous page.
+// Unlike offsets, cursors stay stable while items are added or removed. The Page struct selects a page, in a MongoDB query
+// (Filter, FindOptions) or in a list already in memory (Includes), and Paginate trims the fetched items and returns the next cursor.
+package pagination
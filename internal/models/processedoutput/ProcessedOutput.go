@@ -0,0 +1,18 @@
+// This file contains the ProcessedOutput struct and its members.
+
+package processedoutput
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ProcessedOutput represents a worker output message that was processed
+type ProcessedOutput struct {
+	// ID identifies the message, see Key
+	ID          string             `bson:"_id" json:"id"`
+	Queue       string             `bson:"queue" json:"queue"`
+	SceneID     primitive.ObjectID `bson:"scene_id" json:"scene_id"`
+	ProcessedAt time.Time          `bson:"processed_at" json:"processed_at"`
+}
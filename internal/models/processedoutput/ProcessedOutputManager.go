@@ -0,0 +1,90 @@
+// This file contains the ProcessedOutputManager implementation, which is responsible for interacting with the MongoDB
+// processed_outputs collection. The ProcessedOutputManager struct contains a pointer to the nerfdb.processed_outputs MongoDB
+// collection and a logger.
+
+package processedoutput
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+)
+
+// retention is how long a processed message is remembered
+const retention = 7 * 24 * time.Hour
+
+type ProcessedOutputManager struct {
+	collection *mongo.Collection
+	logger     *log.Logger
+}
+
+// NewProcessedOutputManager creates a new ProcessedOutputManager with the given MongoDB client and logger.
+func NewProcessedOutputManager(client *mongo.Client, logger *log.Logger, unittest bool) *ProcessedOutputManager {
+	return &ProcessedOutputManager{
+		collection: client.Database("nerfdb").Collection("processed_outputs"),
+		logger:     logger,
+	}
+}
+
+// EnsureIndexes creates the TTL index removing processed messages after retention, and the index of the messages of a scene.
+func (pm *ProcessedOutputManager) EnsureIndexes(ctx context.Context) error {
+	_, err := pm.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "processed_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(retention.Seconds())),
+		},
+		{Keys: bson.D{{Key: "scene_id", Value: 1}, {Key: "queue", Value: 1}}},
+	})
+	return err
+}
+
+// Key returns the ID of a message of the given queue: its message ID if the worker set one, otherwise the hash of its body,
+// so redeliveries and republished copies of a message have the same key. As a rerun of a job may produce the same message,
+// the messages of a scene are forgotten whenever its job is published again, see ForgetScene.
+func Key(queue, messageID string, body []byte) string {
+	if messageID != "" {
+		return queue + ":id:" + messageID
+	}
+	sum := sha256.Sum256(body)
+	return queue + ":sha256:" + hex.EncodeToString(sum[:])
+}
+
+// IsProcessed returns whether the message with the given key was processed.
+func (pm *ProcessedOutputManager) IsProcessed(ctx context.Context, key string) (bool, error) {
+	err := pm.collection.FindOne(ctx, bson.M{"_id": key}).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// MarkProcessed records the message with the given key, of the given queue and scene, as processed now.
+// Marking a message twice is not an error.
+func (pm *ProcessedOutputManager) MarkProcessed(ctx context.Context, key, queue string, sceneID primitive.ObjectID) error {
+	_, err := pm.collection.InsertOne(ctx, ProcessedOutput{
+		ID:          key,
+		Queue:       queue,
+		SceneID:     sceneID,
+		ProcessedAt: time.Now().UTC(),
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+// ForgetScene removes the processed messages of the given queue for the scene with the given ID, so the output of a new
+// job of the scene is processed even if it is identical to a processed one.
+func (pm *ProcessedOutputManager) ForgetScene(ctx context.Context, queue string, sceneID primitive.ObjectID) error {
+	_, err := pm.collection.DeleteMany(ctx, bson.M{"scene_id": sceneID, "queue": queue})
+	return err
+}
@@ -0,0 +1,7 @@
+// Package processedoutput contains the implementation of the registry of processed worker output, stored in the MongoDB
+// processed_outputs collection.
+// The ProcessedOutputManager struct is responsible for interacting with the MongoDB processed_outputs collection.
+// The ProcessedOutput struct is used to represent a worker output message that was processed, identified by its queue and
+// message ID (or the hash of its body), so a redelivered message is recognized and not processed twice. Entries are removed
+// a week after the message was processed, as brokers do not redeliver messages that long after.
+package processedoutput
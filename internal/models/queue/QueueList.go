@@ -1,13 +1,34 @@
 // This file contains the QueueList struct and its members
 // QueueList is used to represent a list of items in a queue, and is (currently) used for reporting job processing progress.
+// Items are ordered by priority, then by the time they were queued.
 
 package queue
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
 
 // QueueList represents a list of items in a queue.
 // Used for reporting job processing progress.
 type QueueList struct {
 	ID    string               `bson:"_id"`
 	Queue []primitive.ObjectID `bson:"queue"`
+	// Priorities maps the hex IDs of the items queued with a priority to it, items without one have priority 0
+	Priorities map[string]int `bson:"priorities,omitempty"`
+	// Queued maps the hex IDs of the items to when they were queued, or their job last published again
+	Queued map[string]time.Time `bson:"queued,omitempty"`
+	// Started maps the hex IDs of the items a worker reported processing to the worker, see MarkStarted
+	Started map[string]ItemStart `bson:"started,omitempty"`
+	// Requeues maps the hex IDs of the requeued items to the number of times they were requeued
+	Requeues map[string]int `bson:"requeues,omitempty"`
+}
+
+// ItemStart represents the worker processing an item of a queue
+type ItemStart struct {
+	WorkerID string `bson:"worker_id"`
+	// At is when the worker started processing the item, ReportedAt when it last reported processing it
+	At         time.Time `bson:"at"`
+	ReportedAt time.Time `bson:"reported_at"`
 }
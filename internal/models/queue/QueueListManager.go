@@ -3,6 +3,9 @@
 // get queue data from the database. Interaction with queues is almost always by ID, as the ID will (almost always) be unique.
 
 // Note that the only valid queues are those in the queueNames slice.
+//
+// Items queued with a priority are inserted ahead of the items of a lower priority, so the queue lists are in the order
+// the broker delivers jobs of priority queues in, and queue positions reflect it.
 
 package queue
 
@@ -11,6 +14,7 @@ import (
 	"errors"
 	"fmt"
 	"slices"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -20,6 +24,9 @@ import (
 	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
 )
 
+// maxInsertAttempts is the number of times inserting an item with a priority is attempted while the queue changes concurrently
+const maxInsertAttempts = 10
+
 // Custom errors
 var (
 	// ErrInvalidQueueID is returned when an invalid queue ID is used.
@@ -88,8 +95,18 @@ func (qlm *QueueListManager) AddNewQueue(ctx context.Context, queueID string) er
 	return qlm.setQueue(ctx, queueID, &queueList)
 }
 
+// RegisterQueue adds the queue ID to qlm.queueNames if it is not already valid, without modifying the queue in the database,
+// so a queue that already has items keeps them. The queue is created by its first insertion.
+// It is not safe for concurrent use with other operations, and is intended to be called on startup.
+func (qlm *QueueListManager) RegisterQueue(queueID string) {
+	if !slices.Contains(qlm.queueNames, queueID) {
+		qlm.queueNames = append(qlm.queueNames, queueID)
+	}
+}
+
 // GetQueuePosition gets the position of itemID in the queue by the queue ID.
-// Returns the position of the item in the queue and the total number of items in the queue.
+// Returns the position of the item in the queue and the total number of items in the queue, or ErrIDNotFoundInQueue if the
+// item is not in the queue, including when the queue was not created yet.
 func (qlm *QueueListManager) GetQueuePosition(ctx context.Context, queueID string, itemID primitive.ObjectID) (int, int, error) {
 	if !slices.Contains(qlm.queueNames, queueID) {
 		return 0, 0, ErrInvalidQueueID
@@ -97,6 +114,9 @@ func (qlm *QueueListManager) GetQueuePosition(ctx context.Context, queueID strin
 
 	var queueList QueueList
 	err := qlm.collection.FindOne(ctx, bson.M{"_id": queueID}).Decode(&queueList)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, 0, ErrIDNotFoundInQueue
+	}
 	if err != nil {
 		return 0, 0, err
 	}
@@ -133,60 +153,316 @@ func (qlm *QueueListManager) GetQueueSize(ctx context.Context, queueID string) (
 	return len(queueList.Queue), nil
 }
 
-// AppendToQueue appends a item's ID to the queue by the queue ID.
+// GetQueueItems returns the IDs of the items in the queue by the queue ID, in queue order.
+func (qlm *QueueListManager) GetQueueItems(ctx context.Context, queueID string) ([]primitive.ObjectID, error) {
+	if !slices.Contains(qlm.queueNames, queueID) {
+		return nil, ErrInvalidQueueID
+	}
+
+	var queueList QueueList
+	err := qlm.collection.FindOne(ctx, bson.M{"_id": queueID}).Decode(&queueList)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return []primitive.ObjectID{}, nil
+		}
+		return nil, err
+	}
+
+	if queueList.Queue == nil {
+		return []primitive.ObjectID{}, nil
+	}
+	return queueList.Queue, nil
+}
+
+// AppendToQueue appends a item's ID to the queue by the queue ID, and records when it was queued.
 // Returns ErrIDAlreadyInQueue if the itemID is already in the queue.
 // If the queue does not exist, and queueID is valid, it is created, and the item is added.
+//
+// The membership check and the append are a single atomic update, so concurrent appends of the same itemID
+// (i.e a job republished while it is still queued) succeed exactly once.
 func (qlm *QueueListManager) AppendToQueue(ctx context.Context, queueID string, itemID primitive.ObjectID) error {
 	if !slices.Contains(qlm.queueNames, queueID) {
 		qlm.logger.Info("Invalid queue ID")
 		return ErrInvalidQueueID
 	}
 
+	// Only matches the queue if the item is not in it. Otherwise the upsert collides with the existing queue
+	_, err := qlm.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": queueID, "queue": bson.M{"$ne": itemID}},
+		bson.M{
+			"$push": bson.M{"queue": itemID},
+			"$set":  bson.M{"queued." + itemID.Hex(): time.Now().UTC()},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		qlm.logger.Info(fmt.Sprintf("Attemped to add %s to queue %s, but it is already in the queue", itemID, queueID))
+		return ErrIDAlreadyInQueue
+	}
+	return err
+}
+
+// InsertWithPriority inserts a item's ID into the queue by the queue ID, behind the items of the same or a higher priority,
+// and ahead of those of a lower priority, and records when it was queued. Items appended without a priority have priority 0.
+// Returns ErrIDAlreadyInQueue if the itemID is already in the queue.
+// If the queue does not exist, and queueID is valid, it is created, and the item is added.
+//
+// The position is computed from the queue as read, and the insert only applies if the queue is still unchanged, so
+// concurrent inserts of the same itemID succeed exactly once. Inserts conflicting with a concurrent change are retried.
+func (qlm *QueueListManager) InsertWithPriority(ctx context.Context, queueID string, itemID primitive.ObjectID, priority int) error {
+	if !slices.Contains(qlm.queueNames, queueID) {
+		qlm.logger.Info("Invalid queue ID")
+		return ErrInvalidQueueID
+	}
+
+	for range maxInsertAttempts {
+		var queueList QueueList
+		err := qlm.collection.FindOne(ctx, bson.M{"_id": queueID}).Decode(&queueList)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			if err := qlm.AppendToQueue(ctx, queueID, itemID); err != nil {
+				return err
+			}
+			return qlm.setPriority(ctx, queueID, itemID, priority)
+		}
+		if err != nil {
+			return err
+		}
+		if slices.Contains(queueList.Queue, itemID) {
+			qlm.logger.Info(fmt.Sprintf("Attemped to add %s to queue %s, but it is already in the queue", itemID, queueID))
+			return ErrIDAlreadyInQueue
+		}
+
+		position := len(queueList.Queue)
+		for i, id := range queueList.Queue {
+			if queueList.Priorities[id.Hex()] < priority {
+				position = i
+				break
+			}
+		}
+		fields := bson.M{"queued." + itemID.Hex(): time.Now().UTC()}
+		if priority != 0 {
+			fields["priorities."+itemID.Hex()] = priority
+		}
+		update := bson.M{
+			"$push": bson.M{"queue": bson.M{"$each": bson.A{itemID}, "$position": position}},
+			"$set":  fields,
+		}
+
+		result, err := qlm.collection.UpdateOne(ctx, bson.M{"_id": queueID, "queue": queueList.Queue}, update)
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 1 {
+			return nil
+		}
+	}
+	return fmt.Errorf("queue %s changed concurrently %d times while inserting %s", queueID, maxInsertAttempts, itemID.Hex())
+}
+
+// setPriority records the priority of an item of the queue by the queue ID. Priority 0 is not recorded.
+func (qlm *QueueListManager) setPriority(ctx context.Context, queueID string, itemID primitive.ObjectID, priority int) error {
+	if priority == 0 {
+		return nil
+	}
+	_, err := qlm.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": queueID, "queue": itemID},
+		bson.M{"$set": bson.M{"priorities." + itemID.Hex(): priority}},
+	)
+	return err
+}
+
+// itemFields returns the fields recorded for the given item besides its position, to unset once it leaves the queue.
+func itemFields(itemID primitive.ObjectID) bson.M {
+	return bson.M{
+		"priorities." + itemID.Hex(): "",
+		"queued." + itemID.Hex():     "",
+		"started." + itemID.Hex():    "",
+		"requeues." + itemID.Hex():   "",
+	}
+}
+
+// MarkStarted records that the worker with the given ID reported processing the itemID of the queue by the queue ID.
+// The first worker reporting the item is recorded as processing it from now on. Another worker only takes over once the
+// recorded worker did not report the item for staleAfter (i.e the job was redelivered after its worker died), which restarts
+// the processing time of the item. Does nothing if the itemID is not in the queue.
+func (qlm *QueueListManager) MarkStarted(ctx context.Context, queueID string, itemID primitive.ObjectID, workerID string, staleAfter time.Duration) error {
+	if !slices.Contains(qlm.queueNames, queueID) {
+		return ErrInvalidQueueID
+	}
+
+	field := "started." + itemID.Hex()
+	now := time.Now().UTC()
+	result, err := qlm.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": queueID, "queue": itemID, field + ".worker_id": workerID},
+		bson.M{"$set": bson.M{field + ".reported_at": now}},
+	)
+	if err != nil || result.MatchedCount > 0 {
+		return err
+	}
+
+	_, err = qlm.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": queueID, "queue": itemID, "$or": bson.A{
+			bson.M{field: bson.M{"$exists": false}},
+			bson.M{field + ".reported_at": bson.M{"$lt": now.Add(-staleAfter)}},
+		}},
+		bson.M{"$set": bson.M{field: ItemStart{WorkerID: workerID, At: now, ReportedAt: now}}},
+	)
+	return err
+}
+
+// ItemsStartedBefore returns the items of the queue by the queue ID a worker started processing before the given time,
+// with the worker processing them. Items no worker reported processing are not returned.
+func (qlm *QueueListManager) ItemsStartedBefore(ctx context.Context, queueID string, before time.Time) (map[primitive.ObjectID]ItemStart, error) {
+	if !slices.Contains(qlm.queueNames, queueID) {
+		return nil, ErrInvalidQueueID
+	}
+
 	var queueList QueueList
 	err := qlm.collection.FindOne(ctx, bson.M{"_id": queueID}).Decode(&queueList)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
 	if err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
-			queueList = QueueList{ID: queueID, Queue: []primitive.ObjectID{itemID}}
-			return qlm.setQueue(ctx, queueID, &queueList)
+		return nil, err
+	}
+
+	items := make(map[primitive.ObjectID]ItemStart)
+	for _, id := range queueList.Queue {
+		if start, ok := queueList.Started[id.Hex()]; ok && start.At.Before(before) {
+			items[id] = start
 		}
-		return err
 	}
+	return items, nil
+}
 
-	if slices.Contains(queueList.Queue, itemID) {
-		qlm.logger.Info(fmt.Sprintf("Attemped to add %s to queue %s, but it is already in the queue", itemID, queueID))
-		return ErrIDAlreadyInQueue
+// ItemsQueuedBefore returns the items of the queue by the queue ID queued (or whose job was last published again) before the
+// given time, that no worker reported processing. Items queued before their queue time was recorded are not returned.
+func (qlm *QueueListManager) ItemsQueuedBefore(ctx context.Context, queueID string, before time.Time) ([]primitive.ObjectID, error) {
+	if !slices.Contains(qlm.queueNames, queueID) {
+		return nil, ErrInvalidQueueID
 	}
 
-	queueList.Queue = append(queueList.Queue, itemID)
-	return qlm.setQueue(ctx, queueID, &queueList)
+	var queueList QueueList
+	err := qlm.collection.FindOne(ctx, bson.M{"_id": queueID}).Decode(&queueList)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var items []primitive.ObjectID
+	for _, id := range queueList.Queue {
+		if _, started := queueList.Started[id.Hex()]; started {
+			continue
+		}
+		if queued, ok := queueList.Queued[id.Hex()]; ok && queued.Before(before) {
+			items = append(items, id)
+		}
+	}
+	return items, nil
+}
+
+// MarkRequeued records that the job of the itemID of the queue by the queue ID was published again: the worker processing
+// it is cleared, its queue time restarted, and its number of requeues incremented. The item keeps its position.
+// Returns the number of times the item was requeued, or ErrIDNotFoundInQueue if the itemID is not in the queue.
+func (qlm *QueueListManager) MarkRequeued(ctx context.Context, queueID string, itemID primitive.ObjectID) (int, error) {
+	if !slices.Contains(qlm.queueNames, queueID) {
+		return 0, ErrInvalidQueueID
+	}
+
+	var queueList QueueList
+	err := qlm.collection.FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": queueID, "queue": itemID},
+		bson.M{
+			"$unset": bson.M{"started." + itemID.Hex(): ""},
+			"$set":   bson.M{"queued." + itemID.Hex(): time.Now().UTC()},
+			"$inc":   bson.M{"requeues." + itemID.Hex(): 1},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&queueList)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, ErrIDNotFoundInQueue
+	}
+	if err != nil {
+		return 0, err
+	}
+	return queueList.Requeues[itemID.Hex()], nil
 }
 
 // PopFromQueue pops the itemID from the queue by the queue ID.
 // Returns ErrIDNotFoundInQueue if the itemID is not in the queue.
+//
+// The item is removed with a single atomic update, so concurrent changes to other items of the queue are never lost.
 func (qlm *QueueListManager) DeleteFromQueue(ctx context.Context, queueID string, itemID primitive.ObjectID) error {
 	if !slices.Contains(qlm.queueNames, queueID) {
 		return ErrInvalidQueueID
 	}
 
-	var queueList QueueList
-	err := qlm.collection.FindOne(ctx, bson.M{"_id": queueID}).Decode(&queueList)
+	result, err := qlm.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": queueID, "queue": itemID},
+		bson.M{"$pull": bson.M{"queue": itemID}, "$unset": itemFields(itemID)},
+	)
 	if err != nil {
 		return err
 	}
+	if result.MatchedCount == 1 {
+		return nil
+	}
 
+	// Nothing removed, tell an empty queue apart from a missing item
+	var queueList QueueList
+	if err := qlm.collection.FindOne(ctx, bson.M{"_id": queueID}).Decode(&queueList); err != nil {
+		return err
+	}
 	if len(queueList.Queue) == 0 {
 		return ErrInvalidOpOnEmptyQueue
 	}
+	return ErrIDNotFoundInQueue
+}
 
-	index := slices.IndexFunc(queueList.Queue, func(id primitive.ObjectID) bool {
-		return id == itemID
-	})
-
-	if index == -1 {
-		return ErrIDNotFoundInQueue
+// RemoveMany removes every given itemID from the queue by the queue ID in a single atomic update.
+// Returns the number of items removed. IDs that are not in the queue are ignored.
+func (qlm *QueueListManager) RemoveMany(ctx context.Context, queueID string, itemIDs []primitive.ObjectID) (int, error) {
+	if !slices.Contains(qlm.queueNames, queueID) {
+		return 0, ErrInvalidQueueID
+	}
+	if len(itemIDs) == 0 {
+		return 0, nil
 	}
 
-	queueList.Queue = slices.Delete(queueList.Queue, index, index+1)
+	// The queue before the update tells how many items were pulled
+	fields := bson.M{}
+	for _, id := range itemIDs {
+		for field := range itemFields(id) {
+			fields[field] = ""
+		}
+	}
+	var before QueueList
+	err := qlm.collection.FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": queueID},
+		bson.M{"$pull": bson.M{"queue": bson.M{"$in": itemIDs}}, "$unset": fields},
+		options.FindOneAndUpdate().SetReturnDocument(options.Before),
+	).Decode(&before)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return 0, nil
+		}
+		return 0, err
+	}
 
-	return qlm.setQueue(ctx, queueID, &queueList)
+	removed := 0
+	for _, id := range before.Queue {
+		if slices.Contains(itemIDs, id) {
+			removed++
+		}
+	}
+	return removed, nil
 }
\ No newline at end of file
@@ -0,0 +1,13 @@
+// This file contains the Counter struct and its members.
+// A Counter is identified by its key and the start of its window, so each window starts from a fresh counter.
+
+package ratelimit
+
+import "time"
+
+// Counter represents the number of requests made under a key within a single window
+type Counter struct {
+	ID        string    `bson:"_id"`
+	Count     int       `bson:"count"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
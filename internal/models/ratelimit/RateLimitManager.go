@@ -0,0 +1,63 @@
+// This file contains the RateLimitManager implementation, which is responsible for interacting with the MongoDB rate_limits collection.
+// The RateLimitManager struct contains a pointer to the nerfdb.rate_limits MongoDB collection and a logger. Counters are
+// incremented with an atomic upsert, so concurrent requests on different replicas are all counted.
+
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+)
+
+type RateLimitManager struct {
+	collection *mongo.Collection
+	logger     *log.Logger
+}
+
+// NewRateLimitManager creates a new RateLimitManager with the given MongoDB client and logger.
+func NewRateLimitManager(client *mongo.Client, logger *log.Logger, unittest bool) *RateLimitManager {
+	return &RateLimitManager{
+		collection: client.Database("nerfdb").Collection("rate_limits"),
+		logger:     logger,
+	}
+}
+
+// EnsureIndexes creates the TTL index removing counters once their window ended.
+func (rlm *RateLimitManager) EnsureIndexes(ctx context.Context) error {
+	_, err := rlm.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// Hit counts a request under the given key, in the current window of the given length.
+//
+// Returns the number of requests counted in the window including this one, and the end of the window.
+func (rlm *RateLimitManager) Hit(ctx context.Context, key string, window time.Duration) (int, time.Time, error) {
+	start := time.Now().UTC().Truncate(window)
+	resetAt := start.Add(window)
+
+	var counter Counter
+	err := rlm.collection.FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": fmt.Sprintf("%s@%d", key, start.Unix())},
+		bson.M{"$inc": bson.M{"count": 1}, "$setOnInsert": bson.M{"expires_at": resetAt}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&counter)
+	if err != nil {
+		// Two first hits raced to insert the counter, the loser increments the inserted one
+		if mongo.IsDuplicateKeyError(err) {
+			return rlm.Hit(ctx, key, window)
+		}
+		return 0, time.Time{}, err
+	}
+	return counter.Count, resetAt, nil
+}
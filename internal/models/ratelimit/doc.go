@@ -0,0 +1,5 @@
+// Package ratelimit contains the implementation of rate limit counters stored in the MongoDB rate_limits collection.
+// The RateLimitManager struct is responsible for interacting with the MongoDB rate_limits collection.
+// The Counter struct counts the requests made under a key (i.e a client IP) within a fixed time window, so every web-server
+// replica enforces the same limits. Counters are removed by a TTL index once their window ended.
+package ratelimit
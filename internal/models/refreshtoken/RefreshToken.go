@@ -0,0 +1,57 @@
+// This file contains the RefreshToken struct and its members.
+// A RefreshToken is valid until it is revoked (used, logged out or reused) or ExpiresAt passes.
+// Every token rotated from the same login shares a FamilyID, which identifies the session of that login.
+
+package refreshtoken
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Custom errors
+var (
+	// ErrRefreshTokenNotFound is returned when no refresh token matches the presented token.
+	ErrRefreshTokenNotFound = errors.New("refresh token not found")
+	// ErrRefreshTokenRevoked is returned when a refresh token was already used or revoked.
+	ErrRefreshTokenRevoked = errors.New("refresh token has been revoked")
+	// ErrRefreshTokenExpired is returned when a refresh token is past its expiry.
+	ErrRefreshTokenExpired = errors.New("refresh token has expired")
+	// ErrSessionNotFound is returned when a user has no active session with the given ID.
+	ErrSessionNotFound = errors.New("session not found")
+)
+
+// RefreshToken represents a stored refresh token
+type RefreshToken struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	UserID    primitive.ObjectID `bson:"user_id"`
+	FamilyID  primitive.ObjectID `bson:"family_id"`
+	TokenHash string             `bson:"token_hash"`
+	CreatedAt time.Time          `bson:"created_at"`
+	ExpiresAt time.Time          `bson:"expires_at"`
+	RevokedAt *time.Time         `bson:"revoked_at"`
+	Session   Session            `bson:"session"`
+}
+
+// Session describes the login a token family was issued to. It is copied to every token rotated from that login,
+// with the device and IP of the latest rotation.
+type Session struct {
+	Device   string    `bson:"device"`
+	IP       string    `bson:"ip"`
+	IssuedAt time.Time `bson:"issued_at"`
+}
+
+// IsExpiredAt returns whether the token is expired at the given time.
+func (rt *RefreshToken) IsExpiredAt(at time.Time) bool {
+	return !at.Before(rt.ExpiresAt)
+}
+
+// HashToken returns the hash under which a refresh token is stored.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
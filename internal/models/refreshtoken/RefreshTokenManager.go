@@ -0,0 +1,184 @@
+// This file contains the RefreshTokenManager implementation, which is responsible for interacting with the MongoDB refresh_tokens collection.
+// The RefreshTokenManager struct contains a pointer to the nerfdb.refresh_tokens MongoDB collection and a logger. It provides methods to
+// create, look up and revoke refresh tokens. Tokens are looked up by hash, as the plain token is never stored.
+
+package refreshtoken
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+)
+
+type RefreshTokenManager struct {
+	collection *mongo.Collection
+	logger     *log.Logger
+}
+
+// NewRefreshTokenManager creates a new RefreshTokenManager with the given MongoDB client and logger.
+func NewRefreshTokenManager(client *mongo.Client, logger *log.Logger, unittest bool) *RefreshTokenManager {
+	return &RefreshTokenManager{
+		collection: client.Database("nerfdb").Collection("refresh_tokens"),
+		logger:     logger,
+	}
+}
+
+// EnsureIndexes creates the unique index on the token hash, the index used to list the sessions of a user,
+// and a TTL index removing tokens once they expire.
+func (rtm *RefreshTokenManager) EnsureIndexes(ctx context.Context) error {
+	_, err := rtm.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "token_hash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "revoked_at", Value: 1}},
+		},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+// CreateRefreshToken inserts a new refresh token for the given plain token.
+//
+// Returns the stored RefreshToken if successful, error otherwise.
+func (rtm *RefreshTokenManager) CreateRefreshToken(
+	ctx context.Context,
+	userID, familyID primitive.ObjectID,
+	token string,
+	session Session,
+	ttl time.Duration,
+) (*RefreshToken, error) {
+	now := time.Now().UTC()
+	rt := &RefreshToken{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		FamilyID:  familyID,
+		TokenHash: HashToken(token),
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+		Session:   session,
+	}
+
+	if _, err := rtm.collection.InsertOne(ctx, rt); err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+// GetRefreshToken retrieves the refresh token matching the given plain token.
+//
+// Returns the RefreshToken if found, ErrRefreshTokenNotFound if not, error otherwise.
+func (rtm *RefreshTokenManager) GetRefreshToken(ctx context.Context, token string) (*RefreshToken, error) {
+	var rt RefreshToken
+	err := rtm.collection.FindOne(ctx, bson.M{"token_hash": HashToken(token)}).Decode(&rt)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrRefreshTokenNotFound
+		}
+		return nil, err
+	}
+	return &rt, nil
+}
+
+// RevokeRefreshToken revokes a single refresh token. Only one caller can revoke a given token,
+// so concurrent use of the same token is detected.
+//
+// Returns ErrRefreshTokenRevoked if the token was already revoked.
+func (rtm *RefreshTokenManager) RevokeRefreshToken(ctx context.Context, id primitive.ObjectID) error {
+	result, err := rtm.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "revoked_at": nil},
+		bson.M{"$set": bson.M{"revoked_at": time.Now().UTC()}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrRefreshTokenRevoked
+	}
+	return nil
+}
+
+// RevokeFamily revokes every token issued from the same login as the given family.
+func (rtm *RefreshTokenManager) RevokeFamily(ctx context.Context, familyID primitive.ObjectID) error {
+	_, err := rtm.collection.UpdateMany(
+		ctx,
+		bson.M{"family_id": familyID, "revoked_at": nil},
+		bson.M{"$set": bson.M{"revoked_at": time.Now().UTC()}},
+	)
+	return err
+}
+
+// RevokeUserTokens revokes every refresh token of the given user, i.e after a password change.
+func (rtm *RefreshTokenManager) RevokeUserTokens(ctx context.Context, userID primitive.ObjectID) error {
+	_, err := rtm.collection.UpdateMany(
+		ctx,
+		bson.M{"user_id": userID, "revoked_at": nil},
+		bson.M{"$set": bson.M{"revoked_at": time.Now().UTC()}},
+	)
+	return err
+}
+
+// ListActiveTokens returns the unrevoked, unexpired refresh tokens of the given user, i.e one per active session,
+// most recently used first.
+func (rtm *RefreshTokenManager) ListActiveTokens(ctx context.Context, userID primitive.ObjectID) ([]*RefreshToken, error) {
+	cursor, err := rtm.collection.Find(
+		ctx,
+		bson.M{"user_id": userID, "revoked_at": nil, "expires_at": bson.M{"$gt": time.Now().UTC()}},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var tokens []*RefreshToken
+	if err := cursor.All(ctx, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// RevokeUserFamily revokes the token family of the given user, so one user can not revoke the sessions of another.
+//
+// Returns ErrSessionNotFound if the user has no active token in the family.
+func (rtm *RefreshTokenManager) RevokeUserFamily(ctx context.Context, userID, familyID primitive.ObjectID) error {
+	result, err := rtm.collection.UpdateMany(
+		ctx,
+		bson.M{"user_id": userID, "family_id": familyID, "revoked_at": nil},
+		bson.M{"$set": bson.M{"revoked_at": time.Now().UTC()}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeOtherFamilies revokes every refresh token of the given user outside the given family, i.e to log out other devices.
+//
+// Returns the number of revoked tokens.
+func (rtm *RefreshTokenManager) RevokeOtherFamilies(ctx context.Context, userID, familyID primitive.ObjectID) (int64, error) {
+	result, err := rtm.collection.UpdateMany(
+		ctx,
+		bson.M{"user_id": userID, "family_id": bson.M{"$ne": familyID}, "revoked_at": nil},
+		bson.M{"$set": bson.M{"revoked_at": time.Now().UTC()}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
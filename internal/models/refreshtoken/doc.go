@@ -0,0 +1,6 @@
+// Package refreshtoken contains the implementation of refresh tokens stored in the MongoDB refresh_tokens collection.
+// The RefreshTokenManager struct is responsible for interacting with the MongoDB refresh_tokens collection.
+// The RefreshToken struct is used to represent a long-lived, single-use token that can be exchanged for a new access token.
+// Only a hash of each token is stored. Tokens are rotated on every use, and all tokens issued from the same login share
+// a family, so the whole family can be revoked when a used token is presented again.
+package refreshtoken
@@ -0,0 +1,37 @@
+// This file contains the Replay struct and its members.
+// Every scene of a replay moves from pending to running once its pipeline is started, then to completed or failed once it left the queues.
+
+package replay
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Declarations for valid scene statuses
+const (
+	StatusPending   = "pending"
+	StatusRunning   = "running"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+)
+
+// Replay represents a bulk re-run of the processing pipeline
+type Replay struct {
+	ID          primitive.ObjectID `bson:"_id" json:"id"`
+	RequestedBy primitive.ObjectID `bson:"requested_by" json:"requested_by"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+	// FinishedAt is set once every scene completed or failed
+	FinishedAt *time.Time    `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+	Scenes     []ReplayScene `bson:"scenes" json:"scenes"`
+}
+
+// ReplayScene is the progress of a single scene of a replay
+type ReplayScene struct {
+	SceneID    primitive.ObjectID `bson:"scene_id" json:"scene_id"`
+	Status     string             `bson:"status" json:"status"`
+	StartedAt  *time.Time         `bson:"started_at,omitempty" json:"started_at,omitempty"`
+	FinishedAt *time.Time         `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+	Error      string             `bson:"error,omitempty" json:"error,omitempty"`
+}
@@ -0,0 +1,155 @@
+// This file contains the ReplayManager implementation, which is responsible for interacting with the MongoDB replays collection.
+// The ReplayManager struct contains a pointer to the nerfdb.replays MongoDB collection and a logger. Scene transitions are
+// conditional on the current status of the scene, so a scene is never started or finished twice.
+
+package replay
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/pagination"
+)
+
+// Custom errors
+var (
+	// ErrReplayNotFound is returned when a replay does not exist.
+	ErrReplayNotFound = errors.New("replay not found")
+)
+
+type ReplayManager struct {
+	collection *mongo.Collection
+	logger     *log.Logger
+}
+
+// NewReplayManager creates a new ReplayManager with the given MongoDB client and logger.
+func NewReplayManager(client *mongo.Client, logger *log.Logger, unittest bool) *ReplayManager {
+	return &ReplayManager{
+		collection: client.Database("nerfdb").Collection("replays"),
+		logger:     logger,
+	}
+}
+
+// CreateReplay inserts a new replay of the given scenes, all pending.
+//
+// Returns the created Replay if successful, error otherwise.
+func (rm *ReplayManager) CreateReplay(ctx context.Context, requestedBy primitive.ObjectID, sceneIDs []primitive.ObjectID) (*Replay, error) {
+	r := &Replay{
+		ID:          primitive.NewObjectID(),
+		RequestedBy: requestedBy,
+		CreatedAt:   time.Now().UTC(),
+		Scenes:      make([]ReplayScene, 0, len(sceneIDs)),
+	}
+	for _, sceneID := range sceneIDs {
+		r.Scenes = append(r.Scenes, ReplayScene{SceneID: sceneID, Status: StatusPending})
+	}
+
+	if _, err := rm.collection.InsertOne(ctx, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetReplay retrieves a replay by its ID.
+//
+// Returns the Replay if found, ErrReplayNotFound if not, error otherwise.
+func (rm *ReplayManager) GetReplay(ctx context.Context, id primitive.ObjectID) (*Replay, error) {
+	var r Replay
+	if err := rm.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&r); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrReplayNotFound
+		}
+		return nil, err
+	}
+	return &r, nil
+}
+
+// ListReplays returns the given page of replays, newest first, and the cursor of the next page.
+func (rm *ReplayManager) ListReplays(ctx context.Context, page pagination.Page) ([]*Replay, string, error) {
+	replays, err := rm.find(ctx, page.Filter(bson.M{}), page.FindOptions())
+	if err != nil {
+		return nil, "", err
+	}
+	replays, next := pagination.Paginate(replays, page, func(r *Replay) primitive.ObjectID { return r.ID })
+	return replays, next, nil
+}
+
+// ListActiveReplays returns the unfinished replays, oldest first, so replays are run in the order they were requested.
+func (rm *ReplayManager) ListActiveReplays(ctx context.Context) ([]*Replay, error) {
+	return rm.find(ctx, bson.M{"finished_at": nil}, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+}
+
+// StartScene moves a pending scene of the replay to running.
+//
+// Returns true if the scene was pending, false if it was already started.
+func (rm *ReplayManager) StartScene(ctx context.Context, id, sceneID primitive.ObjectID) (bool, error) {
+	result, err := rm.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "scenes": bson.M{"$elemMatch": bson.M{"scene_id": sceneID, "status": StatusPending}}},
+		bson.M{"$set": bson.M{
+			"scenes.$.status":     StatusRunning,
+			"scenes.$.started_at": time.Now().UTC(),
+		}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// FinishScene moves a pending or running scene of the replay to completed, or to failed if reason is not empty.
+func (rm *ReplayManager) FinishScene(ctx context.Context, id, sceneID primitive.ObjectID, reason string) error {
+	status := StatusCompleted
+	if reason != "" {
+		status = StatusFailed
+	}
+	_, err := rm.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "scenes": bson.M{"$elemMatch": bson.M{
+			"scene_id": sceneID,
+			"status":   bson.M{"$in": bson.A{StatusPending, StatusRunning}},
+		}}},
+		bson.M{"$set": bson.M{
+			"scenes.$.status":      status,
+			"scenes.$.error":       reason,
+			"scenes.$.finished_at": time.Now().UTC(),
+		}},
+	)
+	return err
+}
+
+// FinishReplay marks the replay finished if none of its scenes is pending or running anymore.
+func (rm *ReplayManager) FinishReplay(ctx context.Context, id primitive.ObjectID) error {
+	_, err := rm.collection.UpdateOne(
+		ctx,
+		bson.M{
+			"_id":           id,
+			"finished_at":   nil,
+			"scenes.status": bson.M{"$nin": bson.A{StatusPending, StatusRunning}},
+		},
+		bson.M{"$set": bson.M{"finished_at": time.Now().UTC()}},
+	)
+	return err
+}
+
+// find returns the replays matching the filter.
+func (rm *ReplayManager) find(ctx context.Context, filter bson.M, opts *options.FindOptions) ([]*Replay, error) {
+	cursor, err := rm.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	replays := make([]*Replay, 0)
+	if err := cursor.All(ctx, &replays); err != nil {
+		return nil, err
+	}
+	return replays, nil
+}
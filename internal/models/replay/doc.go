@@ -0,0 +1,6 @@
+// Package replay contains the implementation of pipeline replays stored in the MongoDB replays collection.
+// The ReplayManager struct is responsible for interacting with the MongoDB replays collection.
+// The Replay struct is used to represent an admin request to re-run the full processing pipeline of selected scenes from their
+// stored raw videos (i.e after a worker upgrade), and the progress of every scene. Scenes are started a few at a time,
+// so a replay does not starve user jobs.
+package replay
@@ -12,7 +12,9 @@ package scene
 
 import (
 	"errors"
+	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -25,27 +27,187 @@ var (
 	// ErrInvalidOpOnProcessingScene is returned when an invalid operation is attempted on a processing scene.
 	//(I.e, trying to delete a scene that nerf-worker is actively training)
 	ErrInvalidOpOnProcessingScene = errors.New("invalid operation on processing scene")
+	// ErrSceneArchived is returned when the outputs of an archived scene are requested before it is restored.
+	ErrSceneArchived = errors.New("scene outputs are archived")
+	// ErrArchiveConflict is returned when the archive state of a scene does not allow an archive operation
+	// (i.e restoring a scene that is not archived, or archiving a scene that is being restored).
+	ErrArchiveConflict = errors.New("operation not allowed in the current archive state")
+	// ErrOutputsDeleted is returned when the outputs of a scene were deleted by the retention policy.
+	ErrOutputsDeleted = errors.New("scene outputs were deleted after a period of inactivity")
+	// ErrSceneNotInTrash is returned when restoring a scene that was not deleted.
+	ErrSceneNotInTrash = errors.New("scene is not in the trash")
+	// ErrVersionNotFound is returned when a scene has no training result of the requested version.
+	ErrVersionNotFound = errors.New("scene version not found")
 )
 
 // Scene represents a scene and its components
 type Scene struct {
-	Video  *Video             `bson:"video,omitempty" json:"video,omitempty"`
+	// Videos are the uploaded inputs of the scene, i.e several passes around an object. An image set is always the only input
+	Videos []*Video           `bson:"videos,omitempty" json:"videos,omitempty"`
     Sfm    *Sfm               `bson:"sfm,omitempty" json:"sfm,omitempty"`
     Config *TrainingConfig    `bson:"config,omitempty" json:"config,omitempty"`
     Nerf   *Nerf              `bson:"nerf,omitempty" json:"nerf,omitempty"`
     ID     primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
     Status int                `bson:"status" json:"status"`
 	Name   string             `bson:"name" json:"name"`
+	Cost   *ProcessingCost    `bson:"cost,omitempty" json:"cost,omitempty"`
+	// FailureReason is set when a worker reports a failed stage, or FailureReasonCancelled when processing is cancelled
+	FailureReason string `bson:"failure_reason,omitempty" json:"failure_reason,omitempty"`
+	// Error describes the last failure reported by a worker for the scene, until the scene is processed again
+	Error *SceneError `bson:"error,omitempty" json:"error,omitempty"`
+	// Archive is set while the outputs of the scene are (being moved to) cold storage
+	Archive *Archive `bson:"archive,omitempty" json:"archive,omitempty"`
+	// RestoredAt is when the scene was last restored from cold storage, it restarts the age of the scene for archival
+	RestoredAt *time.Time `bson:"restored_at,omitempty" json:"restored_at,omitempty"`
+	// OutputsDeletedAt is set once the nerf outputs were deleted by the retention policy
+	OutputsDeletedAt *time.Time `bson:"outputs_deleted_at,omitempty" json:"outputs_deleted_at,omitempty"`
+	// DeletedAt is set while the scene is in the trash, from which it can be restored until it is purged
+	DeletedAt *time.Time `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
+	// WorkerVersions maps each processing stage (sfm, nerf) to the software version of the worker that last completed it,
+	// if the worker reported one
+	WorkerVersions map[string]string `bson:"worker_versions,omitempty" json:"worker_versions,omitempty"`
+	// Canary is set when the nerf stage of the scene was last routed to the canary worker build, to compare its results
+	// with the scenes of the current build before rolling it out
+	Canary bool `bson:"canary,omitempty" json:"canary,omitempty"`
+	// Synthetic is set on scenes created by load tests, whose worker results are fabricated instead of processed by workers
+	Synthetic bool `bson:"synthetic,omitempty" json:"synthetic,omitempty"`
+	// ThumbnailFrame is the index of the sfm frame used as the thumbnail of the scene, chosen by frame quality when the sfm
+	// result was ingested. Scenes ingested before use their first frame
+	ThumbnailFrame int `bson:"thumbnail_frame,omitempty" json:"thumbnail_frame,omitempty"`
+	// Thumbnail is the storage key of the thumbnail uploaded by the user of the scene, or generated from its video at ingest,
+	// which takes precedence over its ThumbnailFrame. Scenes ingested without ffmpeg have none until their user uploads one
+	Thumbnail string `bson:"thumbnail,omitempty" json:"-"`
+	// Checksums are the checksums of the nerf outputs of the scene, computed when they are first listed in a download manifest
+	Checksums []Checksum `bson:"checksums,omitempty" json:"-"`
+	// Callback is the webhook notified of the stage transitions of the scene, if its submitter attached one
+	Callback *Callback `bson:"callback,omitempty" json:"-"`
+	// Integrity is the result of the last integrity check of the stored files of the scene
+	Integrity *Integrity `bson:"integrity,omitempty" json:"integrity,omitempty"`
+	// Tenant is the tenant of the user of the scene, whose prefix its files are stored under. Empty for the default tenant
+	Tenant string `bson:"tenant,omitempty" json:"-"`
+	// NerfVersions are the previous training results of the scene, oldest first, kept when the scene is retrained
+	NerfVersions []*Nerf `bson:"nerf_versions,omitempty" json:"-"`
+	// Visibility is who can see the scene besides its user, one of the Visibility declarations. Empty means private
+	Visibility string `bson:"visibility,omitempty" json:"visibility,omitempty"`
+	// RetrainVersion is the version the next training result of the scene is stored as, set while a scene that already
+	// has a training result is retrained. The result it replaces is then kept in NerfVersions
+	RetrainVersion int `bson:"retrain_version,omitempty" json:"-"`
 }
 
-// Video represents video metadata
+// Integrity represents the result of an integrity check of the stored files of a scene
+type Integrity struct {
+	CheckedAt time.Time        `bson:"checked_at" json:"checked_at"`
+	Issues    []IntegrityIssue `bson:"issues,omitempty" json:"issues,omitempty"`
+}
+
+// IntegrityIssue represents a discrepancy between a stored file and what the scene recorded of it
+type IntegrityIssue struct {
+	Key     string `bson:"key" json:"key"`
+	Problem string `bson:"problem" json:"problem"`
+	Detail  string `bson:"detail,omitempty" json:"detail,omitempty"`
+}
+
+// Declarations for valid scene visibilities
+const (
+	// VisibilityPrivate scenes are only visible to their user.
+	VisibilityPrivate = "private"
+	// VisibilityUnlisted scenes are visible to anyone knowing their ID, but not listed in the public gallery.
+	VisibilityUnlisted = "unlisted"
+	// VisibilityPublic scenes are visible to anyone, and listed in the public gallery once completed.
+	VisibilityPublic = "public"
+)
+
+// Declarations for integrity problems
+const (
+	IntegrityMissing          = "missing"
+	IntegrityUnreadable       = "unreadable"
+	IntegritySizeMismatch     = "size_mismatch"
+	IntegrityChecksumMismatch = "checksum_mismatch"
+)
+
+// SceneError represents a failure of a processing stage (sfm, nerf) of a scene, as reported by its worker
+type SceneError struct {
+	Stage     string    `bson:"stage" json:"stage"`
+	Message   string    `bson:"message" json:"message"`
+	Timestamp time.Time `bson:"timestamp" json:"timestamp"`
+}
+
+// Checksum represents the SHA-256 checksums of a stored output of a scene, as a whole and per chunk of ChunkSize bytes.
+// It is only valid while the size and modification time of the object are unchanged.
+type Checksum struct {
+	Key       string    `bson:"key"`
+	Size      int64     `bson:"size"`
+	ModTime   time.Time `bson:"mod_time"`
+	SHA256    string    `bson:"sha256"`
+	ChunkSize int64     `bson:"chunk_size"`
+	Chunks    []string  `bson:"chunks"`
+}
+
+// Callback represents the webhook of a scene. Its secret signs the notifications, and is never returned to clients.
+type Callback struct {
+	URL    string `bson:"url"`
+	Secret string `bson:"secret"`
+}
+
+// Declarations for valid archive statuses
+const (
+	// ArchiveStatusArchiving means the outputs are being copied to cold storage, and can still be served.
+	ArchiveStatusArchiving = "archiving"
+	// ArchiveStatusArchived means the outputs are only in cold storage.
+	ArchiveStatusArchived = "archived"
+	// ArchiveStatusRestoring means the outputs are being copied back from cold storage.
+	ArchiveStatusRestoring = "restoring"
+)
+
+// Archive represents the cold storage state of the outputs of a scene
+type Archive struct {
+	Status string `bson:"status" json:"status"`
+	// Keys are the storage keys of the archived outputs, identical in both storages
+	Keys  []string `bson:"keys" json:"-"`
+	Bytes int64    `bson:"bytes" json:"bytes"`
+	// Moved is the number of Keys copied by the running archive or restore
+	Moved      int        `bson:"moved" json:"moved"`
+	ArchivedAt *time.Time `bson:"archived_at,omitempty" json:"archived_at,omitempty"`
+	UpdatedAt  time.Time  `bson:"updated_at" json:"updated_at"`
+	// Error is the reason the last restore failed
+	Error string `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+// Video represents video metadata. It also represents a set of photos uploaded instead of a video, as a zip archive
+// whose images are used as the frames of the scene.
 type Video struct {
     FilePath   string `bson:"file_path" json:"file_path"`
     Width      int    `bson:"width" json:"width"`
     Height     int    `bson:"height" json:"height"`
+    // FPS (rounded), Duration (in seconds, rounded) and FrameCount are probed from the video at ingest
     FPS        int    `bson:"fps" json:"fps"`
     Duration   int    `bson:"duration" json:"duration"`
     FrameCount int    `bson:"frame_count" json:"frame_count"`
+	// InputType is the kind of the uploaded file, one of the InputType declarations. Empty means a video
+	InputType string `bson:"input_type,omitempty" json:"input_type,omitempty"`
+	// ImageCount is the number of images of an image set
+	ImageCount int `bson:"image_count,omitempty" json:"image_count,omitempty"`
+}
+
+// Declarations for valid input types
+const (
+	// InputTypeVideo is a video, whose frames are extracted by the sfm worker.
+	InputTypeVideo = "video"
+	// InputTypeImages is a zip archive of JPEG / PNG photos, used as frames by the sfm worker as is.
+	InputTypeImages = "images"
+)
+
+// IsImageSet checks if the uploaded file is a set of photos instead of a video.
+func (v *Video) IsImageSet() bool {
+	return v.InputType == InputTypeImages
+}
+
+// Kind returns the input type of the uploaded file, InputTypeVideo if none is recorded.
+func (v *Video) Kind() string {
+	if v.InputType == "" {
+		return InputTypeVideo
+	}
+	return v.InputType
 }
 
 // Frame represents a single frame in the SfM process
@@ -62,10 +224,29 @@ type Sfm struct {
 }
 
 
+// Declarations for valid job priorities. Jobs of a higher priority are processed before the queued jobs of a lower priority,
+// scenes without a priority are PriorityNormal.
+const (
+	PriorityNormal = 0
+	PriorityHigh   = 1
+	PriorityUrgent = 2
+	MaxPriority    = PriorityUrgent
+)
+
 // TrainingConfig represents the configuration for training
 type TrainingConfig struct {
 	SfmTrainingConfig  *SfmTrainingConfig  `bson:"sfm_training_config,omitempty" json:"sfm_training_config,omitempty"`
 	NerfTrainingConfig *NerfTrainingConfig `bson:"nerf_training_config,omitempty" json:"nerf_training_config,omitempty"`
+	// Priority is the priority of the jobs of the scene, from PriorityNormal to MaxPriority
+	Priority int `bson:"priority,omitempty" json:"priority,omitempty"`
+}
+
+// JobPriority returns the priority of the jobs of the scene with the given config, PriorityNormal if it has none.
+func (c *TrainingConfig) JobPriority() int {
+	if c == nil {
+		return PriorityNormal
+	}
+	return min(max(c.Priority, PriorityNormal), MaxPriority)
 }
 
 // NerfTrainingConfig represents the configuration for NeRF training
@@ -90,12 +271,44 @@ type Nerf struct {
     PointCloudFilePathsMap map[int]string `bson:"point_cloud_file_paths,omitempty" json:"point_cloud_file_paths,omitempty"`
     VideoFilePathsMap      map[int]string `bson:"video_file_paths,omitempty" json:"video_file_paths,omitempty"`
     Flag                   int            `bson:"flag" json:"flag"`
+	// Version numbers the training results of a scene, starting at 1. Results stored before scenes were versioned have none
+	Version int `bson:"version,omitempty" json:"version,omitempty"`
+	// CompletedAt is when the result was stored, unset for results stored before scenes were versioned
+	CompletedAt *time.Time `bson:"completed_at,omitempty" json:"completed_at,omitempty"`
+	// WorkerVersion is the software version of the worker that trained a previous version, recorded once it is replaced
+	WorkerVersion string `bson:"worker_version,omitempty" json:"worker_version,omitempty"`
+}
+
+// ProcessingCost represents the resources consumed processing a scene, as reported by the workers
+type ProcessingCost struct {
+	TotalGPUSeconds float64     `bson:"total_gpu_seconds" json:"total_gpu_seconds"`
+	Stages          []StageCost `bson:"stages" json:"stages"`
+}
+
+// StageCost represents the resources consumed by a single worker stage (sfm, nerf) of a scene
+type StageCost struct {
+	Stage       string    `bson:"stage" json:"stage"`
+	WorkerID    string    `bson:"worker_id" json:"worker_id"`
+	GPUSeconds  float64   `bson:"gpu_seconds" json:"gpu_seconds"`
+	CompletedAt time.Time `bson:"completed_at" json:"completed_at"`
 }
 
+// Declarations for processing stages
+const (
+	StageSfm  = "sfm"
+	StageNerf = "nerf"
+)
+
+// FailureReasonCancelled is the failure reason of scenes whose processing was cancelled. Worker results of cancelled scenes are discarded.
+const FailureReasonCancelled = "processing cancelled"
+
 // Declarations for valid training modes and output types
 const (
 	TrainingModeGaussian = "gaussian"
 	TrainingModeTensorf  = "tensorf"
+
+	// MaxIterations is the largest number of training iterations workers accept
+	MaxIterations = 30000
 )
 var (
 	ValidTrainingModes = []string{TrainingModeGaussian, TrainingModeTensorf}
@@ -129,6 +342,100 @@ func (Nerf) IsValidOutputType(trainingMode, outputType string) bool {
 	return false
 }
 
+// OutputKeys returns the file path of every output of every type and iteration.
+func (n *Nerf) OutputKeys() []string {
+	var keys []string
+	for _, paths := range []map[int]string{n.ModelFilePathsMap, n.SplatCloudFilePathsMap, n.PointCloudFilePathsMap, n.VideoFilePathsMap} {
+		for _, path := range paths {
+			keys = append(keys, path)
+		}
+	}
+	return keys
+}
+
+// CurrentVersion returns the version of the training result, 1 if it was stored before scenes were versioned.
+func (n *Nerf) CurrentVersion() int {
+	return max(n.Version, 1)
+}
+
+// UnmarshalBSON decodes a scene, moving the single video of scenes stored before scenes had several inputs into Videos.
+func (sc *Scene) UnmarshalBSON(data []byte) error {
+	type StoredScene Scene
+	var stored struct {
+		StoredScene `bson:",inline"`
+		Video       *Video `bson:"video,omitempty"`
+	}
+	if err := bson.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+	*sc = Scene(stored.StoredScene)
+	if len(sc.Videos) == 0 && stored.Video != nil {
+		sc.Videos = []*Video{stored.Video}
+	}
+	return nil
+}
+
+// PrimaryVideo returns the first input of the scene, which the thumbnail and the resolution of the scene are taken from,
+// or nil if the scene has no input.
+func (sc *Scene) PrimaryVideo() *Video {
+	if len(sc.Videos) == 0 {
+		return nil
+	}
+	return sc.Videos[0]
+}
+
+// VideoKeys returns the storage keys of the inputs of the scene.
+func (sc *Scene) VideoKeys() []string {
+	var keys []string
+	for _, video := range sc.Videos {
+		if video.FilePath != "" {
+			keys = append(keys, video.FilePath)
+		}
+	}
+	return keys
+}
+
+// OutputKeys returns the storage keys of the outputs of every version of the scene, current and previous.
+func (sc *Scene) OutputKeys() []string {
+	var keys []string
+	if sc.Nerf != nil {
+		keys = append(keys, sc.Nerf.OutputKeys()...)
+	}
+	for _, version := range sc.NerfVersions {
+		keys = append(keys, version.OutputKeys()...)
+	}
+	return keys
+}
+
+// GetNerfVersion returns the training result of the given version of the scene, the current one if version is 0.
+//
+// Returns ErrNerfNotFound if the scene was not trained yet, ErrVersionNotFound if it has no such version.
+func (sc *Scene) GetNerfVersion(version int) (*Nerf, error) {
+	if sc.Nerf == nil {
+		return nil, ErrNerfNotFound
+	}
+	if version == 0 || version == sc.Nerf.CurrentVersion() {
+		return sc.Nerf, nil
+	}
+	for _, nerf := range sc.NerfVersions {
+		if nerf.CurrentVersion() == version {
+			return nerf, nil
+		}
+	}
+	return nil, ErrVersionNotFound
+}
+
+// LatestIteration returns the farthest iteration of any output type, 0 if there is no output.
+func (n *Nerf) LatestIteration() int {
+	latest := 0
+	for _, paths := range []map[int]string{n.ModelFilePathsMap, n.SplatCloudFilePathsMap, n.PointCloudFilePathsMap, n.VideoFilePathsMap} {
+		for iteration := range paths {
+			latest = max(latest, iteration)
+		}
+	}
+	return latest
+}
+
 // GetFilePathsForOutputType returns a map of iteration to file path for a given output type.
 //
 // Returns (nil, ErrInvalidOutputType) if the output type is invalid.
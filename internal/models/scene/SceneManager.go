@@ -7,6 +7,7 @@ package scene
 import (
 	"context"
 	"errors"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -14,6 +15,7 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/pagination"
 )
 
 // Custom errors
@@ -28,6 +30,10 @@ var (
 	ErrNerfNotFound = errors.New("nerf not found")
 	// ErrTrainingConfigNotFound is returned when a requested training config is not found in the database.
 	ErrTrainingConfigNotFound = errors.New("training config not found")
+	// ErrTrainingStarted is returned when changing the training config of a scene whose training stage was already reached.
+	ErrTrainingStarted = errors.New("training already started, the training config can no longer be changed")
+	// ErrCostNotFound is returned when no processing cost was recorded for a scene yet.
+	ErrCostNotFound = errors.New("processing cost not found")
 )
 
 type SceneManager struct {
@@ -60,6 +66,33 @@ func (sm *SceneManager) SetTrainingConfig(ctx context.Context, id primitive.Obje
 	return nil
 }
 
+// SetPendingNerfTrainingConfig sets the NerfTrainingConfig of a scene in the database by the scene ID, as long as the scene has
+// no sfm result. The sfm result and the training config are set atomically with respect to each other, so a training stage
+// never starts with a config that is changed afterwards.
+//
+// Returns ErrSceneNotFound if the scene does not exist, ErrTrainingStarted if it has an sfm result.
+func (sm *SceneManager) SetPendingNerfTrainingConfig(ctx context.Context, id primitive.ObjectID, config *NerfTrainingConfig) error {
+	result, err := sm.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "sfm": nil},
+		bson.M{"$set": bson.M{"config.nerf_training_config": config}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		exists, err := sm.SceneExists(ctx, id)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrSceneNotFound
+		}
+		return ErrTrainingStarted
+	}
+	return nil
+}
+
 // SetScene sets the Scene data in the database by the scene ID.
 func (sm *SceneManager) SetScene(ctx context.Context, id primitive.ObjectID, scene *Scene) error {
 	result, err := sm.collection.UpdateOne(
@@ -77,12 +110,12 @@ func (sm *SceneManager) SetScene(ctx context.Context, id primitive.ObjectID, sce
 	return nil
 }
 
-// SetVideo sets the Video data in the database by the scene ID.
-func (sm *SceneManager) SetVideo(ctx context.Context, id primitive.ObjectID, vid *Video) error {
+// SetVideos sets the inputs of a scene in the database by the scene ID.
+func (sm *SceneManager) SetVideos(ctx context.Context, id primitive.ObjectID, videos []*Video) error {
 	result, err := sm.collection.UpdateOne(
 		ctx,
 		bson.M{"_id": id},
-		bson.M{"$set": bson.M{"video": vid}},
+		bson.M{"$set": bson.M{"videos": videos}, "$unset": bson.M{"video": ""}},
 		options.Update().SetUpsert(true),
 	)
 	if err != nil {
@@ -128,6 +161,173 @@ func (sm *SceneManager) SetNerf(ctx context.Context, id primitive.ObjectID, nerf
 	return nil
 }
 
+// SetVisibility sets who can see the scene, one of the Visibility declarations.
+//
+// Returns ErrSceneNotFound if the scene does not exist.
+func (sm *SceneManager) SetVisibility(ctx context.Context, id primitive.ObjectID, visibility string) error {
+	update := bson.M{"$set": bson.M{"visibility": visibility}}
+	if visibility == VisibilityPrivate {
+		update = bson.M{"$unset": bson.M{"visibility": ""}}
+	}
+	result, err := sm.collection.UpdateOne(ctx, bson.M{"_id": id}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrSceneNotFound
+	}
+	return nil
+}
+
+// SetRetrainVersion records the version the next training result of a retrained scene is stored as.
+//
+// Returns ErrSceneNotFound if the scene does not exist.
+func (sm *SceneManager) SetRetrainVersion(ctx context.Context, id primitive.ObjectID, version int) error {
+	result, err := sm.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"retrain_version": version}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrSceneNotFound
+	}
+	return nil
+}
+
+// SetRetrainedNerf sets the Nerf data of a retrained scene, and keeps the result it replaces as a previous version.
+// Both are updated at once, and only while the scene is retrained as the version of nerf.
+//
+// Returns ErrSceneNotFound if the scene does not exist or is not retrained as this version.
+func (sm *SceneManager) SetRetrainedNerf(ctx context.Context, id primitive.ObjectID, nerf, previous *Nerf) error {
+	result, err := sm.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "retrain_version": nerf.Version},
+		bson.M{
+			"$set":   bson.M{"nerf": nerf},
+			"$push":  bson.M{"nerf_versions": previous},
+			"$unset": bson.M{"retrain_version": ""},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrSceneNotFound
+	}
+	return nil
+}
+
+// SetChecksums replaces the checksums of the outputs of a scene.
+//
+// Returns ErrSceneNotFound if the scene does not exist.
+func (sm *SceneManager) SetChecksums(ctx context.Context, id primitive.ObjectID, checksums []Checksum) error {
+	result, err := sm.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"checksums": checksums}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrSceneNotFound
+	}
+	return nil
+}
+
+// AddStageCost records the cost of a finished processing stage, and adds it to the total cost of the scene.
+// Each stage is only recorded once, so redelivered worker output is not counted twice.
+func (sm *SceneManager) AddStageCost(ctx context.Context, id primitive.ObjectID, cost StageCost) error {
+	_, err := sm.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "cost.stages.stage": bson.M{"$ne": cost.Stage}},
+		bson.M{
+			"$push": bson.M{"cost.stages": cost},
+			"$inc":  bson.M{"cost.total_gpu_seconds": cost.GPUSeconds},
+		},
+	)
+	return err
+}
+
+// SetWorkerVersion records the software version of the worker that completed the given stage of the scene.
+// An empty version removes the version recorded by a previous run of the stage.
+func (sm *SceneManager) SetWorkerVersion(ctx context.Context, id primitive.ObjectID, stage, version string) error {
+	update := bson.M{"$set": bson.M{"worker_versions." + stage: version}}
+	if version == "" {
+		update = bson.M{"$unset": bson.M{"worker_versions." + stage: ""}}
+	}
+	result, err := sm.collection.UpdateOne(ctx, bson.M{"_id": id}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrSceneNotFound
+	}
+	return nil
+}
+
+// ListScenesByWorkerVersion returns the IDs of up to limit scenes whose given stage was completed by the given worker version,
+// oldest first.
+func (sm *SceneManager) ListScenesByWorkerVersion(ctx context.Context, stage, version string, limit int64) ([]primitive.ObjectID, error) {
+	opts := options.Find().SetProjection(bson.M{"_id": 1}).SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(limit)
+	return sm.findIDs(ctx, bson.M{"worker_versions." + stage: version}, opts)
+}
+
+// PageScenesByWorkerVersion returns the given page of IDs of scenes whose given stage was completed by the given worker version,
+// newest first, and the cursor of the next page.
+func (sm *SceneManager) PageScenesByWorkerVersion(ctx context.Context, stage, version string, page pagination.Page) ([]primitive.ObjectID, string, error) {
+	opts := page.FindOptions().SetProjection(bson.M{"_id": 1})
+	ids, err := sm.findIDs(ctx, page.Filter(bson.M{"worker_versions." + stage: version}), opts)
+	if err != nil {
+		return nil, "", err
+	}
+	ids, next := pagination.Paginate(ids, page, func(id primitive.ObjectID) primitive.ObjectID { return id })
+	return ids, next, nil
+}
+
+// SetCanary tags (or untags) the scene as processed by the canary worker build.
+func (sm *SceneManager) SetCanary(ctx context.Context, id primitive.ObjectID, canary bool) error {
+	update := bson.M{"$set": bson.M{"canary": true}}
+	if !canary {
+		update = bson.M{"$unset": bson.M{"canary": ""}}
+	}
+	result, err := sm.collection.UpdateOne(ctx, bson.M{"_id": id}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrSceneNotFound
+	}
+	return nil
+}
+
+// SetFailureReason records why processing the scene failed.
+func (sm *SceneManager) SetFailureReason(ctx context.Context, id primitive.ObjectID, reason string) error {
+	result, err := sm.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"failure_reason": reason}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrSceneNotFound
+	}
+	return nil
+}
+
+// SetSceneError records the failure reported by a worker for the scene, or clears it if sceneErr is nil.
+func (sm *SceneManager) SetSceneError(ctx context.Context, id primitive.ObjectID, sceneErr *SceneError) error {
+	update := bson.M{"$set": bson.M{"error": sceneErr}}
+	if sceneErr == nil {
+		update = bson.M{"$unset": bson.M{"error": ""}}
+	}
+	result, err := sm.collection.UpdateOne(ctx, bson.M{"_id": id}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrSceneNotFound
+	}
+	return nil
+}
+
 // SetSceneName sets the name of the scene in the database by its ID.
 func (sm *SceneManager) SetSceneName(ctx context.Context, id primitive.ObjectID, name string) error {
 	result, err := sm.collection.UpdateOne(
@@ -178,6 +378,91 @@ func (sm *SceneManager) GetTrainingConfig(ctx context.Context, id primitive.Obje
 	return result.Config, nil
 }
 
+// SceneExists checks if a scene with the given ID exists in the database.
+func (sm *SceneManager) SceneExists(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	count, err := sm.collection.CountDocuments(ctx, bson.M{"_id": id}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// CountScenes returns how many of the scenes with the given IDs exist, in the trash or outside of it.
+func (sm *SceneManager) CountScenes(ctx context.Context, ids []primitive.ObjectID, trashed bool) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	return sm.collection.CountDocuments(ctx, bson.M{"_id": bson.M{"$in": ids}, "deleted_at": bson.M{"$exists": trashed}})
+}
+
+// PageSceneSummaries returns the given page of the scenes with the given IDs, in the trash or outside of it, newest first,
+// and the cursor of the next page, in a single query. Only the fields summarizing a scene are loaded: its name, failure reason,
+// deletion time, thumbnail, nerf outputs and first sfm frame.
+func (sm *SceneManager) PageSceneSummaries(ctx context.Context, ids []primitive.ObjectID, trashed bool, page pagination.Page) ([]*Scene, string, error) {
+	if len(ids) == 0 {
+		return []*Scene{}, "", nil
+	}
+
+	opts := page.FindOptions().SetProjection(bson.M{
+		"name":           1,
+		"failure_reason": 1,
+		"deleted_at":     1,
+		"thumbnail":      1,
+		"nerf":           1,
+		"sfm.frames":     bson.M{"$slice": 1},
+	})
+	filter := bson.M{"_id": bson.M{"$in": ids}, "deleted_at": bson.M{"$exists": trashed}}
+	cursor, err := sm.collection.Find(ctx, page.Filter(filter), opts)
+	if err != nil {
+		return nil, "", err
+	}
+	defer cursor.Close(ctx)
+
+	scenes := make([]*Scene, 0)
+	if err := cursor.All(ctx, &scenes); err != nil {
+		return nil, "", err
+	}
+	scenes, next := pagination.Paginate(scenes, page, func(sc *Scene) primitive.ObjectID { return sc.ID })
+	return scenes, next, nil
+}
+
+// PagePublicScenes returns the given page of the completed public scenes of the given tenant ("" for the default tenant),
+// newest first, and the cursor of the next page. Scenes that failed, are in the trash, or whose outputs are in cold storage
+// or were deleted are left out. Only the fields summarizing a scene are loaded, like PageSceneSummaries.
+func (sm *SceneManager) PagePublicScenes(ctx context.Context, tenant string, page pagination.Page) ([]*Scene, string, error) {
+	opts := page.FindOptions().SetProjection(bson.M{
+		"name":       1,
+		"thumbnail":  1,
+		"nerf":       1,
+		"sfm.frames": bson.M{"$slice": 1},
+	})
+	filter := bson.M{
+		"visibility":         VisibilityPublic,
+		"nerf":               bson.M{"$exists": true},
+		"failure_reason":     bson.M{"$exists": false},
+		"deleted_at":         bson.M{"$exists": false},
+		"outputs_deleted_at": bson.M{"$exists": false},
+		"archive.status":     bson.M{"$nin": bson.A{ArchiveStatusArchived, ArchiveStatusRestoring}},
+		"tenant":             tenant,
+	}
+	if tenant == "" {
+		// The default tenant is not stored
+		filter["tenant"] = nil
+	}
+	cursor, err := sm.collection.Find(ctx, page.Filter(filter), opts)
+	if err != nil {
+		return nil, "", err
+	}
+	defer cursor.Close(ctx)
+
+	scenes := make([]*Scene, 0)
+	if err := cursor.All(ctx, &scenes); err != nil {
+		return nil, "", err
+	}
+	scenes, next := pagination.Paginate(scenes, page, func(sc *Scene) primitive.ObjectID { return sc.ID })
+	return scenes, next, nil
+}
+
 // GetScene retrieves the Scene data from the database by its ID.
 func (sm *SceneManager) GetScene(ctx context.Context, id primitive.ObjectID) (*Scene, error) {
 	var scene Scene
@@ -191,22 +476,85 @@ func (sm *SceneManager) GetScene(ctx context.Context, id primitive.ObjectID) (*S
 	return &scene, nil
 }
 
-// GetVideo retrieves the Video data from the database by its ID.
-func (sm *SceneManager) GetVideo(ctx context.Context, id primitive.ObjectID) (*Video, error) {
-	var result struct {
-		Video *Video `bson:"video"`
+// GetScenes retrieves the Scene data of every given ID that exists in a single query, keyed by scene ID.
+func (sm *SceneManager) GetScenes(ctx context.Context, ids []primitive.ObjectID) (map[primitive.ObjectID]*Scene, error) {
+	scenes := make(map[primitive.ObjectID]*Scene, len(ids))
+	if len(ids) == 0 {
+		return scenes, nil
 	}
-	err := sm.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&result)
+
+	cursor, err := sm.collection.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var scene Scene
+		if err := cursor.Decode(&scene); err != nil {
+			return nil, err
+		}
+		scenes[scene.ID] = &scene
+	}
+	return scenes, cursor.Err()
+}
+
+// ListScenesAfter returns at most limit scenes with an ID greater than the given one (NilObjectID for the first scenes),
+// oldest first, so every scene can be walked in batches.
+func (sm *SceneManager) ListScenesAfter(ctx context.Context, after primitive.ObjectID, limit int64) ([]*Scene, error) {
+	opts := options.Find().SetSort(bson.M{"_id": 1}).SetLimit(limit)
+	cursor, err := sm.collection.Find(ctx, bson.M{"_id": bson.M{"$gt": after}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	scenes := make([]*Scene, 0)
+	if err := cursor.All(ctx, &scenes); err != nil {
+		return nil, err
+	}
+	return scenes, nil
+}
+
+// SetIntegrity records the result of an integrity check of the scene.
+func (sm *SceneManager) SetIntegrity(ctx context.Context, id primitive.ObjectID, integrity *Integrity) error {
+	result, err := sm.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"integrity": integrity}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrSceneNotFound
+	}
+	return nil
+}
+
+// SetThumbnail sets the storage key of the thumbnail of the scene.
+func (sm *SceneManager) SetThumbnail(ctx context.Context, id primitive.ObjectID, key string) error {
+	result, err := sm.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"thumbnail": key}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrSceneNotFound
+	}
+	return nil
+}
+
+// GetVideos retrieves the inputs of a scene from the database by its ID.
+func (sm *SceneManager) GetVideos(ctx context.Context, id primitive.ObjectID) ([]*Video, error) {
+	var result Scene
+	opts := options.FindOne().SetProjection(bson.M{"videos": 1, "video": 1})
+	err := sm.collection.FindOne(ctx, bson.M{"_id": id}, opts).Decode(&result)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return nil, ErrSceneNotFound
 		}
 		return nil, err
 	}
-	if result.Video == nil {
+	if len(result.Videos) == 0 {
 		return nil, ErrVideoNotFound
 	}
-	return result.Video, nil
+	return result.Videos, nil
 }
 
 // GetSfm retrieves the Sfm data from the database by its ID.
@@ -245,6 +593,24 @@ func (sm *SceneManager) GetNerf(ctx context.Context, id primitive.ObjectID) (*Ne
 	return result.Nerf, nil
 }
 
+// GetCost retrieves the ProcessingCost data from the database by its ID.
+func (sm *SceneManager) GetCost(ctx context.Context, id primitive.ObjectID) (*ProcessingCost, error) {
+	var result struct {
+		Cost *ProcessingCost `bson:"cost"`
+	}
+	err := sm.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&result)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrSceneNotFound
+		}
+		return nil, err
+	}
+	if result.Cost == nil {
+		return nil, ErrCostNotFound
+	}
+	return result.Cost, nil
+}
+
 // DeleteScene deletes a scene from the database by its ID.
 func (sm *SceneManager) DeleteScene(ctx context.Context, id primitive.ObjectID) error {
 	result, err := sm.collection.DeleteOne(ctx, bson.M{"_id": id})
@@ -256,3 +622,253 @@ func (sm *SceneManager) DeleteScene(ctx context.Context, id primitive.ObjectID)
 	}
 	return nil
 }
+
+// TrashScene moves the scene to the trash, as deleted at the given time. Scenes already in the trash keep their deletion time.
+func (sm *SceneManager) TrashScene(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	result, err := sm.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "deleted_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"deleted_at": at}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		if _, err := sm.GetDeletedAt(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreTrashedScene moves the scene out of the trash.
+//
+// Returns ErrSceneNotInTrash if the scene is not in the trash, ErrSceneNotFound if it does not exist.
+func (sm *SceneManager) RestoreTrashedScene(ctx context.Context, id primitive.ObjectID) error {
+	result, err := sm.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "deleted_at": bson.M{"$exists": true}},
+		bson.M{"$unset": bson.M{"deleted_at": ""}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		if _, err := sm.GetDeletedAt(ctx, id); err != nil {
+			return err
+		}
+		return ErrSceneNotInTrash
+	}
+	return nil
+}
+
+// GetDeletedAt returns when the scene was moved to the trash, or nil if it is not in the trash.
+//
+// Returns ErrSceneNotFound if the scene does not exist.
+func (sm *SceneManager) GetDeletedAt(ctx context.Context, id primitive.ObjectID) (*time.Time, error) {
+	var result struct {
+		DeletedAt *time.Time `bson:"deleted_at"`
+	}
+	opts := options.FindOne().SetProjection(bson.M{"deleted_at": 1})
+	err := sm.collection.FindOne(ctx, bson.M{"_id": id}, opts).Decode(&result)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrSceneNotFound
+		}
+		return nil, err
+	}
+	return result.DeletedAt, nil
+}
+
+// GetCallback returns the webhook of a scene, nil if it has none.
+//
+// Returns ErrSceneNotFound if the scene does not exist.
+func (sm *SceneManager) GetCallback(ctx context.Context, id primitive.ObjectID) (*Callback, error) {
+	var result struct {
+		Callback *Callback `bson:"callback"`
+	}
+	opts := options.FindOne().SetProjection(bson.M{"callback": 1})
+	err := sm.collection.FindOne(ctx, bson.M{"_id": id}, opts).Decode(&result)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrSceneNotFound
+		}
+		return nil, err
+	}
+	return result.Callback, nil
+}
+
+// ListTrashedScenes returns the IDs of the scenes moved to the trash before the given time.
+func (sm *SceneManager) ListTrashedScenes(ctx context.Context, before time.Time) ([]primitive.ObjectID, error) {
+	filter := bson.M{"deleted_at": bson.M{"$lt": before}}
+	return sm.findIDs(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+}
+
+// BeginArchive marks a completed scene as being archived with the given output keys. An archive stuck since before
+// staleBefore (i.e its instance died) is taken over.
+//
+// Returns false if the scene is not completed, or already (being) archived or restored.
+func (sm *SceneManager) BeginArchive(ctx context.Context, id primitive.ObjectID, keys []string, bytes int64, staleBefore time.Time) (bool, error) {
+	result, err := sm.collection.UpdateOne(
+		ctx,
+		bson.M{
+			"_id":                id,
+			"nerf":               bson.M{"$exists": true},
+			"outputs_deleted_at": bson.M{"$exists": false},
+			"$or": bson.A{
+				bson.M{"archive": bson.M{"$exists": false}},
+				bson.M{"archive.status": ArchiveStatusArchiving, "archive.updated_at": bson.M{"$lt": staleBefore}},
+			},
+		},
+		bson.M{"$set": bson.M{"archive": Archive{
+			Status:    ArchiveStatusArchiving,
+			Keys:      keys,
+			Bytes:     bytes,
+			UpdatedAt: time.Now().UTC(),
+		}}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// TransitionArchive moves the archive of a scene from one status to another, and resets its progress.
+// A scene stuck in the target status since before staleBefore is taken over; pass the zero time to never take over.
+//
+// Returns false if the archive is in neither state.
+func (sm *SceneManager) TransitionArchive(ctx context.Context, id primitive.ObjectID, from, to string, staleBefore time.Time) (bool, error) {
+	now := time.Now().UTC()
+	set := bson.M{"archive.status": to, "archive.moved": 0, "archive.updated_at": now}
+	if to == ArchiveStatusArchived {
+		set["archive.archived_at"] = now
+	}
+	update := bson.M{"$set": set}
+	if to == ArchiveStatusRestoring {
+		update["$unset"] = bson.M{"archive.error": ""}
+	}
+
+	result, err := sm.collection.UpdateOne(
+		ctx,
+		bson.M{
+			"_id": id,
+			"$or": bson.A{
+				bson.M{"archive.status": from},
+				bson.M{"archive.status": to, "archive.updated_at": bson.M{"$lt": staleBefore}},
+			},
+		},
+		update,
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// SetArchiveProgress records the number of objects copied by the running archive operation.
+func (sm *SceneManager) SetArchiveProgress(ctx context.Context, id primitive.ObjectID, status string, moved int) error {
+	_, err := sm.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "archive.status": status},
+		bson.M{"$set": bson.M{"archive.moved": moved, "archive.updated_at": time.Now().UTC()}},
+	)
+	return err
+}
+
+// FailRestore moves a restoring scene back to archived, recording why the restore failed.
+func (sm *SceneManager) FailRestore(ctx context.Context, id primitive.ObjectID, reason string) error {
+	_, err := sm.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "archive.status": ArchiveStatusRestoring},
+		bson.M{"$set": bson.M{
+			"archive.status":     ArchiveStatusArchived,
+			"archive.error":      reason,
+			"archive.updated_at": time.Now().UTC(),
+		}},
+	)
+	return err
+}
+
+// ClearArchive removes the archive of a scene in the given status, making its outputs hot again.
+// Clearing a restored archive sets RestoredAt.
+func (sm *SceneManager) ClearArchive(ctx context.Context, id primitive.ObjectID, status string) error {
+	update := bson.M{"$unset": bson.M{"archive": ""}}
+	if status == ArchiveStatusRestoring {
+		update["$set"] = bson.M{"restored_at": time.Now().UTC()}
+	}
+	_, err := sm.collection.UpdateOne(ctx, bson.M{"_id": id, "archive.status": status}, update)
+	return err
+}
+
+// ListArchiveCandidates returns the IDs of completed, hot scenes outside of the trash created (or last restored) before the given time.
+func (sm *SceneManager) ListArchiveCandidates(ctx context.Context, before time.Time, limit int64) ([]primitive.ObjectID, error) {
+	filter := bson.M{
+		"_id":                bson.M{"$lt": primitive.NewObjectIDFromTimestamp(before)},
+		"nerf":               bson.M{"$exists": true},
+		"archive":            bson.M{"$exists": false},
+		"outputs_deleted_at": bson.M{"$exists": false},
+		"deleted_at":         bson.M{"$exists": false},
+		"$or": bson.A{
+			bson.M{"restored_at": bson.M{"$exists": false}},
+			bson.M{"restored_at": bson.M{"$lt": before}},
+		},
+	}
+	opts := options.Find().SetProjection(bson.M{"_id": 1}).SetLimit(limit)
+	return sm.findIDs(ctx, filter, opts)
+}
+
+// ListStaleArchives returns the IDs of scenes whose archive or restore made no progress since before the given time.
+func (sm *SceneManager) ListStaleArchives(ctx context.Context, status string, before time.Time) ([]primitive.ObjectID, error) {
+	filter := bson.M{"archive.status": status, "archive.updated_at": bson.M{"$lt": before}}
+	return sm.findIDs(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+}
+
+// findIDs returns the IDs of the scenes matching filter.
+func (sm *SceneManager) findIDs(ctx context.Context, filter bson.M, opts *options.FindOptions) ([]primitive.ObjectID, error) {
+	cursor, err := sm.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var results []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, len(results))
+	for i, r := range results {
+		ids[i] = r.ID
+	}
+	return ids, nil
+}
+
+// MarkOutputsDeleted removes the output paths, previous versions and archive of a scene whose outputs were deleted, unless
+// an archive or restore is moving them.
+//
+// Returns ErrArchiveConflict if the outputs are being moved.
+func (sm *SceneManager) MarkOutputsDeleted(ctx context.Context, id primitive.ObjectID) error {
+	result, err := sm.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "archive.status": bson.M{"$nin": bson.A{ArchiveStatusArchiving, ArchiveStatusRestoring}}},
+		bson.M{
+			"$set": bson.M{"outputs_deleted_at": time.Now().UTC()},
+			"$unset": bson.M{
+				"archive":                     "",
+				"nerf.model_file_paths":       "",
+				"nerf.splat_cloud_file_paths": "",
+				"nerf.point_cloud_file_paths": "",
+				"nerf.video_file_paths":       "",
+				"nerf_versions":               "",
+			},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrArchiveConflict
+	}
+	return nil
+}
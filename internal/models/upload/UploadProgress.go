@@ -0,0 +1,44 @@
+// This file contains the UploadProgress struct and its members.
+
+package upload
+
+import (
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Custom errors
+var (
+	// ErrUploadProgressNotFound is returned when no upload of the user is tracked under the requested ID, or its progress expired.
+	ErrUploadProgressNotFound = errors.New("upload progress not found")
+)
+
+// Statuses of a tracked upload
+const (
+	// ProgressReceiving is the status of an upload whose file is still being received
+	ProgressReceiving = "receiving"
+	// ProgressProcessing is the status of an upload whose file was received, while it is validated and its scene created
+	ProgressProcessing = "processing"
+	// ProgressDone is the status of an upload whose scene was created
+	ProgressDone = "done"
+	// ProgressFailed is the status of an upload that was rejected or interrupted
+	ProgressFailed = "failed"
+)
+
+// UploadProgress records the bytes received of a streamed upload, under an ID chosen by the client
+type UploadProgress struct {
+	UserID   primitive.ObjectID `bson:"user_id" json:"-"`
+	UploadID string             `bson:"upload_id" json:"upload_id"`
+	FileName string             `bson:"file_name" json:"file_name"`
+	Status   string             `bson:"status" json:"status"`
+	Received int64              `bson:"received" json:"received"`
+	// Total is the declared size of the upload, or 0 if unknown. For multipart uploads it is the size of the request body,
+	// so it is slightly larger than the file
+	Total     int64              `bson:"total" json:"total"`
+	SceneID   primitive.ObjectID `bson:"scene_id,omitempty" json:"scene_id,omitempty"`
+	Error     string             `bson:"error,omitempty" json:"error,omitempty"`
+	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
+	ExpiresAt time.Time          `bson:"expires_at" json:"-"`
+}
@@ -0,0 +1,77 @@
+// This file contains the UploadProgressManager implementation, which is responsible for interacting with the MongoDB upload_progress collection.
+// The UploadProgressManager struct contains a pointer to the nerfdb.upload_progress MongoDB collection and a logger. It provides methods to
+// save and look up the progress of streamed uploads, so a client can poll it from any replica while its upload is received by another.
+//
+// Progress is only useful while an upload runs, so it is removed by a TTL index once expired.
+
+package upload
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+)
+
+type UploadProgressManager struct {
+	collection *mongo.Collection
+	logger     *log.Logger
+}
+
+// NewUploadProgressManager creates a new UploadProgressManager with the given MongoDB client and logger.
+func NewUploadProgressManager(client *mongo.Client, logger *log.Logger, unittest bool) *UploadProgressManager {
+	return &UploadProgressManager{
+		collection: client.Database("nerfdb").Collection("upload_progress"),
+		logger:     logger,
+	}
+}
+
+// EnsureIndexes creates the unique index on the upload IDs of a user, and the TTL index removing expired progress.
+func (upm *UploadProgressManager) EnsureIndexes(ctx context.Context) error {
+	_, err := upm.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "upload_id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+// SaveProgress inserts or replaces the progress of the upload of progress.UserID with ID progress.UploadID.
+func (upm *UploadProgressManager) SaveProgress(ctx context.Context, progress *UploadProgress) error {
+	_, err := upm.collection.ReplaceOne(
+		ctx,
+		bson.M{"user_id": progress.UserID, "upload_id": progress.UploadID},
+		progress,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+// GetProgress retrieves the progress of the upload of the given user with the given ID.
+//
+// Returns ErrUploadProgressNotFound if no upload is tracked under the ID, or its progress expired.
+func (upm *UploadProgressManager) GetProgress(ctx context.Context, userID primitive.ObjectID, uploadID string) (*UploadProgress, error) {
+	var progress UploadProgress
+	err := upm.collection.FindOne(
+		ctx,
+		bson.M{"user_id": userID, "upload_id": uploadID, "expires_at": bson.M{"$gt": time.Now().UTC()}},
+	).Decode(&progress)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrUploadProgressNotFound
+		}
+		return nil, err
+	}
+	return &progress, nil
+}
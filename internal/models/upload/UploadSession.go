@@ -0,0 +1,43 @@
+// This file contains the UploadSession struct and its members.
+
+package upload
+
+import (
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Custom errors
+var (
+	// ErrUploadSessionNotFound is returned when a requested upload session does not exist or expired.
+	ErrUploadSessionNotFound = errors.New("upload session not found")
+	// ErrOffsetMismatch is returned when a chunk does not start at the number of bytes received so far.
+	ErrOffsetMismatch = errors.New("chunk offset does not match the bytes received")
+)
+
+// UploadSession represents a resumable, chunked video upload, or a direct upload to object storage
+type UploadSession struct {
+	ID        primitive.ObjectID `bson:"_id" json:"upload_id"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"-"`
+	FileName  string             `bson:"file_name" json:"file_name"`
+	Size      int64              `bson:"size" json:"size"`
+	Offset    int64              `bson:"offset" json:"offset"`
+	ChunkKeys []string           `bson:"chunk_keys" json:"-"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	ExpiresAt time.Time          `bson:"expires_at" json:"expires_at"`
+	// SceneID and ObjectKey are set for direct uploads: the scene the file is reserved for, and the key the client uploads it to
+	SceneID   primitive.ObjectID `bson:"scene_id,omitempty" json:"-"`
+	ObjectKey string             `bson:"object_key,omitempty" json:"key,omitempty"`
+}
+
+// IsDirect checks if the file is uploaded directly to object storage instead of in chunks through the server.
+func (s *UploadSession) IsDirect() bool {
+	return s.ObjectKey != ""
+}
+
+// IsComplete checks if every declared byte of the upload was received.
+func (s *UploadSession) IsComplete() bool {
+	return s.Offset == s.Size
+}
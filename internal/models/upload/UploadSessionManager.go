@@ -0,0 +1,178 @@
+// This file contains the UploadSessionManager implementation, which is responsible for interacting with the MongoDB upload_sessions collection.
+// The UploadSessionManager struct contains a pointer to the nerfdb.upload_sessions MongoDB collection and a logger. It provides methods to
+// create, look up, advance and delete upload sessions. Advancing is conditional on the current offset, so concurrent chunks
+// for the same offset can not both be accepted.
+//
+// Expired sessions are not removed by a TTL index, as their chunks must be removed from storage first. See ListExpiredSessions.
+
+package upload
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+)
+
+type UploadSessionManager struct {
+	collection *mongo.Collection
+	logger     *log.Logger
+}
+
+// NewUploadSessionManager creates a new UploadSessionManager with the given MongoDB client and logger.
+func NewUploadSessionManager(client *mongo.Client, logger *log.Logger, unittest bool) *UploadSessionManager {
+	return &UploadSessionManager{
+		collection: client.Database("nerfdb").Collection("upload_sessions"),
+		logger:     logger,
+	}
+}
+
+// EnsureIndexes creates the indexes used to find expired sessions, and direct uploads by their object key.
+func (usm *UploadSessionManager) EnsureIndexes(ctx context.Context) error {
+	_, err := usm.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "object_key", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"object_key": bson.M{"$exists": true}}),
+		},
+	})
+	return err
+}
+
+// CreateSession inserts a new, empty upload session for the given user.
+//
+// Returns the stored UploadSession if successful, error otherwise.
+func (usm *UploadSessionManager) CreateSession(
+	ctx context.Context,
+	userID primitive.ObjectID,
+	fileName string,
+	size int64,
+	ttl time.Duration,
+) (*UploadSession, error) {
+	now := time.Now().UTC()
+	session := &UploadSession{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		FileName:  fileName,
+		Size:      size,
+		ChunkKeys: []string{},
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+
+	if _, err := usm.collection.InsertOne(ctx, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// CreateDirectSession inserts a new upload session for the given user, whose file is uploaded directly to object storage
+// under objectKey, for the scene with the given ID.
+//
+// Returns the stored UploadSession if successful, error otherwise.
+func (usm *UploadSessionManager) CreateDirectSession(
+	ctx context.Context,
+	userID primitive.ObjectID,
+	fileName string,
+	size int64,
+	sceneID primitive.ObjectID,
+	objectKey string,
+	ttl time.Duration,
+) (*UploadSession, error) {
+	now := time.Now().UTC()
+	session := &UploadSession{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		FileName:  fileName,
+		Size:      size,
+		ChunkKeys: []string{},
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+		SceneID:   sceneID,
+		ObjectKey: objectKey,
+	}
+
+	if _, err := usm.collection.InsertOne(ctx, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// GetSession retrieves the upload session with the given ID.
+//
+// Returns ErrUploadSessionNotFound if the session does not exist or expired.
+func (usm *UploadSessionManager) GetSession(ctx context.Context, id primitive.ObjectID) (*UploadSession, error) {
+	var session UploadSession
+	err := usm.collection.FindOne(ctx, bson.M{"_id": id, "expires_at": bson.M{"$gt": time.Now().UTC()}}).Decode(&session)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrUploadSessionNotFound
+		}
+		return nil, err
+	}
+	return &session, nil
+}
+
+// GetSessionByObjectKey retrieves the direct upload session whose file is uploaded under the given key.
+//
+// Returns ErrUploadSessionNotFound if the session does not exist or expired.
+func (usm *UploadSessionManager) GetSessionByObjectKey(ctx context.Context, objectKey string) (*UploadSession, error) {
+	var session UploadSession
+	err := usm.collection.FindOne(ctx, bson.M{"object_key": objectKey, "expires_at": bson.M{"$gt": time.Now().UTC()}}).Decode(&session)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrUploadSessionNotFound
+		}
+		return nil, err
+	}
+	return &session, nil
+}
+
+// AdvanceOffset records a chunk stored under chunkKey, moving the offset of the session from `from` to `to`,
+// and extends the expiry of the session to expiresAt.
+//
+// Returns ErrOffsetMismatch if the offset of the session is no longer `from` (i.e another chunk was accepted concurrently).
+func (usm *UploadSessionManager) AdvanceOffset(ctx context.Context, id primitive.ObjectID, from, to int64, chunkKey string, expiresAt time.Time) error {
+	result, err := usm.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "offset": from},
+		bson.M{
+			"$set":  bson.M{"offset": to, "expires_at": expiresAt},
+			"$push": bson.M{"chunk_keys": chunkKey},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrOffsetMismatch
+	}
+	return nil
+}
+
+// ListExpiredSessions returns the sessions that expired before the given time.
+func (usm *UploadSessionManager) ListExpiredSessions(ctx context.Context, before time.Time) ([]*UploadSession, error) {
+	cursor, err := usm.collection.Find(ctx, bson.M{"expires_at": bson.M{"$lte": before}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	sessions := make([]*UploadSession, 0)
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// DeleteSession deletes the upload session with the given ID. Deleting a missing session is not an error.
+func (usm *UploadSessionManager) DeleteSession(ctx context.Context, id primitive.ObjectID) error {
+	_, err := usm.collection.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
@@ -0,0 +1,9 @@
+// Package upload contains the implementation of resumable upload sessions stored in the MongoDB upload_sessions collection.
+// The UploadSessionManager struct is responsible for interacting with the MongoDB upload_sessions collection.
+// The UploadSession struct records the state of a chunked video upload (declared size, bytes received, stored chunks, expiry),
+// so an interrupted upload can be resumed from its last received byte, even on another replica or after a restart.
+// The chunks themselves are stored in artifact storage, only their keys are stored in the session.
+// Sessions of direct uploads record the key the client uploads the whole file to with a presigned URL, instead of chunks.
+// The UploadProgressManager struct is responsible for interacting with the MongoDB upload_progress collection, which records
+// the bytes received of streamed (multipart) uploads, so clients can show the progress of large uploads.
+package upload
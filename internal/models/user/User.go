@@ -3,12 +3,22 @@
 // The User struct contains the user's ID, username, encrypted password, and a list of scene IDs.
 // The scene IDs are used to associate a user with the scenes they have access to.
 // Passwords are encrypted and checked using bcrypt.
+// Users may also log in through linked external accounts (OAuth identities), in which case they may have no password.
+// Users may set an email address for notifications (i.e weekly digests), which otherwise falls back to the email of a linked identity.
+// Consecutive failed password logins are counted on the user, and lock the account for a while once they reach a threshold.
+// Users are granted privileges through roles (i.e admin), checked by the web middleware of protected routes.
+// Users belong to a tier (DefaultTier unless set), which selects the retention rule applied to their outputs once inactive.
+// Admins can give a user their own maximum upload size, replacing the one of the deployment.
+// Users deleting their account are scheduled for deletion, and are only removed once the grace period passed; logging in cancels it.
+// Acceptances of the terms of service / privacy policy are appended to the user, so the full acceptance history is kept.
+// Guest users are ephemeral trial accounts without credentials, created already scheduled for deletion.
 
 package user
 
 import (
 	"errors"
 	"slices"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"golang.org/x/crypto/bcrypt"
@@ -19,14 +29,159 @@ var (
 	ErrSceneIDNotFound = errors.New("scene ID not found in User scene list")
 	// ErrSceneIDAlreadyExists is returned when a scene ID is already in the user's scene list
 	ErrSceneIDAlreadyExists = errors.New("scene ID already exists in user scene list")
+	// ErrPoliciesNotAccepted is returned when the user has not accepted the current terms of service / privacy policy
+	ErrPoliciesNotAccepted = errors.New("current terms of service and privacy policy must be accepted")
+	// ErrPolicyVersionMismatch is returned when the user accepts a policy version that is not the current one
+	ErrPolicyVersionMismatch = errors.New("accepted policy version is not the current version")
+	// ErrOAuthIdentityLinked is returned when an external account is already linked to a different user
+	ErrOAuthIdentityLinked = errors.New("external account is already linked to another user")
+	// ErrInvalidTimezone is returned when a timezone preference is not a valid IANA timezone name
+	ErrInvalidTimezone = errors.New("invalid timezone, expected an IANA timezone name (i.e Europe/Berlin)")
+	// ErrInvalidRole is returned when a role is not one of ValidRoles
+	ErrInvalidRole = errors.New("invalid role")
+	// ErrAccountLocked is returned (wrapped in an AccountLockedError) when logging in to a temporarily locked account
+	ErrAccountLocked = errors.New("too many failed login attempts, account temporarily locked")
 )
 
+// AccountLockedError is returned when logging in to an account locked after too many failed login attempts.
+// It unwraps to ErrAccountLocked.
+type AccountLockedError struct {
+	Until time.Time
+}
+
+func (e *AccountLockedError) Error() string {
+	return ErrAccountLocked.Error()
+}
+
+func (e *AccountLockedError) Unwrap() error {
+	return ErrAccountLocked
+}
+
+// Declarations for valid roles
+const (
+	// RoleAdmin grants access to the /admin routes (announcements, trends, user management, queue inspection)
+	RoleAdmin = "admin"
+)
+
+// ValidRoles are the roles that can be granted to users
+var ValidRoles = []string{RoleAdmin}
+
 // User represents a user in the system
 type User struct {
-	ID                primitive.ObjectID   `bson:"_id,omitempty"`
-	Username          string               `bson:"username"`
-	EncryptedPassword string               `bson:"encrypted_password"`
-	SceneIDs          []primitive.ObjectID `bson:"scene_ids"`
+	ID                  primitive.ObjectID   `bson:"_id,omitempty"`
+	Username            string               `bson:"username"`
+	EncryptedPassword   string               `bson:"encrypted_password"`
+	SceneIDs            []primitive.ObjectID `bson:"scene_ids"`
+	PolicyAcceptances   []PolicyAcceptance   `bson:"policy_acceptances,omitempty"`
+	OAuthIdentities     []OAuthIdentity      `bson:"oauth_identities,omitempty"`
+	Timezone            string               `bson:"timezone,omitempty"`
+	Email               string               `bson:"email,omitempty"`
+	DigestOptOut        bool                 `bson:"digest_opt_out,omitempty"`
+	LastDigestAt        *time.Time           `bson:"last_digest_at,omitempty"`
+	Roles               []string             `bson:"roles,omitempty"`
+	FailedLogins        int                  `bson:"failed_logins,omitempty"`
+	LockedUntil         *time.Time           `bson:"locked_until,omitempty"`
+	Tier                string               `bson:"tier,omitempty"`
+	RetentionExempt     bool                 `bson:"retention_exempt,omitempty"`
+	LastActiveAt        *time.Time           `bson:"last_active_at,omitempty"`
+	RetentionWarnedAt   *time.Time           `bson:"retention_warned_at,omitempty"`
+	RetentionPurgedAt   *time.Time           `bson:"retention_purged_at,omitempty"`
+	DeletionScheduledAt *time.Time           `bson:"deletion_scheduled_at,omitempty"`
+	Guest               bool                 `bson:"guest,omitempty"`
+	Tenant              string               `bson:"tenant,omitempty"`
+	UploadMaxSize       int64                `bson:"upload_max_size,omitempty"`
+}
+
+// DefaultTier is the tier of users without an explicit tier
+const DefaultTier = "free"
+
+// OAuthIdentity represents an external (social login) account linked to a user.
+// Users created through social login have no password, and can only log in through a linked identity.
+type OAuthIdentity struct {
+	Provider string    `bson:"provider"`
+	Subject  string    `bson:"subject"`
+	Email    string    `bson:"email,omitempty"`
+	LinkedAt time.Time `bson:"linked_at"`
+}
+
+// PolicyAcceptance represents a single acceptance of the terms of service and privacy policy
+type PolicyAcceptance struct {
+	TermsVersion   string    `bson:"terms_version"`
+	PrivacyVersion string    `bson:"privacy_version"`
+	AcceptedAt     time.Time `bson:"accepted_at"`
+	IP             string    `bson:"ip,omitempty"`
+}
+
+// Location returns the user's preferred timezone, used to localize notifications and digests.
+// API responses are always in UTC. Returns UTC if the user has no (valid) preference.
+func (u *User) Location() *time.Location {
+	if u.Timezone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(u.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// SetTimezone sets the user's preferred timezone. An empty timezone resets the preference to UTC.
+//
+// Returns ErrInvalidTimezone if the timezone is not a valid IANA timezone name.
+func (u *User) SetTimezone(timezone string) error {
+	if timezone != "" {
+		if _, err := time.LoadLocation(timezone); err != nil {
+			return ErrInvalidTimezone
+		}
+	}
+	u.Timezone = timezone
+	return nil
+}
+
+// IsLocked checks if the account is locked at the given time.
+func (u *User) IsLocked(now time.Time) bool {
+	return u.LockedUntil != nil && now.Before(*u.LockedUntil)
+}
+
+// EffectiveTier returns the tier of the user, DefaultTier if none was set.
+func (u *User) EffectiveTier() string {
+	if u.Tier == "" {
+		return DefaultTier
+	}
+	return u.Tier
+}
+
+// HasRole checks if the user was granted the given role.
+func (u *User) HasRole(role string) bool {
+	return slices.Contains(u.Roles, role)
+}
+
+// NotificationEmail returns the address notifications are sent to: the user's email if set, otherwise the email
+// of the first linked identity that has one. Returns "" if the user has no known address.
+func (u *User) NotificationEmail() string {
+	if u.Email != "" {
+		return u.Email
+	}
+	for _, identity := range u.OAuthIdentities {
+		if identity.Email != "" {
+			return identity.Email
+		}
+	}
+	return ""
+}
+
+// HasAcceptedPolicies checks if the user's latest acceptance matches the given versions.
+// Empty versions are treated as not enforced.
+func (u *User) HasAcceptedPolicies(termsVersion, privacyVersion string) bool {
+	if termsVersion == "" && privacyVersion == "" {
+		return true
+	}
+	if len(u.PolicyAcceptances) == 0 {
+		return false
+	}
+	latest := u.PolicyAcceptances[len(u.PolicyAcceptances)-1]
+	return (termsVersion == "" || latest.TermsVersion == termsVersion) &&
+		(privacyVersion == "" || latest.PrivacyVersion == privacyVersion)
 }
 
 // AddScene adds a scene ID to the user's list of scenes
@@ -61,6 +216,11 @@ func (u *User) SetPassword(password string) error {
 	return nil
 }
 
+// HasPassword checks if the user can log in with a password. Users created through social login have none.
+func (u *User) HasPassword() bool {
+	return u.EncryptedPassword != ""
+}
+
 // CheckPassword verifies if the provided password is correct.
 // Returns nil on success, or error on failure
 func (u *User) CheckPassword(password string) error {
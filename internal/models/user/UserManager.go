@@ -9,6 +9,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -42,6 +44,14 @@ func NewUserManager(client *mongo.Client, logger *log.Logger, unittest bool) *Us
 	}
 }
 
+// tenantFilter returns the filter value matching users of the given tenant. Users of the default tenant have no tenant field.
+func tenantFilter(tenant string) interface{} {
+	if tenant == "" {
+		return nil
+	}
+	return tenant
+}
+
 // SetUser updates or inserts a user document in the database.
 // Returns nil if successful, or an error if an error occurred while updating the user.
 func (um *UserManager) SetUser(ctx context.Context, user *User) error {
@@ -70,12 +80,12 @@ func (um *UserManager) UpdateUser(ctx context.Context, user *User) error {
 	return nil
 }
 
-// GenerateUser generates a new user document with the given username and password,
+// GenerateUser generates a new user document of the given tenant with the given username and password,
 // and inserts it into the database. Returns the User, nil if successful.
 // Returns nil, error if the username is already taken or an error occurred while inserting the user.
-func (um *UserManager) GenerateUser(ctx context.Context, username, password string) (*User, error) {
+func (um *UserManager) GenerateUser(ctx context.Context, tenant, username, password string) (*User, error) {
 	// Check if username is already taken
-	_, err := um.GetUserByUsername(ctx, username)
+	_, err := um.GetUserByUsername(ctx, tenant, username)
 	if err != nil {
 		if !errors.Is(err, ErrUserNotFound) {
 			return nil, err
@@ -88,6 +98,7 @@ func (um *UserManager) GenerateUser(ctx context.Context, username, password stri
 	user := &User{
 		ID:       id,
 		Username: username,
+		Tenant:   tenant,
 	}
 
 	if err := user.SetPassword(password); err != nil {
@@ -114,11 +125,12 @@ func (um *UserManager) GetUserByID(ctx context.Context, userID primitive.ObjectI
 	return &user, nil
 }
 
-// GetUserByUsername retrieves a user from the database based on the given username.
+// GetUserByUsername retrieves a user of the given tenant from the database based on the given username.
+// Usernames are unique per tenant, so the same username may exist in several tenants.
 // Returns the User, nil if successful. Returns nil, error if the user is not found.
-func (um *UserManager) GetUserByUsername(ctx context.Context, username string) (*User, error) {
+func (um *UserManager) GetUserByUsername(ctx context.Context, tenant, username string) (*User, error) {
 	var user User
-	err := um.collection.FindOne(ctx, bson.M{"username": username}).Decode(&user)
+	err := um.collection.FindOne(ctx, bson.M{"username": username, "tenant": tenantFilter(tenant)}).Decode(&user)
 	if err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
 			fmt.Println("User not found")
@@ -130,6 +142,23 @@ func (um *UserManager) GetUserByUsername(ctx context.Context, username string) (
 	return &user, nil
 }
 
+// AddPolicyAcceptance appends a terms of service / privacy policy acceptance to the user's acceptance history.
+// Returns ErrUserNotFound if the user does not exist.
+func (um *UserManager) AddPolicyAcceptance(ctx context.Context, userID primitive.ObjectID, acceptance PolicyAcceptance) error {
+	result, err := um.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": userID},
+		bson.M{"$push": bson.M{"policy_acceptances": acceptance}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
 // UserHasJobAccess checks if a user has access to a job by searching for the job ID in the user's sceneIDs.
 func (um *UserManager) UserHasJobAccess(ctx context.Context, userID, jobID primitive.ObjectID) (bool, error) {
 	user, err := um.GetUserByID(ctx, userID)
@@ -144,6 +173,24 @@ func (um *UserManager) UserHasJobAccess(ctx context.Context, userID, jobID primi
 	return false, nil
 }
 
+// GetSceneOwnerID returns the ID of the user whose scene list holds the given scene.
+//
+// Returns ErrUserNotFound if no user holds the scene.
+func (um *UserManager) GetSceneOwnerID(ctx context.Context, sceneID primitive.ObjectID) (primitive.ObjectID, error) {
+	var result struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	opts := options.FindOne().SetProjection(bson.M{"_id": 1})
+	err := um.collection.FindOne(ctx, bson.M{"scene_ids": sceneID}, opts).Decode(&result)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return primitive.NilObjectID, ErrUserNotFound
+		}
+		return primitive.NilObjectID, err
+	}
+	return result.ID, nil
+}
+
 // UpdatePassword updates the user's password. Verifies the old password before setting the new password.
 // Returns nil if successful, or an error if the old password is incorrect or an error occurred while updating the password.
 func (um *UserManager) UpdatePassword(ctx context.Context, userID primitive.ObjectID, oldPassword, newPassword string) error {
@@ -163,21 +210,517 @@ func (um *UserManager) UpdatePassword(ctx context.Context, userID primitive.Obje
 // Requires the user's password to verify the change.
 // Returns nil if successful, or an error if the new username is already taken or an error occurred while updating the username.
 func (um *UserManager) UpdateUsername(ctx context.Context, userID primitive.ObjectID, userPassword, newUsername string) error {
-	_, err := um.GetUserByUsername(ctx, newUsername)
+	user, err := um.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = um.GetUserByUsername(ctx, user.Tenant, newUsername)
 	if err == nil {
 		return ErrUsernameTaken
 	}
-	
+
+	err = user.CheckPassword(userPassword)
+	if err != nil {
+		return err
+	}
+
+	user.Username = newUsername
+	return um.UpdateUser(ctx, user)
+}
+
+// RemoveSceneID atomically removes a scene ID from the scene list of the user with the given ID.
+//
+// Returns ErrUserNotFound if the user does not exist, ErrSceneIDNotFound if the scene is not in the user's scene list.
+func (um *UserManager) RemoveSceneID(ctx context.Context, userID, sceneID primitive.ObjectID) error {
+	result, err := um.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": userID, "scene_ids": sceneID},
+		bson.M{"$pull": bson.M{"scene_ids": sceneID}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		if _, err := um.GetUserByID(ctx, userID); err != nil {
+			return err
+		}
+		return ErrSceneIDNotFound
+	}
+	return nil
+}
+
+// RemoveSceneIDFromUsers atomically removes a scene ID from the scene list of every user holding it.
+func (um *UserManager) RemoveSceneIDFromUsers(ctx context.Context, sceneID primitive.ObjectID) error {
+	_, err := um.collection.UpdateMany(
+		ctx,
+		bson.M{"scene_ids": sceneID},
+		bson.M{"$pull": bson.M{"scene_ids": sceneID}},
+	)
+	return err
+}
+
+// GenerateOAuthUser generates a new user document of the given tenant without a password, linked to the given external account,
+// and inserts it into the database.
+//
+// Returns the User if successful, ErrUsernameTaken if the username is taken, error otherwise.
+func (um *UserManager) GenerateOAuthUser(ctx context.Context, tenant, username string, identity OAuthIdentity) (*User, error) {
+	_, err := um.GetUserByUsername(ctx, tenant, username)
+	if err != nil {
+		if !errors.Is(err, ErrUserNotFound) {
+			return nil, err
+		}
+	} else {
+		return nil, ErrUsernameTaken
+	}
+
+	user := &User{
+		ID:              primitive.NewObjectID(),
+		Username:        username,
+		SceneIDs:        []primitive.ObjectID{},
+		OAuthIdentities: []OAuthIdentity{identity},
+		Tenant:          tenant,
+	}
+	if err := um.SetUser(ctx, user); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// GenerateGuestUser generates a new guest user document of the given tenant, without a password and scheduled for deletion
+// at the given time, and inserts it into the database. The username is derived from the generated ID, so it never collides.
+//
+// Returns the User if successful, error otherwise.
+func (um *UserManager) GenerateGuestUser(ctx context.Context, tenant string, expiresAt time.Time) (*User, error) {
+	id := primitive.NewObjectID()
+	user := &User{
+		ID:                  id,
+		Username:            "guest-" + id.Hex(),
+		SceneIDs:            []primitive.ObjectID{},
+		DeletionScheduledAt: &expiresAt,
+		Guest:               true,
+		Tenant:              tenant,
+	}
+	if err := um.SetUser(ctx, user); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// GetUserByOAuthIdentity retrieves the user of the given tenant linked to the given external account.
+//
+// Returns the User if found, ErrUserNotFound if no user is linked, error otherwise.
+func (um *UserManager) GetUserByOAuthIdentity(ctx context.Context, tenant, provider, subject string) (*User, error) {
+	var user User
+	err := um.collection.FindOne(ctx, bson.M{
+		"oauth_identities": bson.M{"$elemMatch": bson.M{"provider": provider, "subject": subject}},
+		"tenant":           tenantFilter(tenant),
+	}).Decode(&user)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// AddOAuthIdentity links an external account to the user with the given ID. Linking an already linked account is a no-op.
+//
+// Returns ErrOAuthIdentityLinked if the account is linked to another user, ErrUserNotFound if the user does not exist.
+func (um *UserManager) AddOAuthIdentity(ctx context.Context, userID primitive.ObjectID, identity OAuthIdentity) error {
 	user, err := um.GetUserByID(ctx, userID)
 	if err != nil {
 		return err
 	}
 
-	err = user.CheckPassword(userPassword)
+	linked, err := um.GetUserByOAuthIdentity(ctx, user.Tenant, identity.Provider, identity.Subject)
+	if err == nil {
+		if linked.ID != userID {
+			return ErrOAuthIdentityLinked
+		}
+		return nil
+	}
+	if !errors.Is(err, ErrUserNotFound) {
+		return err
+	}
+
+	result, err := um.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": userID},
+		bson.M{"$push": bson.M{"oauth_identities": identity}},
+	)
 	if err != nil {
 		return err
 	}
+	if result.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
 
-	user.Username = newUsername
+// UpdateTimezone updates the preferred timezone of the user with the given ID.
+//
+// Returns ErrInvalidTimezone if the timezone is invalid, ErrUserNotFound if the user does not exist.
+func (um *UserManager) UpdateTimezone(ctx context.Context, userID primitive.ObjectID, timezone string) error {
+	user, err := um.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	if err := user.SetTimezone(timezone); err != nil {
+		return err
+	}
 	return um.UpdateUser(ctx, user)
 }
+
+// UpdateNotificationPreferences updates the notification email and / or the weekly digest opt-out of the user with the given ID.
+// Nil arguments are left unchanged, an empty email removes the user's own address.
+//
+// Returns ErrUserNotFound if the user does not exist.
+func (um *UserManager) UpdateNotificationPreferences(ctx context.Context, userID primitive.ObjectID, email *string, digestOptOut *bool) error {
+	set := bson.M{}
+	unset := bson.M{}
+	if email != nil {
+		if *email == "" {
+			unset["email"] = ""
+		} else {
+			set["email"] = *email
+		}
+	}
+	if digestOptOut != nil {
+		set["digest_opt_out"] = *digestOptOut
+	}
+	if len(set) == 0 && len(unset) == 0 {
+		return nil
+	}
+
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	result, err := um.collection.UpdateOne(ctx, bson.M{"_id": userID}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// ListDigestRecipients returns the users that did not opt out of digests, have a notification email,
+// did not receive a digest since sentBefore, and are not scheduled for deletion.
+func (um *UserManager) ListDigestRecipients(ctx context.Context, sentBefore time.Time) ([]*User, error) {
+	filter := bson.M{
+		"digest_opt_out":        bson.M{"$ne": true},
+		"deletion_scheduled_at": bson.M{"$exists": false},
+		"$and": bson.A{
+			bson.M{"$or": bson.A{
+				bson.M{"email": bson.M{"$gt": ""}},
+				bson.M{"oauth_identities.email": bson.M{"$gt": ""}},
+			}},
+			bson.M{"$or": bson.A{
+				bson.M{"last_digest_at": bson.M{"$exists": false}},
+				bson.M{"last_digest_at": bson.M{"$lt": sentBefore}},
+			}},
+		},
+	}
+
+	cursor, err := um.collection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	users := make([]*User, 0)
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// SetLastDigestAt records when the last digest was sent to the user with the given ID.
+func (um *UserManager) SetLastDigestAt(ctx context.Context, userID primitive.ObjectID, sentAt time.Time) error {
+	result, err := um.collection.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$set": bson.M{"last_digest_at": sentAt}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// SetRoles replaces the roles of the user with the given ID. Duplicate roles are removed.
+//
+// Returns ErrInvalidRole if any role is not valid, ErrUserNotFound if the user does not exist.
+func (um *UserManager) SetRoles(ctx context.Context, userID primitive.ObjectID, roles []string) error {
+	unique := make([]string, 0, len(roles))
+	for _, role := range roles {
+		if !slices.Contains(ValidRoles, role) {
+			return fmt.Errorf("%w: %s", ErrInvalidRole, role)
+		}
+		if !slices.Contains(unique, role) {
+			unique = append(unique, role)
+		}
+	}
+
+	result, err := um.collection.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$set": bson.M{"roles": unique}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// AddRole grants a role to the user with the given ID. Granting a role the user already has is a no-op.
+//
+// Returns ErrInvalidRole if the role is not valid, ErrUserNotFound if the user does not exist.
+func (um *UserManager) AddRole(ctx context.Context, userID primitive.ObjectID, role string) error {
+	if !slices.Contains(ValidRoles, role) {
+		return fmt.Errorf("%w: %s", ErrInvalidRole, role)
+	}
+
+	result, err := um.collection.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$addToSet": bson.M{"roles": role}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// RecordFailedLogin counts a failed login of the user with the given ID. Once threshold consecutive failures are reached,
+// the account is locked for cooldown and the count starts over.
+//
+// Returns the time the account is locked until, or nil if it was not locked by this failure.
+func (um *UserManager) RecordFailedLogin(ctx context.Context, userID primitive.ObjectID, threshold int, cooldown time.Duration) (*time.Time, error) {
+	var u User
+	err := um.collection.FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": userID},
+		bson.M{"$inc": bson.M{"failed_logins": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&u)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	if u.FailedLogins < threshold {
+		return nil, nil
+	}
+
+	// Only the failure reaching the threshold locks the account, concurrent failures find the count already reset
+	lockedUntil := time.Now().UTC().Add(cooldown)
+	result, err := um.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": userID, "failed_logins": bson.M{"$gte": threshold}},
+		bson.M{"$set": bson.M{"failed_logins": 0, "locked_until": lockedUntil}},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if result.ModifiedCount == 0 {
+		return nil, nil
+	}
+	return &lockedUntil, nil
+}
+
+// ResetFailedLogins clears the failed login count and lock of the user with the given ID after a successful login.
+func (um *UserManager) ResetFailedLogins(ctx context.Context, userID primitive.ObjectID) error {
+	_, err := um.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": userID, "$or": bson.A{
+			bson.M{"failed_logins": bson.M{"$gt": 0}},
+			bson.M{"locked_until": bson.M{"$exists": true}},
+		}},
+		bson.M{
+			"$set":   bson.M{"failed_logins": 0},
+			"$unset": bson.M{"locked_until": ""},
+		},
+	)
+	return err
+}
+
+// TouchLastActive records that the user with the given ID was active at the given time.
+func (um *UserManager) TouchLastActive(ctx context.Context, userID primitive.ObjectID, at time.Time) error {
+	_, err := um.collection.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$set": bson.M{"last_active_at": at}})
+	return err
+}
+
+// BackfillLastActive records the given time as the last activity of every user without a recorded activity,
+// so users created before activity was recorded are not considered inactive since their creation.
+func (um *UserManager) BackfillLastActive(ctx context.Context, at time.Time) error {
+	_, err := um.collection.UpdateMany(
+		ctx,
+		bson.M{"last_active_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"last_active_at": at}},
+	)
+	return err
+}
+
+// ListInactiveUsers returns the users of the given tier inactive since before the given time,
+// excluding admins and users exempt from retention. Users without a tier belong to DefaultTier.
+func (um *UserManager) ListInactiveUsers(ctx context.Context, tier string, inactiveSince time.Time) ([]*User, error) {
+	filter := bson.M{
+		"tier":             tier,
+		"last_active_at":   bson.M{"$lt": inactiveSince},
+		"retention_exempt": bson.M{"$ne": true},
+		"roles":            bson.M{"$ne": RoleAdmin},
+	}
+	if tier == DefaultTier {
+		filter["tier"] = bson.M{"$in": bson.A{nil, tier}}
+	}
+
+	cursor, err := um.collection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	users := make([]*User, 0)
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// SetRetentionWarnedAt records when the user with the given ID was warned that their outputs will be deleted.
+func (um *UserManager) SetRetentionWarnedAt(ctx context.Context, userID primitive.ObjectID, at time.Time) error {
+	_, err := um.collection.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$set": bson.M{"retention_warned_at": at}})
+	return err
+}
+
+// SetRetentionPurgedAt records when the outputs of the user with the given ID were deleted by the retention policy.
+func (um *UserManager) SetRetentionPurgedAt(ctx context.Context, userID primitive.ObjectID, at time.Time) error {
+	_, err := um.collection.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$set": bson.M{"retention_purged_at": at}})
+	return err
+}
+
+// UpdateRetention sets the tier and / or the retention exemption of the user with the given ID. Nil values are left unchanged,
+// and an empty tier resets the user to DefaultTier.
+//
+// Returns ErrUserNotFound if the user does not exist.
+func (um *UserManager) UpdateRetention(ctx context.Context, userID primitive.ObjectID, tier *string, exempt *bool) error {
+	set := bson.M{}
+	unset := bson.M{}
+	if tier != nil {
+		if *tier == "" {
+			unset["tier"] = ""
+		} else {
+			set["tier"] = *tier
+		}
+	}
+	if exempt != nil {
+		set["retention_exempt"] = *exempt
+	}
+	if len(set) == 0 && len(unset) == 0 {
+		return nil
+	}
+
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	result, err := um.collection.UpdateOne(ctx, bson.M{"_id": userID}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// SetUploadMaxSize sets the maximum upload size in bytes of the user with the given ID. A size <= 0 resets the user to the
+// maximum upload size of the deployment.
+//
+// Returns ErrUserNotFound if the user does not exist.
+func (um *UserManager) SetUploadMaxSize(ctx context.Context, userID primitive.ObjectID, size int64) error {
+	update := bson.M{"$set": bson.M{"upload_max_size": size}}
+	if size <= 0 {
+		update = bson.M{"$unset": bson.M{"upload_max_size": ""}}
+	}
+	result, err := um.collection.UpdateOne(ctx, bson.M{"_id": userID}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// ScheduleDeletion schedules the deletion of the user with the given ID at the given time.
+//
+// Returns ErrUserNotFound if the user does not exist.
+func (um *UserManager) ScheduleDeletion(ctx context.Context, userID primitive.ObjectID, at time.Time) error {
+	result, err := um.collection.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$set": bson.M{"deletion_scheduled_at": at}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// CancelDeletion cancels the scheduled deletion of the user with the given ID.
+//
+// Returns true if a deletion was cancelled, false if none was scheduled.
+func (um *UserManager) CancelDeletion(ctx context.Context, userID primitive.ObjectID) (bool, error) {
+	result, err := um.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": userID, "deletion_scheduled_at": bson.M{"$exists": true}},
+		bson.M{"$unset": bson.M{"deletion_scheduled_at": ""}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// ListDueDeletions returns the users whose deletion was scheduled at or before the given time.
+func (um *UserManager) ListDueDeletions(ctx context.Context, now time.Time) ([]*User, error) {
+	cursor, err := um.collection.Find(ctx, bson.M{"deletion_scheduled_at": bson.M{"$lte": now}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	users := make([]*User, 0)
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// DeleteUser deletes the user with the given ID, if their deletion is still scheduled. A user who cancelled the deletion
+// in the meantime (i.e by logging in) is kept.
+//
+// Returns ErrUserNotFound if the user does not exist or is no longer scheduled for deletion.
+func (um *UserManager) DeleteUser(ctx context.Context, userID primitive.ObjectID) error {
+	result, err := um.collection.DeleteOne(ctx, bson.M{"_id": userID, "deletion_scheduled_at": bson.M{"$exists": true}})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
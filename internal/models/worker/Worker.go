@@ -0,0 +1,25 @@
+// This file contains the Worker struct and its members.
+// Timestamps are taken by the web server when a heartbeat is recorded, so the clocks of workers do not matter.
+
+package worker
+
+import (
+	"time"
+)
+
+// Worker represents a sfm or nerf worker, as reported by its last heartbeat
+type Worker struct {
+	ID    string `bson:"_id" json:"worker_id"`
+	Stage string `bson:"stage" json:"stage"`
+	// Version is the software version the worker reported, if any
+	Version string `bson:"version,omitempty" json:"worker_version,omitempty"`
+	// SceneID is the (hex) ID of the scene the worker is processing, empty while it is idle
+	SceneID     string    `bson:"scene_id,omitempty" json:"scene_id,omitempty"`
+	FirstSeenAt time.Time `bson:"first_seen_at" json:"first_seen_at"`
+	LastSeenAt  time.Time `bson:"last_seen_at" json:"last_seen_at"`
+}
+
+// OnlineAt checks if the worker sent a heartbeat within the given timeout before now.
+func (w *Worker) OnlineAt(now time.Time, timeout time.Duration) bool {
+	return now.Sub(w.LastSeenAt) <= timeout
+}
@@ -0,0 +1,77 @@
+// This file contains the WorkerManager implementation, which is responsible for interacting with the MongoDB workers collection.
+// The WorkerManager struct contains a pointer to the nerfdb.workers MongoDB collection and a logger. Every heartbeat upserts
+// the worker it comes from, so the registry holds a single, up to date document per worker.
+
+package worker
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+)
+
+// registryRetention is how long a worker stays in the registry after its last heartbeat
+const registryRetention = 7 * 24 * time.Hour
+
+type WorkerManager struct {
+	collection *mongo.Collection
+	logger     *log.Logger
+}
+
+// NewWorkerManager creates a new WorkerManager with the given MongoDB client and logger.
+func NewWorkerManager(client *mongo.Client, logger *log.Logger, unittest bool) *WorkerManager {
+	return &WorkerManager{
+		collection: client.Database("nerfdb").Collection("workers"),
+		logger:     logger,
+	}
+}
+
+// EnsureIndexes creates the TTL index removing workers silent for longer than registryRetention.
+func (wm *WorkerManager) EnsureIndexes(ctx context.Context) error {
+	_, err := wm.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "last_seen_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(registryRetention.Seconds())),
+	})
+	return err
+}
+
+// RecordHeartbeat records a heartbeat of the given worker, seen now. The worker is added to the registry on its first heartbeat.
+func (wm *WorkerManager) RecordHeartbeat(ctx context.Context, w Worker) error {
+	now := time.Now().UTC()
+	_, err := wm.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": w.ID},
+		bson.M{
+			"$set": bson.M{
+				"stage":        w.Stage,
+				"version":      w.Version,
+				"scene_id":     w.SceneID,
+				"last_seen_at": now,
+			},
+			"$setOnInsert": bson.M{"first_seen_at": now},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// ListWorkers returns every worker of the registry, by stage then ID.
+func (wm *WorkerManager) ListWorkers(ctx context.Context) ([]*Worker, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "stage", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := wm.collection.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	workers := make([]*Worker, 0)
+	if err := cursor.All(ctx, &workers); err != nil {
+		return nil, err
+	}
+	return workers, nil
+}
@@ -0,0 +1,6 @@
+// Package worker contains the implementation of the worker registry stored in the MongoDB workers collection.
+// The WorkerManager struct is responsible for interacting with the MongoDB workers collection.
+// The Worker struct is used to represent a sfm or nerf worker as last reported by its heartbeat: its stage, software version
+// and the scene it is processing. A worker is online while its heartbeats keep arriving, and workers silent for a week are
+// removed from the registry.
+package worker
@@ -0,0 +1,330 @@
+// This file contains the JWTKeyring implementation, which holds the keys used to sign and verify JWT tokens.
+//
+// New tokens are always signed with the current key. Retired keys are kept for verification only, so that
+// rotating the secret does not immediately invalidate every session. Rotation is done by moving the current key
+// into JWT_PREVIOUS_SECRET_KEYS, setting a new JWT_SECRET_KEY in the secrets backend, and waiting for the next reload.
+//
+// Every key is identified by a key ID (kid) derived from the key, which signed tokens carry in their header,
+// so a token is verified with the key that signed it instead of trying every key.
+//
+// With an asymmetric algorithm (JWT_ALGORITHM RS256 or EdDSA), tokens are signed with the PEM private key JWT_PRIVATE_KEY,
+// and the public keys are published as a JWKS, so other services can verify tokens without sharing a secret.
+// Rotation works the same way: the public key of the retired private key moves into JWT_PREVIOUS_PUBLIC_KEYS.
+// HMAC secrets, if still set, are then only accepted for verification, to switch algorithms without invalidating sessions.
+
+package secrets
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+)
+
+// Custom errors
+var (
+	// ErrEmptySigningKey is returned when the secrets backend holds an empty JWT signing key.
+	ErrEmptySigningKey = errors.New("jwt signing key is empty")
+	// ErrInvalidJWTKey is returned when a JWT private or public key can not be parsed, or does not match the algorithm.
+	ErrInvalidJWTKey = errors.New("invalid jwt key")
+	// ErrWeakJWTKey is returned by CheckStrength when the signing key is too short or too repetitive to sign tokens safely.
+	ErrWeakJWTKey = errors.New("jwt signing key is too weak")
+)
+
+// Minimum strength of JWT signing keys. HMAC secrets must be at least as long as the SHA-256 output (RFC 7518).
+const (
+	minHMACSecretLength  = 32
+	minHMACDistinctBytes = 10
+	minRSAKeyBits        = 2048
+)
+
+// Declarations for valid JWT signing algorithms
+const (
+	AlgorithmHS256 = "HS256"
+	AlgorithmRS256 = "RS256"
+	AlgorithmEdDSA = "EdDSA"
+)
+
+// JWTKey is a key of the keyring. SignKey is only set on the current signing key.
+type JWTKey struct {
+	ID        string
+	Method    jwt.SigningMethod
+	SignKey   interface{}
+	VerifyKey interface{}
+}
+
+// JWTKeyring holds the current and retired JWT keys. It is safe for concurrent use.
+type JWTKeyring struct {
+	provider     Provider
+	algorithm    string
+	logger       *log.Logger
+	mu           sync.RWMutex
+	signingKey   JWTKey
+	previousKeys []JWTKey
+	keysByID     map[string]JWTKey
+}
+
+// KeyID returns the key ID (kid) of a key: the first 8 bytes of its SHA-256, hex encoded.
+// The key ID identifies the key in token headers without revealing it.
+func KeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// NewJWTKeyring creates a JWTKeyring signing with the given algorithm (HS256, RS256 or EdDSA), and loads the keys
+// from the given provider.
+//
+// Returns error if the signing key could not be loaded.
+func NewJWTKeyring(ctx context.Context, provider Provider, algorithm string, logger *log.Logger) (*JWTKeyring, error) {
+	k := &JWTKeyring{
+		provider:  provider,
+		algorithm: algorithm,
+		logger:    logger,
+	}
+	if err := k.Reload(ctx); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload re-reads the keys from the secrets provider. On failure, the previously loaded keys are kept.
+func (k *JWTKeyring) Reload(ctx context.Context) error {
+	var signingKey JWTKey
+	var err error
+	previousKeys := make([]JWTKey, 0)
+
+	if k.algorithm == AlgorithmHS256 {
+		secret, err := k.provider.GetSecret(ctx, JWTSecretKey)
+		if err != nil {
+			return err
+		}
+		if secret == "" {
+			return ErrEmptySigningKey
+		}
+		signingKey = hmacKey(secret)
+		signingKey.SignKey = signingKey.VerifyKey
+	} else {
+		signingKey, err = k.loadPrivateKey(ctx)
+		if err != nil {
+			return err
+		}
+		if publicKeys := GetOptionalSecret(ctx, k.provider, JWTPreviousPublicKeys); publicKeys != "" {
+			previousKeys, err = parsePublicKeys(publicKeys)
+			if err != nil {
+				return err
+			}
+		}
+		// HMAC tokens issued before switching algorithms stay valid until they expire
+		if secret := GetOptionalSecret(ctx, k.provider, JWTSecretKey); secret != "" {
+			previousKeys = append(previousKeys, hmacKey(secret))
+		}
+	}
+
+	for _, secret := range strings.Split(GetOptionalSecret(ctx, k.provider, JWTPreviousSecretKeys), ",") {
+		secret = strings.TrimSpace(secret)
+		if secret != "" {
+			previousKeys = append(previousKeys, hmacKey(secret))
+		}
+	}
+
+	keysByID := make(map[string]JWTKey, len(previousKeys)+1)
+	for _, key := range previousKeys {
+		keysByID[key.ID] = key
+	}
+	keysByID[signingKey.ID] = signingKey
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.signingKey = signingKey
+	k.previousKeys = previousKeys
+	k.keysByID = keysByID
+	return nil
+}
+
+// loadPrivateKey reads and parses the PEM private key of the asymmetric algorithm.
+func (k *JWTKeyring) loadPrivateKey(ctx context.Context) (JWTKey, error) {
+	privateKey, err := k.provider.GetSecret(ctx, JWTPrivateKey)
+	if err != nil {
+		return JWTKey{}, err
+	}
+	if privateKey == "" {
+		return JWTKey{}, ErrEmptySigningKey
+	}
+	block, _ := pem.Decode([]byte(unescapeNewlines(privateKey)))
+	if block == nil {
+		return JWTKey{}, fmt.Errorf("%w: %s is not PEM encoded", ErrInvalidJWTKey, JWTPrivateKey)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return JWTKey{}, fmt.Errorf("%w: %s: %v", ErrInvalidJWTKey, JWTPrivateKey, err)
+	}
+
+	switch key := parsed.(type) {
+	case *rsa.PrivateKey:
+		if k.algorithm != AlgorithmRS256 {
+			break
+		}
+		signingKey, err := publicKey(&key.PublicKey)
+		signingKey.SignKey = key
+		return signingKey, err
+	case ed25519.PrivateKey:
+		if k.algorithm != AlgorithmEdDSA {
+			break
+		}
+		signingKey, err := publicKey(key.Public())
+		signingKey.SignKey = key
+		return signingKey, err
+	}
+	return JWTKey{}, fmt.Errorf("%w: %s does not match algorithm %s", ErrInvalidJWTKey, JWTPrivateKey, k.algorithm)
+}
+
+// CheckStrength verifies the current signing key is strong enough to sign tokens: HMAC secrets must be at least 32 bytes
+// long and not a repeated pattern, and RSA keys at least 2048 bits. Ed25519 keys have a fixed size.
+//
+// Returns ErrWeakJWTKey describing the weakness, nil otherwise.
+func (k *JWTKeyring) CheckStrength() error {
+	switch key := k.SigningKey().SignKey.(type) {
+	case []byte:
+		if len(key) < minHMACSecretLength {
+			return fmt.Errorf("%w: %s is %d bytes long, expected at least %d", ErrWeakJWTKey, JWTSecretKey, len(key), minHMACSecretLength)
+		}
+		distinct := make(map[byte]struct{})
+		for _, b := range key {
+			distinct[b] = struct{}{}
+		}
+		if len(distinct) < minHMACDistinctBytes {
+			return fmt.Errorf("%w: %s only uses %d distinct characters", ErrWeakJWTKey, JWTSecretKey, len(distinct))
+		}
+	case *rsa.PrivateKey:
+		if bits := key.N.BitLen(); bits < minRSAKeyBits {
+			return fmt.Errorf("%w: %s is a %d bit RSA key, expected at least %d", ErrWeakJWTKey, JWTPrivateKey, bits, minRSAKeyBits)
+		}
+	}
+	return nil
+}
+
+// hmacKey returns the verification key of an HMAC secret.
+func hmacKey(secret string) JWTKey {
+	return JWTKey{
+		ID:        KeyID([]byte(secret)),
+		Method:    jwt.SigningMethodHS256,
+		VerifyKey: []byte(secret),
+	}
+}
+
+// publicKey returns the verification key of an RSA or Ed25519 public key. Its key ID is derived from its PKIX encoding.
+func publicKey(key interface{}) (JWTKey, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return JWTKey{}, fmt.Errorf("%w: %v", ErrInvalidJWTKey, err)
+	}
+
+	var method jwt.SigningMethod
+	switch key.(type) {
+	case *rsa.PublicKey:
+		method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		method = jwt.SigningMethodEdDSA
+	default:
+		return JWTKey{}, fmt.Errorf("%w: unsupported public key type %T", ErrInvalidJWTKey, key)
+	}
+	return JWTKey{ID: KeyID(der), Method: method, VerifyKey: key}, nil
+}
+
+// parsePublicKeys parses concatenated PEM encoded (PKIX) public keys.
+func parsePublicKeys(publicKeys string) ([]JWTKey, error) {
+	keys := make([]JWTKey, 0)
+	rest := []byte(unescapeNewlines(publicKeys))
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidJWTKey, JWTPreviousPublicKeys, err)
+		}
+		key, err := publicKey(parsed)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if strings.TrimSpace(string(rest)) != "" {
+		return nil, fmt.Errorf("%w: %s is not PEM encoded", ErrInvalidJWTKey, JWTPreviousPublicKeys)
+	}
+	return keys, nil
+}
+
+// unescapeNewlines restores the newlines of PEM keys stored on a single line (i.e in an env file) as literal "\n".
+func unescapeNewlines(value string) string {
+	return strings.ReplaceAll(value, `\n`, "\n")
+}
+
+// Watch reloads the keyring every interval until the context is cancelled. Intended to be run as a goroutine.
+func (k *JWTKeyring) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := k.Reload(ctx); err != nil {
+				k.logger.Errorf("Failed to reload JWT keyring, keeping current keys: %v", err)
+			}
+		}
+	}
+}
+
+// SigningKey returns the key new tokens should be signed with.
+func (k *JWTKeyring) SigningKey() JWTKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.signingKey
+}
+
+// VerificationKey returns the current or retired key with the given key ID, if it is in the keyring.
+func (k *JWTKeyring) VerificationKey(keyID string) (JWTKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keysByID[keyID]
+	return key, ok
+}
+
+// VerificationKeys returns every key a token may be verified with, the current signing key first.
+// Only needed for tokens without a key ID, issued before tokens carried one.
+func (k *JWTKeyring) VerificationKeys() []JWTKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return append([]JWTKey{k.signingKey}, k.previousKeys...)
+}
+
+// PublicKeys returns the asymmetric keys of the keyring, the current signing key first, to be published as a JWKS.
+// HMAC secrets are never included.
+func (k *JWTKeyring) PublicKeys() []JWTKey {
+	keys := make([]JWTKey, 0)
+	for _, key := range k.VerificationKeys() {
+		if _, ok := key.Method.(*jwt.SigningMethodHMAC); !ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,132 @@
+// This file contains the Provider interface, the names of the secrets used by the web server,
+// and the env and file providers. Secret names are shared across providers, so switching providers
+// only requires storing the same names in the new backend.
+
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
+)
+
+// Custom errors
+var (
+	// ErrSecretNotFound is returned when a requested secret does not exist in the provider.
+	ErrSecretNotFound = errors.New("secret not found")
+	// ErrUnknownProvider is returned when the configured provider kind is not supported.
+	ErrUnknownProvider = errors.New("unknown secrets provider")
+)
+
+// Names of the secrets used by the web server
+const (
+	MongoUsername    = "MONGO_INITDB_ROOT_USERNAME"
+	MongoPassword    = "MONGO_INITDB_ROOT_PASSWORD"
+	RabbitMQUsername = "RABBITMQ_DEFAULT_USER"
+	RabbitMQPassword = "RABBITMQ_DEFAULT_PASS"
+	// NATS and Kafka credentials, only required if BROKER_BACKEND selects a server requiring authentication
+	NATSUsername  = "NATS_USER"
+	NATSPassword  = "NATS_PASSWORD"
+	KafkaUsername = "KAFKA_USERNAME"
+	KafkaPassword = "KAFKA_PASSWORD"
+	// JWTSecretKey is the key used to sign new tokens
+	JWTSecretKey = "JWT_SECRET_KEY"
+	// JWTPreviousSecretKeys is a comma-separated list of retired keys that are still accepted for verification
+	JWTPreviousSecretKeys = "JWT_PREVIOUS_SECRET_KEYS"
+	// JWTPrivateKey is the PEM private key used to sign new tokens with an asymmetric JWT_ALGORITHM (RS256, EdDSA)
+	JWTPrivateKey = "JWT_PRIVATE_KEY"
+	// JWTPreviousPublicKeys are the concatenated PEM public keys of retired private keys, still accepted for verification
+	JWTPreviousPublicKeys = "JWT_PREVIOUS_PUBLIC_KEYS"
+	S3AccessKey           = "S3_ACCESS_KEY"
+	S3SecretKey           = "S3_SECRET_KEY"
+	// OAuth client secrets, only required for enabled social login providers
+	OAuthGoogleClientSecret = "OAUTH_GOOGLE_CLIENT_SECRET"
+	OAuthGitHubClientSecret = "OAUTH_GITHUB_CLIENT_SECRET"
+	OAuthOIDCClientSecret   = "OAUTH_OIDC_CLIENT_SECRET"
+	// BootstrapAdminPassword is only required when BOOTSTRAP_ADMIN_USERNAME names an account that does not exist yet
+	BootstrapAdminPassword = "BOOTSTRAP_ADMIN_PASSWORD"
+	// SMTPPassword is only required when SMTP_USERNAME is set
+	SMTPPassword = "SMTP_PASSWORD"
+	// ArtifactHookSecret optionally signs the artifact webhook requests
+	ArtifactHookSecret = "ARTIFACT_HOOK_SECRET"
+	// StorageEncryptionKey is the master key of the artifacts encrypted at rest, only required when STORAGE_ENCRYPTION is enabled
+	StorageEncryptionKey = "STORAGE_ENCRYPTION_KEY"
+	// WorkerDataKey signs the URLs workers download the inputs of their jobs from
+	WorkerDataKey = "WORKER_DATA_KEY"
+)
+
+// Declarations for valid provider kinds
+const (
+	ProviderEnv   = "env"
+	ProviderFile  = "file"
+	ProviderVault = "vault"
+)
+
+// Provider is implemented by every secrets backend.
+type Provider interface {
+	// GetSecret returns the value of the secret with the given name.
+	// Returns ErrSecretNotFound if the secret does not exist.
+	GetSecret(ctx context.Context, name string) (string, error)
+}
+
+// NewProvider creates the secrets provider selected by the configuration.
+//
+// Returns ErrUnknownProvider if the configured kind is not supported.
+func NewProvider(cfg *config.Config) (Provider, error) {
+	switch cfg.SecretsProvider {
+	case ProviderEnv, "":
+		return &EnvProvider{}, nil
+	case ProviderFile:
+		return &FileProvider{Dir: cfg.SecretsDir}, nil
+	case ProviderVault:
+		// The vault token is the one credential that has to be bootstrapped from the environment
+		return NewVaultProvider(cfg.VaultAddr, os.Getenv("VAULT_TOKEN"), cfg.VaultSecretPath), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownProvider, cfg.SecretsProvider)
+	}
+}
+
+// GetOptionalSecret returns the value of the secret with the given name, or "" if it could not be retrieved.
+// It should only be used for optional secrets.
+func GetOptionalSecret(ctx context.Context, p Provider, name string) string {
+	value, err := p.GetSecret(ctx, name)
+	if err != nil {
+		return ""
+	}
+	return value
+}
+
+// EnvProvider reads secrets from environment variables.
+type EnvProvider struct{}
+
+// GetSecret returns the value of the environment variable with the given name.
+func (p *EnvProvider) GetSecret(ctx context.Context, name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrSecretNotFound, name)
+	}
+	return value, nil
+}
+
+// FileProvider reads secrets from a directory containing one file per secret, named after the secret.
+// Files are re-read on every call, so secrets rotated on disk are picked up on the next read.
+type FileProvider struct {
+	Dir string
+}
+
+// GetSecret returns the trimmed contents of the file with the given name.
+func (p *FileProvider) GetSecret(ctx context.Context, name string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(p.Dir, name))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("%w: %s", ErrSecretNotFound, name)
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
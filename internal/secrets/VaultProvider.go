@@ -0,0 +1,74 @@
+// This file contains the VaultProvider implementation, which reads secrets from a HashiCorp Vault KV secret
+// using the Vault HTTP API. Both KV v1 (`secret/go-web-server`) and KV v2 (`secret/data/go-web-server`) paths are supported;
+// every secret used by the web server is expected to be a key of the same Vault secret.
+
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// VaultProvider reads secrets from a single HashiCorp Vault KV secret.
+type VaultProvider struct {
+	addr       string
+	token      string
+	secretPath string
+	client     *http.Client
+}
+
+// NewVaultProvider creates a VaultProvider for the Vault server at addr, authenticating with token,
+// and reading keys of the secret at secretPath (i.e "secret/data/go-web-server").
+func NewVaultProvider(addr, token, secretPath string) *VaultProvider {
+	return &VaultProvider{
+		addr:       strings.TrimRight(addr, "/"),
+		token:      token,
+		secretPath: strings.Trim(secretPath, "/"),
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// GetSecret reads the Vault secret and returns the value of the key with the given name.
+// The secret is read on every call, so rotated values are picked up on the next read.
+func (p *VaultProvider) GetSecret(ctx context.Context, name string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/v1/%s", p.addr, p.secretPath), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", p.token)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to read vault secret: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", fmt.Errorf("%w: %s", ErrSecretNotFound, name)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to read vault secret: status %d", resp.StatusCode)
+	}
+
+	// KV v2 nests the key/value pairs in data.data, KV v1 stores them directly in data
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode vault secret: %v", err)
+	}
+	values := body.Data
+	if nested, ok := body.Data["data"].(map[string]interface{}); ok {
+		values = nested
+	}
+
+	value, ok := values[name].(string)
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrSecretNotFound, name)
+	}
+	return value, nil
+}
@@ -0,0 +1,14 @@
+// Package secrets contains the secrets providers used to retrieve credentials and signing keys.
+// Credentials (MongoDB, RabbitMQ) and JWT signing keys should never be read directly from the environment,
+// and should instead be requested from the Provider injected into the struct that needs them.
+//
+// Current providers include:
+//   - EnvProvider:
+//     Reads secrets from environment variables (the default, and the behaviour of the secrets/.env file)
+//   - FileProvider:
+//     Reads secrets from one file per secret in a directory (i.e docker / kubernetes secrets mounted at /run/secrets)
+//   - VaultProvider:
+//     Reads secrets from a HashiCorp Vault KV secret over the Vault HTTP API
+//
+// The JWTKeyring is built on top of a Provider, and can be reloaded at runtime so the JWT secret can be rotated without a restart.
+package secrets
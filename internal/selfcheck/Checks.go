@@ -0,0 +1,107 @@
+// This file contains the checks of the dependencies shared by every deployment: the database, the storages,
+// the temporary directory and the JWT signing key.
+
+package selfcheck
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/secrets"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/storage"
+)
+
+// Mongo returns a critical check pinging the MongoDB primary, then inserting and deleting a probe document in the
+// self_checks collection of the database, so missing write permissions are reported at startup.
+func Mongo(client *mongo.Client) Check {
+	return Check{
+		Name:     "mongodb",
+		Critical: true,
+		Run: func(ctx context.Context) error {
+			if err := client.Ping(ctx, readpref.Primary()); err != nil {
+				return fmt.Errorf("failed to reach the primary: %v", err)
+			}
+
+			collection := client.Database("nerfdb").Collection("self_checks")
+			id := primitive.NewObjectID()
+			if _, err := collection.InsertOne(ctx, bson.M{"_id": id, "created_at": time.Now().UTC()}); err != nil {
+				return fmt.Errorf("failed to write to nerfdb, check the permissions of the user: %v", err)
+			}
+			if _, err := collection.DeleteOne(ctx, bson.M{"_id": id}); err != nil {
+				return fmt.Errorf("failed to delete from nerfdb, check the permissions of the user: %v", err)
+			}
+			return nil
+		},
+	}
+}
+
+// Storage returns a critical check writing, reading back and deleting a probe object in the given storage.
+// For a local storage, this verifies its root directory is writable, and for an s3 storage that its bucket is.
+func Storage(name string, store storage.Storage) Check {
+	return Check{
+		Name:     name,
+		Critical: true,
+		Run: func(ctx context.Context) error {
+			key := path.Join("selfcheck", primitive.NewObjectID().Hex())
+			probe := []byte("self-check probe")
+			if err := store.Put(ctx, key, bytes.NewReader(probe), int64(len(probe))); err != nil {
+				return fmt.Errorf("failed to write to %s storage: %v", store.Backend(), err)
+			}
+			defer store.Delete(context.WithoutCancel(ctx), key)
+
+			r, err := store.Open(ctx, key)
+			if err != nil {
+				return fmt.Errorf("failed to read from %s storage: %v", store.Backend(), err)
+			}
+			defer r.Close()
+			contents, err := io.ReadAll(r)
+			if err != nil {
+				return fmt.Errorf("failed to read from %s storage: %v", store.Backend(), err)
+			}
+			if !bytes.Equal(contents, probe) {
+				return fmt.Errorf("%s storage returned different contents than written", store.Backend())
+			}
+			return nil
+		},
+	}
+}
+
+// TempDir returns a warning check writing a file to the temporary directory, where database backups are staged.
+func TempDir() Check {
+	return Check{
+		Name: "temp directory",
+		Run: func(ctx context.Context) error {
+			f, err := os.CreateTemp("", "selfcheck-*")
+			if err != nil {
+				return err
+			}
+			defer os.Remove(f.Name())
+			if _, err := f.WriteString("self-check probe"); err != nil {
+				f.Close()
+				return err
+			}
+			return f.Close()
+		},
+	}
+}
+
+// JWTKeys returns a critical check verifying the signing key of the keyring is strong enough to sign tokens.
+func JWTKeys(keyring *secrets.JWTKeyring) Check {
+	return Check{
+		Name:     "jwt signing key",
+		Critical: true,
+		Run: func(ctx context.Context) error {
+			return keyring.CheckStrength()
+		},
+	}
+}
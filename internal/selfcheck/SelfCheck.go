@@ -0,0 +1,110 @@
+// This file contains the Check type, and the functions running checks and printing their report.
+//
+// Checks run concurrently, each bounded by the same timeout, so the self-check takes at most as long as its slowest check.
+
+package selfcheck
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Check is a single startup check. Critical checks refuse to start the server when they fail.
+type Check struct {
+	Name     string
+	Critical bool
+	Run      func(ctx context.Context) error
+}
+
+// Result is the outcome of a Check. Err is nil if the check passed.
+type Result struct {
+	Name     string
+	Critical bool
+	Err      error
+	Duration time.Duration
+}
+
+// Run runs the given checks concurrently, each with its own timeout, and returns their results in the order of the checks.
+// A check still running at its timeout fails with the context error.
+func Run(ctx context.Context, timeout time.Duration, checks ...Check) []Result {
+	results := make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = run(ctx, timeout, check)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// run runs a single check, returning once it finished or its timeout expired.
+func run(ctx context.Context, timeout time.Duration, check Check) Result {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- check.Run(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out after %s: %w", timeout, ctx.Err())
+	}
+	return Result{
+		Name:     check.Name,
+		Critical: check.Critical,
+		Err:      err,
+		Duration: time.Since(start).Round(time.Millisecond),
+	}
+}
+
+// Failed returns the number of critical checks that failed.
+func Failed(results []Result) int {
+	failed := 0
+	for _, result := range results {
+		if result.Critical && result.Err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+// Report writes a readable report of the results to w, one line per check:
+//
+//	[ OK ] mongodb          12ms
+//	[FAIL] rabbitmq queues  30s   failed to connect to RabbitMQ: ...
+//	[WARN] temp directory   1ms   open /tmp/...: permission denied
+func Report(w io.Writer, results []Result) {
+	width := 0
+	for _, result := range results {
+		width = max(width, len(result.Name))
+	}
+
+	fmt.Fprintln(w, "Startup self-check:")
+	for _, result := range results {
+		status := " OK "
+		if result.Err != nil && result.Critical {
+			status = "FAIL"
+		} else if result.Err != nil {
+			status = "WARN"
+		}
+		if result.Err == nil {
+			fmt.Fprintf(w, "  [%s] %-*s  %s\n", status, width, result.Name, result.Duration)
+		} else {
+			fmt.Fprintf(w, "  [%s] %-*s  %-6s  %v\n", status, width, result.Name, result.Duration, result.Err)
+		}
+	}
+	if failed := Failed(results); failed > 0 {
+		fmt.Fprintf(w, "%d critical check(s) failed, refusing to start\n", failed)
+	}
+}
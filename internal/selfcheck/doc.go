@@ -0,0 +1,15 @@
+// Package selfcheck contains the startup self-check, which verifies the dependencies of the web server before any service
+// is started, so a misconfigured deployment fails fast with a readable report instead of failing on its first request.
+//
+// Checks are either critical, refusing to start when they fail, or warnings that are only reported. Current checks include:
+//   - Mongo:
+//     Pings MongoDB and writes and deletes a probe document, verifying the credentials may write the database
+//   - Storage:
+//     Writes, reads back and deletes a probe object, verifying a storage (i.e the local data directory) is writable
+//   - TempDir:
+//     Writes a temporary file, used to stage database backups
+//   - JWTKeys:
+//     Verifies the JWT signing key is strong enough to sign tokens
+//
+// Checks of other packages (i.e the broker queues declared by the AMPQService) can be added as a Check literal.
+package selfcheck
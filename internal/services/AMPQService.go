@@ -1,179 +1,328 @@
 // This file contains the implementation of AMPQService. This service is responsible for handling the communication
-// Between the web server and an AMPQ message broker, and thus workers. The service is the main handler for the training pipeline
+// Between the web server and a message broker, and thus workers. The service is the main handler for the training pipeline
 // and is responsible for sending and receiving messages to and from the workers, as well as updating the database with the results.
 //
-// This service expects a rabbitMQ AMPQ 0.9.1 broker to be running on the specified domain. The service connects to the broker and
-// creates the necessary queues for communication. The service then starts consumers for the 'sfm-out' and 'nerf-out' queues, which
-// are responsible for processing the output of the workers.
+// The broker is the backend selected by BROKER_BACKEND (RabbitMQ by default, NATS JetStream or Kafka, see the broker package),
+// which creates the queues of BrokerTopology on connect and recovers its connection. The service then starts consumers for the
+// output queues of the pipeline stages ('sfm-out' and 'nerf-out' by default), which are responsible for processing the output
+// of the workers (see PipelineStages.go).
 //
 // A go channel and waitgroup are used to manage the consumers, and the service can be gracefully shutdown by closing the stopChan.
-// The consumers should *hopefully* be tolerant to connection failures, and will attempt to reconnect every 5 seconds if the connection
-// is lost.
+// Consumers whose consumption failed are restarted after a jittered exponential backoff, which restarts from half a second
+// once they succeed, so a single channel error only briefly pauses message processing.
+//
+// When several web-server replicas share the broker and database, only one of them may process worker output, as processing writes
+// files and updates queue lists. The replicas elect that instance through a lease in MongoDB: every instance can publish jobs, but only
+// the lease holder runs the output queue consumers. If the holder dies, its unacked messages are requeued by the broker,
+// and another instance takes over once the lease expires.
+//
+// Workers report their liveness through heartbeats on the 'worker-heartbeat' queue, also consumed by the lease holder only,
+// which records them in the worker registry (see WorkerLiveness.go).
+//
+// A configurable percentage of nerf jobs can be routed to a canary worker build through the 'nerf-in.canary' queue, tagging the scenes
+// it processed, so its results can be compared with the current build before it is rolled out.
+//
+// Worker output whose processing fails is retried with a backoff by publishing it again with a delay, and dead-lettered to MongoDB once its retries are exhausted, instead of being requeued forever (see DeadLetters.go).
+//
+// Cancellations are broadcast to the workers through the 'worker-control' topic, which every worker subscribes to, so the worker processing a cancelled scene stops instead of finishing a stage whose result would be discarded.
+//
+// Jobs carry the priority of their scene: they are inserted ahead of lower priority scenes in the queue lists, and published
+// with their priority, which RabbitMQ honours when the job queues are declared as priority queues (AMQP_PRIORITY_QUEUES).
+//
+// Messages are published with publisher confirms: publishing fails once the broker did not confirm a message after retries,
+// in which case the scene is removed from the queue lists it was inserted into, so a lost job never leaves a scene queued.
+//
+// Jobs are deduplicated through the queue lists: a scene is atomically inserted into the list of its stage before its job is published,
+// and publishing is skipped if it already is in it. Republishing a scene (i.e a replay, or a redelivered worker result) therefore never
+// trains the same scene twice concurrently.
+//
+// Worker output is processed idempotently: processed messages are recorded in MongoDB until the job of their stage is published again,
+// and a redelivered message, or output of a stage the scene already moved on from, is acknowledged without being processed again
+// (see PipelineStages.go).
+//
+// Jobs time out once a worker processed them for longer than STAGE_TIMEOUT, or no worker reported them within STAGE_QUEUE_TIMEOUT
+// of their publication, so a stuck worker never leaves a scene processing forever: they are published again, or their scene
+// fails (see StageTimeouts.go).
 
 package services
 
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"math/rand/v2"
 	"net/http"
-	"os"
-	"path/filepath"
+	"net/url"
+	"path"
 	"slices"
+	"strings"
 	"sync"
 	"time"
 
-	amqp "github.com/rabbitmq/amqp091-go"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 
+	"github.com/NeRF-or-Nothing/go-web-server/internal/broker"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
 	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/deadletter"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/event"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/lease"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/processedoutput"
 	"github.com/NeRF-or-Nothing/go-web-server/internal/models/queue"
 	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/worker"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/storage"
+)
+
+// Custom errors
+var (
+	// ErrJobAlreadyQueued is returned when a job is published for a scene whose stage is already queued or being processed.
+	ErrJobAlreadyQueued = errors.New("scene is already queued for this stage")
+	// ErrJobNotQueued is returned when cancelling the processing of a scene that is not being processed.
+	ErrJobNotQueued = errors.New("scene is not being processed")
+	// ErrPublishNotConfirmed is returned when the broker did not confirm a published message, even after retries.
+	ErrPublishNotConfirmed = errors.New("message was not confirmed by the broker")
 )
 
 type AMPQService struct {
-	baseURL             string
-	messageBrokerDomain string
-	sceneManager        *scene.SceneManager
-	queueManager        *queue.QueueListManager
-	connection          *amqp.Connection
-	channel             *amqp.Channel
-	logger              *log.Logger
+	broker                 broker.Broker
+	sceneManager           *scene.SceneManager
+	queueManager           *queue.QueueListManager
+	leaseManager           *lease.LeaseManager
+	eventManager           *event.EventManager
+	deadLetterManager      *deadletter.DeadLetterManager
+	workerManager          *worker.WorkerManager
+	processedOutputManager *processedoutput.ProcessedOutputManager
+	storage                storage.Storage
+	workerURLs             *storage.WorkerURLSigner
+	callbacks              *SceneCallbacks
+	config                 *config.Config
+	logger                 *log.Logger
+	// pipeline are the processing stages of PIPELINE_STAGES, in order
+	pipeline []*StageDefinition
 	// used for reconnection and graceful shutdown
 	stopChan chan struct{}
 	wg       sync.WaitGroup
+	// counters reported by ConsumerHealth
+	consumerStats consumerStats
+	// used for downloading worker artifacts, the limiter is nil if the bandwidth is unlimited
+	artifactClient  *http.Client
+	downloadLimiter *bandwidthLimiter
 }
 
+// consumerLeaseName is the name of the lease held by the instance elected to consume worker output
+const consumerLeaseName = "ampq-consumers"
+
+const (
+	// workerControlTopic is the topic control messages (i.e cancellations) are broadcast to every worker through
+	workerControlTopic = "worker-control"
+	// controlMessageTTL is how long a control message waits in the queue of a worker, workers started later do not need it
+	controlMessageTTL = time.Hour
+)
+
 // Starts a new AMPQService instance as goroutine
-func NewAMPQService(messageBrokerDomain string, sceneManager *scene.SceneManager, queueManager *queue.QueueListManager, logger *log.Logger) (*AMPQService, error) {
+func NewAMPQService(
+	messageBroker broker.Broker,
+	sceneManager *scene.SceneManager,
+	queueManager *queue.QueueListManager,
+	leaseManager *lease.LeaseManager,
+	eventManager *event.EventManager,
+	deadLetterManager *deadletter.DeadLetterManager,
+	workerManager *worker.WorkerManager,
+	processedOutputManager *processedoutput.ProcessedOutputManager,
+	store storage.Storage,
+	workerURLs *storage.WorkerURLSigner,
+	callbacks *SceneCallbacks,
+	cfg *config.Config,
+	logger *log.Logger,
+) (*AMPQService, error) {
 	service := &AMPQService{
-		messageBrokerDomain: messageBrokerDomain,
-		queueManager:        queueManager,
-		sceneManager:        sceneManager,
-		baseURL:             "http://web-server:5000/",
-		logger:              logger,
-		stopChan:            make(chan struct{}),
-	}
-
-	err := service.connect()
+		broker:                 messageBroker,
+		queueManager:           queueManager,
+		sceneManager:           sceneManager,
+		leaseManager:           leaseManager,
+		eventManager:           eventManager,
+		deadLetterManager:      deadLetterManager,
+		workerManager:          workerManager,
+		processedOutputManager: processedOutputManager,
+		storage:                store,
+		workerURLs:             workerURLs,
+		callbacks:              callbacks,
+		config:                 cfg,
+		logger:                 logger,
+		stopChan:               make(chan struct{}),
+		downloadLimiter:        newBandwidthLimiter(cfg.ArtifactDownloadBandwidth),
+	}
+	service.artifactClient = service.newArtifactClient()
+
+	pipeline, err := service.newPipeline()
 	if err != nil {
 		return nil, err
 	}
+	service.pipeline = pipeline
 
+	service.wg.Add(1)
 	go service.startConsumers()
 
 	return service, nil
 }
 
-// connect establishes a connection to the AMPQ message broker and creates the necessary queues
-func (s *AMPQService) connect() error {
-	fmt.Println("AMPQService.connect")
-	timeout := time.Now().Add(time.Minute / 4)
-	var err error
-
-	for time.Now().Before(timeout) {
-		s.connection, err = amqp.Dial(fmt.Sprintf("amqp://%s:%s@%s:5672/",
-			os.Getenv("RABBITMQ_DEFAULT_USER"),
-			os.Getenv("RABBITMQ_DEFAULT_PASS"),
-			s.messageBrokerDomain))
-		if err == nil {
-			break
-		}
-		time.Sleep(time.Second)
+// BrokerTopology returns the queues and topics the workers are communicated with through: the job queues of the stages
+// (priority queues), their output queues (retried with a delay), the heartbeat queue and the worker control topic.
+func BrokerTopology(cfg *config.Config) broker.Topology {
+	var topology broker.Topology
+	for _, queue := range jobQueues(cfg) {
+		topology.Queues = append(topology.Queues, broker.QueueConfig{Name: queue, MaxPriority: scene.MaxPriority})
 	}
-
-	if err != nil {
-		return fmt.Errorf("failed to connect to RabbitMQ: %v", err)
+	for _, queue := range outputQueues(cfg) {
+		topology.Queues = append(topology.Queues, broker.QueueConfig{Name: queue, Delayed: true})
 	}
+	topology.Queues = append(topology.Queues, broker.QueueConfig{Name: workerHeartbeatQueue, MessageTTL: heartbeatMessageTTL})
+	topology.Topics = []broker.QueueConfig{{Name: workerControlTopic, MessageTTL: controlMessageTTL}}
+	return topology
+}
 
-	s.channel, err = s.connection.Channel()
-	if err != nil {
-		return fmt.Errorf("failed to open a channel: %v", err)
-	}
+// startConsumers starts the consumers for the AMPQ queues once this instance is elected as the consumer instance.
+//
+// The consumer lease is renewed every third of its TTL. Consumers are started when the lease is acquired, and stopped when it is lost
+// (or cannot be renewed, i.e MongoDB is unreachable), so at most one instance processes worker output at a time.
+func (s *AMPQService) startConsumers() {
+	defer s.wg.Done()
 
-	// Declare queues with 1 hour consumer timeout
-	queues := []string{"sfm-in", "nerf-in", "sfm-out", "nerf-out"}
-	for _, queue := range queues {
-		args := amqp.Table{
-			"x-consumer-timeout": int64(time.Hour.Milliseconds()),
-		}
-		_, err = s.channel.QueueDeclare(queue, false, false, false, false, args)
+	ticker := time.NewTicker(s.config.ConsumerLeaseTTL / 3)
+	defer ticker.Stop()
+
+	var stopConsumers context.CancelFunc
+	for {
+		acquired, err := s.leaseManager.TryAcquire(context.Background(), consumerLeaseName, s.config.InstanceID, s.config.ConsumerLeaseTTL)
 		if err != nil {
-			return fmt.Errorf("failed to declare queue %s: %v", queue, err)
+			s.logger.Errorf("Failed to renew consumer lease: %v", err)
+			acquired = false
 		}
-	}
 
-	return nil
-}
+		if acquired && stopConsumers == nil {
+			s.logger.Infof("Instance %s elected as consumer instance", s.config.InstanceID)
+			var ctx context.Context
+			ctx, stopConsumers = context.WithCancel(context.Background())
+			s.wg.Add(len(s.pipeline) + 2)
+			for _, stage := range s.pipeline {
+				go s.runConsumer(ctx, stage.OutputQueue, s.stageConsumer(stage))
+			}
+			go s.runConsumer(ctx, workerHeartbeatQueue, s.processHeartbeat)
+			go s.monitorWorkers(ctx)
+			if s.config.StageTimeout > 0 || s.config.StageQueueTimeout > 0 {
+				s.wg.Add(1)
+				go s.monitorStageTimeouts(ctx)
+			}
+		} else if !acquired && stopConsumers != nil {
+			s.logger.Infof("Instance %s lost the consumer lease, stopping consumers", s.config.InstanceID)
+			stopConsumers()
+			stopConsumers = nil
+		}
 
-// startConsumers starts the consumers for the AMPQ queues.
-//
-// consumers are started as goroutines, and the function waits for them to finish using a WaitGroup.
-func (s *AMPQService) startConsumers() {
-	go s.runConsumer("sfm-out", s.processSFMJob)
-	go s.runConsumer("nerf-out", s.processNERFJob)
+		select {
+		case <-s.stopChan:
+			if stopConsumers != nil {
+				stopConsumers()
+				if err := s.leaseManager.Release(context.Background(), consumerLeaseName, s.config.InstanceID); err != nil {
+					s.logger.Errorf("Failed to release consumer lease: %v", err)
+				}
+			}
+			return
+		case <-ticker.C:
+		}
+	}
 }
 
-// runConsumer runs a consumer for the specified queue and consumption handler
-func (s *AMPQService) runConsumer(queueName string, processFunc func(amqp.Delivery) error) {
+// runConsumer runs a consumer for the specified queue and consumption handler until the context is cancelled.
+// A consumer whose consumption failed is restarted after a jittered backoff, which restarts from its minimum
+// once the consumer registered again, so a single channel error only briefly pauses processing.
+func (s *AMPQService) runConsumer(ctx context.Context, queueName string, processFunc func(broker.Delivery) error) {
 	defer s.wg.Done()
 
+	var b broker.Backoff
 	for {
 		select {
-		case <-s.stopChan:
+		case <-ctx.Done():
 			s.logger.Infof("Stopping %s consumer", queueName)
+			s.consumerStats.setState(queueName, ConsumerStateStopped, nil)
 			return
 		default:
-			if err := s.consume(queueName, processFunc); err != nil {
-				s.logger.Errorf("Error in %s consumer: %v. Reconnecting in 5 seconds...", queueName, err)
-				time.Sleep(5 * time.Second)
+			s.consumerStats.setState(queueName, ConsumerStateConnecting, nil)
+			if err := s.consume(ctx, queueName, processFunc, &b); err != nil && ctx.Err() == nil {
+				delay := b.Next()
+				s.logger.Errorf("Error in %s consumer: %v. Restarting in %s...", queueName, err, delay.Round(time.Millisecond))
+				s.consumerStats.setState(queueName, ConsumerStateReconnecting, err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(delay):
+				}
 			}
 		}
 	}
 }
 
-// consume consumes messages from the specified queue and processes them using the provided function
-func (s *AMPQService) consume(queueName string, processFunc func(amqp.Delivery) error) error {
-	if err := s.ensureConnection(); err != nil {
-		return fmt.Errorf("failed to ensure connection: %v", err)
-	}
-
-	ch, err := s.connection.Channel()
+// consume consumes messages from the specified queue and processes them using the provided function.
+// Consumption ends when the context is cancelled, which requeues any unacked messages.
+// The backoff is reset once the consumer is registered.
+func (s *AMPQService) consume(ctx context.Context, queueName string, processFunc func(broker.Delivery) error, b *broker.Backoff) error {
+	sub, err := s.broker.Consume(ctx, queueName)
 	if err != nil {
-		return fmt.Errorf("failed to open a channel: %v", err)
-	}
-	defer ch.Close()
-
-	messages, err := ch.Consume(
-		queueName, "", false, false, false, false, nil,
-	)
-	if err != nil {
-		return fmt.Errorf("failed to register a consumer: %v", err)
+		return err
 	}
 
 	s.logger.Infof("Started consuming from %s", queueName)
+	s.consumerStats.setState(queueName, ConsumerStateConsuming, nil)
+	b.Reset()
 
-	for msg := range messages {
-		if err := processFunc(msg); err != nil {
+	for msg := range sub.Deliveries() {
+		err := processFunc(msg)
+		s.consumerStats.recordMessage(queueName, err)
+		if err != nil {
 			s.logger.Errorf("Error processing message from %s: %v", queueName, err)
-			msg.Nack(false, true) // Negative acknowledge and requeue
-		} else {
-			msg.Ack(false)
+			s.settleFailure(queueName, msg, err)
+		} else if err := msg.Ack(); err != nil {
+			s.logger.Errorf("Failed to ack message from %s: %v", queueName, err)
 		}
 	}
+	return sub.Err()
+}
 
-	return fmt.Errorf("consumer channel closed")
+// publish publishes a message to the given queue, see publishWithRetries.
+func (s *AMPQService) publish(ctx context.Context, queueName string, msg broker.Message) error {
+	return s.publishWithRetries(ctx, queueName, func(ctx context.Context) error {
+		return s.broker.Publish(ctx, queueName, msg)
+	})
 }
 
-// ensureConnection ensures that the AMPQ connection is established
-func (s *AMPQService) ensureConnection() error {
-	if s.connection != nil && !s.connection.IsClosed() {
-		return nil
-	}
+// publishWithRetries publishes a message to the given destination with the given publishing function.
+//
+// The broker confirms published messages, so a message is only published once the broker confirmed it within
+// PUBLISH_CONFIRM_TIMEOUT. A message that is refused, unconfirmed or could not be sent is published again up to PUBLISH_RETRIES
+// times, after a jittered backoff. A message whose confirmation was lost may therefore be delivered twice, which consumers
+// handle as a redelivery.
+//
+// Returns ErrPublishNotConfirmed wrapping the last failure if the message was never confirmed.
+func (s *AMPQService) publishWithRetries(ctx context.Context, destination string, publish func(context.Context) error) error {
+	var b broker.Backoff
+	for attempt := 0; ; attempt++ {
+		err := publish(ctx)
+		if err == nil {
+			return nil
+		}
+		if attempt >= s.config.PublishRetries || ctx.Err() != nil {
+			return fmt.Errorf("%w: publishing to %s: %v", ErrPublishNotConfirmed, destination, err)
+		}
 
-	s.logger.Info("Reconnecting to RabbitMQ...")
-	return s.connect()
+		delay := b.Next()
+		s.logger.Warnf("Publishing to %s failed: %v. Retrying in %s...", destination, err, delay.Round(time.Millisecond))
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: publishing to %s: %v", ErrPublishNotConfirmed, destination, ctx.Err())
+		case <-time.After(delay):
+		}
+	}
 }
 
 // Shutdown shuts down the AMPQ service
@@ -181,61 +330,151 @@ func (s *AMPQService) Shutdown() {
 	s.logger.Info("Shutting down AMQP service...")
 	close(s.stopChan)
 	s.wg.Wait()
-	if s.connection != nil {
-		s.connection.Close()
+	if err := s.broker.Close(); err != nil {
+		s.logger.Errorf("Failed to close the broker connection: %v", err)
 	}
 	s.logger.Info("AMQP service shut down")
 }
 
-// toAPIUrl converts a file path to an API URL
-func (s *AMPQService) toAPIUrl(filePath string) string {
-	return s.baseURL + "worker-data/" + filePath
+// toAPIUrl converts a storage key to the signed worker-data API URL workers download it from.
+// Keys that are already URLs (scenes stored before the storage abstraction) are signed again if they are worker-data URLs,
+// and returned unchanged otherwise.
+func (s *AMPQService) toAPIUrl(key string) string {
+	if strings.HasPrefix(key, "http://") || strings.HasPrefix(key, "https://") {
+		u, err := url.Parse(key)
+		if err != nil || !strings.HasPrefix(u.Path, "/worker-data/") {
+			return key
+		}
+		key = strings.TrimPrefix(u.Path, "/worker-data/")
+	}
+	if cleaned, err := storage.CleanKey(key); err == nil {
+		key = cleaned
+	}
+	return s.config.WorkerDataBaseURL + "worker-data/" + key + "?" + s.workerURLs.Sign(key)
 }
 
-// PublishSFMJob publishes a new SFM job to the AMPQ message broker.
-//
-// The job is published to the 'sfm-in' queue, and the scene ID is appended to the 'sfm_list' and 'queue_list' queues.
+// PublishSFMJob starts the processing pipeline of a scene with its first stage, the sfm stage unless PIPELINE_STAGES lists
+// stages before it. The scene is claimed in 'queue_list' before its job is published, see startPipeline.
 //
-// Returns an error if the job could not be published.
+// Returns ErrJobAlreadyQueued if the scene is already in the pipeline, an error if the job could not be published.
 func (s *AMPQService) PublishSFMJob(ctx context.Context, scene *scene.Scene) error {
+	return s.startPipeline(ctx, s.pipeline[0], scene)
+}
+
+// buildSFMJob builds the job of the sfm stage of a scene, published to the 'sfm-in' queue.
+//
+// Jobs of image sets have the "input_type": "images" hint, so the worker uses the images of the zip archive as frames
+// instead of extracting frames from a video.
+// Every input of the scene (i.e several passes around an object) is listed under "inputs", in upload order. "file_path"
+// remains the first input, for workers handling a single input.
+func (s *AMPQService) buildSFMJob(ctx context.Context, scene *scene.Scene) (*StageJob, error) {
+	primary := scene.PrimaryVideo()
+	inputs := make([]map[string]string, 0, len(scene.Videos))
+	for _, video := range scene.Videos {
+		inputs = append(inputs, map[string]string{"file_path": s.toAPIUrl(video.FilePath), "input_type": video.Kind()})
+	}
 	job := map[string]interface{}{
 		"id":        scene.ID.Hex(),
-		"file_path": s.toAPIUrl(scene.Video.FilePath),
+		"file_path": s.toAPIUrl(primary.FilePath),
+		"inputs":    inputs,
+	}
+	if primary.IsImageSet() {
+		job["input_type"] = primary.InputType
 	}
 
 	jsonJob, err := json.Marshal(job)
 	if err != nil {
-		return fmt.Errorf("failed to marshal SFM job: %v", err)
+		return nil, fmt.Errorf("failed to marshal SFM job: %v", err)
 	}
+	return &StageJob{Body: jsonJob}, nil
+}
 
-	err = s.channel.PublishWithContext(ctx, "", "sfm-in", false, false, amqp.Publishing{
-		ContentType: "application/json",
-		Body:        jsonJob,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to publish SFM job: %v", err)
+// releaseQueues removes a scene whose job could not be published (or was cancelled) from the given queues, so it can be published again.
+func (s *AMPQService) releaseQueues(ctx context.Context, sceneID primitive.ObjectID, queueNames ...string) {
+	for _, queueName := range queueNames {
+		err := s.queueManager.DeleteFromQueue(ctx, queueName, sceneID)
+		if err != nil && !errors.Is(err, queue.ErrIDNotFoundInQueue) && !errors.Is(err, queue.ErrInvalidOpOnEmptyQueue) {
+			s.logger.Errorf("Failed to remove scene %s from %s: %v", sceneID.Hex(), queueName, err)
+		}
 	}
+}
 
-	err = s.queueManager.AppendToQueue(ctx, "sfm_list", scene.ID)
+// CancelJob cancels the processing of a scene. Published jobs can not be withdrawn from the broker, so the scene is marked
+// cancelled and removed from the queue lists, and the worker results of cancelled scenes are discarded by the consumers.
+// A cancelled scene can be published again, i.e by a replay.
+//
+// The cancellation is broadcast to the workers on the 'worker-control' topic, so the worker processing the scene can
+// stop, and workers skip its job if they receive it later. Workers that miss the message still have their result discarded,
+// so failing to broadcast it does not fail the cancellation. The message format is:
+//
+//	{
+//		"type": "cancel",
+//		"id": string (primitive.ObjectID.Hex()),
+//		"stage": string (the stage of PIPELINE_STAGES the scene was queued for, "" if unknown)
+//	}
+//
+// Returns ErrJobNotQueued if the scene is not being processed.
+func (s *AMPQService) CancelJob(ctx context.Context, sceneID primitive.ObjectID) error {
+	_, _, err := s.queueManager.GetQueuePosition(ctx, "queue_list", sceneID)
+	if errors.Is(err, queue.ErrIDNotFoundInQueue) {
+		return ErrJobNotQueued
+	}
 	if err != nil {
-		return fmt.Errorf("failed to append to sfm_list: %v", err)
+		return err
+	}
+	stage := ""
+	queueLists := make([]string, 0, len(s.pipeline)+1)
+	for _, candidate := range s.pipeline {
+		if _, _, err := s.queueManager.GetQueuePosition(ctx, candidate.ListName, sceneID); err == nil && stage == "" {
+			stage = candidate.Name
+		}
+		queueLists = append(queueLists, candidate.ListName)
 	}
+	queueLists = append(queueLists, "queue_list")
 
-	err = s.queueManager.AppendToQueue(ctx, "queue_list", scene.ID)
-	if err != nil {
-		return fmt.Errorf("failed to append to queue_list: %v", err)
+	// Marked before the scene leaves the queue lists, so results consumed meanwhile are discarded
+	if err := s.sceneManager.SetFailureReason(ctx, sceneID, scene.FailureReasonCancelled); err != nil {
+		return err
+	}
+	s.releaseQueues(ctx, sceneID, queueLists...)
+	s.callbacks.Notify(sceneID, CallbackEventCancelled, "")
+	if err := s.publishCancellation(ctx, sceneID, stage); err != nil {
+		s.logger.Warnf("Failed to notify the workers of the cancellation of scene %s: %v", sceneID.Hex(), err)
 	}
 
-	s.logger.Infof("SFM Job Published with ID %s", scene.ID.Hex())
+	s.logger.Infof("Processing of scene %s cancelled", sceneID.Hex())
 	return nil
 }
 
-// processSFMJob processes a message from the 'sfm-out' queue.
+// publishCancellation broadcasts the cancellation of the scene with the given ID, queued for the given stage, to the workers.
+func (s *AMPQService) publishCancellation(ctx context.Context, sceneID primitive.ObjectID, stage string) error {
+	return s.publishControl(ctx, map[string]string{
+		"type":  "cancel",
+		"id":    sceneID.Hex(),
+		"stage": stage,
+	})
+}
+
+// publishControl broadcasts the given control message to the workers on the 'worker-control' topic.
+func (s *AMPQService) publishControl(ctx context.Context, message map[string]string) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	msg := broker.Message{ContentType: "application/json", Body: body}
+	return s.publishWithRetries(ctx, workerControlTopic, func(ctx context.Context) error {
+		return s.broker.Broadcast(ctx, workerControlTopic, msg)
+	})
+}
+
+// processSFMOutput processes a message from the 'sfm-out' queue for the given scene.
 //
 // The message is expected to contain the output of the SFM worker, which is then processed and saved to the database.
-// Upon successful processing, the scene is removed from the 'sfm_list' queue and a new NERF job is published.
+// Upon successful processing, the scene moves on to the next stage (see advance), the nerf stage by default.
+// A scene whose worker reported a non-zero flag fails, and is removed from the queue lists instead of moving on.
 //
-// This function TRUSTS the output of the SFM worker, and does not perform any validation on the message.
+// The output is validated against its schema before any frame is downloaded, see validateSFMOutput. Output that does not
+// match it is dead-lettered without retries. The message is acknowledged by the consumer, which retries it if an error is returned.
 // The expected message format is:
 //
 //	{
@@ -253,15 +492,21 @@ func (s *AMPQService) PublishSFMJob(ctx context.Context, scene *scene.Scene) err
 //  	    ],
 //  	    "white_background": bool
 //  	},
-//  	"flag": someInt
+//  	"flag": someInt,
+//  	"error": string (optional, describes the failure when flag is not 0),
+//  	"worker_id": string (optional),
+//  	"gpu_seconds": float64 (optional),
+//  	"worker_version": string (optional, the worker_version header takes precedence)
 //	}
-func (s *AMPQService) processSFMJob(d amqp.Delivery) error {
+func (s *AMPQService) processSFMOutput(ctx context.Context, currentScene *scene.Scene, d broker.Delivery) (*StageResult, error) {
 	type SfmWorkerData struct {
-		SceneID   string    `json:"id"`
 		VidWidth  int       `json:"vid_width"`
 		VidHeight int       `json:"vid_height"`
 		Sfm       scene.Sfm `json:"sfm"`
 		Flag      int       `json:"flag"`
+		Error     string    `json:"error"`
+		WorkerCost
+		WorkerVersion string `json:"worker_version"`
 	}
 
 	var data SfmWorkerData
@@ -269,28 +514,13 @@ func (s *AMPQService) processSFMJob(d amqp.Delivery) error {
 	// Decode sfm-worker output
 	err := json.Unmarshal(d.Body, &data)
 	if err != nil {
-		s.logger.Errorf("Error unmarshalling SFM data: %v", err)
-		d.Nack(false, true)
-		return err
-	}
-
-	s.logger.Debug("Processing SFM job: ", data)
-
-	sceneID, err := primitive.ObjectIDFromHex(data.SceneID)
-	if err != nil {
-		s.logger.Errorf("Invalid ID format: %v", err)
-		d.Nack(false, true)
-		return err
+		return nil, rejectOutput(scene.StageSfm, "", RejectionInvalidJSON, "%v", err)
 	}
 
-	ctx := context.Background()
-
-	// Create sfm output directory
-	saveDir := filepath.Join("data", "sfm", sceneID.Hex())
-	err = os.MkdirAll(saveDir, os.ModePerm)
-	if err != nil {
-		s.logger.Errorf("Error creating directory: %v", err)
-		return fmt.Errorf("error creating directory: %v", err)
+	s.logger.Debug("Processing SFM job: ", s.logger.RedactBody(data))
+	sceneID := currentScene.ID
+	if err := s.validateSFMOutput(currentScene, data.VidWidth, data.VidHeight, &data.Sfm, data.Flag); err != nil {
+		return nil, err
 	}
 
 	// Process the frames: download and save the files
@@ -298,92 +528,97 @@ func (s *AMPQService) processSFMJob(d amqp.Delivery) error {
 		url := frame.FilePath
 		s.logger.Debugf("Downloading image from %s", url)
 
-		resp, err := http.Get(url)
-		if err != nil {
-			s.logger.Errorf("Error downloading image: %v", err)
-			return fmt.Errorf("error downloading image: %v", err)
-		}
-		defer resp.Body.Close()
-
-		// Download and save the file
-		fileName := filepath.Base(url)
-		filePath := filepath.Join(saveDir, fileName)
-
-		file, err := os.Create(filePath)
-		if err != nil {
-			s.logger.Errorf("Error creating file: %v", err)
-			return fmt.Errorf("error creating file: %v", err)
-		}
-		defer file.Close()
-
-		_, err = io.Copy(file, resp.Body)
-		if err != nil {
-			s.logger.Errorf("Error saving file: %v", err)
-			return fmt.Errorf("error saving file: %v", err)
+		key := storage.TenantKey(currentScene.Tenant, storage.SfmFrameKey(sceneID.Hex(), path.Base(url)))
+		if err := s.downloadToStorage(ctx, sceneID, url, key); err != nil {
+			s.logger.Errorf("Error saving image: %v", err)
+			if isRejectedArtifact(err) {
+				s.rejectArtifacts(ctx, sceneID, scene.StageSfm, err)
+				return nil, nil
+			}
+			return nil, err
 		}
 
-		s.logger.Infof("File saved at %s", filePath)
+		s.logger.Infof("File saved at %s", key)
 
-		data.Sfm.Frames[i].FilePath = s.toAPIUrl(filePath)
+		data.Sfm.Frames[i].FilePath = key
 	}
 
 	// Update the scene with the new SFM Worker data
-	currentScene, err := s.sceneManager.GetScene(ctx, sceneID)
-	if err != nil {
-		s.logger.Errorf("Error getting scene: %v", err)
-		d.Nack(false, true)
-		return err
-	}
-
-	// Assumes that scene, scene.Video, and scene.Config are already populated
+	// Assumes that scene, its first video, and scene.Config are already populated
 	currentScene.Sfm = &data.Sfm
-	currentScene.Video.Width = data.VidWidth
-	currentScene.Video.Height = data.VidHeight
-
+	currentScene.ThumbnailFrame = s.chooseThumbnail(ctx, sceneID, data.Sfm.Frames)
+	currentScene.PrimaryVideo().Width = data.VidWidth
+	currentScene.PrimaryVideo().Height = data.VidHeight
+
+	// The training config may have been changed while the sfm stage ran, it is left as stored and read back once the
+	// sfm result is set, after which it can no longer change
+	loadedConfig := currentScene.Config
+	currentScene.Config = nil
 	err = s.sceneManager.SetScene(ctx, sceneID, currentScene)
 	if err != nil {
-		s.logger.Errorf("Error setting scene data: %v", err)
-		d.Nack(false, true)
-		return err
+		return nil, fmt.Errorf("failed to set scene data: %v", err)
 	}
-
-	// Remove from sfm_list queue
-	err = s.queueManager.DeleteFromQueue(ctx, "sfm_list", sceneID)
+	currentScene.Config, err = s.sceneManager.GetTrainingConfig(ctx, sceneID)
 	if err != nil {
-		s.logger.Errorf("Error popping from sfm_list queue: %v", err)
+		s.logger.Warnf("Error reading training config of scene %s, using the config it was submitted with: %v", sceneID.Hex(), err)
+		currentScene.Config = loadedConfig
+	}
+
+	s.recordStageCost(ctx, sceneID, scene.StageSfm, data.WorkerCost)
+	s.recordWorkerVersion(ctx, sceneID, scene.StageSfm, d, data.WorkerVersion)
+	if data.Flag != 0 {
+		// The scene stops here, it is not handed on to the nerf stage
+		s.logger.Warnf("SFM worker reported flag %d for scene %s", data.Flag, sceneID.Hex())
+		recordEvent(ctx, s.eventManager, s.logger, event.TypeJobFailed, sceneID, 0)
+		reason := fmt.Sprintf("structure from motion failed (flag %d)", data.Flag)
+		if err := s.sceneManager.SetFailureReason(ctx, sceneID, reason); err != nil {
+			s.logger.Errorf("Error setting failure reason: %v", err)
+		}
+		message := data.Error
+		if message == "" {
+			message = reason
+		}
+		s.recordSceneError(ctx, sceneID, scene.StageSfm, message)
+		s.releaseQueues(ctx, sceneID, "sfm_list", "queue_list")
+		s.callbacks.Notify(sceneID, CallbackEventFailed, reason)
+		return nil, nil
 	}
 
 	s.logger.Debug("Saved finished SFM job")
+	return &StageResult{Event: CallbackEventSfmCompleted}, nil
+}
 
-	// Publish new job to nerf-in
-	err = s.PublishNERFJob(ctx, currentScene)
-	if err != nil {
-		s.logger.Errorf("Error publishing NERF job: %v", err)
-		d.Nack(false, true)
-		return err
-	}
+// nerfCanaryQueue is the queue of the nerf jobs routed to the canary worker build. Canary workers publish to 'nerf-out' as usual.
+const nerfCanaryQueue = "nerf-in.canary"
 
-	d.Ack(false)
-	return nil
+// PublishNERFJob publishes the job of the nerf stage of a scene whose sfm stage completed, see publishStageJob.
+//
+// Returns ErrJobAlreadyQueued if the scene is already queued for training, an error if the job could not be published.
+func (s *AMPQService) PublishNERFJob(ctx context.Context, sc *scene.Scene) error {
+	return s.publishStageJob(ctx, s.stage(scene.StageNerf), sc)
 }
 
-// PublishNERFJob publishes a new NERF job to the AMPQ message broker.
-// The job is published to the 'nerf-in' queue, and the scene ID is appended to the 'nerf_list' queue.
-//
-// Returns an error if the job could not be published.
-func (s *AMPQService) PublishNERFJob(ctx context.Context, scene *scene.Scene) error {
+// buildNERFJob builds the job of the nerf stage of a scene, published to the 'nerf-in' queue.
+// CANARY_PERCENT percent of the jobs are published to the 'nerf-in.canary' queue instead, and their scene is tagged canary.
+func (s *AMPQService) buildNERFJob(ctx context.Context, scene *scene.Scene) (*StageJob, error) {
 	// Extract data from scene
 	sceneID := scene.ID
-	vid := scene.Video
+	vid := scene.PrimaryVideo()
 	sfm := scene.Sfm
 	config := scene.Config
 
+	// Frames are stored by key, workers need URLs
+	frames := slices.Clone(sfm.Frames)
+	for i := range frames {
+		frames[i].FilePath = s.toAPIUrl(frames[i].FilePath)
+	}
+
 	// Construct job
 	jobMap := map[string]interface{}{
 		"id":               sceneID.Hex(),
 		"vid_width":        vid.Width,
 		"vid_height":       vid.Height,
-		"frames":           sfm.Frames,
+		"frames":           frames,
 		"intrinsic_matrix": sfm.IntrinsicMatrix,
 		"white_background": sfm.WhiteBackground,
 		"output_types":     config.NerfTrainingConfig.OutputTypes,
@@ -394,39 +629,108 @@ func (s *AMPQService) PublishNERFJob(ctx context.Context, scene *scene.Scene) er
 
 	jobJson, err := json.Marshal(jobMap)
 	if err != nil {
-		s.logger.Errorf("Failed to marshal NERF job: %v", err)
-		return fmt.Errorf("failed to marshal NERF job: %v", err)
+		return nil, fmt.Errorf("failed to marshal NERF job: %v", err)
+	}
+
+	s.logger.Debugf("Job JSON: %s", s.logger.RedactBody(jobJson))
+
+	// Route to the canary build, the tag always reflects the build of the last nerf run
+	job := &StageJob{Body: jobJson}
+	canary := s.config.CanaryPercent > 0 && rand.IntN(100) < s.config.CanaryPercent
+	if canary {
+		job.Queue = nerfCanaryQueue
+	}
+	if canary || scene.Canary {
+		if err := s.sceneManager.SetCanary(ctx, sceneID, canary); err != nil {
+			return nil, fmt.Errorf("failed to tag canary scene: %v", err)
+		}
 	}
+	return job, nil
+}
+
+// PublishTrainingJob starts the processing pipeline of a scene whose structure from motion result is already available
+// (i.e a clone of a processed scene) with its nerf stage, skipping the stages before it. The scene is claimed in
+// 'queue_list' before its job is published, as PublishSFMJob does.
+//
+// Returns ErrJobAlreadyQueued if the scene is already in the pipeline, an error if the job could not be published.
+func (s *AMPQService) PublishTrainingJob(ctx context.Context, sc *scene.Scene) error {
+	return s.startPipeline(ctx, s.stage(scene.StageNerf), sc)
+}
+
+// WorkerCost contains the resource usage workers report alongside their output. Both fields are optional,
+// so workers that do not report usage yet are still accepted.
+type WorkerCost struct {
+	WorkerID   string  `json:"worker_id"`
+	GPUSeconds float64 `json:"gpu_seconds"`
+}
 
-	s.logger.Debugf("Job JSON: %s", jobJson)
+// recordStageCost stores the cost reported for a finished stage. Failing to record the cost does not fail the job.
+func (s *AMPQService) recordStageCost(ctx context.Context, sceneID primitive.ObjectID, stage string, cost WorkerCost) {
+	if cost.GPUSeconds < 0 {
+		s.logger.Warnf("Worker %s reported negative GPU seconds for scene %s, ignoring", cost.WorkerID, sceneID.Hex())
+		cost.GPUSeconds = 0
+	}
 
-	// Publish job
-	err = s.channel.PublishWithContext(ctx, "", "nerf-in", false, false, amqp.Publishing{
-		ContentType: "application/json",
-		Body:        jobJson,
+	err := s.sceneManager.AddStageCost(ctx, sceneID, scene.StageCost{
+		Stage:       stage,
+		WorkerID:    cost.WorkerID,
+		GPUSeconds:  cost.GPUSeconds,
+		CompletedAt: time.Now().UTC(),
 	})
 	if err != nil {
-		s.logger.Errorf("Failed to publish NERF job: %v", err)
-		return fmt.Errorf("failed to publish NERF job: %v", err)
+		s.logger.Errorf("Error recording %s cost for scene %s: %v", stage, sceneID.Hex(), err)
 	}
+}
 
-	// Append to nerf_list queue
-	err = s.queueManager.AppendToQueue(ctx, "nerf_list", sceneID)
+// recordSceneError stores the failure of a stage of a scene reported by its worker, so users can see why processing failed.
+// Failing to record the failure does not fail the job.
+func (s *AMPQService) recordSceneError(ctx context.Context, sceneID primitive.ObjectID, stage, message string) {
+	err := s.sceneManager.SetSceneError(ctx, sceneID, &scene.SceneError{
+		Stage:     stage,
+		Message:   message,
+		Timestamp: time.Now().UTC(),
+	})
 	if err != nil {
-		return fmt.Errorf("failed to append to nerf_list: %v", err)
+		s.logger.Errorf("Error recording %s failure for scene %s: %v", stage, sceneID.Hex(), err)
 	}
+}
 
-	s.logger.Debug("NERF Job Published with ID ", sceneID.Hex())
-	return nil
+// workerVersionHeader is the message header workers report their software version in
+const workerVersionHeader = "worker_version"
+
+// tenantHeader is the message header jobs carry the tenant of their scene in, so workers can keep the files of tenants apart
+const tenantHeader = "tenant"
+
+// jobHeaders returns the message headers of a job of the given scene. Jobs of the default tenant have none.
+func jobHeaders(sc *scene.Scene) map[string]interface{} {
+	if sc.Tenant == "" {
+		return nil
+	}
+	return map[string]interface{}{tenantHeader: sc.Tenant}
 }
 
-// processNERFJob processes a message from the 'nerf-out' queue
+// recordWorkerVersion stores the software version of the worker that completed a stage, read from the message header,
+// or from the `worker_version` field of the message body for workers that can not set headers.
+// Failing to record the version does not fail the job.
+func (s *AMPQService) recordWorkerVersion(ctx context.Context, sceneID primitive.ObjectID, stage string, d broker.Delivery, bodyVersion string) {
+	version := bodyVersion
+	if header, ok := d.Headers[workerVersionHeader].(string); ok && header != "" {
+		version = header
+	}
+
+	if err := s.sceneManager.SetWorkerVersion(ctx, sceneID, stage, version); err != nil {
+		s.logger.Errorf("Error recording %s worker version for scene %s: %v", stage, sceneID.Hex(), err)
+	}
+}
+
+// processNERFOutput processes a message from the 'nerf-out' queue for the given scene.
 //
 // The message is expected to contain the output of the NERF worker, which is then processed and saved to the file system & database.
-// Upon successful processing, the scene is removed from the 'nerf_list' and 'queue_list' queues.
+// Upon successful processing, the scene moves on to the next stage (see advance), or completes its pipeline if nerf is the last stage.
+// The output of a retrained scene is stored as a new version, and the output it replaces is kept as a previous version.
 //
-// This function TRUSTS the output of the nerf worker, and only validates the output types
-// and iterations against the scene config.
+// The output is validated against its schema and the scene config before any file is downloaded, see validateNERFOutput.
+// Output that does not match them is dead-lettered without retries.
 //
 // The expected message format is:
 //
@@ -441,37 +745,44 @@ func (s *AMPQService) PublishNERFJob(ctx context.Context, scene *scene.Scene) er
 //				...
 //	        },
 //	        ...
-//		}
+//		},
+//	    "worker_id": string (optional),
+//	    "gpu_seconds": float64 (optional),
+//	    "worker_version": string (optional, the worker_version header takes precedence)
 //	}
-func (s *AMPQService) processNERFJob(msg amqp.Delivery) error {
-	type IterationPaths map[int]string
-	type FilePaths map[string]IterationPaths
+func (s *AMPQService) processNERFOutput(ctx context.Context, currentScene *scene.Scene, msg broker.Delivery) (*StageResult, error) {
+	type IterationPaths = map[int]string
+	type FilePaths = map[string]IterationPaths
 	type NerfWorkerData struct {
-		SceneID   string    `json:"id"`
 		FilePaths FilePaths `json:"file_paths"`
+		WorkerCost
+		WorkerVersion string `json:"worker_version"`
 	}
 
 	var data NerfWorkerData
 	err := json.Unmarshal(msg.Body, &data)
 	if err != nil {
-		return fmt.Errorf("failed to unmarshal NERF worker data: %w", err)
+		return nil, rejectOutput(scene.StageNerf, "", RejectionInvalidJSON, "%v", err)
 	}
 
-	s.logger.Debug("Processing NERF job: ", data)
-
-	sceneID, err := primitive.ObjectIDFromHex(data.SceneID)
-	if err != nil {
-		return fmt.Errorf("invalid ID format: %v", err)
+	s.logger.Debug("Processing NERF job: ", s.logger.RedactBody(data))
+	sceneID := currentScene.ID
+	if err := s.validateNERFOutput(currentScene, data.FilePaths); err != nil {
+		return nil, err
 	}
 
-	ctx := context.Background()
-
-	currentScene, err := s.sceneManager.GetScene(ctx, sceneID)
-	if err != nil {
-		return fmt.Errorf("failed to get scene: %v", err)
+	// A retrained scene stores its result as a new version, keeping the result it replaces. Otherwise the result
+	// (re)places the current version, i.e on redelivery of the worker output
+	retrain := currentScene.RetrainVersion > 0 && currentScene.Nerf != nil
+	version := 1
+	switch {
+	case retrain:
+		version = currentScene.RetrainVersion
+	case currentScene.Nerf != nil:
+		version = currentScene.Nerf.CurrentVersion()
 	}
-
-	nerf := &scene.Nerf{}
+	completedAt := time.Now().UTC()
+	nerf := &scene.Nerf{Version: version, CompletedAt: &completedAt}
 	s.logger.Debug("Current Nerf: ", nerf)
 	config := currentScene.Config
 	s.logger.Debug("Current Config: ", config)
@@ -480,57 +791,16 @@ func (s *AMPQService) processNERFJob(msg amqp.Delivery) error {
 	saveIterations := config.NerfTrainingConfig.SaveIterations
 	s.logger.Debug("Save Iterations: ", saveIterations)
 
-	saveDir := filepath.Join("data", "nerf", sceneID.Hex())
-	// Create the save directory if it doesn't exist
-	err = os.MkdirAll(saveDir, os.ModePerm)
-	if err != nil {
-		return fmt.Errorf("failed to create save directory: %v", err)
-	}
-
 	for outputType, outputTypeURLs := range data.FilePaths {
-
-		// Create the type save directory if it doesn't exist
-		typeSaveDir := filepath.Join(saveDir, outputType)
-		err = os.MkdirAll(typeSaveDir, os.ModePerm)
-		if err != nil {
-			return fmt.Errorf("failed to create save directory for type %s: %v", outputType, err)
-		}
-
-		if !slices.Contains(outputTypes, outputType) {
-			return fmt.Errorf("output type unwanted by config: %s", outputType)
-		}
-
 		for iteration, URL := range outputTypeURLs {
-
-			// Create the iteration save directory if it doesn't exist
-			iterSaveDir := filepath.Join(typeSaveDir, fmt.Sprintf("iteration_%d", iteration))
-			err = os.MkdirAll(iterSaveDir, os.ModePerm)
-			if err != nil {
-				return fmt.Errorf("failed to create save directory for output/iteration %d: %v", iteration, err)
-			}
-
-			if !slices.Contains(saveIterations, iteration) {
-				return fmt.Errorf("iteration unwanted by config: %d", iteration)
-			}
-
 			// Download and save the file
-			resp, err := http.Get(URL)
-			if err != nil {
-				return fmt.Errorf("error downloading file: %v", err)
-			}
-			defer resp.Body.Close()
-
-			fileName := filepath.Base(URL)
-			filePath := filepath.Join(iterSaveDir, fileName)
-			file, err := os.Create(filePath)
-			if err != nil {
-				return fmt.Errorf("error creating file: %v", err)
-			}
-			defer file.Close()
-
-			_, err = io.Copy(file, resp.Body)
-			if err != nil {
-				return fmt.Errorf("error saving file: %v", err)
+			filePath := storage.TenantKey(currentScene.Tenant, storage.NerfVersionOutputKey(sceneID.Hex(), version, outputType, iteration, path.Base(URL)))
+			if err := s.downloadToStorage(ctx, sceneID, URL, filePath); err != nil {
+				if isRejectedArtifact(err) {
+					s.rejectArtifacts(ctx, sceneID, scene.StageNerf, err)
+					return nil, nil
+				}
+				return nil, err
 			}
 
 			switch outputType {
@@ -562,20 +832,19 @@ func (s *AMPQService) processNERFJob(msg amqp.Delivery) error {
 		}
 	}
 
-	err = s.sceneManager.SetNerf(ctx, sceneID, nerf)
-	if err != nil {
-		return fmt.Errorf("failed to set Nerf: %v", err)
-	}
-
-	err = s.queueManager.DeleteFromQueue(ctx, "nerf_list", sceneID)
-	if err != nil {
-		return fmt.Errorf("failed to pop from nerf_list: %v", err)
+	if retrain {
+		previous := currentScene.Nerf
+		previous.WorkerVersion = currentScene.WorkerVersions[scene.StageNerf]
+		err = s.sceneManager.SetRetrainedNerf(ctx, sceneID, nerf, previous)
+	} else {
+		err = s.sceneManager.SetNerf(ctx, sceneID, nerf)
 	}
-
-	err = s.queueManager.DeleteFromQueue(ctx, "queue_list", sceneID)
 	if err != nil {
-		return fmt.Errorf("failed to pop from queue_list: %v", err)
+		return nil, fmt.Errorf("failed to set Nerf: %v", err)
 	}
+	currentScene.Nerf = nerf
 
-	return nil
+	s.recordStageCost(ctx, sceneID, scene.StageNerf, data.WorkerCost)
+	s.recordWorkerVersion(ctx, sceneID, scene.StageNerf, msg, data.WorkerVersion)
+	return &StageResult{}, nil
 }
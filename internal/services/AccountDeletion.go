@@ -0,0 +1,170 @@
+// This file contains the account deletion of the ClientService.
+//
+// Deleting an account requires the user's password (or username for users without one), revokes every session,
+// and schedules the removal of the account after the configured grace period. Logging in during the grace period cancels it.
+// Once due, the user's scenes are removed with their files (videos, sfm frames and outputs, including archived outputs),
+// then the user itself. Scenes still being processed hold the removal back until the workers are done with them, as worker
+// results for a removed scene would be redelivered forever.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/audit"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/queue"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/user"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/storage"
+)
+
+// Custom errors
+var (
+	// ErrDeletionNotConfirmed is returned when an account deletion is not confirmed with the user's password (or username).
+	ErrDeletionNotConfirmed = errors.New("account deletion must be confirmed with your password")
+	// errScenesProcessing is returned when an account can not be removed yet, as some of its scenes are still being processed.
+	errScenesProcessing = errors.New("scenes are still being processed")
+)
+
+// DeleteAccount schedules the deletion of the given user, confirmed by their password. Users without a password
+// (social login only) confirm with their username instead. Every session of the user is revoked.
+// Without a grace period, the account is removed immediately unless scenes are still being processed.
+//
+// Returns the time the account will be removed at, or nil if it was removed. Returns ErrDeletionNotConfirmed
+// if the confirmation is wrong, user.ErrUserNotFound if the user does not exist.
+func (s *ClientService) DeleteAccount(ctx context.Context, userID primitive.ObjectID, password, username string) (*time.Time, error) {
+	u, err := s.userManager.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if u.HasPassword() {
+		if u.CheckPassword(password) != nil {
+			return nil, ErrDeletionNotConfirmed
+		}
+	} else if username != u.Username {
+		return nil, ErrDeletionNotConfirmed
+	}
+
+	deleteAt := time.Now().UTC().Add(s.config.AccountDeletionGrace)
+	if err := s.userManager.ScheduleDeletion(ctx, userID, deleteAt); err != nil {
+		return nil, err
+	}
+	if err := s.tokenManager.RevokeUserTokens(ctx, userID); err != nil {
+		return nil, err
+	}
+	s.logger.Infof("Deletion of user %s scheduled at %s", userID.Hex(), deleteAt.Format(time.RFC3339))
+
+	if s.config.AccountDeletionGrace > 0 {
+		return &deleteAt, nil
+	}
+	u.DeletionScheduledAt = &deleteAt
+	if err := s.purgeAccount(ctx, u); err != nil {
+		if !errors.Is(err, errScenesProcessing) {
+			s.logger.Warnf("Failed to remove user %s, retrying later: %v", userID.Hex(), err)
+		}
+		return &deleteAt, nil
+	}
+	return nil, nil
+}
+
+// RunAccountDeletion removes the accounts whose grace period passed every interval, until the context is cancelled.
+// Removal is idempotent, so every replica may run it.
+func (s *ClientService) RunAccountDeletion(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		users, err := s.userManager.ListDueDeletions(ctx, time.Now().UTC())
+		if err != nil {
+			s.logger.Errorf("Failed to list accounts due for deletion: %v", err)
+			continue
+		}
+		for _, u := range users {
+			if err := s.purgeAccount(ctx, u); err != nil && !errors.Is(err, errScenesProcessing) {
+				s.logger.Warnf("Failed to remove user %s: %v", u.ID.Hex(), err)
+			}
+		}
+	}
+}
+
+// purgeAccount removes the scenes of a user scheduled for deletion, then the user itself.
+//
+// Returns errScenesProcessing if a scene is still being processed, in which case nothing is removed.
+func (s *ClientService) purgeAccount(ctx context.Context, u *user.User) error {
+	for _, sceneID := range u.SceneIDs {
+		_, _, err := s.queueManager.GetQueuePosition(ctx, "queue_list", sceneID)
+		if err == nil {
+			return errScenesProcessing
+		}
+		if !errors.Is(err, queue.ErrIDNotFoundInQueue) {
+			return err
+		}
+	}
+
+	for _, sceneID := range u.SceneIDs {
+		if err := s.removeScene(ctx, sceneID); err != nil {
+			return fmt.Errorf("failed to remove scene %s: %w", sceneID.Hex(), err)
+		}
+		s.auditService.Record(ctx, audit.Entry{
+			Action:  audit.ActionSceneDeleted,
+			UserID:  u.ID,
+			SceneID: sceneID,
+			Details: map[string]string{"reason": "account_deleted"},
+		})
+	}
+	if err := s.userManager.DeleteUser(ctx, u.ID); err != nil {
+		return err
+	}
+	s.logger.Infof("Removed user %s and %d scenes", u.ID.Hex(), len(u.SceneIDs))
+	return nil
+}
+
+// removeScene deletes the files of a scene from the artifact and cold storage, then the scene itself and any queue entry left.
+// Scenes that were already removed are ignored.
+func (s *ClientService) removeScene(ctx context.Context, sceneID primitive.ObjectID) error {
+	sc, err := s.sceneManager.GetScene(ctx, sceneID)
+	if errors.Is(err, scene.ErrSceneNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if sc.Archive != nil && sc.Archive.Status != scene.ArchiveStatusArchived {
+		return scene.ErrArchiveConflict
+	}
+
+	keys := make([]string, 0)
+	for _, path := range sceneFiles(sc) {
+		if key, err := storage.CleanKey(path); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	s.deleteObjects(ctx, s.storage, keys)
+	if sc.Archive != nil && s.coldStorage != nil {
+		s.deleteObjects(ctx, s.coldStorage, sc.Archive.Keys)
+	}
+
+	if err := s.sceneManager.DeleteScene(ctx, sceneID); err != nil && !errors.Is(err, scene.ErrSceneNotFound) {
+		return err
+	}
+
+	// The scene left the overall queue, but a lost worker result may have left it in a stage queue
+	for _, queueName := range s.queueManager.GetQueueNames() {
+		err := s.queueManager.DeleteFromQueue(ctx, queueName, sceneID)
+		if err != nil && !errors.Is(err, queue.ErrIDNotFoundInQueue) && !errors.Is(err, queue.ErrInvalidOpOnEmptyQueue) {
+			s.logger.Warnf("Failed to remove scene %s from %s: %v", sceneID.Hex(), queueName, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,500 @@
+// This file contains the AdminService implementation, which is responsible for handling requests to admin-only routes.
+// Admin-only routes should be guarded by the web layer, which asks this service whether a user was granted the required role.
+//
+// Any work that needs database access should be delegated to the appropriate manager.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/announcement"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/deadletter"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/event"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/pagination"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/queue"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/user"
+)
+
+// Custom errors
+var (
+	// ErrUnknownTrendMetric is returned when trends are requested for an unknown metric.
+	ErrUnknownTrendMetric = errors.New("unknown trend metric")
+	// ErrInvalidTrendWindow is returned when trends are requested for a window outside of (0, maxTrendWindow].
+	ErrInvalidTrendWindow = errors.New("trend window must be between 1 and 365 days")
+	// ErrSelfDemotion is returned when an admin tries to remove their own admin role, which could leave no admin behind.
+	ErrSelfDemotion = errors.New("admins can not remove their own admin role")
+	// ErrUnknownTier is returned when a user is assigned a tier that has no retention rule.
+	ErrUnknownTier = errors.New("unknown tier")
+	// ErrInvalidConfig is returned when the reloaded configuration is malformed or invalid, in which case it is not applied.
+	ErrInvalidConfig = errors.New("invalid configuration")
+)
+
+// maxTrendWindow is the longest window trends can be requested for
+const maxTrendWindow = 365 * 24 * time.Hour
+
+// trendMetrics maps each trend metric to the event type it aggregates, and whether its value is the summed bytes
+// instead of the number of events.
+var trendMetrics = map[string]struct {
+	eventType string
+	bytes     bool
+}{
+	"jobs":     {eventType: event.TypeJobSubmitted},
+	"failures": {eventType: event.TypeJobFailed},
+	"storage":  {eventType: event.TypeArtifactStored, bytes: true},
+}
+
+// TrendPoint is the value of a trend metric on a single UTC day
+type TrendPoint struct {
+	Day   string `json:"day"`
+	Value int64  `json:"value"`
+}
+
+// UserSummary is the view of a user given to admins, without credentials
+type UserSummary struct {
+	ID         primitive.ObjectID `json:"id"`
+	Username   string             `json:"username"`
+	Roles      []string           `json:"roles"`
+	SceneCount int                `json:"scene_count"`
+	// Tier and RetentionExempt select the retention rule applied to the user's outputs once inactive
+	Tier            string     `json:"tier"`
+	RetentionExempt bool       `json:"retention_exempt"`
+	LastActiveAt    *time.Time `json:"last_active_at,omitempty"`
+	// UploadMaxSize is the maximum upload size of the user in bytes, if it replaces the one of the deployment
+	UploadMaxSize int64 `json:"upload_max_size,omitempty"`
+}
+
+// QueueSnapshot is the content of a processing queue at the time it was inspected
+type QueueSnapshot struct {
+	Name     string               `json:"name"`
+	Size     int                  `json:"size"`
+	SceneIDs []primitive.ObjectID `json:"scene_ids"`
+}
+
+// QueuePurge is the number of entries of terminal scenes removed from a processing queue
+type QueuePurge struct {
+	Name    string `json:"name"`
+	Removed int    `json:"removed"`
+}
+
+type AdminService struct {
+	announcementManager *announcement.AnnouncementManager
+	eventManager        *event.EventManager
+	userManager         *user.UserManager
+	queueManager        *queue.QueueListManager
+	sceneManager        *scene.SceneManager
+	mqService           *AMPQService
+	config              *config.Config
+	logger              *log.Logger
+}
+
+// NewAdminService creates a new AdminService. Dependencies are injected via the constructor.
+func NewAdminService(
+	am *announcement.AnnouncementManager,
+	em *event.EventManager,
+	um *user.UserManager,
+	qlm *queue.QueueListManager,
+	sm *scene.SceneManager,
+	mqs *AMPQService,
+	cfg *config.Config,
+	logger *log.Logger,
+) *AdminService {
+	return &AdminService{
+		announcementManager: am,
+		eventManager:        em,
+		userManager:         um,
+		queueManager:        qlm,
+		sceneManager:        sm,
+		mqService:           mqs,
+		config:              cfg,
+		logger:              logger,
+	}
+}
+
+// HasRole checks if the user with the given ID was granted the given role. Users that do not exist have no roles.
+func (s *AdminService) HasRole(ctx context.Context, userID primitive.ObjectID, role string) (bool, error) {
+	u, err := s.userManager.GetUserByID(ctx, userID)
+	if errors.Is(err, user.ErrUserNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return u.HasRole(role), nil
+}
+
+// IsAdmin checks if the user with the given ID is allowed to use admin routes.
+func (s *AdminService) IsAdmin(ctx context.Context, userID primitive.ObjectID) (bool, error) {
+	return s.HasRole(ctx, userID, user.RoleAdmin)
+}
+
+// GrantAdmins grants the admin role to every user with one of the given IDs.
+// Used at startup for the ADMIN_USER_IDS configuration. Users that do not exist are skipped with a warning.
+func (s *AdminService) GrantAdmins(ctx context.Context, userIDs []primitive.ObjectID) error {
+	for _, userID := range userIDs {
+		err := s.userManager.AddRole(ctx, userID, user.RoleAdmin)
+		if errors.Is(err, user.ErrUserNotFound) {
+			s.logger.Warnf("Configured admin user %s does not exist", userID.Hex())
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BootstrapAdmin makes sure an admin account with the given username exists, so a fresh deployment can be administered.
+// The account is created with the given password if it does not exist, otherwise the existing account is granted
+// the admin role and its password is left unchanged. The account belongs to the default tenant, as admins are not tenant scoped.
+func (s *AdminService) BootstrapAdmin(ctx context.Context, username, password string) error {
+	u, err := s.userManager.GetUserByUsername(ctx, "", username)
+	if errors.Is(err, user.ErrUserNotFound) {
+		if password == "" {
+			return errors.New("a password is required to create the bootstrap admin")
+		}
+		u, err = s.userManager.GenerateUser(ctx, "", username, password)
+		if err != nil {
+			return err
+		}
+		s.logger.Infof("Created bootstrap admin %s", s.logger.Redact(username))
+	} else if err != nil {
+		return err
+	}
+
+	if u.HasRole(user.RoleAdmin) {
+		return nil
+	}
+	return s.userManager.AddRole(ctx, u.ID, user.RoleAdmin)
+}
+
+// GetUser returns the summary of the user with the given ID.
+//
+// Returns ErrUserNotFound if the user does not exist.
+func (s *AdminService) GetUser(ctx context.Context, userID primitive.ObjectID) (*UserSummary, error) {
+	u, err := s.userManager.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	roles := u.Roles
+	if roles == nil {
+		roles = []string{}
+	}
+	return &UserSummary{
+		ID:         u.ID,
+		Username:   u.Username,
+		Roles:      roles,
+		SceneCount: len(u.SceneIDs),
+
+		Tier:            u.EffectiveTier(),
+		RetentionExempt: u.RetentionExempt,
+		LastActiveAt:    u.LastActiveAt,
+		UploadMaxSize:   u.UploadMaxSize,
+	}, nil
+}
+
+// SetUserRoles replaces the roles of the user with the given ID.
+//
+// Returns ErrSelfDemotion if an admin removes their own admin role, ErrInvalidRole for unknown roles,
+// ErrUserNotFound if the user does not exist.
+func (s *AdminService) SetUserRoles(ctx context.Context, adminID, userID primitive.ObjectID, roles []string) (*UserSummary, error) {
+	if adminID == userID && !slices.Contains(roles, user.RoleAdmin) {
+		return nil, ErrSelfDemotion
+	}
+
+	if err := s.userManager.SetRoles(ctx, userID, roles); err != nil {
+		return nil, err
+	}
+
+	s.logger.Infof("Roles of user %s set to %v by %s", userID.Hex(), roles, adminID.Hex())
+	return s.GetUser(ctx, userID)
+}
+
+// SetUserRetention sets the tier and / or the retention exemption of the user with the given ID. Nil values are left unchanged.
+// The tier must be DefaultTier or have a configured retention rule.
+//
+// Returns ErrUnknownTier for other tiers, ErrUserNotFound if the user does not exist.
+func (s *AdminService) SetUserRetention(ctx context.Context, adminID, userID primitive.ObjectID, tier *string, exempt *bool) (*UserSummary, error) {
+	if tier != nil && *tier != "" && *tier != user.DefaultTier {
+		if _, ok := s.config.RetentionRules[*tier]; !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownTier, *tier)
+		}
+	}
+
+	if err := s.userManager.UpdateRetention(ctx, userID, tier, exempt); err != nil {
+		return nil, err
+	}
+
+	summary, err := s.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Infof("Retention of user %s set to tier %s (exempt: %t) by %s", userID.Hex(), summary.Tier, summary.RetentionExempt, adminID.Hex())
+	return summary, nil
+}
+
+// SetUserUploadLimit sets the maximum upload size in bytes of the user with the given ID, which may be above or below the
+// one of the deployment. A size of 0 resets the user to the maximum upload size of the deployment.
+//
+// Returns ErrUserNotFound if the user does not exist.
+func (s *AdminService) SetUserUploadLimit(ctx context.Context, adminID, userID primitive.ObjectID, size int64) (*UserSummary, error) {
+	if err := s.userManager.SetUploadMaxSize(ctx, userID, size); err != nil {
+		return nil, err
+	}
+
+	s.logger.Infof("Upload limit of user %s set to %d bytes by %s", userID.Hex(), size, adminID.Hex())
+	return s.GetUser(ctx, userID)
+}
+
+// GetQueues returns a snapshot of every processing queue, the overall queue first.
+func (s *AdminService) GetQueues(ctx context.Context) ([]QueueSnapshot, error) {
+	names := s.queueManager.GetQueueNames()
+	snapshots := make([]QueueSnapshot, 0, len(names))
+	for _, name := range names {
+		ids, err := s.queueManager.GetQueueItems(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, QueueSnapshot{Name: name, Size: len(ids), SceneIDs: ids})
+	}
+	return snapshots, nil
+}
+
+// PurgeTerminalQueueEntries removes the scenes that will never be processed again from every processing queue, with a
+// single bulk removal per queue. Returns the number of entries removed from each queue, the overall queue first.
+//
+// A scene is terminal once deleted, failed, or completed. Failed and completed scenes are only purged when they are in no
+// stage queue: a replayed scene keeps the outputs and failure of its previous run while it is processed again, and a failed
+// stage removes its scene from the queues itself.
+func (s *AdminService) PurgeTerminalQueueEntries(ctx context.Context) ([]QueuePurge, error) {
+	names := s.queueManager.GetQueueNames()
+	queued := make(map[string][]primitive.ObjectID, len(names))
+	// Scenes waiting for, or in, a worker stage
+	staged := map[primitive.ObjectID]bool{}
+	var ids []primitive.ObjectID
+	for _, name := range names {
+		items, err := s.queueManager.GetQueueItems(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		queued[name] = items
+		for _, id := range items {
+			if name != "queue_list" {
+				staged[id] = true
+			}
+			if !slices.Contains(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	scenes, err := s.sceneManager.GetScenes(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	terminal := func(id primitive.ObjectID) bool {
+		sc, ok := scenes[id]
+		switch {
+		case !ok:
+			return true
+		case staged[id]:
+			return false
+		default:
+			return sc.FailureReason != "" || sc.Nerf != nil
+		}
+	}
+
+	purges := make([]QueuePurge, 0, len(names))
+	for _, name := range names {
+		var remove []primitive.ObjectID
+		for _, id := range queued[name] {
+			if terminal(id) {
+				remove = append(remove, id)
+			}
+		}
+		removed, err := s.queueManager.RemoveMany(ctx, name, remove)
+		if err != nil {
+			return nil, err
+		}
+		purges = append(purges, QueuePurge{Name: name, Removed: removed})
+	}
+	return purges, nil
+}
+
+// GetConsumerHealth returns the health of the queue consumers of this instance. Only the instance holding the consumer lease
+// runs consumers, so the consumers of other instances are reported stopped.
+func (s *AdminService) GetConsumerHealth() ConsumerHealth {
+	return s.mqService.ConsumerHealth()
+}
+
+// ListDeadLetters returns the given page of worker output messages given up on, newest first, and the cursor of the next page.
+func (s *AdminService) ListDeadLetters(ctx context.Context, page pagination.Page) ([]*deadletter.DeadLetter, string, error) {
+	return s.mqService.ListDeadLetters(ctx, page)
+}
+
+// GetDeadLetter returns the dead letter with the given ID.
+func (s *AdminService) GetDeadLetter(ctx context.Context, id primitive.ObjectID) (*deadletter.DeadLetter, error) {
+	return s.mqService.GetDeadLetter(ctx, id)
+}
+
+// ReplayDeadLetter republishes the message of a dead letter to the queue it was consumed from, and removes the dead letter.
+func (s *AdminService) ReplayDeadLetter(ctx context.Context, id primitive.ObjectID) (*deadletter.DeadLetter, error) {
+	return s.mqService.ReplayDeadLetter(ctx, id)
+}
+
+// DiscardDeadLetter removes a dead letter without replaying it.
+func (s *AdminService) DiscardDeadLetter(ctx context.Context, id primitive.ObjectID) error {
+	return s.mqService.DiscardDeadLetter(ctx, id)
+}
+
+// ListWorkers returns the sfm and nerf workers that reported heartbeats, whether they are online, and the number of online
+// workers of every stage.
+func (s *AdminService) ListWorkers(ctx context.Context) (*WorkerReport, error) {
+	return s.mqService.ListWorkers(ctx)
+}
+
+// ReloadConfig reloads the tunables of the configuration (rate limits, upload size cap, CORS origins, log level) on this
+// instance, without interrupting requests or consumers. Every instance reloads its own configuration.
+//
+// Returns the environment variables of the settings that changed, ErrInvalidConfig if the new configuration is invalid.
+func (s *AdminService) ReloadConfig() ([]string, error) {
+	changed, err := s.config.Reload()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	if err := s.logger.SetLevel(s.config.Tunables().LogLevel); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	s.logger.Infof("Configuration reloaded, changed settings: %v", changed)
+	return changed, nil
+}
+
+// GetActiveAnnouncements returns the announcements that should currently be displayed to users.
+func (s *AdminService) GetActiveAnnouncements(ctx context.Context) ([]*announcement.Announcement, error) {
+	return s.announcementManager.ListActiveAnnouncements(ctx, time.Now().UTC())
+}
+
+// ListAnnouncements returns the given page of every announcement, including scheduled and expired ones, and the cursor of the next page.
+func (s *AdminService) ListAnnouncements(ctx context.Context, page pagination.Page) ([]*announcement.Announcement, string, error) {
+	return s.announcementManager.ListAnnouncements(ctx, page)
+}
+
+// CreateAnnouncement creates a new announcement authored by the given admin.
+//
+// Returns the new announcement if successful, error if validation or insertion failed.
+func (s *AdminService) CreateAnnouncement(
+	ctx context.Context,
+	adminID primitive.ObjectID,
+	title, body, level string,
+	startsAt, endsAt *time.Time,
+) (*announcement.Announcement, error) {
+	a := &announcement.Announcement{
+		Title:     title,
+		Body:      body,
+		Level:     level,
+		StartsAt:  toUTC(startsAt),
+		EndsAt:    toUTC(endsAt),
+		CreatedBy: adminID,
+	}
+
+	if err := s.announcementManager.CreateAnnouncement(ctx, a); err != nil {
+		s.logger.Info("Failed to create announcement:", err.Error())
+		return nil, err
+	}
+
+	s.logger.Infof("Announcement %s created by %s", a.ID.Hex(), adminID.Hex())
+	return a, nil
+}
+
+// UpdateAnnouncement replaces the content and display window of an existing announcement.
+//
+// Returns the updated announcement if successful, error if it does not exist or validation failed.
+func (s *AdminService) UpdateAnnouncement(
+	ctx context.Context,
+	announcementID primitive.ObjectID,
+	title, body, level string,
+	startsAt, endsAt *time.Time,
+) (*announcement.Announcement, error) {
+	a, err := s.announcementManager.GetAnnouncement(ctx, announcementID)
+	if err != nil {
+		return nil, err
+	}
+
+	a.Title = title
+	a.Body = body
+	a.Level = level
+	a.StartsAt = toUTC(startsAt)
+	a.EndsAt = toUTC(endsAt)
+
+	if err := s.announcementManager.UpdateAnnouncement(ctx, a); err != nil {
+		s.logger.Info("Failed to update announcement:", err.Error())
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// DeleteAnnouncement deletes the announcement with the given ID.
+func (s *AdminService) DeleteAnnouncement(ctx context.Context, announcementID primitive.ObjectID) error {
+	return s.announcementManager.DeleteAnnouncement(ctx, announcementID)
+}
+
+// toUTC converts an optional timestamp given by a client (in any offset) to UTC, so responses are consistently in UTC.
+func toUTC(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	utc := t.UTC()
+	return &utc
+}
+
+// GetTrends returns the daily values of a metric over the given window, ending today (UTC).
+// Metrics are "jobs" (submitted scenes), "failures" (failed worker stages) and "storage" (bytes of artifacts stored).
+// Every day of the window is included, days without events have a value of 0.
+//
+// Returns ErrUnknownTrendMetric or ErrInvalidTrendWindow for invalid arguments, error if the aggregation failed.
+func (s *AdminService) GetTrends(ctx context.Context, metric string, window time.Duration) ([]TrendPoint, error) {
+	m, ok := trendMetrics[metric]
+	if !ok {
+		return nil, ErrUnknownTrendMetric
+	}
+	if window < 24*time.Hour || window > maxTrendWindow {
+		return nil, ErrInvalidTrendWindow
+	}
+
+	// Whole days, the oldest day of the window included
+	days := int(window / (24 * time.Hour))
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	since := today.AddDate(0, 0, -(days - 1))
+
+	aggregates, err := s.eventManager.GetDailyAggregates(ctx, []string{m.eventType}, since)
+	if err != nil {
+		return nil, err
+	}
+	byDay := make(map[string]event.DailyAggregate, len(aggregates))
+	for _, a := range aggregates {
+		byDay[a.Day] = a
+	}
+
+	points := make([]TrendPoint, days)
+	for i := range points {
+		day := since.AddDate(0, 0, i).Format(event.DayFormat)
+		points[i].Day = day
+		if m.bytes {
+			points[i].Value = byDay[day].Bytes
+		} else {
+			points[i].Value = byDay[day].Count
+		}
+	}
+	return points, nil
+}
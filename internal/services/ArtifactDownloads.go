@@ -0,0 +1,251 @@
+// This file contains the download of worker artifacts by the AMPQService.
+//
+// Workers report their artifacts (sfm frames, nerf outputs) as URLs the service downloads into the artifact storage.
+// Since those URLs come from worker messages, a misbehaving or compromised worker could point them anywhere, or serve
+// endless files. Downloads are therefore restricted to the WORKER_ALLOWED_HOSTS (redirects included), capped at
+// ARTIFACT_MAX_SIZE bytes per artifact, and share a bandwidth ceiling of ARTIFACT_DOWNLOAD_BANDWIDTH bytes per second.
+//
+// Without WORKER_ALLOWED_HOSTS, artifacts may be downloaded from any host of the worker network, but connections to
+// loopback, link-local (i.e cloud metadata services) and other addresses no worker serves from are still refused.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/event"
+)
+
+// Custom errors
+var (
+	// ErrWorkerHostNotAllowed is returned when a worker reports an artifact URL outside of the allowed worker hosts.
+	ErrWorkerHostNotAllowed = errors.New("artifact URL host is not an allowed worker host")
+	// ErrArtifactTooLarge is returned when a worker artifact exceeds the maximum artifact size.
+	ErrArtifactTooLarge = errors.New("artifact exceeds the maximum allowed size")
+)
+
+// maxArtifactRedirects is the number of redirects followed when downloading a worker artifact
+const maxArtifactRedirects = 5
+
+// newArtifactClient creates the HTTP client downloading worker artifacts, which only follows redirects to allowed hosts.
+func (s *AMPQService) newArtifactClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: s.checkArtifactDial}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxArtifactRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxArtifactRedirects)
+			}
+			return s.checkArtifactURL(req.URL)
+		},
+	}
+}
+
+// checkArtifactURL checks if an artifact may be downloaded from the given URL: it must be an http(s) URL whose host
+// is one of the allowed worker hosts, when any is configured. Hosts match with or without their port.
+//
+// Returns ErrWorkerHostNotAllowed otherwise.
+func (s *AMPQService) checkArtifactURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: unsupported scheme %q", ErrWorkerHostNotAllowed, u.Scheme)
+	}
+	allowed := s.config.WorkerAllowedHosts
+	if len(allowed) == 0 {
+		return nil
+	}
+	host := strings.ToLower(u.Host)
+	if slices.ContainsFunc(allowed, func(h string) bool {
+		h = strings.ToLower(h)
+		return h == host || h == strings.ToLower(u.Hostname())
+	}) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrWorkerHostNotAllowed, u.Host)
+}
+
+// checkArtifactDial refuses connections to addresses no worker serves artifacts from, after the host was resolved for the
+// connection, unless allowed worker hosts are configured.
+func (s *AMPQService) checkArtifactDial(network, address string, conn syscall.RawConn) error {
+	if len(s.config.WorkerAllowedHosts) > 0 {
+		return nil
+	}
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !isWorkerAddr(addrPort.Addr()) {
+		return fmt.Errorf("%w: refused to connect to %s, list the host in WORKER_ALLOWED_HOSTS to allow it", ErrWorkerHostNotAllowed, addrPort.Addr())
+	}
+	return nil
+}
+
+// isWorkerAddr checks if the given address may serve worker artifacts: private and public unicast addresses may, loopback,
+// link-local, multicast and unspecified addresses may not.
+func isWorkerAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return !addr.IsLoopback() && !addr.IsLinkLocalUnicast() && !addr.IsLinkLocalMulticast() &&
+		!addr.IsInterfaceLocalMulticast() && !addr.IsMulticast() && !addr.IsUnspecified()
+}
+
+// downloadToStorage downloads a worker artifact from the given URL and stores it under key.
+//
+// Returns ErrWorkerHostNotAllowed if the URL is not on an allowed worker host, ErrArtifactTooLarge if the artifact
+// exceeds the maximum artifact size, error if the download or storing failed.
+func (s *AMPQService) downloadToStorage(ctx context.Context, sceneID primitive.ObjectID, rawURL, key string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid artifact URL: %v", err)
+	}
+	if err := s.checkArtifactURL(u); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("error creating download request: %v", err)
+	}
+
+	resp, err := s.artifactClient.Do(req)
+	if err != nil {
+		// Wrapped, so refused redirects and connections are recognized by isRejectedArtifact
+		return fmt.Errorf("error downloading file: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error downloading file: status %d", resp.StatusCode)
+	}
+	if resp.ContentLength > s.config.ArtifactMaxSize {
+		return ErrArtifactTooLarge
+	}
+
+	// The declared length is not trusted, the body is capped while it is read
+	var r io.Reader = &cappedReader{r: resp.Body, remaining: s.config.ArtifactMaxSize}
+	if s.downloadLimiter != nil {
+		r = &throttledReader{ctx: ctx, r: r, limiter: s.downloadLimiter}
+	}
+	body := &countingReader{r: r}
+	if err := s.storage.Put(ctx, key, body, resp.ContentLength); err != nil {
+		return fmt.Errorf("error saving file: %w", err)
+	}
+
+	recordEvent(ctx, s.eventManager, s.logger, event.TypeArtifactStored, sceneID, body.n)
+	return nil
+}
+
+// isRejectedArtifact returns whether err means a worker artifact was refused, rather than failed to download.
+// Refused artifacts are refused again on every redelivery, so their message must not be requeued.
+func isRejectedArtifact(err error) bool {
+	return errors.Is(err, ErrWorkerHostNotAllowed) || errors.Is(err, ErrArtifactTooLarge)
+}
+
+// rejectArtifacts fails a scene whose worker reported a refused artifact for the given stage, and removes it from the queues,
+// so the worker message can be dropped. Failures are logged, as the message is dropped either way.
+func (s *AMPQService) rejectArtifacts(ctx context.Context, sceneID primitive.ObjectID, stage string, err error) {
+	s.logger.Warnf("Rejected %s artifact of scene %s: %v", stage, sceneID.Hex(), err)
+	recordEvent(ctx, s.eventManager, s.logger, event.TypeJobFailed, sceneID, 0)
+	reason := fmt.Sprintf("%s worker reported a rejected artifact: %v", stage, err)
+	if err := s.sceneManager.SetFailureReason(ctx, sceneID, reason); err != nil {
+		s.logger.Errorf("Error setting failure reason: %v", err)
+	}
+	s.recordSceneError(ctx, sceneID, stage, reason)
+	s.releaseQueues(ctx, sceneID, stage+"_list", "queue_list")
+	s.callbacks.Notify(sceneID, CallbackEventFailed, reason)
+}
+
+// cappedReader fails with ErrArtifactTooLarge once more than remaining bytes are read through it
+type cappedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (cr *cappedReader) Read(p []byte) (int, error) {
+	if cr.remaining < 0 {
+		return 0, ErrArtifactTooLarge
+	}
+	// Read one byte past the cap, to tell an artifact of exactly the maximum size from a larger one
+	if int64(len(p)) > cr.remaining+1 {
+		p = p[:cr.remaining+1]
+	}
+	n, err := cr.r.Read(p)
+	cr.remaining -= int64(n)
+	if cr.remaining < 0 {
+		return 0, ErrArtifactTooLarge
+	}
+	return n, err
+}
+
+// throttledReader waits for the bandwidth limiter after every read through it
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *bandwidthLimiter
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	if n > 0 {
+		if waitErr := tr.limiter.wait(tr.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// bandwidthLimiter is a token bucket of bytes, refilled at rate bytes per second up to one second of transfer.
+// Reads are accounted after they happened, so a large read puts the bucket in debt, delaying the following reads.
+type bandwidthLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newBandwidthLimiter creates a limiter of the given bytes per second, or nil if unlimited.
+func newBandwidthLimiter(bytesPerSecond int64) *bandwidthLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &bandwidthLimiter{rate: float64(bytesPerSecond), tokens: float64(bytesPerSecond), last: time.Now()}
+}
+
+// wait accounts n transferred bytes, and blocks until the bucket is out of debt or the context is cancelled.
+func (l *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate) - float64(n)
+	l.last = now
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
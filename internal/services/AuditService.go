@@ -0,0 +1,43 @@
+// This file contains the AuditService implementation, which is responsible for recording security relevant actions
+// (logins, password changes, scene creation / deletion, admin actions) to the audit log, and for listing the audit trail of a user.
+//
+// Recording entries is best-effort like recording events: a failure is logged, and never fails the request or job.
+
+package services
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/audit"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/pagination"
+)
+
+type AuditService struct {
+	auditManager *audit.AuditManager
+	logger       *log.Logger
+}
+
+// NewAuditService creates a new AuditService. Dependencies are injected via the constructor.
+func NewAuditService(am *audit.AuditManager, logger *log.Logger) *AuditService {
+	return &AuditService{
+		auditManager: am,
+		logger:       logger,
+	}
+}
+
+// Record records an audit entry, logging instead of returning any error.
+func (s *AuditService) Record(ctx context.Context, entry audit.Entry) {
+	if err := s.auditManager.RecordEntry(ctx, entry); err != nil {
+		s.logger.Warnf("Failed to record %s audit entry for user %s: %v", entry.Action, entry.UserID.Hex(), err)
+	}
+}
+
+// ListUserTrail returns the given page of audit entries concerning the given user, or performed by them, recorded before the given time,
+// newest first, and the cursor of the next page. A zero before lists the most recent entries.
+func (s *AuditService) ListUserTrail(ctx context.Context, userID primitive.ObjectID, before time.Time, page pagination.Page) ([]audit.Entry, string, error) {
+	return s.auditManager.ListUserTrail(ctx, userID, before, page)
+}
@@ -0,0 +1,230 @@
+// This file contains the AuthProvider interface verifying password logins, and the providers a deployment selects between
+// with AUTH_PROVIDER:
+//   - LocalAuthProvider: accounts registered on this server, with bcrypt passwords and lockout after repeated failures
+//   - LDAPAuthProvider: accounts of an LDAP directory, verified by binding as the user
+//   - SSOAuthProvider: accounts of the OpenID Connect single sign-on provider, which log in through the OAuth flow only
+//
+// Whatever the provider, logins end with the same user documents and tokens: users of the directory are provisioned on
+// their first login like social login users, linked by their DN. Local accounts with a password, i.e the bootstrap admin,
+// keep logging in with it under every provider, so a deployment can not lock out its admins.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/ldap"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/user"
+)
+
+// Declarations for valid auth providers
+const (
+	AuthProviderLocal = "local"
+	AuthProviderLDAP  = "ldap"
+	AuthProviderOIDC  = "oidc"
+)
+
+// Custom errors
+var (
+	// ErrInvalidCredentials is returned when the username or password of a login is incorrect.
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	// ErrPasswordLoginDisabled is returned when logging in with a password where users log in through single sign-on.
+	ErrPasswordLoginDisabled = errors.New("password login is disabled, log in with single sign-on")
+	// ErrRegistrationDisabled is returned when registering where accounts are managed by an external identity system.
+	ErrRegistrationDisabled = errors.New("registration is disabled, accounts are managed by the identity provider")
+)
+
+// Authentication is the result of a successful password login
+type Authentication struct {
+	// UserID is the user of a local account, unset for external accounts
+	UserID primitive.ObjectID
+	// Identity is the external account, provisioned as a user on its first login. Unset for local accounts
+	Identity *user.OAuthIdentity
+	// Username is the username of the user provisioned for Identity, made unique if taken
+	Username string
+}
+
+// AuthProvider is implemented by every identity system password logins can be verified against.
+type AuthProvider interface {
+	// Name returns the name of the provider, as set in AUTH_PROVIDER.
+	Name() string
+	// Authenticate verifies the password of the given username of the given tenant.
+	//
+	// Returns the authenticated account, *user.AccountLockedError if the account is locked, ErrInvalidCredentials if the
+	// credentials are incorrect, ErrPasswordLoginDisabled if the provider has no password logins, error otherwise.
+	Authenticate(ctx context.Context, tenant, username, password string) (*Authentication, error)
+	// AllowsRegistration reports whether users can register local accounts.
+	AllowsRegistration() bool
+}
+
+// NewAuthProvider creates the auth provider selected by AUTH_PROVIDER.
+func NewAuthProvider(cfg *config.Config, um *user.UserManager, logger *log.Logger) (AuthProvider, error) {
+	local := NewLocalAuthProvider(um, cfg, logger)
+	switch cfg.AuthProvider {
+	case AuthProviderLocal:
+		return local, nil
+	case AuthProviderLDAP:
+		return NewLDAPAuthProvider(local, cfg.LDAPURL, cfg.LDAPUserDNTemplate, cfg.LDAPTimeout), nil
+	case AuthProviderOIDC:
+		return &SSOAuthProvider{local: local}, nil
+	default:
+		return nil, fmt.Errorf("unknown auth provider %q", cfg.AuthProvider)
+	}
+}
+
+// LocalAuthProvider verifies the bcrypt passwords of accounts registered on this server. Consecutive failures are counted,
+// and lock the account for the configured cooldown once they reach the configured threshold.
+type LocalAuthProvider struct {
+	userManager *user.UserManager
+	config      *config.Config
+	logger      *log.Logger
+}
+
+// NewLocalAuthProvider creates a new LocalAuthProvider. Dependencies are injected via the constructor.
+func NewLocalAuthProvider(um *user.UserManager, cfg *config.Config, logger *log.Logger) *LocalAuthProvider {
+	return &LocalAuthProvider{
+		userManager: um,
+		config:      cfg,
+		logger:      logger,
+	}
+}
+
+func (p *LocalAuthProvider) Name() string { return AuthProviderLocal }
+
+func (p *LocalAuthProvider) AllowsRegistration() bool { return true }
+
+func (p *LocalAuthProvider) Authenticate(ctx context.Context, tenant, username, password string) (*Authentication, error) {
+	u, err := p.userManager.GetUserByUsername(ctx, tenant, username)
+	if errors.Is(err, user.ErrUserNotFound) {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p.authenticateUser(ctx, u, password)
+}
+
+// authenticateUser verifies the password of the given local account.
+func (p *LocalAuthProvider) authenticateUser(ctx context.Context, u *user.User, password string) (*Authentication, error) {
+	if u.IsLocked(time.Now()) {
+		return nil, &user.AccountLockedError{Until: *u.LockedUntil}
+	}
+
+	if !u.HasPassword() || u.CheckPassword(password) != nil {
+		if p.config.LoginLockoutThreshold > 0 {
+			lockedUntil, lockErr := p.userManager.RecordFailedLogin(ctx, u.ID, p.config.LoginLockoutThreshold, p.config.LoginLockoutCooldown)
+			if lockErr != nil {
+				p.logger.Warn("Failed to record failed login:", lockErr.Error())
+			} else if lockedUntil != nil {
+				p.logger.Infof("User %s locked until %s after too many failed logins", u.ID.Hex(), lockedUntil.Format(time.RFC3339))
+				return nil, &user.AccountLockedError{Until: *lockedUntil}
+			}
+		}
+		return nil, ErrInvalidCredentials
+	}
+
+	if err := p.userManager.ResetFailedLogins(ctx, u.ID); err != nil {
+		p.logger.Warn("Failed to reset failed logins:", err.Error())
+	}
+	return &Authentication{UserID: u.ID}, nil
+}
+
+// localAccount returns the local account with a password of the given username, nil if there is none.
+func (p *LocalAuthProvider) localAccount(ctx context.Context, tenant, username string) (*user.User, error) {
+	u, err := p.userManager.GetUserByUsername(ctx, tenant, username)
+	if errors.Is(err, user.ErrUserNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !u.HasPassword() {
+		return nil, nil
+	}
+	return u, nil
+}
+
+// LDAPAuthProvider verifies passwords by binding to an LDAP directory as the user, whose DN is built from a template.
+// Local accounts with a password are verified locally instead.
+type LDAPAuthProvider struct {
+	local      *LocalAuthProvider
+	url        string
+	dnTemplate string
+	timeout    time.Duration
+}
+
+// NewLDAPAuthProvider creates a new LDAPAuthProvider binding to the directory at url as dnTemplate, with %s replaced by the
+// escaped username.
+func NewLDAPAuthProvider(local *LocalAuthProvider, url, dnTemplate string, timeout time.Duration) *LDAPAuthProvider {
+	return &LDAPAuthProvider{
+		local:      local,
+		url:        url,
+		dnTemplate: dnTemplate,
+		timeout:    timeout,
+	}
+}
+
+func (p *LDAPAuthProvider) Name() string { return AuthProviderLDAP }
+
+func (p *LDAPAuthProvider) AllowsRegistration() bool { return false }
+
+func (p *LDAPAuthProvider) Authenticate(ctx context.Context, tenant, username, password string) (*Authentication, error) {
+	u, err := p.local.localAccount(ctx, tenant, username)
+	if err != nil {
+		return nil, err
+	}
+	if u != nil {
+		return p.local.authenticateUser(ctx, u, password)
+	}
+
+	dn := fmt.Sprintf(p.dnTemplate, ldap.EscapeDN(username))
+	bindCtx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	err = ldap.Bind(bindCtx, p.url, dn, password, nil)
+	if errors.Is(err, ldap.ErrInvalidCredentials) {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		p.local.logger.Warnf("LDAP bind of %s failed: %v", p.local.logger.Redact(username), err)
+		return nil, fmt.Errorf("directory unavailable: %w", err)
+	}
+
+	return &Authentication{
+		Identity: &user.OAuthIdentity{
+			Provider: AuthProviderLDAP,
+			// Directories compare DNs case-insensitively, so "Alice" and "alice" are the same account
+			Subject:  strings.ToLower(dn),
+			LinkedAt: time.Now().UTC(),
+		},
+		Username: username,
+	}, nil
+}
+
+// SSOAuthProvider leaves logins to the OpenID Connect single sign-on provider, which users log in through with the OAuth
+// flow. Only local accounts with a password log in with it.
+type SSOAuthProvider struct {
+	local *LocalAuthProvider
+}
+
+func (p *SSOAuthProvider) Name() string { return AuthProviderOIDC }
+
+func (p *SSOAuthProvider) AllowsRegistration() bool { return false }
+
+func (p *SSOAuthProvider) Authenticate(ctx context.Context, tenant, username, password string) (*Authentication, error) {
+	u, err := p.local.localAccount(ctx, tenant, username)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return nil, ErrPasswordLoginDisabled
+	}
+	return p.local.authenticateUser(ctx, u, password)
+}
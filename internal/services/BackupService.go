@@ -0,0 +1,384 @@
+// This file contains the BackupService implementation, which backs up and restores the database for disaster recovery.
+//
+// A backup is a dump of every backed up collection, and a manifest listing the dumps with their checksums and the artifact
+// files referenced by the backed up scenes. Both are written to the backup storage, which should be kept apart from the
+// artifact storage. The collections are dumped one after the other, so a backup taken under load is not a point-in-time
+// snapshot; a scene may reference a queue entry or user that changed while backing up.
+//
+// Restoring first verifies the backup: the checksum of every dump, and the presence of every referenced file in the artifact
+// or cold storage. Collections are only replaced once the verification passed, so a restore never points documents at lost files
+// unless explicitly allowed. Restores are only run from the backup CLI, as replacing collections under running replicas is unsafe.
+
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/backup"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/pagination"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/storage"
+)
+
+// Custom errors
+var (
+	// ErrBackupNotFound is returned when a backup does not exist, or is incomplete (it has no manifest).
+	ErrBackupNotFound = errors.New("backup not found")
+	// ErrBackupCorrupt is returned when a dump of a backup does not match the checksum of its manifest.
+	ErrBackupCorrupt = errors.New("backup is corrupt")
+	// ErrBackupFilesMissing is returned when restoring a backup whose referenced files are not all present.
+	ErrBackupFilesMissing = errors.New("files referenced by the backup are missing")
+)
+
+// BackupSummary is the view of a backup given when listing backups, without its file list
+type BackupSummary struct {
+	ID          string              `json:"id"`
+	CreatedAt   time.Time           `json:"created_at"`
+	Collections []backup.Collection `json:"collections"`
+	Files       int                 `json:"files"`
+	Missing     int                 `json:"missing"`
+}
+
+// RestoreReport is the result of verifying or restoring a backup
+type RestoreReport struct {
+	BackupID string `json:"backup_id"`
+	// Files is the number of referenced files checked, Missing the ones not found in any storage
+	Files   int      `json:"files"`
+	Missing []string `json:"missing"`
+	// Restored maps every restored collection to its number of documents, and is empty for verifications
+	Restored map[string]int `json:"restored,omitempty"`
+}
+
+type BackupService struct {
+	backupManager *backup.BackupManager
+	storage       storage.Storage
+	coldStorage   storage.Storage
+	backupStorage storage.Storage
+	logger        *log.Logger
+}
+
+// NewBackupService creates a new BackupService. Dependencies are injected via the constructor.
+// cold may be nil if archival is disabled.
+func NewBackupService(
+	bm *backup.BackupManager,
+	store storage.Storage,
+	cold storage.Storage,
+	backups storage.Storage,
+	logger *log.Logger,
+) *BackupService {
+	return &BackupService{
+		backupManager: bm,
+		storage:       store,
+		coldStorage:   cold,
+		backupStorage: backups,
+		logger:        logger,
+	}
+}
+
+// CreateBackup dumps every backed up collection to the backup storage, and writes the manifest of the backup.
+//
+// Returns the manifest once the backup is complete, error otherwise. An interrupted backup has no manifest, and is never listed.
+func (s *BackupService) CreateBackup(ctx context.Context) (*backup.Manifest, error) {
+	manifest := &backup.Manifest{
+		ID:          primitive.NewObjectID().Hex(),
+		CreatedAt:   time.Now().UTC(),
+		Collections: make([]backup.Collection, 0, len(backup.Collections)),
+		Files:       make([]backup.File, 0),
+	}
+
+	for _, name := range backup.Collections {
+		dump, err := s.dumpCollection(ctx, manifest, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to back up %s: %w", name, err)
+		}
+		manifest.Collections = append(manifest.Collections, *dump)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	key := storage.BackupKey(manifest.ID, backup.ManifestFileName)
+	if err := s.backupStorage.Put(ctx, key, bytes.NewReader(data), int64(len(data))); err != nil {
+		return nil, fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	s.logger.Infof("Created backup %s with %d referenced files (%d missing)", manifest.ID, len(manifest.Files), len(manifest.Missing))
+	return manifest, nil
+}
+
+// ListBackups returns the given page of complete backups in the backup storage, most recent first, and the cursor of the next page.
+// Only the manifests of the listed backups are read.
+func (s *BackupService) ListBackups(ctx context.Context, page pagination.Page) ([]BackupSummary, string, error) {
+	objects, err := s.backupStorage.List(ctx, "")
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Backup IDs are ObjectIDs, so they sort by creation time
+	backupIDs := make([]primitive.ObjectID, 0)
+	for _, obj := range objects {
+		backupID, fileName, ok := strings.Cut(obj.Key, "/")
+		if !ok || fileName != backup.ManifestFileName {
+			continue
+		}
+		id, err := primitive.ObjectIDFromHex(backupID)
+		if err != nil || !page.Includes(id) {
+			continue
+		}
+		backupIDs = append(backupIDs, id)
+	}
+	slices.SortFunc(backupIDs, func(a, b primitive.ObjectID) int {
+		return bytes.Compare(b[:], a[:])
+	})
+
+	summaries := make([]BackupSummary, 0)
+	for _, id := range backupIDs {
+		if page.Full(len(summaries)) {
+			break
+		}
+		manifest, err := s.GetBackup(ctx, id.Hex())
+		if err != nil {
+			s.logger.Warnf("Failed to read manifest of backup %s: %v", id.Hex(), err)
+			continue
+		}
+		summaries = append(summaries, BackupSummary{
+			ID:          manifest.ID,
+			CreatedAt:   manifest.CreatedAt,
+			Collections: manifest.Collections,
+			Files:       len(manifest.Files),
+			Missing:     len(manifest.Missing),
+		})
+	}
+
+	summaries, next := pagination.Paginate(summaries, page, func(b BackupSummary) primitive.ObjectID {
+		id, _ := primitive.ObjectIDFromHex(b.ID)
+		return id
+	})
+	return summaries, next, nil
+}
+
+// GetBackup returns the manifest of the given backup.
+//
+// Returns ErrBackupNotFound if the backup does not exist or is incomplete.
+func (s *BackupService) GetBackup(ctx context.Context, backupID string) (*backup.Manifest, error) {
+	key, err := storage.CleanKey(storage.BackupKey(backupID, backup.ManifestFileName))
+	if err != nil {
+		return nil, ErrBackupNotFound
+	}
+	r, err := s.backupStorage.Open(ctx, key)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		return nil, ErrBackupNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var manifest backup.Manifest
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("%w: invalid manifest: %v", ErrBackupCorrupt, err)
+	}
+	return &manifest, nil
+}
+
+// VerifyBackup checks that every dump of the given backup matches its checksum, and that every referenced file is present.
+//
+// Returns the report listing the missing files, ErrBackupNotFound if the backup does not exist,
+// ErrBackupCorrupt if a dump does not match its checksum.
+func (s *BackupService) VerifyBackup(ctx context.Context, backupID string) (*RestoreReport, error) {
+	manifest, err := s.GetBackup(ctx, backupID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dump := range manifest.Collections {
+		if err := s.readDump(ctx, dump, func(r io.Reader) error {
+			_, err := io.Copy(io.Discard, r)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	report := &RestoreReport{BackupID: manifest.ID, Files: len(manifest.Files), Missing: make([]string, 0)}
+	for _, file := range manifest.Files {
+		if _, ok := s.locateFile(ctx, file.Key); !ok {
+			report.Missing = append(report.Missing, file.Key)
+		}
+	}
+	return report, nil
+}
+
+// RestoreBackup verifies the given backup, then replaces every backed up collection with its dump.
+// allowMissing restores the backup even if referenced files are missing, i.e to recover the users of a lost artifact storage.
+//
+// Returns the report of the restore, ErrBackupFilesMissing with the verification report if files are missing and not allowed,
+// or any error of VerifyBackup.
+func (s *BackupService) RestoreBackup(ctx context.Context, backupID string, allowMissing bool) (*RestoreReport, error) {
+	report, err := s.VerifyBackup(ctx, backupID)
+	if err != nil {
+		return nil, err
+	}
+	if len(report.Missing) > 0 && !allowMissing {
+		return report, fmt.Errorf("%w: %d of %d", ErrBackupFilesMissing, len(report.Missing), report.Files)
+	}
+
+	manifest, err := s.GetBackup(ctx, backupID)
+	if err != nil {
+		return nil, err
+	}
+	report.Restored = make(map[string]int, len(manifest.Collections))
+	for _, dump := range manifest.Collections {
+		err := s.readDump(ctx, dump, func(r io.Reader) error {
+			count, err := s.backupManager.Import(ctx, dump.Name, r)
+			report.Restored[dump.Name] = count
+			return err
+		})
+		if err != nil {
+			return report, fmt.Errorf("failed to restore %s: %w", dump.Name, err)
+		}
+		s.logger.Infof("Restored %d documents of %s from backup %s", report.Restored[dump.Name], dump.Name, backupID)
+	}
+	return report, nil
+}
+
+// dumpCollection dumps the named collection to the backup storage through a temporary file, so large collections are
+// not held in memory. The files referenced by scenes are added to the manifest.
+func (s *BackupService) dumpCollection(ctx context.Context, manifest *backup.Manifest, name string) (*backup.Collection, error) {
+	tmp, err := os.CreateTemp("", "backup-"+name+"-*.bson")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	count, err := s.backupManager.Export(ctx, name, io.MultiWriter(tmp, hash))
+	if err != nil {
+		return nil, err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	if name == "scenes" {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if err := s.addSceneFiles(ctx, manifest, tmp); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	key := storage.BackupKey(manifest.ID, name+".bson")
+	if err := s.backupStorage.Put(ctx, key, tmp, size); err != nil {
+		return nil, err
+	}
+
+	return &backup.Collection{
+		Name:      name,
+		Key:       key,
+		Documents: count,
+		Bytes:     size,
+		SHA256:    hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+// addSceneFiles adds every file referenced by the scenes of the dump read from r to the manifest, with the storage it is in.
+func (s *BackupService) addSceneFiles(ctx context.Context, manifest *backup.Manifest, r io.Reader) error {
+	seen := make(map[string]bool)
+	return backup.ReadDump(r, func(doc bson.Raw) error {
+		var sc scene.Scene
+		if err := bson.Unmarshal(doc, &sc); err != nil {
+			return err
+		}
+
+		for _, path := range sceneFiles(&sc) {
+			key, err := storage.CleanKey(path)
+			if err != nil || seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			file, ok := s.locateFile(ctx, key)
+			if !ok {
+				manifest.Missing = append(manifest.Missing, key)
+				continue
+			}
+			manifest.Files = append(manifest.Files, *file)
+		}
+		return nil
+	})
+}
+
+// locateFile finds the given key in the artifact storage, or the cold storage if archival is enabled.
+func (s *BackupService) locateFile(ctx context.Context, key string) (*backup.File, bool) {
+	if info, err := s.storage.Stat(ctx, key); err == nil {
+		return &backup.File{Key: key, Size: info.Size, Storage: backup.StorageHot}, true
+	}
+	if s.coldStorage != nil {
+		if info, err := s.coldStorage.Stat(ctx, key); err == nil {
+			return &backup.File{Key: key, Size: info.Size, Storage: backup.StorageCold}, true
+		}
+	}
+	return nil, false
+}
+
+// readDump calls fn with the given dump, and checks the dump against its checksum once fn read all of it.
+// fn must read the dump to its end.
+func (s *BackupService) readDump(ctx context.Context, dump backup.Collection, fn func(r io.Reader) error) error {
+	r, err := s.backupStorage.Open(ctx, dump.Key)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		return fmt.Errorf("%w: %s dump is missing", ErrBackupCorrupt, dump.Name)
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	hash := sha256.New()
+	if err := fn(io.TeeReader(r, hash)); err != nil {
+		return err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != dump.SHA256 {
+		return fmt.Errorf("%w: %s dump does not match its checksum", ErrBackupCorrupt, dump.Name)
+	}
+	return nil
+}
+
+// sceneFiles returns the path of every file referenced by a scene: its videos, thumbnail, sfm frames and the nerf outputs of
+// every version.
+func sceneFiles(sc *scene.Scene) []string {
+	paths := sc.VideoKeys()
+	if sc.Thumbnail != "" {
+		paths = append(paths, sc.Thumbnail)
+	}
+	if sc.Sfm != nil {
+		for _, frame := range sc.Sfm.Frames {
+			if frame.FilePath != "" {
+				paths = append(paths, frame.FilePath)
+			}
+		}
+	}
+	return append(paths, sc.OutputKeys()...)
+}
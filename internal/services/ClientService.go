@@ -5,87 +5,217 @@
 //
 // In order to keep memory usage low, the service should not store any data that can be easily
 // retrieved from the databases, and also not open/read files when it can be avoided.
+//
+// Artifacts are never accessed by local path. They are read and written through the storage abstraction by key,
+// so any replica can handle any request.
 
 package services
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
 	"fmt"
-	"io"
-	"mime/multipart"
 	"net/url"
-	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
 	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/event"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/pagination"
 	"github.com/NeRF-or-Nothing/go-web-server/internal/models/queue"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/refreshtoken"
 	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
 	"github.com/NeRF-or-Nothing/go-web-server/internal/models/user"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/storage"
+)
+
+// Custom errors
+var (
+	// ErrInvalidIteration is returned when a requested output iteration is not a number.
+	ErrInvalidIteration = errors.New("invalid iteration")
+	// ErrThumbnailNotFound is returned when a scene has no frame that can be used as its thumbnail.
+	ErrThumbnailNotFound = errors.New("thumbnail not found")
+	// ErrSceneProcessing is returned when deleting a scene that is still queued or being processed by the workers.
+	ErrSceneProcessing = errors.New("scene is still being processed, it can be deleted once processing finished")
 )
 
 type ClientService struct {
-	mqService    *AMPQService
+	mqService    JobPublisher
 	sceneManager *scene.SceneManager
 	userManager  *user.UserManager
 	queueManager *queue.QueueListManager
+	tokenManager *refreshtoken.RefreshTokenManager
+	eventManager *event.EventManager
+	storage      storage.Storage
+	config       *config.Config
 	logger       *log.Logger
+
+	coldStorage  storage.Storage
+	auditService *AuditService
+	authProvider AuthProvider
 }
 
 // NewClientService creates a new ClientService. Dependencies are injected via the constructor.
-func NewClientService(mqs *AMPQService, sm *scene.SceneManager, um *user.UserManager, qlm *queue.QueueListManager, logger *log.Logger) *ClientService {
+func NewClientService(
+	mqs JobPublisher,
+	sm *scene.SceneManager,
+	um *user.UserManager,
+	qlm *queue.QueueListManager,
+	rtm *refreshtoken.RefreshTokenManager,
+	em *event.EventManager,
+	store storage.Storage,
+	cold storage.Storage,
+	as *AuditService,
+	ap AuthProvider,
+	cfg *config.Config,
+	logger *log.Logger,
+) *ClientService {
 	return &ClientService{
 		mqService:    mqs,
 		sceneManager: sm,
 		userManager:  um,
 		queueManager: qlm,
+		tokenManager: rtm,
+		eventManager: em,
+		storage:      store,
+		config:       cfg,
 		logger:       logger,
+
+		coldStorage:  cold,
+		auditService: as,
+		authProvider: ap,
 	}
 }
 
-// verifyUserAccess checks if the given user has access to the given scene.
+// authorizeScene resolves whether the given user may access the given scene, so every scene route distinguishes
+// a missing scene from a scene of another user in the same way. Scenes in the trash are only accessible to the trash
+// operations, every other route sees them as missing.
 //
-// Returns nil if the user has access, error if the user does not have access or an error occurred.
-func (s *ClientService) verifyUserAccess(ctx context.Context, userID, sceneID primitive.ObjectID) error {
-	authorized, err := s.userManager.UserHasJobAccess(ctx, userID, sceneID)
+// Returns scene.ErrSceneNotFound if the scene does not exist (even if its ID is still in the user's scene list) or is in the trash,
+// user.ErrUserNoAccess if it exists but does not belong to the user, or any other error that occurred.
+func (s *ClientService) authorizeScene(ctx context.Context, userID, sceneID primitive.ObjectID) error {
+	deletedAt, err := s.authorizeSceneOrTrash(ctx, userID, sceneID)
 	if err != nil {
 		return err
 	}
-	if !authorized {
-		return user.ErrUserNoAccess
+	if deletedAt != nil {
+		return scene.ErrSceneNotFound
 	}
 	return nil
 }
 
-// LoginUser checks if the given username and password are correct and returns the user's ID, nil if successful.
+// authorizeSceneOrTrash resolves whether the given user may access the given scene like authorizeScene, including scenes
+// in the trash.
 //
-// Returns "", error if the username or password is incorrect.
-func (s *ClientService) LoginUser(ctx context.Context, username, password string) (string, error) {
-	user, err := s.userManager.GetUserByUsername(ctx, username)
+// Returns when the scene was moved to the trash, nil if it is not in the trash.
+func (s *ClientService) authorizeSceneOrTrash(ctx context.Context, userID, sceneID primitive.ObjectID) (*time.Time, error) {
+	deletedAt, err := s.sceneManager.GetDeletedAt(ctx, sceneID)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	err = user.CheckPassword(password)
+	authorized, err := s.userManager.UserHasJobAccess(ctx, userID, sceneID)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if !authorized {
+		return nil, user.ErrUserNoAccess
 	}
+	return deletedAt, nil
+}
 
-	return user.ID.Hex(), nil
+// LoginUser checks if the given username and password of a user of the given tenant are correct and returns the user's ID, nil if successful.
+// Passwords are verified by the auth provider of the deployment, users of external identity systems are created on their first login.
+//
+// Returns "", *AccountLockedError if the account is locked, "", ErrInvalidCredentials if the username or password is incorrect,
+// "", ErrPasswordLoginDisabled if users log in through single sign-on, "", error otherwise.
+func (s *ClientService) LoginUser(ctx context.Context, tenant, username, password string) (string, error) {
+	auth, err := s.authProvider.Authenticate(ctx, tenant, username, password)
+	if err != nil {
+		return "", err
+	}
+	if auth.Identity != nil {
+		return s.LoginOAuthUser(ctx, tenant, *auth.Identity, auth.Username)
+	}
+	return auth.UserID.Hex(), nil
 }
 
-// RegisterUser generates a new user document with the given username and password, and inserts it into the database.
+// RegisterUser generates a new user document of the given tenant with the given username and password, and inserts it into the database.
+// The accepted terms of service / privacy policy versions must match the configured versions, and are recorded on the user.
 //
-// Returns nil if successful, error if the username is already taken or an error occurred while inserting the user.
-func (s *ClientService) RegisterUser(ctx context.Context, username, password string) error {
-	_, err := s.userManager.GenerateUser(ctx, username, password)
+// Returns nil if successful, ErrRegistrationDisabled if accounts are managed by an external identity system, error if the
+// username is already taken, the policy versions are not current, or an error occurred while inserting the user.
+func (s *ClientService) RegisterUser(ctx context.Context, tenant, username, password, termsVersion, privacyVersion, ip string) error {
+	if !s.authProvider.AllowsRegistration() {
+		return ErrRegistrationDisabled
+	}
+	if !s.isCurrentPolicyVersion(termsVersion, privacyVersion) {
+		return user.ErrPolicyVersionMismatch
+	}
+
+	newUser, err := s.userManager.GenerateUser(ctx, tenant, username, password)
 	if err != nil {
 		return err
 	}
 
+	return s.userManager.AddPolicyAcceptance(ctx, newUser.ID, user.PolicyAcceptance{
+		TermsVersion:   termsVersion,
+		PrivacyVersion: privacyVersion,
+		AcceptedAt:     time.Now().UTC(),
+		IP:             ip,
+	})
+}
+
+// GetPolicyVersions returns the current terms of service and privacy policy versions.
+// Empty versions are not enforced.
+func (s *ClientService) GetPolicyVersions() (string, string) {
+	return s.config.TermsVersion, s.config.PrivacyVersion
+}
+
+// isCurrentPolicyVersion checks if the given versions match the configured ones. Unconfigured versions always match.
+func (s *ClientService) isCurrentPolicyVersion(termsVersion, privacyVersion string) bool {
+	return (s.config.TermsVersion == "" || termsVersion == s.config.TermsVersion) &&
+		(s.config.PrivacyVersion == "" || privacyVersion == s.config.PrivacyVersion)
+}
+
+// AcceptPolicies records that the user with the given ID accepted the given terms of service / privacy policy versions.
+//
+// Returns nil if successful, ErrPolicyVersionMismatch if the versions are not current, error if the user does not exist.
+func (s *ClientService) AcceptPolicies(ctx context.Context, userID primitive.ObjectID, termsVersion, privacyVersion, ip string) error {
+	if !s.isCurrentPolicyVersion(termsVersion, privacyVersion) {
+		return user.ErrPolicyVersionMismatch
+	}
+
+	return s.userManager.AddPolicyAcceptance(ctx, userID, user.PolicyAcceptance{
+		TermsVersion:   termsVersion,
+		PrivacyVersion: privacyVersion,
+		AcceptedAt:     time.Now().UTC(),
+		IP:             ip,
+	})
+}
+
+// CheckPolicyAcceptance checks if the user with the given ID has accepted the current policy versions.
+//
+// Returns nil if accepted, ErrPoliciesNotAccepted if re-acceptance is required, error if the user does not exist.
+func (s *ClientService) CheckPolicyAcceptance(ctx context.Context, userID primitive.ObjectID) error {
+	if s.config.TermsVersion == "" && s.config.PrivacyVersion == "" {
+		return nil
+	}
+
+	u, err := s.userManager.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !u.HasAcceptedPolicies(s.config.TermsVersion, s.config.PrivacyVersion) {
+		return user.ErrPoliciesNotAccepted
+	}
 	return nil
 }
 
@@ -96,18 +226,219 @@ func (s *ClientService) UpdateUserUsername(ctx context.Context, userID primitive
 	return s.userManager.UpdateUsername(ctx, userID, password, newUsername)
 }
 
+// UpdateUserTimezone updates the preferred timezone of the user with the given ID, used for notifications and digests.
+// An empty timezone resets the preference to UTC.
+//
+// Returns nil if successful, ErrInvalidTimezone if the timezone is invalid, error if the user does not exist or an error occurred.
+func (s *ClientService) UpdateUserTimezone(ctx context.Context, userID primitive.ObjectID, timezone string) error {
+	return s.userManager.UpdateTimezone(ctx, userID, timezone)
+}
+
+// UpdateNotificationPreferences updates the notification email and / or the digest opt-out of the user with the given ID.
+// Nil arguments are left unchanged. An empty email removes the user's own address, falling back to the email of a linked account.
+//
+// Returns nil if successful, error if the user does not exist or an error occurred.
+func (s *ClientService) UpdateNotificationPreferences(ctx context.Context, userID primitive.ObjectID, email *string, weeklyDigest *bool) error {
+	var digestOptOut *bool
+	if weeklyDigest != nil {
+		optOut := !*weeklyDigest
+		digestOptOut = &optOut
+	}
+	return s.userManager.UpdateNotificationPreferences(ctx, userID, email, digestOptOut)
+}
+
 // UpdateUserPassword updates the password of the user with the given ID.
 //
+// Every refresh token of the user is revoked, so other sessions must log in again with the new password.
+//
 // Returns nil if successful, error if the user does not exist or an error occurred.
 func (s *ClientService) UpdateUserPassword(ctx context.Context, userID primitive.ObjectID, oldPassword, newPassword string) error {
-	return s.userManager.UpdatePassword(ctx, userID, oldPassword, newPassword)
+	if err := s.userManager.UpdatePassword(ctx, userID, oldPassword, newPassword); err != nil {
+		return err
+	}
+	return s.tokenManager.RevokeUserTokens(ctx, userID)
 }
 
-// GetSceneMetadata returns metadata about the resources available for the given scene.
+// maxUsernameAttempts is the number of usernames tried when creating a user through social login
+const maxUsernameAttempts = 5
+
+// LoginOAuthUser logs in the user of the given tenant linked to the given external account, creating a new user if none is linked yet.
+// New users are named after preferredUsername, with a random suffix if that username is taken.
 //
-// Returns error if the user does not have access to the scene or an error occurred.
-// For each available output file type, it returns a map of iteration numbers to file information.
-// Specifically, it returns whether the file exists, its size, number of (1 MB) chunks, and size of the last chunk.
+// Returns the user ID if successful, ErrRegistrationDisabled if no user is linked yet and accounts are managed by an external
+// identity system, error otherwise.
+func (s *ClientService) LoginOAuthUser(ctx context.Context, tenant string, identity user.OAuthIdentity, preferredUsername string) (string, error) {
+	existing, err := s.userManager.GetUserByOAuthIdentity(ctx, tenant, identity.Provider, identity.Subject)
+	if err == nil {
+		return existing.ID.Hex(), nil
+	}
+	if !errors.Is(err, user.ErrUserNotFound) {
+		return "", err
+	}
+	if !s.authProvider.AllowsRegistration() {
+		return "", ErrRegistrationDisabled
+	}
+
+	if preferredUsername == "" {
+		preferredUsername = identity.Provider + "-user"
+	}
+	username := preferredUsername
+	for attempt := 0; attempt < maxUsernameAttempts; attempt++ {
+		newUser, err := s.userManager.GenerateOAuthUser(ctx, tenant, username, identity)
+		if err == nil {
+			return newUser.ID.Hex(), nil
+		}
+		if !errors.Is(err, user.ErrUsernameTaken) {
+			return "", err
+		}
+
+		suffix := make([]byte, 3)
+		if _, err := rand.Read(suffix); err != nil {
+			return "", err
+		}
+		username = fmt.Sprintf("%s-%x", preferredUsername, suffix)
+	}
+	return "", user.ErrUsernameTaken
+}
+
+// LinkOAuthIdentity links an external account to an existing user, so they can also log in through it.
+//
+// Guests can not link external accounts, as logging in through them would keep the guest user beyond its session.
+//
+// Returns nil if successful, ErrOAuthIdentityLinked if the account is linked to another user,
+// ErrGuestRestricted if the user is a guest, error otherwise.
+func (s *ClientService) LinkOAuthIdentity(ctx context.Context, userID primitive.ObjectID, identity user.OAuthIdentity) error {
+	u, err := s.userManager.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if u.Guest {
+		return ErrGuestRestricted
+	}
+	return s.userManager.AddOAuthIdentity(ctx, userID, identity)
+}
+
+// IssueRefreshToken creates a refresh token for a user who just logged in from the given device (user agent) and IP.
+// The token starts a new token family, i.e a new session. Logging in cancels a scheduled deletion of the account.
+//
+// Returns the plain refresh token and the session ID if successful, error otherwise.
+func (s *ClientService) IssueRefreshToken(ctx context.Context, userID primitive.ObjectID, device, ip string) (string, string, error) {
+	cancelled, err := s.userManager.CancelDeletion(ctx, userID)
+	if err != nil {
+		return "", "", err
+	}
+	if cancelled {
+		s.logger.Infof("Deletion of user %s cancelled by login", userID.Hex())
+	}
+
+	familyID := primitive.NewObjectID()
+	token, err := s.createRefreshToken(ctx, userID, familyID, newSession(device, ip, time.Now().UTC()))
+	if err != nil {
+		return "", "", err
+	}
+	return token, familyID.Hex(), nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one. The presented token is revoked, and can not be used again.
+//
+// Presenting a token that was already used indicates it was stolen, so every token of its family is revoked,
+// forcing both the legitimate user and the attacker to log in again.
+//
+// The session keeps its issue time, and records the device and IP of the rotation.
+//
+// Returns the user ID, the session ID and the new plain refresh token if successful, error if the token is unknown, expired or revoked.
+func (s *ClientService) RotateRefreshToken(ctx context.Context, token, device, ip string) (string, string, string, error) {
+	rt, err := s.tokenManager.GetRefreshToken(ctx, token)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	if rt.RevokedAt != nil {
+		s.logger.Warn("Revoked refresh token reused, revoking token family for user", rt.UserID.Hex())
+		if err := s.tokenManager.RevokeFamily(ctx, rt.FamilyID); err != nil {
+			return "", "", "", err
+		}
+		return "", "", "", refreshtoken.ErrRefreshTokenRevoked
+	}
+	if rt.IsExpiredAt(time.Now().UTC()) {
+		return "", "", "", refreshtoken.ErrRefreshTokenExpired
+	}
+
+	if err := s.tokenManager.RevokeRefreshToken(ctx, rt.ID); err != nil {
+		if errors.Is(err, refreshtoken.ErrRefreshTokenRevoked) {
+			// Lost a race against another use of the same token
+			s.logger.Warn("Refresh token used concurrently, revoking token family for user", rt.UserID.Hex())
+			if err := s.tokenManager.RevokeFamily(ctx, rt.FamilyID); err != nil {
+				return "", "", "", err
+			}
+		}
+		return "", "", "", err
+	}
+
+	issuedAt := rt.Session.IssuedAt
+	if issuedAt.IsZero() {
+		// Tokens issued before sessions were recorded
+		issuedAt = rt.FamilyID.Timestamp()
+	}
+	newToken, err := s.createRefreshToken(ctx, rt.UserID, rt.FamilyID, newSession(device, ip, issuedAt))
+	if err != nil {
+		return "", "", "", err
+	}
+	return rt.UserID.Hex(), rt.FamilyID.Hex(), newToken, nil
+}
+
+// GetUserTenant returns the tenant of the user with the given ID.
+//
+// Returns the tenant if successful, ErrUserNotFound if the user does not exist, error otherwise.
+func (s *ClientService) GetUserTenant(ctx context.Context, userID string) (string, error) {
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return "", err
+	}
+	u, err := s.userManager.GetUserByID(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	return u.Tenant, nil
+}
+
+// RevokeRefreshToken revokes the token family of a refresh token, i.e when the user logs out.
+//
+// Returns nil if successful, error if the token is unknown or an error occurred.
+func (s *ClientService) RevokeRefreshToken(ctx context.Context, token string) error {
+	rt, err := s.tokenManager.GetRefreshToken(ctx, token)
+	if err != nil {
+		return err
+	}
+	return s.tokenManager.RevokeFamily(ctx, rt.FamilyID)
+}
+
+// createRefreshToken generates a random refresh token and stores it in the given family.
+func (s *ClientService) createRefreshToken(ctx context.Context, userID, familyID primitive.ObjectID, session refreshtoken.Session) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	// Logins and token refreshes are the activity the retention policy measures
+	if err := s.userManager.TouchLastActive(ctx, userID, time.Now().UTC()); err != nil {
+		s.logger.Warn("Failed to record user activity:", err.Error())
+	}
+
+	if _, err := s.tokenManager.CreateRefreshToken(ctx, userID, familyID, token, session, s.config.RefreshTokenTTL); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// GetSceneMetadata returns metadata about the inputs and resources available for the given scene.
+//
+// Returns error if the scene does not exist, the user does not have access to it or an error occurred.
+// The inputs are described as probed at ingest (dimensions, fps, duration and frame count of videos, image count of image
+// sets), so they are available before processing completes. For each available output file type, it returns a map of
+// iteration numbers to file information. Specifically, it returns whether the file exists, its size, number of (1 MB)
+// chunks, and size of the last chunk. Scenes not trained yet have no resources.
 func (s *ClientService) GetSceneMetadata(ctx context.Context, userID, sceneID primitive.ObjectID) (interface{}, error) {
 	// Information about a single resource available for a scene.
 	type ResourceInfo struct {
@@ -116,15 +447,51 @@ func (s *ClientService) GetSceneMetadata(ctx context.Context, userID, sceneID pr
 		Chunks        int   `json:"chunks,omitempty"`
 		LastChunkSize int64 `json:"last_chunk_size,omitempty"`
 	}
-	// Metadata about all resources available for a scene.
+	// Information about a single uploaded input of a scene, without its storage key.
+	type InputInfo struct {
+		InputType  string `json:"input_type"`
+		Width      int    `json:"width"`
+		Height     int    `json:"height"`
+		FPS        int    `json:"fps,omitempty"`
+		Duration   int    `json:"duration,omitempty"`
+		FrameCount int    `json:"frame_count,omitempty"`
+		ImageCount int    `json:"image_count,omitempty"`
+	}
+	// Metadata about the inputs and all resources available for a scene.
 	type SceneMetadata struct {
+		Inputs    []InputInfo                        `json:"inputs"`
 		Resources map[string]map[string]ResourceInfo `json:"resources"`
+		Error     *scene.SceneError                  `json:"error,omitempty"`
 	}
 
-	if err := s.verifyUserAccess(ctx, userID, sceneID); err != nil {
+	if err := s.authorizeScene(ctx, userID, sceneID); err != nil {
 		return nil, err
 	}
 
+	sc, err := s.sceneManager.GetScene(ctx, sceneID)
+	if err != nil {
+		return nil, err
+	}
+	metadata := &SceneMetadata{
+		Inputs:    make([]InputInfo, 0, len(sc.Videos)),
+		Resources: make(map[string]map[string]ResourceInfo),
+		Error:     sc.Error,
+	}
+	for _, input := range sc.Videos {
+		metadata.Inputs = append(metadata.Inputs, InputInfo{
+			InputType:  input.Kind(),
+			Width:      input.Width,
+			Height:     input.Height,
+			FPS:        input.FPS,
+			Duration:   input.Duration,
+			FrameCount: input.FrameCount,
+			ImageCount: input.ImageCount,
+		})
+	}
+	// Scenes not trained yet (or failing before training) have no resources, only their inputs and the failure reported by their worker
+	if sc.Nerf == nil {
+		return metadata, nil
+	}
 	nerf, err := s.sceneManager.GetNerf(ctx, sceneID)
 	if err != nil {
 		return nil, err
@@ -135,10 +502,6 @@ func (s *ClientService) GetSceneMetadata(ctx context.Context, userID, sceneID pr
 		return nil, err
 	}
 
-	metadata := &SceneMetadata{
-		Resources: make(map[string]map[string]ResourceInfo),
-	}
-
 	for _, ot := range config.NerfTrainingConfig.OutputTypes {
 
 		s.logger.Debug("Getting file paths for output type:", ot)
@@ -150,15 +513,15 @@ func (s *ClientService) GetSceneMetadata(ctx context.Context, userID, sceneID pr
 			return nil, err
 		}
 
-		for iteration, path := range iterFilePaths {
+		for iteration, key := range iterFilePaths {
 
 			s.logger.Debug("Getting file info for iteration:", iteration)
 
 			info := ResourceInfo{Exists: false}
 
-			if fileInfo, err := os.Stat(path); err == nil {
+			if objectInfo, err := s.storage.Stat(ctx, key); err == nil {
 
-				fileSize := fileInfo.Size()
+				fileSize := objectInfo.Size
 				chunks := (fileSize + 1024*1024 - 1) / (1024 * 1024)
 				lastChunkSize := fileSize % (1024 * 1024)
 				if lastChunkSize == 0 {
@@ -179,217 +542,265 @@ func (s *ClientService) GetSceneMetadata(ctx context.Context, userID, sceneID pr
 	return metadata, nil
 }
 
-// HandleIncomingVideo processes the video file uploaded by the user and starts the processing pipeline.
+// DeleteUserScene deletes a scene of the given user. The scene is moved to the trash, from which it can be restored until it is
+// purged, unless the deletion is permanent or the trash is disabled, in which case it is removed with its files. Scenes still queued
+// or being processed are refused, as worker results for a deleted scene would be redelivered forever. Guests can not delete their
+// scene, since they could then submit another one.
 //
-// If a training config value is not provided, a default value is used.
+// On permanent deletion, the scene is first removed from the user's scene list, so it disappears for the user even if removing
+// its files fails. Scenes in the trash can only be deleted permanently.
 //
-// Returns the scene ID if successful, error otherwise.
-func (s *ClientService) HandleIncomingVideo(
-	ctx context.Context,
-	userID primitive.ObjectID,
-	file *multipart.FileHeader,
-	trainingMode string,
-	outputTypes []string,
-	saveIterations []int,
-	totalIterations int,
-	sceneName string,
-) (string, error) {
-	// Validate video file
-	if file == nil {
-		return "", fmt.Errorf("file not received")
+// Returns the time the scene will be purged from the trash at, or nil if it was removed. Returns ErrSceneNotFound / ErrUserNoAccess
+// if the scene does not exist or belongs to another user, ErrSceneProcessing if it is being processed, ErrArchiveConflict if it
+// is being archived or restored, ErrGuestRestricted if the user is a guest, error otherwise.
+func (s *ClientService) DeleteUserScene(ctx context.Context, userID, sceneID primitive.ObjectID, permanent bool) (*time.Time, error) {
+	deletedAt, err := s.authorizeSceneOrTrash(ctx, userID, sceneID)
+	if err != nil {
+		return nil, err
 	}
-
-	fileName := file.Filename
-	if fileName == "" {
-		return "", fmt.Errorf("file not received")
+	if deletedAt != nil && !permanent {
+		return nil, scene.ErrSceneNotFound
 	}
 
-	fileExt := filepath.Ext(fileName)
-	if fileExt != ".mp4" {
-		return "", fmt.Errorf("improper file extension")
+	u, err := s.userManager.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
 	}
-
-	sceneID := primitive.NewObjectID()
-
-	// Save video to file storage
-	videoName := sceneID.Hex() + ".mp4"
-	videosFolder := "data/raw/videos"
-	if err := os.MkdirAll(videosFolder, os.ModePerm); err != nil {
-		return "", err
+	if u.Guest {
+		return nil, ErrGuestRestricted
 	}
-	videoFilePath := filepath.Join(videosFolder, videoName)
 
-	dst, err := os.Create(videoFilePath)
-	if err != nil {
-		return "", err
+	_, _, err = s.queueManager.GetQueuePosition(ctx, "queue_list", sceneID)
+	if err == nil {
+		return nil, ErrSceneProcessing
+	}
+	if !errors.Is(err, queue.ErrIDNotFoundInQueue) {
+		return nil, err
 	}
-	defer dst.Close()
 
-	src, err := file.Open()
+	sc, err := s.sceneManager.GetScene(ctx, sceneID)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer src.Close()
-
-	if _, err = io.Copy(dst, src); err != nil {
-		return "", err
+	if sc.Archive != nil && sc.Archive.Status != scene.ArchiveStatusArchived {
+		return nil, scene.ErrArchiveConflict
 	}
 
-	// Handle non-provided configuration values
-	if sceneName == "" {
-		sceneName = "Untitled Scene"
-	}
-	if trainingMode == "" {
-		trainingMode = "gaussian"
-	}
-	if len(outputTypes) == 0 {
-		outputTypes = []string{"video"}
-	}
-	if len(saveIterations) == 0 {
-		saveIterations = []int{1000, 7000, 30000}
+	if !permanent && s.config.SceneTrashRetention > 0 {
+		now := time.Now().UTC()
+		if err := s.sceneManager.TrashScene(ctx, sceneID, now); err != nil {
+			return nil, err
+		}
+		purgeAt := now.Add(s.config.SceneTrashRetention)
+		s.logger.Infof("Scene %s moved to the trash by user %s", sceneID.Hex(), userID.Hex())
+		return &purgeAt, nil
 	}
 
-
-	// Partially Initialize new scene
-	newScene := &scene.Scene{
-		ID: sceneID,
-		Video: &scene.Video{
-			FilePath: videoFilePath,
-		},
-		Config: &scene.TrainingConfig{
-			NerfTrainingConfig: &scene.NerfTrainingConfig{
-				TrainingMode:    trainingMode,
-				OutputTypes:     outputTypes,
-				SaveIterations:  saveIterations,
-				TotalIterations: totalIterations,
-			},
-		},
-		Name: sceneName,
+	if err := s.userManager.RemoveSceneID(ctx, userID, sceneID); err != nil {
+		return nil, err
 	}
-
-	// Insert scene into database
-	if err := s.sceneManager.SetScene(ctx, sceneID, newScene); err != nil {
-		s.logger.Errorf("Failed to insert new scene into database: %v", err)
-		return "", err
+	if err := s.removeScene(ctx, sceneID); err != nil {
+		return nil, err
 	}
+	s.logger.Infof("Scene %s deleted by user %s", sceneID.Hex(), userID.Hex())
+	return nil, nil
+}
 
-	// Start pipeline
-	if err := s.mqService.PublishSFMJob(ctx, newScene); err != nil {
-		s.logger.Errorf("Failed to publish SFM job: %v", err)
-		return "", err
+// CancelUserScene cancels the processing of a scene of the given user. The scene is kept, marked as failed, and can be deleted.
+//
+// Returns nil if successful, ErrSceneNotFound / ErrUserNoAccess if the scene does not exist or belongs to another user,
+// ErrJobNotQueued if it is not being processed, error otherwise.
+func (s *ClientService) CancelUserScene(ctx context.Context, userID, sceneID primitive.ObjectID) error {
+	if err := s.authorizeScene(ctx, userID, sceneID); err != nil {
+		return err
 	}
 
-	// Update user with new scene
-	user, err := s.userManager.GetUserByID(ctx, userID)
-	if err != nil {
-		return "", err
-	}
-	if err := user.AddScene(sceneID); err != nil {
-		return "", err
-	}
-	if err := s.userManager.UpdateUser(ctx, user); err != nil {
-		return "", err
+	if err := s.mqService.CancelJob(ctx, sceneID); err != nil {
+		return err
 	}
+	s.logger.Infof("Processing of scene %s cancelled by user %s", sceneID.Hex(), userID.Hex())
+	return nil
+}
 
-	return sceneID.Hex(), nil
+// SceneSummary is the overview of a scene listed in the scene history
+type SceneSummary struct {
+	ID              primitive.ObjectID `json:"id"`
+	Name            string             `json:"name"`
+	Status          string             `json:"status"`
+	CreatedAt       time.Time          `json:"created_at"`
+	HasThumbnail    bool               `json:"has_thumbnail"`
+	LatestIteration int                `json:"latest_iteration,omitempty"`
+	FailureReason   string             `json:"failure_reason,omitempty"`
+	DeletedAt       *time.Time         `json:"deleted_at,omitempty"`
 }
 
-// GetUserSceneHistory returns a list of scene IDS that the user has access to.
-// It is tolerant of scenes that have been deleted / not finished processing by ignoring them.
+// GetUserSceneHistory returns the summaries of the given page of scenes that the user has access to, in the trash or outside of it,
+// newest first, the cursor of the next page, and the total number of scenes in the history (or trash). Scenes are loaded in a single query, and their status is
+// derived like the progress report (see GetSceneProgressReport) from a single read of each processing queue.
+// It is tolerant of scenes that have been deleted by ignoring them.
 //
-// Returns a list of primitive.ObjectID's. Returns error if the user does not exist or non scene-existence errors occur.
-func (s *ClientService) GetUserSceneHistory(ctx context.Context, userID primitive.ObjectID) ([]string, error) {
+// Returns error if the user does not exist or an error occurred.
+func (s *ClientService) GetUserSceneHistory(ctx context.Context, userID primitive.ObjectID, trashed bool, page pagination.Page) ([]SceneSummary, string, int64, error) {
 	s.logger.Debug("Get user history request received")
 
 	user, err := s.userManager.GetUserByID(ctx, userID)
 	if err != nil {
 		s.logger.Info("Failed to get user history:", err.Error())
-		return nil, err
+		return nil, "", 0, err
 	}
 
-	resources := make([]string, 0)
-	for _, sceneID := range user.SceneIDs {
-		_, err := s.sceneManager.GetNerf(ctx, sceneID)
+	scenes, next, err := s.sceneManager.PageSceneSummaries(ctx, user.SceneIDs, trashed, page)
+	if err != nil {
+		s.logger.Info("Failed to get user history:", err.Error())
+		return nil, "", 0, err
+	}
+	total, err := s.sceneManager.CountScenes(ctx, user.SceneIDs, trashed)
+	if err != nil {
+		s.logger.Info("Failed to count user history:", err.Error())
+		return nil, "", 0, err
+	}
+	statuses, err := s.queueStatuses(ctx)
+	if err != nil {
+		s.logger.Info("Failed to get user history:", err.Error())
+		return nil, "", 0, err
+	}
 
-		// Ignore scenes that have been deleted / not finished processing
-		if err == scene.ErrSceneNotFound || err == scene.ErrNerfNotFound {
-			continue
+	summaries := make([]SceneSummary, len(scenes))
+	for i, sc := range scenes {
+		summary := SceneSummary{
+			ID:            sc.ID,
+			Name:          sc.Name,
+			CreatedAt:     sc.ID.Timestamp().UTC(),
+			FailureReason: sc.FailureReason,
+			DeletedAt:     sc.DeletedAt,
 		}
-		if err != nil {
-			s.logger.Info("Failed to get user history:", err.Error())
-			return nil, err
+		_, err := sceneThumbnailKey(sc)
+		summary.HasThumbnail = err == nil
+		if sc.Nerf != nil {
+			summary.LatestIteration = sc.Nerf.LatestIteration()
 		}
 
-		resources = append(resources, sceneID.Hex())
+		status, queued := statuses[sc.ID]
+		switch {
+		case sc.FailureReason != "":
+			summary.Status = ProgressStatusFailed
+		case queued:
+			summary.Status = status
+		case sc.Nerf != nil:
+			summary.Status = ProgressStatusCompleted
+		default:
+			summary.Status = ProgressStatusUnknown
+		}
+		summaries[i] = summary
 	}
 
 	s.logger.Info("User history retrieved successfully")
-	return resources, nil
+	return summaries, next, total, nil
+}
+
+// queueStatuses returns the progress status (queued or processing) of every scene in the overall queue, from a single read
+// of each processing queue. As in the progress report, scenes within WorkerConcurrency of the head of their stage queue are
+// being processed.
+func (s *ClientService) queueStatuses(ctx context.Context) (map[primitive.ObjectID]string, error) {
+	statuses := make(map[primitive.ObjectID]string)
+	for i, queueName := range s.queueManager.GetQueueNames() {
+		ids, err := s.queueManager.GetQueueItems(ctx, queueName)
+		if err != nil {
+			return nil, err
+		}
+		for position, id := range ids {
+			if i == 0 {
+				statuses[id] = ProgressStatusQueued
+			} else if _, ok := statuses[id]; ok && position < s.config.WorkerConcurrency {
+				statuses[id] = ProgressStatusProcessing
+			}
+		}
+	}
+	return statuses, nil
 }
 
-// GetSceneThumbnailPath returns the path to the thumbnail image for the given scene.
-// Paths are relative to the main *.go executable.
+// GetSceneThumbnailKey returns the storage key of the thumbnail image for the given scene.
 //
-// Internally, sfm frame data is used to determine the thumbnail path. THese are stored as http endpoints.
-// So, a little bit of string manipulation is required.
+// The thumbnail generated from the video of the scene at ingest is used if there is one, so it is available before the sfm
+// stage completes. Otherwise, sfm frame data is used to determine the thumbnail. Older scenes store frames as http endpoints
+// of the worker-data route, so a little bit of string manipulation is required for them.
 //
-// Returns ("", error) if the user does not have access to the scene or an error occurred.
-func (s *ClientService) GetSceneThumbnailPath(ctx context.Context, userID, sceneID primitive.ObjectID) (string, error) {
+// Returns ("", error) if the scene does not exist, the user does not have access to it or an error occurred.
+func (s *ClientService) GetSceneThumbnailKey(ctx context.Context, userID, sceneID primitive.ObjectID) (string, error) {
 	s.logger.Debug("Get scene thumbnail request received")
 
 	// Verify user access to scene
-	if err := s.verifyUserAccess(ctx, userID, sceneID); err != nil {
-		s.logger.Info("Invalid user ID access:", err.Error())
+	if err := s.authorizeScene(ctx, userID, sceneID); err != nil {
+		s.logger.Info("Scene access denied:", err.Error())
 		return "", err
 	}
 
-	sfm, err := s.sceneManager.GetSfm(ctx, sceneID)
+	sc, err := s.sceneManager.GetScene(ctx, sceneID)
 	if err != nil {
 		s.logger.Info("Invalid scene ID:", err.Error())
 		return "", err
 	}
 
+	key, err := sceneThumbnailKey(sc)
+	if err != nil {
+		s.logger.Info("No thumbnail:", err.Error())
+		return "", err
+	}
+
+	s.logger.Info("Thumbnail retrieved successfully")
+	return key, nil
+}
+
+// sceneThumbnailKey returns the storage key of the thumbnail of a scene: the thumbnail uploaded by its user or generated at
+// ingest, or else its thumbnail frame.
+//
+// Returns scene.ErrSfmNotFound if the scene has neither, error like thumbnailKey otherwise.
+func sceneThumbnailKey(sc *scene.Scene) (string, error) {
+	if sc.Thumbnail != "" {
+		return sc.Thumbnail, nil
+	}
+	if sc.Sfm == nil {
+		return "", scene.ErrSfmNotFound
+	}
+	return thumbnailKey(sc.Sfm, sc.ThumbnailFrame)
+}
+
+// thumbnailKey returns the storage key of the thumbnail of a scene: its sfm frame of the given index (the first frame if the index
+// is out of range), if it is a PNG file.
+//
+// Returns ErrThumbnailNotFound if the scene has no such frame, error if the frame path is invalid.
+func thumbnailKey(sfm *scene.Sfm, frame int) (string, error) {
 	if len(sfm.Frames) == 0 {
-		s.logger.Info("No frames found in SFM data")
-		return "", fmt.Errorf("no frames found in SFM data")
+		return "", fmt.Errorf("%w: no frames found in SFM data", ErrThumbnailNotFound)
+	}
+	if frame < 0 || frame >= len(sfm.Frames) {
+		frame = 0
 	}
 
-	// Use the first frame as the thumbnail
-	thumbnailPath := sfm.Frames[0].FilePath
+	thumbnailPath := sfm.Frames[frame].FilePath
 
 	if filepath.Ext(thumbnailPath) != ".png" {
-		s.logger.Info("First frame is not a PNG file")
-		return "", fmt.Errorf("first frame is not a PNG file")
+		return "", fmt.Errorf("%w: thumbnail frame is not a PNG file", ErrThumbnailNotFound)
 	}
 
-	// Convert API endpoint path to local file system path
+	// Convert legacy API endpoint path to a storage key
 	u, err := url.Parse(thumbnailPath)
 	if err != nil {
-		s.logger.Info("Invalid URL:", err.Error())
 		return "", fmt.Errorf("invalid URL: %v", err)
 	}
 
-	// Extract the path and remove "/worker-data" prefix if it exists
-	localPath := strings.TrimPrefix(u.Path, "/worker-data/")
-
-	// Ensure the path starts with "/data"
-	if !strings.HasPrefix(localPath, "data") {
-		s.logger.Info("Invalid path: does not start with data")
-		return "", fmt.Errorf("invalid path: does not start with data")
-	}
-
-	s.logger.Info("Thumbnail retrieved successfully")
-	return localPath, nil
+	return storage.CleanKey(strings.TrimPrefix(u.Path, "/worker-data/"))
 }
+
 // GetSceneName returns the name of the scene with the given ID.
 //
-// Returns (string) if scene valid. Returns ("", error) if the user does not have access to the scene or an error occurred.
+// Returns (string) if scene valid. Returns ("", error) if the scene does not exist, the user does not have access to it or an error occurred.
 func (s *ClientService) GetSceneName(ctx context.Context, userID, sceneID primitive.ObjectID) (string, error) {
 	s.logger.Debug("Get scene name request received")
 
 	// Verify user access to scene
-	if err := s.verifyUserAccess(ctx, userID, sceneID); err != nil {
-		s.logger.Info("Invalid user ID access:", err.Error())
+	if err := s.authorizeScene(ctx, userID, sceneID); err != nil {
+		s.logger.Info("Scene access denied:", err.Error())
 		return "", err
 	}
 
@@ -403,24 +814,210 @@ func (s *ClientService) GetSceneName(ctx context.Context, userID, sceneID primit
 	return sceneName, nil
 }
 
-// GetSceneOutputPath returns the relative path to the output file for the given scene.
-// Paths are relative to the main *.go executable.
+// GetSceneTrainingConfig returns the training configuration the scene with the given ID was submitted with.
 //
-// Returns (string) if successful. Returns ("", error) if the user does not have access to the scene or an error occurred.
-func (s *ClientService) GetSceneOutputPath(ctx context.Context, userID, sceneID primitive.ObjectID, outputType, iteration string) (string, error) {
+// Returns error if the scene does not exist, the user does not have access to it, scene.ErrTrainingConfigNotFound if the
+// scene was never submitted, or an error occurred.
+func (s *ClientService) GetSceneTrainingConfig(ctx context.Context, userID, sceneID primitive.ObjectID) (*scene.TrainingConfig, error) {
+	if err := s.authorizeScene(ctx, userID, sceneID); err != nil {
+		s.logger.Info("Scene access denied:", err.Error())
+		return nil, err
+	}
+
+	return s.sceneManager.GetTrainingConfig(ctx, sceneID)
+}
+
+// TrainingConfigUpdate holds the training values to change of a scene waiting for its sfm stage. Values that are not
+// provided are kept.
+type TrainingConfigUpdate struct {
+	OutputTypes     []string
+	SaveIterations  []int
+	TotalIterations int
+}
+
+// UpdateSceneTrainingConfig changes the training values of the scene with the given ID, as long as it is waiting in
+// sfm_list. The training mode can not be changed. Guests are limited by the guest quota.
+//
+// Returns the updated training config if successful, error if the scene does not exist or the user does not have access to
+// it, ErrJobNotQueued if the scene is not being processed, scene.ErrTrainingStarted if its training stage was already
+// reached, ErrInvalidTrainingConfig / ErrGuestQuotaExceeded if the resulting values are invalid, or an error occurred.
+func (s *ClientService) UpdateSceneTrainingConfig(ctx context.Context, userID, sceneID primitive.ObjectID, update TrainingConfigUpdate) (*scene.TrainingConfig, error) {
+	if err := s.authorizeScene(ctx, userID, sceneID); err != nil {
+		s.logger.Info("Scene access denied:", err.Error())
+		return nil, err
+	}
+
+	sc, err := s.sceneManager.GetScene(ctx, sceneID)
+	if err != nil {
+		return nil, err
+	}
+	_, _, err = s.queueManager.GetQueuePosition(ctx, "sfm_list", sceneID)
+	if errors.Is(err, queue.ErrIDNotFoundInQueue) {
+		if sc.Sfm != nil || sc.Nerf != nil {
+			return nil, scene.ErrTrainingStarted
+		}
+		return nil, ErrJobNotQueued
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sc.Config == nil || sc.Config.NerfTrainingConfig == nil {
+		return nil, scene.ErrTrainingConfigNotFound
+	}
+
+	nerfConfig := *sc.Config.NerfTrainingConfig
+	if len(update.OutputTypes) > 0 {
+		nerfConfig.OutputTypes = update.OutputTypes
+	}
+	if len(update.SaveIterations) > 0 {
+		nerfConfig.SaveIterations = update.SaveIterations
+	}
+	if update.TotalIterations > 0 {
+		nerfConfig.TotalIterations = update.TotalIterations
+	}
+
+	u, err := s.userManager.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if u.Guest && nerfConfig.TotalIterations > s.config.GuestMaxIterations {
+		return nil, ErrGuestQuotaExceeded
+	}
+	if err := validateTrainingConfig(nerfConfig.TrainingMode, nerfConfig.OutputTypes, nerfConfig.SaveIterations, nerfConfig.TotalIterations); err != nil {
+		return nil, err
+	}
+
+	if err := s.sceneManager.SetPendingNerfTrainingConfig(ctx, sceneID, &nerfConfig); err != nil {
+		return nil, err
+	}
+
+	s.logger.Infof("Training config of scene %s updated by user %s", sceneID.Hex(), userID.Hex())
+	sc.Config.NerfTrainingConfig = &nerfConfig
+	return sc.Config, nil
+}
+
+// QueueEstimate describes where a newly submitted scene is in the processing queue, and when processing is expected to start
+type QueueEstimate struct {
+	Position       int       `json:"queue_position"`
+	Size           int       `json:"queue_size"`
+	EstimatedStart time.Time `json:"estimated_start"`
+	Delayed        bool      `json:"delayed"`
+}
+
+// jobDurationSampleSize is the number of recently completed scenes the processing time estimate is averaged over
+const jobDurationSampleSize = 20
+
+// GetQueueEstimate returns the queue position of the scene with the given ID, and an estimate of when processing starts.
+// The estimate assumes the configured number of scenes are processed in parallel, each taking the average processing time
+// of recently completed scenes (or the configured estimate, if none completed yet).
+//
+// Returns error if the scene is not queued or an error occurred.
+func (s *ClientService) GetQueueEstimate(ctx context.Context, sceneID primitive.ObjectID) (*QueueEstimate, error) {
+	position, size, err := s.queueManager.GetQueuePosition(ctx, s.queueManager.GetQueueNames()[0], sceneID)
+	if err != nil {
+		return nil, err
+	}
+
+	rounds := position / s.config.WorkerConcurrency
+	return &QueueEstimate{
+		Position:       position,
+		Size:           size,
+		EstimatedStart: time.Now().UTC().Add(time.Duration(rounds) * s.estimateJobDuration(ctx)).Truncate(time.Second),
+		Delayed:        s.config.QueueSoftLimit > 0 && position >= s.config.QueueSoftLimit,
+	}, nil
+}
+
+// estimateJobDuration averages the time between submission and completion of recently completed scenes.
+// Falls back to the configured estimate if no scene completed yet, or the events can not be read.
+func (s *ClientService) estimateJobDuration(ctx context.Context) time.Duration {
+	completed, err := s.eventManager.GetRecentEvents(ctx, event.TypeJobCompleted, jobDurationSampleSize)
+	if err != nil {
+		s.logger.Warn("Failed to read completed jobs for queue estimate:", err.Error())
+		return s.config.EstimatedJobDuration
+	}
+
+	var total time.Duration
+	var count int
+	for _, e := range completed {
+		// Scene IDs are generated at submission time
+		if d := e.Timestamp.Sub(e.SceneID.Timestamp()); d > 0 {
+			total += d
+			count++
+		}
+	}
+	if count == 0 {
+		return s.config.EstimatedJobDuration
+	}
+	return total / time.Duration(count)
+}
+
+// GetSceneCost returns the resources consumed processing the scene with the given ID, as reported by the workers.
+//
+// Returns error if the scene does not exist, the user does not have access to it, ErrCostNotFound if no stage finished yet, or an error occurred.
+func (s *ClientService) GetSceneCost(ctx context.Context, userID, sceneID primitive.ObjectID) (*scene.ProcessingCost, error) {
+	if err := s.authorizeScene(ctx, userID, sceneID); err != nil {
+		s.logger.Info("Scene access denied:", err.Error())
+		return nil, err
+	}
+
+	cost, err := s.sceneManager.GetCost(ctx, sceneID)
+	if err != nil {
+		s.logger.Info("Error getting scene cost:", err.Error())
+		return nil, err
+	}
+
+	return cost, nil
+}
+
+// GetSceneOutputKey returns the storage key of the output file for the given version of the scene, its current version if
+// version is 0.
+//
+// Returns (string) if successful. Returns ("", error) if the scene does not exist, the user does not have access to it or an error occurred.
+// Returns ErrSceneArchived if the outputs are in cold storage, scene.ErrVersionNotFound if the scene has no such version.
+func (s *ClientService) GetSceneOutputKey(ctx context.Context, userID, sceneID primitive.ObjectID, version int, outputType, iteration string) (string, error) {
 	s.logger.Debug("Get scene output request received")
 
 	// Verify user access to scene
-	if err := s.verifyUserAccess(ctx, userID, sceneID); err != nil {
-		s.logger.Info("Invalid user ID access:", err.Error())
+	if err := s.authorizeScene(ctx, userID, sceneID); err != nil {
+		s.logger.Info("Scene access denied:", err.Error())
 		return "", err
 	}
 
-	nerf, err := s.sceneManager.GetNerf(ctx, sceneID)
+	return s.sceneOutputKey(ctx, sceneID, version, outputType, iteration)
+}
+
+// GetSharedSceneOutputKey returns the storage key of the output file for the given scene, without checking access.
+// Only call it for a share link which was verified, and is scoped to this scene and output type.
+//
+// Returns ("", error) like GetSceneOutputKey, i.e if the scene was deleted since the link was created.
+func (s *ClientService) GetSharedSceneOutputKey(ctx context.Context, sceneID primitive.ObjectID, outputType, iteration string) (string, error) {
+	return s.sceneOutputKey(ctx, sceneID, 0, outputType, iteration)
+}
+
+// sceneOutputKey returns the storage key of the output file of the given version (0 for the current one), type and iteration
+// (-1 or "" for the last one) for the given scene.
+func (s *ClientService) sceneOutputKey(ctx context.Context, sceneID primitive.ObjectID, version int, outputType, iteration string) (string, error) {
+	sc, err := s.sceneManager.GetScene(ctx, sceneID)
 	if err != nil {
 		s.logger.Info("Invalid scene ID:", err.Error())
 		return "", err
 	}
+	if sc.DeletedAt != nil {
+		return "", scene.ErrSceneNotFound
+	}
+	if sc.OutputsDeletedAt != nil {
+		return "", scene.ErrOutputsDeleted
+	}
+	if sc.Nerf == nil {
+		return "", scene.ErrNerfNotFound
+	}
+	if sc.Archive != nil && sc.Archive.Status != scene.ArchiveStatusArchiving {
+		return "", scene.ErrSceneArchived
+	}
+	nerf, err := sc.GetNerfVersion(version)
+	if err != nil {
+		return "", err
+	}
 
 	intIteration := -1
 	if iteration == "" {
@@ -429,7 +1026,7 @@ func (s *ClientService) GetSceneOutputPath(ctx context.Context, userID, sceneID
 		intIteration, err = strconv.Atoi(iteration)
 		if err != nil {
 			s.logger.Info("Invalid iteration:", err.Error())
-			return "", err
+			return "", ErrInvalidIteration
 		}
 	}
 
@@ -442,8 +1039,68 @@ func (s *ClientService) GetSceneOutputPath(ctx context.Context, userID, sceneID
 	return outputPath, nil
 }
 
+// SceneVersion summarizes a training result of a scene
+type SceneVersion struct {
+	Version int `json:"version"`
+	// Current is set on the version served when no version is requested
+	Current         bool       `json:"current"`
+	CompletedAt     *time.Time `json:"completed_at,omitempty"`
+	WorkerVersion   string     `json:"worker_version,omitempty"`
+	OutputTypes     []string   `json:"output_types"`
+	LatestIteration int        `json:"latest_iteration"`
+}
+
+// ListSceneVersions returns the training results of the scene with the given ID, newest first. A scene that was never
+// retrained has a single version.
+//
+// Returns error if the scene does not exist, the user does not have access to it, scene.ErrNerfNotFound if the scene was
+// not trained yet, or an error occurred.
+func (s *ClientService) ListSceneVersions(ctx context.Context, userID, sceneID primitive.ObjectID) ([]SceneVersion, error) {
+	if err := s.authorizeScene(ctx, userID, sceneID); err != nil {
+		s.logger.Info("Scene access denied:", err.Error())
+		return nil, err
+	}
+
+	sc, err := s.sceneManager.GetScene(ctx, sceneID)
+	if err != nil {
+		return nil, err
+	}
+	if sc.DeletedAt != nil {
+		return nil, scene.ErrSceneNotFound
+	}
+	if sc.Nerf == nil {
+		return nil, scene.ErrNerfNotFound
+	}
+
+	current := newSceneVersion(sc.Nerf)
+	current.Current = true
+	current.WorkerVersion = sc.WorkerVersions[scene.StageNerf]
+	versions := []SceneVersion{current}
+	for i := len(sc.NerfVersions) - 1; i >= 0; i-- {
+		versions = append(versions, newSceneVersion(sc.NerfVersions[i]))
+	}
+	return versions, nil
+}
+
+// newSceneVersion summarizes the given training result.
+func newSceneVersion(nerf *scene.Nerf) SceneVersion {
+	version := SceneVersion{
+		Version:         nerf.CurrentVersion(),
+		CompletedAt:     nerf.CompletedAt,
+		WorkerVersion:   nerf.WorkerVersion,
+		OutputTypes:     make([]string, 0),
+		LatestIteration: nerf.LatestIteration(),
+	}
+	for _, outputType := range exportOutputTypes {
+		if paths, _ := nerf.GetFilePathsForType(outputType); len(paths) > 0 {
+			version.OutputTypes = append(version.OutputTypes, outputType)
+		}
+	}
+	return version
+}
+
 // GetSceneProgress returns the progress of the scene processing pipeline for the given scene.
-// Returns (nil, error) if the user does not have access to the scene or an error occurred.
+// Returns (nil, error) if the scene does not exist, the user does not have access to it or an error occurred.
 //
 // This function trusts the ordering of queue names provivded by QueueListManager.
 // The first queue is the overall progress, and the rest are the ordered training stages.
@@ -455,13 +1112,14 @@ func (s *ClientService) GetSceneOutputPath(ctx context.Context, userID, sceneID
 //	    "stage": string,
 //	    "stage_position": int,
 //	    "stage_size": int,
+//	    "poll_after_seconds": int,
 //	}
 func (s *ClientService) GetSceneProgress(ctx context.Context, userID, sceneID primitive.ObjectID) (map[string]interface{}, error) {
 	s.logger.Debug("Get scene progress handler")
 
 	// Verify user access to scene
-	if err := s.verifyUserAccess(ctx, userID, sceneID); err != nil {
-		s.logger.Info("Invalid user ID access:", err.Error())
+	if err := s.authorizeScene(ctx, userID, sceneID); err != nil {
+		s.logger.Info("Scene access denied:", err.Error())
 		return nil, err
 	}
 
@@ -497,7 +1155,7 @@ func (s *ClientService) GetSceneProgress(ctx context.Context, userID, sceneID pr
 		}
 
 		// Training stages (sfm_list, nerf_list)
-		size, position, err := s.queueManager.GetQueuePosition(ctx, queueName, sceneID)
+		position, size, err := s.queueManager.GetQueuePosition(ctx, queueName, sceneID)
 		if err != nil && err != queue.ErrIDNotFoundInQueue {
 			s.logger.Info("Error getting stage queue position:", err.Error())
 			return nil, err
@@ -514,17 +1172,23 @@ func (s *ClientService) GetSceneProgress(ctx context.Context, userID, sceneID pr
 	s.logger.Debugf("Processing: %v, Overall position: %d, Overall size: %d, Stage Idx: %d, Stage position: %d, Stage size: %d", processing, overallPosition, overallSize, stageIdx, stagePosition, stageSize)
 
 	if !processing{
-		return map[string]interface{}{
+		progress := map[string]interface{}{
 			"processing": false,
-		}, nil
+		}
+		// Tell why processing stopped, if a worker reported a failure
+		if sc, err := s.sceneManager.GetScene(ctx, sceneID); err == nil && sc.Error != nil {
+			progress["error"] = sc.Error
+		}
+		return progress, nil
 	}
 
 	return map[string]interface{}{
-		"processing":       processing,
-		"overall_position": overallPosition,
-		"overall_size":     overallSize,
-		"stage":            queueNames[stageIdx],
-		"stage_position":   stagePosition,
-		"stage_size":       stageSize,
+		"processing":         processing,
+		"overall_position":   overallPosition,
+		"overall_size":       overallSize,
+		"stage":              queueNames[stageIdx],
+		"stage_position":     stagePosition,
+		"stage_size":         stageSize,
+		"poll_after_seconds": s.pollAfter(stagePosition, nil),
 	}, nil
 }
@@ -0,0 +1,153 @@
+// This file contains the instrumentation of the AMPQService queue consumers, served by the admin consumer health route.
+//
+// Counters are kept in memory per instance, and reset on restart. Only the instance holding the consumer lease runs consumers,
+// so the consumers of every other instance are reported stopped.
+
+package services
+
+import (
+	"sync"
+	"time"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
+)
+
+// Declarations for valid consumer states
+const (
+	// ConsumerStateStopped means the consumer is not running, i.e this instance does not hold the consumer lease.
+	ConsumerStateStopped = "stopped"
+	// ConsumerStateConnecting means the consumer was started, and is registering with the broker.
+	ConsumerStateConnecting = "connecting"
+	// ConsumerStateConsuming means the consumer is registered, and processes messages as they arrive.
+	ConsumerStateConsuming = "consuming"
+	// ConsumerStateReconnecting means the consumer lost its channel, and retries after a delay. LastError describes why.
+	ConsumerStateReconnecting = "reconnecting"
+)
+
+// consumedQueues returns the queues consumed by the AMPQService, in the order they are reported: the output queues of the
+// pipeline stages, and the heartbeat queue.
+func consumedQueues(cfg *config.Config) []string {
+	return append(outputQueues(cfg), workerHeartbeatQueue)
+}
+
+// ConsumerStatus is the health of a single queue consumer of this instance
+type ConsumerStatus struct {
+	Queue          string     `json:"queue"`
+	State          string     `json:"state"`
+	Processed      int64      `json:"messages_processed"`
+	Failed         int64      `json:"messages_failed"`
+	Retried        int64      `json:"messages_retried"`
+	Duplicates     int64      `json:"messages_duplicate"`
+	DeadLettered   int64      `json:"messages_dead_lettered"`
+	LastError      string     `json:"last_error,omitempty"`
+	LastErrorAt    *time.Time `json:"last_error_at,omitempty"`
+	LastActivityAt *time.Time `json:"last_activity_at,omitempty"`
+}
+
+// ConsumerHealth is the health of the queue consumers of this instance, and of its broker connection
+type ConsumerHealth struct {
+	InstanceID       string           `json:"instance_id"`
+	Broker           string           `json:"broker"`
+	BrokerConnected  bool             `json:"broker_connected"`
+	ConsumerInstance bool             `json:"consumer_instance"`
+	Consumers        []ConsumerStatus `json:"consumers"`
+}
+
+// consumerStats holds the counters of every consumer. It is safe for concurrent use.
+type consumerStats struct {
+	mu        sync.Mutex
+	consumers map[string]*ConsumerStatus
+}
+
+// status returns the status of the consumer of the given queue, creating it stopped. The lock must be held.
+func (cs *consumerStats) status(queueName string) *ConsumerStatus {
+	if cs.consumers == nil {
+		cs.consumers = make(map[string]*ConsumerStatus)
+	}
+	status, ok := cs.consumers[queueName]
+	if !ok {
+		status = &ConsumerStatus{Queue: queueName, State: ConsumerStateStopped}
+		cs.consumers[queueName] = status
+	}
+	return status
+}
+
+// setState records the state of the consumer of the given queue. A non-nil err is recorded as its last error.
+func (cs *consumerStats) setState(queueName, state string, err error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	status := cs.status(queueName)
+	status.State = state
+	if err != nil {
+		now := time.Now().UTC()
+		status.LastError = err.Error()
+		status.LastErrorAt = &now
+	}
+}
+
+// recordMessage counts a message processed by the consumer of the given queue. A non-nil err counts it as failed.
+func (cs *consumerStats) recordMessage(queueName string, err error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	status := cs.status(queueName)
+	now := time.Now().UTC()
+	status.LastActivityAt = &now
+	if err != nil {
+		status.Failed++
+		status.LastError = err.Error()
+		status.LastErrorAt = &now
+		return
+	}
+	status.Processed++
+}
+
+// recordRetry counts a failed message of the given queue scheduled for a retry.
+func (cs *consumerStats) recordRetry(queueName string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.status(queueName).Retried++
+}
+
+// recordDuplicate counts a message of the given queue acknowledged without processing, as it was already processed.
+func (cs *consumerStats) recordDuplicate(queueName string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.status(queueName).Duplicates++
+}
+
+// recordDeadLetter counts a failed message of the given queue that was dead-lettered.
+func (cs *consumerStats) recordDeadLetter(queueName string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.status(queueName).DeadLettered++
+}
+
+// snapshot returns a copy of the status of the consumers of the given queues.
+func (cs *consumerStats) snapshot(queueNames []string) []ConsumerStatus {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	statuses := make([]ConsumerStatus, 0, len(queueNames))
+	for _, queueName := range queueNames {
+		statuses = append(statuses, *cs.status(queueName))
+	}
+	return statuses
+}
+
+// ConsumerHealth returns the health of the queue consumers of this instance, and of its broker connection.
+func (s *AMPQService) ConsumerHealth() ConsumerHealth {
+	consumers := s.consumerStats.snapshot(consumedQueues(s.config))
+	consumerInstance := false
+	for _, consumer := range consumers {
+		if consumer.State != ConsumerStateStopped {
+			consumerInstance = true
+		}
+	}
+
+	return ConsumerHealth{
+		InstanceID:       s.config.InstanceID,
+		Broker:           s.broker.Backend(),
+		BrokerConnected:  s.broker.Connected(),
+		ConsumerInstance: consumerInstance,
+		Consumers:        consumers,
+	}
+}
@@ -0,0 +1,186 @@
+// This file contains the retry policy of the AMPQService queue consumers, and the dead letters served by the admin routes.
+//
+// A worker output message whose processing fails is published to its queue again, delayed by its backoff, with its retry count
+// in the 'retry_count' header (see Broker.PublishDelayed for how each broker delays messages). The backoff starts at
+// WORKER_RETRY_BACKOFF and doubles on every retry, up to an hour.
+//
+// Once WORKER_RETRY_MAX retries failed, or straight away if the message can never be processed (i.e it is rejected by schema
+// validation, with its reason and invalid field recorded, or its scene was deleted), the message is stored as a dead letter in MongoDB instead of the broker, so admins can page through dead
+// letters, and replay or discard them individually. If a message can be neither retried nor dead-lettered (i.e the broker or
+// MongoDB is unreachable), it is requeued, so no worker output is lost.
+
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/broker"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/deadletter"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/pagination"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+)
+
+// errMalformedOutput is wrapped by the errors of worker output that can never be processed, which is dead-lettered without retries
+var errMalformedOutput = errors.New("malformed worker output")
+
+// retryCountHeader is the message header the number of times a worker output message was retried is kept in
+const retryCountHeader = "retry_count"
+
+// maxRetryDelay is the longest a worker output message waits before it is retried
+const maxRetryDelay = time.Hour
+
+// retryCount returns the number of times the given message was retried. Brokers without typed headers deliver it as a string.
+func retryCount(d broker.Delivery) int {
+	switch count := d.Headers[retryCountHeader].(type) {
+	case int32:
+		return int(count)
+	case int64:
+		return int(count)
+	case int:
+		return count
+	case string:
+		if n, err := strconv.Atoi(count); err == nil {
+			return n
+		}
+	}
+	return 0
+}
+
+// retryDelay returns the backoff before the given retry (starting at 0), doubled on every retry up to maxRetryDelay.
+func retryDelay(backoff time.Duration, retry int) time.Duration {
+	delay := backoff
+	for range retry {
+		delay *= 2
+		if delay >= maxRetryDelay {
+			return maxRetryDelay
+		}
+	}
+	return min(delay, maxRetryDelay)
+}
+
+// settleFailure settles a worker output message of the given queue whose processing failed with cause. The message is retried
+// after a backoff, or dead-lettered once its retries are exhausted or it can never be processed, and requeued if neither is possible.
+func (s *AMPQService) settleFailure(queueName string, d broker.Delivery, cause error) {
+	ctx := context.Background()
+	retries := retryCount(d)
+	permanent := errors.Is(cause, errMalformedOutput) || errors.Is(cause, scene.ErrSceneNotFound)
+
+	if !permanent && retries < s.config.WorkerRetryMax {
+		delay := retryDelay(s.config.WorkerRetryBackoff, retries)
+		headers := map[string]interface{}{}
+		for key, value := range d.Headers {
+			headers[key] = value
+		}
+		headers[retryCountHeader] = int32(retries + 1)
+
+		msg := broker.Message{ID: d.ID, ContentType: d.ContentType, Headers: headers, Body: d.Body}
+		err := s.publishWithRetries(ctx, queueName, func(ctx context.Context) error {
+			return s.broker.PublishDelayed(ctx, queueName, msg, delay)
+		})
+		if err != nil {
+			s.logger.Errorf("Failed to schedule the retry of a message from %s, requeueing it: %v", queueName, err)
+			d.Nack(true)
+			return
+		}
+		s.logger.Warnf("Retrying message from %s in %s (retry %d of %d)", queueName, delay, retries+1, s.config.WorkerRetryMax)
+		s.consumerStats.recordRetry(queueName)
+		d.Ack()
+		return
+	}
+
+	dl := deadletter.DeadLetter{
+		Queue:       queueName,
+		Error:       cause.Error(),
+		Attempts:    retries + 1,
+		ContentType: d.ContentType,
+		Headers:     make(map[string]string),
+		Body:        string(d.Body),
+	}
+	var invalid *OutputValidationError
+	if errors.As(cause, &invalid) {
+		dl.Reason, dl.Field = invalid.Reason, invalid.Field
+	}
+	var body struct {
+		SceneID string `json:"id"`
+	}
+	if json.Unmarshal(d.Body, &body) == nil {
+		dl.SceneID = body.SceneID
+	}
+	// The retry count is not kept, so a replayed dead letter is retried again
+	for key, value := range d.Headers {
+		if value, ok := value.(string); ok && key != retryCountHeader {
+			dl.Headers[key] = value
+		}
+	}
+
+	created, err := s.deadLetterManager.CreateDeadLetter(ctx, dl)
+	if err != nil {
+		s.logger.Errorf("Failed to dead-letter a message from %s, requeueing it: %v", queueName, err)
+		d.Nack(true)
+		return
+	}
+	s.logger.Errorf("Dead-lettered message from %s as %s after %d attempts: %v", queueName, created.ID.Hex(), created.Attempts, cause)
+	s.consumerStats.recordDeadLetter(queueName)
+	d.Ack()
+}
+
+// ListDeadLetters returns the given page of dead letters, newest first, and the cursor of the next page.
+func (s *AMPQService) ListDeadLetters(ctx context.Context, page pagination.Page) ([]*deadletter.DeadLetter, string, error) {
+	return s.deadLetterManager.ListDeadLetters(ctx, page)
+}
+
+// GetDeadLetter returns the dead letter with the given ID.
+//
+// Returns deadletter.ErrDeadLetterNotFound if it does not exist.
+func (s *AMPQService) GetDeadLetter(ctx context.Context, id primitive.ObjectID) (*deadletter.DeadLetter, error) {
+	return s.deadLetterManager.GetDeadLetter(ctx, id)
+}
+
+// ReplayDeadLetter republishes the message of a dead letter to the queue it was consumed from, with its retries reset, and
+// removes the dead letter. A message failing again is dead-lettered again, under a new ID.
+//
+// Returns the replayed dead letter, deadletter.ErrDeadLetterNotFound if it does not exist, error if it could not be republished,
+// in which case it is kept.
+func (s *AMPQService) ReplayDeadLetter(ctx context.Context, id primitive.ObjectID) (*deadletter.DeadLetter, error) {
+	dl, err := s.deadLetterManager.TakeDeadLetter(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := map[string]interface{}{}
+	for key, value := range dl.Headers {
+		headers[key] = value
+	}
+	err = s.publish(ctx, dl.Queue, broker.Message{
+		ContentType: dl.ContentType,
+		Headers:     headers,
+		Body:        []byte(dl.Body),
+	})
+	if err != nil {
+		if restoreErr := s.deadLetterManager.RestoreDeadLetter(ctx, dl); restoreErr != nil {
+			s.logger.Errorf("Failed to restore dead letter %s after failing to replay it: %v", id.Hex(), restoreErr)
+		}
+		return nil, fmt.Errorf("failed to republish dead letter: %v", err)
+	}
+
+	s.logger.Infof("Dead letter %s replayed to %s", id.Hex(), dl.Queue)
+	return dl, nil
+}
+
+// DiscardDeadLetter removes a dead letter without replaying it.
+//
+// Returns deadletter.ErrDeadLetterNotFound if it does not exist.
+func (s *AMPQService) DiscardDeadLetter(ctx context.Context, id primitive.ObjectID) error {
+	if _, err := s.deadLetterManager.TakeDeadLetter(ctx, id); err != nil {
+		return err
+	}
+	s.logger.Infof("Dead letter %s discarded", id.Hex())
+	return nil
+}
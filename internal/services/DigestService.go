@@ -0,0 +1,191 @@
+// This file contains the DigestService implementation, which periodically emails users a summary of their recent activity.
+//
+// Every replica runs the scheduler, but the replicas elect a single sender through a lease in MongoDB, like the AMPQ consumers.
+// Each user's last digest time is stored on the user, so a digest is sent at most once per interval even if the sender changes,
+// and users who registered mid-week receive their first digest at the next check instead of waiting for a fixed weekday.
+//
+// Digests summarize the scenes completed during the interval and the storage used by the user's scenes.
+// Gallery activity is not included, as the server has no gallery yet.
+
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/mail"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/event"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/lease"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/user"
+)
+
+// digestLeaseName is the name of the lease held by the instance elected to send digests
+const digestLeaseName = "weekly-digest"
+
+// digestCheckInterval is how often the scheduler looks for users due a digest. It is also the TTL of the digest lease,
+// so a sender that dies mid-run is replaced at the next check.
+const digestCheckInterval = time.Hour
+
+// Digest is the summary of a user's activity sent in a digest email
+type Digest struct {
+	Since           time.Time
+	Until           time.Time
+	ScenesCompleted int64
+	StorageBytes    int64
+}
+
+type DigestService struct {
+	userManager  *user.UserManager
+	eventManager *event.EventManager
+	leaseManager *lease.LeaseManager
+	mailer       mail.Mailer
+	config       *config.Config
+	logger       *log.Logger
+}
+
+// NewDigestService creates a new DigestService. Dependencies are injected via the constructor.
+func NewDigestService(
+	um *user.UserManager,
+	em *event.EventManager,
+	lm *lease.LeaseManager,
+	mailer mail.Mailer,
+	cfg *config.Config,
+	logger *log.Logger,
+) *DigestService {
+	return &DigestService{
+		userManager:  um,
+		eventManager: em,
+		leaseManager: lm,
+		mailer:       mailer,
+		config:       cfg,
+		logger:       logger,
+	}
+}
+
+// Run sends the digests of due users every digestCheckInterval, while this instance holds the digest lease,
+// until the context is cancelled. Returns immediately if digests are disabled.
+func (s *DigestService) Run(ctx context.Context) {
+	if !s.config.DigestEnabled {
+		s.logger.Info("Digest emails disabled")
+		return
+	}
+
+	ticker := time.NewTicker(digestCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		acquired, err := s.leaseManager.TryAcquire(ctx, digestLeaseName, s.config.InstanceID, digestCheckInterval)
+		if err != nil {
+			s.logger.Errorf("Failed to acquire digest lease: %v", err)
+		} else if acquired {
+			s.SendDueDigests(ctx)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SendDueDigests sends a digest to every user that did not receive one during the last interval.
+// Failures are logged per user, and the user is retried at the next check.
+func (s *DigestService) SendDueDigests(ctx context.Context) {
+	now := time.Now().UTC()
+	users, err := s.userManager.ListDigestRecipients(ctx, now.Add(-s.config.DigestInterval))
+	if err != nil {
+		s.logger.Errorf("Failed to list digest recipients: %v", err)
+		return
+	}
+
+	sent := 0
+	for _, u := range users {
+		if ctx.Err() != nil {
+			return
+		}
+
+		ok, err := s.sendDigest(ctx, u, now)
+		if err != nil {
+			s.logger.Warnf("Failed to send digest to user %s: %v", u.ID.Hex(), err)
+			continue
+		}
+		if ok {
+			sent++
+		}
+	}
+	s.logger.Infof("Sent %d digests (%d users due)", sent, len(users))
+}
+
+// sendDigest builds and sends the digest of a single user, then records it as sent.
+// Users without any completed scene during the interval are recorded without being emailed.
+//
+// Returns true if an email was sent.
+func (s *DigestService) sendDigest(ctx context.Context, u *user.User, now time.Time) (bool, error) {
+	digest, err := s.BuildDigest(ctx, u, now)
+	if err != nil {
+		return false, err
+	}
+
+	sent := false
+	if digest.ScenesCompleted > 0 {
+		if err := s.mailer.Send(ctx, u.NotificationEmail(), "Your NeRF-or-Nothing activity digest", formatDigest(u, digest)); err != nil {
+			return false, err
+		}
+		sent = true
+	}
+
+	return sent, s.userManager.SetLastDigestAt(ctx, u.ID, now)
+}
+
+// BuildDigest summarizes the activity of the user during the interval ending at until.
+func (s *DigestService) BuildDigest(ctx context.Context, u *user.User, until time.Time) (*Digest, error) {
+	since := until.Add(-s.config.DigestInterval)
+
+	completed, _, err := s.eventManager.GetSceneTotals(ctx, event.TypeJobCompleted, u.SceneIDs, since)
+	if err != nil {
+		return nil, err
+	}
+	_, storageBytes, err := s.eventManager.GetSceneTotals(ctx, event.TypeArtifactStored, u.SceneIDs, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Digest{
+		Since:           since,
+		Until:           until,
+		ScenesCompleted: completed,
+		StorageBytes:    storageBytes,
+	}, nil
+}
+
+// formatDigest renders the plain text body of a digest, with dates in the user's timezone.
+func formatDigest(u *user.User, d *Digest) string {
+	loc := u.Location()
+	var b strings.Builder
+	fmt.Fprintf(&b, "Hi %s,\n\n", u.Username)
+	fmt.Fprintf(&b, "Here is your summary for %s - %s:\n\n",
+		d.Since.In(loc).Format("Jan 2"), d.Until.In(loc).Format("Jan 2, 2006"))
+	fmt.Fprintf(&b, "  Scenes completed: %d\n", d.ScenesCompleted)
+	fmt.Fprintf(&b, "  Storage used:     %s\n\n", formatBytes(d.StorageBytes))
+	b.WriteString("You can unsubscribe from these emails in your account notification settings.\n")
+	return b.String()
+}
+
+// formatBytes formats a byte count with a binary unit (i.e "1.5 GiB").
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,170 @@
+// This file contains the direct uploads of the UploadService, which spare the server from proxying large videos.
+//
+// Instead of streaming the video through the server, the client asks for a presigned URL, uploads the whole file to object
+// storage with a single PUT request, then references the key of the uploaded object to create the scene. Direct uploads are
+// tracked as upload sessions, so unfinished uploads expire and are removed like resumable ones.
+//
+// The presigned URL uploads to a staging key, and stays valid for at most directUploadURLExpiry: S3 can not revoke it, so the
+// client may replace the staged object as long as it is valid. Presigned URLs can not bound the size of the uploaded object
+// either. Once the upload is referenced, the staged object is therefore copied to the key of the input of the scene, which
+// was never presigned, checking its size and signature as it is copied, and only that copy is validated like any upload
+// (scanning, transcoding, upload policy) and sent to the workers. The staged object is removed once copied.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/upload"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/user"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/storage"
+)
+
+// Custom errors
+var (
+	// ErrDirectUpload is returned when sending chunks to, or completing in chunks, an upload session of a direct upload.
+	ErrDirectUpload = errors.New("upload session is a direct upload")
+)
+
+// directUploadURLExpiry bounds the validity of the presigned URL of a direct upload. An upload started before it expires
+// completes however long it takes.
+const directUploadURLExpiry = time.Hour
+
+// DirectUpload is an upload session whose file is uploaded directly to object storage
+type DirectUpload struct {
+	*upload.UploadSession
+	// URL is the presigned URL the file must be uploaded to, with a single PUT request of the whole file
+	URL string `json:"url"`
+	// URLExpiresAt is when the presigned URL expires, the upload must be started before
+	URLExpiresAt time.Time `json:"url_expires_at"`
+}
+
+// CreateDirectUpload starts a direct upload of a video (or image set) with the given file name and total size, reserving
+// a scene for it.
+//
+// Returns the session and its presigned URL, storage.ErrPresignUnsupported if the storage backend can not presign uploads,
+// and errors like CreateUploadSession otherwise.
+func (s *UploadService) CreateDirectUpload(ctx context.Context, userID primitive.ObjectID, fileName string, size int64) (*DirectUpload, error) {
+	if _, err := s.uploadFormat(fileName); err != nil {
+		return nil, err
+	}
+	u, err := s.userManager.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if size > s.uploadMaxSize(u) {
+		return nil, ErrUploadTooLarge
+	}
+	if err := s.checkUploadAllowed(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	sceneID := primitive.NewObjectID()
+	key := storage.TenantKey(u.Tenant, storage.DirectUploadKey(sceneID.Hex(), uploadExt(fileName)))
+	expiry := min(s.config.UploadSessionTTL, directUploadURLExpiry)
+	urlExpiresAt := time.Now().UTC().Add(expiry)
+	url, err := storage.PresignPut(ctx, s.storage, key, expiry)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := s.uploadSessionManager.CreateDirectSession(ctx, userID, fileName, size, sceneID, key, s.config.UploadSessionTTL)
+	if err != nil {
+		return nil, err
+	}
+	return &DirectUpload{UploadSession: session, URL: url, URLExpiresAt: urlExpiresAt}, nil
+}
+
+// CompleteDirectUpload copies the file of the direct upload staged under the given key to the input of its scene, and
+// validates the copy like ReceiveVideo validates streamed uploads. The session is removed once the file is accepted or rejected, but kept if the file is missing or
+// incomplete, so the client can upload it again.
+//
+// Returns the reserved scene ID, to submit with SubmitScene, ErrUploadSessionNotFound if no direct upload of the user has
+// the given key, ErrFileNotReceived if the file was not uploaded, ErrUploadIncomplete if its size differs from the declared
+// size, and errors like ReceiveVideo otherwise.
+func (s *UploadService) CompleteDirectUpload(ctx context.Context, userID primitive.ObjectID, key string) (primitive.ObjectID, error) {
+	session, err := s.uploadSessionManager.GetSessionByObjectKey(ctx, key)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	if session.UserID != userID {
+		return primitive.NilObjectID, upload.ErrUploadSessionNotFound
+	}
+	u, err := s.userManager.GetUserByID(ctx, userID)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	_, err = s.receiveDirectUpload(ctx, u, session)
+	var rejected *UploadRejectedError
+	switch {
+	case err == nil:
+		if err := s.uploadSessionManager.DeleteSession(ctx, session.ID); err != nil {
+			s.logger.Warnf("Failed to delete upload session %s: %v", session.ID.Hex(), err)
+		}
+		return session.SceneID, nil
+	case errors.As(err, &rejected), errors.Is(err, ErrNotAVideo), errors.Is(err, ErrNotAnImageSet), errors.Is(err, ErrUploadTooLarge),
+		errors.Is(err, ErrUploadFlagged):
+		s.removeUploadSession(ctx, session)
+	}
+	return primitive.NilObjectID, err
+}
+
+// receiveDirectUpload checks the size of the staged file of a direct upload, copies it to the input of the scene checking its
+// size and signature, then accepts the copy like persist. The staged file is removed once copied, rejected copies are
+// removed from storage.
+func (s *UploadService) receiveDirectUpload(ctx context.Context, u *user.User, session *upload.UploadSession) (*scene.Video, error) {
+	info, err := s.storage.Stat(ctx, session.ObjectKey)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		return nil, ErrFileNotReceived
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.Size > s.uploadMaxSize(u) {
+		return nil, ErrUploadTooLarge
+	}
+	if info.Size != session.Size {
+		return nil, fmt.Errorf("%w: received %d of %d bytes", ErrUploadIncomplete, info.Size, session.Size)
+	}
+
+	format, err := s.uploadFormat(session.FileName)
+	if err != nil {
+		return nil, err
+	}
+	object, err := s.storage.Open(ctx, session.ObjectKey)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	// The staged object may be replaced until its URL expires, so the copy is checked again, as a streamed upload
+	key := inputKey(u.Tenant, session.SceneID, 0, uploadExt(session.FileName))
+	release, err := s.acquireUploadSlot()
+	if err != nil {
+		return nil, err
+	}
+	copied := newValidatingReader(object, format, s.uploadMaxSize(u))
+	err = s.storage.Put(ctx, key, copied, -1)
+	release()
+	if err != nil {
+		s.logger.Info("Rejected video upload:", err.Error())
+		s.discardVideo(ctx, u.Tenant, session.SceneID)
+		return nil, err
+	}
+	if copied.read != session.Size {
+		s.discardVideo(ctx, u.Tenant, session.SceneID)
+		return nil, fmt.Errorf("%w: received %d of %d bytes", ErrUploadIncomplete, copied.read, session.Size)
+	}
+	if err := s.storage.Delete(ctx, session.ObjectKey); err != nil {
+		s.logger.Warnf("Failed to delete direct upload %s: %v", session.ObjectKey, err)
+	}
+
+	return s.accept(ctx, u.Tenant, session.SceneID, 0, key, isImageSet(session.FileName), copied.read)
+}
@@ -0,0 +1,34 @@
+// This file contains the helpers used by the services to record usage events.
+//
+// Events feed aggregate statistics only, so recording them is best-effort: a failure is logged, and never fails the request or job.
+
+package services
+
+import (
+	"context"
+	"io"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/event"
+)
+
+// recordEvent records a usage event, logging instead of returning any error.
+func recordEvent(ctx context.Context, em *event.EventManager, logger *log.Logger, eventType string, sceneID primitive.ObjectID, bytes int64) {
+	if err := em.RecordEvent(ctx, eventType, sceneID, bytes); err != nil {
+		logger.Warnf("Failed to record %s event for scene %s: %v", eventType, sceneID.Hex(), err)
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,61 @@
+// This file contains the guest (anonymous trial) sessions of the ClientService.
+//
+// A guest session is backed by an ephemeral guest user, created already scheduled for deletion at the end of the session,
+// so the account deletion removes it with its scene like any other deleted account. Guests only get an access token
+// lasting the session: logging in (issuing a refresh token) would cancel the scheduled deletion.
+//
+// Guests may submit a single scene, of at most GUEST_MAX_ITERATIONS total iterations (enforced by the UploadService), and can not
+// link external accounts.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/user"
+)
+
+// Custom errors
+var (
+	// ErrGuestDisabled is returned when a guest session is requested while guest sessions are disabled.
+	ErrGuestDisabled = errors.New("guest sessions are disabled")
+	// ErrGuestQuotaExceeded is returned when a guest submits a second scene, or a scene with too many iterations.
+	ErrGuestQuotaExceeded = errors.New("guest quota exceeded, register to submit more scenes or more iterations")
+	// ErrGuestRestricted is returned when a guest attempts an action reserved to registered users.
+	ErrGuestRestricted = errors.New("not available to guests, register to continue")
+)
+
+// CreateGuest creates an ephemeral guest user of the given tenant for a trial session, which accepted the given terms of service / privacy
+// policy versions from the given IP. The guest user is removed with its scene once the session expires.
+//
+// Returns the guest user ID and the session expiry if successful, ErrGuestDisabled if guest sessions are disabled,
+// ErrPolicyVersionMismatch if the policy versions are not current, error otherwise.
+func (s *ClientService) CreateGuest(ctx context.Context, tenant, termsVersion, privacyVersion, ip string) (primitive.ObjectID, time.Time, error) {
+	if !s.config.GuestEnabled {
+		return primitive.NilObjectID, time.Time{}, ErrGuestDisabled
+	}
+	if !s.isCurrentPolicyVersion(termsVersion, privacyVersion) {
+		return primitive.NilObjectID, time.Time{}, user.ErrPolicyVersionMismatch
+	}
+
+	expiresAt := time.Now().UTC().Add(s.config.GuestSessionTTL)
+	guest, err := s.userManager.GenerateGuestUser(ctx, tenant, expiresAt)
+	if err != nil {
+		return primitive.NilObjectID, time.Time{}, err
+	}
+	if err := s.userManager.AddPolicyAcceptance(ctx, guest.ID, user.PolicyAcceptance{
+		TermsVersion:   termsVersion,
+		PrivacyVersion: privacyVersion,
+		AcceptedAt:     time.Now().UTC(),
+		IP:             ip,
+	}); err != nil {
+		return primitive.NilObjectID, time.Time{}, err
+	}
+
+	s.logger.Infof("Guest user %s created, expiring at %s", guest.ID.Hex(), expiresAt.Format(time.RFC3339))
+	return guest.ID, expiresAt, nil
+}
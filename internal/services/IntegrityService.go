@@ -0,0 +1,314 @@
+// This file contains the IntegrityService implementation, which verifies that the files referenced by scenes are still stored
+// as they were recorded, i.e after a storage migration or a disk failure.
+//
+// A check walks every scene in ID order, and checks the raw video, the thumbnail, the sfm frames, and the nerf outputs of each
+// scene. A file is flagged missing if it is not in storage. Outputs whose checksum was recorded by a download manifest are also
+// flagged if their size differs, or if their contents no longer match the checksum. Outputs rewritten since their checksum was
+// recorded (i.e by a replay) are only checked to exist, as the manifest checksums them again. Outputs that are archived or were
+// deleted by the retention policy are not checked.
+//
+// The result of each scene is recorded on the scene, and the check counts the scenes and files checked and lists the scenes
+// with issues. Checks are requested by admins or scheduled every INTEGRITY_CHECK_INTERVAL, and only one check runs at a time.
+// Like the replays, every replica runs the scheduler, and the replicas elect a single one through a lease. A check interrupted
+// by the loss of the lease is failed, and can be requested again.
+
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/integrity"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/lease"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/pagination"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/storage"
+)
+
+// Custom errors
+var (
+	// ErrIntegrityCheckActive is returned when an integrity check is requested while another one is pending or running.
+	ErrIntegrityCheckActive = errors.New("an integrity check is already pending or running")
+)
+
+// integrityLeaseName is the name of the lease held by the instance elected to run integrity checks
+const integrityLeaseName = "integrity"
+
+// integrityCheckInterval is how often pending checks are started. It is also the TTL of the integrity lease,
+// which is renewed after every batch of scenes while a check runs.
+const integrityCheckInterval = time.Minute
+
+// integrityBatchSize is the number of scenes read at once by a running check
+const integrityBatchSize = 100
+
+type IntegrityService struct {
+	integrityManager *integrity.IntegrityManager
+	sceneManager     *scene.SceneManager
+	leaseManager     *lease.LeaseManager
+	storage          storage.Storage
+	config           *config.Config
+	logger           *log.Logger
+}
+
+// NewIntegrityService creates a new IntegrityService. Dependencies are injected via the constructor.
+func NewIntegrityService(
+	im *integrity.IntegrityManager,
+	sm *scene.SceneManager,
+	lm *lease.LeaseManager,
+	store storage.Storage,
+	cfg *config.Config,
+	logger *log.Logger,
+) *IntegrityService {
+	return &IntegrityService{
+		integrityManager: im,
+		sceneManager:     sm,
+		leaseManager:     lm,
+		storage:          store,
+		config:           cfg,
+		logger:           logger,
+	}
+}
+
+// CreateCheck requests an integrity check of every scene. The check is started by the scheduler.
+//
+// Returns the created check, ErrIntegrityCheckActive if another check is pending or running.
+func (s *IntegrityService) CreateCheck(ctx context.Context, adminID primitive.ObjectID) (*integrity.IntegrityCheck, error) {
+	active, err := s.integrityManager.HasActiveCheck(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if active {
+		return nil, ErrIntegrityCheckActive
+	}
+
+	check, err := s.integrityManager.CreateCheck(ctx, adminID)
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Infof("Integrity check %s requested by %s", check.ID.Hex(), adminID.Hex())
+	return check, nil
+}
+
+// GetCheck returns the given integrity check, with its progress.
+//
+// Returns integrity.ErrCheckNotFound if the check does not exist.
+func (s *IntegrityService) GetCheck(ctx context.Context, checkID primitive.ObjectID) (*integrity.IntegrityCheck, error) {
+	return s.integrityManager.GetCheck(ctx, checkID)
+}
+
+// ListChecks returns the given page of integrity checks, newest first, and the cursor of the next page.
+func (s *IntegrityService) ListChecks(ctx context.Context, page pagination.Page) ([]*integrity.IntegrityCheck, string, error) {
+	return s.integrityManager.ListChecks(ctx, page)
+}
+
+// Run starts the pending checks every integrityCheckInterval, while this instance holds the integrity lease, until the context
+// is cancelled. A check is scheduled once INTEGRITY_CHECK_INTERVAL elapsed since the last one was requested.
+func (s *IntegrityService) Run(ctx context.Context) {
+	ticker := time.NewTicker(integrityCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		acquired, err := s.leaseManager.TryAcquire(ctx, integrityLeaseName, s.config.InstanceID, integrityCheckInterval)
+		if err != nil {
+			s.logger.Errorf("Failed to acquire integrity lease: %v", err)
+		} else if acquired {
+			s.advance(ctx)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// advance fails the checks whose instance stopped, schedules a check if one is due, and runs the oldest pending check.
+func (s *IntegrityService) advance(ctx context.Context) {
+	// Running checks record their progress after every batch, well within a few lease periods
+	if err := s.integrityManager.FailStaleChecks(ctx, time.Now().Add(-3*integrityCheckInterval)); err != nil {
+		s.logger.Warnf("Failed to fail stale integrity checks: %v", err)
+	}
+	if err := s.scheduleCheck(ctx); err != nil {
+		s.logger.Warnf("Failed to schedule integrity check: %v", err)
+	}
+
+	check, err := s.integrityManager.StartNextCheck(ctx)
+	if err != nil {
+		s.logger.Errorf("Failed to start integrity check: %v", err)
+		return
+	}
+	if check == nil {
+		return
+	}
+
+	s.logger.Infof("Integrity check %s started", check.ID.Hex())
+	reason := s.runCheck(ctx, check)
+	if err := s.integrityManager.FinishCheck(ctx, check, reason); err != nil {
+		s.logger.Errorf("Failed to finish integrity check %s: %v", check.ID.Hex(), err)
+		return
+	}
+	if reason != "" {
+		s.logger.Warnf("Integrity check %s failed: %s", check.ID.Hex(), reason)
+		return
+	}
+	s.logger.Infof("Integrity check %s completed: %d scenes, %d files checked, %d scenes with %d issues",
+		check.ID.Hex(), check.ScenesChecked, check.FilesChecked, check.ScenesWithIssues, check.Issues)
+}
+
+// scheduleCheck creates a check if INTEGRITY_CHECK_INTERVAL elapsed since the last check was requested.
+func (s *IntegrityService) scheduleCheck(ctx context.Context) error {
+	if s.config.IntegrityCheckInterval == 0 {
+		return nil
+	}
+	latest, err := s.integrityManager.GetLatestCheck(ctx)
+	if err != nil {
+		return err
+	}
+	if latest != nil && time.Since(latest.CreatedAt) < s.config.IntegrityCheckInterval {
+		return nil
+	}
+	check, err := s.integrityManager.CreateCheck(ctx, primitive.NilObjectID)
+	if err != nil {
+		return err
+	}
+	s.logger.Infof("Integrity check %s scheduled", check.ID.Hex())
+	return nil
+}
+
+// runCheck checks every scene, recording the progress of the check after every batch of scenes.
+//
+// Returns the reason the check failed, empty if every scene was checked.
+func (s *IntegrityService) runCheck(ctx context.Context, check *integrity.IntegrityCheck) string {
+	for {
+		scenes, err := s.sceneManager.ListScenesAfter(ctx, check.LastSceneID, integrityBatchSize)
+		if err != nil {
+			return fmt.Sprintf("failed to list scenes: %v", err)
+		}
+		if len(scenes) == 0 {
+			return ""
+		}
+
+		for _, sc := range scenes {
+			issues, files := s.checkScene(ctx, sc)
+			if err := s.sceneManager.SetIntegrity(ctx, sc.ID, &scene.Integrity{CheckedAt: time.Now().UTC(), Issues: issues}); err != nil &&
+				!errors.Is(err, scene.ErrSceneNotFound) {
+				s.logger.Warnf("Failed to record the integrity of scene %s: %v", sc.ID.Hex(), err)
+			}
+
+			check.LastSceneID = sc.ID
+			check.ScenesChecked++
+			check.FilesChecked += files
+			if len(issues) > 0 {
+				check.ScenesWithIssues++
+				check.Issues += len(issues)
+				if len(check.IssueScenes) < integrity.MaxReportedScenes {
+					check.IssueScenes = append(check.IssueScenes, sc.ID)
+				}
+			}
+		}
+
+		if err := s.integrityManager.UpdateProgress(ctx, check); err != nil {
+			s.logger.Warnf("Failed to record the progress of integrity check %s: %v", check.ID.Hex(), err)
+		}
+		// Another instance may have taken over, i.e if this one was paused, and would run the next check concurrently
+		acquired, err := s.leaseManager.TryAcquire(ctx, integrityLeaseName, s.config.InstanceID, integrityCheckInterval)
+		if err != nil {
+			return fmt.Sprintf("failed to renew the integrity lease: %v", err)
+		}
+		if !acquired {
+			return "integrity lease lost"
+		}
+	}
+}
+
+// checkScene checks the stored files of the given scene.
+//
+// Returns the issues found, and the number of files checked.
+func (s *IntegrityService) checkScene(ctx context.Context, sc *scene.Scene) ([]scene.IntegrityIssue, int) {
+	var keys []string
+	if !sc.Synthetic {
+		keys = append(keys, sc.VideoKeys()...)
+	}
+	if sc.Thumbnail != "" {
+		keys = append(keys, sc.Thumbnail)
+	}
+	if sc.Sfm != nil {
+		for _, frame := range sc.Sfm.Frames {
+			keys = append(keys, frame.FilePath)
+		}
+	}
+	if sc.Nerf != nil && sc.Archive == nil && sc.OutputsDeletedAt == nil {
+		keys = append(keys, sc.OutputKeys()...)
+	}
+
+	checksums := make(map[string]scene.Checksum, len(sc.Checksums))
+	for _, checksum := range sc.Checksums {
+		checksums[checksum.Key] = checksum
+	}
+
+	issues := make([]scene.IntegrityIssue, 0)
+	for _, key := range keys {
+		if issue := s.checkFile(ctx, key, checksums); issue != nil {
+			issues = append(issues, *issue)
+		}
+	}
+	return issues, len(keys)
+}
+
+// checkFile checks the file stored under key against its recorded checksum, if any.
+//
+// Returns the issue found, nil if the file is intact.
+func (s *IntegrityService) checkFile(ctx context.Context, key string, checksums map[string]scene.Checksum) *scene.IntegrityIssue {
+	cleaned, err := storage.CleanKey(key)
+	if err != nil {
+		return &scene.IntegrityIssue{Key: key, Problem: scene.IntegrityUnreadable, Detail: err.Error()}
+	}
+	info, err := s.storage.Stat(ctx, cleaned)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		return &scene.IntegrityIssue{Key: cleaned, Problem: scene.IntegrityMissing}
+	}
+	if err != nil {
+		return &scene.IntegrityIssue{Key: cleaned, Problem: scene.IntegrityUnreadable, Detail: err.Error()}
+	}
+
+	checksum, ok := checksums[cleaned]
+	// Stored times only keep milliseconds
+	if !ok || !checksum.ModTime.Equal(info.ModTime.Truncate(time.Millisecond)) {
+		return nil
+	}
+	if checksum.Size != info.Size {
+		return &scene.IntegrityIssue{
+			Key:     cleaned,
+			Problem: scene.IntegritySizeMismatch,
+			Detail:  fmt.Sprintf("recorded %d bytes, stored %d bytes", checksum.Size, info.Size),
+		}
+	}
+
+	object, err := s.storage.Open(ctx, cleaned)
+	if err != nil {
+		return &scene.IntegrityIssue{Key: cleaned, Problem: scene.IntegrityUnreadable, Detail: err.Error()}
+	}
+	defer object.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, object); err != nil {
+		return &scene.IntegrityIssue{Key: cleaned, Problem: scene.IntegrityUnreadable, Detail: err.Error()}
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != checksum.SHA256 {
+		return &scene.IntegrityIssue{
+			Key:     cleaned,
+			Problem: scene.IntegrityChecksumMismatch,
+			Detail:  fmt.Sprintf("recorded sha256 %s, stored %s", checksum.SHA256, sum),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+// This file contains the JobPublisher interface, through which services start and cancel the processing of scenes.
+//
+// Services depend on the interface instead of the AMPQService, so they can be tested with fakes, and another broker can
+// be used by implementing it.
+
+package services
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+)
+
+// JobPublisher is implemented by the services handing scenes to the workers, i.e the AMPQService.
+type JobPublisher interface {
+	// PublishSFMJob starts the processing pipeline of the scene with its first stage, structure from motion by default.
+	// Returns ErrJobAlreadyQueued if the scene is already being processed.
+	PublishSFMJob(ctx context.Context, scene *scene.Scene) error
+	// PublishNERFJob starts the training stage of a scene whose structure from motion stage completed.
+	// Returns ErrJobAlreadyQueued if the scene is already queued for training.
+	PublishNERFJob(ctx context.Context, scene *scene.Scene) error
+	// PublishTrainingJob starts the processing pipeline of a scene whose structure from motion result is already available
+	// (i.e a clone) with its training stage. Returns ErrJobAlreadyQueued if the scene is already being processed.
+	PublishTrainingJob(ctx context.Context, scene *scene.Scene) error
+	// CancelJob stops the processing of the scene, discarding the results of the stage being processed, and tells the
+	// workers to stop processing it.
+	// Returns ErrJobNotQueued if the scene is not being processed.
+	CancelJob(ctx context.Context, sceneID primitive.ObjectID) error
+}
@@ -0,0 +1,159 @@
+// This file contains the NotificationService implementation, which notifies users of their scenes advancing in the processing queue.
+//
+// Users otherwise poll the progress of their scenes to know when training is about to start. Instead, the service periodically
+// compares the positions of the scenes in 'queue_list' with their position at their last notification, and records a notification
+// in the notification center when a scene advanced within the first QUEUE_NOTIFY_TOP positions, or by QUEUE_NOTIFY_STEP positions
+// elsewhere. Clients list or stream the notifications of their user through the web server.
+//
+// Like the digests, every replica runs the scheduler but only the replica holding the notification lease checks the queue.
+// The last notified positions are kept in memory: a new lease holder starts from the current positions, so advances that happened
+// while the lease changed hands are notified at the next threshold instead of twice.
+
+package services
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/lease"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/notification"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/queue"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/user"
+)
+
+// notificationLeaseName is the name of the lease held by the instance elected to check queue positions
+const notificationLeaseName = "queue-notifications"
+
+type NotificationService struct {
+	notificationManager *notification.NotificationManager
+	queueManager        *queue.QueueListManager
+	userManager         *user.UserManager
+	leaseManager        *lease.LeaseManager
+	config              *config.Config
+	logger              *log.Logger
+
+	// positions maps the scenes of the queue to their position at their last notification, or when they were first seen.
+	// Only used by Run.
+	positions map[primitive.ObjectID]int
+}
+
+// NewNotificationService creates a new NotificationService. Dependencies are injected via the constructor.
+func NewNotificationService(
+	nm *notification.NotificationManager,
+	qlm *queue.QueueListManager,
+	um *user.UserManager,
+	lm *lease.LeaseManager,
+	cfg *config.Config,
+	logger *log.Logger,
+) *NotificationService {
+	return &NotificationService{
+		notificationManager: nm,
+		queueManager:        qlm,
+		userManager:         um,
+		leaseManager:        lm,
+		config:              cfg,
+		logger:              logger,
+		positions:           make(map[primitive.ObjectID]int),
+	}
+}
+
+// Run checks the queue positions every QUEUE_NOTIFY_INTERVAL, while this instance holds the notification lease,
+// until the context is cancelled. Returns immediately if queue notifications are disabled.
+func (s *NotificationService) Run(ctx context.Context) {
+	if s.config.QueueNotifyTop == 0 && s.config.QueueNotifyStep == 0 {
+		s.logger.Info("Queue notifications disabled")
+		return
+	}
+
+	interval := s.config.QueueNotifyInterval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		// The lease outlives a few missed checks, so a slow check does not hand it over
+		acquired, err := s.leaseManager.TryAcquire(ctx, notificationLeaseName, s.config.InstanceID, 3*interval)
+		if err != nil {
+			s.logger.Errorf("Failed to acquire queue notification lease: %v", err)
+		} else if acquired {
+			s.CheckQueuePositions(ctx)
+		} else {
+			// Another instance notifies, its positions are unknown here
+			clear(s.positions)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckQueuePositions notifies the owners of the scenes that advanced far enough in 'queue_list' since their last notification.
+// Scenes seen for the first time are only recorded, as their submission already reported their position.
+func (s *NotificationService) CheckQueuePositions(ctx context.Context) {
+	items, err := s.queueManager.GetQueueItems(ctx, "queue_list")
+	if err != nil {
+		s.logger.Errorf("Failed to get queue_list for notifications: %v", err)
+		return
+	}
+
+	queued := make(map[primitive.ObjectID]bool, len(items))
+	for position, sceneID := range items {
+		queued[sceneID] = true
+		last, seen := s.positions[sceneID]
+		if !seen || position >= last {
+			if !seen {
+				s.positions[sceneID] = position
+			}
+			continue
+		}
+		if !s.shouldNotify(last, position) {
+			continue
+		}
+
+		if err := s.notifyPosition(ctx, sceneID, position, len(items)); err != nil {
+			s.logger.Warnf("Failed to notify queue position of scene %s: %v", sceneID.Hex(), err)
+			continue
+		}
+		s.positions[sceneID] = position
+	}
+
+	// Scenes that left the queue are forgotten
+	for sceneID := range s.positions {
+		if !queued[sceneID] {
+			delete(s.positions, sceneID)
+		}
+	}
+}
+
+// shouldNotify returns whether a scene that advanced from position last to position deserves a notification.
+func (s *NotificationService) shouldNotify(last, position int) bool {
+	top, step := s.config.QueueNotifyTop, s.config.QueueNotifyStep
+	return position < top || (step > 0 && last-position >= step)
+}
+
+// notifyPosition records a queue position notification for the owner of the given scene.
+func (s *NotificationService) notifyPosition(ctx context.Context, sceneID primitive.ObjectID, position, size int) error {
+	userID, err := s.userManager.GetSceneOwnerID(ctx, sceneID)
+	if err != nil {
+		return err
+	}
+	return s.notificationManager.CreateNotification(ctx, &notification.Notification{
+		UserID:    userID,
+		Type:      notification.TypeQueuePosition,
+		SceneID:   sceneID,
+		Position:  position,
+		QueueSize: size,
+	})
+}
+
+// ListNotifications returns at most limit notifications of the given user, created after the notification with the given ID
+// (NilObjectID for the oldest kept one), oldest first.
+func (s *NotificationService) ListNotifications(ctx context.Context, userID, after primitive.ObjectID, limit int64) ([]notification.Notification, error) {
+	return s.notificationManager.ListNotifications(ctx, userID, after, limit)
+}
@@ -0,0 +1,162 @@
+// This file contains the schema validation of the worker output consumed by the AMPQService.
+//
+// Worker output is validated before anything is downloaded or written: required fields must be set, matrices must have the
+// expected dimensions and finite values, artifact URLs must be absolute http(s) URLs on the WORKER_ALLOWED_HOSTS, and nerf
+// outputs must be of the output types and iterations the scene was configured with, within its total iterations.
+// Output that does not match is rejected with an OutputValidationError, naming the invalid field and why it was rejected,
+// and is dead-lettered without retries, as it would be rejected on every attempt (see DeadLetters.go).
+//
+// Synthetic scenes have fabricated output without artifacts, so their output may have no frames or output files.
+
+package services
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"slices"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+)
+
+// Declarations for the reasons worker output is rejected for
+const (
+	RejectionInvalidJSON         = "invalid_json"
+	RejectionMissingField        = "missing_field"
+	RejectionInvalidValue        = "invalid_value"
+	RejectionInvalidMatrix       = "invalid_matrix"
+	RejectionInvalidURL          = "invalid_url"
+	RejectionURLNotAllowed       = "url_not_allowed"
+	RejectionUnwantedOutput      = "unwanted_output_type"
+	RejectionIterationOutOfRange = "iteration_out_of_range"
+)
+
+// OutputValidationError is returned when worker output does not match the schema of its stage. It wraps errMalformedOutput.
+type OutputValidationError struct {
+	Stage string
+	// Field is the path of the invalid field in the message, i.e "sfm.frames[2].extrinsic_matrix", empty for the whole message
+	Field string
+	// Reason is one of the Rejection* declarations
+	Reason string
+	Detail string
+}
+
+func (e *OutputValidationError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("%v: %s output rejected (%s): %s", errMalformedOutput, e.Stage, e.Reason, e.Detail)
+	}
+	return fmt.Sprintf("%v: %s output rejected at %s (%s): %s", errMalformedOutput, e.Stage, e.Field, e.Reason, e.Detail)
+}
+
+func (e *OutputValidationError) Unwrap() error {
+	return errMalformedOutput
+}
+
+// rejectOutput returns the OutputValidationError of a field of the output of the given stage.
+func rejectOutput(stage, field, reason, format string, args ...interface{}) *OutputValidationError {
+	return &OutputValidationError{Stage: stage, Field: field, Reason: reason, Detail: fmt.Sprintf(format, args...)}
+}
+
+// checkMatrix checks that the matrix of the given field has the given dimensions and finite values.
+func checkMatrix(stage, field string, m [][]float64, rows, cols int) error {
+	if len(m) == 0 {
+		return rejectOutput(stage, field, RejectionMissingField, "matrix is required")
+	}
+	if len(m) != rows {
+		return rejectOutput(stage, field, RejectionInvalidMatrix, "expected %dx%d matrix, got %d rows", rows, cols, len(m))
+	}
+	for i, row := range m {
+		if len(row) != cols {
+			return rejectOutput(stage, field, RejectionInvalidMatrix, "expected %dx%d matrix, row %d has %d columns", rows, cols, i, len(row))
+		}
+		for _, v := range row {
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				return rejectOutput(stage, field, RejectionInvalidMatrix, "row %d has a non-finite value", i)
+			}
+		}
+	}
+	return nil
+}
+
+// checkOutputURL checks that the artifact URL of the given field is an absolute http(s) URL on an allowed worker host.
+func (s *AMPQService) checkOutputURL(stage, field, rawURL string) error {
+	if rawURL == "" {
+		return rejectOutput(stage, field, RejectionMissingField, "URL is required")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return rejectOutput(stage, field, RejectionInvalidURL, "expected an absolute URL, got %q", rawURL)
+	}
+	if err := s.checkArtifactURL(u); err != nil {
+		if errors.Is(err, ErrWorkerHostNotAllowed) {
+			return rejectOutput(stage, field, RejectionURLNotAllowed, "%v", err)
+		}
+		return rejectOutput(stage, field, RejectionInvalidURL, "%v", err)
+	}
+	return nil
+}
+
+// validateSFMOutput validates the output of the sfm worker for the given scene. Output reporting a failure (flag not 0)
+// may omit the video dimensions and the structure from motion result, but the frames it lists are still validated.
+func (s *AMPQService) validateSFMOutput(sc *scene.Scene, vidWidth, vidHeight int, sfm *scene.Sfm, flag int) error {
+	stage := scene.StageSfm
+	if flag == 0 {
+		if vidWidth <= 0 || vidHeight <= 0 {
+			return rejectOutput(stage, "vid_width", RejectionInvalidValue, "video dimensions must be positive, got %dx%d", vidWidth, vidHeight)
+		}
+		if err := checkMatrix(stage, "sfm.intrinsic_matrix", sfm.IntrinsicMatrix, 3, 3); err != nil {
+			return err
+		}
+		if len(sfm.Frames) == 0 && !sc.Synthetic {
+			return rejectOutput(stage, "sfm.frames", RejectionMissingField, "at least one frame is required")
+		}
+	}
+
+	for i, frame := range sfm.Frames {
+		field := fmt.Sprintf("sfm.frames[%d]", i)
+		if err := s.checkOutputURL(stage, field+".file_path", frame.FilePath); err != nil {
+			return err
+		}
+		if err := checkMatrix(stage, field+".extrinsic_matrix", frame.ExtrinsicMatrix, 4, 4); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateNERFOutput validates the output of the nerf worker for the given scene: only the output types and save iterations
+// of the scene config may be reported, and iterations must be within its total iterations.
+func (s *AMPQService) validateNERFOutput(sc *scene.Scene, filePaths map[string]map[int]string) error {
+	stage := scene.StageNerf
+	if sc.Config == nil || sc.Config.NerfTrainingConfig == nil {
+		return fmt.Errorf("scene %s has no nerf training config", sc.ID.Hex())
+	}
+	if len(filePaths) == 0 && !sc.Synthetic {
+		return rejectOutput(stage, "file_paths", RejectionMissingField, "at least one output is required")
+	}
+
+	config := sc.Config.NerfTrainingConfig
+	for outputType, iterationURLs := range filePaths {
+		field := "file_paths." + outputType
+		if !slices.Contains(config.OutputTypes, outputType) {
+			return rejectOutput(stage, field, RejectionUnwantedOutput, "output type unwanted by config: %s", outputType)
+		}
+		if len(iterationURLs) == 0 {
+			return rejectOutput(stage, field, RejectionMissingField, "at least one iteration is required")
+		}
+		for iteration, rawURL := range iterationURLs {
+			iterationField := fmt.Sprintf("%s.%d", field, iteration)
+			if iteration < 1 || iteration > config.TotalIterations {
+				return rejectOutput(stage, iterationField, RejectionIterationOutOfRange, "iteration must be between 1 and %d", config.TotalIterations)
+			}
+			if !slices.Contains(config.SaveIterations, iteration) {
+				return rejectOutput(stage, iterationField, RejectionIterationOutOfRange, "iteration unwanted by config: %d", iteration)
+			}
+			if err := s.checkOutputURL(stage, iterationField, rawURL); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
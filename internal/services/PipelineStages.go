@@ -0,0 +1,378 @@
+// This file contains the stages of the processing pipeline run by the AMPQService, configured with PIPELINE_STAGES.
+//
+// Every stage is run by its own workers: its jobs are published to the '<stage>-in' queue, workers publish their output to
+// the '<stage>-out' queue, and the scenes queued for the stage are kept in the '<stage>_list' queue list. The consumer
+// plumbing is the same for every stage: the output of a stage is retried, dead-lettered, discarded for cancelled scenes and
+// advanced to the next stage (or completes the pipeline) by the AMPQService, while a StageDefinition only builds the job of
+// a scene and processes the output of its workers.
+//
+// Adding a stage (i.e mesh extraction, upscaling) only requires registering its definition in stageDefinitions, and adding it
+// to PIPELINE_STAGES. The built-in stages are sfm and nerf, which every pipeline includes, in this order.
+
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/broker"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/event"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/processedoutput"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/queue"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+)
+
+// StageJob is a job built by a stage for the workers
+type StageJob struct {
+	Body []byte
+	// Queue overrides the input queue of the stage, i.e to route the job to a canary worker build
+	Queue string
+}
+
+// StageResult is the result of processing the worker output of a stage, notified to the callbacks of the scene once it
+// moved on to the next stage
+type StageResult struct {
+	// Event is the callback event of the stage, if any. The last stage always notifies CallbackEventCompleted
+	Event string
+	// FailureReason is set if the workers reported a failure, which is notified as CallbackEventFailed and ends the pipeline
+	FailureReason string
+}
+
+// StageDefinition is a stage of the processing pipeline: its queues, and how its jobs are built and its output processed.
+type StageDefinition struct {
+	Name string
+	// InputQueue is the queue jobs are published to, OutputQueue the queue workers publish their output to
+	InputQueue  string
+	OutputQueue string
+	// ListName is the queue list holding the scenes queued for, or being processed by, the stage
+	ListName string
+	// BuildJob returns the job of the given scene. It is called once the scene is inserted into ListName, which the scene
+	// is removed from if an error is returned.
+	BuildJob func(ctx context.Context, sc *scene.Scene) (*StageJob, error)
+	// ProcessOutput processes a worker output message of the given scene, which is not cancelled, and updates sc with
+	// the result, which the next stage is built from.
+	//
+	// Returns the result of the stage, nil if the output was discarded and the scene does not move on, error if the
+	// message must be retried, or dead-lettered if the error wraps errMalformedOutput.
+	ProcessOutput func(ctx context.Context, sc *scene.Scene, d broker.Delivery) (*StageResult, error)
+	// SyntheticOutput returns the fields of the worker output fabricated for synthetic scenes, besides their ID. Optional.
+	SyntheticOutput func() map[string]interface{}
+}
+
+// stageDefinitions are the stages PIPELINE_STAGES can list, by name
+var stageDefinitions = map[string]func(s *AMPQService) *StageDefinition{
+	scene.StageSfm: func(s *AMPQService) *StageDefinition {
+		return &StageDefinition{BuildJob: s.buildSFMJob, ProcessOutput: s.processSFMOutput, SyntheticOutput: syntheticSFMOutput}
+	},
+	scene.StageNerf: func(s *AMPQService) *StageDefinition {
+		return &StageDefinition{BuildJob: s.buildNERFJob, ProcessOutput: s.processNERFOutput, SyntheticOutput: syntheticNERFOutput}
+	},
+}
+
+// stageInputQueue returns the queue the jobs of the given stage are published to.
+func stageInputQueue(stage string) string {
+	return stage + "-in"
+}
+
+// stageOutputQueue returns the queue the workers of the given stage publish their output to.
+func stageOutputQueue(stage string) string {
+	return stage + "-out"
+}
+
+// stageListName returns the queue list of the scenes queued for the given stage.
+func stageListName(stage string) string {
+	return stage + "_list"
+}
+
+// jobQueues returns the queues jobs are published to for the workers, declared as priority queues if configured.
+func jobQueues(cfg *config.Config) []string {
+	queues := make([]string, 0, len(cfg.PipelineStages)+1)
+	for _, stage := range cfg.PipelineStages {
+		queues = append(queues, stageInputQueue(stage))
+	}
+	if cfg.CanaryPercent > 0 && slices.Contains(cfg.PipelineStages, scene.StageNerf) {
+		queues = append(queues, nerfCanaryQueue)
+	}
+	return queues
+}
+
+// outputQueues returns the queues the workers of every stage publish their output to.
+func outputQueues(cfg *config.Config) []string {
+	queues := make([]string, 0, len(cfg.PipelineStages))
+	for _, stage := range cfg.PipelineStages {
+		queues = append(queues, stageOutputQueue(stage))
+	}
+	return queues
+}
+
+// newPipeline returns the definitions of the stages of PIPELINE_STAGES, in order, and registers their queue lists.
+//
+// Returns an error if a stage has no definition, or the pipeline does not include the sfm and nerf stages, in this order.
+func (s *AMPQService) newPipeline() ([]*StageDefinition, error) {
+	sfm := slices.Index(s.config.PipelineStages, scene.StageSfm)
+	nerf := slices.Index(s.config.PipelineStages, scene.StageNerf)
+	if sfm < 0 || nerf < sfm {
+		return nil, fmt.Errorf("pipeline stages must include the %q and %q stages, in this order", scene.StageSfm, scene.StageNerf)
+	}
+
+	pipeline := make([]*StageDefinition, 0, len(s.config.PipelineStages))
+	for _, name := range s.config.PipelineStages {
+		newStage, ok := stageDefinitions[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown pipeline stage %q", name)
+		}
+
+		stage := newStage(s)
+		stage.Name = name
+		stage.InputQueue = stageInputQueue(name)
+		stage.OutputQueue = stageOutputQueue(name)
+		stage.ListName = stageListName(name)
+		s.queueManager.RegisterQueue(stage.ListName)
+		pipeline = append(pipeline, stage)
+	}
+	return pipeline, nil
+}
+
+// stage returns the stage of the pipeline with the given name, nil if the pipeline has no such stage.
+func (s *AMPQService) stage(name string) *StageDefinition {
+	for _, stage := range s.pipeline {
+		if stage.Name == name {
+			return stage
+		}
+	}
+	return nil
+}
+
+// nextStage returns the stage following the given one, nil if it is the last stage of the pipeline.
+func (s *AMPQService) nextStage(stage *StageDefinition) *StageDefinition {
+	i := slices.Index(s.pipeline, stage)
+	if i < 0 || i == len(s.pipeline)-1 {
+		return nil
+	}
+	return s.pipeline[i+1]
+}
+
+// startPipeline starts the processing of a scene with the given stage. The scene ID is inserted into 'queue_list' by priority
+// before the job is published, which claims it atomically: a scene stays in 'queue_list' until its pipeline finished, so it
+// can never be processed twice concurrently. The claim is released if publishing fails.
+//
+// Returns ErrJobAlreadyQueued if the scene is already in the pipeline, an error if the job could not be published.
+func (s *AMPQService) startPipeline(ctx context.Context, stage *StageDefinition, sc *scene.Scene) error {
+	err := s.queueManager.InsertWithPriority(ctx, "queue_list", sc.ID, sc.Config.JobPriority())
+	if errors.Is(err, queue.ErrIDAlreadyInQueue) {
+		s.logger.Warnf("%s job for scene %s not published, the scene is already being processed", stage.Name, sc.ID.Hex())
+		return ErrJobAlreadyQueued
+	}
+	if err != nil {
+		return fmt.Errorf("failed to append to queue_list: %v", err)
+	}
+
+	// A lost worker result may have left the scene in the list of the stage, the claim guarantees it is stale
+	s.releaseQueues(ctx, sc.ID, stage.ListName)
+	if err := s.publishStageJob(ctx, stage, sc); err != nil {
+		s.releaseQueues(ctx, sc.ID, "queue_list")
+		return err
+	}
+	return nil
+}
+
+// publishStageJob publishes the job of a scene for the given stage, with the priority of the scene.
+// The scene ID is inserted into the list of the stage by priority before publishing, so a scene is never queued twice for a
+// stage, and removed from it if publishing fails. Synthetic scenes skip the workers, the server fabricates their output.
+//
+// Returns ErrJobAlreadyQueued if the scene is already queued for the stage, an error if the job could not be published.
+func (s *AMPQService) publishStageJob(ctx context.Context, stage *StageDefinition, sc *scene.Scene) error {
+	err := s.queueManager.InsertWithPriority(ctx, stage.ListName, sc.ID, sc.Config.JobPriority())
+	if errors.Is(err, queue.ErrIDAlreadyInQueue) {
+		s.logger.Warnf("%s job for scene %s not published, the scene is already queued for the stage", stage.Name, sc.ID.Hex())
+		return ErrJobAlreadyQueued
+	}
+	if err != nil {
+		return fmt.Errorf("failed to append to %s: %v", stage.ListName, err)
+	}
+
+	if err := s.publishJob(ctx, stage, sc); err != nil {
+		s.releaseQueues(ctx, sc.ID, stage.ListName)
+		return err
+	}
+	return nil
+}
+
+// publishJob builds and publishes the job of a scene queued for the given stage, with the priority of the scene, or
+// fabricates its output if the scene is synthetic.
+func (s *AMPQService) publishJob(ctx context.Context, stage *StageDefinition, sc *scene.Scene) error {
+	// The output of a rerun (replay, retrain, timeout) may be identical to the output of the previous job
+	if err := s.processedOutputManager.ForgetScene(ctx, stage.OutputQueue, sc.ID); err != nil {
+		return fmt.Errorf("failed to forget processed %s outputs: %v", stage.Name, err)
+	}
+
+	if sc.Synthetic {
+		s.publishSyntheticResult(sc.ID, stage)
+		s.logger.Infof("Synthetic %s job started with ID %s", stage.Name, sc.ID.Hex())
+		return nil
+	}
+
+	job, err := stage.BuildJob(ctx, sc)
+	if err != nil {
+		return fmt.Errorf("failed to build %s job: %v", stage.Name, err)
+	}
+	queueName := stage.InputQueue
+	if job.Queue != "" {
+		queueName = job.Queue
+	}
+
+	err = s.publish(ctx, queueName, broker.Message{
+		ContentType: "application/json",
+		Priority:    uint8(sc.Config.JobPriority()),
+		Headers:     jobHeaders(sc),
+		Body:        job.Body,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish %s job: %v", stage.Name, err)
+	}
+
+	s.logger.Infof("%s job published to %s with ID %s", stage.Name, queueName, sc.ID.Hex())
+	return nil
+}
+
+// stageConsumer returns the consumption handler of the output queue of the given stage.
+func (s *AMPQService) stageConsumer(stage *StageDefinition) func(broker.Delivery) error {
+	return func(d broker.Delivery) error {
+		return s.processStageOutput(stage, d)
+	}
+}
+
+// processStageOutput processes a worker output message of the given stage. The output of cancelled scenes is discarded,
+// otherwise it is processed by the stage, and the scene moves on to the next stage.
+//
+// Processing is idempotent: a message that was already processed since the job of the stage was last published (identified
+// by its message ID, or the hash of its body), or the output of a stage the scene is no longer queued for (i.e it already
+// moved on), is a duplicate delivery, and is acknowledged without being processed again.
+//
+// Every output message must contain the ID of its scene, output without a valid ID is rejected with an OutputValidationError:
+//
+//	{
+//	    "id": string (primitive.ObjectID.Hex()),
+//	    ...
+//	}
+func (s *AMPQService) processStageOutput(stage *StageDefinition, d broker.Delivery) error {
+	var output struct {
+		SceneID string `json:"id"`
+	}
+	if err := json.Unmarshal(d.Body, &output); err != nil {
+		return rejectOutput(stage.Name, "", RejectionInvalidJSON, "%v", err)
+	}
+	sceneID, err := primitive.ObjectIDFromHex(output.SceneID)
+	if err != nil {
+		return rejectOutput(stage.Name, "id", RejectionInvalidValue, "invalid ID format: %v", err)
+	}
+
+	ctx := context.Background()
+
+	sc, err := s.sceneManager.GetScene(ctx, sceneID)
+	if err != nil {
+		return fmt.Errorf("failed to get scene: %w", err)
+	}
+	if sc.FailureReason == scene.FailureReasonCancelled {
+		s.logger.Infof("Discarding %s result of cancelled scene %s", stage.Name, sceneID.Hex())
+		return nil
+	}
+
+	key := processedoutput.Key(stage.OutputQueue, d.ID, d.Body)
+	duplicate, err := s.isDuplicateOutput(ctx, stage, sceneID, key)
+	if err != nil {
+		return err
+	}
+	if duplicate {
+		s.logger.Infof("Acknowledging duplicate %s result of scene %s without processing it", stage.Name, sceneID.Hex())
+		s.consumerStats.recordDuplicate(stage.OutputQueue)
+		return nil
+	}
+
+	result, err := stage.ProcessOutput(ctx, sc, d)
+	if err != nil || result == nil {
+		return err
+	}
+	if err := s.advance(ctx, stage, sc, result); err != nil {
+		return err
+	}
+	if err := s.processedOutputManager.MarkProcessed(ctx, key, stage.OutputQueue, sceneID); err != nil {
+		s.logger.Errorf("Failed to record %s result of scene %s as processed: %v", stage.Name, sceneID.Hex(), err)
+	}
+	return nil
+}
+
+// isDuplicateOutput returns whether the output message with the given key, of the given stage and scene, was already
+// processed, or the scene is no longer queued for the stage.
+func (s *AMPQService) isDuplicateOutput(ctx context.Context, stage *StageDefinition, sceneID primitive.ObjectID, key string) (bool, error) {
+	processed, err := s.processedOutputManager.IsProcessed(ctx, key)
+	if err != nil {
+		return false, fmt.Errorf("failed to check processed outputs: %v", err)
+	}
+	if processed {
+		return true, nil
+	}
+
+	_, _, err = s.queueManager.GetQueuePosition(ctx, stage.ListName, sceneID)
+	if errors.Is(err, queue.ErrIDNotFoundInQueue) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get position in %s: %v", stage.ListName, err)
+	}
+	return false, nil
+}
+
+// advance moves a scene whose given stage completed on to the next stage, or completes its pipeline after the last stage,
+// and notifies the result of the stage once it did. The scene only leaves the list of the stage once it moved on, so output
+// whose processing failed is retried rather than taken for a duplicate. A redelivered output finds the next job already
+// queued, and is not notified again. A scene whose stage failed stops there: it leaves the queue lists and the failure is
+// notified instead of the result of the stage.
+func (s *AMPQService) advance(ctx context.Context, stage *StageDefinition, sc *scene.Scene, result *StageResult) error {
+	if result.FailureReason != "" {
+		s.releaseQueues(ctx, sc.ID, stage.ListName, "queue_list")
+		s.callbacks.Notify(sc.ID, CallbackEventFailed, result.FailureReason)
+		return nil
+	}
+
+	next := s.nextStage(stage)
+	if next == nil {
+		recordEvent(ctx, s.eventManager, s.logger, event.TypeJobCompleted, sc.ID, 0)
+		err := s.queueManager.DeleteFromQueue(ctx, "queue_list", sc.ID)
+		if err != nil && !errors.Is(err, queue.ErrIDNotFoundInQueue) && !errors.Is(err, queue.ErrInvalidOpOnEmptyQueue) {
+			return fmt.Errorf("failed to pop from queue_list: %v", err)
+		}
+		s.leaveStage(ctx, stage, sc.ID)
+		s.callbacks.Notify(sc.ID, CallbackEventCompleted, "")
+		return nil
+	}
+
+	err := s.publishStageJob(ctx, next, sc)
+	if errors.Is(err, ErrJobAlreadyQueued) {
+		s.leaveStage(ctx, stage, sc.ID)
+		s.logger.Infof("%s job for scene %s already published, acknowledging redelivered %s result", next.Name, sc.ID.Hex(), stage.Name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.leaveStage(ctx, stage, sc.ID)
+	if result.Event != "" {
+		s.callbacks.Notify(sc.ID, result.Event, "")
+	}
+	return nil
+}
+
+// leaveStage removes a scene that moved on from the list of the given stage. Failures are logged, as the scene already moved on.
+func (s *AMPQService) leaveStage(ctx context.Context, stage *StageDefinition, sceneID primitive.ObjectID) {
+	err := s.queueManager.DeleteFromQueue(ctx, stage.ListName, sceneID)
+	if err != nil && !errors.Is(err, queue.ErrIDNotFoundInQueue) && !errors.Is(err, queue.ErrInvalidOpOnEmptyQueue) {
+		s.logger.Errorf("Error popping from %s queue: %v", stage.ListName, err)
+	}
+}
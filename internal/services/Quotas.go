@@ -0,0 +1,208 @@
+// This file contains the per-user quotas limiting the scenes a user creates: the bytes their scenes use in storage, the
+// scenes queued or processing at once, and the scenes created per UTC day. The limits are tunables shared by every user
+// (QUOTA_MAX_STORAGE_BYTES, QUOTA_MAX_ACTIVE_SCENES, QUOTA_MAX_SCENES_PER_DAY), 0 disables the respective quota.
+//
+// Quotas are checked before an upload is received and again when its scene is submitted, so every source of scenes
+// (uploads, URLs, clones, synthetic scenes) is limited, and uploads are rejected before their bytes are received. They are
+// checked against the usage at that time: a scene may exceed the storage quota by the size of its own upload.
+//
+// Usage is derived from the scenes of the user instead of being counted separately, so it never drifts: active scenes are
+// those in 'queue_list', scenes created today are counted from the timestamps of their IDs (scenes deleted for good no
+// longer count), and storage is measured by walking the storage prefixes of every scene like the storage usage reports.
+// Storage is only measured when reported, or when its quota is enabled. As measuring it lists every scene of the user, the
+// storage a check measured is reused by the checks of the next storageUsageTTL, so a user may exceed the storage quota by the
+// files of the scenes they created meanwhile. Reports always measure it, and refresh the measure of later checks.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/queue"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/user"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/storage"
+)
+
+// Custom errors
+var (
+	// ErrQuotaExceeded is returned when a user reached one of their quotas, and may not create another scene.
+	ErrQuotaExceeded = errors.New("quota exceeded")
+)
+
+// storageUsageTTL is how long the storage measured for a user is reused by the quota checks
+const storageUsageTTL = time.Minute
+
+// Quota is the usage of a single quota, and its limit (0 = unlimited)
+type Quota struct {
+	Used  int64 `json:"used"`
+	Limit int64 `json:"limit"`
+}
+
+// reached checks if the quota is limited, and no more can be used.
+func (q Quota) reached() bool {
+	return q.Limit > 0 && q.Used >= q.Limit
+}
+
+// QuotaUsage is the usage of every quota of a user
+type QuotaUsage struct {
+	StorageBytes Quota `json:"storage_bytes"`
+	ActiveScenes Quota `json:"active_scenes"`
+	ScenesToday  Quota `json:"scenes_today"`
+	// ScenesTodayResetAt is when the scenes created today stop counting, the start of the next UTC day
+	ScenesTodayResetAt time.Time `json:"scenes_today_reset_at"`
+}
+
+// Quotas measures the usage of users, and checks it against the configured quotas.
+type Quotas struct {
+	sceneManager *scene.SceneManager
+	queueManager *queue.QueueListManager
+	storage      storage.Storage
+	coldStorage  storage.Storage
+	config       *config.Config
+
+	// storageMu guards storageUsage, the last storage measured for every user
+	storageMu    sync.Mutex
+	storageUsage map[primitive.ObjectID]measuredStorage
+}
+
+// measuredStorage is the storage used by the scenes of a user, as measured at the given time
+type measuredStorage struct {
+	bytes      int64
+	measuredAt time.Time
+}
+
+// NewQuotas creates new Quotas. Dependencies are injected via the constructor.
+func NewQuotas(sm *scene.SceneManager, qlm *queue.QueueListManager, store, coldStorage storage.Storage, cfg *config.Config) *Quotas {
+	return &Quotas{
+		sceneManager: sm,
+		queueManager: qlm,
+		storage:      store,
+		coldStorage:  coldStorage,
+		config:       cfg,
+		storageUsage: make(map[primitive.ObjectID]measuredStorage),
+	}
+}
+
+// Usage returns the usage of every quota of the given user.
+//
+// Returns error if the usage could not be measured.
+func (q *Quotas) Usage(ctx context.Context, u *user.User) (*QuotaUsage, error) {
+	usage, err := q.usage(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	usage.StorageBytes.Used, err = q.storageBytes(ctx, u, false)
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// Check checks if the given user may create another scene.
+//
+// Returns ErrQuotaExceeded describing the reached quota, error if the usage could not be measured.
+func (q *Quotas) Check(ctx context.Context, u *user.User) error {
+	tunables := q.config.Tunables()
+	if tunables.QuotaMaxStorageBytes == 0 && tunables.QuotaMaxActiveScenes == 0 && tunables.QuotaMaxScenesPerDay == 0 {
+		return nil
+	}
+	usage, err := q.usage(ctx, u)
+	if err != nil {
+		return err
+	}
+	if tunables.QuotaMaxStorageBytes > 0 {
+		usage.StorageBytes.Used, err = q.storageBytes(ctx, u, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case usage.ScenesToday.reached():
+		return fmt.Errorf("%w: %d of %d scenes created today, try again after %s", ErrQuotaExceeded,
+			usage.ScenesToday.Used, usage.ScenesToday.Limit, usage.ScenesTodayResetAt.Format(time.RFC3339))
+	case usage.ActiveScenes.reached():
+		return fmt.Errorf("%w: %d of %d scenes are queued or processing, wait for one to finish", ErrQuotaExceeded,
+			usage.ActiveScenes.Used, usage.ActiveScenes.Limit)
+	case usage.StorageBytes.reached():
+		return fmt.Errorf("%w: %d of %d bytes of storage used, delete scenes to free storage", ErrQuotaExceeded,
+			usage.StorageBytes.Used, usage.StorageBytes.Limit)
+	}
+	return nil
+}
+
+// usage measures the usage of the given user, except their storage.
+func (q *Quotas) usage(ctx context.Context, u *user.User) (*QuotaUsage, error) {
+	tunables := q.config.Tunables()
+	dayStart := time.Now().UTC().Truncate(24 * time.Hour)
+	usage := &QuotaUsage{
+		StorageBytes:       Quota{Limit: tunables.QuotaMaxStorageBytes},
+		ActiveScenes:       Quota{Limit: int64(tunables.QuotaMaxActiveScenes)},
+		ScenesToday:        Quota{Limit: int64(tunables.QuotaMaxScenesPerDay)},
+		ScenesTodayResetAt: dayStart.Add(24 * time.Hour),
+	}
+
+	owned := make(map[primitive.ObjectID]bool, len(u.SceneIDs))
+	for _, sceneID := range u.SceneIDs {
+		owned[sceneID] = true
+		if !sceneID.Timestamp().Before(dayStart) {
+			usage.ScenesToday.Used++
+		}
+	}
+
+	queued, err := q.queueManager.GetQueueItems(ctx, "queue_list")
+	if err != nil {
+		return nil, err
+	}
+	for _, sceneID := range queued {
+		if owned[sceneID] {
+			usage.ActiveScenes.Used++
+		}
+	}
+	return usage, nil
+}
+
+// storageBytes returns the bytes the scenes of the given user use in storage. If cached is set, the storage measured for
+// the user in the last storageUsageTTL is returned instead of measuring it again.
+func (q *Quotas) storageBytes(ctx context.Context, u *user.User, cached bool) (int64, error) {
+	if cached {
+		q.storageMu.Lock()
+		measured, ok := q.storageUsage[u.ID]
+		q.storageMu.Unlock()
+		if ok && time.Since(measured.measuredAt) < storageUsageTTL {
+			return measured.bytes, nil
+		}
+	}
+
+	scenes, err := q.sceneManager.GetScenes(ctx, u.SceneIDs)
+	if err != nil {
+		return 0, err
+	}
+	var bytes int64
+	for _, sc := range scenes {
+		sceneUsage, err := measureSceneStorage(ctx, q.storage, q.coldStorage, sc)
+		if err != nil {
+			return 0, err
+		}
+		bytes += sceneUsage.TotalBytes
+	}
+
+	now := time.Now()
+	q.storageMu.Lock()
+	defer q.storageMu.Unlock()
+	for userID, measured := range q.storageUsage {
+		if now.Sub(measured.measuredAt) >= storageUsageTTL {
+			delete(q.storageUsage, userID)
+		}
+	}
+	q.storageUsage[u.ID] = measuredStorage{bytes: bytes, measuredAt: now}
+	return bytes, nil
+}
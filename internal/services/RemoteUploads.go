@@ -0,0 +1,232 @@
+// This file contains the remote uploads of the UploadService, which create scenes from videos hosted elsewhere.
+//
+// Instead of uploading a video, a user submits the URL of a hosted video with the training values of the scene. The
+// submission is validated right away, then the video is downloaded in the background and goes through the same steps as
+// an upload (persist → register → publish). Its progress is tracked like a streamed upload, under the returned upload ID,
+// so the client polls /user/upload/progress/:upload_id for the download, and for the scene ID once it is done.
+//
+// URLs are chosen by users, so downloads are guarded against server-side request forgery like scene callbacks: only http(s)
+// URLs resolving to public addresses are accepted, unless REMOTE_UPLOAD_ALLOW_PRIVATE is set, and every connection (including
+// those of redirects) is checked again. Downloads are bounded by REMOTE_UPLOAD_TIMEOUT and the maximum upload size of the
+// user, and at most maxRemoteUploads run at once.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"syscall"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/user"
+)
+
+// Custom errors
+var (
+	// ErrInvalidRemoteURL is returned when a scene is submitted with a URL that can not be downloaded from.
+	ErrInvalidRemoteURL = errors.New("invalid video URL")
+	// ErrRemoteDownload is returned when the video of a URL could not be downloaded.
+	ErrRemoteDownload = errors.New("failed to download the video")
+	// ErrRemoteUploadsBusy is returned when a URL is submitted while maxRemoteUploads downloads are running.
+	ErrRemoteUploadsBusy = errors.New("too many videos are being downloaded, try again later")
+)
+
+const (
+	// maxRemoteUploads is the number of concurrent downloads of submitted URLs
+	maxRemoteUploads = 8
+	// maxRemoteRedirects is the number of redirects followed when downloading a submitted URL
+	maxRemoteRedirects = 5
+	// remoteConnectTimeout bounds connecting to the host of a submitted URL, and receiving its response headers
+	remoteConnectTimeout = 30 * time.Second
+)
+
+// remoteContentTypes are the extensions of the accepted formats by the content type of their downloads, for URLs whose
+// path has no accepted extension
+var remoteContentTypes = map[string]string{
+	"video/mp4":        ".mp4",
+	"video/quicktime":  ".mov",
+	"video/x-matroska": ".mkv",
+	"video/webm":       ".webm",
+	"video/x-msvideo":  ".avi",
+	"application/zip":  ".zip",
+}
+
+// newRemoteClient creates the HTTP client downloading submitted URLs, refusing to connect to non-public addresses unless
+// allowed by the given config.
+func newRemoteClient(cfg *config.Config) *http.Client {
+	allowPrivate := cfg.RemoteUploadAllowPrivate
+	dialer := &net.Dialer{
+		Timeout: remoteConnectTimeout,
+		Control: func(network, address string, conn syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !allowPrivate && !isPublicAddr(addrPort.Addr()) {
+				return fmt.Errorf("%w: refused to connect to non-public address %s", ErrInvalidRemoteURL, addrPort.Addr())
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   remoteConnectTimeout,
+			ResponseHeaderTimeout: remoteConnectTimeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRemoteRedirects {
+				return fmt.Errorf("%w: too many redirects", ErrRemoteDownload)
+			}
+			if req.URL.Scheme != "https" && req.URL.Scheme != "http" {
+				return fmt.Errorf("%w: redirected to unsupported scheme %q", ErrRemoteDownload, req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// UploadFromURL validates a submission of the given user for the video (or image set) hosted at rawURL, and starts
+// downloading it in the background. The scene is created once the video was downloaded and accepted. The download is
+// tracked under uploadID, or under a generated ID if it is empty.
+//
+// Returns the upload ID to poll the progress of the download with, ErrInvalidRemoteURL if the URL can not be downloaded
+// from, ErrInvalidUploadID if uploadID is malformed, ErrRemoteUploadsBusy if too many downloads are running, errors of
+// SubmitScene otherwise. Errors of the download itself are only reported by its progress.
+func (s *UploadService) UploadFromURL(ctx context.Context, userID primitive.ObjectID, rawURL, uploadID string, submission SceneSubmission) (string, error) {
+	u, err := s.validateRemoteURL(ctx, rawURL)
+	if err != nil {
+		return "", err
+	}
+	if uploadID == "" {
+		uploadID = primitive.NewObjectID().Hex()
+	}
+	if !uploadIDPattern.MatchString(uploadID) {
+		return "", ErrInvalidUploadID
+	}
+	if err := s.checkUploadAllowed(ctx, userID); err != nil {
+		return "", err
+	}
+	submitter, newScene, err := s.validate(ctx, userID, primitive.NewObjectID(), submission)
+	if err != nil {
+		return "", err
+	}
+
+	select {
+	case s.remoteUploads <- struct{}{}:
+	default:
+		return "", ErrRemoteUploadsBusy
+	}
+	tracker, err := s.TrackUpload(context.Background(), userID, uploadID, 0)
+	if err != nil {
+		<-s.remoteUploads
+		return "", err
+	}
+
+	go func() {
+		defer func() { <-s.remoteUploads }()
+		sceneID, err := s.ingestURL(u, submitter, newScene, tracker)
+		if err != nil {
+			s.logger.Infof("Failed to create a scene from %s for user %s: %v", u.Redacted(), userID.Hex(), err)
+		}
+		tracker.Finish(sceneID, err)
+	}()
+	return uploadID, nil
+}
+
+// validateRemoteURL checks if videos may be downloaded from the given URL: it must be an absolute http(s) URL without
+// credentials whose host resolves to public addresses only, unless private addresses are allowed.
+//
+// Returns the parsed URL if valid, ErrInvalidRemoteURL otherwise.
+func (s *UploadService) validateRemoteURL(ctx context.Context, rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed URL", ErrInvalidRemoteURL)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("%w: unsupported scheme %q", ErrInvalidRemoteURL, u.Scheme)
+	}
+	if u.Host == "" || u.User != nil {
+		return nil, fmt.Errorf("%w: URL must have a host and no credentials", ErrInvalidRemoteURL)
+	}
+	if s.config.RemoteUploadAllowPrivate {
+		return u, nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", u.Hostname())
+	if err != nil || len(addrs) == 0 {
+		return nil, fmt.Errorf("%w: host %s does not resolve", ErrInvalidRemoteURL, u.Hostname())
+	}
+	for _, addr := range addrs {
+		if !isPublicAddr(addr) {
+			return nil, fmt.Errorf("%w: host %s resolves to a non-public address", ErrInvalidRemoteURL, u.Hostname())
+		}
+	}
+	return u, nil
+}
+
+// ingestURL downloads the video at the given URL into the scene validated for the submitter, and submits the scene.
+// The downloaded video is discarded if the scene can not be submitted.
+//
+// Returns the scene ID if successful, error otherwise.
+func (s *UploadService) ingestURL(u *url.URL, submitter *user.User, newScene *scene.Scene, tracker *UploadTracker) (primitive.ObjectID, error) {
+	ctx := context.Background()
+	downloadCtx, cancel := context.WithTimeout(ctx, s.config.RemoteUploadTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(downloadCtx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return primitive.NilObjectID, fmt.Errorf("%w: %v", ErrInvalidRemoteURL, err)
+	}
+	resp, err := s.remoteClient.Do(req)
+	if err != nil {
+		return primitive.NilObjectID, fmt.Errorf("%w: %v", ErrRemoteDownload, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return primitive.NilObjectID, fmt.Errorf("%w: %s answered %d", ErrRemoteDownload, u.Hostname(), resp.StatusCode)
+	}
+	if resp.ContentLength > s.uploadMaxSize(submitter) {
+		return primitive.NilObjectID, ErrUploadTooLarge
+	}
+
+	fileName := remoteFileName(resp.Request.URL, resp.Header.Get("Content-Type"))
+	tracker.SetTotal(resp.ContentLength)
+	input, err := s.persist(downloadCtx, submitter, newScene.ID, 0, fileName, tracker.Reader(fileName, resp.Body))
+	if err != nil {
+		if downloadCtx.Err() != nil {
+			err = fmt.Errorf("%w: not downloaded within %v", ErrRemoteDownload, s.config.RemoteUploadTimeout)
+		}
+		s.discardVideo(ctx, submitter.Tenant, newScene.ID)
+		return primitive.NilObjectID, err
+	}
+
+	newScene.Videos = []*scene.Video{input}
+	if err := s.submit(ctx, submitter, newScene); err != nil {
+		s.discardVideo(ctx, submitter.Tenant, newScene.ID)
+		return primitive.NilObjectID, err
+	}
+	return newScene.ID, nil
+}
+
+// remoteFileName returns the name of the file downloaded from the given URL (after redirects): the last element of its
+// path if it has an accepted extension, a name with the extension of the given content type otherwise.
+func remoteFileName(u *url.URL, contentType string) string {
+	name := path.Base(u.Path)
+	if _, ok := uploadFormats[uploadExt(name)]; ok {
+		return name
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return "download" + remoteContentTypes[mediaType]
+}
@@ -0,0 +1,320 @@
+// This file contains the ReplayService implementation, which re-runs the full processing pipeline of selected scenes from their
+// stored raw videos, i.e after a worker algorithm upgrade.
+//
+// Admins request a replay of a list of scenes. The scheduler starts pending scenes while fewer than the configured number
+// of replayed scenes are in the queues, so user jobs keep being interleaved. A replayed scene is finished once it left the
+// queues, and its previous outputs are kept as a previous version of the scene. Like the digest scheduler, every replica runs the scheduler,
+// and the replicas elect a single one through a lease.
+//
+// Scenes keep serving their previous outputs until the new ones are stored. Scenes that are archived, whose outputs were
+// deleted by the retention policy, or that are already being processed, fail instead of being replayed.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/lease"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/pagination"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/queue"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/replay"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/storage"
+)
+
+// Custom errors
+var (
+	// ErrInvalidReplay is returned when a replay is requested without scenes, with duplicate scenes, or with too many scenes.
+	ErrInvalidReplay = errors.New("a replay needs between 1 and 1000 distinct scenes")
+)
+
+// replayLeaseName is the name of the lease held by the instance elected to run replays
+const replayLeaseName = "replay"
+
+// replayCheckInterval is how often replayed scenes are checked and started. It is also the TTL of the replay lease.
+const replayCheckInterval = time.Minute
+
+// replayStaleAfter is how long a replayed scene may stay in the queues before it is failed, i.e if its worker output was lost
+const replayStaleAfter = 24 * time.Hour
+
+// maxReplayScenes is the maximum number of scenes of a single replay
+const maxReplayScenes = 1000
+
+type ReplayService struct {
+	mqService     JobPublisher
+	sceneManager  *scene.SceneManager
+	queueManager  *queue.QueueListManager
+	replayManager *replay.ReplayManager
+	leaseManager  *lease.LeaseManager
+	storage       storage.Storage
+	config        *config.Config
+	logger        *log.Logger
+}
+
+// NewReplayService creates a new ReplayService. Dependencies are injected via the constructor.
+func NewReplayService(
+	mq JobPublisher,
+	sm *scene.SceneManager,
+	qlm *queue.QueueListManager,
+	rm *replay.ReplayManager,
+	lm *lease.LeaseManager,
+	store storage.Storage,
+	cfg *config.Config,
+	logger *log.Logger,
+) *ReplayService {
+	return &ReplayService{
+		mqService:     mq,
+		sceneManager:  sm,
+		queueManager:  qlm,
+		replayManager: rm,
+		leaseManager:  lm,
+		storage:       store,
+		config:        cfg,
+		logger:        logger,
+	}
+}
+
+// CreateReplay requests a replay of the given scenes. The scenes are started by the scheduler.
+//
+// Returns the created replay, ErrInvalidReplay if the scene list is invalid, scene.ErrSceneNotFound if a scene does not exist.
+func (s *ReplayService) CreateReplay(ctx context.Context, adminID primitive.ObjectID, sceneIDs []primitive.ObjectID) (*replay.Replay, error) {
+	if len(sceneIDs) == 0 || len(sceneIDs) > maxReplayScenes {
+		return nil, ErrInvalidReplay
+	}
+	seen := make(map[primitive.ObjectID]bool, len(sceneIDs))
+	for _, sceneID := range sceneIDs {
+		if seen[sceneID] {
+			return nil, ErrInvalidReplay
+		}
+		seen[sceneID] = true
+
+		exists, err := s.sceneManager.SceneExists(ctx, sceneID)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, fmt.Errorf("%w: %s", scene.ErrSceneNotFound, sceneID.Hex())
+		}
+	}
+
+	r, err := s.replayManager.CreateReplay(ctx, adminID, sceneIDs)
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Infof("Replay %s of %d scenes requested by %s", r.ID.Hex(), len(sceneIDs), adminID.Hex())
+	return r, nil
+}
+
+// ListScenesByWorkerVersion returns the given page of IDs of scenes whose given stage (sfm, nerf) was last completed by the given
+// worker version, newest first, and the cursor of the next page. Used to find the scenes affected by a bug in a specific worker version.
+func (s *ReplayService) ListScenesByWorkerVersion(ctx context.Context, stage, version string, page pagination.Page) ([]primitive.ObjectID, string, error) {
+	return s.sceneManager.PageScenesByWorkerVersion(ctx, stage, version, page)
+}
+
+// CreateWorkerVersionReplay requests a replay of the (up to 1000 oldest) scenes whose given stage was last completed by the
+// given worker version.
+//
+// Returns the created replay, ErrInvalidReplay if no scene matches.
+func (s *ReplayService) CreateWorkerVersionReplay(ctx context.Context, adminID primitive.ObjectID, stage, version string) (*replay.Replay, error) {
+	sceneIDs, err := s.sceneManager.ListScenesByWorkerVersion(ctx, stage, version, maxReplayScenes)
+	if err != nil {
+		return nil, err
+	}
+	return s.CreateReplay(ctx, adminID, sceneIDs)
+}
+
+// GetReplay returns the given replay, with the progress of every scene.
+//
+// Returns replay.ErrReplayNotFound if the replay does not exist.
+func (s *ReplayService) GetReplay(ctx context.Context, replayID primitive.ObjectID) (*replay.Replay, error) {
+	return s.replayManager.GetReplay(ctx, replayID)
+}
+
+// ListReplays returns the given page of replays, newest first, and the cursor of the next page.
+func (s *ReplayService) ListReplays(ctx context.Context, page pagination.Page) ([]*replay.Replay, string, error) {
+	return s.replayManager.ListReplays(ctx, page)
+}
+
+// Run advances the replays every replayCheckInterval, while this instance holds the replay lease, until the context is cancelled.
+func (s *ReplayService) Run(ctx context.Context) {
+	ticker := time.NewTicker(replayCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		acquired, err := s.leaseManager.TryAcquire(ctx, replayLeaseName, s.config.InstanceID, replayCheckInterval)
+		if err != nil {
+			s.logger.Errorf("Failed to acquire replay lease: %v", err)
+		} else if acquired {
+			s.advance(ctx)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// advance finishes the replayed scenes that left the queues, then starts pending scenes, oldest replay first,
+// until ReplayConcurrency scenes are running.
+func (s *ReplayService) advance(ctx context.Context) {
+	replays, err := s.replayManager.ListActiveReplays(ctx)
+	if err != nil {
+		s.logger.Errorf("Failed to list active replays: %v", err)
+		return
+	}
+
+	running := 0
+	for _, r := range replays {
+		for _, rs := range r.Scenes {
+			if rs.Status != replay.StatusRunning {
+				continue
+			}
+			done, err := s.checkScene(ctx, r.ID, rs)
+			if err != nil {
+				s.logger.Warnf("Failed to check replayed scene %s: %v", rs.SceneID.Hex(), err)
+			}
+			if !done {
+				running++
+			}
+		}
+	}
+
+	for _, r := range replays {
+		for _, rs := range r.Scenes {
+			if running >= s.config.ReplayConcurrency {
+				break
+			}
+			if rs.Status != replay.StatusPending {
+				continue
+			}
+			started, err := s.startScene(ctx, r.ID, rs.SceneID)
+			if err != nil {
+				s.logger.Warnf("Failed to replay scene %s: %v", rs.SceneID.Hex(), err)
+				s.finishScene(ctx, r.ID, rs.SceneID, err.Error())
+				continue
+			}
+			if started {
+				running++
+			}
+		}
+		if err := s.replayManager.FinishReplay(ctx, r.ID); err != nil {
+			s.logger.Warnf("Failed to finish replay %s: %v", r.ID.Hex(), err)
+		}
+	}
+}
+
+// startScene checks that the scene can be replayed, claims it, and publishes it to the start of the pipeline.
+//
+// Returns true if the scene was started, false if it was already claimed, error if the scene can not be replayed.
+func (s *ReplayService) startScene(ctx context.Context, replayID, sceneID primitive.ObjectID) (bool, error) {
+	sc, err := s.sceneManager.GetScene(ctx, sceneID)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case len(sc.Videos) == 0 || sc.Config == nil:
+		return false, errors.New("scene has no video to replay")
+	case sc.Archive != nil:
+		return false, scene.ErrSceneArchived
+	case sc.OutputsDeletedAt != nil:
+		return false, scene.ErrOutputsDeleted
+	}
+	if _, _, err := s.queueManager.GetQueuePosition(ctx, "queue_list", sceneID); !errors.Is(err, queue.ErrIDNotFoundInQueue) {
+		if err != nil {
+			return false, err
+		}
+		return false, errors.New("scene is already being processed")
+	}
+	for _, video := range sc.Videos {
+		videoKey, err := storage.CleanKey(video.FilePath)
+		if err != nil {
+			return false, err
+		}
+		if _, err := s.storage.Stat(ctx, videoKey); err != nil {
+			return false, fmt.Errorf("raw video unavailable: %w", err)
+		}
+	}
+
+	claimed, err := s.replayManager.StartScene(ctx, replayID, sceneID)
+	if err != nil || !claimed {
+		return false, err
+	}
+
+	if sc.Nerf != nil {
+		if err := s.sceneManager.SetRetrainVersion(ctx, sceneID, nextNerfVersion(sc)); err != nil {
+			return false, err
+		}
+	}
+
+	if err := s.sceneManager.SetFailureReason(ctx, sceneID, ""); err != nil {
+		return false, err
+	}
+	if err := s.sceneManager.SetSceneError(ctx, sceneID, nil); err != nil {
+		return false, err
+	}
+	if err := s.mqService.PublishSFMJob(ctx, sc); err != nil {
+		return false, err
+	}
+	s.logger.Infof("Replaying scene %s (replay %s)", sceneID.Hex(), replayID.Hex())
+	return true, nil
+}
+
+// checkScene finishes a running scene once it left the queues, or failed if it stayed in them for too long.
+//
+// Returns true if the scene is finished.
+func (s *ReplayService) checkScene(ctx context.Context, replayID primitive.ObjectID, rs replay.ReplayScene) (bool, error) {
+	_, _, err := s.queueManager.GetQueuePosition(ctx, "queue_list", rs.SceneID)
+	if err == nil {
+		if rs.StartedAt != nil && time.Since(*rs.StartedAt) > replayStaleAfter {
+			s.finishScene(ctx, replayID, rs.SceneID, "timed out waiting for the workers")
+			return true, nil
+		}
+		return false, nil
+	}
+	if !errors.Is(err, queue.ErrIDNotFoundInQueue) {
+		return false, err
+	}
+
+	sc, err := s.sceneManager.GetScene(ctx, rs.SceneID)
+	if err != nil {
+		s.finishScene(ctx, replayID, rs.SceneID, err.Error())
+		return true, nil
+	}
+	if sc.FailureReason != "" {
+		s.finishScene(ctx, replayID, rs.SceneID, "processing failed: "+sc.FailureReason)
+		return true, nil
+	}
+	if sc.Nerf == nil {
+		s.finishScene(ctx, replayID, rs.SceneID, "processing produced no outputs")
+		return true, nil
+	}
+
+	s.finishScene(ctx, replayID, rs.SceneID, "")
+	return true, nil
+}
+
+// nextNerfVersion returns the version the next training result of the scene is stored as, after its current and
+// previous versions.
+func nextNerfVersion(sc *scene.Scene) int {
+	version := sc.Nerf.CurrentVersion()
+	for _, previous := range sc.NerfVersions {
+		version = max(version, previous.CurrentVersion())
+	}
+	return version + 1
+}
+
+// finishScene records the outcome of a replayed scene, logging instead of returning any error.
+func (s *ReplayService) finishScene(ctx context.Context, replayID, sceneID primitive.ObjectID, reason string) {
+	if err := s.replayManager.FinishScene(ctx, replayID, sceneID, reason); err != nil {
+		s.logger.Warnf("Failed to record replay of scene %s: %v", sceneID.Hex(), err)
+	}
+}
@@ -0,0 +1,247 @@
+// This file contains the RetentionService implementation, which deletes the outputs of inactive users according to the
+// retention rule of their tier.
+//
+// Activity is recorded whenever a user obtains tokens (login or refresh). Once a user has been inactive for their tier's
+// retention period minus the warning period, they are emailed a warning. Their outputs are deleted once the retention period
+// passed, but never sooner than the warning period after the warning, so every user is warned for the full period.
+// Becoming active again cancels the deletion. Admins and users flagged exempt are never affected.
+//
+// Like the digest scheduler, every replica runs the scheduler, and the replicas elect a single enforcer through a lease.
+// Only the nerf outputs (the large artifacts) are deleted; scenes, their videos and sfm frames are kept.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/mail"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/lease"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/user"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/storage"
+)
+
+// retentionLeaseName is the name of the lease held by the instance elected to enforce retention
+const retentionLeaseName = "retention"
+
+// retentionCheckInterval is how often inactive users are checked. It is also the TTL of the retention lease.
+const retentionCheckInterval = time.Hour
+
+type RetentionService struct {
+	userManager  *user.UserManager
+	sceneManager *scene.SceneManager
+	leaseManager *lease.LeaseManager
+	storage      storage.Storage
+	coldStorage  storage.Storage
+	mailer       mail.Mailer
+	config       *config.Config
+	logger       *log.Logger
+}
+
+// NewRetentionService creates a new RetentionService. Dependencies are injected via the constructor.
+// cold may be nil if archival is disabled.
+func NewRetentionService(
+	um *user.UserManager,
+	sm *scene.SceneManager,
+	lm *lease.LeaseManager,
+	store storage.Storage,
+	cold storage.Storage,
+	mailer mail.Mailer,
+	cfg *config.Config,
+	logger *log.Logger,
+) *RetentionService {
+	return &RetentionService{
+		userManager:  um,
+		sceneManager: sm,
+		leaseManager: lm,
+		storage:      store,
+		coldStorage:  cold,
+		mailer:       mailer,
+		config:       cfg,
+		logger:       logger,
+	}
+}
+
+// Run enforces the retention rules every retentionCheckInterval, while this instance holds the retention lease,
+// until the context is cancelled. Returns immediately if no tier has a retention period.
+func (s *RetentionService) Run(ctx context.Context) {
+	enabled := false
+	for _, period := range s.config.RetentionRules {
+		enabled = enabled || period > 0
+	}
+	if !enabled {
+		s.logger.Info("Output retention disabled")
+		return
+	}
+
+	ticker := time.NewTicker(retentionCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		acquired, err := s.leaseManager.TryAcquire(ctx, retentionLeaseName, s.config.InstanceID, retentionCheckInterval)
+		if err != nil {
+			s.logger.Errorf("Failed to acquire retention lease: %v", err)
+		} else if acquired {
+			s.Enforce(ctx)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Enforce warns the users due a warning, and deletes the outputs of the users whose retention period passed.
+// Failures are logged per user, and the user is retried at the next check.
+func (s *RetentionService) Enforce(ctx context.Context) {
+	now := time.Now().UTC()
+	if err := s.userManager.BackfillLastActive(ctx, now); err != nil {
+		s.logger.Errorf("Failed to backfill user activity: %v", err)
+		return
+	}
+
+	for tier, period := range s.config.RetentionRules {
+		if period == 0 {
+			continue
+		}
+		users, err := s.userManager.ListInactiveUsers(ctx, tier, now.Add(-period+s.config.RetentionWarning))
+		if err != nil {
+			s.logger.Errorf("Failed to list inactive %s users: %v", tier, err)
+			continue
+		}
+		for _, u := range users {
+			if ctx.Err() != nil {
+				return
+			}
+			if err := s.enforceUser(ctx, u, period, now); err != nil {
+				s.logger.Warnf("Failed to enforce retention for user %s: %v", u.ID.Hex(), err)
+			}
+		}
+	}
+}
+
+// enforceUser warns an inactive user, or deletes their outputs once they were warned and the deletion is due.
+func (s *RetentionService) enforceUser(ctx context.Context, u *user.User, period time.Duration, now time.Time) error {
+	lastActive := *u.LastActiveAt
+	if u.RetentionPurgedAt != nil && u.RetentionPurgedAt.After(lastActive) {
+		return nil
+	}
+
+	deleteAt := lastActive.Add(period)
+	if u.RetentionWarnedAt == nil || !u.RetentionWarnedAt.After(lastActive) {
+		return s.warnUser(ctx, u, latest(deleteAt, now.Add(s.config.RetentionWarning)), now)
+	}
+	deleteAt = latest(deleteAt, u.RetentionWarnedAt.Add(s.config.RetentionWarning))
+	if now.Before(deleteAt) {
+		return nil
+	}
+
+	deleted, err := s.deleteOutputs(ctx, u)
+	if err != nil {
+		return err
+	}
+	s.logger.Infof("Deleted the outputs of %d scenes of inactive user %s", deleted, u.ID.Hex())
+	return s.userManager.SetRetentionPurgedAt(ctx, u.ID, now)
+}
+
+// warnUser emails the user that their outputs will be deleted at deleteAt, then records the warning.
+// Users without a notification email can not be warned, and are recorded as warned so the rule still applies to them.
+func (s *RetentionService) warnUser(ctx context.Context, u *user.User, deleteAt, now time.Time) error {
+	if !s.hasOutputs(ctx, u) {
+		return nil
+	}
+
+	if to := u.NotificationEmail(); to != "" {
+		if err := s.mailer.Send(ctx, to, "Your NeRF-or-Nothing outputs will be deleted", formatRetentionWarning(u, deleteAt)); err != nil {
+			return err
+		}
+	} else {
+		s.logger.Infof("Inactive user %s has no notification email, outputs deleted without warning", u.ID.Hex())
+	}
+	return s.userManager.SetRetentionWarnedAt(ctx, u.ID, now)
+}
+
+// hasOutputs checks if any scene of the user still has outputs that the retention policy would delete.
+func (s *RetentionService) hasOutputs(ctx context.Context, u *user.User) bool {
+	for _, sceneID := range u.SceneIDs {
+		sc, err := s.sceneManager.GetScene(ctx, sceneID)
+		if err == nil && sc.Nerf != nil && sc.OutputsDeletedAt == nil && len(sc.OutputKeys()) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteOutputs deletes the nerf outputs of every scene of the user, from the artifact storage or the cold storage.
+//
+// Returns the number of scenes whose outputs were deleted, error if any scene could not be processed (i.e its outputs
+// are being archived or restored), in which case the remaining scenes are retried at the next check.
+func (s *RetentionService) deleteOutputs(ctx context.Context, u *user.User) (int, error) {
+	deleted := 0
+	var errs []error
+	for _, sceneID := range u.SceneIDs {
+		sc, err := s.sceneManager.GetScene(ctx, sceneID)
+		if errors.Is(err, scene.ErrSceneNotFound) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if sc.Nerf == nil || sc.OutputsDeletedAt != nil {
+			continue
+		}
+
+		store := s.storage
+		if sc.Archive != nil {
+			if sc.Archive.Status != scene.ArchiveStatusArchived || s.coldStorage == nil {
+				errs = append(errs, fmt.Errorf("scene %s: %w", sceneID.Hex(), scene.ErrArchiveConflict))
+				continue
+			}
+			store = s.coldStorage
+		}
+
+		// Outputs are unlinked before they are deleted, so a failed deletion never leaves dangling output paths
+		if err := s.sceneManager.MarkOutputsDeleted(ctx, sceneID); err != nil {
+			errs = append(errs, fmt.Errorf("scene %s: %w", sceneID.Hex(), err))
+			continue
+		}
+		for _, path := range sc.OutputKeys() {
+			key, err := storage.CleanKey(path)
+			if err != nil {
+				continue
+			}
+			if err := store.Delete(ctx, key); err != nil {
+				s.logger.Warnf("Failed to delete output %s: %v", key, err)
+			}
+		}
+		deleted++
+	}
+	return deleted, errors.Join(errs...)
+}
+
+// latest returns the later of two times.
+func latest(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// formatRetentionWarning renders the plain text body of a retention warning, with the deletion date in the user's timezone.
+func formatRetentionWarning(u *user.User, deleteAt time.Time) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Hi %s,\n\n", u.Username)
+	fmt.Fprintf(&b, "Your account has been inactive for a while. Under the retention policy of the %s tier, the outputs of your scenes\n", u.EffectiveTier())
+	fmt.Fprintf(&b, "will be deleted on %s.\n\n", deleteAt.In(u.Location()).Format("Jan 2, 2006 15:04 MST"))
+	b.WriteString("Log in before then to keep them. Your scenes and their videos are kept either way.\n")
+	return b.String()
+}
@@ -0,0 +1,101 @@
+// This file contains the access analytics of shared scenes, so creators sharing public links can see their engagement.
+//
+// Every request for a shared output records an anonymous event of the scene: no user, address or client is stored. Outputs
+// loaded by viewers count as views, outputs navigated to or fetched by non-browser clients as downloads, and the rendered
+// video as plays. Owners get the daily counts of their scenes.
+
+package services
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/event"
+)
+
+// sceneAccessTypes are the event types of accesses to shared scenes
+var sceneAccessTypes = []string{event.TypeSceneViewed, event.TypeSceneDownloaded, event.TypeScenePlayed}
+
+// SceneAccessCounts represents the number of accesses to a shared scene, by kind of access
+type SceneAccessCounts struct {
+	Views     int64 `json:"views"`
+	Downloads int64 `json:"downloads"`
+	Plays     int64 `json:"plays"`
+}
+
+// SceneAccessDay represents the accesses to a shared scene in a single UTC day
+type SceneAccessDay struct {
+	Day string `json:"day"`
+	SceneAccessCounts
+}
+
+// SceneAnalytics represents the accesses to a shared scene per day, oldest day first, and their totals
+type SceneAnalytics struct {
+	SceneID primitive.ObjectID `json:"scene_id"`
+	Days    []SceneAccessDay   `json:"days"`
+	Totals  SceneAccessCounts  `json:"totals"`
+}
+
+// RecordSharedAccess records an access to the given output type of the shared scene with the given ID. Navigated tells if
+// the output was requested as a file, instead of being loaded by a viewer.
+func (s *ClientService) RecordSharedAccess(ctx context.Context, sceneID primitive.ObjectID, outputType string, navigated bool) {
+	eventType := event.TypeSceneViewed
+	switch {
+	case outputType == "video":
+		eventType = event.TypeScenePlayed
+	case navigated:
+		eventType = event.TypeSceneDownloaded
+	}
+	recordEvent(ctx, s.eventManager, s.logger, eventType, sceneID, 0)
+}
+
+// GetSceneAnalytics returns the daily accesses to the shared scene with the given ID over the given window of whole days,
+// today included. Days without accesses are included with zero counts.
+//
+// Returns error if the scene does not exist, the user does not have access to it, ErrInvalidTrendWindow if the window is
+// outside of (0, 365] days, or an error occurred.
+func (s *ClientService) GetSceneAnalytics(ctx context.Context, userID, sceneID primitive.ObjectID, window time.Duration) (*SceneAnalytics, error) {
+	if window < 24*time.Hour || window > maxTrendWindow {
+		return nil, ErrInvalidTrendWindow
+	}
+	if err := s.authorizeScene(ctx, userID, sceneID); err != nil {
+		s.logger.Info("Scene access denied:", err.Error())
+		return nil, err
+	}
+
+	days := int(window / (24 * time.Hour))
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	since := today.AddDate(0, 0, -(days - 1))
+
+	counts, err := s.eventManager.GetSceneDailyCounts(ctx, sceneID, sceneAccessTypes, since)
+	if err != nil {
+		return nil, err
+	}
+
+	analytics := &SceneAnalytics{SceneID: sceneID, Days: make([]SceneAccessDay, days)}
+	byDay := make(map[string]*SceneAccessCounts, days)
+	for i := range analytics.Days {
+		analytics.Days[i].Day = since.AddDate(0, 0, i).Format(event.DayFormat)
+		byDay[analytics.Days[i].Day] = &analytics.Days[i].SceneAccessCounts
+	}
+	for _, count := range counts {
+		day, ok := byDay[count.Day]
+		if !ok {
+			continue
+		}
+		switch count.Type {
+		case event.TypeSceneViewed:
+			day.Views += count.Count
+			analytics.Totals.Views += count.Count
+		case event.TypeSceneDownloaded:
+			day.Downloads += count.Count
+			analytics.Totals.Downloads += count.Count
+		case event.TypeScenePlayed:
+			day.Plays += count.Count
+			analytics.Totals.Plays += count.Count
+		}
+	}
+	return analytics, nil
+}
@@ -0,0 +1,298 @@
+// This file contains the archival of scene outputs to cold storage.
+//
+// Archiving moves the nerf outputs of a completed scene (the large artifacts) from the artifact storage to the cold storage,
+// and restoring moves them back. Both run in the background: they are claimed through a conditional update of the scene's
+// archive state, so only one replica moves a scene at a time, and their progress is recorded on the scene for status reporting.
+// Operations that stop making progress (i.e their replica restarted) are resumed by the archive policy.
+//
+// Objects are copied before the source is deleted, so an interrupted operation never loses outputs.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/storage"
+)
+
+// ErrArchiveDisabled is returned when an archive operation is requested, but no cold storage is configured.
+var ErrArchiveDisabled = errors.New("scene archival is disabled")
+
+// archiveStaleAfter is how long an archive or restore may make no progress before another run takes it over
+const archiveStaleAfter = time.Hour
+
+// archivePolicyBatch is the maximum number of scenes archived by a single policy run
+const archivePolicyBatch = 50
+
+// ArchiveStatus is the archive state of a scene, as reported to its owner
+type ArchiveStatus struct {
+	// Status is hot (outputs served), archiving, archived or restoring
+	Status     string     `json:"status"`
+	Objects    int        `json:"objects"`
+	Moved      int        `json:"moved"`
+	Bytes      int64      `json:"bytes"`
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
+	RestoredAt *time.Time `json:"restored_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// ArchiveStatusHot is the ArchiveStatus of scenes whose outputs are in the artifact storage
+const ArchiveStatusHot = "hot"
+
+// GetArchiveStatus returns the archive state of the given scene.
+//
+// Returns error if the scene does not exist, the user does not have access to it, or an error occurred.
+func (s *ClientService) GetArchiveStatus(ctx context.Context, userID, sceneID primitive.ObjectID) (*ArchiveStatus, error) {
+	if err := s.authorizeScene(ctx, userID, sceneID); err != nil {
+		return nil, err
+	}
+	sc, err := s.sceneManager.GetScene(ctx, sceneID)
+	if err != nil {
+		return nil, err
+	}
+	return newArchiveStatus(sc), nil
+}
+
+// ArchiveScene starts moving the outputs of the given completed scene to cold storage.
+//
+// Returns the archive state once the move started, ErrArchiveDisabled if no cold storage is configured,
+// scene.ErrNerfNotFound if the scene is not completed, scene.ErrArchiveConflict if it is already (being) archived or restored.
+func (s *ClientService) ArchiveScene(ctx context.Context, userID, sceneID primitive.ObjectID) (*ArchiveStatus, error) {
+	if s.coldStorage == nil {
+		return nil, ErrArchiveDisabled
+	}
+	if err := s.authorizeScene(ctx, userID, sceneID); err != nil {
+		return nil, err
+	}
+
+	if err := s.beginArchive(ctx, sceneID, time.Time{}); err != nil {
+		return nil, err
+	}
+	return s.GetArchiveStatus(ctx, userID, sceneID)
+}
+
+// RestoreScene starts moving the outputs of the given archived scene back from cold storage.
+// The outputs are served again once the status is hot.
+//
+// Returns the archive state once the move started, scene.ErrArchiveConflict if the scene is not archived.
+func (s *ClientService) RestoreScene(ctx context.Context, userID, sceneID primitive.ObjectID) (*ArchiveStatus, error) {
+	if s.coldStorage == nil {
+		return nil, ErrArchiveDisabled
+	}
+	if err := s.authorizeScene(ctx, userID, sceneID); err != nil {
+		return nil, err
+	}
+
+	claimed, err := s.sceneManager.TransitionArchive(ctx, sceneID, scene.ArchiveStatusArchived, scene.ArchiveStatusRestoring, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, scene.ErrArchiveConflict
+	}
+	go s.restore(context.Background(), sceneID)
+
+	return s.GetArchiveStatus(ctx, userID, sceneID)
+}
+
+// RunArchivePolicy archives the completed scenes older than the configured age every interval, and resumes stale
+// archives and restores, until the context is cancelled. Claims are conditional, so every replica may run it.
+func (s *ClientService) RunArchivePolicy(ctx context.Context, interval time.Duration) {
+	if s.coldStorage == nil {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		staleBefore := time.Now().UTC().Add(-archiveStaleAfter)
+		stale, err := s.sceneManager.ListStaleArchives(ctx, scene.ArchiveStatusArchiving, staleBefore)
+		if err != nil {
+			s.logger.Errorf("Failed to list stale archives: %v", err)
+		}
+		for _, id := range stale {
+			if err := s.beginArchive(ctx, id, staleBefore); err != nil && !errors.Is(err, scene.ErrArchiveConflict) {
+				s.logger.Warnf("Failed to resume archive of scene %s: %v", id.Hex(), err)
+			}
+		}
+
+		stale, err = s.sceneManager.ListStaleArchives(ctx, scene.ArchiveStatusRestoring, staleBefore)
+		if err != nil {
+			s.logger.Errorf("Failed to list stale restores: %v", err)
+		}
+		for _, id := range stale {
+			claimed, err := s.sceneManager.TransitionArchive(ctx, id, scene.ArchiveStatusArchived, scene.ArchiveStatusRestoring, staleBefore)
+			if err != nil {
+				s.logger.Warnf("Failed to resume restore of scene %s: %v", id.Hex(), err)
+			} else if claimed {
+				go s.restore(context.Background(), id)
+			}
+		}
+
+		if s.config.ArchiveAfter == 0 {
+			continue
+		}
+		candidates, err := s.sceneManager.ListArchiveCandidates(ctx, time.Now().UTC().Add(-s.config.ArchiveAfter), archivePolicyBatch)
+		if err != nil {
+			s.logger.Errorf("Failed to list scenes to archive: %v", err)
+			continue
+		}
+		for _, id := range candidates {
+			if err := s.beginArchive(ctx, id, time.Time{}); err != nil && !errors.Is(err, scene.ErrArchiveConflict) {
+				s.logger.Warnf("Failed to archive scene %s: %v", id.Hex(), err)
+			}
+		}
+	}
+}
+
+// beginArchive claims the archive of a scene, taking over archives stuck since before staleBefore, and starts the move.
+func (s *ClientService) beginArchive(ctx context.Context, sceneID primitive.ObjectID, staleBefore time.Time) error {
+	sc, err := s.sceneManager.GetScene(ctx, sceneID)
+	if err != nil {
+		return err
+	}
+	if sc.Nerf == nil {
+		return scene.ErrNerfNotFound
+	}
+
+	keys := make([]string, 0)
+	var bytes int64
+	for _, path := range sc.OutputKeys() {
+		key, err := storage.CleanKey(path)
+		if err != nil {
+			return err
+		}
+		info, err := s.storage.Stat(ctx, key)
+		if err != nil {
+			return fmt.Errorf("failed to stat output %s: %w", key, err)
+		}
+		keys = append(keys, key)
+		bytes += info.Size
+	}
+
+	claimed, err := s.sceneManager.BeginArchive(ctx, sceneID, keys, bytes, staleBefore)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return scene.ErrArchiveConflict
+	}
+	go s.archive(context.Background(), sceneID)
+	return nil
+}
+
+// archive copies the claimed outputs of a scene to cold storage, marks the scene archived, then deletes the hot copies.
+// On failure the archive is cleared, so the scene stays hot and can be archived again.
+func (s *ClientService) archive(ctx context.Context, sceneID primitive.ObjectID) {
+	sc, err := s.sceneManager.GetScene(ctx, sceneID)
+	if err != nil || sc.Archive == nil {
+		s.logger.Warnf("Failed to load archive of scene %s: %v", sceneID.Hex(), err)
+		return
+	}
+
+	if err := s.moveObjects(ctx, sceneID, scene.ArchiveStatusArchiving, sc.Archive.Keys, s.storage, s.coldStorage); err != nil {
+		s.logger.Errorf("Failed to archive scene %s: %v", sceneID.Hex(), err)
+		if err := s.sceneManager.ClearArchive(ctx, sceneID, scene.ArchiveStatusArchiving); err != nil {
+			s.logger.Warnf("Failed to reset archive of scene %s: %v", sceneID.Hex(), err)
+		}
+		return
+	}
+
+	done, err := s.sceneManager.TransitionArchive(ctx, sceneID, scene.ArchiveStatusArchiving, scene.ArchiveStatusArchived, time.Time{})
+	if err != nil || !done {
+		s.logger.Warnf("Failed to mark scene %s archived: %v", sceneID.Hex(), err)
+		return
+	}
+	s.deleteObjects(ctx, s.storage, sc.Archive.Keys)
+	s.logger.Infof("Archived %d outputs of scene %s", len(sc.Archive.Keys), sceneID.Hex())
+}
+
+// restore copies the archived outputs of a scene back to the artifact storage, marks the scene hot, then deletes the cold copies.
+// On failure the scene stays archived, with the reason reported in its archive status.
+func (s *ClientService) restore(ctx context.Context, sceneID primitive.ObjectID) {
+	sc, err := s.sceneManager.GetScene(ctx, sceneID)
+	if err != nil || sc.Archive == nil {
+		s.logger.Warnf("Failed to load archive of scene %s: %v", sceneID.Hex(), err)
+		return
+	}
+
+	if err := s.moveObjects(ctx, sceneID, scene.ArchiveStatusRestoring, sc.Archive.Keys, s.coldStorage, s.storage); err != nil {
+		s.logger.Errorf("Failed to restore scene %s: %v", sceneID.Hex(), err)
+		if err := s.sceneManager.FailRestore(ctx, sceneID, err.Error()); err != nil {
+			s.logger.Warnf("Failed to record failed restore of scene %s: %v", sceneID.Hex(), err)
+		}
+		return
+	}
+
+	if err := s.sceneManager.ClearArchive(ctx, sceneID, scene.ArchiveStatusRestoring); err != nil {
+		s.logger.Warnf("Failed to mark scene %s restored: %v", sceneID.Hex(), err)
+		return
+	}
+	s.deleteObjects(ctx, s.coldStorage, sc.Archive.Keys)
+	s.logger.Infof("Restored %d outputs of scene %s", len(sc.Archive.Keys), sceneID.Hex())
+}
+
+// moveObjects copies every key from src to dst, recording the progress of the operation in the given status.
+func (s *ClientService) moveObjects(ctx context.Context, sceneID primitive.ObjectID, status string, keys []string, src, dst storage.Storage) error {
+	for i, key := range keys {
+		if err := copyObject(ctx, src, dst, key); err != nil {
+			return fmt.Errorf("failed to copy %s: %w", key, err)
+		}
+		if err := s.sceneManager.SetArchiveProgress(ctx, sceneID, status, i+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteObjects deletes the given keys from store, logging instead of returning any error.
+func (s *ClientService) deleteObjects(ctx context.Context, store storage.Storage, keys []string) {
+	for _, key := range keys {
+		if err := store.Delete(ctx, key); err != nil {
+			s.logger.Warnf("Failed to delete %s from %s storage: %v", key, store.Backend(), err)
+		}
+	}
+}
+
+// copyObject streams the object stored under key in src to the same key in dst.
+func copyObject(ctx context.Context, src, dst storage.Storage, key string) error {
+	info, err := src.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	r, err := src.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return dst.Put(ctx, key, r, info.Size)
+}
+
+// newArchiveStatus reports the archive state of a scene.
+func newArchiveStatus(sc *scene.Scene) *ArchiveStatus {
+	if sc.Archive == nil {
+		return &ArchiveStatus{Status: ArchiveStatusHot, RestoredAt: sc.RestoredAt}
+	}
+	return &ArchiveStatus{
+		Status:     sc.Archive.Status,
+		Objects:    len(sc.Archive.Keys),
+		Moved:      sc.Archive.Moved,
+		Bytes:      sc.Archive.Bytes,
+		ArchivedAt: sc.Archive.ArchivedAt,
+		RestoredAt: sc.RestoredAt,
+		Error:      sc.Archive.Error,
+	}
+}
@@ -0,0 +1,232 @@
+// This file contains the SceneCallbacks, notifying the webhook attached to a scene at upload time of its stage transitions.
+//
+// Automation pipelines submitting scenes programmatically attach a callback URL and secret to each scene, instead of polling
+// its progress. Every stage transition POSTs a JSON SceneCallbackEvent to the URL, signed as a hex HMAC-SHA256 of the body with
+// the secret of the scene in the X-Scene-Callback-Signature header. As with the artifact hooks, deliveries are asynchronous and
+// best-effort: failures are logged, and events are dropped while too many are pending. Each run of a scene ends with a
+// single terminal event, scene.completed, scene.failed or scene.cancelled, as a failed stage stops the pipeline of its scene.
+//
+// Callback URLs are chosen by users, so they are validated against server-side request forgery: only https URLs resolving to
+// public addresses are accepted, unless SCENE_CALLBACK_ALLOW_PRIVATE is set. The address is checked again when connecting, so
+// a host re-resolving to a private address after validation is refused, and redirects are never followed.
+
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+)
+
+// Custom errors
+var (
+	// ErrInvalidCallback is returned when a scene is submitted with a callback URL or secret that can not be used.
+	ErrInvalidCallback = errors.New("invalid scene callback")
+)
+
+// Declarations for scene callback events
+const (
+	CallbackEventQueued       = "scene.queued"
+	CallbackEventSfmCompleted = "scene.sfm_completed"
+	CallbackEventCompleted    = "scene.completed"
+	CallbackEventFailed       = "scene.failed"
+	CallbackEventCancelled    = "scene.cancelled"
+)
+
+const (
+	// maxPendingSceneCallbacks is the number of events waiting for delivery before new events are dropped
+	maxPendingSceneCallbacks = 1024
+	// sceneCallbackWorkers is the number of concurrent deliveries, so a slow webhook does not delay those of other scenes
+	sceneCallbackWorkers = 4
+	// MinCallbackSecretLength is the minimum length of the secret signing the callbacks of a scene
+	MinCallbackSecretLength = 16
+)
+
+// blockedAddrPrefixes are the special-purpose ranges not covered by the netip.Addr predicates that are not public
+var blockedAddrPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+// SceneCallbackEvent is the payload of a scene callback
+type SceneCallbackEvent struct {
+	Event         string    `json:"event"`
+	SceneID       string    `json:"scene_id"`
+	FailureReason string    `json:"failure_reason,omitempty"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// SceneCallbacks delivers the stage transitions of scenes to their callback, if they have one.
+type SceneCallbacks struct {
+	sceneManager *scene.SceneManager
+	client       *http.Client
+	allowPrivate bool
+	events       chan SceneCallbackEvent
+	logger       *log.Logger
+}
+
+// NewSceneCallbacks creates a new SceneCallbacks, and starts the workers delivering its events.
+func NewSceneCallbacks(sm *scene.SceneManager, cfg *config.Config, logger *log.Logger) *SceneCallbacks {
+	c := &SceneCallbacks{
+		sceneManager: sm,
+		allowPrivate: cfg.SceneCallbackAllowPrivate,
+		events:       make(chan SceneCallbackEvent, maxPendingSceneCallbacks),
+		logger:       logger,
+	}
+	dialer := &net.Dialer{Timeout: cfg.SceneCallbackTimeout, Control: c.checkDial}
+	c.client = &http.Client{
+		Timeout:   cfg.SceneCallbackTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: cfg.SceneCallbackTimeout},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	for range sceneCallbackWorkers {
+		go c.run()
+	}
+	return c
+}
+
+// ValidateCallback checks if a scene may be submitted with the given callback: the URL must be an absolute https URL
+// without credentials whose host resolves to public addresses only (http and private addresses are accepted if allowed),
+// and the secret must be at least MinCallbackSecretLength long.
+//
+// Returns ErrInvalidCallback otherwise.
+func (c *SceneCallbacks) ValidateCallback(ctx context.Context, rawURL, secret string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("%w: malformed URL", ErrInvalidCallback)
+	}
+	if u.Scheme != "https" && !(u.Scheme == "http" && c.allowPrivate) {
+		return fmt.Errorf("%w: unsupported scheme %q", ErrInvalidCallback, u.Scheme)
+	}
+	if u.Host == "" || u.User != nil {
+		return fmt.Errorf("%w: URL must have a host and no credentials", ErrInvalidCallback)
+	}
+	if len(secret) < MinCallbackSecretLength {
+		return fmt.Errorf("%w: secret must be at least %d characters", ErrInvalidCallback, MinCallbackSecretLength)
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", u.Hostname())
+	if err != nil || len(addrs) == 0 {
+		return fmt.Errorf("%w: host %s does not resolve", ErrInvalidCallback, u.Hostname())
+	}
+	for _, addr := range addrs {
+		if !c.allowedAddr(addr) {
+			return fmt.Errorf("%w: host %s resolves to a non-public address", ErrInvalidCallback, u.Hostname())
+		}
+	}
+	return nil
+}
+
+// allowedAddr checks if callbacks may connect to the given address.
+func (c *SceneCallbacks) allowedAddr(addr netip.Addr) bool {
+	return c.allowPrivate || isPublicAddr(addr)
+}
+
+// isPublicAddr checks if the given address is a public unicast address, which user-chosen URLs may be requested from.
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() {
+		return false
+	}
+	for _, prefix := range blockedAddrPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkDial refuses connections to addresses callbacks may not reach, after the host was resolved for the connection.
+func (c *SceneCallbacks) checkDial(network, address string, conn syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !c.allowedAddr(addrPort.Addr()) {
+		return fmt.Errorf("%w: refused to connect to non-public address %s", ErrInvalidCallback, addrPort.Addr())
+	}
+	return nil
+}
+
+// Notify queues an event of the scene with the given ID for its callback, dropping it if too many events are pending.
+// The failure reason is only sent with CallbackEventFailed. Scenes without a callback are skipped on delivery.
+func (c *SceneCallbacks) Notify(sceneID primitive.ObjectID, event, failureReason string) {
+	e := SceneCallbackEvent{Event: event, SceneID: sceneID.Hex(), FailureReason: failureReason, Timestamp: time.Now().UTC()}
+	select {
+	case c.events <- e:
+	default:
+		c.logger.Warnf("Dropped %s callback of scene %s, too many callbacks pending", event, sceneID.Hex())
+	}
+}
+
+// run delivers the queued events, forever.
+func (c *SceneCallbacks) run() {
+	for e := range c.events {
+		if err := c.deliver(e); err != nil {
+			c.logger.Warnf("Callback failed for %s of scene %s: %v", e.Event, e.SceneID, err)
+		}
+	}
+}
+
+// deliver sends an event to the callback of its scene, if it has one. Any non 2xx response is an error.
+func (c *SceneCallbacks) deliver(e SceneCallbackEvent) error {
+	sceneID, err := primitive.ObjectIDFromHex(e.SceneID)
+	if err != nil {
+		return err
+	}
+	callback, err := c.sceneManager.GetCallback(context.Background(), sceneID)
+	if err != nil {
+		return err
+	}
+	if callback == nil {
+		return nil
+	}
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, callback.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, []byte(callback.Secret))
+	mac.Write(body)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Scene-Callback-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
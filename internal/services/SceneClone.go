@@ -0,0 +1,205 @@
+// This file contains the scene clones of the UploadService.
+//
+// Cloning a scene creates a new scene of the same user trained with other training values, without uploading the video again.
+// The raw videos and the structure from motion frames of the source scene are copied to the keys of the clone, so the clone
+// stays independent of its source (which may be deleted, archived or replayed meanwhile). When the source has a structure
+// from motion result, only the training stage of the clone runs, otherwise the whole pipeline runs from the copied videos.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"path"
+	"slices"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/event"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/user"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/storage"
+)
+
+// Custom errors
+var (
+	// ErrCloneUnavailable is returned when cloning a scene whose video and structure from motion result are both unavailable.
+	ErrCloneUnavailable = errors.New("scene has no video or structure from motion result to clone")
+)
+
+// CloneScene creates a new scene of the user from an existing scene of theirs, trained with the given training values,
+// and starts its processing with the first stage it needs.
+//
+// Values that are not provided are inherited from the source scene: its name, training mode and total iterations, its
+// output types unless the training mode changes, and its save iterations unless the total iterations change. Values
+// the source does not have default like a new scene. Guests are limited by the guest quota.
+//
+// Returns the ID of the clone if successful, scene.ErrSceneNotFound / user.ErrUserNoAccess if the source scene does not exist
+// or belongs to another user, ErrCloneUnavailable if nothing of the source can be reused, errors of SubmitScene otherwise.
+func (s *UploadService) CloneScene(ctx context.Context, userID, sourceID primitive.ObjectID, submission SceneSubmission) (primitive.ObjectID, error) {
+	source, err := s.getCloneSource(ctx, userID, sourceID)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	cloneID := primitive.NewObjectID()
+	submitter, clone, err := s.validate(ctx, userID, cloneID, inheritSubmission(source, submission))
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	// The videos are kept for replays of the clone, even if its structure from motion result is reused. The clone can only
+	// run its structure from motion stage if every video of the source was copied
+	var copied int64
+	videoCopied := len(source.Videos) > 0
+	if videoCopied {
+		clone.Videos = make([]*scene.Video, 0, len(source.Videos))
+	}
+	for i, input := range source.Videos {
+		video := *input
+		video.FilePath = inputKey(clone.Tenant, cloneID, i, path.Ext(input.FilePath))
+		clone.Videos = append(clone.Videos, &video)
+
+		n, err := s.copyObject(ctx, input.FilePath, video.FilePath)
+		if err != nil && !errors.Is(err, storage.ErrObjectNotFound) {
+			s.discardVideo(ctx, clone.Tenant, cloneID)
+			return primitive.NilObjectID, err
+		}
+		videoCopied = videoCopied && err == nil
+		copied += n
+	}
+	sfm, n := s.copySfm(ctx, source, clone)
+	clone.Sfm = sfm
+	if sfm != nil {
+		clone.ThumbnailFrame = source.ThumbnailFrame
+	}
+	copied += n
+
+	if !videoCopied && sfm == nil {
+		return primitive.NilObjectID, ErrCloneUnavailable
+	}
+	if err := s.submit(ctx, submitter, clone); err != nil {
+		s.discardClone(ctx, clone)
+		return primitive.NilObjectID, err
+	}
+
+	recordEvent(ctx, s.eventManager, s.logger, event.TypeArtifactStored, cloneID, copied)
+	s.logger.Infof("Scene %s cloned from scene %s by user %s", cloneID.Hex(), sourceID.Hex(), userID.Hex())
+	return cloneID, nil
+}
+
+// getCloneSource returns the scene to clone, if the given user may access it. Scenes in the trash are not found.
+func (s *UploadService) getCloneSource(ctx context.Context, userID, sourceID primitive.ObjectID) (*scene.Scene, error) {
+	authorized, err := s.userManager.UserHasJobAccess(ctx, userID, sourceID)
+	if err != nil {
+		return nil, err
+	}
+	if !authorized {
+		return nil, user.ErrUserNoAccess
+	}
+
+	source, err := s.sceneManager.GetScene(ctx, sourceID)
+	if err != nil {
+		return nil, err
+	}
+	if source.DeletedAt != nil {
+		return nil, scene.ErrSceneNotFound
+	}
+	return source, nil
+}
+
+// inheritSubmission fills the training values missing from a clone submission with those of the source scene.
+func inheritSubmission(source *scene.Scene, submission SceneSubmission) SceneSubmission {
+	if submission.Name == "" {
+		submission.Name = source.Name
+	}
+	if source.Config == nil || source.Config.NerfTrainingConfig == nil {
+		return submission
+	}
+
+	nerfConfig := source.Config.NerfTrainingConfig
+	if submission.TrainingMode == "" || submission.TrainingMode == nerfConfig.TrainingMode {
+		submission.TrainingMode = nerfConfig.TrainingMode
+		if len(submission.OutputTypes) == 0 {
+			submission.OutputTypes = slices.Clone(nerfConfig.OutputTypes)
+		}
+	}
+	if submission.TotalIterations == 0 || submission.TotalIterations == nerfConfig.TotalIterations {
+		submission.TotalIterations = nerfConfig.TotalIterations
+		if len(submission.SaveIterations) == 0 {
+			submission.SaveIterations = slices.Clone(nerfConfig.SaveIterations)
+		}
+	}
+	return submission
+}
+
+// copySfm copies the frames of the structure from motion result of the source scene to the given clone.
+// Results of scenes that failed are not reused, unless the scene was cancelled.
+//
+// Returns the result referencing the copied frames and the number of bytes copied, nil if the source has no reusable result
+// or one of its frames could not be copied, in which case the clone runs its structure from motion stage again.
+func (s *UploadService) copySfm(ctx context.Context, source, clone *scene.Scene) (*scene.Sfm, int64) {
+	if source.Sfm == nil || len(source.Sfm.Frames) == 0 {
+		return nil, 0
+	}
+	if source.FailureReason != "" && source.FailureReason != scene.FailureReasonCancelled {
+		return nil, 0
+	}
+
+	sfm := *source.Sfm
+	sfm.Frames = slices.Clone(source.Sfm.Frames)
+	var copied int64
+	for i, frame := range sfm.Frames {
+		key := storage.TenantKey(clone.Tenant, storage.SfmFrameKey(clone.ID.Hex(), path.Base(frame.FilePath)))
+		n, err := s.copyObject(ctx, frame.FilePath, key)
+		if err != nil {
+			s.logger.Infof("Structure from motion result of scene %s not reused: %v", source.ID.Hex(), err)
+			s.deleteFrames(ctx, sfm.Frames[:i])
+			return nil, 0
+		}
+		sfm.Frames[i].FilePath = key
+		copied += n
+	}
+	return &sfm, copied
+}
+
+// copyObject copies the object stored under the given key of artifact storage to another key.
+//
+// Returns the number of bytes copied, storage.ErrObjectNotFound if the object does not exist.
+func (s *UploadService) copyObject(ctx context.Context, from, to string) (int64, error) {
+	key, err := storage.CleanKey(from)
+	if err != nil {
+		return 0, err
+	}
+	info, err := s.storage.Stat(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	object, err := s.storage.Open(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	defer object.Close()
+
+	if err := s.storage.Put(ctx, to, object, info.Size); err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+// discardClone removes the videos and frames copied for a clone that could not be submitted.
+func (s *UploadService) discardClone(ctx context.Context, clone *scene.Scene) {
+	s.discardVideo(ctx, clone.Tenant, clone.ID)
+	if clone.Sfm != nil {
+		s.deleteFrames(ctx, clone.Sfm.Frames)
+	}
+}
+
+// deleteFrames removes the given frames from artifact storage, logging instead of returning any error.
+func (s *UploadService) deleteFrames(ctx context.Context, frames []scene.Frame) {
+	for _, frame := range frames {
+		if err := s.storage.Delete(ctx, frame.FilePath); err != nil {
+			s.logger.Warnf("Failed to remove copied frame %s: %v", frame.FilePath, err)
+		}
+	}
+}
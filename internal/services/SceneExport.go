@@ -0,0 +1,260 @@
+// This file contains the scene exports of the ClientService.
+//
+// An export is a single zip or tar archive of a scene, for users moving their scenes to other tools: the raw videos, the
+// structure from motion frames, the selected nerf outputs, and a scene.json manifest with the training configuration and
+// the camera poses, whose file paths refer to the files of the archive.
+//
+// Exports are prepared and written in two steps, so missing scenes and invalid selections are reported before the response starts.
+// The archive is then assembled on the fly while it is sent, streaming one object at a time from storage, so its size is not
+// bounded by memory. An export failing while it is written can only be truncated, and is logged.
+
+package services
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"path"
+	"slices"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/storage"
+)
+
+// Declarations for valid export formats
+const (
+	ExportFormatZip = "zip"
+	ExportFormatTar = "tar"
+)
+
+// exportManifestName is the name of the manifest of an export, in its root directory
+const exportManifestName = "scene.json"
+
+// exportOutputTypes are the output types exported when none is selected, in the order they are written
+var exportOutputTypes = []string{"splat_cloud", "point_cloud", "model", "video"}
+
+// SceneExport is a scene export ready to be written.
+type SceneExport struct {
+	SceneID primitive.ObjectID
+	Format  string
+	// entries are the stored objects of the export, and manifest the contents of its scene.json
+	entries  []exportEntry
+	manifest []byte
+}
+
+// exportEntry is a stored object written to an export under the given name
+type exportEntry struct {
+	name string
+	info *storage.ObjectInfo
+}
+
+// exportManifest is the scene.json of an export. File paths are relative to the root directory of the archive.
+type exportManifest struct {
+	ID         string                    `json:"id"`
+	Name       string                    `json:"name"`
+	Videos     []*scene.Video            `json:"videos,omitempty"`
+	Config     *scene.TrainingConfig     `json:"config,omitempty"`
+	Sfm        *scene.Sfm                `json:"sfm,omitempty"`
+	Outputs    map[string]map[int]string `json:"outputs,omitempty"`
+	ExportedAt time.Time                 `json:"exported_at"`
+}
+
+// FileName returns the name the export is downloaded as.
+func (e *SceneExport) FileName() string {
+	return e.SceneID.Hex() + "." + e.Format
+}
+
+// PrepareSceneExport lists the files of an export of the given scene in the given format (zip or tar). The outputs of the
+// given types are included, every output of the scene if none is given, in which case outputs that are not available
+// (i.e the scene is still processing, or its outputs are archived) are left out. Objects missing from storage are left out.
+//
+// Returns the export if successful, scene.ErrSceneNotFound / user.ErrUserNoAccess if the scene does not exist or belongs to
+// another user, and for selected output types the errors of the output route (scene.ErrSceneArchived, scene.ErrOutputsDeleted,
+// scene.ErrNerfNotFound, scene.ErrNoOutputPaths).
+func (s *ClientService) PrepareSceneExport(ctx context.Context, userID, sceneID primitive.ObjectID, format string, outputTypes []string) (*SceneExport, error) {
+	if err := s.authorizeScene(ctx, userID, sceneID); err != nil {
+		return nil, err
+	}
+	sc, err := s.sceneManager.GetScene(ctx, sceneID)
+	if err != nil {
+		return nil, err
+	}
+
+	export := &SceneExport{SceneID: sceneID, Format: format}
+	manifest := exportManifest{ID: sceneID.Hex(), Name: sc.Name, Config: sc.Config, ExportedAt: time.Now().UTC()}
+
+	for i, input := range sc.Videos {
+		name := "video"
+		if i > 0 {
+			name = fmt.Sprintf("video-%d", i)
+		}
+		video := *input
+		video.FilePath = s.addExportEntry(ctx, export, name+path.Ext(input.FilePath), input.FilePath)
+		manifest.Videos = append(manifest.Videos, &video)
+	}
+	if sc.Sfm != nil {
+		sfm := *sc.Sfm
+		sfm.Frames = slices.Clone(sc.Sfm.Frames)
+		for i, frame := range sfm.Frames {
+			sfm.Frames[i].FilePath = s.addExportEntry(ctx, export, path.Join("sfm", path.Base(frame.FilePath)), frame.FilePath)
+		}
+		manifest.Sfm = &sfm
+	}
+
+	outputs, err := exportOutputs(sc, outputTypes)
+	if err != nil {
+		return nil, err
+	}
+	for _, outputType := range exportOutputTypes {
+		paths := outputs[outputType]
+		for _, iteration := range slices.Sorted(maps.Keys(paths)) {
+			key := paths[iteration]
+			name := path.Join("outputs", outputType, "iteration_"+strconv.Itoa(iteration), path.Base(key))
+			if name = s.addExportEntry(ctx, export, name, key); name == "" {
+				continue
+			}
+			if manifest.Outputs == nil {
+				manifest.Outputs = make(map[string]map[int]string)
+			}
+			if manifest.Outputs[outputType] == nil {
+				manifest.Outputs[outputType] = make(map[int]string)
+			}
+			manifest.Outputs[outputType][iteration] = name
+		}
+	}
+
+	export.manifest, err = json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return export, nil
+}
+
+// exportOutputs returns the output file paths of the given types of a scene, by type and iteration, or of every type
+// if none is given.
+func exportOutputs(sc *scene.Scene, outputTypes []string) (map[string]map[int]string, error) {
+	selected := len(outputTypes) > 0
+	switch {
+	case sc.OutputsDeletedAt != nil:
+		if selected {
+			return nil, scene.ErrOutputsDeleted
+		}
+		return nil, nil
+	case sc.Archive != nil && sc.Archive.Status != scene.ArchiveStatusArchiving:
+		if selected {
+			return nil, scene.ErrSceneArchived
+		}
+		return nil, nil
+	case sc.Nerf == nil:
+		if selected {
+			return nil, scene.ErrNerfNotFound
+		}
+		return nil, nil
+	}
+
+	if !selected {
+		outputTypes = exportOutputTypes
+	}
+	outputs := make(map[string]map[int]string)
+	for _, outputType := range outputTypes {
+		paths, err := sc.Nerf.GetFilePathsForType(outputType)
+		if err != nil {
+			return nil, err
+		}
+		if len(paths) == 0 && selected {
+			return nil, fmt.Errorf("%w: %s", scene.ErrNoOutputPaths, outputType)
+		}
+		if len(paths) > 0 {
+			outputs[outputType] = paths
+		}
+	}
+	return outputs, nil
+}
+
+// addExportEntry adds the object stored under key to the export, under the given name in the root directory of the archive.
+//
+// Returns the name of the entry relative to the root directory, "" if the object is missing or can not be read.
+func (s *ClientService) addExportEntry(ctx context.Context, export *SceneExport, name, key string) string {
+	info, err := s.storage.Stat(ctx, key)
+	if err != nil {
+		if !errors.Is(err, storage.ErrObjectNotFound) {
+			s.logger.Warnf("Leaving %s out of the export of scene %s: %v", key, export.SceneID.Hex(), err)
+		}
+		return ""
+	}
+	export.entries = append(export.entries, exportEntry{name: name, info: info})
+	return name
+}
+
+// WriteSceneExport writes the archive of a prepared export to w, one object at a time.
+//
+// Returns error if an object could not be read or the archive could not be written, in which case the archive is truncated.
+func (s *ClientService) WriteSceneExport(ctx context.Context, w io.Writer, export *SceneExport) error {
+	root := export.SceneID.Hex()
+	switch export.Format {
+	case ExportFormatZip:
+		zw := zip.NewWriter(w)
+		manifest, err := zw.CreateHeader(&zip.FileHeader{Name: path.Join(root, exportManifestName), Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			return err
+		}
+		if _, err := manifest.Write(export.manifest); err != nil {
+			return err
+		}
+		for _, entry := range export.entries {
+			// Videos, frames and outputs are mostly compressed already, so they are stored as is
+			fw, err := zw.CreateHeader(&zip.FileHeader{Name: path.Join(root, entry.name), Method: zip.Store, Modified: entry.info.ModTime})
+			if err != nil {
+				return err
+			}
+			if err := s.copyExportEntry(ctx, fw, entry); err != nil {
+				return err
+			}
+		}
+		return zw.Close()
+	case ExportFormatTar:
+		tw := tar.NewWriter(w)
+		header := &tar.Header{Name: path.Join(root, exportManifestName), Mode: 0o644, Size: int64(len(export.manifest)), ModTime: time.Now()}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(export.manifest); err != nil {
+			return err
+		}
+		for _, entry := range export.entries {
+			header := &tar.Header{Name: path.Join(root, entry.name), Mode: 0o644, Size: entry.info.Size, ModTime: entry.info.ModTime}
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			if err := s.copyExportEntry(ctx, tw, entry); err != nil {
+				return err
+			}
+		}
+		return tw.Close()
+	default:
+		return fmt.Errorf("unknown export format %q", export.Format)
+	}
+}
+
+// copyExportEntry copies the object of an entry to w. Exactly the size the object had when the export was prepared is copied,
+// as tar headers are written before their contents.
+func (s *ClientService) copyExportEntry(ctx context.Context, w io.Writer, entry exportEntry) error {
+	object, err := s.storage.Open(ctx, entry.info.Key)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", entry.info.Key, err)
+	}
+	defer object.Close()
+	if _, err := io.CopyN(w, object, entry.info.Size); err != nil {
+		return fmt.Errorf("failed to copy %s: %w", entry.info.Key, err)
+	}
+	return nil
+}
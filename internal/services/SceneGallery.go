@@ -0,0 +1,114 @@
+// This file contains the visibility of scenes and the public gallery, a community showcase of the scenes users chose to publish.
+//
+// Scenes are private unless their user makes them unlisted or public. Anyone can view the thumbnail and outputs of unlisted
+// and public scenes without an account, and completed public scenes are listed in the gallery of their tenant, newest first.
+// Unlike share links, the visibility of a scene does not expire, and making the scene private again revokes access at once.
+// Accesses to the outputs of visible scenes are counted for the analytics of the owner, like share links.
+
+package services
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/pagination"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+)
+
+// GalleryScene summarizes a completed public scene for the gallery
+type GalleryScene struct {
+	ID              primitive.ObjectID `json:"id"`
+	Name            string             `json:"name"`
+	CreatedAt       time.Time          `json:"created_at"`
+	HasThumbnail    bool               `json:"has_thumbnail"`
+	OutputTypes     []string           `json:"output_types"`
+	LatestIteration int                `json:"latest_iteration"`
+}
+
+// SetSceneVisibility changes who can see the scene with the given ID, one of the scene.Visibility declarations.
+// Guests can only keep their scenes private, as their scenes are removed with their session.
+//
+// Returns error if the scene does not exist, the user does not have access to it, ErrGuestRestricted if the user is a guest
+// publishing a scene, or an error occurred.
+func (s *ClientService) SetSceneVisibility(ctx context.Context, userID, sceneID primitive.ObjectID, visibility string) error {
+	if err := s.authorizeScene(ctx, userID, sceneID); err != nil {
+		s.logger.Info("Scene access denied:", err.Error())
+		return err
+	}
+
+	if visibility != scene.VisibilityPrivate {
+		u, err := s.userManager.GetUserByID(ctx, userID)
+		if err != nil {
+			return err
+		}
+		if u.Guest {
+			return ErrGuestRestricted
+		}
+	}
+
+	return s.sceneManager.SetVisibility(ctx, sceneID, visibility)
+}
+
+// ListPublicScenes returns the given page of the gallery of the given tenant, and the cursor of the next page.
+//
+// Returns error if an error occurred.
+func (s *ClientService) ListPublicScenes(ctx context.Context, tenant string, page pagination.Page) ([]GalleryScene, string, error) {
+	scenes, next, err := s.sceneManager.PagePublicScenes(ctx, tenant, page)
+	if err != nil {
+		return nil, "", err
+	}
+
+	gallery := make([]GalleryScene, len(scenes))
+	for i, sc := range scenes {
+		version := newSceneVersion(sc.Nerf)
+		_, err := sceneThumbnailKey(sc)
+		gallery[i] = GalleryScene{
+			ID:              sc.ID,
+			Name:            sc.Name,
+			CreatedAt:       sc.ID.Timestamp().UTC(),
+			HasThumbnail:    err == nil,
+			OutputTypes:     version.OutputTypes,
+			LatestIteration: version.LatestIteration,
+		}
+	}
+	return gallery, next, nil
+}
+
+// GetPublicSceneThumbnailKey returns the storage key of the thumbnail of the unlisted or public scene with the given ID.
+//
+// Returns scene.ErrSceneNotFound if the scene does not exist, is private or belongs to another tenant, error like
+// GetSceneThumbnailKey otherwise.
+func (s *ClientService) GetPublicSceneThumbnailKey(ctx context.Context, tenant string, sceneID primitive.ObjectID) (string, error) {
+	sc, err := s.publicScene(ctx, tenant, sceneID)
+	if err != nil {
+		return "", err
+	}
+	return sceneThumbnailKey(sc)
+}
+
+// GetPublicSceneOutputKey returns the storage key of the output file of the unlisted or public scene with the given ID.
+//
+// Returns scene.ErrSceneNotFound if the scene does not exist, is private or belongs to another tenant, error like
+// GetSceneOutputKey otherwise.
+func (s *ClientService) GetPublicSceneOutputKey(ctx context.Context, tenant string, sceneID primitive.ObjectID, outputType, iteration string) (string, error) {
+	if _, err := s.publicScene(ctx, tenant, sceneID); err != nil {
+		return "", err
+	}
+	return s.sceneOutputKey(ctx, sceneID, 0, outputType, iteration)
+}
+
+// publicScene returns the scene with the given ID if it is unlisted or public, and belongs to the given tenant.
+// Other scenes are reported as not found, so private scenes can not be told apart from missing ones.
+func (s *ClientService) publicScene(ctx context.Context, tenant string, sceneID primitive.ObjectID) (*scene.Scene, error) {
+	sc, err := s.sceneManager.GetScene(ctx, sceneID)
+	if err != nil {
+		return nil, err
+	}
+	if sc.DeletedAt != nil || sc.Tenant != tenant ||
+		(sc.Visibility != scene.VisibilityUnlisted && sc.Visibility != scene.VisibilityPublic) {
+		return nil, scene.ErrSceneNotFound
+	}
+	return sc, nil
+}
@@ -0,0 +1,179 @@
+// This file contains the download manifests of the ClientService.
+//
+// Native viewers (desktop, mobile) download every output of a scene from a single manifest, instead of combining the metadata,
+// output and share routes. The manifest lists each output with its size, its SHA-256 checksum, and the checksums of its chunks
+// of ManifestChunkSize bytes, so viewers can download large outputs as parallel range requests and verify every chunk.
+// The web server adds a signed URL to each output.
+//
+// Checksums are computed the first time an output is listed, and stored on the scene. A stored checksum is reused as long as
+// the size and modification time of its object are unchanged, so outputs rewritten by a replay are checksummed again.
+// The layout of the manifest is versioned by ManifestSchemaVersion, which is incremented on every incompatible change.
+
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"maps"
+	"path"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+)
+
+const (
+	// ManifestSchemaVersion is the version of the layout of SceneManifest
+	ManifestSchemaVersion = 1
+	// ManifestChunkSize is the size of the chunks outputs are checksummed by, all chunks but the last are this size
+	ManifestChunkSize = 8 * 1024 * 1024
+)
+
+// SceneManifest describes every output of a scene, as consumed by native viewers
+type SceneManifest struct {
+	SchemaVersion int              `json:"schema_version"`
+	SceneID       string           `json:"scene_id"`
+	Name          string           `json:"name"`
+	TrainingMode  string           `json:"training_mode,omitempty"`
+	GeneratedAt   time.Time        `json:"generated_at"`
+	ExpiresAt     time.Time        `json:"expires_at"`
+	ChunkSize     int64            `json:"chunk_size"`
+	Outputs       []ManifestOutput `json:"outputs"`
+}
+
+// ManifestOutput describes a single output file of a scene. URL is a signed URL the output can be downloaded from until
+// the manifest expires, with range requests for single chunks.
+type ManifestOutput struct {
+	Type      string          `json:"type"`
+	Iteration int             `json:"iteration"`
+	FileName  string          `json:"file_name"`
+	Size      int64           `json:"size"`
+	SHA256    string          `json:"sha256"`
+	Chunks    []ManifestChunk `json:"chunks"`
+	URL       string          `json:"url"`
+}
+
+// ManifestChunk describes the byte range [Offset, Offset+Length) of an output
+type ManifestChunk struct {
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	SHA256 string `json:"sha256"`
+}
+
+// GetSceneManifest returns the download manifest of the outputs of the given scene, without URLs. Outputs are ordered by
+// type, then iteration. Outputs missing from storage are left out.
+//
+// Returns the manifest if successful, and like GetSceneOutputKey scene.ErrSceneNotFound / user.ErrUserNoAccess if the scene
+// does not exist or belongs to another user, scene.ErrNerfNotFound if it has no outputs yet, scene.ErrSceneArchived /
+// scene.ErrOutputsDeleted if they are archived / deleted.
+func (s *ClientService) GetSceneManifest(ctx context.Context, userID, sceneID primitive.ObjectID) (*SceneManifest, error) {
+	if err := s.authorizeScene(ctx, userID, sceneID); err != nil {
+		return nil, err
+	}
+	sc, err := s.sceneManager.GetScene(ctx, sceneID)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case sc.OutputsDeletedAt != nil:
+		return nil, scene.ErrOutputsDeleted
+	case sc.Archive != nil && sc.Archive.Status != scene.ArchiveStatusArchiving:
+		return nil, scene.ErrSceneArchived
+	case sc.Nerf == nil:
+		return nil, scene.ErrNerfNotFound
+	}
+
+	manifest := &SceneManifest{
+		SchemaVersion: ManifestSchemaVersion,
+		SceneID:       sceneID.Hex(),
+		Name:          sc.Name,
+		GeneratedAt:   time.Now().UTC(),
+		ChunkSize:     ManifestChunkSize,
+		Outputs:       make([]ManifestOutput, 0),
+	}
+	if sc.Config != nil && sc.Config.NerfTrainingConfig != nil {
+		manifest.TrainingMode = sc.Config.NerfTrainingConfig.TrainingMode
+	}
+
+	stored := make(map[string]scene.Checksum, len(sc.Checksums))
+	for _, checksum := range sc.Checksums {
+		stored[checksum.Key] = checksum
+	}
+	checksums := make([]scene.Checksum, 0, len(sc.Checksums))
+	computed := false
+	for _, outputType := range exportOutputTypes {
+		paths, _ := sc.Nerf.GetFilePathsForType(outputType)
+		for _, iteration := range slices.Sorted(maps.Keys(paths)) {
+			checksum, fresh, err := s.outputChecksum(ctx, paths[iteration], stored)
+			if err != nil {
+				s.logger.Warnf("Leaving %s out of the manifest of scene %s: %v", paths[iteration], sceneID.Hex(), err)
+				continue
+			}
+			computed = computed || fresh
+			checksums = append(checksums, *checksum)
+			manifest.Outputs = append(manifest.Outputs, newManifestOutput(outputType, iteration, checksum))
+		}
+	}
+
+	if computed {
+		if err := s.sceneManager.SetChecksums(ctx, sceneID, checksums); err != nil {
+			s.logger.Warnf("Failed to store the checksums of scene %s: %v", sceneID.Hex(), err)
+		}
+	}
+	return manifest, nil
+}
+
+// outputChecksum returns the checksum of the output stored under key, from the stored checksums if it is still valid.
+//
+// Returns whether the checksum was computed, error if the output can not be read.
+func (s *ClientService) outputChecksum(ctx context.Context, key string, stored map[string]scene.Checksum) (*scene.Checksum, bool, error) {
+	info, err := s.storage.Stat(ctx, key)
+	if err != nil {
+		return nil, false, err
+	}
+	// Stored times only keep milliseconds
+	modTime := info.ModTime.Truncate(time.Millisecond)
+	if checksum, ok := stored[info.Key]; ok && checksum.Size == info.Size && checksum.ModTime.Equal(modTime) &&
+		checksum.ChunkSize == ManifestChunkSize {
+		return &checksum, false, nil
+	}
+
+	object, err := s.storage.Open(ctx, info.Key)
+	if err != nil {
+		return nil, false, err
+	}
+	defer object.Close()
+
+	checksum := &scene.Checksum{Key: info.Key, Size: info.Size, ModTime: modTime, ChunkSize: ManifestChunkSize}
+	total := sha256.New()
+	for offset := int64(0); offset < info.Size; offset += ManifestChunkSize {
+		chunk := sha256.New()
+		if _, err := io.CopyN(io.MultiWriter(total, chunk), object, min(ManifestChunkSize, info.Size-offset)); err != nil {
+			return nil, false, err
+		}
+		checksum.Chunks = append(checksum.Chunks, hex.EncodeToString(chunk.Sum(nil)))
+	}
+	checksum.SHA256 = hex.EncodeToString(total.Sum(nil))
+	return checksum, true, nil
+}
+
+// newManifestOutput describes an output of the given type and iteration from its checksum.
+func newManifestOutput(outputType string, iteration int, checksum *scene.Checksum) ManifestOutput {
+	output := ManifestOutput{
+		Type:      outputType,
+		Iteration: iteration,
+		FileName:  path.Base(checksum.Key),
+		Size:      checksum.Size,
+		SHA256:    checksum.SHA256,
+		Chunks:    make([]ManifestChunk, len(checksum.Chunks)),
+	}
+	for i, sum := range checksum.Chunks {
+		offset := int64(i) * checksum.ChunkSize
+		output.Chunks[i] = ManifestChunk{Offset: offset, Length: min(checksum.ChunkSize, checksum.Size-offset), SHA256: sum}
+	}
+	return output
+}
@@ -0,0 +1,189 @@
+// This file contains the typed scene progress report served by the versioned API (/api/v1).
+//
+// The report is derived from the processing queues and the scene document: a scene is queued or processing while it is in a
+// stage queue (sfm_list, nerf_list), completed once the nerf outputs are stored, and failed once a worker reported a failure.
+// Percentages and ETAs are estimates, based on the measured average job duration split evenly across the stages.
+//
+// Reports of scenes still in the queues suggest when to poll again, so clients of scenes far back in the queue poll rarely.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/queue"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+)
+
+// Declarations for valid scene progress statuses
+const (
+	// ProgressStatusQueued means the scene waits for a worker of its current stage.
+	ProgressStatusQueued = "queued"
+	// ProgressStatusProcessing means a worker is processing the current stage of the scene.
+	ProgressStatusProcessing = "processing"
+	// ProgressStatusCompleted means every stage finished, and the outputs can be downloaded.
+	ProgressStatusCompleted = "completed"
+	// ProgressStatusFailed means a worker reported a failed stage. FailureReason describes the failure, and Error the failure
+	// reported by the worker if any.
+	ProgressStatusFailed = "failed"
+	// ProgressStatusUnknown means the scene is neither queued nor completed, i.e it was never dispatched to the workers.
+	ProgressStatusUnknown = "unknown"
+)
+
+// QueuePosition is the 0-based position of a scene in a queue, and the size of the queue
+type QueuePosition struct {
+	Position int `json:"position"`
+	Size     int `json:"size"`
+}
+
+// ProgressQueues are the positions of a scene in the overall queue and the queue of its current stage
+type ProgressQueues struct {
+	Overall QueuePosition  `json:"overall"`
+	Stage   *QueuePosition `json:"stage,omitempty"`
+}
+
+// SceneProgress is the progress report of a scene
+type SceneProgress struct {
+	Status          string            `json:"status"`
+	Stage           string            `json:"stage,omitempty"`
+	PercentComplete float64           `json:"percent_complete"`
+	StageETA        *time.Time        `json:"stage_eta,omitempty"`
+	FailureReason   string            `json:"failure_reason,omitempty"`
+	Error           *scene.SceneError `json:"error,omitempty"`
+	Queues          *ProgressQueues   `json:"queues,omitempty"`
+	// PollAfterSeconds is the suggested number of seconds before polling the progress again, omitted once the scene
+	// stopped progressing
+	PollAfterSeconds int `json:"poll_after_seconds,omitempty"`
+}
+
+// GetSceneProgressReport returns the typed progress report of the scene with the given ID.
+//
+// Returns error if the scene does not exist, the user does not have access to it, or an error occurred.
+func (s *ClientService) GetSceneProgressReport(ctx context.Context, userID, sceneID primitive.ObjectID) (*SceneProgress, error) {
+	if err := s.authorizeScene(ctx, userID, sceneID); err != nil {
+		s.logger.Info("Scene access denied:", err.Error())
+		return nil, err
+	}
+
+	sc, err := s.sceneManager.GetScene(ctx, sceneID)
+	if err != nil {
+		return nil, err
+	}
+	if sc.FailureReason != "" {
+		return &SceneProgress{Status: ProgressStatusFailed, FailureReason: sc.FailureReason, Error: sc.Error}, nil
+	}
+
+	queueNames := s.queueManager.GetQueueNames()
+	overallPosition, overallSize, err := s.queueManager.GetQueuePosition(ctx, queueNames[0], sceneID)
+	if errors.Is(err, queue.ErrIDNotFoundInQueue) {
+		if sc.Nerf != nil {
+			return &SceneProgress{Status: ProgressStatusCompleted, PercentComplete: 100}, nil
+		}
+		return &SceneProgress{Status: ProgressStatusUnknown, PollAfterSeconds: s.pollAfter(-1, nil)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	progress := &SceneProgress{
+		Status: ProgressStatusQueued,
+		Queues: &ProgressQueues{Overall: QueuePosition{Position: overallPosition, Size: overallSize}},
+	}
+
+	// Find the current stage, the first stage queue holding the scene
+	stages := queueNames[1:]
+	for idx, queueName := range stages {
+		position, size, err := s.queueManager.GetQueuePosition(ctx, queueName, sceneID)
+		if errors.Is(err, queue.ErrIDNotFoundInQueue) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		progress.Stage = strings.TrimSuffix(queueName, "_list")
+		progress.Queues.Stage = &QueuePosition{Position: position, Size: size}
+		s.estimateStageProgress(ctx, progress, sc, idx, len(stages))
+		progress.PollAfterSeconds = s.pollAfter(position, progress.StageETA)
+		break
+	}
+	if progress.PollAfterSeconds == 0 {
+		// Between stages, the next stage queue receives the scene any moment
+		progress.PollAfterSeconds = s.pollAfter(0, nil)
+	}
+
+	return progress, nil
+}
+
+// pollAfter returns the seconds a client should wait before polling the progress of a scene at the given position of its
+// stage queue again, between PollIntervalMin and PollIntervalMax. A negative position means the scene is in no queue.
+//
+// Scenes being processed are polled about ten times over the rest of their stage, until stageETA. Scenes waiting for a
+// worker double the interval for every round of WorkerConcurrency scenes ahead of them, as each round takes a whole stage.
+func (s *ClientService) pollAfter(position int, stageETA *time.Time) int {
+	minInterval, maxInterval := s.config.PollIntervalMin, s.config.PollIntervalMax
+
+	interval := maxInterval
+	switch {
+	case position < 0:
+	case position < s.config.WorkerConcurrency:
+		interval = minInterval
+		if stageETA != nil {
+			interval = time.Until(*stageETA) / 10
+		}
+	default:
+		rounds := position / s.config.WorkerConcurrency
+		if rounds < 32 && minInterval<<rounds < maxInterval {
+			interval = minInterval << rounds
+		}
+	}
+
+	interval = min(max(interval, minInterval), maxInterval)
+	return int(interval.Round(time.Second) / time.Second)
+}
+
+// estimateStageProgress sets the status, percentage and ETA of a scene in the stage at stageIdx of numStages.
+//
+// Scenes within WorkerConcurrency of the head of the stage queue are being processed. Their stage started when the previous
+// stage completed (or at submission for the first stage), and their percentage advances with the elapsed time.
+func (s *ClientService) estimateStageProgress(ctx context.Context, progress *SceneProgress, sc *scene.Scene, stageIdx, numStages int) {
+	now := time.Now().UTC()
+	stageDuration := s.estimateJobDuration(ctx) / time.Duration(numStages)
+	stageShare := 100 / float64(numStages)
+	progress.PercentComplete = float64(stageIdx) * stageShare
+
+	position := progress.Queues.Stage.Position
+	if position >= s.config.WorkerConcurrency {
+		rounds := position / s.config.WorkerConcurrency
+		eta := now.Add(time.Duration(rounds+1) * stageDuration).Truncate(time.Second)
+		progress.StageETA = &eta
+		return
+	}
+
+	progress.Status = ProgressStatusProcessing
+	started := sc.ID.Timestamp()
+	if stageIdx > 0 && sc.Cost != nil {
+		for _, stage := range sc.Cost.Stages {
+			if stage.CompletedAt.After(started) {
+				started = stage.CompletedAt
+			}
+		}
+	}
+
+	eta := started.Add(stageDuration).UTC()
+	if eta.Before(now) {
+		// Overdue, the stage is expected to finish any moment
+		eta = now
+	}
+	eta = eta.Truncate(time.Second)
+	progress.StageETA = &eta
+
+	// Never report a stage as done before its worker reported it
+	elapsed := min(float64(now.Sub(started))/float64(stageDuration), 0.95)
+	progress.PercentComplete += max(elapsed, 0) * stageShare
+}
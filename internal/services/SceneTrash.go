@@ -0,0 +1,92 @@
+// This file contains the scene trash of the ClientService.
+//
+// Deleting a scene moves it to the trash by default: it disappears from every route but the trash listing, keeps its files,
+// and can be restored until it is purged. Scenes are purged with their files once they spent the configured retention in the
+// trash (SCENE_TRASH_RETENTION). A zero retention disables the trash, and deleted scenes are removed immediately.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/audit"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/queue"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+)
+
+// RestoreUserScene moves a scene of the given user out of the trash.
+//
+// Returns nil if successful, ErrSceneNotFound / ErrUserNoAccess if the scene does not exist or belongs to another user,
+// ErrSceneNotInTrash if the scene is not in the trash, error otherwise.
+func (s *ClientService) RestoreUserScene(ctx context.Context, userID, sceneID primitive.ObjectID) error {
+	deletedAt, err := s.authorizeSceneOrTrash(ctx, userID, sceneID)
+	if err != nil {
+		return err
+	}
+	if deletedAt == nil {
+		return scene.ErrSceneNotInTrash
+	}
+
+	if err := s.sceneManager.RestoreTrashedScene(ctx, sceneID); err != nil {
+		return err
+	}
+	s.logger.Infof("Scene %s restored from the trash by user %s", sceneID.Hex(), userID.Hex())
+	return nil
+}
+
+// RunTrashPurge removes the scenes whose trash retention passed every interval, until the context is cancelled.
+// Removal is idempotent, so every replica may run it.
+func (s *ClientService) RunTrashPurge(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		sceneIDs, err := s.sceneManager.ListTrashedScenes(ctx, time.Now().UTC().Add(-s.config.SceneTrashRetention))
+		if err != nil {
+			s.logger.Errorf("Failed to list scenes due for purge: %v", err)
+			continue
+		}
+		for _, sceneID := range sceneIDs {
+			if err := s.purgeTrashedScene(ctx, sceneID); err != nil && !errors.Is(err, errScenesProcessing) {
+				s.logger.Warnf("Failed to purge scene %s: %v", sceneID.Hex(), err)
+			}
+		}
+	}
+}
+
+// purgeTrashedScene removes a scene from the trash with its files, and from the scene list of its user.
+//
+// Returns errScenesProcessing if the scene was queued again (i.e replayed) since it was deleted, in which case nothing is removed.
+func (s *ClientService) purgeTrashedScene(ctx context.Context, sceneID primitive.ObjectID) error {
+	_, _, err := s.queueManager.GetQueuePosition(ctx, "queue_list", sceneID)
+	if err == nil {
+		return errScenesProcessing
+	}
+	if !errors.Is(err, queue.ErrIDNotFoundInQueue) {
+		return err
+	}
+
+	if err := s.userManager.RemoveSceneIDFromUsers(ctx, sceneID); err != nil {
+		return err
+	}
+	if err := s.removeScene(ctx, sceneID); err != nil {
+		return err
+	}
+	s.auditService.Record(ctx, audit.Entry{
+		Action:  audit.ActionSceneDeleted,
+		SceneID: sceneID,
+		Details: map[string]string{"reason": "trash_purged"},
+	})
+	s.logger.Infof("Purged scene %s from the trash", sceneID.Hex())
+	return nil
+}
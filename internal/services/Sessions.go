@@ -0,0 +1,81 @@
+// This file contains the active session management of the ClientService.
+//
+// A session is a login: every refresh token rotated from the same login shares a token family, whose ID is the session ID.
+// Access tokens carry the session ID in their `sid` claim, so the session a request was made from can be identified.
+// Revoking a session revokes its refresh tokens, so the device must log in again once its access token expires.
+
+package services
+
+import (
+	"context"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/refreshtoken"
+)
+
+// maxDeviceLength is the maximum number of characters of a device (user agent) recorded on a session
+const maxDeviceLength = 256
+
+// Session is an active session of a user, as reported to the user
+type Session struct {
+	ID         string    `json:"id"`
+	Device     string    `json:"device"`
+	IP         string    `json:"ip"`
+	IssuedAt   time.Time `json:"issued_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	// Current is set on the session the listing request was made from
+	Current bool `json:"current"`
+}
+
+// ListSessions returns the active sessions of the given user, most recently used first.
+// currentSessionID is the session of the request, or "" if unknown (i.e access tokens issued before sessions were recorded).
+func (s *ClientService) ListSessions(ctx context.Context, userID primitive.ObjectID, currentSessionID string) ([]Session, error) {
+	tokens, err := s.tokenManager.ListActiveTokens(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]Session, 0, len(tokens))
+	for _, rt := range tokens {
+		issuedAt := rt.Session.IssuedAt
+		if issuedAt.IsZero() {
+			issuedAt = rt.FamilyID.Timestamp()
+		}
+		sessions = append(sessions, Session{
+			ID:         rt.FamilyID.Hex(),
+			Device:     rt.Session.Device,
+			IP:         rt.Session.IP,
+			IssuedAt:   issuedAt,
+			LastUsedAt: rt.CreatedAt,
+			ExpiresAt:  rt.ExpiresAt,
+			Current:    rt.FamilyID.Hex() == currentSessionID,
+		})
+	}
+	return sessions, nil
+}
+
+// RevokeSession revokes the given session of the user, logging out the device it was issued to.
+//
+// Returns refreshtoken.ErrSessionNotFound if the user has no active session with this ID.
+func (s *ClientService) RevokeSession(ctx context.Context, userID, sessionID primitive.ObjectID) error {
+	return s.tokenManager.RevokeUserFamily(ctx, userID, sessionID)
+}
+
+// RevokeOtherSessions revokes every session of the user except the given one, logging out every other device.
+//
+// Returns the number of revoked refresh tokens.
+func (s *ClientService) RevokeOtherSessions(ctx context.Context, userID, currentSessionID primitive.ObjectID) (int64, error) {
+	return s.tokenManager.RevokeOtherFamilies(ctx, userID, currentSessionID)
+}
+
+// newSession describes a session issued at the given time to the given device and IP.
+func newSession(device, ip string, issuedAt time.Time) refreshtoken.Session {
+	if utf8.RuneCountInString(device) > maxDeviceLength {
+		device = string([]rune(device)[:maxDeviceLength])
+	}
+	return refreshtoken.Session{Device: device, IP: ip, IssuedAt: issuedAt}
+}
@@ -0,0 +1,200 @@
+// This file contains the timeout of the jobs of the pipeline stages, configured with STAGE_TIMEOUT and STAGE_QUEUE_TIMEOUT.
+//
+// Workers report the scene they are processing in their heartbeats (see WorkerLiveness.go), and the first heartbeat of a worker
+// reporting a scene records in the list of the stage when, and by which worker, its job was started. A job redelivered to
+// another worker once its worker went silent is started again. The consumer instance checks the lists every
+// stageTimeoutCheckInterval, and times out the jobs a worker started more than STAGE_TIMEOUT ago, as the worker hung, or died
+// and its job or result was lost. Jobs waiting in the queue for a worker only time out once no worker reported them for
+// STAGE_QUEUE_TIMEOUT since they were published, however long the backlog, which is disabled by default.
+//
+// A job no worker reported most likely still waits in the queue of its stage, and publishing it again would queue a second
+// copy of it, so its scene fails right away, as below. A job timed out on its worker is taken from it and published again,
+// restarting its timeouts, up to STAGE_TIMEOUT_REPUBLISHES times: an abort is broadcast on the 'worker-control' topic (see
+// publishAbort), which only the worker of the job acts upon, and the scene stays in the list of the stage, so it is never
+// queued twice. After that, its scene fails: it is removed from the queue lists, its failure is notified, and its
+// cancellation is broadcast so a worker still processing it stops. A result the worker publishes anyway is processed if it
+// arrives first, and acknowledged as a duplicate once the scene left the stage.
+// Timed out jobs are exported as the stage_timeouts_total metric.
+//
+// Jobs of workers that do not report their scene in heartbeats are never started, so they only time out with STAGE_QUEUE_TIMEOUT,
+// and are never published again.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/event"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/queue"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+)
+
+// stageTimeoutCheckInterval is how often the consumer instance checks the queue lists for timed out jobs
+const stageTimeoutCheckInterval = time.Minute
+
+// Outcomes of a timed out job
+const (
+	timeoutOutcomeRepublished = "republished"
+	timeoutOutcomeFailed      = "failed"
+)
+
+var stageTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "stage_timeouts_total",
+	Help: "Jobs of a stage that timed out, by outcome (republished or failed). Only exported by the consumer instance.",
+}, []string{"stage", "outcome"})
+
+// monitorStageTimeouts times out the jobs of every stage every stageTimeoutCheckInterval, until the context is cancelled.
+func (s *AMPQService) monitorStageTimeouts(ctx context.Context) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(stageTimeoutCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, stage := range s.pipeline {
+			s.checkStageTimeouts(ctx, stage)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkStageTimeouts times out the jobs of the given stage a worker started more than STAGE_TIMEOUT ago, and those no worker
+// reported within STAGE_QUEUE_TIMEOUT of their publication.
+func (s *AMPQService) checkStageTimeouts(ctx context.Context, stage *StageDefinition) {
+	if s.config.StageTimeout > 0 {
+		started, err := s.queueManager.ItemsStartedBefore(ctx, stage.ListName, time.Now().Add(-s.config.StageTimeout))
+		if err != nil {
+			s.logger.Errorf("Error checking %s jobs for timeouts: %v", stage.Name, err)
+			return
+		}
+		for sceneID, start := range started {
+			if ctx.Err() != nil {
+				return
+			}
+			s.timeOutJob(ctx, stage, sceneID, start.WorkerID, s.config.StageTimeout)
+		}
+	}
+
+	if s.config.StageQueueTimeout > 0 {
+		queued, err := s.queueManager.ItemsQueuedBefore(ctx, stage.ListName, time.Now().Add(-s.config.StageQueueTimeout))
+		if err != nil {
+			s.logger.Errorf("Error checking queued %s jobs for timeouts: %v", stage.Name, err)
+			return
+		}
+		for _, sceneID := range queued {
+			if ctx.Err() != nil {
+				return
+			}
+			s.timeOutJob(ctx, stage, sceneID, "", s.config.StageQueueTimeout)
+		}
+	}
+}
+
+// timeOutJob takes the job of a scene for the given stage, timed out after the given timeout, from the worker with the given ID
+// and publishes it again, or fails the scene once its job was republished STAGE_TIMEOUT_REPUBLISHES times. The scene of a job
+// no worker reported (an empty worker ID) fails right away.
+func (s *AMPQService) timeOutJob(ctx context.Context, stage *StageDefinition, sceneID primitive.ObjectID, workerID string, timeout time.Duration) {
+	sc, err := s.sceneManager.GetScene(ctx, sceneID)
+	if errors.Is(err, scene.ErrSceneNotFound) {
+		s.logger.Warnf("Removing deleted scene %s from %s", sceneID.Hex(), stage.ListName)
+		s.releaseQueues(ctx, sceneID, stage.ListName, "queue_list")
+		return
+	}
+	if err != nil {
+		s.logger.Errorf("Error getting scene %s with a timed out %s job: %v", sceneID.Hex(), stage.Name, err)
+		return
+	}
+
+	if sc.FailureReason == scene.FailureReasonCancelled {
+		// Its cancellation failed to remove it from the queue lists
+		s.releaseQueues(ctx, sceneID, stage.ListName, "queue_list")
+		return
+	}
+
+	if workerID == "" {
+		// The job most likely still waits in the queue, publishing it again would queue a second copy of it
+		s.logger.Warnf("%s job of scene %s was not reported by a worker within %s", stage.Name, sceneID.Hex(), timeout)
+		stageTimeouts.WithLabelValues(stage.Name, timeoutOutcomeFailed).Inc()
+		s.failTimedOutJob(ctx, stage, sc, timeout)
+		return
+	}
+
+	// The requeue is recorded first, so a job that can not be published counts toward the limit as well. It only succeeds
+	// while the scene is in the list of the stage, so a scene whose result arrived meanwhile is not published again.
+	requeues, err := s.queueManager.MarkRequeued(ctx, stage.ListName, sceneID)
+	if errors.Is(err, queue.ErrIDNotFoundInQueue) {
+		// The result of the worker arrived meanwhile
+		return
+	}
+	if err != nil {
+		s.logger.Errorf("Error requeueing timed out %s job of scene %s: %v", stage.Name, sceneID.Hex(), err)
+		return
+	}
+	if requeues <= s.config.StageTimeoutRepublishes {
+		s.logger.Warnf("%s job of scene %s timed out after %s on worker %s, publishing it again (%d/%d)", stage.Name, sceneID.Hex(), timeout, workerID, requeues, s.config.StageTimeoutRepublishes)
+		if err := s.publishAbort(ctx, sceneID, stage.Name, workerID); err != nil {
+			s.logger.Warnf("Failed to notify worker %s of the timeout of scene %s: %v", workerID, sceneID.Hex(), err)
+		}
+		if err := s.publishJob(ctx, stage, sc); err != nil {
+			// No worker reports the job until it is published, so it would never time out again
+			s.logger.Errorf("Error publishing timed out %s job of scene %s again: %v", stage.Name, sceneID.Hex(), err)
+			stageTimeouts.WithLabelValues(stage.Name, timeoutOutcomeFailed).Inc()
+			s.failTimedOutJob(ctx, stage, sc, timeout)
+			return
+		}
+		stageTimeouts.WithLabelValues(stage.Name, timeoutOutcomeRepublished).Inc()
+		return
+	}
+
+	stageTimeouts.WithLabelValues(stage.Name, timeoutOutcomeFailed).Inc()
+	s.failTimedOutJob(ctx, stage, sc, timeout)
+}
+
+// failTimedOutJob fails a scene whose job for the given stage timed out after the given timeout, and removes it from the queue lists.
+func (s *AMPQService) failTimedOutJob(ctx context.Context, stage *StageDefinition, sc *scene.Scene, timeout time.Duration) {
+	reason := fmt.Sprintf("%s stage timed out after %s", stage.Name, timeout)
+	// Marked before the scene leaves the queue lists, as for cancellations
+	if err := s.sceneManager.SetFailureReason(ctx, sc.ID, reason); err != nil {
+		s.logger.Errorf("Error setting failure reason of scene %s: %v", sc.ID.Hex(), err)
+		return
+	}
+	recordEvent(ctx, s.eventManager, s.logger, event.TypeJobFailed, sc.ID, 0)
+	s.recordSceneError(ctx, sc.ID, stage.Name, reason)
+	s.releaseQueues(ctx, sc.ID, stage.ListName, "queue_list")
+	s.callbacks.Notify(sc.ID, CallbackEventFailed, reason)
+	if err := s.publishCancellation(ctx, sc.ID, stage.Name); err != nil {
+		s.logger.Warnf("Failed to notify the workers of the timeout of scene %s: %v", sc.ID.Hex(), err)
+	}
+
+	s.logger.Errorf("%s job of scene %s timed out after %s, the scene failed", stage.Name, sc.ID.Hex(), timeout)
+}
+
+// publishAbort broadcasts to the workers that the worker with the given ID must stop processing the job of the scene with the
+// given ID for the given stage. Unlike a cancellation, other workers ignore it, and process the job if they receive it.
+// The message format is:
+//
+//	{
+//		"type": "abort",
+//		"id": string (primitive.ObjectID.Hex()),
+//		"stage": string (the stage of PIPELINE_STAGES the job belongs to),
+//		"worker_id": string (the worker that must stop)
+//	}
+func (s *AMPQService) publishAbort(ctx context.Context, sceneID primitive.ObjectID, stage, workerID string) error {
+	return s.publishControl(ctx, map[string]string{
+		"type":      "abort",
+		"id":        sceneID.Hex(),
+		"stage":     stage,
+		"worker_id": workerID,
+	})
+}
@@ -0,0 +1,120 @@
+// This file contains the storage usage reports of scenes, so users and admins can see what is consuming disk.
+//
+// Usage is measured by walking the storage prefixes of the scene (raw video, thumbnails, sfm frames, nerf outputs) instead
+// of the files the scene references, so files left behind by interrupted jobs are counted too. Outputs of archived scenes
+// are measured in cold storage.
+
+package services
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/storage"
+)
+
+// SceneStorageUsage represents the bytes a scene uses in storage, by kind of file
+type SceneStorageUsage struct {
+	SceneID        primitive.ObjectID `json:"scene_id"`
+	VideoBytes     int64              `json:"video_bytes"`
+	ThumbnailBytes int64              `json:"thumbnail_bytes"`
+	SfmBytes       int64              `json:"sfm_bytes"`
+	SfmFiles       int                `json:"sfm_files"`
+	// NerfBytes are the bytes of the nerf outputs by output type (splat_cloud, point_cloud, video, model)
+	NerfBytes map[string]int64 `json:"nerf_bytes"`
+	NerfFiles int              `json:"nerf_files"`
+	// ColdBytes are the bytes of the outputs held in cold storage, included in NerfBytes
+	ColdBytes  int64 `json:"cold_bytes"`
+	TotalBytes int64 `json:"total_bytes"`
+}
+
+// GetSceneStorageUsage returns the storage usage of the given scene of the given user, including scenes in the trash.
+//
+// Returns scene.ErrSceneNotFound / user.ErrUserNoAccess if the scene does not exist or belongs to another user, error otherwise.
+func (s *ClientService) GetSceneStorageUsage(ctx context.Context, userID, sceneID primitive.ObjectID) (*SceneStorageUsage, error) {
+	if _, err := s.authorizeSceneOrTrash(ctx, userID, sceneID); err != nil {
+		return nil, err
+	}
+	return s.SceneStorageUsage(ctx, sceneID)
+}
+
+// SceneStorageUsage returns the storage usage of the scene with the given ID, regardless of its user, for admins.
+//
+// Returns scene.ErrSceneNotFound if the scene does not exist, error if storage could not be listed.
+func (s *ClientService) SceneStorageUsage(ctx context.Context, sceneID primitive.ObjectID) (*SceneStorageUsage, error) {
+	sc, err := s.sceneManager.GetScene(ctx, sceneID)
+	if err != nil {
+		return nil, err
+	}
+	return measureSceneStorage(ctx, s.storage, s.coldStorage, sc)
+}
+
+// measureSceneStorage returns the storage usage of the given scene, in the given artifact storage and cold storage (if any).
+//
+// Returns error if storage could not be listed.
+func measureSceneStorage(ctx context.Context, store, coldStorage storage.Storage, sc *scene.Scene) (*SceneStorageUsage, error) {
+	sceneID := sc.ID
+	usage := &SceneStorageUsage{SceneID: sceneID, NerfBytes: make(map[string]int64)}
+	for _, videoKey := range sc.VideoKeys() {
+		if key, err := storage.CleanKey(videoKey); err == nil {
+			if info, err := store.Stat(ctx, key); err == nil {
+				usage.VideoBytes += info.Size
+			}
+		}
+	}
+
+	thumbnails, err := store.List(ctx, scenePrefix(sc, storage.ThumbnailKey(sceneID.Hex(), "")))
+	if err != nil {
+		return nil, err
+	}
+	for _, object := range thumbnails {
+		usage.ThumbnailBytes += object.Size
+	}
+
+	frames, err := store.List(ctx, scenePrefix(sc, storage.SfmFrameKey(sceneID.Hex(), "")))
+	if err != nil {
+		return nil, err
+	}
+	for _, object := range frames {
+		usage.SfmBytes += object.Size
+		usage.SfmFiles++
+	}
+
+	nerfPrefix := scenePrefix(sc, path.Join("nerf", sceneID.Hex()))
+	outputs, err := store.List(ctx, nerfPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if sc.Archive != nil && coldStorage != nil {
+		cold, err := coldStorage.List(ctx, nerfPrefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range cold {
+			usage.ColdBytes += object.Size
+		}
+		outputs = append(outputs, cold...)
+	}
+	for _, object := range outputs {
+		// Output keys are nerf/<scene>/<output type>/iteration_<n>/<file>
+		outputType, _, _ := strings.Cut(strings.TrimPrefix(object.Key, nerfPrefix), "/")
+		usage.NerfBytes[outputType] += object.Size
+		usage.NerfFiles++
+	}
+
+	usage.TotalBytes = usage.VideoBytes + usage.ThumbnailBytes + usage.SfmBytes
+	for _, bytes := range usage.NerfBytes {
+		usage.TotalBytes += bytes
+	}
+	return usage, nil
+}
+
+// scenePrefix returns the given storage directory of a scene under the prefix of its tenant, followed by a slash so the
+// directory of a scene never matches the files of another.
+func scenePrefix(sc *scene.Scene, dir string) string {
+	return storage.TenantKey(sc.Tenant, dir) + "/"
+}
@@ -0,0 +1,109 @@
+// This file contains the synthetic scenes, which let load tests exercise the processing pipeline at scale without GPU workers.
+//
+// Synthetic scenes are submitted like uploaded scenes, without a video, and flagged synthetic. Their jobs are never published
+// to the worker queues: after SYNTHETIC_STAGE_DELAY, the server instead publishes a fabricated worker result to the output queue
+// of the stage ('sfm-out', 'nerf-out'), which the consumers process like any other result. The API, the database, the queue
+// lists and the broker are therefore exercised end to end, while only the GPU work is short-circuited.
+//
+// Fabricated results have no frames or outputs, so no artifacts are downloaded or stored. Synthetic scenes can only be created
+// when SYNTHETIC_ENABLED is set, which is meant for staging deployments.
+
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/broker"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+)
+
+// Custom errors
+var (
+	// ErrSyntheticDisabled is returned when creating synthetic scenes while SYNTHETIC_ENABLED is not set.
+	ErrSyntheticDisabled = errors.New("synthetic scenes are disabled")
+)
+
+const (
+	// syntheticWorkerID is the worker ID reported by fabricated worker results
+	syntheticWorkerID = "synthetic"
+	// syntheticVideoWidth and syntheticVideoHeight are the video resolution reported by fabricated sfm results
+	syntheticVideoWidth  = 1920
+	syntheticVideoHeight = 1080
+)
+
+// SubmitSyntheticScene creates a synthetic scene of the given user with the given training values, and starts its processing.
+// Synthetic scenes count towards the quotas of their user like uploaded scenes.
+//
+// Returns the ID of the scene if successful, ErrSyntheticDisabled if synthetic scenes are disabled, errors of SubmitScene otherwise.
+func (s *UploadService) SubmitSyntheticScene(ctx context.Context, userID primitive.ObjectID, submission SceneSubmission) (primitive.ObjectID, error) {
+	if !s.config.SyntheticEnabled {
+		return primitive.NilObjectID, ErrSyntheticDisabled
+	}
+
+	sceneID := primitive.NewObjectID()
+	submitter, newScene, err := s.validate(ctx, userID, sceneID, submission)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	newScene.Synthetic = true
+	if err := s.submit(ctx, submitter, newScene); err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	s.logger.Infof("Synthetic scene %s submitted for user %s", sceneID.Hex(), userID.Hex())
+	return sceneID, nil
+}
+
+// syntheticSFMOutput returns the sfm worker output fabricated for synthetic scenes: a result without frames.
+func syntheticSFMOutput() map[string]interface{} {
+	return map[string]interface{}{
+		"vid_width":  syntheticVideoWidth,
+		"vid_height": syntheticVideoHeight,
+		"sfm": scene.Sfm{
+			IntrinsicMatrix: [][]float64{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}},
+			Frames:          []scene.Frame{},
+		},
+		"flag": 0,
+	}
+}
+
+// syntheticNERFOutput returns the nerf worker output fabricated for synthetic scenes: a result without files.
+func syntheticNERFOutput() map[string]interface{} {
+	return map[string]interface{}{"file_paths": map[string]map[int]string{}}
+}
+
+// publishSyntheticResult publishes the fabricated worker result of a synthetic scene to the output queue of the given stage,
+// once the simulated processing time elapsed. If the result can not be published, the scene is removed from the queue lists,
+// as no result will ever be processed for it.
+func (s *AMPQService) publishSyntheticResult(sceneID primitive.ObjectID, stage *StageDefinition) {
+	result := map[string]interface{}{}
+	if stage.SyntheticOutput != nil {
+		result = stage.SyntheticOutput()
+	}
+	result["id"] = sceneID.Hex()
+	result["worker_id"] = syntheticWorkerID
+	result["gpu_seconds"] = s.config.SyntheticStageDelay.Seconds()
+	queueName := stage.OutputQueue
+
+	time.AfterFunc(s.config.SyntheticStageDelay, func() {
+		ctx := context.Background()
+		body, err := json.Marshal(result)
+		if err == nil {
+			err = s.publish(ctx, queueName, broker.Message{
+				ContentType: "application/json",
+				Body:        body,
+			})
+		}
+		if err != nil {
+			s.logger.Errorf("Failed to publish synthetic result of scene %s to %s: %v", sceneID.Hex(), queueName, err)
+			s.releaseQueues(ctx, sceneID, stage.ListName, "queue_list")
+			return
+		}
+		s.logger.Debugf("Synthetic result of scene %s published to %s", sceneID.Hex(), queueName)
+	})
+}
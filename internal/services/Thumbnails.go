@@ -0,0 +1,239 @@
+// This file contains the thumbnails of scenes: their generation from the uploaded video by the UploadService, the choice
+// of a thumbnail among the structure from motion frames by the AMPQService, when the sfm result is ingested, and the thumbnails
+// uploaded by users through the ClientService.
+//
+// A thumbnail uploaded by the user of a scene replaces any other thumbnail of the scene. Uploads must be PNG or JPEG images of
+// at most THUMBNAIL_MAX_SIZE bytes and maxThumbnailDimension pixels per side, and are decoded entirely before being stored.
+//
+// When FFMPEG_PATH is set, a few frames spread over the video of a new scene are extracted at ingest, and the best one is stored
+// as its thumbnail, so the scene has one before its sfm stage completes. Otherwise, or if the generation fails, the thumbnail
+// is chosen among the sfm frames: instead of the first frame, which often shows the camera still being positioned, a few PNG
+// frames spread over the video are scored, and the best one is recorded on the scene.
+//
+// In both cases, frames are scored by sharpness and exposure. Scoring is best-effort: frames that can not be scored are skipped,
+// and the first frame is kept if none could be.
+
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/storage"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/video"
+)
+
+// Custom errors
+var (
+	// ErrThumbnailTooLarge is returned when an uploaded thumbnail exceeds THUMBNAIL_MAX_SIZE, or maxThumbnailDimension pixels per side.
+	ErrThumbnailTooLarge = errors.New("thumbnail is too large")
+	// ErrInvalidThumbnail is returned when an uploaded thumbnail is not a valid PNG or JPEG image.
+	ErrInvalidThumbnail = errors.New("thumbnail must be a PNG or JPEG image")
+)
+
+const (
+	// maxThumbnailDimension is the maximum width and height of an uploaded thumbnail, in pixels
+	maxThumbnailDimension = 4096
+	// maxThumbnailCandidates is the number of frames scored when choosing the thumbnail of a scene
+	maxThumbnailCandidates = 8
+	// videoThumbnailCandidates is the number of frames extracted from a video when generating the thumbnail of a scene
+	videoThumbnailCandidates = 3
+	// videoThumbnailWidth is the maximum width of the thumbnails generated from videos
+	videoThumbnailWidth = 640
+	// videoThumbnailTimeout bounds the frame extraction of a thumbnail, so a pathological video does not hold a submission
+	videoThumbnailTimeout = 30 * time.Second
+)
+
+// generateThumbnail extracts frames spread over the stored (first) video of a scene with ffmpeg, and stores the best one as the
+// thumbnail of the scene. The video is copied to a temporary file first, as ffmpeg seeks in it.
+//
+// Returns the storage key of the thumbnail if successful, error otherwise.
+func (s *UploadService) generateThumbnail(ctx context.Context, sc *scene.Scene) (string, error) {
+	videoKey, err := storage.CleanKey(sc.PrimaryVideo().FilePath)
+	if err != nil {
+		return "", err
+	}
+	object, err := s.storage.Open(ctx, videoKey)
+	if err != nil {
+		return "", err
+	}
+	defer object.Close()
+	info, err := video.Probe(object)
+	if err != nil {
+		return "", err
+	}
+	if _, err := object.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	file, err := os.CreateTemp("", "thumbnail-*.mp4")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if _, err := io.Copy(file, object); err != nil {
+		return "", err
+	}
+
+	extractCtx, cancel := context.WithTimeout(ctx, videoThumbnailTimeout)
+	defer cancel()
+	candidates := videoThumbnailCandidates
+	if info.Duration <= 0 {
+		candidates = 1
+	}
+	frames := make([][]byte, candidates)
+	qualities := make([]*video.FrameQuality, candidates)
+	for i := range candidates {
+		at := info.Duration * time.Duration(i+1) / time.Duration(candidates+1)
+		frame, extractErr := video.ExtractFrame(extractCtx, s.config.FFmpegPath, path.Ext(videoKey), file.Name(), at, videoThumbnailWidth)
+		if extractErr != nil {
+			err = extractErr
+			s.logger.Debugf("Frame at %v of scene %s not extracted for its thumbnail: %v", at, sc.ID.Hex(), extractErr)
+			continue
+		}
+		quality, measureErr := video.MeasureFrameQuality(bytes.NewReader(frame))
+		if measureErr != nil {
+			err = measureErr
+			s.logger.Debugf("Frame at %v of scene %s not scored for its thumbnail: %v", at, sc.ID.Hex(), measureErr)
+			continue
+		}
+		frames[i], qualities[i] = frame, quality
+	}
+
+	best := video.BestFrame(qualities)
+	if best < 0 {
+		return "", err
+	}
+	key := storage.TenantKey(sc.Tenant, storage.ThumbnailKey(sc.ID.Hex(), "video.png"))
+	if err := s.storage.Put(ctx, key, bytes.NewReader(frames[best]), int64(len(frames[best]))); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// discardThumbnail removes the generated thumbnail of a scene that was never created.
+func (s *UploadService) discardThumbnail(ctx context.Context, sc *scene.Scene) {
+	if sc.Thumbnail == "" {
+		return
+	}
+	if err := s.storage.Delete(ctx, sc.Thumbnail); err != nil {
+		s.logger.Warnf("Failed to discard the thumbnail of scene %s: %v", sc.ID.Hex(), err)
+	}
+}
+
+// chooseThumbnail scores candidate frames of a scene, whose files were already stored, and returns the index of the best one.
+func (s *AMPQService) chooseThumbnail(ctx context.Context, sceneID primitive.ObjectID, frames []scene.Frame) int {
+	candidates := thumbnailCandidates(frames)
+	qualities := make([]*video.FrameQuality, len(candidates))
+	for i, index := range candidates {
+		quality, err := s.measureFrame(ctx, frames[index].FilePath)
+		if err != nil {
+			s.logger.Debugf("Frame %d of scene %s not scored for its thumbnail: %v", index, sceneID.Hex(), err)
+			continue
+		}
+		qualities[i] = quality
+	}
+
+	best := video.BestFrame(qualities)
+	if best < 0 {
+		return 0
+	}
+	s.logger.Debugf("Frame %d chosen as thumbnail of scene %s", candidates[best], sceneID.Hex())
+	return candidates[best]
+}
+
+// thumbnailCandidates returns the indexes of at most maxThumbnailCandidates PNG frames, evenly spread over the frames.
+func thumbnailCandidates(frames []scene.Frame) []int {
+	var pngs []int
+	for i, frame := range frames {
+		if path.Ext(frame.FilePath) == ".png" {
+			pngs = append(pngs, i)
+		}
+	}
+	if len(pngs) <= maxThumbnailCandidates {
+		return pngs
+	}
+
+	candidates := make([]int, maxThumbnailCandidates)
+	for i := range candidates {
+		candidates[i] = pngs[i*len(pngs)/maxThumbnailCandidates]
+	}
+	return candidates
+}
+
+// measureFrame reads the frame stored under key and measures its quality.
+func (s *AMPQService) measureFrame(ctx context.Context, key string) (*video.FrameQuality, error) {
+	object, err := s.storage.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+	return video.MeasureFrameQuality(object)
+}
+
+// SetSceneThumbnail validates the image read from r and stores it as the thumbnail of the given scene, replacing its
+// previous thumbnail.
+//
+// Returns ErrThumbnailTooLarge / ErrInvalidThumbnail if the image is rejected, scene.ErrSceneNotFound / user.ErrUserNoAccess
+// if the scene does not exist or belongs to another user, error otherwise.
+func (s *ClientService) SetSceneThumbnail(ctx context.Context, userID, sceneID primitive.ObjectID, r io.Reader) error {
+	if err := s.authorizeScene(ctx, userID, sceneID); err != nil {
+		return err
+	}
+	sc, err := s.sceneManager.GetScene(ctx, sceneID)
+	if err != nil {
+		return err
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r, s.config.ThumbnailMaxSize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > s.config.ThumbnailMaxSize {
+		return ErrThumbnailTooLarge
+	}
+	imageConfig, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || (format != "png" && format != "jpeg") {
+		return ErrInvalidThumbnail
+	}
+	if imageConfig.Width > maxThumbnailDimension || imageConfig.Height > maxThumbnailDimension {
+		return fmt.Errorf("%w: at most %dx%d pixels", ErrThumbnailTooLarge, maxThumbnailDimension, maxThumbnailDimension)
+	}
+	if _, _, err := image.Decode(bytes.NewReader(data)); err != nil {
+		return ErrInvalidThumbnail
+	}
+
+	// The file extension sets the content type the thumbnail is served with
+	ext := ".png"
+	if format == "jpeg" {
+		ext = ".jpg"
+	}
+	key := storage.TenantKey(sc.Tenant, storage.ThumbnailKey(sceneID.Hex(), "custom"+ext))
+	if err := s.storage.Put(ctx, key, bytes.NewReader(data), int64(len(data))); err != nil {
+		return err
+	}
+	if err := s.sceneManager.SetThumbnail(ctx, sceneID, key); err != nil {
+		return err
+	}
+	if sc.Thumbnail != "" && sc.Thumbnail != key {
+		if err := s.storage.Delete(ctx, sc.Thumbnail); err != nil {
+			s.logger.Warnf("Failed to remove the previous thumbnail of scene %s: %v", sceneID.Hex(), err)
+		}
+	}
+
+	s.logger.Infof("Thumbnail of scene %s replaced", sceneID.Hex())
+	return nil
+}
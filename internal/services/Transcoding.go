@@ -0,0 +1,95 @@
+// This file contains the transcoding of uploaded videos by the UploadService.
+//
+// Videos are accepted in the mp4 and mov containers, and, when UPLOAD_TRANSCODE is set, in the mkv, webm and avi containers.
+// With UPLOAD_TRANSCODE, every uploaded video that is not an H.264 mp4 video is transcoded to one with FFMPEG_PATH once stored,
+// before it is probed and evaluated against the upload policy, so the sfm worker always receives the same format.
+// The transcoded video replaces the upload, which is removed from storage.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/video"
+)
+
+// videoTranscodeTimeout bounds the transcoding of an upload, so a pathological video does not hold a submission forever
+const videoTranscodeTimeout = 10 * time.Minute
+
+// transcodeVideo transcodes the stored video with the given index of the scene with the given ID to an H.264 mp4 video
+// with ffmpeg, unless it already is one. The video is copied to a temporary file first, as ffmpeg seeks in it.
+//
+// Returns the storage key of the video to use if successful, ErrNotAVideo if ffmpeg can not read the video, error otherwise.
+func (s *UploadService) transcodeVideo(ctx context.Context, tenant string, sceneID primitive.ObjectID, index int, key string) (string, error) {
+	object, err := s.storage.Open(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer object.Close()
+
+	if path.Ext(key) == ".mp4" {
+		info, err := video.Probe(object)
+		if err != nil {
+			s.logger.Debug("Failed to probe video:", err.Error())
+			return "", fmt.Errorf("%w: %v", ErrNotAVideo, err)
+		}
+		if slices.Contains(video.H264Codecs, info.Codec) {
+			return key, nil
+		}
+		if _, err := object.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+	}
+
+	input, err := os.CreateTemp("", "transcode-*"+path.Ext(key))
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(input.Name())
+	defer input.Close()
+	if _, err := io.Copy(input, object); err != nil {
+		return "", err
+	}
+
+	output, err := os.CreateTemp("", "transcoded-*.mp4")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(output.Name())
+	defer output.Close()
+
+	transcodeCtx, cancel := context.WithTimeout(ctx, videoTranscodeTimeout)
+	defer cancel()
+	started := time.Now()
+	if err := video.Transcode(transcodeCtx, s.config.FFmpegPath, path.Ext(key), input.Name(), output.Name()); err != nil {
+		if errors.Is(err, video.ErrTranscodeFailed) {
+			return "", fmt.Errorf("%w: %v", ErrNotAVideo, err)
+		}
+		return "", err
+	}
+
+	stat, err := output.Stat()
+	if err != nil {
+		return "", err
+	}
+	transcodedKey := videoKey(tenant, sceneID, index)
+	if err := s.storage.Put(ctx, transcodedKey, output, stat.Size()); err != nil {
+		return "", err
+	}
+	if transcodedKey != key {
+		if err := s.storage.Delete(ctx, key); err != nil {
+			s.logger.Warnf("Failed to remove the transcoded upload of scene %s: %v", sceneID.Hex(), err)
+		}
+	}
+	s.logger.Infof("Transcoded the video of scene %s from %s in %v", sceneID.Hex(), path.Ext(key), time.Since(started).Round(time.Millisecond))
+	return transcodedKey, nil
+}
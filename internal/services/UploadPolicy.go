@@ -0,0 +1,142 @@
+// This file contains the acceptance policy evaluated against every uploaded video at ingest.
+//
+// Each rule is evaluated independently, so a rejected upload reports every rule it violates instead of only the first,
+// each with a hint telling the user how to make the video acceptable.
+// Operators tune the rules through the UPLOAD_* environment variables to match what their GPU fleet will accept.
+
+package services
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/video"
+)
+
+// PolicyViolation describes a single failed acceptance rule
+type PolicyViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+	// Hint tells the user what to change for the upload to be accepted
+	Hint string `json:"hint"`
+}
+
+// UploadRejectedError is returned when an uploaded video violates one or more acceptance rules
+type UploadRejectedError struct {
+	Violations []PolicyViolation
+}
+
+func (e *UploadRejectedError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		messages[i] = v.Message
+	}
+	return "upload rejected: " + strings.Join(messages, "; ")
+}
+
+// UploadPolicy contains the acceptance rules for uploaded videos. A zero value disables the respective rule.
+type UploadPolicy struct {
+	MaxDuration  time.Duration
+	MaxWidth     int
+	MaxHeight    int
+	MinFrames    int
+	BannedCodecs []string
+}
+
+// NewUploadPolicy creates the UploadPolicy described by the configuration.
+func NewUploadPolicy(cfg *config.Config) *UploadPolicy {
+	return &UploadPolicy{
+		MaxDuration:  cfg.UploadMaxDuration,
+		MaxWidth:     cfg.UploadMaxWidth,
+		MaxHeight:    cfg.UploadMaxHeight,
+		MinFrames:    cfg.UploadMinFrames,
+		BannedCodecs: cfg.UploadBannedCodecs,
+	}
+}
+
+// Evaluate checks the probed video against every rule of the policy.
+//
+// Returns the violated rules, or nil if the video is accepted.
+func (p *UploadPolicy) Evaluate(info *video.Info) []PolicyViolation {
+	var violations []PolicyViolation
+
+	if p.MaxDuration > 0 && info.Duration > p.MaxDuration {
+		violations = append(violations, PolicyViolation{
+			Rule:    "max_duration",
+			Message: fmt.Sprintf("video is %s long, the maximum is %s", info.Duration.Round(time.Second), p.MaxDuration),
+			Hint:    fmt.Sprintf("Trim the video to at most %s, keeping the part that moves around the subject", p.MaxDuration),
+		})
+	}
+
+	if violation, ok := p.checkResolution("video", info.Width, info.Height); !ok {
+		violations = append(violations, violation)
+	}
+
+	if p.MinFrames > 0 && info.FrameCount < p.MinFrames {
+		violations = append(violations, PolicyViolation{
+			Rule:    "min_frames",
+			Message: fmt.Sprintf("video has %d frames, the minimum is %d", info.FrameCount, p.MinFrames),
+			Hint:    "Record a longer video, or record at a higher frame rate",
+		})
+	}
+
+	for _, codec := range p.BannedCodecs {
+		if strings.EqualFold(strings.TrimSpace(info.Codec), codec) {
+			violations = append(violations, PolicyViolation{
+				Rule:    "banned_codec",
+				Message: fmt.Sprintf("video codec %s is not accepted", info.Codec),
+				Hint:    "Export the video with the H.264 codec, i.e with the \"Most Compatible\" camera format on iPhones",
+			})
+			break
+		}
+	}
+
+	return violations
+}
+
+// EvaluateImageSet checks the probed image set against the rules of the policy that apply to photos: the resolution of its
+// largest image, and its number of images against the minimum number of frames.
+//
+// Returns the violated rules, or nil if the image set is accepted.
+func (p *UploadPolicy) EvaluateImageSet(info *video.ImageSetInfo) []PolicyViolation {
+	var violations []PolicyViolation
+
+	if violation, ok := p.checkResolution("image", info.Width, info.Height); !ok {
+		violations = append(violations, violation)
+	}
+
+	if p.MinFrames > 0 && info.ImageCount < p.MinFrames {
+		violations = append(violations, PolicyViolation{
+			Rule:    "min_frames",
+			Message: fmt.Sprintf("image set has %d images, the minimum is %d", info.ImageCount, p.MinFrames),
+			Hint:    fmt.Sprintf("Add photos of the subject from more viewpoints, at least %d in total", p.MinFrames),
+		})
+	}
+
+	return violations
+}
+
+// checkResolution checks the resolution of a video or image against the maximum resolution of the policy.
+// Resolution is compared regardless of orientation, so portrait videos are not rejected by a landscape limit.
+//
+// Returns the violation and false if the resolution exceeds the maximum.
+func (p *UploadPolicy) checkResolution(kind string, width, height int) (PolicyViolation, bool) {
+	if p.MaxWidth <= 0 || p.MaxHeight <= 0 {
+		return PolicyViolation{}, true
+	}
+	long, short := max(width, height), min(width, height)
+	if long > max(p.MaxWidth, p.MaxHeight) || short > min(p.MaxWidth, p.MaxHeight) {
+		hint := fmt.Sprintf("Record or export the video at %dx%d or lower", p.MaxWidth, p.MaxHeight)
+		if kind == "image" {
+			hint = fmt.Sprintf("Resize the photos to %dx%d or lower", p.MaxWidth, p.MaxHeight)
+		}
+		return PolicyViolation{
+			Rule:    "max_resolution",
+			Message: fmt.Sprintf("%s resolution is %dx%d, the maximum is %dx%d", kind, width, height, p.MaxWidth, p.MaxHeight),
+			Hint:    hint,
+		}, false
+	}
+	return PolicyViolation{}, true
+}
@@ -0,0 +1,181 @@
+// This file contains the progress tracking of streamed uploads by the UploadService.
+//
+// A client uploading a video to /user/scene/new may choose an ID for the upload, and poll its progress under that ID while
+// the video is streamed. The bytes received are saved at most once per uploadProgressInterval, as the upload may be received
+// by another replica than the one answering the poll. Once the video was received, the upload is processing until its scene
+// is created (done) or the upload is rejected (failed).
+//
+// Resumable uploads need no tracking, their progress is the offset of their session, so it is returned for their session ID.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/upload"
+)
+
+// Custom errors
+var (
+	// ErrInvalidUploadID is returned when the ID chosen by a client for a tracked upload is not 8 to 64 letters, digits, '-' or '_'.
+	ErrInvalidUploadID = errors.New("upload ID must be 8 to 64 letters, digits, '-' or '_'")
+)
+
+const (
+	// uploadProgressInterval is the minimum interval between two saves of the progress of an upload
+	uploadProgressInterval = time.Second
+	// uploadProgressTTL is how long the progress of an upload is kept after its last update
+	uploadProgressTTL = time.Hour
+)
+
+var uploadIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{8,64}$`)
+
+// UploadTracker saves the progress of a streamed upload. A nil UploadTracker tracks nothing, so callers need not check
+// whether the client asked for tracking.
+type UploadTracker struct {
+	service *UploadService
+	ctx     context.Context
+
+	mu       sync.Mutex // guards progress and saved
+	progress upload.UploadProgress
+	saved    time.Time
+}
+
+// TrackUpload starts tracking an upload of the given user under the ID chosen by the client, with the given total size
+// (0 if unknown).
+//
+// Returns nil if uploadID is empty, ErrInvalidUploadID if it is malformed.
+func (s *UploadService) TrackUpload(ctx context.Context, userID primitive.ObjectID, uploadID string, total int64) (*UploadTracker, error) {
+	if uploadID == "" {
+		return nil, nil
+	}
+	if !uploadIDPattern.MatchString(uploadID) {
+		return nil, ErrInvalidUploadID
+	}
+	t := &UploadTracker{
+		service: s,
+		ctx:     ctx,
+		progress: upload.UploadProgress{
+			UserID:   userID,
+			UploadID: uploadID,
+			Status:   upload.ProgressReceiving,
+			Total:    max(total, 0),
+		},
+	}
+	t.save()
+	return t, nil
+}
+
+// Reader returns a reader counting the bytes of the file with the given name read from r. The upload is processing once
+// r is read to its end, until the reader of another file of the upload is read.
+func (t *UploadTracker) Reader(fileName string, r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.progress.FileName = fileName
+	t.progress.Status = upload.ProgressReceiving
+	return &progressReader{r: r, tracker: t}
+}
+
+// SetTotal sets the total size of the upload (0 if unknown), once it is known after tracking started.
+func (t *UploadTracker) SetTotal(total int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.progress.Total = max(total, 0)
+}
+
+// Finish records the outcome of the upload: done with the created scene if err is nil, failed otherwise.
+func (t *UploadTracker) Finish(sceneID primitive.ObjectID, err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err != nil {
+		t.progress.Status = upload.ProgressFailed
+		t.progress.Error = err.Error()
+	} else {
+		t.progress.Status = upload.ProgressDone
+		t.progress.SceneID = sceneID
+	}
+	t.save()
+}
+
+// save stores the progress of the upload, with the lock of the tracker held. Failures are only logged, tracking must not
+// fail an upload.
+func (t *UploadTracker) save() {
+	now := time.Now().UTC()
+	t.progress.UpdatedAt = now
+	t.progress.ExpiresAt = now.Add(uploadProgressTTL)
+	t.saved = now
+	if err := t.service.uploadProgressManager.SaveProgress(t.ctx, &t.progress); err != nil {
+		t.service.logger.Warnf("Failed to save the progress of upload %s: %v", t.progress.UploadID, err)
+	}
+}
+
+// progressReader counts the bytes read from the file of a tracked upload
+type progressReader struct {
+	r       io.Reader
+	tracker *UploadTracker
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	t := pr.tracker
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.progress.Received += int64(n)
+	switch {
+	case err == io.EOF && t.progress.Status == upload.ProgressReceiving:
+		t.progress.Status = upload.ProgressProcessing
+		t.save()
+	case time.Since(t.saved) >= uploadProgressInterval:
+		t.save()
+	}
+	return n, err
+}
+
+// GetUploadProgress returns the progress of the upload of the given user with the given ID: the ID chosen for a streamed
+// upload, or the ID of a resumable upload session.
+//
+// Returns ErrUploadProgressNotFound if no upload of the user has the given ID, ErrInvalidUploadID if it is malformed.
+func (s *UploadService) GetUploadProgress(ctx context.Context, userID primitive.ObjectID, uploadID string) (*upload.UploadProgress, error) {
+	if !uploadIDPattern.MatchString(uploadID) {
+		return nil, ErrInvalidUploadID
+	}
+	progress, err := s.uploadProgressManager.GetProgress(ctx, userID, uploadID)
+	if !errors.Is(err, upload.ErrUploadProgressNotFound) {
+		return progress, err
+	}
+
+	sessionID, hexErr := primitive.ObjectIDFromHex(uploadID)
+	if hexErr != nil {
+		return nil, err
+	}
+	session, sessionErr := s.uploadSessionManager.GetSession(ctx, sessionID)
+	if sessionErr != nil || session.UserID != userID || session.IsDirect() {
+		return nil, err
+	}
+	return &upload.UploadProgress{
+		UserID:    userID,
+		UploadID:  uploadID,
+		FileName:  session.FileName,
+		Status:    upload.ProgressReceiving,
+		Received:  session.Offset,
+		Total:     session.Size,
+		UpdatedAt: session.CreatedAt,
+		ExpiresAt: session.ExpiresAt,
+	}, nil
+}
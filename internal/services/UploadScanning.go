@@ -0,0 +1,209 @@
+// This file contains the Scanner interface checking uploads for malware, and the scanners a deployment selects between
+// with UPLOAD_SCANNER:
+//   - ClamAVScanner: streams the upload to a clamd daemon with the INSTREAM command
+//   - CommandScanner: runs a shell command with the upload on its stdin, i.e another antivirus command line client
+//
+// Every upload is scanned once stored, before it is transcoded, probed or turned into a scene, whatever its source
+// (multipart, resumable, direct or remote uploads). Flagged uploads are rejected with ErrUploadFlagged and removed,
+// unless UPLOAD_SCAN_ON_THREAT is "allow", in which case the threat is only logged. Uploads that could not be scanned
+// are rejected with ErrUploadScanFailed unless UPLOAD_SCAN_ON_ERROR is "allow".
+
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
+)
+
+// Declarations for valid upload scanners
+const (
+	UploadScannerClamAV  = "clamav"
+	UploadScannerCommand = "command"
+)
+
+// Custom errors
+var (
+	// ErrUploadFlagged is returned when the content scanner flagged an upload as malicious.
+	ErrUploadFlagged = errors.New("upload was flagged by the content scanner")
+	// ErrUploadScanFailed is returned when an upload could not be scanned, and unscanned uploads are blocked.
+	ErrUploadScanFailed = errors.New("upload could not be scanned")
+)
+
+// clamdChunkSize is the size of the chunks an upload is streamed to clamd in
+const clamdChunkSize = 64 * 1024
+
+// ScanResult is the verdict of a Scanner on an upload
+type ScanResult struct {
+	// Clean is set if no threat was found
+	Clean bool
+	// Threat is the name of the threat found, if any
+	Threat string
+}
+
+// Scanner is implemented by every content scanner uploads can be checked with.
+type Scanner interface {
+	// Name returns the name of the scanner, as set in UPLOAD_SCANNER.
+	Name() string
+	// Scan reads the upload from r until EOF and returns the verdict of the scanner.
+	//
+	// Returns an error if the upload could not be scanned.
+	Scan(ctx context.Context, r io.Reader) (ScanResult, error)
+}
+
+// NewScanner creates the upload scanner selected by UPLOAD_SCANNER, nil if uploads are not scanned.
+func NewScanner(cfg *config.Config) (Scanner, error) {
+	switch cfg.UploadScanner {
+	case "":
+		return nil, nil
+	case UploadScannerClamAV:
+		return &ClamAVScanner{addr: cfg.UploadScanClamdAddr, timeout: cfg.UploadScanTimeout}, nil
+	case UploadScannerCommand:
+		return &CommandScanner{command: cfg.UploadScanCommand}, nil
+	default:
+		return nil, fmt.Errorf("unknown upload scanner %q", cfg.UploadScanner)
+	}
+}
+
+// ClamAVScanner scans uploads with a clamd daemon. clamd refuses streams above its StreamMaxLength, which fails the scan.
+type ClamAVScanner struct {
+	addr    string
+	timeout time.Duration
+}
+
+// Name returns the name of the scanner.
+func (c *ClamAVScanner) Name() string {
+	return UploadScannerClamAV
+}
+
+// Scan streams the upload to clamd with the INSTREAM command, in length-prefixed chunks ended by an empty chunk, and
+// parses its reply: "stream: OK" if clean, "stream: <threat> FOUND" if not.
+func (c *ClamAVScanner) Scan(ctx context.Context, r io.Reader) (ScanResult, error) {
+	dialer := &net.Dialer{Timeout: c.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(c.timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return ScanResult{}, err
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return ScanResult{}, err
+	}
+	chunk := make([]byte, 4+clamdChunkSize)
+	for {
+		n, readErr := r.Read(chunk[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(chunk, uint32(n))
+			if _, err := conn.Write(chunk[:4+n]); err != nil {
+				// clamd closes the connection once the stream exceeds its limit, its reply tells why
+				break
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return ScanResult{}, readErr
+		}
+	}
+	// The reply may already be sent if clamd stopped reading, so a failed end of stream is not an error by itself
+	conn.Write([]byte{0, 0, 0, 0})
+
+	reply, err := io.ReadAll(conn)
+	if err != nil && len(reply) == 0 {
+		return ScanResult{}, err
+	}
+	status := strings.TrimSpace(strings.TrimRight(string(reply), "\x00"))
+	status = strings.TrimPrefix(status, "stream: ")
+	switch {
+	case status == "OK":
+		return ScanResult{Clean: true}, nil
+	case strings.HasSuffix(status, " FOUND"):
+		return ScanResult{Threat: strings.TrimSuffix(status, " FOUND")}, nil
+	default:
+		return ScanResult{}, fmt.Errorf("clamd: %s", status)
+	}
+}
+
+// CommandScanner scans uploads with a shell command reading the upload on its stdin. The command exits 0 if the upload
+// is clean, 1 if it is not, with the name of the threat as its output, and with any other status if it failed.
+type CommandScanner struct {
+	command string
+}
+
+// Name returns the name of the scanner.
+func (c *CommandScanner) Name() string {
+	return UploadScannerCommand
+}
+
+// Scan runs the command with the upload on its stdin.
+func (c *CommandScanner) Scan(ctx context.Context, r io.Reader) (ScanResult, error) {
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", c.command)
+	cmd.Stdin = r
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return ScanResult{Clean: true}, nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		return ScanResult{Threat: strings.TrimSpace(output.String())}, nil
+	default:
+		return ScanResult{}, fmt.Errorf("%v: %s", err, strings.TrimSpace(output.String()))
+	}
+}
+
+// scanUpload scans the stored upload of the scene with the given ID with the configured scanner, if any.
+//
+// Returns ErrUploadFlagged if the upload is blocked as malicious, ErrUploadScanFailed if it could not be scanned and
+// unscanned uploads are blocked, nil otherwise.
+func (s *UploadService) scanUpload(ctx context.Context, sceneID primitive.ObjectID, key string) error {
+	if s.scanner == nil {
+		return nil
+	}
+	object, err := s.storage.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+
+	scanCtx, cancel := context.WithTimeout(ctx, s.config.UploadScanTimeout)
+	defer cancel()
+	result, err := s.scanner.Scan(scanCtx, object)
+	switch {
+	case err != nil:
+		s.logger.Warnf("Failed to scan the upload of scene %s with %s: %v", sceneID.Hex(), s.scanner.Name(), err)
+		if s.config.UploadScanOnError == "allow" {
+			return nil
+		}
+		return ErrUploadScanFailed
+	case !result.Clean:
+		s.logger.Warnf("The upload of scene %s was flagged by %s: %s", sceneID.Hex(), s.scanner.Name(), result.Threat)
+		if s.config.UploadScanOnThreat == "allow" {
+			return nil
+		}
+		return fmt.Errorf("%w: %s", ErrUploadFlagged, result.Threat)
+	}
+	return nil
+}
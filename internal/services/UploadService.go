@@ -0,0 +1,701 @@
+// This file contains the UploadService implementation, which is responsible for turning uploaded videos into queued scenes.
+//
+// A submission goes through staged steps: validate (training values, guest quota, user quotas) → persist (stream the video into
+// artifact storage, validating it as it arrives, and scanning it once stored) → register (create the scene, add it to the
+// user) → publish (start the processing pipeline). A failed step compensates the steps completed before it, so a failed
+// submission leaves no video, scene or scene list entry behind.
+//
+// Multipart uploads receive the video before the training values are known, so they persist with ReceiveVideo first and
+// then submit with SubmitScene. Other sources (resumable upload sessions, direct uploads to object storage, batch, URL or import
+// uploads) reuse the same steps.
+//
+// Videos are accepted as mp4 or mov files, and as mkv, webm or avi files if UPLOAD_TRANSCODE is set (see Transcoding.go).
+// Instead of a video, users can upload a set of photos as a .zip archive of JPEG / PNG images. Image sets go through the
+// same steps, are stored next to the videos, and the sfm worker is told to use the images as frames instead of extracting them.
+//
+// Uploads are streamed from the request body to storage without being buffered as a whole: the body is only read as fast
+// as storage accepts it, and each upload buffers at most a part of the upload (S3_PART_SIZE) in memory. At most
+// UPLOAD_MAX_CONCURRENT uploads are streamed at once, further ones are rejected with ErrUploadsBusy.
+//
+// A scene may have up to SCENE_MAX_VIDEOS videos, i.e several passes around an object, received one after the other with
+// ReceiveVideo and ReceiveAdditionalVideo. Each video is validated on its own, and the sfm job lists every input of the scene.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/event"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/upload"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/user"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/storage"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/video"
+)
+
+// SceneSubmission contains the values requested for a new scene. Zero values are replaced by the deployment defaults.
+type SceneSubmission struct {
+	Name            string
+	TrainingMode    string
+	OutputTypes     []string
+	SaveIterations  []int
+	TotalIterations int
+	// Priority is the priority of the jobs of the scene, at most the highest priority allowed to the user
+	Priority int
+	// CallbackURL is the optional webhook notified of the stage transitions of the scene, signed with CallbackSecret
+	CallbackURL    string
+	CallbackSecret string
+}
+
+type UploadService struct {
+	mqService             JobPublisher
+	sceneManager          *scene.SceneManager
+	userManager           *user.UserManager
+	eventManager          *event.EventManager
+	uploadSessionManager  *upload.UploadSessionManager
+	uploadProgressManager *upload.UploadProgressManager
+	storage               storage.Storage
+	uploadPolicy          *UploadPolicy
+	callbacks             *SceneCallbacks
+	quotas                *Quotas
+	// scanner checks uploads for malware before they are accepted, nil if uploads are not scanned
+	scanner Scanner
+	// remoteClient downloads the videos submitted by URL, at most as many at once as remoteUploads holds
+	remoteClient  *http.Client
+	remoteUploads chan struct{}
+	// uploadSlots holds a slot per upload streamed to storage, nil if the number of concurrent uploads is unlimited
+	uploadSlots chan struct{}
+	config      *config.Config
+	logger      *log.Logger
+}
+
+// NewUploadService creates a new UploadService. Dependencies are injected via the constructor.
+func NewUploadService(
+	mqs JobPublisher,
+	sm *scene.SceneManager,
+	um *user.UserManager,
+	em *event.EventManager,
+	usm *upload.UploadSessionManager,
+	upm *upload.UploadProgressManager,
+	store storage.Storage,
+	callbacks *SceneCallbacks,
+	quotas *Quotas,
+	scanner Scanner,
+	cfg *config.Config,
+	logger *log.Logger,
+) *UploadService {
+	s := &UploadService{
+		mqService:             mqs,
+		sceneManager:          sm,
+		userManager:           um,
+		eventManager:          em,
+		uploadSessionManager:  usm,
+		uploadProgressManager: upm,
+		storage:               store,
+		uploadPolicy:          NewUploadPolicy(cfg),
+		callbacks:             callbacks,
+		quotas:                quotas,
+		scanner:               scanner,
+		remoteClient:          newRemoteClient(cfg),
+		remoteUploads:         make(chan struct{}, maxRemoteUploads),
+		config:                cfg,
+		logger:                logger,
+	}
+	if cfg.UploadMaxConcurrent > 0 {
+		s.uploadSlots = make(chan struct{}, cfg.UploadMaxConcurrent)
+	}
+	return s
+}
+
+// Upload runs every step of a submission for a video read from r, for uploads whose training values are known before
+// the video is read.
+//
+// Returns the scene ID if successful, error otherwise (see ReceiveVideo and SubmitScene).
+func (s *UploadService) Upload(ctx context.Context, userID primitive.ObjectID, fileName string, r io.Reader, submission SceneSubmission) (primitive.ObjectID, error) {
+	sceneID := primitive.NewObjectID()
+	submitter, newScene, err := s.validate(ctx, userID, sceneID, submission)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	input, err := s.persist(ctx, submitter, sceneID, 0, fileName, r)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	newScene.Videos = []*scene.Video{input}
+	if err := s.submit(ctx, submitter, newScene); err != nil {
+		return primitive.NilObjectID, err
+	}
+	return sceneID, nil
+}
+
+// ReceiveVideo streams a video (or image set) uploaded by the user into artifact storage, and returns the ID of the scene it
+// was reserved for. The video is validated while it is streamed: the upload is aborted with ErrNotAVideo (ErrNotAnImageSet)
+// as soon as the magic bytes do not match, and with ErrUploadTooLarge as soon as more than the maximum upload size of the
+// user was received.
+// Once stored, the video is probed and evaluated against the upload policy, returning an *UploadRejectedError listing every
+// violated rule if it is not accepted. Rejected videos are removed from storage.
+//
+// The scene itself is only created by SubmitScene. If the scene is never submitted, the video should be removed with DiscardVideo.
+//
+// The video is stored under the prefix of the tenant of the given user.
+//
+// Returns the reserved scene ID if successful, ErrQuotaExceeded if the user reached a quota before the video was read,
+// error otherwise.
+func (s *UploadService) ReceiveVideo(ctx context.Context, userID primitive.ObjectID, fileName string, r io.Reader) (primitive.ObjectID, error) {
+	u, err := s.userManager.GetUserByID(ctx, userID)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	if err := s.quotas.Check(ctx, u); err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	sceneID := primitive.NewObjectID()
+	if _, err := s.persist(ctx, u, sceneID, 0, fileName, r); err != nil {
+		return primitive.NilObjectID, err
+	}
+	return sceneID, nil
+}
+
+// ReceiveAdditionalVideo streams another video of the scene reserved by ReceiveVideo into artifact storage, as its input
+// with the given (1-based) index. The video is validated like the first one, and removed with it by DiscardVideo.
+//
+// Returns ErrTooManyVideos if the index reaches the maximum number of videos of a scene, ErrImageSetCombined if either
+// file is an image set, errors like ReceiveVideo otherwise.
+func (s *UploadService) ReceiveAdditionalVideo(ctx context.Context, userID, sceneID primitive.ObjectID, index int, fileName string, r io.Reader) error {
+	if index < 1 || index >= s.config.SceneMaxVideos {
+		return ErrTooManyVideos
+	}
+	if isImageSet(fileName) {
+		return ErrImageSetCombined
+	}
+	u, err := s.userManager.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if _, err := s.storage.Stat(ctx, inputKey(u.Tenant, sceneID, 0, ".zip")); err == nil {
+		return ErrImageSetCombined
+	}
+
+	_, err = s.persist(ctx, u, sceneID, index, fileName, r)
+	return err
+}
+
+// DiscardVideo removes the videos (or image set) received by ReceiveVideo and ReceiveAdditionalVideo from the given user,
+// for a scene that was never created.
+func (s *UploadService) DiscardVideo(ctx context.Context, userID, sceneID primitive.ObjectID) error {
+	tenant, err := s.userTenant(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for index := range s.config.SceneMaxVideos {
+		for ext := range uploadFormats {
+			if err := s.storage.Delete(ctx, inputKey(tenant, sceneID, index, ext)); err != nil && !errors.Is(err, storage.ErrObjectNotFound) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// videoKey returns the key of the uploaded video with the given index of the scene with the given ID, of the given tenant.
+func videoKey(tenant string, sceneID primitive.ObjectID, index int) string {
+	return inputKey(tenant, sceneID, index, ".mp4")
+}
+
+// inputKey returns the key of the uploaded video with the given index, or image set, of the scene with the given ID, of
+// the given tenant, by the extension of the uploaded file. The first input keeps the key of scenes with a single input.
+func inputKey(tenant string, sceneID primitive.ObjectID, index int, ext string) string {
+	name := sceneID.Hex()
+	if index > 0 {
+		name = fmt.Sprintf("%s-%d", name, index)
+	}
+	if ext == ".zip" {
+		return storage.TenantKey(tenant, storage.RawImageSetKey(name))
+	}
+	return storage.TenantKey(tenant, storage.RawVideoKey(name, ext))
+}
+
+// uploadExt returns the lower-cased extension of an uploaded file name, i.e ".mov" for "IMG_0001.MOV".
+func uploadExt(fileName string) string {
+	return strings.ToLower(filepath.Ext(fileName))
+}
+
+// isImageSet checks if an uploaded file is an image set (a .zip archive of photos) by its name, instead of a video.
+func isImageSet(fileName string) bool {
+	return uploadExt(fileName) == ".zip"
+}
+
+// uploadFormat returns the format of an uploaded file by its name.
+//
+// Returns ErrImproperFileExtension if the format is not accepted, i.e it can only be accepted when uploads are transcoded.
+func (s *UploadService) uploadFormat(fileName string) (uploadFormat, error) {
+	format, ok := uploadFormats[uploadExt(fileName)]
+	if !ok || (format.transcoded && !s.config.UploadTranscode) {
+		return uploadFormat{}, ErrImproperFileExtension
+	}
+	return format, nil
+}
+
+// SubmitScene creates the scene for the videos previously received by ReceiveVideo (and ReceiveAdditionalVideo), and starts
+// the processing pipeline. The videos are discarded if the scene can not be created or queued.
+//
+// If a training value is not provided, the deployment default is used. Guests are limited by the guest quota, and every
+// user by their quotas.
+//
+// Returns ErrFileNotReceived if no video was received for the scene, ErrInvalidTrainingConfig if the training values
+// do not form a valid training config, ErrGuestQuotaExceeded if the guest quota is exceeded, ErrQuotaExceeded if a quota
+// of the user is reached, ErrPriorityNotAllowed if the user may not request the priority, error otherwise.
+func (s *UploadService) SubmitScene(ctx context.Context, userID, sceneID primitive.ObjectID, submission SceneSubmission) error {
+	tenant, err := s.userTenant(ctx, userID)
+	if err != nil {
+		return err
+	}
+	inputs, err := s.receivedInputs(ctx, tenant, sceneID)
+	if err != nil {
+		return err
+	}
+
+	submitter, newScene, err := s.validate(ctx, userID, sceneID, submission)
+	if err == nil {
+		newScene.Videos = inputs
+		err = s.submit(ctx, submitter, newScene)
+	}
+	if err != nil {
+		s.discardVideo(ctx, tenant, sceneID)
+		return err
+	}
+	return nil
+}
+
+// validate resolves the training values of a submission of the given user, and builds the scene to register.
+//
+// Returns the submitting user and the scene if successful, error otherwise.
+func (s *UploadService) validate(ctx context.Context, userID, sceneID primitive.ObjectID, submission SceneSubmission) (*user.User, *scene.Scene, error) {
+	// Guests submit a single, smaller scene
+	submitter, err := s.userManager.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	saveIterations, totalIterations, err := s.applyGuestQuota(submitter, submission.SaveIterations, submission.TotalIterations)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.quotas.Check(ctx, submitter); err != nil {
+		return nil, nil, err
+	}
+	if allowed := s.maxPriority(submitter); submission.Priority > allowed {
+		return nil, nil, fmt.Errorf("%w: the highest priority available to you is %d", ErrPriorityNotAllowed, allowed)
+	}
+
+	// Handle non-provided configuration values with the deployment defaults
+	sceneName := submission.Name
+	if sceneName == "" {
+		sceneName = s.config.DefaultSceneName
+	}
+	trainingMode := submission.TrainingMode
+	if trainingMode == "" {
+		trainingMode = s.config.DefaultTrainingMode
+	}
+	outputTypes := submission.OutputTypes
+	if len(outputTypes) == 0 {
+		outputTypes = slices.Clone(s.config.DefaultOutputTypes)
+	}
+	if len(saveIterations) == 0 {
+		saveIterations = slices.Clone(s.config.DefaultSaveIterations)
+	}
+	if totalIterations == 0 {
+		totalIterations = s.config.DefaultTotalIterations
+	}
+	if err := validateTrainingConfig(trainingMode, outputTypes, saveIterations, totalIterations); err != nil {
+		return nil, nil, err
+	}
+
+	// Partially Initialize new scene
+	newScene := &scene.Scene{
+		ID:     sceneID,
+		Videos: []*scene.Video{{FilePath: videoKey(submitter.Tenant, sceneID, 0)}},
+		Config: &scene.TrainingConfig{
+			NerfTrainingConfig: &scene.NerfTrainingConfig{
+				TrainingMode:    trainingMode,
+				OutputTypes:     outputTypes,
+				SaveIterations:  saveIterations,
+				TotalIterations: totalIterations,
+			},
+			Priority: submission.Priority,
+		},
+		Name:   sceneName,
+		Tenant: submitter.Tenant,
+	}
+	if submission.CallbackURL != "" {
+		if err := s.callbacks.ValidateCallback(ctx, submission.CallbackURL, submission.CallbackSecret); err != nil {
+			return nil, nil, err
+		}
+		newScene.Callback = &scene.Callback{URL: submission.CallbackURL, Secret: submission.CallbackSecret}
+	}
+	return submitter, newScene, nil
+}
+
+// maxPriority returns the highest job priority the given user may request: any for admins, the one of their tier
+// (PRIORITY_TIERS) otherwise.
+func (s *UploadService) maxPriority(u *user.User) int {
+	if u.HasRole(user.RoleAdmin) {
+		return scene.MaxPriority
+	}
+	return s.config.PriorityTiers[u.EffectiveTier()]
+}
+
+// validateTrainingConfig checks the combination of training values, after defaults were applied.
+func validateTrainingConfig(trainingMode string, outputTypes []string, saveIterations []int, totalIterations int) error {
+	for _, outputType := range outputTypes {
+		if !(scene.Nerf{}).IsValidOutputType(trainingMode, outputType) {
+			return fmt.Errorf("%w: output type %s is not available for training mode %s", ErrInvalidTrainingConfig, outputType, trainingMode)
+		}
+	}
+	for _, iteration := range saveIterations {
+		if iteration > totalIterations {
+			return fmt.Errorf("%w: save iteration %d exceeds total iterations %d", ErrInvalidTrainingConfig, iteration, totalIterations)
+		}
+	}
+	return nil
+}
+
+// receivedInputs returns the videos (or image set) received for the scene with the given ID by ReceiveVideo and
+// ReceiveAdditionalVideo, in the order they were received.
+//
+// Returns ErrFileNotReceived if none was received, error like checkUploadPolicy otherwise.
+func (s *UploadService) receivedInputs(ctx context.Context, tenant string, sceneID primitive.ObjectID) ([]*scene.Video, error) {
+	var inputs []*scene.Video
+	for index := range s.config.SceneMaxVideos {
+		input, err := s.receivedInput(ctx, tenant, sceneID, index)
+		if errors.Is(err, ErrFileNotReceived) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		inputs = append(inputs, input)
+	}
+	if len(inputs) == 0 {
+		return nil, ErrFileNotReceived
+	}
+	if len(inputs) > 1 && inputs[0].IsImageSet() {
+		return nil, ErrImageSetCombined
+	}
+	return inputs, nil
+}
+
+// receivedInput returns the video (or image set) with the given index received for the scene with the given ID.
+//
+// Returns ErrFileNotReceived if none was received, error like checkUploadPolicy otherwise.
+func (s *UploadService) receivedInput(ctx context.Context, tenant string, sceneID primitive.ObjectID, index int) (*scene.Video, error) {
+	for ext := range uploadFormats {
+		key := inputKey(tenant, sceneID, index, ext)
+		if _, err := s.storage.Stat(ctx, key); err == nil {
+			return s.checkUploadPolicy(ctx, key, ext == ".zip")
+		}
+	}
+	return nil, ErrFileNotReceived
+}
+
+// persist streams the video (or image set) of the given user for the scene with the given ID into artifact storage, as
+// its input with the given index, transcodes it if enabled, and checks it against the upload policy. Rejected videos are
+// removed from storage, with the other inputs of the scene.
+//
+// Returns the Video describing the stored file if successful, error otherwise.
+func (s *UploadService) persist(ctx context.Context, u *user.User, sceneID primitive.ObjectID, index int, fileName string, r io.Reader) (*scene.Video, error) {
+	if fileName == "" || r == nil {
+		return nil, ErrFileNotReceived
+	}
+	tenant := u.Tenant
+
+	format, err := s.uploadFormat(fileName)
+	if err != nil {
+		return nil, err
+	}
+	imageSet := isImageSet(fileName)
+
+	// Save video to artifact storage
+	key := inputKey(tenant, sceneID, index, uploadExt(fileName))
+	release, err := s.acquireUploadSlot()
+	if err != nil {
+		return nil, err
+	}
+	upload := newValidatingReader(r, format, s.uploadMaxSize(u))
+	err = s.storage.Put(ctx, key, upload, -1)
+	release()
+	if err != nil {
+		s.logger.Info("Rejected video upload:", err.Error())
+		return nil, err
+	}
+
+	return s.accept(ctx, tenant, sceneID, index, key, imageSet, upload.read)
+}
+
+// acquireUploadSlot reserves one of the UPLOAD_MAX_CONCURRENT slots of uploads streamed to storage, until the returned
+// function is called.
+//
+// Returns ErrUploadsBusy if every slot is in use.
+func (s *UploadService) acquireUploadSlot() (func(), error) {
+	if s.uploadSlots == nil {
+		return func() {}, nil
+	}
+	select {
+	case s.uploadSlots <- struct{}{}:
+		return func() { <-s.uploadSlots }, nil
+	default:
+		return nil, ErrUploadsBusy
+	}
+}
+
+// accept scans the stored video (or image set) with the given index of the scene with the given ID if a scanner is
+// configured, transcodes it if enabled, and checks it against the upload policy. Rejected videos are removed from storage,
+// with the other inputs of the scene.
+//
+// Returns the Video describing the stored file if successful, error otherwise.
+func (s *UploadService) accept(ctx context.Context, tenant string, sceneID primitive.ObjectID, index int, key string, imageSet bool, size int64) (*scene.Video, error) {
+	if err := s.scanUpload(ctx, sceneID, key); err != nil {
+		s.logger.Info("Rejected video upload:", err.Error())
+		s.discardVideo(ctx, tenant, sceneID)
+		return nil, err
+	}
+
+	var err error
+	if s.config.UploadTranscode && !imageSet {
+		key, err = s.transcodeVideo(ctx, tenant, sceneID, index, key)
+		if err != nil {
+			s.logger.Info("Rejected video upload:", err.Error())
+			s.discardVideo(ctx, tenant, sceneID)
+			return nil, err
+		}
+	}
+
+	input, err := s.checkUploadPolicy(ctx, key, imageSet)
+	if err != nil {
+		s.logger.Info("Rejected video upload:", err.Error())
+		s.discardVideo(ctx, tenant, sceneID)
+		return nil, err
+	}
+
+	recordEvent(ctx, s.eventManager, s.logger, event.TypeArtifactStored, sceneID, size)
+	return input, nil
+}
+
+// checkUploadPolicy probes the stored video (or image set) and evaluates it against the upload policy.
+//
+// Returns the Video describing the file, with the properties probed from it, if it is accepted, ErrNotAVideo
+// (ErrNotAnImageSet) wrapping the reason if it cannot be probed, *UploadRejectedError if it violates the policy.
+func (s *UploadService) checkUploadPolicy(ctx context.Context, key string, imageSet bool) (*scene.Video, error) {
+	object, err := s.storage.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	if imageSet {
+		info, err := video.ProbeImageSet(object)
+		if err != nil {
+			s.logger.Debug("Failed to probe image set:", err.Error())
+			if errors.Is(err, video.ErrInvalidImageSet) {
+				return nil, fmt.Errorf("%w: %v", ErrNotAnImageSet, err)
+			}
+			return nil, err
+		}
+		if violations := s.uploadPolicy.EvaluateImageSet(info); len(violations) > 0 {
+			return nil, &UploadRejectedError{Violations: violations}
+		}
+		return &scene.Video{
+			FilePath:   key,
+			Width:      info.Width,
+			Height:     info.Height,
+			InputType:  scene.InputTypeImages,
+			ImageCount: info.ImageCount,
+		}, nil
+	}
+
+	info, err := video.Probe(object)
+	if err != nil {
+		s.logger.Debug("Failed to probe video:", err.Error())
+		return nil, fmt.Errorf("%w: %v", ErrNotAVideo, err)
+	}
+
+	if violations := s.uploadPolicy.Evaluate(info); len(violations) > 0 {
+		return nil, &UploadRejectedError{Violations: violations}
+	}
+	return &scene.Video{
+		FilePath:   key,
+		Width:      info.Width,
+		Height:     info.Height,
+		FPS:        int(math.Round(info.FrameRate())),
+		Duration:   int(info.Duration.Round(time.Second).Seconds()),
+		FrameCount: info.FrameCount,
+	}, nil
+}
+
+// submit registers the validated scene of the given user and publishes it, unregistering the scene if it can not be published.
+// Scenes with a structure from motion result (i.e clones) start with their training stage. Scenes with a video get a thumbnail
+// generated from its first video first, if ffmpeg is configured. Image sets are not decoded, so they get no thumbnail.
+func (s *UploadService) submit(ctx context.Context, submitter *user.User, newScene *scene.Scene) error {
+	if primary := newScene.PrimaryVideo(); s.config.FFmpegPath != "" && primary != nil && !primary.IsImageSet() && !newScene.Synthetic {
+		thumbnail, err := s.generateThumbnail(ctx, newScene)
+		if err != nil {
+			s.logger.Warnf("Failed to generate the thumbnail of scene %s: %v", newScene.ID.Hex(), err)
+		}
+		newScene.Thumbnail = thumbnail
+	}
+
+	if err := s.register(ctx, submitter, newScene); err != nil {
+		s.discardThumbnail(ctx, newScene)
+		return err
+	}
+
+	// Start pipeline
+	publish := s.mqService.PublishSFMJob
+	if newScene.Sfm != nil {
+		publish = s.mqService.PublishTrainingJob
+	}
+	if err := publish(ctx, newScene); err != nil {
+		s.logger.Errorf("Failed to publish job: %v", err)
+		s.unregister(ctx, submitter.ID, newScene.ID)
+		s.discardThumbnail(ctx, newScene)
+		return err
+	}
+
+	recordEvent(ctx, s.eventManager, s.logger, event.TypeJobSubmitted, newScene.ID, 0)
+	s.callbacks.Notify(newScene.ID, CallbackEventQueued, "")
+	return nil
+}
+
+// register inserts the scene into the database and adds it to the scene list of the given user. The scene is removed
+// again if the user can not be updated.
+func (s *UploadService) register(ctx context.Context, submitter *user.User, newScene *scene.Scene) error {
+	if err := s.sceneManager.SetScene(ctx, newScene.ID, newScene); err != nil {
+		s.logger.Errorf("Failed to insert new scene into database: %v", err)
+		return err
+	}
+
+	err := submitter.AddScene(newScene.ID)
+	if err == nil {
+		err = s.userManager.UpdateUser(ctx, submitter)
+	}
+	if err != nil {
+		s.logger.Errorf("Failed to add scene %s to user %s: %v", newScene.ID.Hex(), submitter.ID.Hex(), err)
+		if err := s.sceneManager.DeleteScene(ctx, newScene.ID); err != nil {
+			s.logger.Warnf("Failed to remove unregistered scene %s: %v", newScene.ID.Hex(), err)
+		}
+		return err
+	}
+	return nil
+}
+
+// unregister reverts register, removing the scene from the scene list of the given user and from the database.
+func (s *UploadService) unregister(ctx context.Context, userID, sceneID primitive.ObjectID) {
+	if err := s.userManager.RemoveSceneID(ctx, userID, sceneID); err != nil && !errors.Is(err, user.ErrSceneIDNotFound) {
+		s.logger.Warnf("Failed to remove scene %s from user %s: %v", sceneID.Hex(), userID.Hex(), err)
+	}
+	if err := s.sceneManager.DeleteScene(ctx, sceneID); err != nil {
+		s.logger.Warnf("Failed to remove unpublished scene %s: %v", sceneID.Hex(), err)
+	}
+}
+
+// discardVideo removes the videos (or image set) of a scene that was rejected or never created. Missing files are ignored.
+func (s *UploadService) discardVideo(ctx context.Context, tenant string, sceneID primitive.ObjectID) {
+	for index := range s.config.SceneMaxVideos {
+		for ext := range uploadFormats {
+			if err := s.storage.Delete(ctx, inputKey(tenant, sceneID, index, ext)); err != nil && !errors.Is(err, storage.ErrObjectNotFound) {
+				s.logger.Warn("Failed to discard rejected video:", err.Error())
+			}
+		}
+	}
+}
+
+// uploadMaxSize returns the maximum upload size in bytes of the given user: their own if an admin set one, the maximum
+// upload size of the deployment otherwise.
+func (s *UploadService) uploadMaxSize(u *user.User) int64 {
+	if u.UploadMaxSize > 0 {
+		return u.UploadMaxSize
+	}
+	return s.config.Tunables().UploadMaxSize
+}
+
+// userTenant returns the tenant of the user with the given ID, whose files are stored under its prefix.
+func (s *UploadService) userTenant(ctx context.Context, userID primitive.ObjectID) (string, error) {
+	u, err := s.userManager.GetUserByID(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	return u.Tenant, nil
+}
+
+// checkUploadAllowed checks if the user with the given ID may start another upload. Registered users may until they
+// reach a quota, guests only until they submitted their scene.
+//
+// Returns ErrGuestQuotaExceeded if the guest already submitted a scene, ErrQuotaExceeded if a quota of the user is
+// reached, error if the user does not exist.
+func (s *UploadService) checkUploadAllowed(ctx context.Context, userID primitive.ObjectID) error {
+	u, err := s.userManager.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if u.Guest && len(u.SceneIDs) > 0 {
+		return ErrGuestQuotaExceeded
+	}
+	return s.quotas.Check(ctx, u)
+}
+
+// GetQuotaUsage returns the usage of every quota of the user with the given ID, and their limits.
+//
+// Returns error if the user does not exist, or the usage could not be measured.
+func (s *UploadService) GetQuotaUsage(ctx context.Context, userID primitive.ObjectID) (*QuotaUsage, error) {
+	u, err := s.userManager.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return s.quotas.Usage(ctx, u)
+}
+
+// applyGuestQuota applies the guest quota to the requested training values of a scene submitted by the given user.
+// Registered users are unaffected. Guests default to the maximum guest iterations (or the deployment default if lower),
+// saving the default save iterations within them, or only the final iteration if none is.
+//
+// Returns the save iterations and total iterations to use, ErrGuestQuotaExceeded if the guest already submitted a scene
+// or requested more iterations than allowed.
+func (s *UploadService) applyGuestQuota(u *user.User, saveIterations []int, totalIterations int) ([]int, int, error) {
+	if !u.Guest {
+		return saveIterations, totalIterations, nil
+	}
+	if len(u.SceneIDs) > 0 {
+		return nil, 0, ErrGuestQuotaExceeded
+	}
+
+	if totalIterations == 0 {
+		totalIterations = min(s.config.DefaultTotalIterations, s.config.GuestMaxIterations)
+	}
+	if totalIterations > s.config.GuestMaxIterations {
+		return nil, 0, ErrGuestQuotaExceeded
+	}
+	if len(saveIterations) == 0 {
+		for _, iteration := range s.config.DefaultSaveIterations {
+			if iteration <= totalIterations {
+				saveIterations = append(saveIterations, iteration)
+			}
+		}
+		if len(saveIterations) == 0 {
+			saveIterations = []int{totalIterations}
+		}
+	}
+	return saveIterations, totalIterations, nil
+}
@@ -0,0 +1,255 @@
+// This file contains the resumable upload sessions of the UploadService.
+//
+// Large videos can be uploaded in chunks instead of a single multipart request. The session (declared size, bytes received,
+// chunk keys, expiry) is persisted in MongoDB and the chunks in artifact storage, so an interrupted upload is resumed from the
+// last received byte, even after a restart or on another replica. Completing the session hands the concatenated chunks to
+// ReceiveVideo, so chunked uploads are validated exactly like single request uploads.
+
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/upload"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/user"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/storage"
+)
+
+// Custom errors
+var (
+	// ErrUploadIncomplete is returned when an upload session is completed before every declared byte was received.
+	ErrUploadIncomplete = errors.New("upload is incomplete")
+	// ErrEmptyChunk is returned when a chunk contains no bytes.
+	ErrEmptyChunk = errors.New("chunk is empty")
+)
+
+// CreateUploadSession starts a resumable upload of a video (or image set) with the given file name and total size.
+//
+// Returns ErrImproperFileExtension for files of a format that is not accepted, ErrUploadTooLarge if size exceeds the maximum
+// upload size of the user, ErrGuestQuotaExceeded if the user is a guest who already submitted a scene, ErrQuotaExceeded
+// if a quota of the user is reached.
+func (s *UploadService) CreateUploadSession(ctx context.Context, userID primitive.ObjectID, fileName string, size int64) (*upload.UploadSession, error) {
+	if _, err := s.uploadFormat(fileName); err != nil {
+		return nil, err
+	}
+	u, err := s.userManager.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if size > s.uploadMaxSize(u) {
+		return nil, ErrUploadTooLarge
+	}
+	if err := s.checkUploadAllowed(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	return s.uploadSessionManager.CreateSession(ctx, userID, fileName, size, s.config.UploadSessionTTL)
+}
+
+// GetUploadSession returns the upload session with the given ID, so a client can resume from its offset.
+//
+// Returns ErrUploadSessionNotFound if the session does not exist or expired, ErrUserNoAccess if it belongs to another user.
+func (s *UploadService) GetUploadSession(ctx context.Context, userID, uploadID primitive.ObjectID) (*upload.UploadSession, error) {
+	session, err := s.uploadSessionManager.GetSession(ctx, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if session.UserID != userID {
+		return nil, user.ErrUserNoAccess
+	}
+	return session, nil
+}
+
+// AppendUploadChunk stores a chunk of the upload session starting at the given offset, and extends the session expiry.
+// The first chunk must start with the signature of the format of the file, and no chunk may go past the declared size.
+//
+// Returns the updated session if successful, ErrOffsetMismatch if offset is not the number of bytes received so far.
+func (s *UploadService) AppendUploadChunk(ctx context.Context, userID, uploadID primitive.ObjectID, offset int64, r io.Reader) (*upload.UploadSession, error) {
+	session, err := s.GetUploadSession(ctx, userID, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if session.IsDirect() {
+		return nil, ErrDirectUpload
+	}
+	if offset != session.Offset {
+		return session, upload.ErrOffsetMismatch
+	}
+
+	var chunk *validatingReader
+	if offset == 0 {
+		format, err := s.uploadFormat(session.FileName)
+		if err != nil {
+			return session, err
+		}
+		chunk = newValidatingReader(r, format, session.Size)
+	} else {
+		chunk = newSizeCappedReader(r, session.Size-offset)
+	}
+
+	// Concurrent chunks for the same offset are stored under distinct keys, the loser is deleted below
+	nonce := make([]byte, 4)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	tenant, err := s.userTenant(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	key := storage.TenantKey(tenant, storage.UploadChunkKey(uploadID.Hex(), offset, fmt.Sprintf("%x", nonce)))
+	release, err := s.acquireUploadSlot()
+	if err != nil {
+		return nil, err
+	}
+	err = s.storage.Put(ctx, key, chunk, -1)
+	release()
+	if err != nil {
+		s.deleteChunks(ctx, []string{key})
+		return nil, err
+	}
+	if chunk.read == 0 {
+		s.deleteChunks(ctx, []string{key})
+		return nil, ErrEmptyChunk
+	}
+
+	expiresAt := time.Now().UTC().Add(s.config.UploadSessionTTL)
+	err = s.uploadSessionManager.AdvanceOffset(ctx, uploadID, offset, offset+chunk.read, key, expiresAt)
+	if err != nil {
+		// Another chunk for this offset was accepted first
+		s.deleteChunks(ctx, []string{key})
+		return nil, err
+	}
+
+	session.Offset += chunk.read
+	session.ChunkKeys = append(session.ChunkKeys, key)
+	session.ExpiresAt = expiresAt
+	return session, nil
+}
+
+// CompleteUploadSession assembles the chunks of a fully received upload session into the raw video of a new scene,
+// through ReceiveVideo. The session is removed once the video is stored or rejected, but kept on storage errors so
+// completing can be retried.
+//
+// Returns the reserved scene ID (see ReceiveVideo), ErrUploadIncomplete if bytes are missing.
+func (s *UploadService) CompleteUploadSession(ctx context.Context, userID, uploadID primitive.ObjectID) (primitive.ObjectID, error) {
+	session, err := s.GetUploadSession(ctx, userID, uploadID)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	if session.IsDirect() {
+		return primitive.NilObjectID, ErrDirectUpload
+	}
+	if !session.IsComplete() {
+		return primitive.NilObjectID, fmt.Errorf("%w: received %d of %d bytes", ErrUploadIncomplete, session.Offset, session.Size)
+	}
+
+	sceneID, err := s.ReceiveVideo(ctx, userID, session.FileName, &chunkReader{ctx: ctx, store: s.storage, keys: session.ChunkKeys})
+	var rejected *UploadRejectedError
+	if err == nil || errors.As(err, &rejected) || errors.Is(err, ErrNotAVideo) || errors.Is(err, ErrNotAnImageSet) || errors.Is(err, ErrUploadTooLarge) ||
+		errors.Is(err, ErrUploadFlagged) {
+		s.removeUploadSession(ctx, session)
+	}
+	return sceneID, err
+}
+
+// AbortUploadSession removes the upload session with the given ID and its chunks.
+func (s *UploadService) AbortUploadSession(ctx context.Context, userID, uploadID primitive.ObjectID) error {
+	session, err := s.GetUploadSession(ctx, userID, uploadID)
+	if err != nil {
+		return err
+	}
+	s.removeUploadSession(ctx, session)
+	return nil
+}
+
+// RunUploadCleanup removes expired upload sessions and their chunks every interval, until the context is cancelled.
+// Removal is idempotent, so every replica may run it.
+func (s *UploadService) RunUploadCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		sessions, err := s.uploadSessionManager.ListExpiredSessions(ctx, time.Now().UTC())
+		if err != nil {
+			s.logger.Errorf("Failed to list expired upload sessions: %v", err)
+			continue
+		}
+		for _, session := range sessions {
+			s.removeUploadSession(ctx, session)
+		}
+		if len(sessions) > 0 {
+			s.logger.Infof("Removed %d expired upload sessions", len(sessions))
+		}
+	}
+}
+
+// removeUploadSession deletes the chunks of a session, then the session itself. The staged file of a direct upload is
+// deleted too, scenes only use its copy.
+func (s *UploadService) removeUploadSession(ctx context.Context, session *upload.UploadSession) {
+	s.deleteChunks(ctx, session.ChunkKeys)
+	if session.IsDirect() {
+		if err := s.storage.Delete(ctx, session.ObjectKey); err != nil {
+			s.logger.Warnf("Failed to delete direct upload %s: %v", session.ObjectKey, err)
+		}
+	}
+	if err := s.uploadSessionManager.DeleteSession(ctx, session.ID); err != nil {
+		s.logger.Warnf("Failed to delete upload session %s: %v", session.ID.Hex(), err)
+	}
+}
+
+// deleteChunks deletes the given chunks from storage, logging instead of returning any error.
+func (s *UploadService) deleteChunks(ctx context.Context, keys []string) {
+	for _, key := range keys {
+		if err := s.storage.Delete(ctx, key); err != nil {
+			s.logger.Warnf("Failed to delete upload chunk %s: %v", key, err)
+		}
+	}
+}
+
+// chunkReader reads the chunks stored under keys one after another, opening each chunk only once it is reached.
+type chunkReader struct {
+	ctx     context.Context
+	store   storage.Storage
+	keys    []string
+	current io.ReadCloser
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if cr.current == nil {
+			if len(cr.keys) == 0 {
+				return 0, io.EOF
+			}
+			rc, err := cr.store.Open(cr.ctx, cr.keys[0])
+			if err != nil {
+				return 0, err
+			}
+			cr.current = rc
+			cr.keys = cr.keys[1:]
+		}
+
+		n, err := cr.current.Read(p)
+		if errors.Is(err, io.EOF) {
+			cr.current.Close()
+			cr.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
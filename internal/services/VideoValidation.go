@@ -0,0 +1,219 @@
+// This file contains the validation applied to uploaded videos while they are being streamed into storage.
+//
+// Uploads are validated as bytes arrive instead of after the upload is complete, so oversized or non-video uploads
+// are aborted after the first few bytes / once the size cap is crossed, instead of after gigabytes were written to disk.
+//
+// The extension of an upload only selects the format it is expected to be: its content must start with the signature of
+// that format (and, for mp4 and mov files, declare a video brand). Mislabeled files are rejected with the type detected
+// from their first bytes, i.e "expected a .mp4 file, but its content is an mkv / webm video".
+
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+)
+
+// Custom errors
+var (
+	// ErrUploadTooLarge is returned when an upload exceeds the maximum allowed size.
+	ErrUploadTooLarge = errors.New("upload exceeds the maximum allowed size")
+	// ErrNotAVideo is returned when the content of an upload is not a supported video container.
+	ErrNotAVideo = errors.New("uploaded file is not a supported video")
+	// ErrNotAnImageSet is returned when the content of a .zip upload is not a zip archive of JPEG / PNG images.
+	ErrNotAnImageSet = errors.New("uploaded file is not a zip archive of JPEG / PNG images")
+	// ErrFileNotReceived is returned when an upload has no file, or an empty file name.
+	ErrFileNotReceived = errors.New("file not received")
+	// ErrImproperFileExtension is returned when an upload has an unsupported file extension.
+	ErrImproperFileExtension = errors.New("improper file extension")
+	// ErrTooManyVideos is returned when more videos are uploaded for a scene than SCENE_MAX_VIDEOS.
+	ErrTooManyVideos = errors.New("too many videos uploaded for a single scene")
+	// ErrImageSetCombined is returned when an image set is uploaded together with other files for a scene.
+	ErrImageSetCombined = errors.New("an image set must be the only upload of a scene")
+	// ErrInvalidTrainingConfig is returned when the requested training values do not form a valid training config.
+	ErrInvalidTrainingConfig = errors.New("invalid training config")
+	// ErrPriorityNotAllowed is returned when a scene is submitted with a higher priority than the tier of the user allows.
+	ErrPriorityNotAllowed = errors.New("job priority not allowed")
+	// ErrUploadsBusy is returned when an upload starts while UPLOAD_MAX_CONCURRENT uploads are streamed to storage.
+	ErrUploadsBusy = errors.New("too many uploads in progress, try again later")
+)
+
+// sniffLength is the number of bytes read to detect the type of a file not matching its format, as used by http.DetectContentType
+const sniffLength = 512
+
+// isoImageBrands are the major brands of ISO base media files holding still images or image sequences (HEIF, AVIF)
+var isoImageBrands = []string{"heic", "heix", "heim", "heis", "hevc", "hevx", "mif1", "msf1", "avif", "avis"}
+
+// uploadFormat describes a file format accepted at ingest, by the signature of its first bytes
+type uploadFormat struct {
+	// ext is the extension of the format, as named in errors
+	ext string
+	// headerSize is the number of bytes passed to matches
+	headerSize int
+	matches    func(header []byte) bool
+	// notMatching is returned if the header does not match
+	notMatching error
+	// transcoded formats can not be probed, they are only accepted if uploads are transcoded to mp4
+	transcoded bool
+}
+
+// uploadFormats are the accepted upload formats by file extension
+var uploadFormats = map[string]uploadFormat{
+	".mp4":  {ext: ".mp4", headerSize: 12, matches: isISOBaseMedia, notMatching: ErrNotAVideo},
+	".mov":  {ext: ".mov", headerSize: 12, matches: isQuickTime, notMatching: ErrNotAVideo},
+	".mkv":  {ext: ".mkv", headerSize: 4, matches: isEBML, notMatching: ErrNotAVideo, transcoded: true},
+	".webm": {ext: ".webm", headerSize: 4, matches: isEBML, notMatching: ErrNotAVideo, transcoded: true},
+	".avi":  {ext: ".avi", headerSize: 12, matches: isAVI, notMatching: ErrNotAVideo, transcoded: true},
+	".zip":  {ext: ".zip", headerSize: 4, matches: isZip, notMatching: ErrNotAnImageSet},
+}
+
+// isISOBaseMedia checks for the ISO base media file signature of a video: the first box of an mp4 is always 'ftyp',
+// stored after the 4 byte box size, followed by the major brand, which must not be one of an image format.
+func isISOBaseMedia(header []byte) bool {
+	return string(header[4:8]) == "ftyp" && !isISOImage(header)
+}
+
+// isISOImage checks for the signature of an ISO base media file holding images instead of a video, i.e a HEIC photo.
+func isISOImage(header []byte) bool {
+	if string(header[4:8]) != "ftyp" {
+		return false
+	}
+	brand := string(header[8:12])
+	for _, imageBrand := range isoImageBrands {
+		if brand == imageBrand {
+			return true
+		}
+	}
+	return false
+}
+
+// isQuickTime checks for the signature of a QuickTime movie. Recent ones start with 'ftyp' like mp4, older ones with
+// any other top-level atom.
+func isQuickTime(header []byte) bool {
+	switch string(header[4:8]) {
+	case "ftyp":
+		return !isISOImage(header)
+	case "moov", "mdat", "wide", "free", "skip":
+		return true
+	}
+	return false
+}
+
+// isEBML checks for the EBML header starting Matroska (mkv) and WebM files.
+func isEBML(header []byte) bool {
+	return bytes.Equal(header, []byte{0x1a, 0x45, 0xdf, 0xa3})
+}
+
+// isAVI checks for the RIFF header of an AVI file.
+func isAVI(header []byte) bool {
+	return string(header[0:4]) == "RIFF" && string(header[8:12]) == "AVI "
+}
+
+// isZip checks for the signature of the first local file header of a zip archive.
+func isZip(header []byte) bool {
+	return string(header) == "PK\x03\x04"
+}
+
+// validatingReader wraps an upload stream, checking the magic bytes of the first read
+// and failing once more than maxSize bytes were read.
+type validatingReader struct {
+	r       io.Reader
+	maxSize int64
+	read    int64
+	header  []byte
+	checked bool
+	format  uploadFormat
+}
+
+// newValidatingReader wraps r, expecting a file of the given format. A maxSize <= 0 disables the size cap.
+func newValidatingReader(r io.Reader, format uploadFormat, maxSize int64) *validatingReader {
+	return &validatingReader{r: r, maxSize: maxSize, format: format}
+}
+
+// newSizeCappedReader wraps r like newValidatingReader, without checking the magic bytes.
+// Used for the chunks of a resumable upload that do not start the file.
+func newSizeCappedReader(r io.Reader, maxSize int64) *validatingReader {
+	return &validatingReader{r: r, maxSize: maxSize, checked: true}
+}
+
+// Read reads from the wrapped stream, returning ErrNotAVideo (ErrNotAnImageSet) or ErrUploadTooLarge as soon as the stream
+// is known to be invalid.
+func (v *validatingReader) Read(p []byte) (int, error) {
+	if !v.checked {
+		if err := v.checkHeader(); err != nil {
+			return 0, err
+		}
+	}
+
+	// Replay the buffered header first
+	if len(v.header) > 0 {
+		n := copy(p, v.header)
+		v.header = v.header[n:]
+		return n, nil
+	}
+
+	n, err := v.r.Read(p)
+	v.read += int64(n)
+	if v.maxSize > 0 && v.read > v.maxSize {
+		return n, ErrUploadTooLarge
+	}
+	return n, err
+}
+
+// checkHeader buffers the first bytes of the stream and checks them against the signature of the expected format.
+func (v *validatingReader) checkHeader() error {
+	v.checked = true
+
+	header := make([]byte, v.format.headerSize)
+	n, err := io.ReadFull(v.r, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if n < len(header) || !v.format.matches(header) {
+		return v.mismatch(header[:n])
+	}
+
+	v.header = header
+	v.read = int64(n)
+	return nil
+}
+
+// mismatch returns the error of a file whose header does not match the signature of the expected format, naming the type
+// detected from its first sniffLength bytes.
+func (v *validatingReader) mismatch(header []byte) error {
+	sniffed := make([]byte, sniffLength)
+	n := copy(sniffed, header)
+	if n == v.format.headerSize {
+		m, _ := io.ReadFull(v.r, sniffed[n:])
+		n += m
+	}
+	return fmt.Errorf("%w: expected a %s file, but its content is %s", v.format.notMatching, v.format.ext, detectFileType(sniffed[:n]))
+}
+
+// detectFileType describes the type of a file from its first bytes: the accepted formats by their signature, other types
+// by their MIME type as sniffed by http.DetectContentType.
+func detectFileType(data []byte) string {
+	switch {
+	case len(data) == 0:
+		return "empty"
+	case len(data) >= 12 && isISOImage(data):
+		return "a HEIF / AVIF image"
+	case len(data) >= 12 && isISOBaseMedia(data):
+		return "an mp4 / mov video"
+	case len(data) >= 12 && isAVI(data):
+		return "an avi video"
+	case len(data) >= 4 && isEBML(data[:4]):
+		return "an mkv / webm video"
+	case len(data) >= 4 && isZip(data[:4]):
+		return "a zip archive"
+	}
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(data))
+	if err != nil || mediaType == "application/octet-stream" {
+		return "of an unknown type"
+	}
+	return "of type " + mediaType
+}
@@ -0,0 +1,181 @@
+// This file contains the liveness tracking of the workers of the pipeline stages, served by the admin workers route.
+//
+// Workers publish a heartbeat to the 'worker-heartbeat' queue at least every third of WORKER_HEARTBEAT_TIMEOUT, while idle and
+// while processing. The consumer instance records every heartbeat in the worker registry in MongoDB, so every instance can
+// report which workers are online: those whose last heartbeat is more recent than the timeout. Heartbeats expire in the
+// queue after a minute, so heartbeats published while no instance consumes do not pile up.
+//
+// The consumer instance also monitors the stages: once workers of a stage reported heartbeats, a stage with queued jobs
+// and no online worker is logged as an error (once, until a worker is back), and the number of online workers of every
+// stage is exported as the workers_online metric, so alerts can be raised on either. Stages whose workers never sent a
+// heartbeat are not monitored, as their workers may not support heartbeats.
+
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/broker"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/worker"
+)
+
+const (
+	// workerHeartbeatQueue is the queue workers publish their heartbeats to
+	workerHeartbeatQueue = "worker-heartbeat"
+	// heartbeatMessageTTL is how long a heartbeat waits in the queue before it expires
+	heartbeatMessageTTL = time.Minute
+	// workerCheckInterval is how often the consumer instance checks that every stage has online workers
+	workerCheckInterval = 30 * time.Second
+)
+
+var workersOnline = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "workers_online",
+	Help: "Workers of a stage whose last heartbeat is within WORKER_HEARTBEAT_TIMEOUT. Only exported by the consumer instance.",
+}, []string{"stage"})
+
+// WorkerStatus is a worker of the registry, and whether it is online
+type WorkerStatus struct {
+	*worker.Worker
+	Online bool `json:"online"`
+}
+
+// WorkerReport lists the workers of the registry, and the number of online workers of every stage
+type WorkerReport struct {
+	Workers []WorkerStatus `json:"workers"`
+	Online  map[string]int `json:"online"`
+}
+
+// processHeartbeat processes a message from the 'worker-heartbeat' queue, recording the worker it comes from.
+//
+// Heartbeats are never retried: malformed heartbeats are dropped, and a heartbeat that could not be recorded is replaced by
+// the next one of its worker. The expected message format is:
+//
+//	{
+//	    "worker_id": string,
+//	    "stage": string (a stage of PIPELINE_STAGES, i.e "sfm" or "nerf"),
+//	    "worker_version": string (optional, the worker_version header takes precedence),
+//	    "scene_id": string (optional, primitive.ObjectID.Hex() of the scene being processed)
+//	}
+//
+// With STAGE_TIMEOUT set, the first heartbeat reporting a scene starts the processing time of its job, see StageTimeouts.go.
+func (s *AMPQService) processHeartbeat(d broker.Delivery) error {
+	var heartbeat struct {
+		WorkerID      string `json:"worker_id"`
+		Stage         string `json:"stage"`
+		WorkerVersion string `json:"worker_version"`
+		SceneID       string `json:"scene_id"`
+	}
+	if err := json.Unmarshal(d.Body, &heartbeat); err != nil {
+		s.logger.Warnf("Dropping malformed worker heartbeat: %v", err)
+		return nil
+	}
+	if s.stage(heartbeat.Stage) == nil || heartbeat.WorkerID == "" {
+		s.logger.Warnf("Dropping worker heartbeat without worker ID or with unknown stage %q", heartbeat.Stage)
+		return nil
+	}
+	if heartbeat.SceneID != "" && !primitive.IsValidObjectID(heartbeat.SceneID) {
+		heartbeat.SceneID = ""
+	}
+	version := heartbeat.WorkerVersion
+	if header, ok := d.Headers[workerVersionHeader].(string); ok && header != "" {
+		version = header
+	}
+
+	err := s.workerManager.RecordHeartbeat(context.Background(), worker.Worker{
+		ID:      heartbeat.WorkerID,
+		Stage:   heartbeat.Stage,
+		Version: version,
+		SceneID: heartbeat.SceneID,
+	})
+	if err != nil {
+		s.logger.Errorf("Error recording heartbeat of worker %s: %v", heartbeat.WorkerID, err)
+	}
+	if heartbeat.SceneID != "" && (s.config.StageTimeout > 0 || s.config.StageQueueTimeout > 0) {
+		sceneID, _ := primitive.ObjectIDFromHex(heartbeat.SceneID)
+		err := s.queueManager.MarkStarted(context.Background(), s.stage(heartbeat.Stage).ListName, sceneID, heartbeat.WorkerID, s.config.WorkerHeartbeatTimeout)
+		if err != nil {
+			s.logger.Errorf("Error recording %s job of scene %s started by worker %s: %v", heartbeat.Stage, heartbeat.SceneID, heartbeat.WorkerID, err)
+		}
+	}
+	return nil
+}
+
+// ListWorkers returns the workers of the registry, whether they are online, and the number of online workers of every stage.
+func (s *AMPQService) ListWorkers(ctx context.Context) (*WorkerReport, error) {
+	workers, err := s.workerManager.ListWorkers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	report := &WorkerReport{Workers: make([]WorkerStatus, 0, len(workers)), Online: make(map[string]int, len(s.pipeline))}
+	for _, stage := range s.pipeline {
+		report.Online[stage.Name] = 0
+	}
+	for _, w := range workers {
+		online := w.OnlineAt(now, s.config.WorkerHeartbeatTimeout)
+		if online {
+			report.Online[w.Stage]++
+		}
+		report.Workers = append(report.Workers, WorkerStatus{Worker: w, Online: online})
+	}
+	return report, nil
+}
+
+// monitorWorkers checks that every stage with queued jobs has online workers every workerCheckInterval, until the
+// context is cancelled.
+func (s *AMPQService) monitorWorkers(ctx context.Context) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(workerCheckInterval)
+	defer ticker.Stop()
+
+	unavailable := make(map[string]bool, len(s.pipeline))
+	for {
+		s.checkWorkers(ctx, unavailable)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkWorkers exports the number of online workers of every stage, and logs the stages with queued jobs whose workers
+// all went offline. unavailable holds the stages already logged, so each outage is only logged once.
+func (s *AMPQService) checkWorkers(ctx context.Context, unavailable map[string]bool) {
+	report, err := s.ListWorkers(ctx)
+	if err != nil {
+		s.logger.Errorf("Error checking worker liveness: %v", err)
+		return
+	}
+	known := make(map[string]bool, len(s.pipeline))
+	for _, w := range report.Workers {
+		known[w.Stage] = true
+	}
+
+	for _, stage := range s.pipeline {
+		online := report.Online[stage.Name]
+		workersOnline.WithLabelValues(stage.Name).Set(float64(online))
+		if !known[stage.Name] || online > 0 {
+			if unavailable[stage.Name] {
+				s.logger.Infof("%d %s worker(s) online again", online, stage.Name)
+			}
+			unavailable[stage.Name] = false
+			continue
+		}
+
+		queued, err := s.queueManager.GetQueueSize(ctx, stage.ListName)
+		if err != nil || queued == 0 || unavailable[stage.Name] {
+			continue
+		}
+		unavailable[stage.Name] = true
+		s.logger.Errorf("No %s worker online for %s, %d job(s) are waiting in %s", stage.Name, s.config.WorkerHeartbeatTimeout, queued, stage.ListName)
+	}
+}
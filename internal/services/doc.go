@@ -9,4 +9,23 @@
 //   - ClientService:
 //     Is the main handler for dispatched http requests to the client. It is responsible for handling requests to the client,
 //     such as getting the user's scenes, starting a job, and much more
+//   - UploadService:
+//     Is the handler turning uploaded videos (single request or resumable uploads) into queued scenes, undoing the completed
+//     steps of a failed submission
+//   - AdminService:
+//     Is the handler for admin-only http requests, such as managing the announcements broadcast to all users
+//   - DigestService:
+//     Is the scheduler emailing users a periodic digest of their completed scenes and storage used
+//   - RetentionService:
+//     Is the scheduler deleting the outputs of inactive users according to the retention rule of their tier
+//   - ReplayService:
+//     Is the scheduler re-running the processing pipeline of scenes selected by admins, a few scenes at a time
+//   - IntegrityService:
+//     Is the scheduler verifying the stored files of every scene against their recorded sizes and checksums
+//   - BackupService:
+//     Is the handler creating, verifying and restoring database backups, used by admin routes and the backup CLI
+//   - AuditService:
+//     Is the handler recording logins, account changes, scene creation / deletion and admin actions to the audit log
+//   - NotificationService:
+//     Is the scheduler notifying users of their scenes advancing in the processing queue, and lists their notifications
 package services
\ No newline at end of file
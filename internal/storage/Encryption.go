@@ -0,0 +1,384 @@
+// This file contains the encryption at rest of the artifacts of scenes.
+//
+// With STORAGE_ENCRYPTION enabled, every artifact belonging to a scene (raw video, sfm frames, nerf outputs, thumbnails, and the
+// chunks of resumable uploads) is encrypted with AES-256-GCM before it reaches the backend. Each object gets its own key,
+// derived with HKDF-SHA256 from the STORAGE_ENCRYPTION_KEY master key of the secrets provider, a random salt stored in the
+// object header, and the ID of the scene (or upload) it belongs to, with its tenant for objects of isolated tenants (see
+// TenantKey), so every tenant gets keys of its own. Objects without a scene (i.e backups) are stored as they are.
+//
+// Objects are encrypted in segments of encryptionSegmentSize bytes, each sealed with its index (and whether it is the last one)
+// as nonce and the object key as additional data, so objects can be read from any offset (i.e range requests) without decrypting
+// them whole, and segments can not be reordered, truncated or moved to another key unnoticed.
+//
+// Encrypted objects are recognized by their header, and decrypted transparently by Open and sized by Stat, so objects stored
+// before encryption was enabled stay readable. The master key must stay configured as long as encrypted objects exist.
+// List reports the stored (encrypted) sizes.
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/secrets"
+)
+
+// Custom errors
+var (
+	// ErrDecryptionFailed is returned when reading an encrypted object that was tampered with, or encrypted with another master key.
+	ErrDecryptionFailed = errors.New("failed to decrypt object")
+	// ErrInvalidEncryptionKey is returned when the master key is not 32 base64 encoded bytes.
+	ErrInvalidEncryptionKey = errors.New("storage encryption key must be 32 base64 encoded bytes")
+)
+
+// Layout of encrypted objects: a header (magic, then the salt of the object key), followed by the sealed segments.
+// Every object has a last segment, empty if the plaintext size is a multiple of the segment size.
+const (
+	encryptionMagic       = "NRFENC01"
+	encryptionSaltSize    = 32
+	encryptionHeaderSize  = len(encryptionMagic) + encryptionSaltSize
+	encryptionSegmentSize = 64 * 1024
+	encryptionTagSize     = 16
+)
+
+// encryptedStorage encrypts the scene objects stored through it, and decrypts the encrypted objects read through it
+type encryptedStorage struct {
+	Storage
+	masterKey []byte
+	encrypt   bool
+}
+
+// WithEncryption wraps a storage so scene objects are encrypted at rest, if STORAGE_ENCRYPTION is enabled.
+// Whenever the STORAGE_ENCRYPTION_KEY secret is available, encrypted objects are decrypted, even with encryption disabled,
+// so encryption can be turned off without losing access to the objects encrypted so far.
+//
+// Returns the storage unchanged if encryption is disabled and no key is available, ErrInvalidEncryptionKey if the key
+// is malformed, error if encryption is enabled but the key is missing or empty.
+func WithEncryption(ctx context.Context, s Storage, cfg *config.Config, secretsProvider secrets.Provider) (Storage, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	encoded := strings.TrimSpace(secrets.GetOptionalSecret(ctx, secretsProvider, secrets.StorageEncryptionKey))
+	if encoded == "" {
+		if cfg.StorageEncryption {
+			return nil, errors.New("storage encryption is enabled, but no storage encryption key is configured")
+		}
+		return s, nil
+	}
+	masterKey, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(masterKey) != 32 {
+		return nil, ErrInvalidEncryptionKey
+	}
+	return &encryptedStorage{Storage: s, masterKey: masterKey, encrypt: cfg.StorageEncryption}, nil
+}
+
+// keyScope returns the ID of the scene (or upload) the object stored under key belongs to, as "<tenant>:<id>" for objects
+// under the prefix of a tenant.
+func keyScope(key string) (string, bool) {
+	tenant := ""
+	if rest, ok := strings.CutPrefix(key, "tenants/"); ok {
+		tenant, key, ok = strings.Cut(rest, "/")
+		if !ok || tenant == "" {
+			return "", false
+		}
+	}
+
+	var id string
+	parts := strings.Split(key, "/")
+	switch {
+	case len(parts) == 3 && parts[0] == "raw" && (parts[1] == "videos" || parts[1] == "images"):
+		id = strings.TrimSuffix(parts[2], path.Ext(parts[2]))
+	case len(parts) == 3 && parts[0] == "uploads" && parts[1] == "direct":
+		id = strings.TrimSuffix(parts[2], path.Ext(parts[2]))
+	case len(parts) >= 3 && (parts[0] == "sfm" || parts[0] == "nerf" || parts[0] == "thumbnails" || parts[0] == "uploads"):
+		id = parts[1]
+	default:
+		return "", false
+	}
+	if tenant != "" {
+		return tenant + ":" + id, true
+	}
+	return id, true
+}
+
+// objectCipher derives the cipher of the object stored under key, of the given scope, from the salt of its header.
+func (es *encryptedStorage) objectCipher(scope string, salt []byte) (cipher.AEAD, error) {
+	objectKey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, es.masterKey, salt, []byte("nerf-artifact:"+scope)), objectKey); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(objectKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// segmentNonce returns the nonce of the segment with the given index.
+func segmentNonce(index int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if last {
+		nonce[8] = 1
+	}
+	return nonce
+}
+
+// encryptedSize returns the stored size of an object of the given plaintext size.
+func encryptedSize(size int64) int64 {
+	return int64(encryptionHeaderSize) + size + encryptionTagSize*(size/encryptionSegmentSize+1)
+}
+
+// plaintextSize returns the plaintext size and number of segments of an encrypted object of the given stored size.
+func plaintextSize(stored int64) (int64, int64) {
+	body := stored - int64(encryptionHeaderSize)
+	segments := (body + encryptionSegmentSize + encryptionTagSize - 1) / (encryptionSegmentSize + encryptionTagSize)
+	return body - encryptionTagSize*segments, segments
+}
+
+func (es *encryptedStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	cleaned, err := CleanKey(key)
+	if err != nil {
+		return err
+	}
+	scope, ok := keyScope(cleaned)
+	if !es.encrypt || !ok {
+		return es.Storage.Put(ctx, key, r, size)
+	}
+
+	salt := make([]byte, encryptionSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := es.objectCipher(scope, salt)
+	if err != nil {
+		return err
+	}
+
+	if size >= 0 {
+		size = encryptedSize(size)
+	}
+	return es.Storage.Put(ctx, key, &encryptingReader{
+		src:     r,
+		aead:    aead,
+		aad:     []byte(cleaned),
+		pending: append([]byte(encryptionMagic), salt...),
+		plain:   make([]byte, encryptionSegmentSize),
+	}, size)
+}
+
+func (es *encryptedStorage) Open(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	object, err := es.Storage.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	cleaned, err := CleanKey(key)
+	if err != nil {
+		object.Close()
+		return nil, err
+	}
+	scope, ok := keyScope(cleaned)
+	if !ok {
+		return object, nil
+	}
+
+	salt, stored, err := readEncryptionHeader(object)
+	if err != nil {
+		object.Close()
+		return nil, err
+	}
+	if salt == nil {
+		if _, err := object.Seek(0, io.SeekStart); err != nil {
+			object.Close()
+			return nil, err
+		}
+		return object, nil
+	}
+
+	aead, err := es.objectCipher(scope, salt)
+	if err != nil {
+		object.Close()
+		return nil, err
+	}
+	size, segments := plaintextSize(stored)
+	return &decryptingReader{
+		src:      object,
+		aead:     aead,
+		aad:      []byte(cleaned),
+		size:     size,
+		segments: segments,
+		loaded:   -1,
+		cipher:   make([]byte, encryptionSegmentSize+encryptionTagSize),
+	}, nil
+}
+
+func (es *encryptedStorage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	info, err := es.Storage.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	cleaned, err := CleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := keyScope(cleaned); !ok || info.Size < int64(encryptionHeaderSize+encryptionTagSize) {
+		return info, nil
+	}
+
+	// Only the header tells encrypted objects apart
+	object, err := es.Storage.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+	salt, _, err := readEncryptionHeader(object)
+	if err != nil {
+		return nil, err
+	}
+	if salt != nil {
+		info.Size, _ = plaintextSize(info.Size)
+	}
+	return info, nil
+}
+
+// readEncryptionHeader reads the header of an object, and returns the salt of its key and its stored size.
+//
+// Returns a nil salt if the object is not encrypted.
+func readEncryptionHeader(object io.ReadSeeker) ([]byte, int64, error) {
+	stored, err := object.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, 0, err
+	}
+	if stored < int64(encryptionHeaderSize+encryptionTagSize) {
+		return nil, stored, nil
+	}
+	if _, err := object.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	header := make([]byte, encryptionHeaderSize)
+	if _, err := io.ReadFull(object, header); err != nil {
+		return nil, 0, err
+	}
+	if !bytes.Equal(header[:len(encryptionMagic)], []byte(encryptionMagic)) {
+		return nil, stored, nil
+	}
+	return header[len(encryptionMagic):], stored, nil
+}
+
+// encryptingReader reads the encrypted form (header, then sealed segments) of the plaintext read from src
+type encryptingReader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	aad     []byte
+	pending []byte
+	plain   []byte
+	index   int64
+	done    bool
+}
+
+func (er *encryptingReader) Read(p []byte) (int, error) {
+	for len(er.pending) == 0 {
+		if er.done {
+			return 0, io.EOF
+		}
+		// Only a short segment is the last one, a full one is followed by at least an empty last segment
+		n, err := io.ReadFull(er.src, er.plain)
+		last := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+		if err != nil && !last {
+			return 0, err
+		}
+		er.pending = er.aead.Seal(er.pending[:0], segmentNonce(er.index, last), er.plain[:n], er.aad)
+		er.index++
+		er.done = last
+	}
+	n := copy(p, er.pending)
+	er.pending = er.pending[n:]
+	return n, nil
+}
+
+// decryptingReader reads the plaintext of the encrypted object src, decrypting one segment at a time
+type decryptingReader struct {
+	src      io.ReadSeekCloser
+	aead     cipher.AEAD
+	aad      []byte
+	size     int64
+	segments int64
+	offset   int64
+	loaded   int64
+	plain    []byte
+	cipher   []byte
+}
+
+// load reads and decrypts the segment with the given index.
+func (dr *decryptingReader) load(index int64) error {
+	if _, err := dr.src.Seek(int64(encryptionHeaderSize)+index*(encryptionSegmentSize+encryptionTagSize), io.SeekStart); err != nil {
+		return err
+	}
+	n, err := io.ReadFull(dr.src, dr.cipher)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	plain, err := dr.aead.Open(dr.plain[:0], segmentNonce(index, index == dr.segments-1), dr.cipher[:n], dr.aad)
+	if err != nil {
+		return ErrDecryptionFailed
+	}
+	dr.plain = plain
+	dr.loaded = index
+	return nil
+}
+
+func (dr *decryptingReader) Read(p []byte) (int, error) {
+	if dr.offset >= dr.size {
+		// An empty object is only its last segment, which still has to be authentic
+		if dr.size == 0 && dr.loaded == -1 {
+			if err := dr.load(0); err != nil {
+				return 0, err
+			}
+		}
+		return 0, io.EOF
+	}
+	index := dr.offset / encryptionSegmentSize
+	if index != dr.loaded {
+		if err := dr.load(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, dr.plain[dr.offset-index*encryptionSegmentSize:])
+	dr.offset += int64(n)
+	return n, nil
+}
+
+func (dr *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += dr.offset
+	case io.SeekEnd:
+		offset += dr.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	dr.offset = offset
+	return offset, nil
+}
+
+func (dr *decryptingReader) Close() error {
+	return dr.src.Close()
+}
@@ -0,0 +1,208 @@
+// This file contains the artifact lifecycle hooks, fired when artifacts are created or deleted.
+//
+// Deployments can plug in custom post-processing (i.e mirroring to a CDN, notifying a render farm) without forking the service,
+// through a webhook (ARTIFACT_HOOK_URL) receiving a JSON HookEvent, and / or a shell command (ARTIFACT_HOOK_COMMAND) receiving
+// the event as ARTIFACT_EVENT, ARTIFACT_STORE, ARTIFACT_KEY and ARTIFACT_SIZE environment variables. Webhook requests are signed
+// with the optional ARTIFACT_HOOK_SECRET secret, as a hex HMAC-SHA256 of the body in the X-Artifact-Hook-Signature header.
+//
+// Hooks are fired asynchronously after the operation succeeded, in order, and are best-effort: they never fail or slow down the storage
+// operation, failures are logged, and events are dropped while too many are pending.
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/secrets"
+)
+
+// Declarations for hook events
+const (
+	HookEventCreated = "artifact.created"
+	HookEventDeleted = "artifact.deleted"
+)
+
+// maxPendingHookEvents is the number of events waiting for their hooks before new events are dropped
+const maxPendingHookEvents = 1024
+
+// HookEvent is the payload of an artifact lifecycle hook
+type HookEvent struct {
+	Event     string    `json:"event"`
+	Store     string    `json:"store"`
+	Key       string    `json:"key"`
+	Size      int64     `json:"size,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Hooks fires the configured webhook and / or command for every artifact lifecycle event.
+type Hooks struct {
+	url     string
+	command string
+	secret  string
+	timeout time.Duration
+	client  *http.Client
+	events  chan HookEvent
+	logger  *log.Logger
+}
+
+// NewHooks creates the configured artifact lifecycle hooks, and starts the worker firing them one event at a time,
+// so events are delivered in the order they happened.
+//
+// Returns nil if no hook is configured.
+func NewHooks(ctx context.Context, cfg *config.Config, secretsProvider secrets.Provider, logger *log.Logger) *Hooks {
+	if cfg.ArtifactHookURL == "" && cfg.ArtifactHookCommand == "" {
+		return nil
+	}
+
+	h := &Hooks{
+		url:     cfg.ArtifactHookURL,
+		command: cfg.ArtifactHookCommand,
+		secret:  secrets.GetOptionalSecret(ctx, secretsProvider, secrets.ArtifactHookSecret),
+		timeout: cfg.ArtifactHookTimeout,
+		client:  &http.Client{Timeout: cfg.ArtifactHookTimeout},
+		events:  make(chan HookEvent, maxPendingHookEvents),
+		logger:  logger,
+	}
+	go h.run()
+	return h
+}
+
+// fire queues an event, dropping it if too many events are pending.
+func (h *Hooks) fire(event HookEvent) {
+	select {
+	case h.events <- event:
+	default:
+		h.logger.Warnf("Dropped %s hook of %s, too many hooks pending", event.Event, event.Key)
+	}
+}
+
+// run fires the queued events, forever.
+func (h *Hooks) run() {
+	for event := range h.events {
+		if h.url != "" {
+			if err := h.post(event); err != nil {
+				h.logger.Warnf("Artifact webhook failed for %s of %s: %v", event.Event, event.Key, err)
+			}
+		}
+		if h.command != "" {
+			if err := h.exec(event); err != nil {
+				h.logger.Warnf("Artifact hook command failed for %s of %s: %v", event.Event, event.Key, err)
+			}
+		}
+	}
+}
+
+// post sends the event to the webhook. Any non 2xx response is an error.
+func (h *Hooks) post(event HookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.secret != "" {
+		mac := hmac.New(sha256.New, []byte(h.secret))
+		mac.Write(body)
+		req.Header.Set("X-Artifact-Hook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// exec runs the hook command through the shell, with the event in its environment.
+func (h *Hooks) exec(event HookEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", h.command)
+	cmd.Env = append(os.Environ(),
+		"ARTIFACT_EVENT="+event.Event,
+		"ARTIFACT_STORE="+event.Store,
+		"ARTIFACT_KEY="+event.Key,
+		"ARTIFACT_SIZE="+strconv.FormatInt(event.Size, 10),
+	)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+// hookedStorage fires the lifecycle hooks of the objects created and deleted through the wrapped storage
+type hookedStorage struct {
+	Storage
+	store string
+	hooks *Hooks
+}
+
+// WithHooks wraps a storage so the given hooks fire for every object created or deleted through it, labelled with
+// the given store (i.e StoreArtifacts). The storage is returned unchanged if hooks is nil.
+func WithHooks(s Storage, store string, hooks *Hooks) Storage {
+	if s == nil || hooks == nil {
+		return s
+	}
+	return &hookedStorage{Storage: s, store: store, hooks: hooks}
+}
+
+func (hs *hookedStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	body := &countingReader{r: r}
+	if err := hs.Storage.Put(ctx, key, body, size); err != nil {
+		return err
+	}
+	hs.fire(HookEventCreated, key, body.n)
+	return nil
+}
+
+func (hs *hookedStorage) Delete(ctx context.Context, key string) error {
+	if err := hs.Storage.Delete(ctx, key); err != nil {
+		return err
+	}
+	hs.fire(HookEventDeleted, key, 0)
+	return nil
+}
+
+// fire fires the hooks of an event of the object stored under key.
+func (hs *hookedStorage) fire(event, key string, size int64) {
+	if cleaned, err := CleanKey(key); err == nil {
+		key = cleaned
+	}
+	hs.hooks.fire(HookEvent{Event: event, Store: hs.store, Key: key, Size: size, Timestamp: time.Now().UTC()})
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
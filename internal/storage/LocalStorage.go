@@ -0,0 +1,164 @@
+// This file contains the LocalStorage implementation, which stores artifacts on the filesystem below a root directory.
+//
+// When running several replicas, the root should be a shared volume, otherwise replicas cannot serve each other's artifacts
+// and S3Storage should be used instead. Objects are written to a temporary file and renamed, so readers never see partial writes.
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tempPrefix prefixes the names of the temporary files objects are written to before being renamed
+const tempPrefix = ".upload-"
+
+// LocalStorage stores artifacts below a root directory
+type LocalStorage struct {
+	root string
+}
+
+// NewLocalStorage creates a LocalStorage rooted at the given directory.
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{root: root}
+}
+
+// path returns the filesystem path of a key.
+func (ls *LocalStorage) path(key string) (string, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(ls.root, filepath.FromSlash(key)), nil
+}
+
+// Put stores the contents of r under key.
+func (ls *LocalStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	p, err := ls.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p), tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// Open opens the object stored under key.
+func (ls *LocalStorage) Open(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	p, err := ls.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrObjectNotFound
+	}
+	return f, err
+}
+
+// Stat returns the metadata of the object stored under key.
+func (ls *LocalStorage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	p, err := ls.path(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && info.IsDir()) {
+		return nil, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	cleaned, _ := CleanKey(key)
+	return &ObjectInfo{Key: cleaned, Size: info.Size(), ModTime: info.ModTime().UTC()}, nil
+}
+
+// Delete deletes the object stored under key.
+func (ls *LocalStorage) Delete(ctx context.Context, key string) error {
+	p, err := ls.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// List returns the metadata of every object whose key starts with prefix. Only the directory of the prefix is walked, and
+// the temporary files of writes in progress are skipped.
+func (ls *LocalStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	start := ls.root
+	if i := strings.LastIndex(prefix, "/"); i > 0 {
+		p, err := ls.path(prefix[:i])
+		if err != nil {
+			return nil, err
+		}
+		start = p
+	}
+
+	objects := make([]ObjectInfo, 0)
+	err := filepath.WalkDir(start, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if p == start {
+			return nil
+		}
+		rel, err := filepath.Rel(ls.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if d.IsDir() {
+			// Every key below a directory starts with its key, so a directory matching neither way holds no match
+			if !strings.HasPrefix(key, prefix) && !strings.HasPrefix(prefix, key+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasPrefix(key, prefix) || strings.HasPrefix(d.Name(), tempPrefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			// Deleted or renamed meanwhile
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		objects = append(objects, ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime().UTC()})
+		return nil
+	})
+	return objects, err
+}
+
+// Backend returns "local".
+func (ls *LocalStorage) Backend() string {
+	return BackendLocal
+}
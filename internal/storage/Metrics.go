@@ -0,0 +1,135 @@
+// This file contains the instrumentation of the storage backends, exported as Prometheus metrics.
+//
+// Every backend created by New, NewArchive and NewBackup is wrapped, so each operation is timed and counted, labelled with
+// the store (artifacts, archive, backup), the backend (local, s3), the operation and its result. Bytes written by Put and
+// read through Open are counted too. Results are "ok", "not_found", "invalid_key", "canceled", the S3 error code
+// (i.e "SlowDown" when a bucket throttles requests) or "error", so slow volumes and throttled buckets can be told apart.
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Declarations for the store label
+const (
+	StoreArtifacts = "artifacts"
+	StoreArchive   = "archive"
+	StoreBackup    = "backup"
+)
+
+var (
+	operationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "storage_operation_duration_seconds",
+		Help:    "Duration of storage operations. Open only covers opening the object, not reading it.",
+		Buckets: []float64{.001, .005, .01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"store", "backend", "operation", "result"})
+	bytesTransferred = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "storage_bytes_total",
+		Help: "Bytes written to (Put) and read from (Open) storage.",
+	}, []string{"store", "backend", "direction"})
+)
+
+// instrumentedStorage records metrics of every operation of the wrapped storage
+type instrumentedStorage struct {
+	Storage
+	store string
+}
+
+// instrument wraps a storage backend, labelling its metrics with the given store.
+func instrument(s Storage, store string) Storage {
+	return &instrumentedStorage{Storage: s, store: store}
+}
+
+// observe records the duration and result of an operation started at start.
+func (is *instrumentedStorage) observe(operation string, start time.Time, err error) {
+	operationDuration.WithLabelValues(is.store, is.Backend(), operation, resultLabel(err)).Observe(time.Since(start).Seconds())
+}
+
+// resultLabel returns the result label of an operation error.
+func resultLabel(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, ErrObjectNotFound):
+		return "not_found"
+	case errors.Is(err, ErrInvalidKey):
+		return "invalid_key"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "canceled"
+	}
+	if code := minio.ToErrorResponse(err).Code; code != "" {
+		return code
+	}
+	return "error"
+}
+
+func (is *instrumentedStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	start := time.Now()
+	body := &meteredReader{r: r, bytes: bytesTransferred.WithLabelValues(is.store, is.Backend(), "write")}
+	err := is.Storage.Put(ctx, key, body, size)
+	is.observe("put", start, err)
+	return err
+}
+
+func (is *instrumentedStorage) Open(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	start := time.Now()
+	f, err := is.Storage.Open(ctx, key)
+	is.observe("open", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &meteredReadSeekCloser{ReadSeekCloser: f, bytes: bytesTransferred.WithLabelValues(is.store, is.Backend(), "read")}, nil
+}
+
+func (is *instrumentedStorage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	start := time.Now()
+	info, err := is.Storage.Stat(ctx, key)
+	is.observe("stat", start, err)
+	return info, err
+}
+
+func (is *instrumentedStorage) Delete(ctx context.Context, key string) error {
+	start := time.Now()
+	err := is.Storage.Delete(ctx, key)
+	is.observe("delete", start, err)
+	return err
+}
+
+func (is *instrumentedStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	start := time.Now()
+	objects, err := is.Storage.List(ctx, prefix)
+	is.observe("list", start, err)
+	return objects, err
+}
+
+// meteredReader counts the bytes read through it
+type meteredReader struct {
+	r     io.Reader
+	bytes prometheus.Counter
+}
+
+func (mr *meteredReader) Read(p []byte) (int, error) {
+	n, err := mr.r.Read(p)
+	mr.bytes.Add(float64(n))
+	return n, err
+}
+
+// meteredReadSeekCloser counts the bytes read through it
+type meteredReadSeekCloser struct {
+	io.ReadSeekCloser
+	bytes prometheus.Counter
+}
+
+func (mr *meteredReadSeekCloser) Read(p []byte) (int, error) {
+	n, err := mr.ReadSeekCloser.Read(p)
+	mr.bytes.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,49 @@
+// This file contains the presigned uploads, letting clients upload objects directly to the backend instead of through
+// the server.
+//
+// Only the s3 backend can presign uploads. Objects uploaded directly bypass every wrapper of the backend: they are
+// stored unencrypted, so uploads can not be presigned while STORAGE_ENCRYPTION is enabled, and no artifact hook is fired
+// for their creation.
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrPresignUnsupported is returned when presigning an upload to a backend that can not presign uploads.
+var ErrPresignUnsupported = errors.New("storage backend does not support direct uploads")
+
+// maxPresignExpiry is the longest validity of a presigned URL accepted by S3
+const maxPresignExpiry = 7 * 24 * time.Hour
+
+// presigner is implemented by backends that can presign uploads.
+type presigner interface {
+	PresignPut(ctx context.Context, key string, expiry time.Duration) (string, error)
+}
+
+// PresignPut returns a URL uploading the object stored under key with a single PUT request directly to the backend of s,
+// valid for the given duration (at most 7 days).
+//
+// Returns ErrPresignUnsupported if the backend can not presign uploads, or objects stored through s are encrypted.
+func PresignPut(ctx context.Context, s Storage, key string, expiry time.Duration) (string, error) {
+	for {
+		switch backend := s.(type) {
+		case presigner:
+			return backend.PresignPut(ctx, key, min(expiry, maxPresignExpiry))
+		case *instrumentedStorage:
+			s = backend.Storage
+		case *hookedStorage:
+			s = backend.Storage
+		case *encryptedStorage:
+			if backend.encrypt {
+				return "", ErrPresignUnsupported
+			}
+			s = backend.Storage
+		default:
+			return "", ErrPresignUnsupported
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// This file contains the S3Storage implementation, which stores artifacts in an S3 compatible bucket (AWS S3, MinIO, etc.).
+// Keys are used as object names unchanged, so the bucket layout matches the LocalStorage directory layout.
+// Clients can upload objects directly to the bucket with presigned PUT URLs, see PresignPut.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Storage stores artifacts in an S3 compatible bucket
+type S3Storage struct {
+	client *minio.Client
+	// presignClient signs the URLs given to clients, for the public endpoint of the server
+	presignClient *minio.Client
+	bucket        string
+	// partSize is the size of the parts objects of unknown size are streamed in, buffered in memory once per upload
+	partSize uint64
+}
+
+// NewS3Storage creates an S3Storage for the given bucket, creating the bucket if it does not exist.
+// Presigned URLs are issued for publicEndpoint, or endpoint if it is empty. Objects of unknown size are streamed in parts
+// of partSize bytes.
+func NewS3Storage(ctx context.Context, endpoint, publicEndpoint, region, bucket, accessKey, secretKey string, useSSL bool, partSize int64) (*S3Storage, error) {
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure: useSSL,
+		Region: region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %v", err)
+	}
+	presignClient := client
+	if publicEndpoint != "" && publicEndpoint != endpoint {
+		// The region is set, so signing never contacts the public endpoint
+		presignClient, err = minio.New(publicEndpoint, &minio.Options{
+			Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+			Secure: useSSL,
+			Region: region,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create S3 presign client: %v", err)
+		}
+	}
+
+	exists, err := client.BucketExists(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check S3 bucket %s: %v", bucket, err)
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{Region: region}); err != nil {
+			return nil, fmt.Errorf("failed to create S3 bucket %s: %v", bucket, err)
+		}
+	}
+
+	return &S3Storage{client: client, presignClient: presignClient, bucket: bucket, partSize: uint64(partSize)}, nil
+}
+
+// isNotFound checks if a minio error is a missing object / bucket error.
+func isNotFound(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NotFound"
+}
+
+// Put stores the contents of r under key. Contents of unknown size (size < 0) are streamed in parts of the configured part
+// size, instead of the part size minio picks for the largest possible object, which would buffer hundreds of MiB per upload.
+func (ss *S3Storage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	key, err := CleanKey(key)
+	if err != nil {
+		return err
+	}
+	opts := minio.PutObjectOptions{
+		ContentType: mime.TypeByExtension(path.Ext(key)),
+	}
+	if size < 0 {
+		opts.PartSize = ss.partSize
+	}
+	_, err = ss.client.PutObject(ctx, ss.bucket, key, r, size, opts)
+	return err
+}
+
+// Open opens the object stored under key. Seeking issues ranged GET requests, so large objects are never fully buffered.
+func (ss *S3Storage) Open(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	// GetObject is lazy, stat first so missing objects are reported here instead of on first read
+	if _, err := ss.client.StatObject(ctx, ss.bucket, key, minio.StatObjectOptions{}); err != nil {
+		if isNotFound(err) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+	return ss.client.GetObject(ctx, ss.bucket, key, minio.GetObjectOptions{})
+}
+
+// Stat returns the metadata of the object stored under key.
+func (ss *S3Storage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := ss.client.StatObject(ctx, ss.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+	return &ObjectInfo{Key: key, Size: info.Size, ModTime: info.LastModified.UTC()}, nil
+}
+
+// Delete deletes the object stored under key.
+func (ss *S3Storage) Delete(ctx context.Context, key string) error {
+	key, err := CleanKey(key)
+	if err != nil {
+		return err
+	}
+	err = ss.client.RemoveObject(ctx, ss.bucket, key, minio.RemoveObjectOptions{})
+	if err != nil && isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// List returns the metadata of every object whose key starts with prefix.
+func (ss *S3Storage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects := make([]ObjectInfo, 0)
+	for obj := range ss.client.ListObjects(ctx, ss.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		objects = append(objects, ObjectInfo{Key: obj.Key, Size: obj.Size, ModTime: obj.LastModified.UTC()})
+	}
+	return objects, nil
+}
+
+// PresignPut returns a URL uploading the object stored under key with a single PUT request, valid for the given duration.
+func (ss *S3Storage) PresignPut(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	u, err := ss.presignClient.PresignedPutObject(ctx, ss.bucket, key, expiry)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// Backend returns "s3".
+func (ss *S3Storage) Backend() string {
+	return BackendS3
+}
@@ -0,0 +1,182 @@
+// This file contains the Storage interface, key helpers, and the constructor selecting the configured backend.
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/secrets"
+)
+
+// Custom errors
+var (
+	// ErrObjectNotFound is returned when the requested key does not exist in storage.
+	ErrObjectNotFound = errors.New("object not found")
+	// ErrInvalidKey is returned when a key is empty or escapes the storage root (i.e contains "..").
+	ErrInvalidKey = errors.New("invalid storage key")
+	// ErrUnknownBackend is returned when the configured storage backend is not supported.
+	ErrUnknownBackend = errors.New("unknown storage backend")
+)
+
+// Declarations for valid backends
+const (
+	BackendLocal = "local"
+	BackendS3    = "s3"
+)
+
+// ObjectInfo represents the metadata of a stored object
+type ObjectInfo struct {
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// Storage is implemented by every artifact storage backend.
+type Storage interface {
+	// Put stores the contents of r under key, replacing any existing object. size may be -1 if unknown.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Open opens the object stored under key for reading. The caller must close it.
+	Open(ctx context.Context, key string) (io.ReadSeekCloser, error)
+	// Stat returns the metadata of the object stored under key.
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	// Delete deletes the object stored under key. Deleting a missing object is not an error.
+	Delete(ctx context.Context, key string) error
+	// List returns the metadata of every object whose key starts with prefix.
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	// Backend returns the name of the backend (local, s3).
+	Backend() string
+}
+
+// New creates the storage backend selected by the configuration.
+// S3 credentials are read from the secrets provider.
+func New(ctx context.Context, cfg *config.Config, secretsProvider secrets.Provider) (Storage, error) {
+	return newBackend(ctx, StoreArtifacts, cfg.StorageBackend, cfg.StorageLocalRoot, cfg.S3Bucket, cfg, secretsProvider)
+}
+
+// NewArchive creates the cold storage archived scene outputs are moved to. An s3 cold storage uses the S3 server and
+// credentials of the artifact storage, with its own bucket.
+//
+// Returns (nil, nil) if archival is disabled.
+func NewArchive(ctx context.Context, cfg *config.Config, secretsProvider secrets.Provider) (Storage, error) {
+	if cfg.ArchiveBackend == "" {
+		return nil, nil
+	}
+	return newBackend(ctx, StoreArchive, cfg.ArchiveBackend, cfg.ArchiveLocalRoot, cfg.ArchiveS3Bucket, cfg, secretsProvider)
+}
+
+// NewBackup creates the storage database backups are written to. An s3 backup storage uses the S3 server and
+// credentials of the artifact storage, with its own bucket.
+func NewBackup(ctx context.Context, cfg *config.Config, secretsProvider secrets.Provider) (Storage, error) {
+	return newBackend(ctx, StoreBackup, cfg.BackupBackend, cfg.BackupLocalRoot, cfg.BackupS3Bucket, cfg, secretsProvider)
+}
+
+// newBackend creates a local storage rooted at localRoot, or an s3 storage of bucket, instrumented as the given store.
+func newBackend(ctx context.Context, store, backend, localRoot, bucket string, cfg *config.Config, secretsProvider secrets.Provider) (Storage, error) {
+	switch backend {
+	case BackendLocal:
+		return instrument(NewLocalStorage(localRoot), store), nil
+	case BackendS3:
+		accessKey, err := secretsProvider.GetSecret(ctx, secrets.S3AccessKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get S3 access key: %v", err)
+		}
+		secretKey, err := secretsProvider.GetSecret(ctx, secrets.S3SecretKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get S3 secret key: %v", err)
+		}
+		s3, err := NewS3Storage(ctx, cfg.S3Endpoint, cfg.S3PublicEndpoint, cfg.S3Region, bucket, accessKey, secretKey, cfg.S3UseSSL, cfg.S3PartSize)
+		if err != nil {
+			return nil, err
+		}
+		return instrument(s3, store), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownBackend, backend)
+	}
+}
+
+// CleanKey validates and normalizes a key. Leading slashes and the legacy "data/" prefix
+// (from when artifacts were addressed by local path) are removed.
+//
+// Returns ErrInvalidKey if the key is empty or escapes the storage root.
+func CleanKey(key string) (string, error) {
+	key = strings.TrimLeft(key, "/")
+	key = strings.TrimPrefix(key, "data/")
+	if key == "" {
+		return "", ErrInvalidKey
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == ".." {
+			return "", ErrInvalidKey
+		}
+	}
+	return path.Clean(key), nil
+}
+
+// Key helpers. Every artifact key should be built with one of these, so the layout stays consistent across backends.
+
+// TenantKey returns the given key under the prefix of the given tenant, so the files of tenants never share keys.
+// Keys of the default tenant ("") are unchanged.
+func TenantKey(tenant, key string) string {
+	if tenant == "" {
+		return key
+	}
+	return path.Join("tenants", tenant, key)
+}
+
+// RawVideoKey returns the key of the uploaded video of a scene.
+func RawVideoKey(sceneID, ext string) string {
+	return path.Join("raw", "videos", sceneID+ext)
+}
+
+// RawImageSetKey returns the key of the zip archive of photos uploaded instead of a video for a scene.
+func RawImageSetKey(sceneID string) string {
+	return path.Join("raw", "images", sceneID+".zip")
+}
+
+// UploadChunkKey returns the key of a chunk of a resumable upload, starting at the given byte offset.
+// The nonce keeps chunks sent concurrently for the same offset apart.
+func UploadChunkKey(uploadID string, offset int64, nonce string) string {
+	return path.Join("uploads", uploadID, fmt.Sprintf("%020d-%s", offset, nonce))
+}
+
+// DirectUploadKey returns the key a client uploads the file of a direct upload for a scene to, with a presigned URL.
+// The file is copied to the key of the input of the scene once validated, so keys clients were given are never processed.
+func DirectUploadKey(sceneID, ext string) string {
+	return path.Join("uploads", "direct", sceneID+ext)
+}
+
+// SfmFrameKey returns the key of a frame produced by the sfm worker.
+func SfmFrameKey(sceneID, fileName string) string {
+	return path.Join("sfm", sceneID, fileName)
+}
+
+// ThumbnailKey returns the key of a thumbnail image of a scene.
+func ThumbnailKey(sceneID, fileName string) string {
+	return path.Join("thumbnails", sceneID, fileName)
+}
+
+// BackupKey returns the key of a file of the given backup, in the backup storage.
+func BackupKey(backupID, fileName string) string {
+	return path.Join(backupID, fileName)
+}
+
+// NerfOutputKey returns the key of an output produced by the nerf worker.
+func NerfOutputKey(sceneID, outputType string, iteration int, fileName string) string {
+	return path.Join("nerf", sceneID, outputType, fmt.Sprintf("iteration_%d", iteration), fileName)
+}
+
+// NerfVersionOutputKey returns the key of an output produced by the nerf worker for the given version of a scene.
+// The first version is stored under the key of NerfOutputKey, so scenes trained before they were versioned keep their keys.
+func NerfVersionOutputKey(sceneID string, version int, outputType string, iteration int, fileName string) string {
+	if version <= 1 {
+		return NerfOutputKey(sceneID, outputType, iteration, fileName)
+	}
+	return path.Join("nerf", sceneID, fmt.Sprintf("v%d", version), outputType, fmt.Sprintf("iteration_%d", iteration), fileName)
+}
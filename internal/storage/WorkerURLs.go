@@ -0,0 +1,114 @@
+// This file contains the signing of the URLs workers download the inputs of their jobs from.
+//
+// Workers download the inputs of their jobs (raw videos, image sets and sfm frames) from the /worker-data route, which has no
+// user to authenticate. The URLs published in jobs carry an expiry time and an HMAC-SHA256 signature of the key and expiry,
+// made with the WORKER_DATA_KEY secret shared by every replica, so only the inputs of published jobs can be downloaded, and
+// only for WORKER_DATA_URL_TTL after their job was published. Jobs published again (i.e timed out jobs) get fresh URLs.
+
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/secrets"
+)
+
+// Custom errors
+var (
+	// ErrInvalidWorkerURL is returned when a worker data URL is not signed, has an invalid signature or expired.
+	ErrInvalidWorkerURL = errors.New("invalid or expired worker data URL")
+)
+
+// Query parameters of signed worker data URLs
+const (
+	workerURLExpiresParam   = "expires"
+	workerURLSignatureParam = "signature"
+)
+
+// WorkerURLSigner signs and verifies the worker data URLs of job inputs
+type WorkerURLSigner struct {
+	key []byte
+	ttl time.Duration
+}
+
+// NewWorkerURLSigner creates a signer with the WORKER_DATA_KEY secret, whose URLs expire after WORKER_DATA_URL_TTL.
+//
+// Returns error if the key is missing or empty.
+func NewWorkerURLSigner(ctx context.Context, cfg *config.Config, secretsProvider secrets.Provider) (*WorkerURLSigner, error) {
+	key, err := secretsProvider.GetSecret(ctx, secrets.WorkerDataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the worker data key: %w", err)
+	}
+	if key == "" {
+		return nil, errors.New("no worker data key is configured")
+	}
+	return &WorkerURLSigner{key: []byte(key), ttl: cfg.WorkerDataURLTTL}, nil
+}
+
+// Sign returns the query string of the worker data URL of the object stored under the given (cleaned) key.
+func (s *WorkerURLSigner) Sign(key string) string {
+	expires := strconv.FormatInt(time.Now().Add(s.ttl).Unix(), 10)
+	return url.Values{
+		workerURLExpiresParam:   {expires},
+		workerURLSignatureParam: {s.signature(key, expires)},
+	}.Encode()
+}
+
+// Verify checks that the given query parameters sign the worker data URL of the object stored under the given (cleaned) key,
+// and have not expired.
+//
+// Returns nil if valid, ErrInvalidWorkerURL otherwise.
+func (s *WorkerURLSigner) Verify(key string, query url.Values) error {
+	expires := query.Get(workerURLExpiresParam)
+	signature, err := hex.DecodeString(query.Get(workerURLSignatureParam))
+	if err != nil || expires == "" {
+		return ErrInvalidWorkerURL
+	}
+	expected, _ := hex.DecodeString(s.signature(key, expires))
+	if !hmac.Equal(signature, expected) {
+		return ErrInvalidWorkerURL
+	}
+	expiry, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > expiry {
+		return ErrInvalidWorkerURL
+	}
+	return nil
+}
+
+// signature returns the hex encoded signature of the given key and expiry time.
+func (s *WorkerURLSigner) signature(key, expires string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(key + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// IsWorkerInputKey reports whether the object stored under the given (cleaned) key may be a job input served to workers:
+// a raw video or image set, or an sfm frame, of any tenant.
+func IsWorkerInputKey(key string) bool {
+	if rest, ok := strings.CutPrefix(key, "tenants/"); ok {
+		tenant, rest, ok := strings.Cut(rest, "/")
+		if !ok || tenant == "" {
+			return false
+		}
+		key = rest
+	}
+	parts := strings.Split(key, "/")
+	switch {
+	case len(parts) == 3 && parts[0] == "raw" && (parts[1] == "videos" || parts[1] == "images"):
+		return true
+	case len(parts) >= 3 && parts[0] == "sfm":
+		return true
+	default:
+		return false
+	}
+}
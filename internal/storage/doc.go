@@ -0,0 +1,16 @@
+// Package storage contains the storage abstraction used for every artifact (raw videos, sfm frames, nerf outputs).
+//
+// Artifacts are addressed by instance-agnostic keys (i.e "raw/videos/<scene id>.mp4", "sfm/<scene id>/<frame>.png",
+// "nerf/<scene id>/<output type>/iteration_<n>/<file>") instead of local file paths, so that any web-server replica behind a
+// load balancer can read and serve any scene's artifacts. Keys, not paths or URLs, should be stored in the database.
+//
+// Current backends include:
+//   - LocalStorage:
+//     Stores artifacts on a local (or shared, i.e NFS / docker volume) filesystem below a root directory
+//   - S3Storage:
+//     Stores artifacts in an S3 compatible bucket (AWS S3, MinIO, etc.), and presigns direct uploads (see PresignPut)
+//
+// Backends created by New, NewArchive and NewBackup are instrumented, exporting the duration, result and transferred bytes
+// of every operation as Prometheus metrics. WithEncryption optionally encrypts the artifacts of scenes at rest, and WithHooks
+// fires the configured lifecycle hooks of created and deleted artifacts.
+package storage
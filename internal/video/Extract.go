@@ -0,0 +1,57 @@
+// This file contains the frame extraction of stored videos, used to generate the thumbnail of a scene as soon as its video
+// is uploaded. Unlike the prober, it runs an external ffmpeg binary, since frames can not be extracted without decoding.
+
+package video
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Custom errors
+var (
+	// ErrNoFrame is returned when ffmpeg extracted no frame, i.e the requested time is past the end of the video
+	ErrNoFrame = errors.New("no frame extracted")
+)
+
+// ExtractFrame decodes the frame of the video file at the given path, in the container with the given file extension
+// (i.e ".mp4"), shown at the given time, scaled down to at most maxWidth pixels wide, with the given ffmpeg binary.
+//
+// Returns the frame encoded as PNG if successful, ErrNoFrame if no frame was extracted, ErrUnsupportedContainer if the
+// container is not accepted at ingest, error if ffmpeg failed.
+func ExtractFrame(ctx context.Context, ffmpegPath, container, videoPath string, at time.Duration, maxWidth int) ([]byte, error) {
+	input, err := inputArgs(container, videoPath)
+	if err != nil {
+		return nil, err
+	}
+	// Seeking before the input jumps to the closest keyframe and decodes from there, instead of decoding the whole video
+	args := append([]string{"-nostdin", "-loglevel", "error", "-ss", strconv.FormatFloat(at.Seconds(), 'f', 3, 64)}, input...)
+	args = append(args,
+		"-frames:v", "1",
+		"-vf", fmt.Sprintf("scale='min(%d,iw)':-2", maxWidth),
+		"-f", "image2pipe", "-c:v", "png", "pipe:1",
+	)
+	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, fmt.Errorf("ffmpeg failed: %v: %s", err, message)
+		}
+		return nil, fmt.Errorf("ffmpeg failed: %v", err)
+	}
+	if stdout.Len() == 0 {
+		return nil, ErrNoFrame
+	}
+	if stdout.Len() > maxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	return stdout.Bytes(), nil
+}
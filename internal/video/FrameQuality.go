@@ -0,0 +1,143 @@
+// This file contains the frame quality heuristics used to choose the thumbnail of a scene among its frames.
+//
+// Frames are scored on a grayscale grid of at most qualitySamples samples per side, so the cost of scoring does not grow with
+// the resolution of the frame, and the detail measured is the detail still visible at thumbnail size.
+
+package video
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math"
+)
+
+// Custom errors
+var (
+	// ErrFrameTooLarge is returned when a frame is too large to be decoded for scoring
+	ErrFrameTooLarge = errors.New("frame is too large to be scored")
+)
+
+const (
+	// maxFrameSize caps the size of an encoded frame read into memory for scoring
+	maxFrameSize = 64 * 1024 * 1024
+	// maxFramePixels caps the resolution of a frame decoded for scoring
+	maxFramePixels = 50_000_000
+	// qualitySamples is the number of samples along the largest side of a scored frame
+	qualitySamples = 256
+	// clipLow and clipHigh are the luminances below and above which a sample is considered clipped
+	clipLow  = 0.02
+	clipHigh = 0.98
+)
+
+// FrameQuality describes the visual quality of a frame
+type FrameQuality struct {
+	// Sharpness is the variance of the Laplacian of the frame, higher for frames with more in-focus detail
+	Sharpness float64
+	// Exposure is 1 for a well exposed frame, and tends to 0 as the frame gets darker or brighter, or more of it is clipped
+	Exposure float64
+}
+
+// MeasureFrameQuality decodes a PNG or JPEG frame read from r and measures its quality.
+//
+// Returns ErrFrameTooLarge if the frame exceeds the size or resolution limits, error if it can not be decoded.
+func MeasureFrameQuality(r io.Reader) (*FrameQuality, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxFrameSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode frame: %v", err)
+	}
+	if config.Width*config.Height > maxFramePixels {
+		return nil, ErrFrameTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode frame: %v", err)
+	}
+	return measure(img), nil
+}
+
+// measure computes the quality of a decoded frame from its grayscale grid.
+func measure(img image.Image) *FrameQuality {
+	bounds := img.Bounds()
+	step := max(1, max(bounds.Dx(), bounds.Dy())/qualitySamples)
+	width, height := bounds.Dx()/step, bounds.Dy()/step
+	if width == 0 || height == 0 {
+		return &FrameQuality{}
+	}
+
+	// Luminance of the samples, between 0 and 1
+	gray := make([]float64, width*height)
+	var sum float64
+	clipped := 0
+	for y := range height {
+		for x := range width {
+			r, g, b, _ := img.At(bounds.Min.X+x*step, bounds.Min.Y+y*step).RGBA()
+			l := (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 0xffff
+			gray[y*width+x] = l
+			sum += l
+			if l < clipLow || l > clipHigh {
+				clipped++
+			}
+		}
+	}
+	mean := sum / float64(len(gray))
+	exposure := (1 - math.Abs(mean-0.5)*2) * (1 - float64(clipped)/float64(len(gray)))
+
+	// Variance of the 4-neighbour Laplacian over the interior samples
+	var lapSum, lapSquares float64
+	n := 0
+	for y := 1; y < height-1; y++ {
+		for x := 1; x < width-1; x++ {
+			i := y*width + x
+			lap := gray[i-1] + gray[i+1] + gray[i-width] + gray[i+width] - 4*gray[i]
+			lapSum += lap
+			lapSquares += lap * lap
+			n++
+		}
+	}
+	sharpness := 0.0
+	if n > 0 {
+		lapMean := lapSum / float64(n)
+		sharpness = lapSquares/float64(n) - lapMean*lapMean
+	}
+	return &FrameQuality{Sharpness: sharpness, Exposure: max(0, exposure)}
+}
+
+// BestFrame returns the index of the best of the measured frames: the frame with the highest sharpness relative to the
+// sharpest frame, weighted by its exposure. Frames that could not be measured are nil.
+//
+// Returns -1 if no frame was measured.
+func BestFrame(qualities []*FrameQuality) int {
+	maxSharpness := 0.0
+	for _, q := range qualities {
+		if q != nil {
+			maxSharpness = max(maxSharpness, q.Sharpness)
+		}
+	}
+
+	best, bestScore := -1, -1.0
+	for i, q := range qualities {
+		if q == nil {
+			continue
+		}
+		score := q.Exposure
+		if maxSharpness > 0 {
+			score *= q.Sharpness / maxSharpness
+		}
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
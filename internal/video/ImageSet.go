@@ -0,0 +1,111 @@
+// This file contains the prober of image sets, zip archives of photos uploaded instead of a video.
+
+package video
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"path"
+	"slices"
+	"strings"
+)
+
+// ImageSetInfo describes a zip archive of photos uploaded instead of a video
+type ImageSetInfo struct {
+	ImageCount int `json:"image_count"`
+	// Width and Height are the dimensions of the largest image
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// ErrInvalidImageSet is returned when a zip archive can not be used as an image set
+var ErrInvalidImageSet = errors.New("invalid image set")
+
+// imageExtensions are the file extensions of the images accepted in an image set
+var imageExtensions = []string{".jpg", ".jpeg", ".png"}
+
+// ProbeImageSet reads the directory of the zip archive in r and the headers of its images, without decompressing them.
+// Directories and metadata added by archivers (hidden files, __MACOSX) are skipped. Every other entry must be a JPEG or
+// PNG image with a relative path that stays inside the archive.
+//
+// Returns the number of images and the largest dimensions, ErrInvalidImageSet if the archive is invalid, contains other
+// files or no image at all.
+func ProbeImageSet(r io.ReadSeeker) (*ImageSetInfo, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := zip.NewReader(&seekReaderAt{r: r}, size)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImageSet, err)
+	}
+
+	info := &ImageSetInfo{}
+	for _, file := range archive.File {
+		name := file.Name
+		if file.FileInfo().IsDir() || strings.HasPrefix(name, "__MACOSX/") || strings.HasPrefix(path.Base(name), ".") {
+			continue
+		}
+		if path.IsAbs(name) || strings.Contains(name, "\\") || !zipLocalPath(name) {
+			return nil, fmt.Errorf("%w: unsafe file name %q", ErrInvalidImageSet, name)
+		}
+		ext := strings.ToLower(path.Ext(name))
+		if !slices.Contains(imageExtensions, ext) {
+			return nil, fmt.Errorf("%w: %s is not a JPEG or PNG image", ErrInvalidImageSet, name)
+		}
+
+		config, err := decodeImageConfig(file)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidImageSet, name, err)
+		}
+		info.ImageCount++
+		info.Width = max(info.Width, config.Width)
+		info.Height = max(info.Height, config.Height)
+	}
+
+	if info.ImageCount == 0 {
+		return nil, fmt.Errorf("%w: no images found", ErrInvalidImageSet)
+	}
+	return info, nil
+}
+
+// decodeImageConfig decodes the dimensions of an image of the archive from its header.
+func decodeImageConfig(file *zip.File) (image.Config, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer rc.Close()
+
+	config, _, err := image.DecodeConfig(rc)
+	return config, err
+}
+
+// zipLocalPath checks if name is a relative path that does not escape the directory the archive is extracted to.
+func zipLocalPath(name string) bool {
+	cleaned := path.Clean(name)
+	return cleaned != ".." && !strings.HasPrefix(cleaned, "../")
+}
+
+// seekReaderAt adapts a ReadSeeker to a ReaderAt for sequential use, i.e by a single zip.Reader.
+type seekReaderAt struct {
+	r io.ReadSeeker
+}
+
+// ReadAt reads len(p) bytes at offset off of the wrapped stream.
+func (s *seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := s.r.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(s.r, p)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		// ReaderAt reports reads past the end with io.EOF
+		err = io.EOF
+	}
+	return n, err
+}
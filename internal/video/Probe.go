@@ -0,0 +1,226 @@
+// This file contains the mp4 box parser used to probe uploaded videos.
+
+package video
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// Info describes the first video track of a video
+type Info struct {
+	Duration   time.Duration `json:"duration"`
+	Width      int           `json:"width"`
+	Height     int           `json:"height"`
+	FrameCount int           `json:"frame_count"`
+	Codec      string        `json:"codec"`
+}
+
+// FrameRate returns the average number of frames per second of the video track, or 0 if its duration is unknown.
+func (i *Info) FrameRate() float64 {
+	if i.Duration <= 0 {
+		return 0
+	}
+	return float64(i.FrameCount) / i.Duration.Seconds()
+}
+
+// Custom errors
+var (
+	// ErrInvalidContainer is returned when the box structure of the file cannot be parsed
+	ErrInvalidContainer = errors.New("invalid mp4 container")
+	// ErrNoVideoTrack is returned when the file contains no video track
+	ErrNoVideoTrack = errors.New("no video track found")
+)
+
+// maxMoovSize caps the size of the moov box read into memory. Regular moov boxes are a few hundred KB to a few MB.
+const maxMoovSize = 64 * 1024 * 1024
+
+// Probe reads the container metadata of an mp4 file.
+//
+// Returns the Info of the first video track if successful, error otherwise.
+func Probe(r io.ReadSeeker) (*Info, error) {
+	moov, err := findMoov(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var info *Info
+	err = walkBoxes(moov, func(boxType string, payload []byte) error {
+		if boxType != "trak" || info != nil {
+			return nil
+		}
+		track, err := parseTrak(payload)
+		if err != nil {
+			return err
+		}
+		info = track
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, ErrNoVideoTrack
+	}
+	return info, nil
+}
+
+// findMoov scans the top level boxes of the file and returns the payload of the moov box.
+func findMoov(r io.ReadSeeker) ([]byte, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(r, header[:8]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, ErrInvalidContainer
+			}
+			return nil, err
+		}
+		size := int64(binary.BigEndian.Uint32(header[0:4]))
+		boxType := string(header[4:8])
+		headerSize := int64(8)
+
+		switch size {
+		case 0:
+			// Box extends to the end of the file
+			if boxType != "moov" {
+				return nil, ErrInvalidContainer
+			}
+			payload, err := io.ReadAll(io.LimitReader(r, maxMoovSize+1))
+			if err != nil {
+				return nil, err
+			}
+			if len(payload) > maxMoovSize {
+				return nil, ErrInvalidContainer
+			}
+			return payload, nil
+		case 1:
+			// 64 bit size follows the box type
+			if _, err := io.ReadFull(r, header[8:16]); err != nil {
+				return nil, ErrInvalidContainer
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		}
+		if size < headerSize {
+			return nil, ErrInvalidContainer
+		}
+
+		if boxType == "moov" {
+			if size-headerSize > maxMoovSize {
+				return nil, ErrInvalidContainer
+			}
+			payload := make([]byte, size-headerSize)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return nil, ErrInvalidContainer
+			}
+			return payload, nil
+		}
+
+		if _, err := r.Seek(size-headerSize, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// walkBoxes calls fn for every box directly contained in data.
+func walkBoxes(data []byte, fn func(boxType string, payload []byte) error) error {
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return ErrInvalidContainer
+		}
+		size := uint64(binary.BigEndian.Uint32(data[0:4]))
+		boxType := string(data[4:8])
+		headerSize := uint64(8)
+
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return ErrInvalidContainer
+			}
+			size = binary.BigEndian.Uint64(data[8:16])
+			headerSize = 16
+		}
+		if size < headerSize || size > uint64(len(data)) {
+			return ErrInvalidContainer
+		}
+
+		if err := fn(boxType, data[headerSize:size]); err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+// findBox returns the payload of the first box at the given path below data, or nil if there is none.
+func findBox(data []byte, path ...string) []byte {
+	for _, name := range path {
+		var found []byte
+		err := walkBoxes(data, func(boxType string, payload []byte) error {
+			if found == nil && boxType == name {
+				found = payload
+			}
+			return nil
+		})
+		if err != nil || found == nil {
+			return nil
+		}
+		data = found
+	}
+	return data
+}
+
+// parseTrak parses a trak box. Returns nil if the track is not a video track.
+func parseTrak(trak []byte) (*Info, error) {
+	hdlr := findBox(trak, "mdia", "hdlr")
+	if len(hdlr) < 12 || string(hdlr[8:12]) != "vide" {
+		return nil, nil
+	}
+
+	info := &Info{}
+
+	// Presentation size is stored as 16.16 fixed point in the last 8 bytes of tkhd
+	tkhd := findBox(trak, "tkhd")
+	if len(tkhd) < 84 {
+		return nil, ErrInvalidContainer
+	}
+	info.Width = int(binary.BigEndian.Uint32(tkhd[len(tkhd)-8:]) >> 16)
+	info.Height = int(binary.BigEndian.Uint32(tkhd[len(tkhd)-4:]) >> 16)
+
+	mdhd := findBox(trak, "mdia", "mdhd")
+	if len(mdhd) < 24 {
+		return nil, ErrInvalidContainer
+	}
+	var timescale, duration uint64
+	if mdhd[0] == 1 {
+		if len(mdhd) < 36 {
+			return nil, ErrInvalidContainer
+		}
+		timescale = uint64(binary.BigEndian.Uint32(mdhd[20:24]))
+		duration = binary.BigEndian.Uint64(mdhd[24:32])
+	} else {
+		timescale = uint64(binary.BigEndian.Uint32(mdhd[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(mdhd[16:20]))
+	}
+	if timescale > 0 {
+		info.Duration = time.Duration(float64(duration) / float64(timescale) * float64(time.Second))
+	}
+
+	stbl := findBox(trak, "mdia", "minf", "stbl")
+	if stsd := findBox(stbl, "stsd"); len(stsd) >= 16 {
+		info.Codec = string(stsd[12:16])
+	}
+	if stsz := findBox(stbl, "stsz"); len(stsz) >= 12 {
+		info.FrameCount = int(binary.BigEndian.Uint32(stsz[8:12]))
+	}
+
+	return info, nil
+}
@@ -0,0 +1,81 @@
+// This file contains the transcoding of uploaded videos to H.264 mp4 videos, the format the prober and the pipeline
+// workers are known to read. Like the frame extraction, it runs an external ffmpeg binary.
+//
+// ffmpeg is only ever run on files whose signature was validated at ingest, and is told both the demuxer of their container
+// and to read local files only: left to probe the content, it would follow the playlists (HLS, concat, ...) a crafted
+// upload contains, to fetch URLs or read files of the server.
+
+package video
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Custom errors
+var (
+	// ErrTranscodeFailed is returned when ffmpeg could not transcode a video, i.e it is corrupted or not a video
+	ErrTranscodeFailed = errors.New("transcoding failed")
+	// ErrUnsupportedContainer is returned when ffmpeg is asked to read a container no demuxer is allowed for
+	ErrUnsupportedContainer = errors.New("unsupported video container")
+)
+
+// demuxers are the ffmpeg demuxers of the video containers accepted at ingest, by file extension
+var demuxers = map[string]string{
+	".mp4":  "mov",
+	".mov":  "mov",
+	".mkv":  "matroska",
+	".webm": "matroska",
+	".avi":  "avi",
+}
+
+// inputArgs returns the ffmpeg arguments reading the video file at the given path, in the container with the given file
+// extension, with its demuxer and from the local filesystem only.
+//
+// Returns ErrUnsupportedContainer if the container has no demuxer.
+func inputArgs(container, path string) ([]string, error) {
+	demuxer, ok := demuxers[strings.ToLower(container)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedContainer, container)
+	}
+	return []string{"-protocol_whitelist", "file", "-f", demuxer, "-i", path}, nil
+}
+
+// H264Codecs are the sample entry fourccs of H.264 video tracks in an mp4
+var H264Codecs = []string{"avc1", "avc3"}
+
+// Transcode converts the first video track of the video file at inputPath, in the container with the given file extension
+// (i.e ".mkv"), to an H.264 mp4 video written to outputPath, with the given ffmpeg binary. Audio is dropped, as the pipeline
+// only uses frames.
+//
+// Returns ErrTranscodeFailed if ffmpeg could not read or convert the video, ErrUnsupportedContainer if the container is not
+// accepted at ingest, error if ffmpeg could not be run.
+func Transcode(ctx context.Context, ffmpegPath, container, inputPath, outputPath string) error {
+	input, err := inputArgs(container, inputPath)
+	if err != nil {
+		return err
+	}
+	args := append([]string{"-nostdin", "-loglevel", "error"}, input...)
+	args = append(args,
+		"-map", "0:v:0",
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "18", "-pix_fmt", "yuv420p",
+		"-an", "-movflags", "+faststart",
+		"-f", "mp4", "-y", outputPath,
+	)
+	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("%w: %s", ErrTranscodeFailed, strings.TrimSpace(stderr.String()))
+	}
+	return err
+}
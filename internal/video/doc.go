@@ -0,0 +1,11 @@
+// Package video contains a minimal, dependency free prober for uploaded videos.
+//
+// Only the ISO base media file format (mp4 / mov) is supported. Other containers accepted at ingest (mkv, webm, avi) are
+// transcoded to mp4 with ffmpeg before they are probed. The prober reads the box ('atom') tree of the moov box to report
+// the duration, resolution, frame count and codec of the first video track, without decoding any frames.
+// Image sets, zip archives of photos uploaded instead of a video, are probed from the archive directory and image headers.
+//
+// It also contains the frame quality heuristics (sharpness and exposure) scoring the structure from motion frames of a scene,
+// so the best of them is used as its thumbnail, and the extraction of frames from stored videos and their transcoding,
+// which run ffmpeg.
+package video
@@ -0,0 +1,973 @@
+// This file contains the handlers for admin-only routes. Every route registered with these handlers
+// should be wrapped in adminRequired, which guarantees a valid admin user ID in the fiber context.
+//
+// Access to the database should be through the AdminService.
+
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/announcement"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/audit"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/deadletter"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/integrity"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/pagination"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/replay"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/user"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/services"
+)
+
+// announcementErrorStatus maps announcement errors to the appropriate HTTP status code.
+func announcementErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, announcement.ErrAnnouncementNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, announcement.ErrInvalidLevel), errors.Is(err, announcement.ErrInvalidWindow):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// auditAdmin records an admin action of the request, concerning the given user (or none), in the audit log.
+// The operation is added to the details.
+func (s *WebServer) auditAdmin(c *fiber.Ctx, operation string, userID primitive.ObjectID, details map[string]string) {
+	if details == nil {
+		details = map[string]string{}
+	}
+	details["operation"] = operation
+	s.audit(c, audit.ActionAdmin, userID, primitive.NilObjectID, details)
+}
+
+// listAnnouncements handles the request to list every announcement, including scheduled and expired ones, newest first.
+// It is an admin protected route, paginated.
+func (s *WebServer) listAnnouncements(c *fiber.Ctx) error {
+	s.logger.Debug("List announcements request received")
+
+	var req ListAnnouncementsRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("List announcements request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	page, err := pagination.New(req.Cursor, req.Limit)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	announcements, next, err := s.adminService.ListAnnouncements(context.TODO(), page)
+	if err != nil {
+		s.logger.Debug("Failed to list announcements: ", err.Error())
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusOK).JSON(pageResponse("announcements", announcements, next))
+}
+
+// createAnnouncement handles the request to create an announcement. It is an admin protected route.
+//
+// It expects a JSON payload with the following format:
+//
+//	{
+//	    "title": "title",
+//	    "body": "body",
+//	    "level": "info" | "warning" | "maintenance",
+//	    "starts_at": "RFC3339 timestamp", (optional)
+//	    "ends_at": "RFC3339 timestamp" (optional)
+//	}
+func (s *WebServer) createAnnouncement(c *fiber.Ctx) error {
+	s.logger.Debug("Create announcement request received")
+
+	var req AnnouncementRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Create announcement request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	adminID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	a, err := s.adminService.CreateAnnouncement(context.TODO(), adminID, req.Title, req.Body, req.Level, req.StartsAt, req.EndsAt)
+	if err != nil {
+		s.logger.Debug("Failed to create announcement: ", err.Error())
+		return c.Status(announcementErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+	s.auditAdmin(c, "create_announcement", primitive.NilObjectID, map[string]string{"announcement_id": a.ID.Hex()})
+
+	return c.Status(http.StatusCreated).JSON(a)
+}
+
+// updateAnnouncement handles the request to replace an announcement. It is an admin protected route.
+//
+// It expects path parameter `announcement_id` and the same JSON payload as createAnnouncement.
+func (s *WebServer) updateAnnouncement(c *fiber.Ctx) error {
+	s.logger.Debug("Update announcement request received")
+
+	var req UpdateAnnouncementRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Update announcement request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	announcementID, err := primitive.ObjectIDFromHex(req.AnnouncementID)
+	if err != nil {
+		s.logger.Debug("Invalid announcement ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid announcement ID"})
+	}
+
+	a, err := s.adminService.UpdateAnnouncement(context.TODO(), announcementID, req.Title, req.Body, req.Level, req.StartsAt, req.EndsAt)
+	if err != nil {
+		s.logger.Debug("Failed to update announcement: ", err.Error())
+		return c.Status(announcementErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+	s.auditAdmin(c, "update_announcement", primitive.NilObjectID, map[string]string{"announcement_id": req.AnnouncementID})
+
+	return c.Status(http.StatusOK).JSON(a)
+}
+
+// deleteAnnouncement handles the request to delete an announcement. It is an admin protected route.
+//
+// It expects path parameter `announcement_id`.
+func (s *WebServer) deleteAnnouncement(c *fiber.Ctx) error {
+	s.logger.Debug("Delete announcement request received")
+
+	var req DeleteAnnouncementRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Delete announcement request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	announcementID, err := primitive.ObjectIDFromHex(req.AnnouncementID)
+	if err != nil {
+		s.logger.Debug("Invalid announcement ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid announcement ID"})
+	}
+
+	if err := s.adminService.DeleteAnnouncement(context.TODO(), announcementID); err != nil {
+		s.logger.Debug("Failed to delete announcement: ", err.Error())
+		return c.Status(announcementErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+	s.auditAdmin(c, "delete_announcement", primitive.NilObjectID, map[string]string{"announcement_id": req.AnnouncementID})
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"message": "Announcement deleted"})
+}
+
+// getTrends handles the request to get the daily aggregates of a metric, for capacity planning dashboards.
+// It is an admin protected route.
+//
+// It expects query parameters:
+//   - metric: required,
+//     jobs, failures or storage
+//   - window: optional,
+//     the number of days to aggregate, i.e "30d" (default "30d", max "365d")
+func (s *WebServer) getTrends(c *fiber.Ctx) error {
+	s.logger.Debug("Get trends request received")
+
+	var req TrendsRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Get trends request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	window, err := parseTrendWindow(req.Window)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	points, err := s.adminService.GetTrends(context.TODO(), req.Metric, window)
+	if err != nil {
+		s.logger.Debug("Failed to get trends: ", err.Error())
+		if errors.Is(err, services.ErrUnknownTrendMetric) || errors.Is(err, services.ErrInvalidTrendWindow) {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"metric": req.Metric, "window": fmt.Sprintf("%dd", len(points)), "points": points})
+}
+
+// parseTrendWindow parses a trend window in days (i.e "30d"). An empty window defaults to 30 days.
+func parseTrendWindow(window string) (time.Duration, error) {
+	if window == "" {
+		return 30 * 24 * time.Hour, nil
+	}
+	days, err := strconv.Atoi(strings.TrimSuffix(window, "d"))
+	if err != nil || !strings.HasSuffix(window, "d") {
+		return 0, fmt.Errorf("invalid window %q, expected a number of days (i.e \"30d\")", window)
+	}
+	return time.Duration(days) * 24 * time.Hour, nil
+}
+
+// userErrorStatus maps user management errors to the appropriate HTTP status code.
+func userErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, user.ErrUserNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, user.ErrInvalidRole), errors.Is(err, services.ErrSelfDemotion), errors.Is(err, services.ErrUnknownTier):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// getUser handles the request to get the summary (username, roles, number of scenes) of a user. It is an admin protected route.
+//
+// It expects a path parameter `user_id`.
+func (s *WebServer) getUser(c *fiber.Ctx) error {
+	s.logger.Debug("Get user request received")
+
+	var req GetUserRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Get user request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(req.UserID)
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	summary, err := s.adminService.GetUser(context.TODO(), userID)
+	if err != nil {
+		s.logger.Debug("Failed to get user: ", err.Error())
+		return c.Status(userErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"user": summary})
+}
+
+// setUserRoles handles the request to replace the roles of a user. It is an admin protected route.
+// Admins can not remove their own admin role.
+//
+// It expects a path parameter `user_id`, and a JSON payload with the following format:
+//
+//	{
+//	    "roles": ["admin"] (or [] to revoke every role)
+//	}
+func (s *WebServer) setUserRoles(c *fiber.Ctx) error {
+	s.logger.Debug("Set user roles request received")
+
+	var req SetUserRolesRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Set user roles request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(req.UserID)
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	adminID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid admin ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	summary, err := s.adminService.SetUserRoles(context.TODO(), adminID, userID, req.Roles)
+	if err != nil {
+		s.logger.Debug("Failed to set user roles: ", err.Error())
+		return c.Status(userErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+	s.auditAdmin(c, "set_roles", userID, map[string]string{"roles": strings.Join(req.Roles, ",")})
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"user": summary})
+}
+
+// setUserRetention handles the request to set the tier and / or retention exemption of a user. It is an admin protected route.
+// Admins are always exempt from retention, regardless of this flag.
+//
+// It expects a path parameter `user_id`, and a JSON payload with the following format:
+//
+//	{
+//	    "tier": "free" | any tier with a retention rule, (optional, "" resets to free)
+//	    "exempt": true | false (optional)
+//	}
+func (s *WebServer) setUserRetention(c *fiber.Ctx) error {
+	s.logger.Debug("Set user retention request received")
+
+	var req SetUserRetentionRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Set user retention request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(req.UserID)
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	adminID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid admin ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	summary, err := s.adminService.SetUserRetention(context.TODO(), adminID, userID, req.Tier, req.Exempt)
+	if err != nil {
+		s.logger.Debug("Failed to set user retention: ", err.Error())
+		return c.Status(userErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+	s.auditAdmin(c, "set_retention", userID, map[string]string{"tier": summary.Tier, "exempt": strconv.FormatBool(summary.RetentionExempt)})
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"user": summary})
+}
+
+// setUserUploadLimit handles the request to set the maximum upload size of a user, replacing UPLOAD_MAX_SIZE for them.
+// It is an admin protected route.
+//
+// It expects a path parameter `user_id`, and a JSON payload with the following format:
+//
+//	{
+//	    "max_size": maximum upload size in bytes (0 resets to UPLOAD_MAX_SIZE)
+//	}
+func (s *WebServer) setUserUploadLimit(c *fiber.Ctx) error {
+	s.logger.Debug("Set user upload limit request received")
+
+	var req SetUserUploadLimitRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Set user upload limit request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(req.UserID)
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	adminID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid admin ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	summary, err := s.adminService.SetUserUploadLimit(context.TODO(), adminID, userID, req.MaxSize)
+	if err != nil {
+		s.logger.Debug("Failed to set user upload limit: ", err.Error())
+		return c.Status(userErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+	s.auditAdmin(c, "set_upload_limit", userID, map[string]string{"max_size": strconv.FormatInt(req.MaxSize, 10)})
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"user": summary})
+}
+
+// getQueues handles the request to inspect the processing queues. It is an admin protected route.
+//
+// Responds with the name, size and scene IDs (in processing order) of every queue, the overall queue first.
+func (s *WebServer) getQueues(c *fiber.Ctx) error {
+	s.logger.Debug("Get queues request received")
+
+	queues, err := s.adminService.GetQueues(context.TODO())
+	if err != nil {
+		s.logger.Debug("Failed to get queues: ", err.Error())
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"queues": queues})
+}
+
+// purgeQueues handles the request to remove the deleted, failed and completed scenes from the processing queues. It is an
+// admin protected route.
+//
+// Responds with the number of entries removed from every queue, the overall queue first.
+func (s *WebServer) purgeQueues(c *fiber.Ctx) error {
+	s.logger.Debug("Purge queues request received")
+
+	purges, err := s.adminService.PurgeTerminalQueueEntries(context.TODO())
+	if err != nil {
+		s.logger.Debug("Failed to purge queues: ", err.Error())
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	details := map[string]string{}
+	for _, p := range purges {
+		details[p.Name] = strconv.Itoa(p.Removed)
+	}
+	s.auditAdmin(c, "purge_queues", primitive.NilObjectID, details)
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"queues": purges})
+}
+
+// getConsumers handles the request for the health of the worker output queue consumers. It is an admin protected route.
+//
+// Responds with the state, processed, failed, retried, duplicate and dead-lettered message counts, last error and last activity of each
+// consumer of the instance serving the request, its broker backend and connection, and whether it is the instance consuming
+// worker output (only one instance is).
+func (s *WebServer) getConsumers(c *fiber.Ctx) error {
+	s.logger.Debug("Get consumers request received")
+
+	return c.Status(http.StatusOK).JSON(s.adminService.GetConsumerHealth())
+}
+
+// getWorkers handles the request for the liveness of the sfm and nerf workers. It is an admin protected route.
+//
+// Responds with the workers that reported heartbeats in the last week, with their stage, version, scene being processed,
+// first and last heartbeat and whether they are online, and the number of online workers of every stage.
+func (s *WebServer) getWorkers(c *fiber.Ctx) error {
+	s.logger.Debug("Get workers request received")
+
+	report, err := s.adminService.ListWorkers(context.TODO())
+	if err != nil {
+		s.logger.Debug("Failed to list workers: ", err.Error())
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(http.StatusOK).JSON(report)
+}
+
+// deadLetterErrorStatus maps dead letter errors to the appropriate HTTP status code.
+func deadLetterErrorStatus(err error) int {
+	if errors.Is(err, deadletter.ErrDeadLetterNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// listDeadLetters handles the request to list the worker output messages whose processing failed permanently, newest first.
+// It is an admin protected route, paginated.
+func (s *WebServer) listDeadLetters(c *fiber.Ctx) error {
+	s.logger.Debug("List dead letters request received")
+
+	var req ListDeadLettersRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("List dead letters request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	page, err := pagination.New(req.Cursor, req.Limit)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	deadLetters, next, err := s.adminService.ListDeadLetters(context.TODO(), page)
+	if err != nil {
+		s.logger.Debug("Failed to list dead letters: ", err.Error())
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusOK).JSON(pageResponse("dead_letters", deadLetters, next))
+}
+
+// getDeadLetter handles the request for a dead letter: the queue, headers and body of the message, and the error that failed it.
+// It is an admin protected route.
+//
+// It expects a path parameter `dead_letter_id`.
+func (s *WebServer) getDeadLetter(c *fiber.Ctx) error {
+	s.logger.Debug("Get dead letter request received")
+
+	var req DeadLetterRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Get dead letter request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	deadLetterID, err := primitive.ObjectIDFromHex(req.DeadLetterID)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid dead letter ID"})
+	}
+
+	dl, err := s.adminService.GetDeadLetter(context.TODO(), deadLetterID)
+	if err != nil {
+		s.logger.Debug("Failed to get dead letter: ", err.Error())
+		return c.Status(deadLetterErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"dead_letter": dl})
+}
+
+// replayDeadLetter handles the request to republish a dead letter to the queue it was consumed from, i.e once the cause of its
+// failure is fixed. It is an admin protected route. The dead letter is removed, and dead-lettered again if it fails again.
+//
+// It expects a path parameter `dead_letter_id`. Returns the replayed dead letter.
+func (s *WebServer) replayDeadLetter(c *fiber.Ctx) error {
+	s.logger.Debug("Replay dead letter request received")
+
+	var req DeadLetterRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Replay dead letter request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	deadLetterID, err := primitive.ObjectIDFromHex(req.DeadLetterID)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid dead letter ID"})
+	}
+
+	dl, err := s.adminService.ReplayDeadLetter(context.TODO(), deadLetterID)
+	if err != nil {
+		s.logger.Debug("Failed to replay dead letter: ", err.Error())
+		return c.Status(deadLetterErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+	s.auditAdmin(c, "replay_dead_letter", primitive.NilObjectID, map[string]string{"dead_letter_id": dl.ID.Hex(), "queue": dl.Queue})
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"dead_letter": dl})
+}
+
+// discardDeadLetter handles the request to remove a dead letter without replaying it. It is an admin protected route.
+//
+// It expects a path parameter `dead_letter_id`.
+func (s *WebServer) discardDeadLetter(c *fiber.Ctx) error {
+	s.logger.Debug("Discard dead letter request received")
+
+	var req DeadLetterRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Discard dead letter request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	deadLetterID, err := primitive.ObjectIDFromHex(req.DeadLetterID)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid dead letter ID"})
+	}
+
+	if err := s.adminService.DiscardDeadLetter(context.TODO(), deadLetterID); err != nil {
+		s.logger.Debug("Failed to discard dead letter: ", err.Error())
+		return c.Status(deadLetterErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+	s.auditAdmin(c, "discard_dead_letter", primitive.NilObjectID, map[string]string{"dead_letter_id": deadLetterID.Hex()})
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"message": "Dead letter discarded"})
+}
+
+// reloadConfig handles the request to reload the runtime tunables (rate limits, upload size cap, CORS origins, log level)
+// from the environment and secrets/.env. It is an admin protected route.
+//
+// Only the instance serving the request is reloaded. Responds with the environment variables of the settings that changed,
+// or 400 if the new configuration is invalid, in which case the current one is kept.
+func (s *WebServer) reloadConfig(c *fiber.Ctx) error {
+	s.logger.Debug("Reload config request received")
+
+	changed, err := s.adminService.ReloadConfig()
+	if errors.Is(err, services.ErrInvalidConfig) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	s.auditAdmin(c, "reload_config", primitive.NilObjectID, map[string]string{"changed": strings.Join(changed, ",")})
+	return c.Status(http.StatusOK).JSON(fiber.Map{"changed": changed})
+}
+
+// backupErrorStatus maps errors returned by the BackupService to an HTTP status code.
+func backupErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrBackupNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, services.ErrBackupCorrupt):
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// listBackups handles the request to list the complete backups, most recent first. It is an admin protected route, paginated.
+func (s *WebServer) listBackups(c *fiber.Ctx) error {
+	s.logger.Debug("List backups request received")
+
+	var req ListBackupsRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("List backups request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	page, err := pagination.New(req.Cursor, req.Limit)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	backups, next, err := s.backupService.ListBackups(context.TODO(), page)
+	if err != nil {
+		s.logger.Debug("Failed to list backups: ", err.Error())
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusOK).JSON(pageResponse("backups", backups, next))
+}
+
+// createBackup handles the request to back up the database. It is an admin protected route.
+// The request returns once the backup is complete, with its manifest, including the referenced files already missing.
+func (s *WebServer) createBackup(c *fiber.Ctx) error {
+	s.logger.Debug("Create backup request received")
+
+	manifest, err := s.backupService.CreateBackup(context.TODO())
+	if err != nil {
+		s.logger.Debug("Failed to create backup: ", err.Error())
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	s.auditAdmin(c, "create_backup", primitive.NilObjectID, map[string]string{"backup_id": manifest.ID})
+
+	return c.Status(http.StatusCreated).JSON(fiber.Map{"backup": manifest})
+}
+
+// verifyBackup handles the request to check that a backup could be restored: its dumps match their checksums, and the
+// files it references are present. It is an admin protected route. Restoring is only possible with the backup CLI.
+//
+// It expects a path parameter `backup_id`. Returns 200 with the missing files, 422 if the backup is corrupt.
+func (s *WebServer) verifyBackup(c *fiber.Ctx) error {
+	s.logger.Debug("Verify backup request received")
+
+	var req BackupRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Verify backup request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	report, err := s.backupService.VerifyBackup(context.TODO(), req.BackupID)
+	if err != nil {
+		s.logger.Debug("Failed to verify backup: ", err.Error())
+		return c.Status(backupErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusOK).JSON(report)
+}
+
+// replayErrorStatus maps errors returned by the ReplayService to an HTTP status code.
+func replayErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, replay.ErrReplayNotFound), errors.Is(err, scene.ErrSceneNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, services.ErrInvalidReplay):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// listReplays handles the request to list the pipeline replays, newest first. It is an admin protected route, paginated.
+func (s *WebServer) listReplays(c *fiber.Ctx) error {
+	s.logger.Debug("List replays request received")
+
+	var req ListReplaysRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("List replays request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	page, err := pagination.New(req.Cursor, req.Limit)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	replays, next, err := s.replayService.ListReplays(context.TODO(), page)
+	if err != nil {
+		s.logger.Debug("Failed to list replays: ", err.Error())
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusOK).JSON(pageResponse("replays", replays, next))
+}
+
+// listWorkerVersionScenes handles the request for the scenes whose processing stage was last completed by a specific
+// worker version, i.e to assess the impact of a worker bug before replaying them. It is an admin protected route.
+//
+// It expects the query parameters `stage` (sfm or nerf) and `worker_version`. It is paginated.
+// Returns the IDs of the matching scenes, newest first.
+func (s *WebServer) listWorkerVersionScenes(c *fiber.Ctx) error {
+	s.logger.Debug("List worker version scenes request received")
+
+	var req WorkerVersionScenesRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("List worker version scenes request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	page, err := pagination.New(req.Cursor, req.Limit)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	sceneIDs, next, err := s.replayService.ListScenesByWorkerVersion(context.TODO(), req.Stage, req.WorkerVersion, page)
+	if err != nil {
+		s.logger.Debug("Failed to list worker version scenes: ", err.Error())
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusOK).JSON(pageResponse("scene_ids", sceneIDs, next))
+}
+
+// createReplay handles the request to re-run the full processing pipeline of scenes from their stored raw videos.
+// It is an admin protected route. Scenes are started in the background, REPLAY_CONCURRENCY at a time.
+//
+// It expects a JSON payload with the following format:
+//
+//	{
+//	    "scene_ids": ["scene_id", ...] (1 to 1000 distinct scenes)
+//	}
+//
+// or, to replay the (up to 1000 oldest) scenes whose stage was last completed by a specific worker version:
+//
+//	{
+//	    "stage": "sfm" | "nerf",
+//	    "worker_version": string
+//	}
+//
+// Returns 201 with the replay, 404 if a scene does not exist, 400 if no scene matches the worker version.
+func (s *WebServer) createReplay(c *fiber.Ctx) error {
+	s.logger.Debug("Create replay request received")
+
+	var req CreateReplayRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Create replay request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	adminID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid admin ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	if req.WorkerVersion != "" {
+		r, err := s.replayService.CreateWorkerVersionReplay(context.TODO(), adminID, req.Stage, req.WorkerVersion)
+		if err != nil {
+			s.logger.Debug("Failed to create worker version replay: ", err.Error())
+			return c.Status(replayErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+		}
+		s.auditAdmin(c, "create_replay", primitive.NilObjectID, map[string]string{"replay_id": r.ID.Hex()})
+		return c.Status(http.StatusCreated).JSON(fiber.Map{"replay": r})
+	}
+
+	sceneIDs := make([]primitive.ObjectID, 0, len(req.SceneIDs))
+	for _, sceneHex := range req.SceneIDs {
+		sceneID, err := primitive.ObjectIDFromHex(sceneHex)
+		if err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid scene ID"})
+		}
+		sceneIDs = append(sceneIDs, sceneID)
+	}
+
+	r, err := s.replayService.CreateReplay(context.TODO(), adminID, sceneIDs)
+	if err != nil {
+		s.logger.Debug("Failed to create replay: ", err.Error())
+		return c.Status(replayErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+	s.auditAdmin(c, "create_replay", primitive.NilObjectID, map[string]string{"replay_id": r.ID.Hex()})
+
+	return c.Status(http.StatusCreated).JSON(fiber.Map{"replay": r})
+}
+
+// createSyntheticScenes handles the request to create synthetic scenes for load tests, whose worker results are fabricated
+// by the server instead of trained by GPU workers. It is an admin protected route, only served when SYNTHETIC_ENABLED is set.
+//
+// It expects a JSON payload with the following format, every field being optional:
+//
+//	{
+//	    "user_id": "user_id" (owner of the scenes, default the admin),
+//	    "count": int (1 to 100, default 1),
+//	    "training_mode": "gaussian" | "tensorf",
+//	    "output_types": ["splat_cloud", ...],
+//	    "save_iterations": [int, ...],
+//	    "total_iterations": int,
+//	    "priority": int (0 normal, 1 high, 2 urgent),
+//	    "scene_name": string
+//	}
+//
+// Returns 201 with the IDs of the created scenes. If a scene can not be created, the error is returned with the IDs of the
+// scenes created before it.
+func (s *WebServer) createSyntheticScenes(c *fiber.Ctx) error {
+	s.logger.Debug("Create synthetic scenes request received")
+
+	var req CreateSyntheticScenesRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Create synthetic scenes request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid admin ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+	if req.UserID != "" {
+		if userID, err = primitive.ObjectIDFromHex(req.UserID); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+		}
+	}
+	count := max(req.Count, 1)
+
+	sceneIDs := make([]string, 0, count)
+	for range count {
+		sceneID, err := s.uploadService.SubmitSyntheticScene(context.TODO(), userID, services.SceneSubmission{
+			Name:            req.SceneName,
+			TrainingMode:    req.TrainingMode,
+			OutputTypes:     req.OutputTypes,
+			SaveIterations:  req.SaveIterations,
+			TotalIterations: req.TotalIterations,
+			Priority:        req.Priority,
+		})
+		if err != nil {
+			s.logger.Debug("Failed to create synthetic scene: ", err.Error())
+			s.auditAdmin(c, "create_synthetic_scenes", userID, map[string]string{"count": strconv.Itoa(len(sceneIDs))})
+			return c.Status(sceneErrorStatus(err)).JSON(fiber.Map{"error": err.Error(), "scene_ids": sceneIDs})
+		}
+		sceneIDs = append(sceneIDs, sceneID.Hex())
+	}
+	s.auditAdmin(c, "create_synthetic_scenes", userID, map[string]string{"count": strconv.Itoa(len(sceneIDs))})
+
+	return c.Status(http.StatusCreated).JSON(fiber.Map{"scene_ids": sceneIDs})
+}
+
+// getReplay handles the request for the progress of a pipeline replay. It is an admin protected route.
+//
+// It expects a path parameter `replay_id`.
+func (s *WebServer) getReplay(c *fiber.Ctx) error {
+	s.logger.Debug("Get replay request received")
+
+	var req ReplayRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Get replay request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	replayID, err := primitive.ObjectIDFromHex(req.ReplayID)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid replay ID"})
+	}
+
+	r, err := s.replayService.GetReplay(context.TODO(), replayID)
+	if err != nil {
+		s.logger.Debug("Failed to get replay: ", err.Error())
+		return c.Status(replayErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"replay": r})
+}
+
+// integrityErrorStatus maps errors returned by the IntegrityService to an HTTP status code.
+func integrityErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, integrity.ErrCheckNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, services.ErrIntegrityCheckActive):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// listIntegrityChecks handles the request to list the integrity checks of the stored scene files, newest first.
+// It is an admin protected route, paginated.
+func (s *WebServer) listIntegrityChecks(c *fiber.Ctx) error {
+	s.logger.Debug("List integrity checks request received")
+
+	var req ListIntegrityChecksRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("List integrity checks request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	page, err := pagination.New(req.Cursor, req.Limit)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	checks, next, err := s.integrityService.ListChecks(context.TODO(), page)
+	if err != nil {
+		s.logger.Debug("Failed to list integrity checks: ", err.Error())
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusOK).JSON(pageResponse("checks", checks, next))
+}
+
+// createIntegrityCheck handles the request to verify the stored files of every scene against their recorded sizes and checksums.
+// It is an admin protected route. The check runs in the background, its progress is returned by /admin/integrity/:check_id,
+// and the issues found are recorded on each scene.
+//
+// Returns 201 with the check, 409 if another check is pending or running.
+func (s *WebServer) createIntegrityCheck(c *fiber.Ctx) error {
+	s.logger.Debug("Create integrity check request received")
+
+	adminID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid admin ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	check, err := s.integrityService.CreateCheck(context.TODO(), adminID)
+	if err != nil {
+		s.logger.Debug("Failed to create integrity check: ", err.Error())
+		return c.Status(integrityErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+	s.auditAdmin(c, "create_integrity_check", primitive.NilObjectID, map[string]string{"check_id": check.ID.Hex()})
+
+	return c.Status(http.StatusCreated).JSON(fiber.Map{"check": check})
+}
+
+// getIntegrityCheck handles the request for the progress and summary of an integrity check. It is an admin protected route.
+//
+// It expects a path parameter `check_id`. The summary counts the scenes and files checked, the scenes with issues and
+// their issues, and lists the IDs of (up to 1000 of) the scenes with issues:
+//
+//	{
+//	    "check": {
+//	        "id": "id",
+//	        "status": "pending" | "running" | "completed" | "failed",
+//	        "scenes_checked": int,
+//	        "files_checked": int,
+//	        "scenes_with_issues": int,
+//	        "issues": int,
+//	        "issue_scenes": ["scene_id", ...],
+//	        ...
+//	    }
+//	}
+func (s *WebServer) getIntegrityCheck(c *fiber.Ctx) error {
+	s.logger.Debug("Get integrity check request received")
+
+	var req IntegrityCheckRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Get integrity check request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	checkID, err := primitive.ObjectIDFromHex(req.CheckID)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid check ID"})
+	}
+
+	check, err := s.integrityService.GetCheck(context.TODO(), checkID)
+	if err != nil {
+		s.logger.Debug("Failed to get integrity check: ", err.Error())
+		return c.Status(integrityErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"check": check})
+}
+
+// getAdminSceneStorage handles the request for the storage used by any scene. It is an admin route.
+//
+// It expects path parameter `scene_id`, and responds like getSceneStorage.
+func (s *WebServer) getAdminSceneStorage(c *fiber.Ctx) error {
+	s.logger.Debug("Admin scene storage request received")
+
+	var req GetSceneStorageRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Admin scene storage request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	sceneID, err := primitive.ObjectIDFromHex(req.SceneID)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid scene ID"})
+	}
+
+	usage, err := s.clientService.SceneStorageUsage(context.TODO(), sceneID)
+	if err != nil {
+		s.logger.Debug("Failed to get scene storage usage: ", err.Error())
+		return c.Status(sceneErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"usage": usage})
+}
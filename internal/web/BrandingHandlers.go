@@ -0,0 +1,99 @@
+// This file contains the branding configuration of tenants, so the same server can back differently branded frontends.
+//
+// The branding is configured per tenant in BRANDING_FILE (see config/Branding.go), and served for the tenant of the
+// hostname of the request. Besides the feature toggles of the branding, features the server itself provides are
+// reported with the toggles of the same name: a branding can hide them, but can not enable them when the server has them off.
+
+package web
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/services"
+)
+
+// brandingMaxAge is how long clients and proxies may cache the branding, in seconds
+const brandingMaxAge = 300
+
+// getBranding handles the request for the branding of the tenant served at the hostname of the request. It is a public route.
+//
+// Fields the branding of the tenant leaves empty are those of the default branding, and omitted if it has none either:
+//
+//	{
+//	    "tenant": "section-a", ("" for the default tenant)
+//	    "name": "CS 101 - Section A",
+//	    "logo_url": "https://cdn.example.com/logo.svg",
+//	    "favicon_url": "https://cdn.example.com/favicon.ico",
+//	    "primary_color": "#1f6feb",
+//	    "support_email": "support@example.com",
+//	    "legal": {
+//	        "terms_url": "https://example.com/terms",
+//	        "privacy_url": "https://example.com/privacy",
+//	        "imprint_url": "https://example.com/imprint"
+//	    },
+//	    "features": {
+//	        "guest_sessions": true,
+//	        "social_login_google": false,
+//	        "social_login_github": true,
+//	        "single_sign_on": false,
+//	        "registration": true,
+//	        "gallery": true,
+//	        ...
+//	    }
+//	}
+func (s *WebServer) getBranding(c *fiber.Ctx) error {
+	s.logger.Debug("Get branding request received")
+
+	tenant := requestTenant(c)
+	branding := s.config.BrandingFor(tenant)
+
+	_, google := s.oauthProviders[OAuthProviderGoogle]
+	_, github := s.oauthProviders[OAuthProviderGitHub]
+	_, sso := s.oauthProviders[OAuthProviderOIDC]
+	serverFeatures := map[string]bool{
+		"guest_sessions":      s.config.GuestEnabled,
+		"social_login_google": google,
+		"social_login_github": github,
+		"single_sign_on":      sso,
+		"registration":        s.config.AuthProvider == services.AuthProviderLocal,
+	}
+	for feature, available := range serverFeatures {
+		enabled, toggled := branding.Features[feature]
+		branding.Features[feature] = available && (enabled || !toggled)
+	}
+
+	legal := fiber.Map{}
+	for key, link := range map[string]string{
+		"terms_url":   branding.TermsURL,
+		"privacy_url": branding.PrivacyURL,
+		"imprint_url": branding.ImprintURL,
+	} {
+		if link != "" {
+			legal[key] = link
+		}
+	}
+
+	response := fiber.Map{
+		"tenant":   tenant,
+		"legal":    legal,
+		"features": branding.Features,
+	}
+	for key, value := range map[string]string{
+		"name":          branding.Name,
+		"logo_url":      branding.LogoURL,
+		"favicon_url":   branding.FaviconURL,
+		"primary_color": branding.PrimaryColor,
+		"support_email": branding.SupportEmail,
+	} {
+		if value != "" {
+			response[key] = value
+		}
+	}
+
+	c.Set(fiber.HeaderCacheControl, "public, max-age="+strconv.Itoa(brandingMaxAge))
+	c.Vary(fiber.HeaderHost)
+	return c.Status(http.StatusOK).JSON(response)
+}
@@ -0,0 +1,185 @@
+// This file contains the visibility of scenes and the public gallery.
+//
+// Users make their scenes unlisted or public instead of sharing outputs one link at a time. The gallery lists the completed
+// public scenes of the tenant served at the hostname of the request, and the thumbnail and outputs of unlisted and public
+// scenes are served to anyone without an account. Private scenes, and scenes of another tenant, answer 404 like missing ones.
+//
+// Access to the database should be through the ClientService.
+
+package web
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/audit"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/pagination"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/services"
+)
+
+// publicCacheControl lets shared caches keep public outputs for a minute, so making a scene private again is effective
+// shortly after
+const publicCacheControl = "public, max-age=60"
+
+// setSceneVisibility handles the request to change who can see a scene. It is a JWT protected route.
+//
+// It expects path parameter `scene_id`, and a JSON payload with the following format:
+//
+//	{
+//	    "visibility": "private" | "unlisted" | "public"
+//	}
+//
+// Returns 403 if a guest publishes a scene.
+func (s *WebServer) setSceneVisibility(c *fiber.Ctx) error {
+	s.logger.Debug("Set scene visibility request received")
+
+	var req SetSceneVisibilityRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Set scene visibility request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	sceneID, err := primitive.ObjectIDFromHex(req.SceneID)
+	if err != nil {
+		s.logger.Debug("Invalid scene ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid scene ID"})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	if err := s.clientService.SetSceneVisibility(context.TODO(), userID, sceneID, req.Visibility); err != nil {
+		s.logger.Debug("Failed to set scene visibility: ", err.Error())
+		return c.Status(sceneErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	s.audit(c, audit.ActionSceneVisibilityChanged, userID, sceneID, map[string]string{"visibility": req.Visibility})
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"id": sceneID.Hex(), "visibility": req.Visibility})
+}
+
+// listGallery handles the request to list the completed public scenes. It is a public route, paginated.
+//
+// Responds with the scenes of the tenant served at the hostname of the request, newest first, each with the URL of its
+// thumbnail (if it has one) and the output types that can be fetched from the public output route:
+//
+//	{
+//	    "scenes": [
+//	        {
+//	            "id": "id",
+//	            "name": "name",
+//	            "created_at": RFC3339,
+//	            "has_thumbnail": bool,
+//	            "thumbnail_url": "<base url>/gallery/scene/<id>/thumbnail", (if it has a thumbnail)
+//	            "output_types": [string],
+//	            "latest_iteration": int
+//	        },
+//	        ...
+//	    ],
+//	    "next_cursor": "cursor" | null
+//	}
+func (s *WebServer) listGallery(c *fiber.Ctx) error {
+	s.logger.Debug("List gallery request received")
+
+	var req ListGalleryRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("List gallery request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	page, err := pagination.New(req.Cursor, req.Limit)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	scenes, next, err := s.clientService.ListPublicScenes(context.TODO(), requestTenant(c), page)
+	if err != nil {
+		s.logger.Debug("Failed to list gallery: ", err.Error())
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	type galleryScene struct {
+		services.GalleryScene
+		ThumbnailURL string `json:"thumbnail_url,omitempty"`
+	}
+	items := make([]galleryScene, len(scenes))
+	for i, sc := range scenes {
+		items[i] = galleryScene{GalleryScene: sc}
+		if sc.HasThumbnail {
+			items[i].ThumbnailURL = c.BaseURL() + "/gallery/scene/" + sc.ID.Hex() + "/thumbnail"
+		}
+	}
+
+	c.Set(fiber.HeaderCacheControl, publicCacheControl)
+	return c.Status(http.StatusOK).JSON(pageResponse("scenes", items, next))
+}
+
+// getPublicSceneThumbnail handles the request to get the thumbnail of an unlisted or public scene. It is a public route.
+//
+// It expects path parameter `scene_id`.
+func (s *WebServer) getPublicSceneThumbnail(c *fiber.Ctx) error {
+	s.logger.Debug("Get public scene thumbnail request received")
+
+	var req GetPublicSceneThumbnailRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Get public scene thumbnail request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	sceneID, err := primitive.ObjectIDFromHex(req.SceneID)
+	if err != nil {
+		s.logger.Debug("Invalid scene ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid scene ID"})
+	}
+
+	thumbnailKey, err := s.clientService.GetPublicSceneThumbnailKey(context.TODO(), requestTenant(c), sceneID)
+	if err != nil {
+		s.logger.Debug("Failed to get public scene thumbnail: ", err.Error())
+		return c.Status(sceneErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	c.Set(fiber.HeaderCacheControl, publicCacheControl)
+	return s.sendObjectWithRangeSupport(c, thumbnailKey)
+}
+
+// getPublicSceneOutput handles the request to get an output of an unlisted or public scene. It is a public route.
+//
+// It expects path parameters `scene_id` `output_type`, and optionally a query parameter `iteration` like getSceneOutput.
+// Accesses are counted for the analytics of the owner, like those of share links.
+func (s *WebServer) getPublicSceneOutput(c *fiber.Ctx) error {
+	s.logger.Debug("Get public scene output request received")
+
+	var req GetPublicSceneOutputRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Get public scene output request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	sceneID, err := primitive.ObjectIDFromHex(req.SceneID)
+	if err != nil {
+		s.logger.Debug("Invalid scene ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid scene ID"})
+	}
+
+	outputKey, err := s.clientService.GetPublicSceneOutputKey(context.TODO(), requestTenant(c), sceneID, req.OutputType, req.Iteration)
+	if err != nil {
+		s.logger.Debug("Failed to get public scene output: ", err.Error())
+		return c.Status(sceneErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// Count every access once, not every range request of a resumed or streamed download
+	if rangeHeader := c.Get(fiber.HeaderRange); rangeHeader == "" || strings.HasPrefix(rangeHeader, "bytes=0-") {
+		dest := c.Get("Sec-Fetch-Dest")
+		s.clientService.RecordSharedAccess(context.TODO(), sceneID, req.OutputType, dest == "" || dest == "document")
+	}
+
+	c.Set(fiber.HeaderCacheControl, publicCacheControl)
+	return s.sendObjectWithRangeSupport(c, outputKey)
+}
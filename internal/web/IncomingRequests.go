@@ -3,7 +3,7 @@
 // appropriate handlers.
 
 // Note that all structs are indepedent of the user id. This is because the user id is extracted from the JWT token
-// There are a few api endpoints that are not covered by these structs, such as the /user/scene/history endpoint.
+// There are a few api endpoints that are not covered by these structs, such as the /user/account/sessions endpoint.
 // This is because its really only requires the userID, which comes from the JWT token. Worker data is also not included,
 // but should probably be included in the future.
 
@@ -13,17 +13,138 @@
 package web
 
 import (
-	"mime/multipart"
+	"time"
 )
 
+// PageRequest holds the query parameters shared by every list endpoint, and is embedded in their requests:
+// the `next_cursor` of the previous page (none for the first page), and the maximum number of items listed.
+type PageRequest struct {
+	Cursor string `query:"cursor"`
+	Limit  int    `query:"limit" validate:"omitempty,min=1,max=200"`
+}
+
+type SceneHistoryRequest struct {
+	PageRequest
+	Trash bool `query:"trash"`
+}
+
+type ListAnnouncementsRequest struct {
+	PageRequest
+}
+
+type ListBackupsRequest struct {
+	PageRequest
+}
+
+type ListReplaysRequest struct {
+	PageRequest
+}
+
+type ListDeadLettersRequest struct {
+	PageRequest
+}
+
+type DeadLetterRequest struct {
+	DeadLetterID string `params:"dead_letter_id" validate:"required,hexadecimal,len=24"`
+}
+
 type LoginRequest struct {
 	Username string `json:"username" validate:"required"`
 	Password string `json:"password" validate:"required"`
 }
 
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+type RevokeSessionRequest struct {
+	SessionID string `params:"session_id" validate:"required,hexadecimal,len=24"`
+}
+
+type AuditTrailRequest struct {
+	PageRequest
+	Before string `query:"before"`
+}
+
 type RegisterRequest struct {
-	Username string `json:"username" validate:"required"`
-	Password string `json:"password" validate:"required"`
+	Username       string `json:"username" validate:"required"`
+	Password       string `json:"password" validate:"required"`
+	TermsVersion   string `json:"terms_version"`
+	PrivacyVersion string `json:"privacy_version"`
+}
+
+type GuestRequest struct {
+	TermsVersion   string `json:"terms_version"`
+	PrivacyVersion string `json:"privacy_version"`
+}
+
+type TrendsRequest struct {
+	Metric string `query:"metric" validate:"required,oneof=jobs failures storage"`
+	Window string `query:"window"`
+}
+
+type GetUserRequest struct {
+	UserID string `params:"user_id" validate:"required,hexadecimal,len=24"`
+}
+
+type SetUserRolesRequest struct {
+	UserID string   `params:"user_id" validate:"required,hexadecimal,len=24"`
+	Roles  []string `json:"roles" validate:"required"`
+}
+
+type BackupRequest struct {
+	BackupID string `params:"backup_id" validate:"required,hexadecimal,len=24"`
+}
+
+type CreateReplayRequest struct {
+	SceneIDs      []string `json:"scene_ids" validate:"required_without=WorkerVersion,omitempty,min=1,max=1000,dive,hexadecimal,len=24"`
+	Stage         string   `json:"stage" validate:"required_with=WorkerVersion,omitempty,oneof=sfm nerf"`
+	WorkerVersion string   `json:"worker_version" validate:"required_with=Stage,excluded_with=SceneIDs"`
+}
+
+type CreateSyntheticScenesRequest struct {
+	UserID          string   `json:"user_id" validate:"omitempty,hexadecimal,len=24"`
+	Count           int      `json:"count" validate:"omitempty,min=1,max=100"`
+	TrainingMode    string   `json:"training_mode" validate:"omitempty,oneof=gaussian tensorf"`
+	OutputTypes     []string `json:"output_types" validate:"omitempty,dive,validOutputType"`
+	SaveIterations  []int    `json:"save_iterations" validate:"omitempty,dive,min=1,max=30000"`
+	TotalIterations int      `json:"total_iterations" validate:"omitempty,min=1,max=30000"`
+	Priority        int      `json:"priority" validate:"omitempty,min=0,max=2"`
+	SceneName       string   `json:"scene_name"`
+}
+
+type WorkerVersionScenesRequest struct {
+	PageRequest
+	Stage         string `query:"stage" validate:"required,oneof=sfm nerf"`
+	WorkerVersion string `query:"worker_version" validate:"required"`
+}
+
+type ReplayRequest struct {
+	ReplayID string `params:"replay_id" validate:"required,hexadecimal,len=24"`
+}
+
+type ListIntegrityChecksRequest struct {
+	PageRequest
+}
+
+type IntegrityCheckRequest struct {
+	CheckID string `params:"check_id" validate:"required,hexadecimal,len=24"`
+}
+
+type SetUserRetentionRequest struct {
+	UserID string  `params:"user_id" validate:"required,hexadecimal,len=24"`
+	Tier   *string `json:"tier"`
+	Exempt *bool   `json:"exempt"`
+}
+
+type SetUserUploadLimitRequest struct {
+	UserID  string `params:"user_id" validate:"required,hexadecimal,len=24"`
+	MaxSize int64  `json:"max_size" validate:"min=0"`
+}
+
+type AcceptPoliciesRequest struct {
+	TermsVersion   string `json:"terms_version"`
+	PrivacyVersion string `json:"privacy_version"`
 }
 
 type UpdatePasswordRequest struct {
@@ -36,21 +157,93 @@ type UpdateUsernameRequest struct {
 	NewUsername string `json:"new_username" validate:"required"`
 }
 
+type UpdateTimezoneRequest struct {
+	Timezone string `json:"timezone"`
+}
+
+type UpdateNotificationsRequest struct {
+	Email        *string `json:"email" validate:"omitempty,max=254"`
+	WeeklyDigest *bool   `json:"weekly_digest"`
+}
+
 type DeleteSceneRequest struct {
+	SceneID   string `params:"scene_id" validate:"required"`
+	Permanent bool   `query:"permanent"`
+}
+
+type RestoreSceneRequest struct {
+	SceneID string `params:"scene_id" validate:"required"`
+}
+
+type CancelSceneRequest struct {
+	SceneID string `params:"scene_id" validate:"required"`
+}
+
+type CloneSceneRequest struct {
+	SceneID         string   `params:"scene_id" validate:"required"`
+	TrainingMode    string   `json:"training_mode" validate:"omitempty,oneof=gaussian"`
+	OutputTypes     []string `json:"output_types" validate:"omitempty,dive,validOutputType"`
+	SaveIterations  []int    `json:"save_iterations" validate:"omitempty,dive,min=1,max=30000"`
+	TotalIterations int      `json:"total_iterations" validate:"omitempty,min=1,max=30000"`
+	Priority        int      `json:"priority" validate:"omitempty,min=0,max=2"`
+	SceneName       string   `json:"scene_name"`
+}
+
+type ShareSceneRequest struct {
+	SceneID    string `params:"scene_id" validate:"required"`
+	OutputType string `json:"output_type" validate:"required,oneof=splat_cloud point_cloud video model"`
+	Iteration  string `json:"iteration" validate:"omitempty,numeric"`
+	ExpiresIn  int64  `json:"expires_in" validate:"omitempty,min=1"`
+}
+
+type SetSceneVisibilityRequest struct {
+	SceneID    string `params:"scene_id" validate:"required"`
+	Visibility string `json:"visibility" validate:"required,oneof=private unlisted public"`
+}
+
+type ListGalleryRequest struct {
+	PageRequest
+}
+
+type GetPublicSceneThumbnailRequest struct {
 	SceneID string `params:"scene_id" validate:"required"`
 }
 
+type GetPublicSceneOutputRequest struct {
+	SceneID    string `params:"scene_id" validate:"required"`
+	OutputType string `params:"output_type" validate:"required,oneof=splat_cloud point_cloud video model"`
+	Iteration  string `query:"iteration"`
+}
+
+type GetSharedSceneOutputRequest struct {
+	Token string `params:"token" validate:"required"`
+}
+
 type DeleteUserRequest struct {
-	Password string `json:"password" validate:"required"`
+	Password string `json:"password"`
+	Username string `json:"username"`
 }
 
 type NewSceneRequest struct {
-	File            *multipart.FileHeader `form:"file" validate:"required"`
-	TrainingMode    string                `form:"training_mode" validate:"required,oneof=gaussian tensorf"`
-	OutputTypes     []string              `form:"output_types" validate:"required,dive,validOutputType"`
-	SaveIterations  []int                 `form:"save_iterations" validate:"required,dive,min=1,max=30000"`
-	TotalIterations int                   `form:"total_iterations" validate:"required,min=1,max=30000"`
+	FileName        string                `form:"file" validate:"required"`
+	TrainingMode    string                `form:"training_mode" validate:"omitempty,oneof=gaussian tensorf"`
+	OutputTypes     []string              `form:"output_types" validate:"omitempty,dive,validOutputType"`
+	SaveIterations  []int                 `form:"save_iterations" validate:"omitempty,dive,min=1,max=30000"`
+	TotalIterations int                   `form:"total_iterations" validate:"omitempty,min=1,max=30000"`
+	Priority        int                   `form:"priority" validate:"omitempty,min=0,max=2"`
 	SceneName       string                `form:"scene_name"`
+	CallbackURL     string                `form:"callback_url" validate:"omitempty,url,max=2048"`
+	CallbackSecret  string                `form:"callback_secret" validate:"required_with=CallbackURL"`
+}
+
+type GetSceneManifestRequest struct {
+	SceneID string `params:"scene_id" validate:"required"`
+}
+
+type ExportSceneRequest struct {
+	SceneID     string `params:"scene_id" validate:"required"`
+	Format      string `query:"format" validate:"omitempty,oneof=zip tar"`
+	OutputTypes string `query:"output_types"`
 }
 
 type GetSceneMetadataRequest struct {
@@ -61,6 +254,11 @@ type GetSceneOutputRequest struct {
 	SceneID    string `params:"scene_id" validate:"required"`
 	OutputType string `params:"output_type" validate:"required,oneof=splat_cloud point_cloud video model"`
 	Iteration  string `query:"iteration"`
+	Version    int    `query:"version" validate:"omitempty,min=1"`
+}
+
+type ListSceneVersionsRequest struct {
+	SceneID string `params:"scene_id" validate:"required"`
 }
 
 type GetSceneThumbnailRequest struct {
@@ -71,10 +269,127 @@ type GetSceneNameRequest struct {
 	SceneID string `params:"scene_id" validate:"required"`
 }
 
+type GetSceneCostRequest struct {
+	SceneID string `params:"scene_id" validate:"required"`
+}
+
+type GetSceneConfigRequest struct {
+	SceneID string `params:"scene_id" validate:"required"`
+}
+
+type UpdateSceneConfigRequest struct {
+	SceneID         string   `params:"scene_id" validate:"required"`
+	OutputTypes     []string `json:"output_types" validate:"omitempty,dive,validOutputType"`
+	SaveIterations  []int    `json:"save_iterations" validate:"omitempty,dive,min=1,max=30000"`
+	TotalIterations int      `json:"total_iterations" validate:"omitempty,min=1,max=30000"`
+}
+
+type GetSceneAnalyticsRequest struct {
+	SceneID string `params:"scene_id" validate:"required"`
+	Window  string `query:"window"`
+}
+
+type GetSceneStorageRequest struct {
+	SceneID string `params:"scene_id" validate:"required"`
+}
+
 type GetSceneProgressRequest struct {
 	SceneID string `params:"scene_id" validate:"required,hexadecimal,len=24"`
 }
 
+type PutSceneThumbnailRequest struct {
+	SceneID string `params:"scene_id" validate:"required,hexadecimal,len=24"`
+}
+
+type SceneArchiveRequest struct {
+	SceneID string `params:"scene_id" validate:"required,hexadecimal,len=24"`
+}
+
 type GetWorkerDataRequest struct {
 	Path string `params:"path" validate:"required"`
+}
+
+type AnnouncementRequest struct {
+	Title    string     `json:"title" validate:"required"`
+	Body     string     `json:"body" validate:"required"`
+	Level    string     `json:"level" validate:"required,oneof=info warning maintenance"`
+	StartsAt *time.Time `json:"starts_at"`
+	EndsAt   *time.Time `json:"ends_at"`
+}
+
+type UpdateAnnouncementRequest struct {
+	AnnouncementID string     `params:"announcement_id" validate:"required,hexadecimal,len=24"`
+	Title          string     `json:"title" validate:"required"`
+	Body           string     `json:"body" validate:"required"`
+	Level          string     `json:"level" validate:"required,oneof=info warning maintenance"`
+	StartsAt       *time.Time `json:"starts_at"`
+	EndsAt         *time.Time `json:"ends_at"`
+}
+
+type DeleteAnnouncementRequest struct {
+	AnnouncementID string `params:"announcement_id" validate:"required,hexadecimal,len=24"`
+}
+
+type CreateUploadRequest struct {
+	FileName string `json:"file_name" validate:"required"`
+	Size     int64  `json:"size" validate:"required,min=1"`
+}
+
+type UploadSessionRequest struct {
+	UploadID string `params:"upload_id" validate:"required,hexadecimal,len=24"`
+}
+
+type UploadProgressRequest struct {
+	UploadID string `params:"upload_id" validate:"required,min=8,max=64"`
+}
+
+type UploadChunkRequest struct {
+	UploadID string `params:"upload_id" validate:"required,hexadecimal,len=24"`
+	Offset   *int64 `reqHeader:"Upload-Offset" validate:"required,min=0"`
+}
+
+type CompleteUploadRequest struct {
+	UploadID        string   `params:"upload_id" validate:"required,hexadecimal,len=24"`
+	TrainingMode    string   `json:"training_mode" validate:"omitempty,oneof=gaussian tensorf"`
+	OutputTypes     []string `json:"output_types" validate:"omitempty,dive,validOutputType"`
+	SaveIterations  []int    `json:"save_iterations" validate:"omitempty,dive,min=1,max=30000"`
+	TotalIterations int      `json:"total_iterations" validate:"omitempty,min=1,max=30000"`
+	Priority        int      `json:"priority" validate:"omitempty,min=0,max=2"`
+	SceneName       string   `json:"scene_name"`
+	CallbackURL     string   `json:"callback_url" validate:"omitempty,url,max=2048"`
+	CallbackSecret  string   `json:"callback_secret" validate:"required_with=CallbackURL"`
+}
+
+type NewSceneFromUploadRequest struct {
+	Key             string   `json:"key" validate:"required"`
+	TrainingMode    string   `json:"training_mode" validate:"omitempty,oneof=gaussian tensorf"`
+	OutputTypes     []string `json:"output_types" validate:"omitempty,dive,validOutputType"`
+	SaveIterations  []int    `json:"save_iterations" validate:"omitempty,dive,min=1,max=30000"`
+	TotalIterations int      `json:"total_iterations" validate:"omitempty,min=1,max=30000"`
+	Priority        int      `json:"priority" validate:"omitempty,min=0,max=2"`
+	SceneName       string   `json:"scene_name"`
+	CallbackURL     string   `json:"callback_url" validate:"omitempty,url,max=2048"`
+	CallbackSecret  string   `json:"callback_secret" validate:"required_with=CallbackURL"`
+}
+
+type NewSceneFromURLRequest struct {
+	URL             string   `json:"url" validate:"required,url,max=2048"`
+	UploadID        string   `json:"upload_id" validate:"omitempty,min=8,max=64"`
+	TrainingMode    string   `json:"training_mode" validate:"omitempty,oneof=gaussian tensorf"`
+	OutputTypes     []string `json:"output_types" validate:"omitempty,dive,validOutputType"`
+	SaveIterations  []int    `json:"save_iterations" validate:"omitempty,dive,min=1,max=30000"`
+	TotalIterations int      `json:"total_iterations" validate:"omitempty,min=1,max=30000"`
+	Priority        int      `json:"priority" validate:"omitempty,min=0,max=2"`
+	SceneName       string   `json:"scene_name"`
+	CallbackURL     string   `json:"callback_url" validate:"omitempty,url,max=2048"`
+	CallbackSecret  string   `json:"callback_secret" validate:"required_with=CallbackURL"`
+}
+
+type ListNotificationsRequest struct {
+	After string `query:"after" validate:"omitempty,hexadecimal,len=24"`
+	Limit int    `query:"limit" validate:"omitempty,min=1,max=200"`
+}
+
+type StreamNotificationsRequest struct {
+	After string `query:"after" validate:"omitempty,hexadecimal,len=24"`
 }
\ No newline at end of file
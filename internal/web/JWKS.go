@@ -0,0 +1,56 @@
+// This file contains the JWKS route, publishing the public keys access tokens are verified with (RFC 7517).
+//
+// With an asymmetric JWT_ALGORITHM (RS256, EdDSA), other internal services (workers, an API gateway) verify access tokens
+// with these keys, selected by the `kid` header of the token, instead of sharing the HMAC secret. Retired public keys stay
+// published until they are removed from the keyring. HMAC secrets are never published, so the key set is empty with HS256.
+
+package web
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// jwk is a single public key of a JSON Web Key Set
+type jwk struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	// RSA public keys
+	Modulus  string `json:"n,omitempty"`
+	Exponent string `json:"e,omitempty"`
+	// Ed25519 public keys
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// getJWKS handles the request for the public keys access tokens are signed with, as a JSON Web Key Set.
+// Responds with `{"keys": [...]}`, the current signing key first.
+func (s *WebServer) getJWKS(c *fiber.Ctx) error {
+	keys := make([]jwk, 0)
+	for _, key := range s.jwtKeyring.PublicKeys() {
+		k := jwk{KeyID: key.ID, Algorithm: key.Method.Alg(), Use: "sig"}
+		switch publicKey := key.VerifyKey.(type) {
+		case *rsa.PublicKey:
+			k.KeyType = "RSA"
+			k.Modulus = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+			k.Exponent = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+		case ed25519.PublicKey:
+			k.KeyType = "OKP"
+			k.Curve = "Ed25519"
+			k.X = base64.RawURLEncoding.EncodeToString(publicKey)
+		default:
+			continue
+		}
+		keys = append(keys, k)
+	}
+
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return c.Status(http.StatusOK).JSON(fiber.Map{"keys": keys})
+}
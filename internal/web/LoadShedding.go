@@ -0,0 +1,87 @@
+// This file contains the load shedding middleware, keeping the server responsive for uploads and worker traffic when saturated.
+//
+// The load of the server is measured by two signals: the number of requests in progress, and the scheduling lag, how much
+// later than requested a sleeping goroutine runs again. The lag rises when the CPU is saturated, before requests start timing out.
+// While either exceeds its threshold (LOAD_SHED_MAX_IN_FLIGHT, LOAD_SHED_MAX_LAG), routes marked as low priority answer 503
+// with a Retry-After header, without authenticating the request. Low priority routes are those clients poll and can retry
+// later, e.g scene progress and metadata. Uploads, scene submissions and worker routes are never shed.
+//
+// Responses streamed after their handler returns (exports, notification streams) are not counted as in progress.
+
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// lagSampleInterval is how often the scheduling lag is sampled
+	lagSampleInterval = 50 * time.Millisecond
+	// shedRetryAfter is the Retry-After of shed requests, in seconds
+	shedRetryAfter = 1
+)
+
+var shedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "web_shed_requests_total",
+	Help: "Low priority requests rejected because the server was overloaded, by the signal over its threshold.",
+}, []string{"reason"})
+
+// loadMonitor measures the load of the server
+type loadMonitor struct {
+	inFlight atomic.Int64
+	// lag is the smoothed scheduling lag, in nanoseconds
+	lag atomic.Int64
+}
+
+// newLoadMonitor creates a loadMonitor, and starts sampling the scheduling lag.
+func newLoadMonitor() *loadMonitor {
+	m := &loadMonitor{}
+	go m.sampleLag()
+	return m
+}
+
+// sampleLag samples the scheduling lag every lagSampleInterval, forever. Samples are smoothed, so a single late
+// wake up does not shed requests, but a saturated CPU does within a few samples.
+func (m *loadMonitor) sampleLag() {
+	for {
+		start := time.Now()
+		time.Sleep(lagSampleInterval)
+		lag := max(time.Since(start)-lagSampleInterval, 0)
+		m.lag.Store((3*m.lag.Load() + int64(lag)) / 4)
+	}
+}
+
+// trackLoad is a middleware counting the requests in progress, applied to every route.
+func (s *WebServer) trackLoad(c *fiber.Ctx) error {
+	s.load.inFlight.Add(1)
+	defer s.load.inFlight.Add(-1)
+	return c.Next()
+}
+
+// lowPriority is a middleware rejecting requests to handler with 503 while the server is overloaded, as configured.
+func (s *WebServer) lowPriority(handler fiber.Handler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		tunables := s.config.Tunables()
+		reason := ""
+		if tunables.LoadShedMaxInFlight > 0 && s.load.inFlight.Load() > int64(tunables.LoadShedMaxInFlight) {
+			reason = "in_flight"
+		} else if tunables.LoadShedMaxLag > 0 && time.Duration(s.load.lag.Load()) > tunables.LoadShedMaxLag {
+			reason = "lag"
+		}
+		if reason == "" {
+			return handler(c)
+		}
+
+		shedRequests.WithLabelValues(reason).Inc()
+		s.logger.Debug("Shed request to ", c.Path(), ", overloaded by ", reason)
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(shedRetryAfter))
+		return c.Status(http.StatusServiceUnavailable).JSON(fiber.Map{"error": "Server overloaded, try again later", "code": "overloaded"})
+	}
+}
@@ -0,0 +1,172 @@
+// This file contains the notification center of users.
+//
+// Users are notified of events of their scenes without polling their progress, e.g when a scene advances in the processing
+// queue. Clients either list the notifications they have not seen yet, or keep a server-sent events stream open that delivers
+// them as they are created. Both resume after the ID of the last notification seen, so no notification is delivered twice.
+//
+// Access to the database should be through the NotificationService.
+
+package web
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// notificationStreamPoll is how often an open notification stream checks for new notifications
+	notificationStreamPoll = time.Second
+	// notificationStreamKeepAlive is how often an idle notification stream sends a comment, so proxies keep it open
+	notificationStreamKeepAlive = 15 * time.Second
+	// notificationStreamBatch is the number of notifications read at once by a notification stream
+	notificationStreamBatch = 100
+)
+
+// listNotifications handles the request to list the notifications of a user. It is a JWT protected route.
+//
+// It expects the optional query parameters:
+//   - after:
+//     the ID of the last notification seen, the oldest kept notifications are listed if not given
+//   - limit:
+//     the maximum number of notifications to list (1-200, default 50)
+//
+// Notifications are listed oldest first, and kept for a week:
+//
+//	{
+//	    "notifications": [
+//	        {
+//	            "id": "id",
+//	            "type": "queue_position",
+//	            "scene_id": "id",
+//	            "position": 2,
+//	            "queue_size": 14,
+//	            "created_at": RFC3339
+//	        },
+//	        ...
+//	    ]
+//	}
+func (s *WebServer) listNotifications(c *fiber.Ctx) error {
+	s.logger.Debug("List notifications request received")
+
+	var req ListNotificationsRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("List notifications request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	after := primitive.NilObjectID
+	if req.After != "" {
+		if after, err = primitive.ObjectIDFromHex(req.After); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid notification ID"})
+		}
+	}
+	limit := int64(req.Limit)
+	if limit == 0 {
+		limit = 50
+	}
+
+	notifications, err := s.notificationService.ListNotifications(context.TODO(), userID, after, limit)
+	if err != nil {
+		s.logger.Error("Failed to list notifications: ", err.Error())
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to list notifications"})
+	}
+	return c.Status(http.StatusOK).JSON(fiber.Map{"notifications": notifications})
+}
+
+// streamNotifications handles the request to stream the notifications of a user as server-sent events. It is a JWT protected route.
+//
+// It expects the optional query parameter `after`, the ID of the last notification seen. Reconnecting clients send it as the
+// Last-Event-ID header instead, which takes precedence. Only notifications created after it are streamed, or after the
+// connection if neither is given.
+//
+// Every notification is sent as an event of its type, with the ID of the notification and the notification as JSON data,
+// as listed by /user/notifications:
+//
+//	id: <id>
+//	event: queue_position
+//	data: {"id": "id", "type": "queue_position", ...}
+func (s *WebServer) streamNotifications(c *fiber.Ctx) error {
+	s.logger.Debug("Stream notifications request received")
+
+	var req StreamNotificationsRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Stream notifications request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	// ObjectIDs start with their creation time, so new notifications sort after one created now
+	after := primitive.NewObjectIDFromTimestamp(time.Now())
+	if lastEventID := c.Get("Last-Event-ID", req.After); lastEventID != "" {
+		if after, err = primitive.ObjectIDFromHex(lastEventID); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid notification ID"})
+		}
+	}
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set("X-Accel-Buffering", "no")
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		s.writeNotificationStream(w, userID, after)
+	})
+	return nil
+}
+
+// writeNotificationStream writes the notifications of a user created after the given ID to w as they are created,
+// until the client disconnects.
+func (s *WebServer) writeNotificationStream(w *bufio.Writer, userID, after primitive.ObjectID) {
+	ticker := time.NewTicker(notificationStreamPoll)
+	defer ticker.Stop()
+
+	// The retry delay reconnecting clients wait for, in milliseconds
+	fmt.Fprintf(w, "retry: %d\n\n", notificationStreamPoll.Milliseconds())
+	lastWrite := time.Now()
+	for {
+		notifications, err := s.notificationService.ListNotifications(context.Background(), userID, after, notificationStreamBatch)
+		if err != nil {
+			s.logger.Warnf("Failed to stream notifications of user %s: %v", userID.Hex(), err)
+		}
+		for _, n := range notifications {
+			data, err := json.Marshal(n)
+			if err != nil {
+				s.logger.Warnf("Failed to encode notification %s: %v", n.ID.Hex(), err)
+				continue
+			}
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", n.ID.Hex(), n.Type, data)
+			after = n.ID
+		}
+		if len(notifications) == 0 && time.Since(lastWrite) >= notificationStreamKeepAlive {
+			w.WriteString(": keep-alive\n\n")
+		}
+
+		// A failed flush means the client is gone
+		if w.Buffered() > 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+			lastWrite = time.Now()
+		}
+		if len(notifications) == notificationStreamBatch {
+			continue
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,449 @@
+// This file contains the social login (OAuth2 authorization code) flow. Users log in through an external provider,
+// and receive the same access / refresh tokens as a password login.
+//
+// Besides the social login providers, any OpenID Connect provider can be configured for single sign-on (provider "oidc"),
+// i.e the identity provider of a university. Its endpoints are discovered from its issuer at startup.
+//
+// The flow is stateless, so any replica can handle the callback: the OAuth state is a short-lived token signed with
+// the JWT keyring, bound to the browser by a nonce cookie. Linking an external account to an existing user stores
+// the user ID in the state.
+//
+// Access to the database should be through the ClientService.
+
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/oauth2"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/audit"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/user"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/secrets"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/services"
+)
+
+// Declarations for supported social login providers
+const (
+	OAuthProviderGoogle = "google"
+	OAuthProviderGitHub = "github"
+	OAuthProviderOIDC   = "oidc"
+)
+
+// oidcDiscoveryTimeout bounds the discovery of the endpoints of the single sign-on provider at startup
+const oidcDiscoveryTimeout = 10 * time.Second
+
+// oauthStateTTL is how long a user has to complete the login at the provider
+const oauthStateTTL = 10 * time.Minute
+
+// oauthNonceCookie binds the OAuth state to the browser that started the flow
+const oauthNonceCookie = "oauth_nonce"
+
+// oauthProfile is the identity of the user at the provider
+type oauthProfile struct {
+	Subject  string
+	Email    string
+	Username string
+}
+
+// OAuthProvider is a social login provider
+type OAuthProvider struct {
+	config       *oauth2.Config
+	fetchProfile func(ctx context.Context, client *http.Client) (*oauthProfile, error)
+}
+
+// OAuthProviders maps provider names to the enabled social login providers
+type OAuthProviders map[string]*OAuthProvider
+
+// NewOAuthProviders creates the social login providers enabled in the configuration.
+// The client secret of each enabled provider is read from the secrets provider.
+//
+// Returns the enabled providers if successful, error if a client secret is missing.
+func NewOAuthProviders(ctx context.Context, cfg *config.Config, secretsProvider secrets.Provider) (OAuthProviders, error) {
+	providers := make(OAuthProviders)
+
+	if cfg.OAuthGoogleClientID != "" {
+		secret, err := secretsProvider.GetSecret(ctx, secrets.OAuthGoogleClientSecret)
+		if err != nil {
+			return nil, fmt.Errorf("google client secret: %w", err)
+		}
+		providers[OAuthProviderGoogle] = &OAuthProvider{
+			config: &oauth2.Config{
+				ClientID:     cfg.OAuthGoogleClientID,
+				ClientSecret: secret,
+				Endpoint: oauth2.Endpoint{
+					AuthURL:  "https://accounts.google.com/o/oauth2/auth",
+					TokenURL: "https://oauth2.googleapis.com/token",
+				},
+				RedirectURL: oauthRedirectURL(cfg, OAuthProviderGoogle),
+				Scopes:      []string{"openid", "email", "profile"},
+			},
+			fetchProfile: fetchGoogleProfile,
+		}
+	}
+
+	if cfg.OAuthGitHubClientID != "" {
+		secret, err := secretsProvider.GetSecret(ctx, secrets.OAuthGitHubClientSecret)
+		if err != nil {
+			return nil, fmt.Errorf("github client secret: %w", err)
+		}
+		providers[OAuthProviderGitHub] = &OAuthProvider{
+			config: &oauth2.Config{
+				ClientID:     cfg.OAuthGitHubClientID,
+				ClientSecret: secret,
+				Endpoint: oauth2.Endpoint{
+					AuthURL:  "https://github.com/login/oauth/authorize",
+					TokenURL: "https://github.com/login/oauth/access_token",
+				},
+				RedirectURL: oauthRedirectURL(cfg, OAuthProviderGitHub),
+				Scopes:      []string{"read:user", "user:email"},
+			},
+			fetchProfile: fetchGitHubProfile,
+		}
+	}
+
+	if cfg.OAuthOIDCClientID != "" {
+		secret, err := secretsProvider.GetSecret(ctx, secrets.OAuthOIDCClientSecret)
+		if err != nil {
+			return nil, fmt.Errorf("oidc client secret: %w", err)
+		}
+		discovery, err := discoverOIDC(ctx, cfg.OAuthOIDCIssuer)
+		if err != nil {
+			return nil, fmt.Errorf("oidc discovery: %w", err)
+		}
+		providers[OAuthProviderOIDC] = &OAuthProvider{
+			config: &oauth2.Config{
+				ClientID:     cfg.OAuthOIDCClientID,
+				ClientSecret: secret,
+				Endpoint: oauth2.Endpoint{
+					AuthURL:  discovery.AuthorizationEndpoint,
+					TokenURL: discovery.TokenEndpoint,
+				},
+				RedirectURL: oauthRedirectURL(cfg, OAuthProviderOIDC),
+				Scopes:      []string{"openid", "email", "profile"},
+			},
+			fetchProfile: func(ctx context.Context, client *http.Client) (*oauthProfile, error) {
+				return fetchOIDCProfile(ctx, client, discovery.UserinfoEndpoint)
+			},
+		}
+	}
+
+	return providers, nil
+}
+
+// oidcDiscovery holds the endpoints of an OpenID Connect provider used by the login flow
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+// discoverOIDC reads the endpoints of the OpenID Connect provider of the given issuer from its discovery document.
+//
+// Returns error if the document can not be read, is issued for another issuer, or lacks an endpoint.
+func discoverOIDC(ctx context.Context, issuer string) (*oidcDiscovery, error) {
+	ctx, cancel := context.WithTimeout(ctx, oidcDiscoveryTimeout)
+	defer cancel()
+
+	var discovery oidcDiscovery
+	if err := getJSON(ctx, http.DefaultClient, issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("discovery document is issued for %q, expected %q", discovery.Issuer, issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.UserinfoEndpoint == "" {
+		return nil, errors.New("discovery document lacks the authorization, token or userinfo endpoint")
+	}
+	return &discovery, nil
+}
+
+// fetchOIDCProfile reads the identity of the user from the userinfo endpoint of an OpenID Connect provider.
+func fetchOIDCProfile(ctx context.Context, client *http.Client, userinfoURL string) (*oauthProfile, error) {
+	var info struct {
+		Sub               string `json:"sub"`
+		Email             string `json:"email"`
+		EmailVerified     bool   `json:"email_verified"`
+		PreferredUsername string `json:"preferred_username"`
+	}
+	if err := getJSON(ctx, client, userinfoURL, &info); err != nil {
+		return nil, err
+	}
+	if info.Sub == "" {
+		return nil, errors.New("oidc profile has no subject")
+	}
+
+	profile := &oauthProfile{Subject: info.Sub, Username: info.PreferredUsername}
+	if info.EmailVerified {
+		profile.Email = info.Email
+		if profile.Username == "" {
+			profile.Username, _, _ = strings.Cut(info.Email, "@")
+		}
+	}
+	return profile, nil
+}
+
+// oauthRedirectURL returns the callback URL of the given provider.
+func oauthRedirectURL(cfg *config.Config, provider string) string {
+	return cfg.OAuthRedirectBaseURL + "user/account/oauth/" + provider + "/callback"
+}
+
+// fetchGoogleProfile reads the identity of the user from the Google OpenID Connect userinfo endpoint.
+func fetchGoogleProfile(ctx context.Context, client *http.Client) (*oauthProfile, error) {
+	var info struct {
+		Sub           string `json:"sub"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err := getJSON(ctx, client, "https://openidconnect.googleapis.com/v1/userinfo", &info); err != nil {
+		return nil, err
+	}
+	if info.Sub == "" {
+		return nil, errors.New("google profile has no subject")
+	}
+
+	profile := &oauthProfile{Subject: info.Sub}
+	if info.EmailVerified {
+		profile.Email = info.Email
+		profile.Username, _, _ = strings.Cut(info.Email, "@")
+	}
+	return profile, nil
+}
+
+// fetchGitHubProfile reads the identity of the user from the GitHub user endpoint.
+func fetchGitHubProfile(ctx context.Context, client *http.Client) (*oauthProfile, error) {
+	var info struct {
+		ID    int64  `json:"id"`
+		Login string `json:"login"`
+		Email string `json:"email"`
+	}
+	if err := getJSON(ctx, client, "https://api.github.com/user", &info); err != nil {
+		return nil, err
+	}
+	if info.ID == 0 {
+		return nil, errors.New("github profile has no id")
+	}
+
+	return &oauthProfile{
+		Subject:  strconv.FormatInt(info.ID, 10),
+		Email:    info.Email,
+		Username: info.Login,
+	}, nil
+}
+
+// getJSON performs a GET request with the given (authorized) client, and decodes the JSON response into v.
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("profile request failed: status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// oauthLogin handles the request to log in through a social login provider.
+//
+// It expects path parameter `provider` (google, github or oidc), and redirects the user to the provider.
+func (s *WebServer) oauthLogin(c *fiber.Ctx) error {
+	s.logger.Debug("OAuth login request received")
+
+	authURL, err := s.startOAuthFlow(c, c.Params("provider"), primitive.NilObjectID)
+	if err != nil {
+		return err
+	}
+	return c.Redirect(authURL, http.StatusFound)
+}
+
+// oauthLink handles the request to link a social login account to the current user. It is a JWT protected route.
+//
+// It expects path parameter `provider` (google, github or oidc), and responds with the `url` the client should navigate to.
+// The request must be made with credentials, as the nonce cookie set in the response is required to complete the flow.
+func (s *WebServer) oauthLink(c *fiber.Ctx) error {
+	s.logger.Debug("OAuth link request received")
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	authURL, err := s.startOAuthFlow(c, c.Params("provider"), userID)
+	if err != nil {
+		return err
+	}
+	return c.Status(http.StatusOK).JSON(fiber.Map{"url": authURL})
+}
+
+// startOAuthFlow creates the signed state and nonce cookie of a new flow, and returns the URL of the provider's consent page.
+// A non-nil linkUserID links the external account to that user instead of logging in.
+func (s *WebServer) startOAuthFlow(c *fiber.Ctx, providerName string, linkUserID primitive.ObjectID) (string, error) {
+	provider, ok := s.oauthProviders[providerName]
+	if !ok {
+		s.logger.Debug("Unknown OAuth provider: ", providerName)
+		return "", c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Unknown login provider"})
+	}
+
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return "", c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to start login"})
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(nonceBytes)
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"typ":      "oauth_state",
+		"provider": providerName,
+		"nonce":    nonce,
+		"iat":      now.Unix(),
+		"exp":      now.Add(oauthStateTTL).Unix(),
+	}
+	if !linkUserID.IsZero() {
+		claims["link"] = linkUserID.Hex()
+	}
+	// The callback may arrive on another hostname, so the state records the tenant the login was started for
+	state, err := s.signToken(withTenant(claims, requestTenant(c)))
+	if err != nil {
+		return "", c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to start login"})
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     oauthNonceCookie,
+		Value:    nonce,
+		Path:     "/user/account/oauth",
+		MaxAge:   int(oauthStateTTL.Seconds()),
+		Secure:   strings.HasPrefix(s.config.OAuthRedirectBaseURL, "https://"),
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+
+	return provider.config.AuthCodeURL(state), nil
+}
+
+// oauthCallback handles the redirect back from a social login provider.
+//
+// It expects path parameter `provider`, and query parameters `code` and `state` set by the provider.
+// Logins respond with the same tokens as /user/account/login (or redirect to the configured frontend URL with the tokens
+// in the URL fragment). Users logging in for the first time are created without a password, or refused with 403 where
+// accounts are managed by an external identity system.
+func (s *WebServer) oauthCallback(c *fiber.Ctx) error {
+	s.logger.Debug("OAuth callback received")
+
+	providerName := c.Params("provider")
+	provider, ok := s.oauthProviders[providerName]
+	if !ok {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Unknown login provider"})
+	}
+	if providerError := c.Query("error"); providerError != "" {
+		s.logger.Debug("OAuth provider returned error: ", providerError)
+		return c.Status(http.StatusUnauthorized).JSON(fiber.Map{"error": "Login was not completed: " + providerError})
+	}
+
+	// The state must be signed by us, for this provider, and started by this browser
+	claims, err := s.parseToken(c.Query("state"))
+	if err != nil || claims["typ"] != "oauth_state" || claims["provider"] != providerName ||
+		claims["nonce"] == "" || claims["nonce"] != c.Cookies(oauthNonceCookie) {
+		s.logger.Debug("Invalid OAuth state")
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid or expired login state, please try again"})
+	}
+	c.ClearCookie(oauthNonceCookie)
+
+	ctx := context.TODO()
+	token, err := provider.config.Exchange(ctx, c.Query("code"))
+	if err != nil {
+		s.logger.Debug("OAuth code exchange failed: ", err.Error())
+		return c.Status(http.StatusUnauthorized).JSON(fiber.Map{"error": "Login could not be verified"})
+	}
+	profile, err := provider.fetchProfile(ctx, provider.config.Client(ctx, token))
+	if err != nil {
+		s.logger.Debug("Failed to fetch OAuth profile: ", err.Error())
+		return c.Status(http.StatusBadGateway).JSON(fiber.Map{"error": "Failed to read profile from login provider"})
+	}
+
+	identity := user.OAuthIdentity{
+		Provider: providerName,
+		Subject:  profile.Subject,
+		Email:    profile.Email,
+		LinkedAt: time.Now().UTC(),
+	}
+
+	// Linking an external account to an existing user
+	if link, ok := claims["link"].(string); ok {
+		userID, err := primitive.ObjectIDFromHex(link)
+		if err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+		}
+		err = s.clientService.LinkOAuthIdentity(ctx, userID, identity)
+		if errors.Is(err, user.ErrOAuthIdentityLinked) {
+			return c.Status(http.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+		}
+		if errors.Is(err, services.ErrGuestRestricted) {
+			return c.Status(http.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err != nil {
+			s.logger.Debug("Failed to link OAuth identity: ", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		s.audit(c, audit.ActionOAuthLinked, userID, primitive.NilObjectID, map[string]string{"provider": providerName})
+		return c.Status(http.StatusOK).JSON(fiber.Map{"message": "Account linked", "provider": providerName})
+	}
+
+	tenant := claimTenant(claims)
+	userID, err := s.clientService.LoginOAuthUser(ctx, tenant, identity, profile.Username)
+	if errors.Is(err, services.ErrRegistrationDisabled) {
+		return c.Status(http.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		s.logger.Debug("OAuth login failed: ", err.Error())
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+	refreshToken, sessionID, err := s.clientService.IssueRefreshToken(ctx, id, c.Get(fiber.HeaderUserAgent), c.IP())
+	if err != nil {
+		s.logger.Debug("Failed to generate refresh token: ", err.Error())
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate token"})
+	}
+	s.audit(c, audit.ActionLogin, id, primitive.NilObjectID, map[string]string{"method": providerName})
+
+	if s.config.OAuthFrontendRedirectURL == "" {
+		return s.sendTokens(c, userID, sessionID, tenant, refreshToken)
+	}
+
+	accessToken, err := s.newAccessToken(userID, sessionID, tenant)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate token"})
+	}
+	fragment := url.Values{
+		"jwtToken":     {accessToken},
+		"expiresIn":    {strconv.Itoa(int(s.config.AccessTokenTTL.Seconds()))},
+		"refreshToken": {refreshToken},
+	}
+	return c.Redirect(s.config.OAuthFrontendRedirectURL+"#"+fragment.Encode(), http.StatusFound)
+}
@@ -0,0 +1,27 @@
+// This file contains the pagination conventions of the list endpoints.
+//
+// Every list endpoint embeds PageRequest in its request, lists its items newest first, and responds with the items under
+// its own key and the cursor of the next page under `next_cursor`, which is null on the last page:
+//
+//	{
+//	    "<items>": [...],
+//	    "next_cursor": "cursor" | null
+//	}
+//
+// Clients page through a list by repeating the request with `cursor` set to the previous `next_cursor`.
+// Invalid cursors answer 400.
+
+package web
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+// pageResponse returns the response of a page of a list endpoint, with its items under the given key.
+func pageResponse(key string, items interface{}, nextCursor string) fiber.Map {
+	var next interface{}
+	if nextCursor != "" {
+		next = nextCursor
+	}
+	return fiber.Map{key: items, "next_cursor": next}
+}
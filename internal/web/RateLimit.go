@@ -0,0 +1,118 @@
+// This file contains the rate limiting middleware protecting the authentication routes against brute force.
+//
+// Requests are counted per client IP, and per username of the JSON body, within fixed windows. A client exceeding either
+// limit receives 429 with a Retry-After header until the window ends. The per username limit stops attacks spread across
+// many IPs, complementing the account lockout (which only counts failed logins).
+//
+// Counters are kept in a RateLimitStore: in memory (per replica) or in MongoDB (shared by every replica).
+// If the store fails, requests are let through, so an outage of the store does not lock every user out.
+
+package web
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RateLimitStore counts the requests made under a key within fixed windows.
+type RateLimitStore interface {
+	// Hit counts a request under key in the current window of the given length. Returns the number of requests
+	// counted in the window including this one, and the end of the window.
+	Hit(ctx context.Context, key string, window time.Duration) (int, time.Time, error)
+}
+
+// memoryRateLimitStore is a RateLimitStore local to a single replica
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	counters  map[string]*memoryCounter
+	nextSweep time.Time
+}
+
+// memoryCounter is the number of requests of a key in the window ending at resetAt
+type memoryCounter struct {
+	count   int
+	resetAt time.Time
+}
+
+// NewMemoryRateLimitStore creates a RateLimitStore keeping its counters in memory.
+func NewMemoryRateLimitStore() RateLimitStore {
+	return &memoryRateLimitStore{counters: make(map[string]*memoryCounter)}
+}
+
+// Hit implements RateLimitStore. Counters of ended windows are swept once per window.
+func (m *memoryRateLimitStore) Hit(ctx context.Context, key string, window time.Duration) (int, time.Time, error) {
+	now := time.Now().UTC()
+	resetAt := now.Truncate(window).Add(window)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if now.After(m.nextSweep) {
+		for k, counter := range m.counters {
+			if !counter.resetAt.After(now) {
+				delete(m.counters, k)
+			}
+		}
+		m.nextSweep = now.Add(window)
+	}
+
+	counter, ok := m.counters[key]
+	if !ok || counter.resetAt != resetAt {
+		counter = &memoryCounter{resetAt: resetAt}
+		m.counters[key] = counter
+	}
+	counter.count++
+	return counter.count, resetAt, nil
+}
+
+// rateLimited is a middleware limiting the requests to handler per client IP and per username, as configured.
+// scope separates the counters of different routes, so logins do not use up the registrations of a client.
+func (s *WebServer) rateLimited(scope string, handler fiber.Handler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var body struct {
+			Username string `json:"username"`
+		}
+		// Malformed bodies are left to the handler to reject, they still count against the IP
+		_ = c.BodyParser(&body)
+
+		type limit struct {
+			key string
+			max int
+		}
+		tunables := s.config.Tunables()
+		limits := []limit{{key: scope + ":ip:" + c.IP(), max: tunables.RateLimitPerIP}}
+		if body.Username != "" {
+			// Usernames are unique per tenant
+			key := scope + ":username:" + strings.ToLower(body.Username)
+			if tenant := requestTenant(c); tenant != "" {
+				key = scope + ":" + tenant + ":username:" + strings.ToLower(body.Username)
+			}
+			limits = append(limits, limit{key: key, max: tunables.RateLimitPerUsername})
+		}
+		for _, limit := range limits {
+			if limit.max == 0 {
+				continue
+			}
+
+			count, resetAt, err := s.rateLimitStore.Hit(context.TODO(), limit.key, tunables.RateLimitWindow)
+			if err != nil {
+				s.logger.Warnf("Failed to count request for rate limit %s: %v", limit.key, err)
+				continue
+			}
+			if count > limit.max {
+				s.logger.Debug("Rate limit exceeded for ", limit.key)
+				retryAfter := int(time.Until(resetAt).Seconds()) + 1
+				c.Set(fiber.HeaderRetryAfter, strconv.Itoa(retryAfter))
+				return c.Status(http.StatusTooManyRequests).JSON(fiber.Map{"error": "Too many requests, try again later", "code": "rate_limited"})
+			}
+		}
+
+		return handler(c)
+	}
+}
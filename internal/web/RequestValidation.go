@@ -5,7 +5,11 @@
 package web
 
 import (
+	"bytes"
 	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
 	"strconv"
 	"strings"
 
@@ -17,6 +21,9 @@ import (
 
 var validate *validator.Validate
 
+// maxFormValueSize caps the size of a single non-file form value in streamed multipart requests.
+const maxFormValueSize = 64 * 1024
+
 // Initialize the custom validator
 func init() {
     validate = validator.New()
@@ -43,10 +50,23 @@ func ValidateRequest(c *fiber.Ctx, req interface{}) error {
         if err := c.BodyParser(req); err != nil {
             return err
         }
-        // Also parse query parameters for these methods if needed
+        // Also parse query and path parameters for these methods if needed
         if err := c.QueryParser(req); err != nil {
             return err
         }
+        if err := c.ParamsParser(req); err != nil {
+            return err
+        }
+    case "DELETE":
+        // DELETE requests identify their resource by path parameter, but may carry a body (e.g. password confirmation)
+        if len(c.Body()) > 0 {
+            if err := c.BodyParser(req); err != nil {
+                return err
+            }
+        }
+        if err := c.ParamsParser(req); err != nil {
+            return err
+        }
     default:
         // Unsupported HTTP method
     }
@@ -56,49 +76,102 @@ func ValidateRequest(c *fiber.Ctx, req interface{}) error {
 
 // ParseNewSceneRequest is a custom validator that parses a video upload request from a Fiber context.
 //
-// The default go-validator is not great with file uploads, so we need to handle the file upload here, and just 
-// redundantly validate the other form fields.
+// The multipart body is read as a stream instead of being buffered: each "file" part is handed to receiveFile as soon
+// as it is reached, with its 0-based index among the file parts, so the caller can validate and store it while it is
+// still being received. An error returned by receiveFile aborts parsing and is returned as is. FileName is the name of
+// the first file.
+//
+// The default go-validator is not great with file uploads, so we need to handle the file upload here, and just
+// redundantly validate the other form fields. Since form fields may follow the file part, they are only validated
+// once the whole body was read, i.e. after receiveFile returned.
 //
 // Returns a NewSceneRequest struct if successful, error otherwise.
-func ParseNewSceneRequest(c *fiber.Ctx) (*NewSceneRequest, error) {
+func ParseNewSceneRequest(c *fiber.Ctx, receiveFile func(index int, fileName string, r io.Reader) error) (*NewSceneRequest, error) {
     var req NewSceneRequest
+    files := 0
+
+    _, params, err := mime.ParseMediaType(c.Get(fiber.HeaderContentType))
+    if err != nil || params["boundary"] == "" {
+        return nil, errors.New("file upload error: expected a multipart form")
+    }
 
-    // Handle file upload
-    file, err := c.FormFile("file")
-    if err != nil {
-        return nil, errors.New("file upload error: " + err.Error())
+    body := c.Context().RequestBodyStream()
+    if body == nil {
+        body = bytes.NewReader(c.Body())
+    }
+    reader := multipart.NewReader(body, params["boundary"])
+
+    form := make(map[string]string)
+    for {
+        part, err := reader.NextPart()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, errors.New("file upload error: " + err.Error())
+        }
+
+        if part.FormName() == "file" {
+            if files == 0 {
+                req.FileName = part.FileName()
+            }
+            if err := receiveFile(files, part.FileName(), part); err != nil {
+                part.Close()
+                return nil, err
+            }
+            files++
+        } else {
+            value, err := io.ReadAll(io.LimitReader(part, maxFormValueSize))
+            if err != nil {
+                part.Close()
+                return nil, errors.New("file upload error: " + err.Error())
+            }
+            form[part.FormName()] = string(value)
+        }
+        part.Close()
     }
-    req.File = file
 
     // Parse other form fields
-    req.TrainingMode = c.FormValue("training_mode")
-    req.SceneName = c.FormValue("scene_name")
+    req.TrainingMode = form["training_mode"]
+    req.SceneName = form["scene_name"]
+    req.CallbackURL = form["callback_url"]
+    req.CallbackSecret = form["callback_secret"]
 
     // Parse total iterations
-    totalIterationsStr := c.FormValue("total_iterations")
+    totalIterationsStr := form["total_iterations"]
     if totalIterationsStr != "" {
         totalIterations, err := strconv.Atoi(totalIterationsStr)
         if err != nil {
-            return nil, errors.New("invalid total iterations")
+            return &req, errors.New("invalid total iterations")
         }
         req.TotalIterations = totalIterations
     }
 
+    // Parse priority
+    priorityStr := form["priority"]
+    if priorityStr != "" {
+        priority, err := strconv.Atoi(priorityStr)
+        if err != nil {
+            return &req, errors.New("invalid priority")
+        }
+        req.Priority = priority
+    }
+
     // Parse output types
-    outputTypesStr := c.FormValue("output_types")
+    outputTypesStr := form["output_types"]
     if outputTypesStr != "" {
         req.OutputTypes = strings.Split(outputTypesStr, ",")
     }
 
     // Parse save iterations
-    saveIterationsStr := c.FormValue("save_iterations")
+    saveIterationsStr := form["save_iterations"]
     if saveIterationsStr != "" {
         saveIterationsSlice := strings.Split(saveIterationsStr, ",")
         req.SaveIterations = make([]int, len(saveIterationsSlice))
         for i, s := range saveIterationsSlice {
             val, err := strconv.Atoi(strings.TrimSpace(s))
             if err != nil {
-                return nil, errors.New("invalid save iterations")
+                return &req, errors.New("invalid save iterations")
             }
             req.SaveIterations[i] = val
         }
@@ -106,15 +179,26 @@ func ParseNewSceneRequest(c *fiber.Ctx) (*NewSceneRequest, error) {
 
     // Validate the request
     if err := validate.Struct(req); err != nil {
-        return nil, err
+        return &req, err
     }
 
     return &req, nil
 }
 
 // ValidateOutputType is a custom validator for output types in a VideoUploadRequest.
+//
+// If no training mode is given, the deployment default is not known here, so output types valid for any
+// training mode are accepted, and the final combination is validated by ClientService.
 func validateOutputType(fl validator.FieldLevel) bool {
     outputType := fl.Field().String()
     trainingMode := fl.Parent().FieldByName("TrainingMode").String()
+    if trainingMode == "" {
+        for _, mode := range scene.ValidTrainingModes {
+            if (scene.Nerf{}).IsValidOutputType(mode, outputType) {
+                return true
+            }
+        }
+        return false
+    }
     return scene.Nerf{}.IsValidOutputType(trainingMode, outputType)
 }
\ No newline at end of file
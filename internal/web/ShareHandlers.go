@@ -0,0 +1,284 @@
+// This file contains the public share links of scene outputs.
+//
+// Users create expiring links to one output type of one of their scenes, which anyone can download without an account.
+// Links are stateless, so any replica can serve them: the link carries a token signed with the JWT keyring, scoped to the
+// scene and output type. Share tokens have no subject, so they are never accepted as access tokens. A link stops working
+// once it expires, the signing key is removed from the keyring, or the scene outputs are deleted or archived.
+//
+// Downloads through share links are counted for the analytics of the owner (see services/SceneAnalytics.go).
+//
+// Download manifests of native viewers are built on the same links: every output they list has a share link of its own,
+// which expires with the manifest.
+//
+// Access to the database should be through the ClientService.
+
+package web
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/audit"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/services"
+)
+
+// shareTokenType is the `typ` claim of share tokens
+const shareTokenType = "scene_share"
+
+// shareScene handles the request to create a public share link of a scene output. It is a JWT protected route.
+//
+// It expects path parameter `scene_id`, and a JSON payload with the following format:
+//
+//	{
+//	    "output_type": "splat_cloud" | "point_cloud" | "video" | "model",
+//	    "iteration": "iteration", (optional, the last one by default)
+//	    "expires_in": seconds (optional, the configured share link TTL by default, capped to the maximum)
+//	}
+//
+// Responds with 201 and the following format:
+//
+//	{
+//	    "url": "<base url>/share/scene/<token>",
+//	    "token": "token",
+//	    "expiresAt": RFC3339
+//	}
+func (s *WebServer) shareScene(c *fiber.Ctx) error {
+	s.logger.Debug("Share scene request received")
+
+	var req ShareSceneRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Share scene request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	sceneID, err := primitive.ObjectIDFromHex(req.SceneID)
+	if err != nil {
+		s.logger.Debug("Invalid scene ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid scene ID"})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	// Only outputs the user can download right now can be shared
+	if _, err := s.clientService.GetSceneOutputKey(context.TODO(), userID, sceneID, 0, req.OutputType, req.Iteration); err != nil {
+		s.logger.Debug("Failed to share scene output: ", err.Error())
+		return c.Status(sceneErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	ttl := s.config.ShareLinkTTL
+	if req.ExpiresIn > 0 {
+		ttl = min(time.Duration(req.ExpiresIn)*time.Second, s.config.ShareLinkMaxTTL)
+	}
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+	token, err := s.signToken(withTenant(jwt.MapClaims{
+		"typ":         shareTokenType,
+		"scene":       sceneID.Hex(),
+		"output_type": req.OutputType,
+		"iteration":   req.Iteration,
+		"iat":         now.Unix(),
+		"exp":         expiresAt.Unix(),
+	}, requestTenant(c)))
+	if err != nil {
+		s.logger.Debug("Failed to sign share token: ", err.Error())
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create share link"})
+	}
+
+	s.audit(c, audit.ActionSceneShared, userID, sceneID, map[string]string{
+		"output_type": req.OutputType,
+		"expires_at":  expiresAt.UTC().Format(time.RFC3339),
+	})
+
+	return c.Status(http.StatusCreated).JSON(fiber.Map{
+		"url":       c.BaseURL() + "/share/scene/" + token,
+		"token":     token,
+		"expiresAt": expiresAt.UTC().Format(time.RFC3339),
+	})
+}
+
+// getSceneManifest handles the request to get the download manifest of a scene, for native viewers. It is a JWT protected route.
+//
+// It expects path parameter `scene_id`. Every output of the manifest has a URL of the share route signed for that output,
+// valid until the `expires_at` of the manifest, so outputs can be downloaded (and ranges of them) without the access token:
+//
+//	{
+//	    "schema_version": 1,
+//	    "scene_id": "id",
+//	    "name": "name",
+//	    "training_mode": "gaussian",
+//	    "generated_at": RFC3339,
+//	    "expires_at": RFC3339,
+//	    "chunk_size": 8388608,
+//	    "outputs": [
+//	        {
+//	            "type": "splat_cloud",
+//	            "iteration": 30000,
+//	            "file_name": "splat_cloud.splat",
+//	            "size": 12345678,
+//	            "sha256": "hex",
+//	            "chunks": [{"offset": 0, "length": 8388608, "sha256": "hex"}, ...],
+//	            "url": "<base url>/share/scene/<token>"
+//	        },
+//	        ...
+//	    ]
+//	}
+//
+// Returns 409 / 410 if the outputs are archived / deleted, 404 if the scene has no outputs yet.
+func (s *WebServer) getSceneManifest(c *fiber.Ctx) error {
+	s.logger.Debug("Get scene manifest request received")
+
+	var req GetSceneManifestRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Get scene manifest request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	sceneID, err := primitive.ObjectIDFromHex(req.SceneID)
+	if err != nil {
+		s.logger.Debug("Invalid scene ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid scene ID"})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	manifest, err := s.clientService.GetSceneManifest(context.TODO(), userID, sceneID)
+	if err != nil {
+		s.logger.Debug("Failed to get scene manifest: ", err.Error())
+		return c.Status(sceneErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// The URLs are share links scoped to a single output and iteration
+	manifest.ExpiresAt = manifest.GeneratedAt.Add(s.config.ManifestURLTTL)
+	for i, output := range manifest.Outputs {
+		token, err := s.signToken(withTenant(jwt.MapClaims{
+			"typ":         shareTokenType,
+			"scene":       sceneID.Hex(),
+			"output_type": output.Type,
+			"iteration":   strconv.Itoa(output.Iteration),
+			"iat":         manifest.GeneratedAt.Unix(),
+			"exp":         manifest.ExpiresAt.Unix(),
+		}, requestTenant(c)))
+		if err != nil {
+			s.logger.Debug("Failed to sign manifest URL: ", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create manifest"})
+		}
+		manifest.Outputs[i].URL = c.BaseURL() + "/share/scene/" + token
+	}
+
+	c.Set(fiber.HeaderCacheControl, "private, no-store")
+	return c.Status(http.StatusOK).JSON(manifest)
+}
+
+// getSceneAnalytics handles the request for the accesses to the share links and public outputs of a scene. It is a JWT
+// protected route.
+//
+// It expects path parameter `scene_id`, and query parameter `window` in days (i.e "30d", default 30 days, at most 365 days).
+// Outputs loaded by viewers count as views, outputs requested as files as downloads, and the video as plays:
+//
+//	{
+//	    "analytics": {
+//	        "scene_id": "id",
+//	        "days": [{"day": "2006-01-02", "views": int, "downloads": int, "plays": int}, ...],
+//	        "totals": {"views": int, "downloads": int, "plays": int}
+//	    }
+//	}
+func (s *WebServer) getSceneAnalytics(c *fiber.Ctx) error {
+	s.logger.Debug("Get scene analytics request received")
+
+	var req GetSceneAnalyticsRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Get scene analytics request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	sceneID, err := primitive.ObjectIDFromHex(req.SceneID)
+	if err != nil {
+		s.logger.Debug("Invalid scene ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid scene ID"})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	window, err := parseTrendWindow(req.Window)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	analytics, err := s.clientService.GetSceneAnalytics(context.TODO(), userID, sceneID, window)
+	if err != nil {
+		s.logger.Debug("Failed to get scene analytics: ", err.Error())
+		if errors.Is(err, services.ErrInvalidTrendWindow) {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(sceneErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"analytics": analytics})
+}
+
+// getSharedSceneOutput handles the request to download a shared scene output. It is a public route, authorized by the share token.
+//
+// It expects path parameter `token`. Expired and invalid links, and links of another tenant, answer 404, so they can not be
+// told apart from deleted scenes.
+func (s *WebServer) getSharedSceneOutput(c *fiber.Ctx) error {
+	s.logger.Debug("Get shared scene output request received")
+
+	var req GetSharedSceneOutputRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Get shared scene output request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// Links of a tenant are only served at its hostnames, see Tenants.go
+	claims, err := s.parseToken(req.Token)
+	if err != nil || claims["typ"] != shareTokenType || !s.allowsTenant(c, claimTenant(claims)) {
+		s.logger.Debug("Invalid or expired share token")
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Share link not found or expired"})
+	}
+	sceneHex, _ := claims["scene"].(string)
+	outputType, _ := claims["output_type"].(string)
+	iteration, _ := claims["iteration"].(string)
+	sceneID, err := primitive.ObjectIDFromHex(sceneHex)
+	if err != nil || outputType == "" {
+		s.logger.Debug("Share token without scene or output type")
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Share link not found or expired"})
+	}
+
+	outputKey, err := s.clientService.GetSharedSceneOutputKey(context.TODO(), sceneID, outputType, iteration)
+	if err != nil {
+		s.logger.Debug("Failed to get shared scene output: ", err.Error())
+		return c.Status(sceneErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// Count every access once, not every range request of a resumed or streamed download
+	if rangeHeader := c.Get(fiber.HeaderRange); rangeHeader == "" || strings.HasPrefix(rangeHeader, "bytes=0-") {
+		dest := c.Get("Sec-Fetch-Dest")
+		s.clientService.RecordSharedAccess(context.TODO(), sceneID, outputType, dest == "" || dest == "document")
+	}
+
+	if exp, ok := claims["exp"].(float64); ok {
+		// The output must not stay cached past the expiry of the link
+		c.Set(fiber.HeaderCacheControl, "private, max-age="+strconv.FormatInt(max(int64(exp)-time.Now().Unix(), 0), 10))
+	}
+	return s.sendObjectWithRangeSupport(c, outputKey)
+}
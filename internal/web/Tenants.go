@@ -0,0 +1,55 @@
+// This file contains the tenant resolution of requests.
+//
+// One deployment can host isolated tenants (e.g classroom sections), configured by TENANTS as the hostnames each tenant is
+// served at. Every user belongs to a single tenant: usernames are unique per tenant, and the scenes, queue messages and
+// stored files of a user carry its tenant. Requests to the hostnames of a tenant act on that tenant only. Access tokens,
+// share links and login states record their tenant in the `tid` claim, so those of one tenant are rejected on the
+// hostnames of another. Requests to other hostnames use the tenant of their token, or the default tenant without one.
+//
+// Admins belong to the default tenant, and administer every tenant from hostnames that are not mapped to one.
+
+package web
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt"
+)
+
+// resolveTenant is a middleware storing the tenant served at the hostname of the request in the fiber context,
+// applied to every route. Hostnames that are not mapped to a tenant serve the default tenant ("").
+func (s *WebServer) resolveTenant(c *fiber.Ctx) error {
+	tenant, mapped := s.config.TenantForHost(c.Hostname())
+	c.Locals("tenant", tenant)
+	c.Locals("tenantHost", mapped)
+	return c.Next()
+}
+
+// requestTenant returns the tenant of the request, set by resolveTenant and refined by tokenRequired.
+func requestTenant(c *fiber.Ctx) string {
+	tenant, _ := c.Locals("tenant").(string)
+	return tenant
+}
+
+// allowsTenant checks if a token issued for the given tenant may be used with the request. Hostnames of a tenant only
+// accept tokens of that tenant, other hostnames accept tokens of any configured tenant.
+func (s *WebServer) allowsTenant(c *fiber.Ctx, tenant string) bool {
+	if mapped, _ := c.Locals("tenantHost").(bool); mapped {
+		return tenant == requestTenant(c)
+	}
+	return s.config.HasTenant(tenant)
+}
+
+// claimTenant returns the tenant recorded in the `tid` claim, the default tenant if the claim is missing.
+func claimTenant(claims jwt.MapClaims) string {
+	tenant, _ := claims["tid"].(string)
+	return tenant
+}
+
+// withTenant records the given tenant in the `tid` claim of claims, and returns them.
+// The claim is omitted for the default tenant, so single tenant deployments issue the same tokens as before.
+func withTenant(claims jwt.MapClaims, tenant string) jwt.MapClaims {
+	if tenant != "" {
+		claims["tid"] = tenant
+	}
+	return claims
+}
@@ -0,0 +1,411 @@
+// This file contains the handlers for resumable (chunked) video uploads. Every route registered with these handlers
+// should be wrapped in tokenRequired, which guarantees a valid user ID in the fiber context.
+//
+// Videos above the request body limit of the server are uploaded through the following custom protocol, modelled on tus:
+//
+//	POST   /user/scene/upload                      creates a session for the file name and total size of the video (201)
+//	PATCH  /user/scene/upload/:upload_id           appends the raw request body at the Upload-Offset header (200)
+//	GET    /user/scene/upload/:upload_id           returns the session, whose offset is the number of bytes received
+//	POST   /user/scene/upload/:upload_id/complete  creates the scene like /user/scene/new once every byte was received
+//	DELETE /user/scene/upload/:upload_id           aborts the upload, removing the received chunks (204)
+//
+// Every session response carries upload_id, file_name, size, offset, created_at and expires_at. Chunks are appended in
+// order: a chunk is only accepted if its Upload-Offset equals the session offset, otherwise 409 is returned with the
+// current offset. A chunk is stored as a whole or not at all, so after an interruption (or a 409) the client resumes by
+// sending the video from the session offset, which survives restarts and is shared by every replica. Each chunk is a single
+// request, so chunks can not exceed the request body limit. Sessions expire UPLOAD_SESSION_TTL after their last chunk,
+// after which their chunks are removed and routes answer 404.
+//
+// With the s3 storage backend, a client can instead upload the whole video directly to object storage with a presigned URL,
+// and create the scene from the key of the uploaded object, so large videos are not proxied through the server.
+// Videos hosted elsewhere can be submitted by URL instead, and are downloaded by the server in the background.
+//
+// Access to the database should be through the UploadService.
+
+package web
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/upload"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/user"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/services"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/storage"
+)
+
+// uploadSessionErrorStatus maps errors returned by the upload session routes of the ClientService to an HTTP status code.
+func uploadSessionErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, upload.ErrUploadSessionNotFound), errors.Is(err, upload.ErrUploadProgressNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, user.ErrUserNoAccess):
+		return http.StatusForbidden
+	case errors.Is(err, upload.ErrOffsetMismatch), errors.Is(err, services.ErrUploadIncomplete), errors.Is(err, services.ErrDirectUpload):
+		return http.StatusConflict
+	case errors.Is(err, services.ErrEmptyChunk):
+		return http.StatusBadRequest
+	case errors.Is(err, storage.ErrPresignUnsupported):
+		return http.StatusNotImplemented
+	case errors.Is(err, services.ErrRemoteUploadsBusy):
+		return http.StatusServiceUnavailable
+	default:
+		return uploadErrorStatus(err)
+	}
+}
+
+// createUploadSession handles the request to start a resumable upload. It is a JWT protected route.
+//
+// It expects a JSON payload with the following format:
+//
+//	{
+//	    "file_name": "video.mp4" | "photos.zip",
+//	    "size": total size of the video (or zip archive of photos) in bytes
+//	}
+//
+// Returns 201 with the session (upload_id, offset, expires_at), 415 for files of a format that is not accepted (see
+// postNewScene), and 413 for files above the maximum upload size.
+func (s *WebServer) createUploadSession(c *fiber.Ctx) error {
+	s.logger.Debug("Create upload session request received")
+	var req CreateUploadRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	session, err := s.uploadService.CreateUploadSession(context.TODO(), userID, req.FileName, req.Size)
+	if err != nil {
+		s.logger.Debug("Failed to create upload session: ", err.Error())
+		return c.Status(uploadSessionErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusCreated).JSON(session)
+}
+
+// createDirectUpload handles the request to start a direct upload to object storage. It is a JWT protected route.
+//
+// It expects the JSON payload of createUploadSession. Returns 201 with the session and the presigned URL the whole file
+// must be uploaded to with a single PUT request, before creating the scene with /user/scene/new/from-upload:
+//
+//	{
+//	    "upload_id": "id",
+//	    "key": "key of the uploaded object",
+//	    "url": "presigned URL",
+//	    "url_expires_at": RFC3339 (the upload must start before, at most an hour after creation),
+//	    "expires_at": RFC3339,
+//	    ...
+//	}
+//
+// Returns 415 and 413 like createUploadSession, and 501 if the storage backend does not support direct uploads.
+func (s *WebServer) createDirectUpload(c *fiber.Ctx) error {
+	s.logger.Debug("Create direct upload request received")
+	var req CreateUploadRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	direct, err := s.uploadService.CreateDirectUpload(context.TODO(), userID, req.FileName, req.Size)
+	if err != nil {
+		s.logger.Debug("Failed to create direct upload: ", err.Error())
+		return c.Status(uploadSessionErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusCreated).JSON(direct)
+}
+
+// postNewSceneFromUpload handles the request to create a scene from a file uploaded directly to object storage.
+// It is a JWT protected route.
+//
+// It expects a JSON payload with the key of the direct upload, and the optional training values of /user/scene/new:
+//
+//	{
+//	    "key": "key of the uploaded object",
+//	    "training_mode": "gaussian",
+//	    "output_types": ["splat_cloud"],
+//	    "save_iterations": [7000, 30000],
+//	    "total_iterations": 30000,
+//	    "priority": 1,
+//	    "scene_name": "name",
+//	    "callback_url": "https://example.com/hook",
+//	    "callback_secret": "secret"
+//	}
+//
+// The file is validated like /user/scene/new (413, 415, 422), and accepted scenes receive the same 202 with queue feedback.
+// Returns 404 if the key is not one of a direct upload of the user, 400 if the file was not uploaded, and 409 if its size
+// differs from the declared size.
+func (s *WebServer) postNewSceneFromUpload(c *fiber.Ctx) error {
+	s.logger.Debug("New scene from upload request received")
+	var req NewSceneFromUploadRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	videoSceneID, err := s.uploadService.CompleteDirectUpload(context.TODO(), userID, req.Key)
+	if err != nil {
+		s.logger.Debug("Failed to complete direct upload: ", err.Error())
+		var rejected *services.UploadRejectedError
+		if errors.As(err, &rejected) {
+			return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{"error": err.Error(), "violations": rejected.Violations})
+		}
+		return c.Status(uploadSessionErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return s.submitScene(c, userID, videoSceneID, &NewSceneRequest{
+		TrainingMode:    req.TrainingMode,
+		OutputTypes:     req.OutputTypes,
+		SaveIterations:  req.SaveIterations,
+		TotalIterations: req.TotalIterations,
+		Priority:        req.Priority,
+		SceneName:       req.SceneName,
+		CallbackURL:     req.CallbackURL,
+		CallbackSecret:  req.CallbackSecret,
+	}, nil)
+}
+
+// postNewSceneFromURL handles the request to create a scene from a video hosted at a URL. It is a JWT protected route.
+//
+// It expects a JSON payload with the URL of the video (or zip archive of photos), an optional upload ID chosen like the
+// Upload-ID header of /user/scene/new, and the optional training values of /user/scene/new:
+//
+//	{
+//	    "url": "https://example.com/video.mp4",
+//	    "upload_id": "my-upload-1",
+//	    "training_mode": "gaussian",
+//	    "output_types": ["splat_cloud"],
+//	    "save_iterations": [7000, 30000],
+//	    "total_iterations": 30000,
+//	    "priority": 1,
+//	    "scene_name": "name",
+//	    "callback_url": "https://example.com/hook",
+//	    "callback_secret": "secret"
+//	}
+//
+// The video is downloaded in the background, so the route answers 202 with the upload ID as soon as the submission is
+// validated. The download, validation and creation of the scene are polled at /user/upload/progress/:upload_id, which
+// holds the scene ID once done, or the reason the upload failed. Returns 400 for URLs that can not be downloaded from, and
+// 503 if too many videos are being downloaded.
+func (s *WebServer) postNewSceneFromURL(c *fiber.Ctx) error {
+	s.logger.Debug("New scene from URL request received")
+	var req NewSceneFromURLRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if req.TrainingMode == "tensorf" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Tensorf training mode is now deprecated. Please use gaussian training mode."})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	uploadID, err := s.uploadService.UploadFromURL(context.TODO(), userID, req.URL, req.UploadID, services.SceneSubmission{
+		Name:            req.SceneName,
+		TrainingMode:    req.TrainingMode,
+		OutputTypes:     req.OutputTypes,
+		SaveIterations:  req.SaveIterations,
+		TotalIterations: req.TotalIterations,
+		Priority:        req.Priority,
+		CallbackURL:     req.CallbackURL,
+		CallbackSecret:  req.CallbackSecret,
+	})
+	if err != nil {
+		s.logger.Debug("Failed to start the download of a scene: ", err.Error())
+		return c.Status(uploadSessionErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusAccepted).JSON(fiber.Map{"upload_id": uploadID})
+}
+
+// getUploadSession handles the request for the state of an upload session, so an interrupted upload can be resumed
+// from its offset. It is a JWT protected route.
+func (s *WebServer) getUploadSession(c *fiber.Ctx) error {
+	s.logger.Debug("Get upload session request received")
+	var req UploadSessionRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	userID, uploadID, err := parseUploadIDs(c, req.UploadID)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	session, err := s.uploadService.GetUploadSession(context.TODO(), userID, uploadID)
+	if err != nil {
+		return c.Status(uploadSessionErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusOK).JSON(session)
+}
+
+// appendUploadChunk handles the request to append a chunk to an upload session. It is a JWT protected route.
+//
+// The raw request body is the chunk, and the Upload-Offset header the position of its first byte in the video, which
+// must equal the session offset. Returns 200 with the updated session, or 409 with the current offset on a mismatch.
+func (s *WebServer) appendUploadChunk(c *fiber.Ctx) error {
+	s.logger.Debug("Append upload chunk request received")
+	var req UploadChunkRequest
+	if err := c.ParamsParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := c.ReqHeaderParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := validate.Struct(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	userID, uploadID, err := parseUploadIDs(c, req.UploadID)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	body := c.Context().RequestBodyStream()
+	if body == nil {
+		body = bytes.NewReader(c.Body())
+	}
+
+	session, err := s.uploadService.AppendUploadChunk(context.TODO(), userID, uploadID, *req.Offset, body)
+	if errors.Is(err, upload.ErrOffsetMismatch) && session != nil {
+		return c.Status(http.StatusConflict).JSON(fiber.Map{"error": err.Error(), "offset": session.Offset})
+	}
+	if err != nil {
+		s.logger.Debug("Failed to append upload chunk: ", err.Error())
+		return c.Status(uploadSessionErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusOK).JSON(session)
+}
+
+// completeUploadSession handles the request to create a scene from a fully received upload session.
+// It is a JWT protected route.
+//
+// It expects a JSON payload with the optional training values of /user/scene/new:
+//
+//	{
+//	    "training_mode": "gaussian",
+//	    "output_types": ["splat_cloud"],
+//	    "save_iterations": [7000, 30000],
+//	    "total_iterations": 30000,
+//	    "priority": 1,
+//	    "scene_name": "name",
+//	    "callback_url": "https://example.com/hook",
+//	    "callback_secret": "secret"
+//	}
+//
+// The video is validated like /user/scene/new (415, 422), and accepted scenes receive the same 202 with queue feedback.
+// Returns 409 if bytes of the video are still missing.
+func (s *WebServer) completeUploadSession(c *fiber.Ctx) error {
+	s.logger.Debug("Complete upload session request received")
+	var req CompleteUploadRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	userID, uploadID, err := parseUploadIDs(c, req.UploadID)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	videoSceneID, err := s.uploadService.CompleteUploadSession(context.TODO(), userID, uploadID)
+	if err != nil {
+		s.logger.Debug("Failed to complete upload session: ", err.Error())
+		s.discardVideo(userID, videoSceneID)
+		var rejected *services.UploadRejectedError
+		if errors.As(err, &rejected) {
+			return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{"error": err.Error(), "violations": rejected.Violations})
+		}
+		return c.Status(uploadSessionErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return s.submitScene(c, userID, videoSceneID, &NewSceneRequest{
+		TrainingMode:    req.TrainingMode,
+		OutputTypes:     req.OutputTypes,
+		SaveIterations:  req.SaveIterations,
+		TotalIterations: req.TotalIterations,
+		Priority:        req.Priority,
+		SceneName:       req.SceneName,
+		CallbackURL:     req.CallbackURL,
+		CallbackSecret:  req.CallbackSecret,
+	}, nil)
+}
+
+// getUploadProgress handles the request for the progress of an upload of the user, so a client can show a progress bar.
+// It is a JWT protected route.
+//
+// The ID is the Upload-ID chosen for an upload to /user/scene/new, or the ID of an upload session. Returns 200 with the
+// status of the upload (receiving, processing, done or failed), the bytes received and the total size (0 if unknown),
+// and the scene ID once done, or 404 if no upload of the user has the given ID.
+func (s *WebServer) getUploadProgress(c *fiber.Ctx) error {
+	s.logger.Debug("Get upload progress request received")
+	var req UploadProgressRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	progress, err := s.uploadService.GetUploadProgress(context.TODO(), userID, req.UploadID)
+	if err != nil {
+		return c.Status(uploadSessionErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusOK).JSON(progress)
+}
+
+// deleteUploadSession handles the request to abort an upload session, removing the received chunks.
+// It is a JWT protected route.
+func (s *WebServer) deleteUploadSession(c *fiber.Ctx) error {
+	s.logger.Debug("Delete upload session request received")
+	var req UploadSessionRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	userID, uploadID, err := parseUploadIDs(c, req.UploadID)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if err := s.uploadService.AbortUploadSession(context.TODO(), userID, uploadID); err != nil {
+		return c.Status(uploadSessionErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.SendStatus(http.StatusNoContent)
+}
+
+// parseUploadIDs parses the user ID of the fiber context and the given upload ID.
+func parseUploadIDs(c *fiber.Ctx, uploadIDHex string) (primitive.ObjectID, primitive.ObjectID, error) {
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		return primitive.NilObjectID, primitive.NilObjectID, errors.New("invalid user ID")
+	}
+	uploadID, err := primitive.ObjectIDFromHex(uploadIDHex)
+	if err != nil {
+		return primitive.NilObjectID, primitive.NilObjectID, errors.New("invalid upload ID")
+	}
+	return userID, uploadID, nil
+}
@@ -2,84 +2,260 @@
 // dispatching them to the appropriate handler.
 //
 // Access to the database should be through the ClientService.
-// The only direct access to filesystem should be for reading files when sending data between
-// workers, thumbnail retrieval, and output retrieval.
+// The only direct access to artifact storage should be for reading files when sending data between
+// workers, thumbnail retrieval, and output retrieval. Artifacts are always read through the storage abstraction,
+// never from the local filesystem, so any replica can serve any scene.
 
 package web
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
+	"net/url"
+	"net/mail"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/golang-jwt/jwt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 
+	"github.com/NeRF-or-Nothing/go-web-server/internal/config"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/audit"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/pagination"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/refreshtoken"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/scene"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/models/user"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/secrets"
 	"github.com/NeRF-or-Nothing/go-web-server/internal/services"
+	"github.com/NeRF-or-Nothing/go-web-server/internal/storage"
 	"github.com/NeRF-or-Nothing/go-web-server/internal/log"
 )
 
+// Custom errors
+var (
+	// errTokenExpired is returned when an access token is past its expiry (allowing for clock skew).
+	errTokenExpired = errors.New("token expired")
+	// errTokenInvalid is returned when an access token is malformed, has a bad signature, or lacks required claims.
+	errTokenInvalid = errors.New("invalid token")
+)
+
 type WebServer struct {
-	jwtSecret     string
-	app           *fiber.App
-	clientService *services.ClientService
-	logger        *log.Logger
+	jwtKeyring          *secrets.JWTKeyring
+	app                 *fiber.App
+	clientService       *services.ClientService
+	uploadService       *services.UploadService
+	adminService        *services.AdminService
+	backupService       *services.BackupService
+	replayService       *services.ReplayService
+	integrityService    *services.IntegrityService
+	auditService        *services.AuditService
+	notificationService *services.NotificationService
+	rateLimitStore      RateLimitStore
+	storage             storage.Storage
+	workerURLs          *storage.WorkerURLSigner
+	oauthProviders      OAuthProviders
+	config              *config.Config
+	logger              *log.Logger
+	load                *loadMonitor
 }
 
 // NewWebServer creates a new WebServer instance.
-func NewWebServer(jwtSecret string, clientService *services.ClientService, logger *log.Logger) *WebServer {
+func NewWebServer(
+	jwtKeyring *secrets.JWTKeyring,
+	clientService *services.ClientService,
+	uploadService *services.UploadService,
+	adminService *services.AdminService,
+	backupService *services.BackupService,
+	replayService *services.ReplayService,
+	integrityService *services.IntegrityService,
+	auditService *services.AuditService,
+	notificationService *services.NotificationService,
+	rateLimitStore RateLimitStore,
+	store storage.Storage,
+	workerURLs *storage.WorkerURLSigner,
+	oauthProviders OAuthProviders,
+	cfg *config.Config,
+	logger *log.Logger,
+) *WebServer {
 	logger.Debug("Creating new web server instance")
 
 	app := fiber.New(fiber.Config{
-		BodyLimit: 16 * 1024 * 1024, // Max Single Request Body Size: 16MB
-		StreamRequestBody: true,     // Stream request body to disk
+		BodyLimit: int(cfg.RequestBodyLimit), // Max Single Request Body Size held in memory
+		StreamRequestBody: true,              // Stream request body to disk
 	})
+	// Allowed origins are checked on every request, as they can be reloaded
 	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
+		AllowOriginsFunc: func(origin string) bool {
+			return cfg.Tunables().AllowsOrigin(origin)
+		},
 		AllowHeaders: "Authorization, Content-Type",
 	}))
 
 	return &WebServer{
-		jwtSecret:     jwtSecret,
-		app:           app,
-		clientService: clientService,
-		logger:        logger,
+		jwtKeyring:          jwtKeyring,
+		app:                 app,
+		clientService:       clientService,
+		uploadService:       uploadService,
+		adminService:        adminService,
+		backupService:       backupService,
+		replayService:       replayService,
+		integrityService:    integrityService,
+		auditService:        auditService,
+		notificationService: notificationService,
+		rateLimitStore:      rateLimitStore,
+		storage:             store,
+		workerURLs:          workerURLs,
+		oauthProviders:      oauthProviders,
+		config:              cfg,
+		logger:              logger,
+		load:                newLoadMonitor(),
 	}
 }
 
 // Run starts the web server on the given IP and port.
 func (s *WebServer) Run(ip string, port int) error {
 	s.SetupRoutes()
-	s.SetupFileStructure()
 	return s.app.Listen(ip + ":" + strconv.Itoa(port))
 }
 
 // SetupRoutes sets up the routes for the web server.
 func (s *WebServer) SetupRoutes() {
+	// Count the requests in progress, low priority routes are shed while too many are
+	s.app.Use(s.trackLoad)
+	// Resolve the tenant served at the hostname of the request, see Tenants.go
+	s.app.Use(s.resolveTenant)
+
 	// External Account Routes
-	s.app.Post("/user/account/login", s.loginUser)
-	s.app.Post("/user/account/register", s.registerUser)
+	s.app.Post("/user/account/login", s.rateLimited("login", s.loginUser))
+	s.app.Post("/user/account/register", s.rateLimited("register", s.registerUser))
+	s.app.Post("/user/account/guest", s.rateLimited("guest", s.createGuest))
+	s.app.Post("/user/account/refresh", s.refreshToken)
+	s.app.Post("/user/account/logout", s.logoutUser)
+	s.app.Get("/user/account/oauth/:provider", s.oauthLogin)
+	s.app.Get("/user/account/oauth/:provider/callback", s.oauthCallback)
+	s.app.Post("/user/account/oauth/:provider/link", s.tokenRequired(s.oauthLink))
 	s.app.Patch("/user/account/update/username", s.tokenRequired(s.updateUserUsername))
 	s.app.Patch("/user/account/update/password", s.tokenRequired(s.updateUserPassword))
+	s.app.Patch("/user/account/update/timezone", s.tokenRequired(s.updateUserTimezone))
+	s.app.Patch("/user/account/update/notifications", s.tokenRequired(s.updateUserNotifications))
 	s.app.Delete("/user/account/delete", s.tokenRequired(s.deleteUser))
+	s.app.Post("/user/account/accept-policies", s.tokenRequired(s.acceptPolicies))
+	s.app.Get("/user/account/sessions", s.tokenRequired(s.listSessions))
+	s.app.Delete("/user/account/sessions", s.tokenRequired(s.revokeOtherSessions))
+	s.app.Delete("/user/account/sessions/:session_id", s.tokenRequired(s.revokeSession))
+	s.app.Get("/user/account/audit", s.lowPriority(s.tokenRequired(s.getAuditTrail)))
 
 	// External Scene Routes
-	s.app.Delete("/user/scene/delete/:scene_id", s.tokenRequired(s.deleteUserScene))
-	s.app.Post("/user/scene/new", s.tokenRequired(s.postNewScene))
-	s.app.Get("/user/scene/metadata/:scene_id", s.tokenRequired(s.getSceneMetadata))
-	s.app.Get("/user/scene/thumbnail/:scene_id", s.tokenRequired(s.getSceneThumbnail))
-	s.app.Get("/user/scene/name/:scene_id", s.tokenRequired(s.getSceneName))
-	s.app.Get("/user/scene/progress/:scene_id", s.tokenRequired(s.getSceneProgress))
-	s.app.Get("/user/scene/history", s.tokenRequired(s.getUserSceneHistory))
-	s.app.Get("/user/scene/output/:output_type/:scene_id", s.tokenRequired(s.getSceneOutput))
+	s.app.Delete("/user/scene/delete/:scene_id", s.tokenRequired(s.policiesRequired(s.deleteUserScene)))
+	s.app.Post("/user/scene/restore/:scene_id", s.tokenRequired(s.policiesRequired(s.restoreUserScene)))
+	s.app.Post("/user/scene/cancel/:scene_id", s.tokenRequired(s.policiesRequired(s.cancelUserScene)))
+	s.app.Post("/user/scene/new", s.tokenRequired(s.policiesRequired(s.postNewScene)))
+	s.app.Post("/user/scene/new/from-upload", s.tokenRequired(s.policiesRequired(s.postNewSceneFromUpload)))
+	s.app.Post("/user/scene/new/from-url", s.tokenRequired(s.policiesRequired(s.postNewSceneFromURL)))
+	s.app.Post("/user/scene/clone/:scene_id", s.tokenRequired(s.policiesRequired(s.cloneScene)))
+	s.app.Post("/user/scene/upload", s.tokenRequired(s.policiesRequired(s.createUploadSession)))
+	s.app.Post("/user/scene/upload/direct", s.tokenRequired(s.policiesRequired(s.createDirectUpload)))
+	s.app.Get("/user/scene/upload/:upload_id", s.tokenRequired(s.policiesRequired(s.getUploadSession)))
+	s.app.Patch("/user/scene/upload/:upload_id", s.tokenRequired(s.policiesRequired(s.appendUploadChunk)))
+	s.app.Post("/user/scene/upload/:upload_id/complete", s.tokenRequired(s.policiesRequired(s.completeUploadSession)))
+	s.app.Delete("/user/scene/upload/:upload_id", s.tokenRequired(s.policiesRequired(s.deleteUploadSession)))
+	s.app.Get("/user/upload/progress/:upload_id", s.lowPriority(s.tokenRequired(s.policiesRequired(s.getUploadProgress))))
+	s.app.Get("/user/quota", s.lowPriority(s.tokenRequired(s.policiesRequired(s.getUserQuota))))
+	s.app.Get("/user/scene/metadata/:scene_id", s.lowPriority(s.tokenRequired(s.policiesRequired(s.getSceneMetadata))))
+	s.app.Get("/user/scene/thumbnail/:scene_id", s.lowPriority(s.tokenRequired(s.policiesRequired(s.getSceneThumbnail))))
+	s.app.Put("/user/scene/thumbnail/:scene_id", s.tokenRequired(s.policiesRequired(s.putSceneThumbnail)))
+	s.app.Get("/user/scene/name/:scene_id", s.lowPriority(s.tokenRequired(s.policiesRequired(s.getSceneName))))
+	s.app.Get("/user/scene/config/:scene_id", s.tokenRequired(s.policiesRequired(s.getSceneConfig)))
+	s.app.Patch("/user/scene/config/:scene_id", s.tokenRequired(s.policiesRequired(s.updateSceneConfig)))
+	s.app.Get("/user/scene/progress/:scene_id", s.lowPriority(s.tokenRequired(s.policiesRequired(s.getSceneProgress))))
+	s.app.Get("/user/scene/cost/:scene_id", s.lowPriority(s.tokenRequired(s.policiesRequired(s.getSceneCost))))
+	s.app.Get("/user/scene/storage/:scene_id", s.lowPriority(s.tokenRequired(s.policiesRequired(s.getSceneStorage))))
+	s.app.Get("/user/scene/archive/:scene_id", s.tokenRequired(s.policiesRequired(s.getSceneArchive)))
+	s.app.Post("/user/scene/archive/:scene_id", s.tokenRequired(s.policiesRequired(s.archiveScene)))
+	s.app.Post("/user/scene/unarchive/:scene_id", s.tokenRequired(s.policiesRequired(s.restoreScene)))
+	s.app.Get("/user/scene/history", s.lowPriority(s.tokenRequired(s.policiesRequired(s.getUserSceneHistory))))
+	s.app.Get("/user/scene/output/:output_type/:scene_id", s.tokenRequired(s.policiesRequired(s.getSceneOutput)))
+	s.app.Get("/user/scene/versions/:scene_id", s.tokenRequired(s.policiesRequired(s.listSceneVersions)))
+	s.app.Get("/user/scene/export/:scene_id", s.tokenRequired(s.policiesRequired(s.exportScene)))
+	s.app.Get("/user/scene/manifest/:scene_id", s.tokenRequired(s.policiesRequired(s.getSceneManifest)))
+	s.app.Post("/user/scene/share/:scene_id", s.tokenRequired(s.policiesRequired(s.shareScene)))
+	s.app.Get("/user/scene/analytics/:scene_id", s.lowPriority(s.tokenRequired(s.policiesRequired(s.getSceneAnalytics))))
+	s.app.Put("/user/scene/visibility/:scene_id", s.tokenRequired(s.policiesRequired(s.setSceneVisibility)))
+
+	// External Notification Routes
+	s.app.Get("/user/notifications", s.lowPriority(s.tokenRequired(s.policiesRequired(s.listNotifications))))
+	s.app.Get("/user/notifications/stream", s.lowPriority(s.tokenRequired(s.policiesRequired(s.streamNotifications))))
+
+	// Versioned API Routes, whose response schemas only change under a new version prefix
+	v1 := s.app.Group("/api/v1")
+	v1.Get("/user/scene/progress/:scene_id", s.lowPriority(s.tokenRequired(s.policiesRequired(s.getSceneProgressReport))))
+
+	// External Announcement / Policy / Branding Routes
+	s.app.Get("/announcements", s.lowPriority(s.getAnnouncements))
+	s.app.Get("/policies", s.getPolicies)
+	s.app.Get("/config/branding", s.getBranding)
+
+	// Public share links of scene outputs, authorized by their signed token instead of an access token
+	s.app.Get("/share/scene/:token", s.getSharedSceneOutput)
+
+	// Public gallery of the scenes users published, and the outputs of unlisted and public scenes
+	s.app.Get("/gallery", s.lowPriority(s.listGallery))
+	s.app.Get("/gallery/scene/:scene_id/thumbnail", s.lowPriority(s.getPublicSceneThumbnail))
+	s.app.Get("/gallery/scene/:scene_id/output/:output_type", s.getPublicSceneOutput)
+
+	// Public keys other services verify access tokens with, when signed with an asymmetric algorithm
+	s.app.Get("/.well-known/jwks.json", s.getJWKS)
+
+	// Prometheus metrics, for scraping from inside the deployment
+	if s.config.MetricsEnabled {
+		s.app.Get("/metrics", adaptor.HTTPHandler(promhttp.Handler()))
+	}
+
+	// Admin Routes
+	s.app.Get("/admin/announcements", s.adminRequired(s.listAnnouncements))
+	s.app.Post("/admin/announcements", s.adminRequired(s.createAnnouncement))
+	s.app.Patch("/admin/announcements/:announcement_id", s.adminRequired(s.updateAnnouncement))
+	s.app.Delete("/admin/announcements/:announcement_id", s.adminRequired(s.deleteAnnouncement))
+	s.app.Get("/admin/trends", s.adminRequired(s.getTrends))
+	s.app.Get("/admin/users/:user_id", s.adminRequired(s.getUser))
+	s.app.Put("/admin/users/:user_id/roles", s.adminRequired(s.setUserRoles))
+	s.app.Put("/admin/users/:user_id/retention", s.adminRequired(s.setUserRetention))
+	s.app.Put("/admin/users/:user_id/upload-limit", s.adminRequired(s.setUserUploadLimit))
+	s.app.Get("/admin/queues", s.adminRequired(s.getQueues))
+	s.app.Post("/admin/queues/purge", s.adminRequired(s.purgeQueues))
+	s.app.Get("/admin/consumers", s.adminRequired(s.getConsumers))
+	s.app.Get("/admin/workers", s.adminRequired(s.getWorkers))
+	s.app.Get("/admin/dead-letters", s.adminRequired(s.listDeadLetters))
+	s.app.Get("/admin/dead-letters/:dead_letter_id", s.adminRequired(s.getDeadLetter))
+	s.app.Post("/admin/dead-letters/:dead_letter_id/replay", s.adminRequired(s.replayDeadLetter))
+	s.app.Delete("/admin/dead-letters/:dead_letter_id", s.adminRequired(s.discardDeadLetter))
+	s.app.Post("/admin/config/reload", s.adminRequired(s.reloadConfig))
+	s.app.Get("/admin/backups", s.adminRequired(s.listBackups))
+	s.app.Post("/admin/backups", s.adminRequired(s.createBackup))
+	s.app.Get("/admin/backups/:backup_id/verify", s.adminRequired(s.verifyBackup))
+	s.app.Get("/admin/scenes/worker-version", s.adminRequired(s.listWorkerVersionScenes))
+	s.app.Get("/admin/scenes/:scene_id/storage", s.adminRequired(s.getAdminSceneStorage))
+	s.app.Get("/admin/replays", s.adminRequired(s.listReplays))
+	s.app.Post("/admin/replays", s.adminRequired(s.createReplay))
+	s.app.Get("/admin/replays/:replay_id", s.adminRequired(s.getReplay))
+	s.app.Get("/admin/integrity", s.adminRequired(s.listIntegrityChecks))
+	s.app.Post("/admin/integrity", s.adminRequired(s.createIntegrityCheck))
+	s.app.Get("/admin/integrity/:check_id", s.adminRequired(s.getIntegrityCheck))
+	// Synthetic scenes for load tests, in staging only
+	if s.config.SyntheticEnabled {
+		s.app.Post("/admin/synthetic/scene", s.adminRequired(s.createSyntheticScenes))
+	}
 
 	// Internal routes
 	s.app.Get("/worker-data/*", s.getWorkerData)
@@ -89,36 +265,15 @@ func (s *WebServer) SetupRoutes() {
 	s.app.Get("/health", s.healthCheck)
 }
 
-// SetupFileStructure creates the necessary directories for storing data files.
-// Due to docker volume mapping, this should be mostly redundant, but it is included for completeness.
-func (s *WebServer) SetupFileStructure() {
-	dataDir := "/data"
-	sfmDir := filepath.Join(dataDir, "sfm")
-	nerfDir := filepath.Join(dataDir, "nerf")
-	rawDir := filepath.Join(dataDir, "raw")
-
-	err := os.MkdirAll(sfmDir, os.ModePerm)
-	if err != nil {
-		s.logger.Info("Failed to create sfm directory:", err.Error())
-	}
-
-	err = os.MkdirAll(nerfDir, os.ModePerm)
-	if err != nil {
-		s.logger.Info("Failed to create nerf directory:", err.Error())
-	}
-
-	err = os.MkdirAll(rawDir, os.ModePerm)
-	if err != nil {
-		s.logger.Info("Failed to create raw directory:", err.Error())
-	}
-}
-
 // tokenRequired is a middleware that checks for a valid JWT token in the Authorization header.
 //
 // The token is expected to be in the format: `Bearer <token>`.   
 // A valid token will decode to a user ID (of type String(primitive.ObjectID)).
 // It is expected that the user ID is stored in the token's `sub` claim. 
 //
+// Rejected tokens receive a 401 whose `code` is `token_expired` if the token only expired (the client should refresh
+// it or prompt a re-login), or `token_invalid` for any other problem, including tokens of another tenant (see Tenants.go).
+//
 // Validation of the user's existence is not performed here.
 // and instead the user ID is stored in the fiber context for use in request handlers,
 // which is then validated by ClientService.
@@ -130,7 +285,7 @@ func (s *WebServer) tokenRequired(handler fiber.Handler) fiber.Handler {
 			return c.Status(http.StatusUnauthorized).JSON(fiber.Map{"error": "Missing Authorization header"})
 		}
 
-		s.logger.Debugf("\nAuthorization header: %s", authHeader)
+		s.logger.Debugf("\nAuthorization header: %s", s.logger.Redact(authHeader))
 		parts := strings.Split(authHeader, " ")
 
 		if len(parts) != 2 || parts[0] != "Bearer" {
@@ -139,38 +294,172 @@ func (s *WebServer) tokenRequired(handler fiber.Handler) fiber.Handler {
 		}
 
 		tokenString := parts[1]
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			return []byte(s.jwtSecret), nil
-		})
-
-		if err != nil || !token.Valid {
-			s.logger.Debug("Invalid token")
-			return c.Status(http.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token"})
+		claims, err := s.parseToken(tokenString)
+		if errors.Is(err, errTokenExpired) {
+			s.logger.Debug("Expired token")
+			return c.Status(http.StatusUnauthorized).JSON(fiber.Map{"error": "Token expired", "code": "token_expired"})
 		}
-
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			s.logger.Debug("Invalid token claims")
-			return c.Status(http.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token claims"})
+		if err != nil {
+			s.logger.Debug("Invalid token: ", err.Error())
+			return c.Status(http.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token", "code": "token_invalid"})
 		}
+
 		userID, ok := claims["sub"].(string)
 		if !ok {
 			s.logger.Debug("Invalid user ID in token")
-			return c.Status(http.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid user ID in token"})
+			return c.Status(http.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid user ID in token", "code": "token_invalid"})
+		}
+
+		// Tokens issued before sessions were recorded have no session ID
+		sessionID, _ := claims["sid"].(string)
+
+		tenant := claimTenant(claims)
+		if !s.allowsTenant(c, tenant) {
+			s.logger.Debug("Token of tenant ", tenant, " used on host ", c.Hostname())
+			return c.Status(http.StatusUnauthorized).JSON(fiber.Map{"error": "Token issued for another tenant", "code": "token_invalid"})
 		}
 
 		c.Locals("userID", userID)
+		c.Locals("sessionID", sessionID)
+		c.Locals("tenant", tenant)
+		return handler(c)
+	}
+}
+
+// parseToken parses and verifies a JWT token with the key of the keyring identified by the `kid` header of the token.
+// Tokens signed with a retired key stay valid until that key is removed from the keyring. Tokens without a `kid`
+// (issued before tokens carried one) are verified against every key, the current signing key first.
+//
+// The exp and iat claims are required, and validated with the configured clock skew as leeway.
+//
+// Returns the token claims if valid, errTokenExpired if the token expired, errTokenInvalid otherwise.
+func (s *WebServer) parseToken(tokenString string) (jwt.MapClaims, error) {
+	// Claims are validated below, with leeway for clock skew
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+
+	// The algorithm of the token must be the one of the key, so a public key is never used as an HMAC secret
+	keyFunc := func(key *secrets.JWTKey) jwt.Keyfunc {
+		return func(token *jwt.Token) (interface{}, error) {
+			if key == nil {
+				keyID, _ := token.Header["kid"].(string)
+				found, ok := s.jwtKeyring.VerificationKey(keyID)
+				if !ok {
+					return nil, fmt.Errorf("unknown key ID: %q", keyID)
+				}
+				key = &found
+			}
+			if token.Method.Alg() != key.Method.Alg() {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+			return key.VerifyKey, nil
+		}
+	}
+
+	token, err := parser.Parse(tokenString, keyFunc(nil))
+	if err != nil && token != nil && token.Header["kid"] == nil {
+		for _, key := range s.jwtKeyring.VerificationKeys() {
+			token, err = parser.Parse(tokenString, keyFunc(&key))
+			if err == nil && token.Valid {
+				break
+			}
+		}
+	}
+	if err != nil || token == nil || !token.Valid {
+		return nil, errTokenInvalid
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, errTokenInvalid
+	}
+
+	now := time.Now()
+	skew := s.config.JWTClockSkew
+	if !claims.VerifyIssuedAt(now.Add(skew).Unix(), true) || !claims.VerifyNotBefore(now.Add(skew).Unix(), false) {
+		return nil, errTokenInvalid
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, errTokenInvalid
+	}
+	if !claims.VerifyExpiresAt(now.Add(-skew).Unix(), true) {
+		return nil, errTokenExpired
+	}
+
+	return claims, nil
+}
+
+// policiesRequired is a middleware that only allows users who accepted the current terms of service / privacy policy through.
+// It must be wrapped by tokenRequired, as it expects the user ID in the fiber context.
+//
+// Users who have not accepted the current versions receive a 451 response with the versions to accept,
+// which should be accepted through /user/account/accept-policies.
+func (s *WebServer) policiesRequired(handler fiber.Handler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+		if err != nil {
+			s.logger.Debug("Invalid user ID: ", err.Error())
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+		}
+
+		err = s.clientService.CheckPolicyAcceptance(context.TODO(), userID)
+		if errors.Is(err, user.ErrPoliciesNotAccepted) {
+			s.logger.Debug("User has not accepted current policies")
+			termsVersion, privacyVersion := s.clientService.GetPolicyVersions()
+			return c.Status(http.StatusUnavailableForLegalReasons).JSON(fiber.Map{
+				"error":           err.Error(),
+				"terms_version":   termsVersion,
+				"privacy_version": privacyVersion,
+			})
+		}
+		if err != nil {
+			s.logger.Debug("Failed to check policy acceptance: ", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
 		return handler(c)
 	}
 }
 
-// loginUser handles the login request.
+// roleRequired is a middleware that only allows users that were granted the given role through.
+// It wraps tokenRequired, so the user ID is validated and stored in the fiber context before the role check.
+func (s *WebServer) roleRequired(role string, handler fiber.Handler) fiber.Handler {
+	return s.tokenRequired(func(c *fiber.Ctx) error {
+		userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+		if err != nil {
+			s.logger.Debug("Invalid user ID: ", err.Error())
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+		}
+
+		hasRole, err := s.adminService.HasRole(context.TODO(), userID, role)
+		if err != nil {
+			s.logger.Debug("Failed to check role: ", err.Error())
+			return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		if !hasRole {
+			s.logger.Debugf("Route requiring role %s requested by user without it", role)
+			return c.Status(http.StatusForbidden).JSON(fiber.Map{"error": fmt.Sprintf("Role %s required", role)})
+		}
+
+		return handler(c)
+	})
+}
+
+// adminRequired is a middleware that only allows users with the admin role through.
+func (s *WebServer) adminRequired(handler fiber.Handler) fiber.Handler {
+	return s.roleRequired(user.RoleAdmin, handler)
+}
+
+// loginUser handles the login request. Users log in to the tenant served at the hostname of the request.
 //
 // It expects a JSON payload with the following format:
 //	{
 //	    "username": "username",
 //	    "password": "password"
 //	}
+//
+// It responds with a short-lived access token (`jwtToken`), and a refresh token to obtain new access tokens with.
+// Accounts locked after too many failed logins receive a 429 with `code` "account_locked", `locked_until`,
+// and a Retry-After header. Clients exceeding the rate limits receive a 429 with `code` "rate_limited".
 func (s *WebServer) loginUser(c *fiber.Ctx) error {
 	s.logger.Debug("Login request received")
 
@@ -181,151 +470,113 @@ func (s *WebServer) loginUser(c *fiber.Ctx) error {
 	}
 	s.logger.Debug("Login request validated")
 
-	userID, err := s.clientService.LoginUser(context.TODO(), req.Username, req.Password)
+	userID, err := s.clientService.LoginUser(context.TODO(), requestTenant(c), req.Username, req.Password)
+	var lockedErr *user.AccountLockedError
+	if errors.As(err, &lockedErr) {
+		s.logger.Debug("Login to locked account: ", s.logger.Redact(req.Username))
+		retryAfter := max(int(time.Until(lockedErr.Until).Seconds()), 1)
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(retryAfter))
+		return c.Status(http.StatusTooManyRequests).JSON(fiber.Map{
+			"error":        err.Error(),
+			"code":         "account_locked",
+			"locked_until": lockedErr.Until.UTC(),
+		})
+	}
+	if errors.Is(err, services.ErrPasswordLoginDisabled) {
+		return c.Status(http.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+	}
 	if err != nil {
 		s.logger.Debug("User login failed: ", err.Error())
 		return c.Status(http.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
 	}
 	s.logger.Debug("User logged in")
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub": userID,
-	})
-	tokenString, err := token.SignedString([]byte(s.jwtSecret))
+	id, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
-		s.logger.Debug("Failed to generate token")
-		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate token"})
-	}
-	s.logger.Debugf("JWT token generated, userID %s\n", userID)
-
-	return c.Status(http.StatusOK).JSON(fiber.Map{"jwtToken": tokenString})
-}
-
-// registerUser handles the registration request. 
-// 
-// It expects a JSON payload with the following format:
-//	{
-//	    "username": "username",
-//	    "password": "password"
-//	}
-func (s *WebServer) registerUser(c *fiber.Ctx) error {
-	s.logger.Debug("Register request received")
-
-	var req RegisterRequest
-	if err := ValidateRequest(c, &req); err != nil {
-		s.logger.Debug("Register request validation failed: ", err.Error())
-		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error(), "success": false})
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Invalid user ID"})
 	}
-
-	err := s.clientService.RegisterUser(context.TODO(), req.Username, req.Password)
+	refreshToken, sessionID, err := s.clientService.IssueRefreshToken(context.TODO(), id, c.Get(fiber.HeaderUserAgent), c.IP())
 	if err != nil {
-		s.logger.Debug("User registration failed: ", err.Error())
-		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error(), "success": false})
+		s.logger.Debug("Failed to generate refresh token: ", err.Error())
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate token"})
 	}
+	s.audit(c, audit.ActionLogin, id, primitive.NilObjectID, map[string]string{"method": "password", "provider": s.config.AuthProvider})
 
-	s.logger.Debug("User registered successfully")
-	return c.Status(http.StatusCreated).JSON(fiber.Map{"success": true})
+	return s.sendTokens(c, userID, sessionID, requestTenant(c), refreshToken)
 }
 
-// updateUserUsername handles the request to update the username of a user. It is a JWT protected route.
+// refreshToken handles the request to exchange a refresh token for a new access token.
+// The refresh token is rotated: the presented token is revoked and a new one is returned.
+// Refresh tokens of another tenant than the one served at the hostname of the request are rejected, and can not be used again.
 //
 // It expects a JSON payload with the following format:
 //	{
-//	    "password": "password",
-//	    "new_username": "new_username"
+//	    "refresh_token": "token"
 //	}
-func (s *WebServer) updateUserUsername(c *fiber.Ctx) error {
-	s.logger.Debug("Update username request received")
+func (s *WebServer) refreshToken(c *fiber.Ctx) error {
+	s.logger.Debug("Refresh token request received")
 
-	var req UpdateUsernameRequest
+	var req RefreshTokenRequest
 	if err := ValidateRequest(c, &req); err != nil {
-		s.logger.Debug("Update username request validation failed: ", err.Error())
-		return fiber.NewError(http.StatusBadRequest, err.Error())
+		s.logger.Debug("Refresh token request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	userID, sessionID, refreshToken, err := s.clientService.RotateRefreshToken(context.TODO(), req.RefreshToken, c.Get(fiber.HeaderUserAgent), c.IP())
 	if err != nil {
-		s.logger.Debug("Invalid user ID: ", err.Error())
-		return fiber.NewError(http.StatusBadRequest, "Invalid user ID")
+		s.logger.Debug("Refresh token rotation failed: ", err.Error())
+		if isRefreshTokenError(err) {
+			return c.Status(http.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	err = s.clientService.UpdateUserUsername(context.TODO(), userID, req.Password, req.NewUsername)
+	tenant, err := s.clientService.GetUserTenant(context.TODO(), userID)
 	if err != nil {
-		s.logger.Debug("Failed to update username: ", err.Error())
-		return fiber.NewError(http.StatusBadRequest, err.Error())
+		s.logger.Debug("Failed to get tenant of user: ", err.Error())
+		return c.Status(http.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !s.allowsTenant(c, tenant) {
+		s.logger.Debug("Refresh token of tenant ", tenant, " used on host ", c.Hostname())
+		return c.Status(http.StatusUnauthorized).JSON(fiber.Map{"error": "Token issued for another tenant"})
 	}
 
-	return c.Status(http.StatusOK).JSON(fiber.Map{"message": "Username updated"})
+	return s.sendTokens(c, userID, sessionID, tenant, refreshToken)
 }
 
-// updateUserPassword handles the request to update the password of a user. It is a JWT protected route.
-// It expects a JSON payload with the following format:
+// logoutUser handles the logout request, revoking the given refresh token and every token rotated from the same login.
+// Access tokens already issued stay valid until they expire.
 //
+// It expects a JSON payload with the following format:
 //	{
-//	    "old_password": "old_password",
-//	    "new_password": "new_password"
+//	    "refresh_token": "token"
 //	}
-func (s *WebServer) updateUserPassword(c *fiber.Ctx) error {
-	s.logger.Debug("Update password request received")
+func (s *WebServer) logoutUser(c *fiber.Ctx) error {
+	s.logger.Debug("Logout request received")
 
-	var req UpdatePasswordRequest
+	var req RefreshTokenRequest
 	if err := ValidateRequest(c, &req); err != nil {
-		return fiber.NewError(http.StatusBadRequest, err.Error())
-	}
-
-	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
-	if err != nil {
-		s.logger.Debug("Invalid user ID: ", err.Error())
-		return fiber.NewError(http.StatusBadRequest, "Invalid user ID")
+		s.logger.Debug("Logout request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	err = s.clientService.UpdateUserPassword(context.TODO(), userID, req.OldPassword, req.NewPassword)
-	if err != nil {
-		s.logger.Debug("Failed to update password: ", err.Error())
-		return fiber.NewError(http.StatusBadRequest, err.Error())
+	if err := s.clientService.RevokeRefreshToken(context.TODO(), req.RefreshToken); err != nil {
+		s.logger.Debug("Logout failed: ", err.Error())
+		if isRefreshTokenError(err) {
+			return c.Status(http.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	return c.Status(http.StatusOK).JSON(fiber.Map{"message": "Password updated"})
-}
-
-// Must be careful in implementing these two functions.
-// Figure our how to gracefully handle deletion of scenes since they might be processing.
-//
-// Planning: Confirmation at the client level. In progress scenes are denied deletion
-// (This should be redundant ui-wise since the client doesnt display )
-// If a completed scene is deleted, we do not need to delete the output files. FOR NOW. Instead just 
-// remove from DB.
-//
-// This allows us to implement a goroutine that periodically cleans up old output files. (we can just append to a list of files to delete)
-func (s *WebServer) deleteUserScene(c *fiber.Ctx) error {
-	return fiber.NewError(http.StatusNotImplemented, "Not implemented")
-}
-
-// Should deleting a user also delete all their scenes? How to handle this?
-// Do we need to expand auth for confirmation, or leave that at the client level?
-func (s *WebServer) deleteUser(c *fiber.Ctx) error {
-	return fiber.NewError(http.StatusNotImplemented, "Not implemented")
+	return c.Status(http.StatusOK).JSON(fiber.Map{"message": "Logged out"})
 }
 
-// postNewScene handles the new scene request. It is a JWT protected route.
+// listSessions handles the request to list the active sessions (logins) of the user. It is a JWT protected route.
 //
-// It expects a multipart form with the following fields:
-//   - file: required,
-//     the video file to upload
-//   - training_mode: optional,
-//     the training mode to use (gaussian or tensorf)
-//   - output_types: optional,
-//     a comma-separated list of output types to save (e.g. splat_cloud, point_cloud, etc.)
-//   - save_iterations: optional,
-//     a comma-separated list of iterations to save the output at (0 <= x <= 30000)
-//   - total_iterations: optional,
-//     the total number of iterations to run (0 <= x <= 30000)
-//   - scene_name: optional,
-//     the name of the scene
-func (s *WebServer) postNewScene(c *fiber.Ctx) error {
-	s.logger.Debug("New Scene Request received")
-	var req *NewSceneRequest
-	var err error
+// Responds with the ID, device (user agent), IP, issue time, last use and expiry of each session, most recently used first.
+// The session the request was made from is marked `current`.
+func (s *WebServer) listSessions(c *fiber.Ctx) error {
+	s.logger.Debug("List sessions request received")
 
 	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
 	if err != nil {
@@ -333,45 +584,25 @@ func (s *WebServer) postNewScene(c *fiber.Ctx) error {
 		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
 	}
 
-	req, err = ParseNewSceneRequest(c)
-	if err != nil {
-		s.logger.Debug("Video upload request parsing failed: ", err.Error())
-		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
-	}
-
-	if req.TrainingMode == "tensorf" {
-		s.logger.Debug("Tensorf training mode is now deprecated. Please use gaussian training mode.")
-		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Tensorf training mode is now deprecated. Please use gaussian training mode."})
-	}
-
-	sceneID, err := s.clientService.HandleIncomingVideo(
-		context.TODO(),
-		userID,
-		req.File,
-		req.TrainingMode,
-		req.OutputTypes,
-		req.SaveIterations,
-		req.TotalIterations,
-		req.SceneName,
-	)
+	sessions, err := s.clientService.ListSessions(context.TODO(), userID, c.Locals("sessionID").(string))
 	if err != nil {
-		s.logger.Debug("Video processing failed:", err.Error())
-		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		s.logger.Debug("Failed to list sessions: ", err.Error())
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	s.logger.Debugf("Video received and processing scene %s. Check back later for updates.\n", sceneID)
-	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"id": sceneID, "message": "Video received and processing scene. Check back later for updates."})
+	return c.Status(http.StatusOK).JSON(fiber.Map{"sessions": sessions})
 }
 
-// getSceneMetadata handles the request to get the metadata for a scene. It is a JWT protected route.
+// revokeSession handles the request to revoke a single session of the user, logging out the device it was issued to.
+// It is a JWT protected route. Access tokens already issued to the session stay valid until they expire.
 //
-// It expects path parameter `scene_id`.
-func (s *WebServer) getSceneMetadata(c *fiber.Ctx) error {
-	s.logger.Debug("Get scene metadata request received")
+// It expects path parameter `session_id`.
+func (s *WebServer) revokeSession(c *fiber.Ctx) error {
+	s.logger.Debug("Revoke session request received")
 
-	var req GetSceneMetadataRequest
+	var req RevokeSessionRequest
 	if err := ValidateRequest(c, &req); err != nil {
-		s.logger.Debug("Get job data request validation failed: ", err.Error())
+		s.logger.Debug("Revoke session request validation failed: ", err.Error())
 		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
 
@@ -380,58 +611,64 @@ func (s *WebServer) getSceneMetadata(c *fiber.Ctx) error {
 		s.logger.Debug("Invalid user ID: ", err.Error())
 		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
 	}
-
-	sceneID, err := primitive.ObjectIDFromHex(req.SceneID)
-	if err != nil {
-		s.logger.Debug("Invalid job ID: ", err.Error())
-		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid job ID"})
-	}
-
-	sceneData, err := s.clientService.GetSceneMetadata(context.TODO(), userID, sceneID)
+	sessionID, err := primitive.ObjectIDFromHex(req.SessionID)
 	if err != nil {
-		s.logger.Debug("Failed to get job data: ", err.Error())
-		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		s.logger.Debug("Invalid session ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid session ID"})
 	}
 
-	sceneJson, err := json.Marshal(sceneData)
-	if err != nil {
-		s.logger.Debug("Failed to marshal job data: ", err.Error())
+	if err := s.clientService.RevokeSession(context.TODO(), userID, sessionID); err != nil {
+		s.logger.Debug("Failed to revoke session: ", err.Error())
+		if errors.Is(err, refreshtoken.ErrSessionNotFound) {
+			return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+		}
 		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	s.logger.Debug(fmt.Sprintf("Job data retrieved successfully, data: %s", sceneJson))
-	return c.Status(http.StatusOK).Send(sceneJson)
+	return c.Status(http.StatusOK).JSON(fiber.Map{"message": "Session revoked"})
 }
 
-// getUserSceneHistory handles the request to get the history of scenes for a user. It is a JWT protected route.
-func (s *WebServer) getUserSceneHistory(c *fiber.Ctx) error {
-	s.logger.Debug("Get user history request received")
+// revokeOtherSessions handles the request to revoke every session of the user except the one the request was made from,
+// logging out every other device. It is a JWT protected route.
+//
+// Access tokens issued before sessions were recorded do not identify their session, and receive a 400 asking to log in again.
+func (s *WebServer) revokeOtherSessions(c *fiber.Ctx) error {
+	s.logger.Debug("Revoke other sessions request received")
 
 	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
 	if err != nil {
 		s.logger.Debug("Invalid user ID: ", err.Error())
 		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
 	}
+	sessionID, err := primitive.ObjectIDFromHex(c.Locals("sessionID").(string))
+	if err != nil {
+		s.logger.Debug("Access token without session ID")
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Access token does not identify its session, log in again"})
+	}
 
-	sceneIDList, err := s.clientService.GetUserSceneHistory(context.TODO(), userID)
+	revoked, err := s.clientService.RevokeOtherSessions(context.TODO(), userID, sessionID)
 	if err != nil {
-		s.logger.Debug("Failed to get user history: ", err.Error())
+		s.logger.Debug("Failed to revoke other sessions: ", err.Error())
 		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	s.logger.Debug("User history retrieved successfully")
-	return c.Status(http.StatusOK).JSON(fiber.Map{"resources": sceneIDList})
+	return c.Status(http.StatusOK).JSON(fiber.Map{"message": "Other sessions revoked", "revoked": revoked})
 }
 
-// getSceneThumbnail handles the request to get the thumbnail for a scene. It is a JWT protected route.
+// getAuditTrail handles the request for the audit trail of the user: logins, account changes, scene creation / deletion,
+// and admin actions concerning the user or performed by them. It is a JWT protected route.
 //
-// It expects path parameter `scene_id`
-func (s *WebServer) getSceneThumbnail(c *fiber.Ctx) error {
-	s.logger.Debug("Get scene thumbnail request received")
+// It expects optional query parameters:
+//   - cursor, limit: the page listed (see Pagination.go)
+//   - before: an RFC3339 timestamp, only entries recorded before it are listed
+//
+// Responds with the entries, newest first.
+func (s *WebServer) getAuditTrail(c *fiber.Ctx) error {
+	s.logger.Debug("Get audit trail request received")
 
-	var req GetSceneThumbnailRequest
+	var req AuditTrailRequest
 	if err := ValidateRequest(c, &req); err != nil {
-		s.logger.Debug("Get scene thumbnail request validation failed: ", err.Error())
+		s.logger.Debug("Get audit trail request validation failed: ", err.Error())
 		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
 
@@ -441,59 +678,1219 @@ func (s *WebServer) getSceneThumbnail(c *fiber.Ctx) error {
 		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
 	}
 
-	sceneID, err := primitive.ObjectIDFromHex(req.SceneID)
-	if err != nil {
-		s.logger.Debug("Invalid scene ID: ", err.Error())
-		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid scene ID"})
+	var before time.Time
+	if req.Before != "" {
+		before, err = time.Parse(time.RFC3339, req.Before)
+		if err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid before timestamp, expected RFC3339"})
+		}
 	}
 
-	thumbnailPath, err := s.clientService.GetSceneThumbnailPath(context.TODO(), userID, sceneID)
+	page, err := pagination.New(req.Cursor, req.Limit)
 	if err != nil {
-		s.logger.Debug("Failed to get scene thumbnail: ", err.Error())
-		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	thumbnailData, err := os.ReadFile(thumbnailPath)
+	entries, next, err := s.auditService.ListUserTrail(context.TODO(), userID, before, page)
 	if err != nil {
-		s.logger.Debug("Failed to read thumbnail data: ", err.Error())
+		s.logger.Debug("Failed to list audit trail: ", err.Error())
 		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	s.logger.Debug("Scene thumbnail retrieved successfully")
-	return c.Status(http.StatusOK).Send(thumbnailData)
+	return c.Status(http.StatusOK).JSON(pageResponse("entries", entries, next))
 }
 
-// getSceneName handles the request to get the name of a scene. It is a JWT protected route.
-//
-// It expects path parameter `scene_id`.
-func (s *WebServer) getSceneName(c *fiber.Ctx) error {
-	s.logger.Debug("Get scene name request received")
-
-	var req GetSceneNameRequest
-	if err := ValidateRequest(c, &req); err != nil {
-		s.logger.Debug("Get scene name request validation failed: ", err.Error())
-		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+// audit records an audit entry for an action concerning the given user, from the IP of the request.
+// The actor is the authenticated user of the request, or the given user itself on routes without a token (i.e logins).
+func (s *WebServer) audit(c *fiber.Ctx, action string, userID, sceneID primitive.ObjectID, details map[string]string) {
+	actorID := userID
+	if local, ok := c.Locals("userID").(string); ok {
+		if id, err := primitive.ObjectIDFromHex(local); err == nil {
+			actorID = id
+		}
 	}
 
-	sceneID, err := primitive.ObjectIDFromHex(req.SceneID)
-	if err != nil {
-		s.logger.Debug("Invalid scene ID: ", err.Error())
-		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid scene ID"})
-	}
+	s.auditService.Record(context.TODO(), audit.Entry{
+		Action:  action,
+		ActorID: actorID,
+		UserID:  userID,
+		SceneID: sceneID,
+		IP:      c.IP(),
+		Details: details,
+	})
+}
 
-	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+// sendTokens signs a new access token for the user's session, and responds with it and the given refresh token.
+func (s *WebServer) sendTokens(c *fiber.Ctx, userID, sessionID, tenant, refreshToken string) error {
+	tokenString, err := s.newAccessToken(userID, sessionID, tenant)
 	if err != nil {
-		s.logger.Debug("Invalid user ID: ", err.Error())
-		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+		s.logger.Debug("Failed to generate token")
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate token"})
 	}
+	s.logger.Debugf("JWT token generated, userID %s\n", userID)
 
-	sceneName, err := s.clientService.GetSceneName(context.TODO(), userID, sceneID)
-	if err != nil {
-		s.logger.Debug("Failed to get scene name: ", err.Error())
-		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
-	}
+	return c.Status(http.StatusOK).JSON(fiber.Map{
+		"jwtToken":     tokenString,
+		"expiresIn":    int(s.config.AccessTokenTTL.Seconds()),
+		"refreshToken": refreshToken,
+	})
+}
 
-	return c.Status(http.StatusOK).JSON(fiber.Map{"name": sceneName})
+// newAccessToken signs a new access token for the user of the given tenant, identifying the session it was issued to.
+func (s *WebServer) newAccessToken(userID, sessionID, tenant string) (string, error) {
+	now := time.Now()
+	return s.signToken(withTenant(jwt.MapClaims{
+		"sub": userID,
+		"sid": sessionID,
+		"iat": now.Unix(),
+		"exp": now.Add(s.config.AccessTokenTTL).Unix(),
+	}, tenant))
+}
+
+// signToken signs a token with the given claims with the current signing key, identified by the `kid` header.
+func (s *WebServer) signToken(claims jwt.MapClaims) (string, error) {
+	key := s.jwtKeyring.SigningKey()
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.SignKey)
+}
+
+// isRefreshTokenError returns whether err means the presented refresh token can not be used.
+func isRefreshTokenError(err error) bool {
+	return errors.Is(err, refreshtoken.ErrRefreshTokenNotFound) ||
+		errors.Is(err, refreshtoken.ErrRefreshTokenRevoked) ||
+		errors.Is(err, refreshtoken.ErrRefreshTokenExpired)
+}
+
+// registerUser handles the registration request. Users are registered in the tenant served at the hostname of the request.
+// 
+// It expects a JSON payload with the following format:
+//	{
+//	    "username": "username",
+//	    "password": "password",
+//	    "terms_version": "version", (required if a terms of service version is configured)
+//	    "privacy_version": "version" (required if a privacy policy version is configured)
+//	}
+func (s *WebServer) registerUser(c *fiber.Ctx) error {
+	s.logger.Debug("Register request received")
+
+	var req RegisterRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Register request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error(), "success": false})
+	}
+
+	err := s.clientService.RegisterUser(context.TODO(), requestTenant(c), req.Username, req.Password, req.TermsVersion, req.PrivacyVersion, c.IP())
+	if errors.Is(err, services.ErrRegistrationDisabled) {
+		return c.Status(http.StatusForbidden).JSON(fiber.Map{"error": err.Error(), "success": false})
+	}
+	if err != nil {
+		s.logger.Debug("User registration failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error(), "success": false})
+	}
+
+	s.logger.Debug("User registered successfully")
+	return c.Status(http.StatusCreated).JSON(fiber.Map{"success": true})
+}
+
+// createGuest handles the request to start an anonymous trial session, backed by an ephemeral guest user.
+// Guests can submit a single scene with limited iterations, and are removed with it once the session expires.
+//
+// It expects a JSON payload with the following format:
+//	{
+//	    "terms_version": "version", (required if a terms of service version is configured)
+//	    "privacy_version": "version" (required if a privacy policy version is configured)
+//	}
+//
+// It responds with an access token (`jwtToken`) lasting the whole session, and no refresh token.
+// Guest sessions answer 404 when they are disabled.
+func (s *WebServer) createGuest(c *fiber.Ctx) error {
+	s.logger.Debug("Guest request received")
+
+	var req GuestRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Guest request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	guestID, expiresAt, err := s.clientService.CreateGuest(context.TODO(), requestTenant(c), req.TermsVersion, req.PrivacyVersion, c.IP())
+	if errors.Is(err, services.ErrGuestDisabled) {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	}
+	if errors.Is(err, user.ErrPolicyVersionMismatch) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		s.logger.Debug("Guest creation failed: ", err.Error())
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// Guest tokens have no session, they expire with the guest user
+	tokenString, err := s.signToken(withTenant(jwt.MapClaims{
+		"sub":   guestID.Hex(),
+		"guest": true,
+		"iat":   time.Now().Unix(),
+		"exp":   expiresAt.Unix(),
+	}, requestTenant(c)))
+	if err != nil {
+		s.logger.Debug("Failed to generate guest token: ", err.Error())
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate token"})
+	}
+	s.audit(c, audit.ActionLogin, guestID, primitive.NilObjectID, map[string]string{"method": "guest"})
+
+	return c.Status(http.StatusCreated).JSON(fiber.Map{
+		"jwtToken":  tokenString,
+		"expiresIn": int(time.Until(expiresAt).Seconds()),
+		"expiresAt": expiresAt,
+		"guest":     true,
+	})
+}
+
+// acceptPolicies handles the request to accept the current terms of service / privacy policy. It is a JWT protected route.
+//
+// It expects a JSON payload with the following format:
+//	{
+//	    "terms_version": "version",
+//	    "privacy_version": "version"
+//	}
+func (s *WebServer) acceptPolicies(c *fiber.Ctx) error {
+	s.logger.Debug("Accept policies request received")
+
+	var req AcceptPoliciesRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Accept policies request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	err = s.clientService.AcceptPolicies(context.TODO(), userID, req.TermsVersion, req.PrivacyVersion, c.IP())
+	if err != nil {
+		s.logger.Debug("Failed to accept policies: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"message": "Policies accepted"})
+}
+
+// updateUserUsername handles the request to update the username of a user. It is a JWT protected route.
+//
+// It expects a JSON payload with the following format:
+//	{
+//	    "password": "password",
+//	    "new_username": "new_username"
+//	}
+func (s *WebServer) updateUserUsername(c *fiber.Ctx) error {
+	s.logger.Debug("Update username request received")
+
+	var req UpdateUsernameRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Update username request validation failed: ", err.Error())
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return fiber.NewError(http.StatusBadRequest, "Invalid user ID")
+	}
+
+	err = s.clientService.UpdateUserUsername(context.TODO(), userID, req.Password, req.NewUsername)
+	if err != nil {
+		s.logger.Debug("Failed to update username: ", err.Error())
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	s.audit(c, audit.ActionUsernameChanged, userID, primitive.NilObjectID, nil)
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"message": "Username updated"})
+}
+
+// updateUserPassword handles the request to update the password of a user. It is a JWT protected route.
+// It expects a JSON payload with the following format:
+//
+//	{
+//	    "old_password": "old_password",
+//	    "new_password": "new_password"
+//	}
+func (s *WebServer) updateUserPassword(c *fiber.Ctx) error {
+	s.logger.Debug("Update password request received")
+
+	var req UpdatePasswordRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return fiber.NewError(http.StatusBadRequest, "Invalid user ID")
+	}
+
+	err = s.clientService.UpdateUserPassword(context.TODO(), userID, req.OldPassword, req.NewPassword)
+	if err != nil {
+		s.logger.Debug("Failed to update password: ", err.Error())
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	s.audit(c, audit.ActionPasswordChanged, userID, primitive.NilObjectID, nil)
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"message": "Password updated"})
+}
+
+// updateUserTimezone handles the request to update the preferred timezone of a user. It is a JWT protected route.
+// The timezone is used to localize notifications and digests; API responses are always in UTC.
+// It expects a JSON payload with the following format:
+//
+//	{
+//	    "timezone": "Europe/Berlin" (an IANA timezone name, or "" to reset to UTC)
+//	}
+func (s *WebServer) updateUserTimezone(c *fiber.Ctx) error {
+	s.logger.Debug("Update timezone request received")
+
+	var req UpdateTimezoneRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return fiber.NewError(http.StatusBadRequest, "Invalid user ID")
+	}
+
+	err = s.clientService.UpdateUserTimezone(context.TODO(), userID, req.Timezone)
+	if err != nil {
+		s.logger.Debug("Failed to update timezone: ", err.Error())
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"message": "Timezone updated"})
+}
+
+// updateUserNotifications handles the request to update the notification preferences of a user. It is a JWT protected route.
+// Omitted fields are left unchanged. Without an email, notifications are sent to the email of a linked social login account.
+// It expects a JSON payload with the following format:
+//
+//	{
+//	    "email": "user@example.com" (or "" to remove it),
+//	    "weekly_digest": false
+//	}
+func (s *WebServer) updateUserNotifications(c *fiber.Ctx) error {
+	s.logger.Debug("Update notifications request received")
+
+	var req UpdateNotificationsRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if req.Email != nil && *req.Email != "" {
+		address, err := mail.ParseAddress(*req.Email)
+		if err != nil || address.Name != "" {
+			return fiber.NewError(http.StatusBadRequest, "Invalid email address")
+		}
+		req.Email = &address.Address
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return fiber.NewError(http.StatusBadRequest, "Invalid user ID")
+	}
+
+	err = s.clientService.UpdateNotificationPreferences(context.TODO(), userID, req.Email, req.WeeklyDigest)
+	if err != nil {
+		s.logger.Debug("Failed to update notification preferences: ", err.Error())
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"message": "Notification preferences updated"})
+}
+
+// deleteUserScene handles the request to delete a scene of the user. It is a JWT protected route.
+//
+// It expects path parameter `scene_id`, and optional query parameter `permanent`.
+//
+// The scene is moved to the trash, and the response contains `purge_at`, when it will be removed with its files unless it is
+// restored. Permanent deletions (and deletions while the trash is disabled) remove the scene with its files immediately.
+// Scenes in the trash can only be deleted permanently.
+//
+// Scenes still queued or being processed can not be deleted, and answer 409 until processing finished.
+// Guests can not delete their scene, and receive a 403.
+func (s *WebServer) deleteUserScene(c *fiber.Ctx) error {
+	s.logger.Debug("Delete scene request received")
+
+	var req DeleteSceneRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Delete scene request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	sceneID, err := primitive.ObjectIDFromHex(req.SceneID)
+	if err != nil {
+		s.logger.Debug("Invalid scene ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid scene ID"})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	purgeAt, err := s.clientService.DeleteUserScene(context.TODO(), userID, sceneID, req.Permanent)
+	if err != nil {
+		s.logger.Debug("Failed to delete scene: ", err.Error())
+		return c.Status(sceneErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if purgeAt != nil {
+		s.audit(c, audit.ActionSceneTrashed, userID, sceneID, nil)
+		return c.Status(http.StatusOK).JSON(fiber.Map{"message": "Scene moved to the trash", "purge_at": purgeAt})
+	}
+	s.audit(c, audit.ActionSceneDeleted, userID, sceneID, nil)
+	return c.Status(http.StatusOK).JSON(fiber.Map{"message": "Scene deleted"})
+}
+
+// restoreUserScene handles the request to restore a scene of the user from the trash. It is a JWT protected route.
+//
+// It expects path parameter `scene_id`. Scenes that are not in the trash answer 409.
+func (s *WebServer) restoreUserScene(c *fiber.Ctx) error {
+	s.logger.Debug("Restore scene request received")
+
+	var req RestoreSceneRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Restore scene request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	sceneID, err := primitive.ObjectIDFromHex(req.SceneID)
+	if err != nil {
+		s.logger.Debug("Invalid scene ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid scene ID"})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	if err := s.clientService.RestoreUserScene(context.TODO(), userID, sceneID); err != nil {
+		s.logger.Debug("Failed to restore scene: ", err.Error())
+		return c.Status(sceneErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+	s.audit(c, audit.ActionSceneRestored, userID, sceneID, nil)
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"message": "Scene restored"})
+}
+
+// cancelUserScene handles the request to cancel the processing of a scene of the user. It is a JWT protected route.
+//
+// It expects path parameter `scene_id`.
+//
+// The scene is kept and reported failed, so it can be deleted or replayed. Scenes that are not being processed answer 409.
+func (s *WebServer) cancelUserScene(c *fiber.Ctx) error {
+	s.logger.Debug("Cancel scene request received")
+
+	var req CancelSceneRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Cancel scene request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	sceneID, err := primitive.ObjectIDFromHex(req.SceneID)
+	if err != nil {
+		s.logger.Debug("Invalid scene ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid scene ID"})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	if err := s.clientService.CancelUserScene(context.TODO(), userID, sceneID); err != nil {
+		s.logger.Debug("Failed to cancel scene: ", err.Error())
+		return c.Status(sceneErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+	s.audit(c, audit.ActionSceneCancelled, userID, sceneID, nil)
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"message": "Scene processing cancelled"})
+}
+
+// deleteUser handles the request to delete the account of a user, with all their scenes. It is a JWT protected route.
+//
+// It expects a JSON payload with the following format:
+//
+//	{
+//	    "password": "password", (required for users with a password)
+//	    "username": "username" (required instead for users without a password, i.e social login only)
+//	}
+//
+// Every session is revoked. Returns 200 once the account is removed, or 202 with `deletion_scheduled_at` if it is kept
+// for a grace period (or until its scenes finished processing). Logging in before then cancels the deletion.
+// Returns 403 if the confirmation is wrong.
+func (s *WebServer) deleteUser(c *fiber.Ctx) error {
+	s.logger.Debug("Delete user request received")
+
+	var req DeleteUserRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	deleteAt, err := s.clientService.DeleteAccount(context.TODO(), userID, req.Password, req.Username)
+	if err != nil {
+		s.logger.Debug("Failed to delete user: ", err.Error())
+		switch {
+		case errors.Is(err, services.ErrDeletionNotConfirmed):
+			return c.Status(http.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+		case errors.Is(err, user.ErrUserNotFound):
+			return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+		default:
+			return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+	s.audit(c, audit.ActionAccountDeletionRequested, userID, primitive.NilObjectID, nil)
+
+	if deleteAt != nil {
+		return c.Status(http.StatusAccepted).JSON(fiber.Map{"message": "Account scheduled for deletion", "deletion_scheduled_at": deleteAt})
+	}
+	return c.Status(http.StatusOK).JSON(fiber.Map{"message": "Account deleted"})
+}
+
+// postNewScene handles the new scene request. It is a JWT protected route.
+//
+// It expects a multipart form with the following fields:
+//   - file: required,
+//     the video file to upload (.mp4, .mov, and .mkv, .webm, .avi if uploads are transcoded), or a set of photos as
+//     a zip archive of JPEG / PNG images (.zip). The field may be repeated to upload up to SCENE_MAX_VIDEOS videos as
+//     the inputs of the scene (i.e several passes around an object), an image set must be the only file
+//   - training_mode: optional,
+//     the training mode to use (gaussian or tensorf)
+//   - output_types: optional,
+//     a comma-separated list of output types to save (e.g. splat_cloud, point_cloud, etc.)
+//   - save_iterations: optional,
+//     a comma-separated list of iterations to save the output at (0 <= x <= 30000)
+//   - total_iterations: optional,
+//     the total number of iterations to run (0 <= x <= 30000)
+//   - priority: optional,
+//     the priority of the jobs of the scene (0 normal, 1 high, 2 urgent), up to the highest priority of the user's tier
+//     (403 otherwise). Higher priority scenes are processed before the queued scenes of a lower priority
+//   - scene_name: optional,
+//     the name of the scene
+//   - callback_url: optional,
+//     an https webhook POSTed a JSON event at each stage transition of the scene (queued, sfm_completed, completed,
+//     failed, cancelled), which must resolve to a public address
+//   - callback_secret: required with callback_url,
+//     the secret (at least 16 characters) signing the events, as a hex HMAC-SHA256 of the body in the X-Scene-Callback-Signature header
+//
+// The video is validated while it is received: uploads above the maximum upload size are aborted with 413, and files
+// with another extension, or not matching their extension, with 415. Transcoded videos are evaluated once transcoded.
+// Videos violating the upload policy (duration, resolution, frames, codec) are rejected with 422, listing every violated
+// rule under `violations` with a `hint` on how to fix it. Image sets are held to the resolution rule, and to the minimum
+// number of frames as their number of images. If uploads are scanned for malware, flagged uploads are rejected with 422,
+// and uploads that could not be scanned with 503.
+//
+// Accepted scenes receive a 202 with the scene ID, the (0-based) queue position and size, the estimated start time
+// of processing, and whether the queue is long enough for processing to be delayed.
+//
+// A client may set the Upload-ID header to an ID of its choice (8 to 64 letters, digits, '-' or '_') to poll the progress
+// of the upload at /user/upload/progress/:upload_id while it is received.
+func (s *WebServer) postNewScene(c *fiber.Ctx) error {
+	s.logger.Debug("New Scene Request received")
+	var req *NewSceneRequest
+	var err error
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	tracker, err := s.uploadService.TrackUpload(context.TODO(), userID, c.Get("Upload-ID"), int64(c.Request().Header.ContentLength()))
+	if err != nil {
+		return c.Status(uploadErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// The video is validated and stored while it is streamed, so oversized or non-video uploads are rejected early
+	var videoSceneID primitive.ObjectID
+	req, err = ParseNewSceneRequest(c, func(index int, fileName string, r io.Reader) error {
+		if index > 0 {
+			return s.uploadService.ReceiveAdditionalVideo(context.TODO(), userID, videoSceneID, index, fileName, tracker.Reader(fileName, r))
+		}
+		id, err := s.uploadService.ReceiveVideo(context.TODO(), userID, fileName, tracker.Reader(fileName, r))
+		videoSceneID = id
+		return err
+	})
+	if err != nil {
+		s.logger.Debug("Video upload request parsing failed: ", err.Error())
+		s.discardVideo(userID, videoSceneID)
+		tracker.Finish(primitive.NilObjectID, err)
+		var rejected *services.UploadRejectedError
+		if errors.As(err, &rejected) {
+			return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{"error": err.Error(), "violations": rejected.Violations})
+		}
+		return c.Status(uploadErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return s.submitScene(c, userID, videoSceneID, req, tracker)
+}
+
+// submitScene creates and queues the scene of a received video with the training values of req, and answers 202 with
+// the queue feedback. The received video is discarded if the scene can not be created. The outcome is recorded by tracker,
+// if the upload is tracked.
+func (s *WebServer) submitScene(c *fiber.Ctx, userID, videoSceneID primitive.ObjectID, req *NewSceneRequest, tracker *services.UploadTracker) error {
+	if req.TrainingMode == "tensorf" {
+		s.logger.Debug("Tensorf training mode is now deprecated. Please use gaussian training mode.")
+		s.discardVideo(userID, videoSceneID)
+		tracker.Finish(primitive.NilObjectID, errors.New("tensorf training mode is deprecated"))
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Tensorf training mode is now deprecated. Please use gaussian training mode."})
+	}
+
+	err := s.uploadService.SubmitScene(context.TODO(), userID, videoSceneID, services.SceneSubmission{
+		Name:            req.SceneName,
+		TrainingMode:    req.TrainingMode,
+		OutputTypes:     req.OutputTypes,
+		SaveIterations:  req.SaveIterations,
+		TotalIterations: req.TotalIterations,
+		Priority:        req.Priority,
+		CallbackURL:     req.CallbackURL,
+		CallbackSecret:  req.CallbackSecret,
+	})
+	tracker.Finish(videoSceneID, err)
+	if err != nil {
+		s.logger.Debug("Video processing failed:", err.Error())
+		return c.Status(uploadErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	s.logger.Debugf("Video received and processing scene %s. Check back later for updates.\n", videoSceneID.Hex())
+	s.audit(c, audit.ActionSceneCreated, userID, videoSceneID, nil)
+	return s.sceneAccepted(c, videoSceneID)
+}
+
+// cloneScene handles the request to retrain a scene of the user with other training values, without uploading its video
+// again. It is a JWT protected route.
+//
+// It expects path parameter `scene_id`, and a JSON payload with the following format:
+//
+//	{
+//	    "training_mode": "gaussian", (optional)
+//	    "output_types": ["splat_cloud", "point_cloud"], (optional)
+//	    "save_iterations": [7000, 30000], (optional)
+//	    "total_iterations": 30000, (optional)
+//	    "priority": 1, (optional, not inherited)
+//	    "scene_name": "name" (optional)
+//	}
+//
+// Values that are not provided are inherited from the scene. The clone is a new scene, reusing the video of the scene and
+// its structure from motion result when available, in which case only training runs. Scenes with neither answer 410.
+// Accepted clones receive a 202 with the scene ID and the queue feedback, like new scenes.
+func (s *WebServer) cloneScene(c *fiber.Ctx) error {
+	s.logger.Debug("Clone scene request received")
+
+	var req CloneSceneRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Clone scene request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	sourceID, err := primitive.ObjectIDFromHex(req.SceneID)
+	if err != nil {
+		s.logger.Debug("Invalid scene ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid scene ID"})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	cloneID, err := s.uploadService.CloneScene(context.TODO(), userID, sourceID, services.SceneSubmission{
+		Name:            req.SceneName,
+		TrainingMode:    req.TrainingMode,
+		OutputTypes:     req.OutputTypes,
+		SaveIterations:  req.SaveIterations,
+		TotalIterations: req.TotalIterations,
+		Priority:        req.Priority,
+	})
+	if err != nil {
+		s.logger.Debug("Failed to clone scene: ", err.Error())
+		return c.Status(sceneErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	s.audit(c, audit.ActionSceneCreated, userID, cloneID, map[string]string{"cloned_from": sourceID.Hex()})
+	return s.sceneAccepted(c, cloneID)
+}
+
+// sceneAccepted answers 202 for a scene that was queued, with its ID and the queue feedback: the (0-based) queue position
+// and size, the estimated start time of processing, and whether the queue is long enough for processing to be delayed.
+func (s *WebServer) sceneAccepted(c *fiber.Ctx, sceneID primitive.ObjectID) error {
+	response := fiber.Map{"id": sceneID.Hex(), "message": "Video received and processing scene. Check back later for updates."}
+
+	// Queue feedback is informational, the scene is accepted either way
+	estimate, err := s.clientService.GetQueueEstimate(context.TODO(), sceneID)
+	if err != nil {
+		s.logger.Debug("Failed to estimate queue position: ", err.Error())
+		return c.Status(fiber.StatusAccepted).JSON(response)
+	}
+	response["queue_position"] = estimate.Position
+	response["queue_size"] = estimate.Size
+	response["estimated_start"] = estimate.EstimatedStart
+	response["delayed"] = estimate.Delayed
+	if estimate.Delayed {
+		response["message"] = "Video received. The processing queue is currently long, so processing may be delayed. Check back later for updates."
+	}
+	return c.Status(fiber.StatusAccepted).JSON(response)
+}
+
+// discardVideo removes a video received from the given user whose scene was never created. A nil scene ID is ignored.
+func (s *WebServer) discardVideo(userID, sceneID primitive.ObjectID) {
+	if sceneID.IsZero() {
+		return
+	}
+	if err := s.uploadService.DiscardVideo(context.TODO(), userID, sceneID); err != nil && !errors.Is(err, storage.ErrObjectNotFound) {
+		s.logger.Warn("Failed to discard rejected video:", err.Error())
+	}
+}
+
+// uploadErrorStatus maps errors raised while receiving a video upload to an HTTP status code.
+func uploadErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrUploadTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, services.ErrNotAVideo), errors.Is(err, services.ErrNotAnImageSet), errors.Is(err, services.ErrImproperFileExtension):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, services.ErrGuestQuotaExceeded), errors.Is(err, services.ErrQuotaExceeded),
+		errors.Is(err, services.ErrPriorityNotAllowed):
+		return http.StatusForbidden
+	case errors.Is(err, services.ErrUploadFlagged):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, services.ErrUploadScanFailed), errors.Is(err, services.ErrUploadsBusy):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// sceneErrorStatus maps errors returned by the scene routes of the ClientService to an HTTP status code,
+// so every scene route answers 404 for missing scenes / outputs and 403 for scenes of other users.
+func sceneErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, user.ErrUserNoAccess):
+		return http.StatusForbidden
+	case errors.Is(err, user.ErrUserNotFound):
+		return http.StatusUnauthorized
+	case errors.Is(err, scene.ErrSceneNotFound), errors.Is(err, scene.ErrNerfNotFound), errors.Is(err, scene.ErrSfmNotFound),
+		errors.Is(err, scene.ErrTrainingConfigNotFound), errors.Is(err, scene.ErrNoOutputPaths),
+		errors.Is(err, scene.ErrCostNotFound), errors.Is(err, services.ErrThumbnailNotFound), errors.Is(err, scene.ErrVersionNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, scene.ErrInvalidOutputType), errors.Is(err, services.ErrInvalidIteration),
+		errors.Is(err, services.ErrInvalidTrainingConfig):
+		return http.StatusBadRequest
+	case errors.Is(err, scene.ErrSceneArchived), errors.Is(err, scene.ErrArchiveConflict), errors.Is(err, services.ErrSceneProcessing),
+		errors.Is(err, services.ErrJobNotQueued), errors.Is(err, scene.ErrSceneNotInTrash), errors.Is(err, scene.ErrTrainingStarted):
+		return http.StatusConflict
+	case errors.Is(err, services.ErrGuestRestricted), errors.Is(err, services.ErrGuestQuotaExceeded), errors.Is(err, services.ErrQuotaExceeded),
+		errors.Is(err, services.ErrPriorityNotAllowed):
+		return http.StatusForbidden
+	case errors.Is(err, services.ErrThumbnailTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, services.ErrInvalidThumbnail):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, services.ErrArchiveDisabled), errors.Is(err, services.ErrSyntheticDisabled):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, scene.ErrOutputsDeleted), errors.Is(err, services.ErrCloneUnavailable):
+		return http.StatusGone
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// getSceneMetadata handles the request to get the metadata for a scene. It is a JWT protected route.
+//
+// It expects path parameter `scene_id`. The response lists the `inputs` of the scene as probed at ingest, available while the
+// scene is still queued, and the `resources` of its outputs once trained. If a worker reported a failure for the scene, the
+// response has an `error` with the failed stage, the message of the worker and when it failed.
+func (s *WebServer) getSceneMetadata(c *fiber.Ctx) error {
+	s.logger.Debug("Get scene metadata request received")
+
+	var req GetSceneMetadataRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Get job data request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	sceneID, err := primitive.ObjectIDFromHex(req.SceneID)
+	if err != nil {
+		s.logger.Debug("Invalid job ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid job ID"})
+	}
+
+	sceneData, err := s.clientService.GetSceneMetadata(context.TODO(), userID, sceneID)
+	if err != nil {
+		s.logger.Debug("Failed to get job data: ", err.Error())
+		return c.Status(sceneErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	sceneJson, err := json.Marshal(sceneData)
+	if err != nil {
+		s.logger.Debug("Failed to marshal job data: ", err.Error())
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	s.logger.Debugf("Job data retrieved successfully, data: %s", s.logger.RedactBody(sceneJson))
+	return c.Status(http.StatusOK).Send(sceneJson)
+}
+
+// getUserSceneHistory handles the request to get the history of scenes for a user. It is a JWT protected route.
+//
+// Responds with the summaries of the scenes of the user, newest first, or of the scenes in the trash with query parameter
+// `trash=true`. It is paginated, and `total` is the number of scenes across every page:
+//
+//	{
+//	    "scenes": [
+//	        {
+//	            "id": "id",
+//	            "name": "name",
+//	            "status": "queued" | "processing" | "completed" | "failed" | "unknown",
+//	            "created_at": RFC3339,
+//	            "has_thumbnail": bool,
+//	            "latest_iteration": int, (omitted until outputs are stored)
+//	            "failure_reason": "reason", (failed scenes only)
+//	            "deleted_at": RFC3339 (scenes in the trash only)
+//	        },
+//	        ...
+//	    ],
+//	    "total": int,
+//	    "next_cursor": "cursor" | null
+//	}
+func (s *WebServer) getUserSceneHistory(c *fiber.Ctx) error {
+	s.logger.Debug("Get user history request received")
+
+	var req SceneHistoryRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Get user history request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	page, err := pagination.New(req.Cursor, req.Limit)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	scenes, next, total, err := s.clientService.GetUserSceneHistory(context.TODO(), userID, req.Trash, page)
+	if err != nil {
+		s.logger.Debug("Failed to get user history: ", err.Error())
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	s.logger.Debug("User history retrieved successfully")
+	response := pageResponse("scenes", scenes, next)
+	response["total"] = total
+	return c.Status(http.StatusOK).JSON(response)
+}
+
+// getSceneThumbnail handles the request to get the thumbnail for a scene. It is a JWT protected route.
+//
+// It expects path parameter `scene_id`
+func (s *WebServer) getSceneThumbnail(c *fiber.Ctx) error {
+	s.logger.Debug("Get scene thumbnail request received")
+
+	var req GetSceneThumbnailRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Get scene thumbnail request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	sceneID, err := primitive.ObjectIDFromHex(req.SceneID)
+	if err != nil {
+		s.logger.Debug("Invalid scene ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid scene ID"})
+	}
+
+	thumbnailKey, err := s.clientService.GetSceneThumbnailKey(context.TODO(), userID, sceneID)
+	if err != nil {
+		s.logger.Debug("Failed to get scene thumbnail: ", err.Error())
+		return c.Status(sceneErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	s.logger.Debug("Scene thumbnail retrieved successfully")
+	return s.sendObjectWithRangeSupport(c, thumbnailKey)
+}
+
+// putSceneThumbnail handles the request to upload the thumbnail of a scene, replacing its thumbnail chosen among its frames.
+// It is a JWT protected route.
+//
+// It expects path parameter `scene_id`, and a multipart form with the image as `file`: a PNG or JPEG image of at most
+// THUMBNAIL_MAX_SIZE bytes and 4096 pixels per side.
+//
+// Returns 413 if the image is too large, 415 if it is not a valid PNG or JPEG image.
+func (s *WebServer) putSceneThumbnail(c *fiber.Ctx) error {
+	s.logger.Debug("Put scene thumbnail request received")
+
+	var req PutSceneThumbnailRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Put scene thumbnail request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	sceneID, err := primitive.ObjectIDFromHex(req.SceneID)
+	if err != nil {
+		s.logger.Debug("Invalid scene ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid scene ID"})
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": services.ErrFileNotReceived.Error()})
+	}
+	if fileHeader.Size > s.config.ThumbnailMaxSize {
+		return c.Status(http.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": services.ErrThumbnailTooLarge.Error()})
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": services.ErrFileNotReceived.Error()})
+	}
+	defer file.Close()
+
+	if err := s.clientService.SetSceneThumbnail(context.TODO(), userID, sceneID, file); err != nil {
+		s.logger.Debug("Failed to set scene thumbnail: ", err.Error())
+		return c.Status(sceneErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"message": "Thumbnail updated"})
+}
+
+// getSceneName handles the request to get the name of a scene. It is a JWT protected route.
+//
+// It expects path parameter `scene_id`.
+func (s *WebServer) getSceneName(c *fiber.Ctx) error {
+	s.logger.Debug("Get scene name request received")
+
+	var req GetSceneNameRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Get scene name request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	sceneID, err := primitive.ObjectIDFromHex(req.SceneID)
+	if err != nil {
+		s.logger.Debug("Invalid scene ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid scene ID"})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	sceneName, err := s.clientService.GetSceneName(context.TODO(), userID, sceneID)
+	if err != nil {
+		s.logger.Debug("Failed to get scene name: ", err.Error())
+		return c.Status(sceneErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"name": sceneName})
+}
+
+// getSceneConfig handles the request to get the training configuration of a scene. It is a JWT protected route.
+//
+// It expects path parameter `scene_id`. Responds with the following format:
+//
+//	{
+//	    "id": "scene_id",
+//	    "config": {
+//	        "nerf_training_config": {
+//	            "training_mode": "gaussian" | "tensorf",
+//	            "output_types": ["splat_cloud", ...],
+//	            "save_iterations": [int, ...],
+//	            "total_iterations": int
+//	        }
+//	    }
+//	}
+func (s *WebServer) getSceneConfig(c *fiber.Ctx) error {
+	s.logger.Debug("Get scene config request received")
+
+	var req GetSceneConfigRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Get scene config request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	sceneID, err := primitive.ObjectIDFromHex(req.SceneID)
+	if err != nil {
+		s.logger.Debug("Invalid scene ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid scene ID"})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	config, err := s.clientService.GetSceneTrainingConfig(context.TODO(), userID, sceneID)
+	if err != nil {
+		s.logger.Debug("Failed to get scene config: ", err.Error())
+		return c.Status(sceneErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"id": sceneID.Hex(), "config": config})
+}
+
+// updateSceneConfig handles the request to change the training configuration of a scene before its training starts.
+// It is a JWT protected route.
+//
+// It expects path parameter `scene_id`, and a JSON body with any of `output_types`, `save_iterations` and `total_iterations`.
+// Values that are not provided are kept. Responds like getSceneConfig with the updated configuration, or 409 once the
+// scene left sfm_list.
+func (s *WebServer) updateSceneConfig(c *fiber.Ctx) error {
+	s.logger.Debug("Update scene config request received")
+
+	var req UpdateSceneConfigRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Update scene config request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	sceneID, err := primitive.ObjectIDFromHex(req.SceneID)
+	if err != nil {
+		s.logger.Debug("Invalid scene ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid scene ID"})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	config, err := s.clientService.UpdateSceneTrainingConfig(context.TODO(), userID, sceneID, services.TrainingConfigUpdate{
+		OutputTypes:     req.OutputTypes,
+		SaveIterations:  req.SaveIterations,
+		TotalIterations: req.TotalIterations,
+	})
+	if err != nil {
+		s.logger.Debug("Failed to update scene config: ", err.Error())
+		return c.Status(sceneErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"id": sceneID.Hex(), "config": config})
+}
+
+// getSceneCost handles the request to get the resources consumed processing a scene. It is a JWT protected route.
+//
+// It expects path parameter `scene_id`.
+//
+// Responds with the total GPU seconds, and the worker and GPU seconds of each finished stage (sfm, nerf).
+func (s *WebServer) getSceneCost(c *fiber.Ctx) error {
+	s.logger.Debug("Get scene cost request received")
+
+	var req GetSceneCostRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Get scene cost request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	sceneID, err := primitive.ObjectIDFromHex(req.SceneID)
+	if err != nil {
+		s.logger.Debug("Invalid scene ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid scene ID"})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	cost, err := s.clientService.GetSceneCost(context.TODO(), userID, sceneID)
+	if err != nil {
+		s.logger.Debug("Failed to get scene cost: ", err.Error())
+		return c.Status(sceneErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"id": sceneID.Hex(), "cost": cost})
+}
+
+// getSceneStorage handles the request to get the storage used by a scene. It is a JWT protected route.
+//
+// It expects path parameter `scene_id`.
+//
+// Responds with the bytes used by the video, thumbnails, sfm frames and each type of nerf output of the scene:
+//
+//	{
+//	    "usage": {
+//	        "scene_id": "id",
+//	        "video_bytes": int,
+//	        "thumbnail_bytes": int,
+//	        "sfm_bytes": int,
+//	        "sfm_files": int,
+//	        "nerf_bytes": {"splat_cloud": int, "point_cloud": int, "video": int, "model": int},
+//	        "nerf_files": int,
+//	        "cold_bytes": int,
+//	        "total_bytes": int
+//	    }
+//	}
+func (s *WebServer) getSceneStorage(c *fiber.Ctx) error {
+	s.logger.Debug("Get scene storage request received")
+
+	var req GetSceneStorageRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Get scene storage request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	sceneID, err := primitive.ObjectIDFromHex(req.SceneID)
+	if err != nil {
+		s.logger.Debug("Invalid scene ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid scene ID"})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	usage, err := s.clientService.GetSceneStorageUsage(context.TODO(), userID, sceneID)
+	if err != nil {
+		s.logger.Debug("Failed to get scene storage usage: ", err.Error())
+		return c.Status(sceneErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"usage": usage})
+}
+
+// getUserQuota handles the request to get the usage of the quotas of the user. It is a JWT protected route.
+//
+// Responds with the usage and limit (0 = unlimited) of every quota, and when the scenes created today stop counting:
+//
+//	{
+//	    "quota": {
+//	        "storage_bytes": {"used": int, "limit": int},
+//	        "active_scenes": {"used": int, "limit": int},
+//	        "scenes_today": {"used": int, "limit": int},
+//	        "scenes_today_reset_at": "time"
+//	    }
+//	}
+func (s *WebServer) getUserQuota(c *fiber.Ctx) error {
+	s.logger.Debug("Get user quota request received")
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	usage, err := s.uploadService.GetQuotaUsage(context.TODO(), userID)
+	if err != nil {
+		s.logger.Debug("Failed to get quota usage: ", err.Error())
+		return c.Status(sceneErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"quota": usage})
+}
+
+// getSceneArchive handles the request to get the archive status of a scene. It is a JWT protected route.
+//
+// It expects path parameter `scene_id`.
+//
+// Responds with the status (hot, archiving, archived, restoring), the number of archived objects and bytes,
+// the number of objects moved by the running archive or restore, and why the last restore failed.
+func (s *WebServer) getSceneArchive(c *fiber.Ctx) error {
+	return s.sceneArchiveAction(c, "Get scene archive", http.StatusOK, s.clientService.GetArchiveStatus)
+}
+
+// archiveScene handles the request to move the outputs of a completed scene to cold storage. It is a JWT protected route.
+//
+// It expects path parameter `scene_id`.
+//
+// Responds 202 with the archive status once the move started. Outputs are served until the status is archived.
+func (s *WebServer) archiveScene(c *fiber.Ctx) error {
+	return s.sceneArchiveAction(c, "Archive scene", http.StatusAccepted, s.clientService.ArchiveScene)
+}
+
+// restoreScene handles the request to move the outputs of an archived scene back from cold storage.
+// It is a JWT protected route.
+//
+// It expects path parameter `scene_id`.
+//
+// Responds 202 with the archive status once the move started. Outputs are served again once the status is hot,
+// poll GET /user/scene/archive/:scene_id for progress.
+func (s *WebServer) restoreScene(c *fiber.Ctx) error {
+	return s.sceneArchiveAction(c, "Restore scene", http.StatusAccepted, s.clientService.RestoreScene)
+}
+
+// sceneArchiveAction validates a scene archive request, and responds with the archive status returned by action.
+func (s *WebServer) sceneArchiveAction(
+	c *fiber.Ctx,
+	name string,
+	status int,
+	action func(ctx context.Context, userID, sceneID primitive.ObjectID) (*services.ArchiveStatus, error),
+) error {
+	s.logger.Debug(name + " request received")
+
+	var req SceneArchiveRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug(name+" request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	sceneID, err := primitive.ObjectIDFromHex(req.SceneID)
+	if err != nil {
+		s.logger.Debug("Invalid scene ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid scene ID"})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	archive, err := action(context.TODO(), userID, sceneID)
+	if err != nil {
+		s.logger.Debug(name+" failed: ", err.Error())
+		return c.Status(sceneErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(status).JSON(fiber.Map{"id": sceneID.Hex(), "archive": archive})
 }
 
 // getSceneOutput handles the request to get the output for a scene. It is a JWT protected route.
@@ -502,6 +1899,8 @@ func (s *WebServer) getSceneName(c *fiber.Ctx) error {
 // 
 // The user can optionally specify a query parameter `iteration` to get the output at a specific iteration.
 // If the iteration is not specified, the latest output is given.
+// The user can optionally specify a query parameter `version` to get the output of a previous training of the scene.
+// If the version is not specified, the output of the current version is given.
 func (s *WebServer) getSceneOutput(c *fiber.Ctx) error {
 	s.logger.Debug("Get scene output request received")
 
@@ -523,18 +1922,125 @@ func (s *WebServer) getSceneOutput(c *fiber.Ctx) error {
 		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
 	}
 
-	outputPath, err := s.clientService.GetSceneOutputPath(context.TODO(), userID, sceneID, req.OutputType, req.Iteration)
+	outputKey, err := s.clientService.GetSceneOutputKey(context.TODO(), userID, sceneID, req.Version, req.OutputType, req.Iteration)
 	if err != nil {
-		s.logger.Debugf("Failed to get scene output: ", err.Error())
-		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		s.logger.Debug("Failed to get scene output: ", err.Error())
+		return c.Status(sceneErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return s.sendObjectWithRangeSupport(c, outputKey)
+}
+
+// listSceneVersions handles the request to list the training results of a scene. It is a JWT protected route.
+//
+// It expects a path parameter `scene_id`. A scene keeps its previous results when it is retrained, newest first in the
+// response, and their outputs are fetched by passing their version to getSceneOutput:
+//
+//	{
+//	    "id": string,
+//	    "versions": [
+//	        {
+//	            "version": int,
+//	            "current": bool,
+//	            "completed_at": RFC3339 (if known),
+//	            "worker_version": string (if reported),
+//	            "output_types": [string],
+//	            "latest_iteration": int
+//	        },
+//	        ...
+//	    ]
+//	}
+func (s *WebServer) listSceneVersions(c *fiber.Ctx) error {
+	s.logger.Debug("List scene versions request received")
+
+	var req ListSceneVersionsRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("List scene versions request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	sceneID, err := primitive.ObjectIDFromHex(req.SceneID)
+	if err != nil {
+		s.logger.Debug("Invalid scene ID: ", req.SceneID)
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid scene ID"})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", c.Locals("userID").(string))
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	versions, err := s.clientService.ListSceneVersions(context.TODO(), userID, sceneID)
+	if err != nil {
+		s.logger.Debug("Failed to list scene versions: ", err.Error())
+		return c.Status(sceneErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"id": sceneID.Hex(), "versions": versions})
+}
+
+// exportScene handles the request to download a scene as a single archive. It is a JWT protected route.
+//
+// It expects a path parameter `scene_id`, and the optional query parameters:
+//   - format:
+//     the archive format, zip (default) or tar
+//   - output_types:
+//     a comma-separated list of the output types to include, every available output if not given
+//
+// The archive contains the raw video, the structure from motion frames, the outputs and a scene.json manifest with the
+// training configuration and camera poses. It is assembled while it is sent, so its size is not known in advance.
+// Returns 409 / 410 if selected outputs are archived / deleted, 404 if the scene has none of a selected type.
+func (s *WebServer) exportScene(c *fiber.Ctx) error {
+	s.logger.Debug("Export scene request received")
+
+	var req ExportSceneRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Export scene request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	sceneID, err := primitive.ObjectIDFromHex(req.SceneID)
+	if err != nil {
+		s.logger.Debug("Invalid scene ID: ", req.SceneID)
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid scene ID"})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", c.Locals("userID").(string))
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	format := req.Format
+	if format == "" {
+		format = services.ExportFormatZip
+	}
+	var outputTypes []string
+	if req.OutputTypes != "" {
+		outputTypes = strings.Split(req.OutputTypes, ",")
 	}
 
-	return s.sendFileWithRangeSupport(c, outputPath)
+	export, err := s.clientService.PrepareSceneExport(context.TODO(), userID, sceneID, format, outputTypes)
+	if err != nil {
+		s.logger.Debug("Failed to export scene: ", err.Error())
+		return c.Status(sceneErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	c.Type(export.Format)
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", export.FileName()))
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		if err := s.clientService.WriteSceneExport(context.Background(), w, export); err != nil {
+			s.logger.Warnf("Export of scene %s truncated: %v", sceneID.Hex(), err)
+		}
+	})
+	return nil
 }
 
 // getSceneProgress handles the request to get the progress of a scene. It is a JWT protected route.
+// Deprecated: kept for old clients, new clients should use the typed report of /api/v1/user/scene/progress/:scene_id.
 //
-// It expects a path parameter `scene_id`.
+// It expects a path parameter `scene_id`. Scenes that are no longer processing have an `error` if a worker reported a failure.
 func (s *WebServer) getSceneProgress(c *fiber.Ctx) error {
 	s.logger.Debug("Get scene progress request received")
 
@@ -559,34 +2065,110 @@ func (s *WebServer) getSceneProgress(c *fiber.Ctx) error {
 	progress, err := s.clientService.GetSceneProgress(context.TODO(), userID, sceneID)
 	if err != nil {
 		s.logger.Debug("Failed to get scene progress: ", err.Error())
-		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		return c.Status(sceneErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
 	}
 
 	return c.Status(http.StatusOK).JSON(progress)
 }
 
-// getWorkerData handles the request to send data between workers. It is an internal route.
-// 
-// The path given is trusted and thus a vulnerability.
+// getSceneProgressReport handles the request to get the typed progress report of a scene. It is a JWT protected route.
+//
+// It expects a path parameter `scene_id`. Responds with the following format:
+//
+//	{
+//	    "status": "queued" | "processing" | "completed" | "failed" | "unknown",
+//	    "stage": "sfm" | "nerf" (while queued / processing),
+//	    "percent_complete": float64,
+//	    "stage_eta": RFC3339 (estimated end of the current stage),
+//	    "failure_reason": string (when failed),
+//	    "error": {"stage": "sfm" | "nerf", "message": string, "timestamp": RFC3339} (when failed, if reported by a worker),
+//	    "queues": {
+//	        "overall": {"position": int, "size": int},
+//	        "stage": {"position": int, "size": int}
+//	    },
+//	    "poll_after_seconds": int (while queued / processing / unknown, seconds to wait before polling again)
+//	}
+func (s *WebServer) getSceneProgressReport(c *fiber.Ctx) error {
+	s.logger.Debug("Get scene progress report request received")
+
+	var req GetSceneProgressRequest
+	if err := ValidateRequest(c, &req); err != nil {
+		s.logger.Debug("Get scene progress report request validation failed: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	sceneID, err := primitive.ObjectIDFromHex(req.SceneID)
+	if err != nil {
+		s.logger.Debug("Invalid scene ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid scene ID"})
+	}
+
+	userID, err := primitive.ObjectIDFromHex(c.Locals("userID").(string))
+	if err != nil {
+		s.logger.Debug("Invalid user ID: ", err.Error())
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	progress, err := s.clientService.GetSceneProgressReport(context.TODO(), userID, sceneID)
+	if err != nil {
+		s.logger.Debug("Failed to get scene progress report: ", err.Error())
+		return c.Status(sceneErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusOK).JSON(progress)
+}
+
+// getAnnouncements handles the request to get the currently active announcements. It is a public route,
+// so that maintenance notices can also be shown on the login page.
+func (s *WebServer) getAnnouncements(c *fiber.Ctx) error {
+	s.logger.Debug("Get announcements request received")
+
+	announcements, err := s.adminService.GetActiveAnnouncements(context.TODO())
+	if err != nil {
+		s.logger.Debug("Failed to get announcements: ", err.Error())
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(http.StatusOK).JSON(fiber.Map{"announcements": announcements})
+}
+
+// getPolicies handles the request to get the current terms of service / privacy policy versions. It is a public route.
+func (s *WebServer) getPolicies(c *fiber.Ctx) error {
+	s.logger.Debug("Get policies request received")
+
+	termsVersion, privacyVersion := s.clientService.GetPolicyVersions()
+	return c.Status(http.StatusOK).JSON(fiber.Map{
+		"terms_version":   termsVersion,
+		"privacy_version": privacyVersion,
+	})
+}
+
+// getWorkerData handles the request of a worker to download an input of its job. It is an internal route.
+//
+// The path given is a storage key (legacy paths prefixed with "data/" are accepted). Keys escaping the storage root are rejected.
+// Only job inputs (raw videos, image sets and sfm frames) are served, with the query parameters the URL was signed with when
+// its job was published (see storage.WorkerURLSigner). Other keys are not found, unsigned or expired URLs are forbidden.
 func (s *WebServer) getWorkerData(c *fiber.Ctx) error {
 	s.logger.Debug("Get worker data request received, path:", c.Params("*"))
 
-	fullPath := c.Params("*")
-
-	if fullPath == "" {
+	key, err := storage.CleanKey(c.Params("*"))
+	if err != nil {
 		s.logger.Debug("Invalid path parameter")
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid path parameter"})
 	}
-
-	basePath := "/app"
-	fullPath = filepath.Join(basePath, fullPath)
-
-	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
-		s.logger.Debug("File not found: ", fullPath)
+	if !storage.IsWorkerInputKey(key) {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File Not Found"})
 	}
+	query, err := url.ParseQuery(string(c.Request().URI().QueryString()))
+	if err == nil {
+		err = s.workerURLs.Verify(key, query)
+	}
+	if err != nil {
+		s.logger.Debug("Worker data request refused: ", err.Error())
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": storage.ErrInvalidWorkerURL.Error()})
+	}
 
-	return c.SendFile(fullPath)
+	return s.sendObjectWithRangeSupport(c, key)
 }
 
 // getRoutes handles the request to get the list of routes available on the server.
@@ -603,72 +2185,73 @@ func (s *WebServer) healthCheck(c *fiber.Ctx) error {
 }
 
 
-// sendFileWithRangeSupport sends a file with support for the Range header.
+// sendObjectWithRangeSupport sends a stored object with support for the Range header.
 // Call this function from any handler which you suspect needs to handle large files.
 //
+// The object is streamed from storage instead of being buffered, so large outputs do not need to fit in memory.
 // This function trusts the Range header and does not perform any validation on the range values.
-func (s *WebServer) sendFileWithRangeSupport(c *fiber.Ctx, filePath string) error {
-    file, err := os.Open(filePath)
-    if err != nil {
-        return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to open file"})
-    }
-    defer file.Close()
-
-    stat, err := file.Stat()
-    if err != nil {
-        return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to get file info"})
-    }
-
-    fileSize := stat.Size()
-    contentLength := fileSize
-    start := int64(0)
-    end := fileSize - 1
-
-    rangeHeader := c.Get("Range")
-    if rangeHeader != "" {
-        if strings.HasPrefix(rangeHeader, "bytes=") {
-            rangeHeader = rangeHeader[6:]
-            rangeParts := strings.Split(rangeHeader, "-")
-            if len(rangeParts) == 2 {
-                start, _ = strconv.ParseInt(rangeParts[0], 10, 64)
-                if rangeParts[1] != "" {
-                    end, _ = strconv.ParseInt(rangeParts[1], 10, 64)
-                }
-            }
-        }
-    }
-
-    if start >= fileSize || start > end || end >= fileSize {
-        return c.Status(fiber.StatusRequestedRangeNotSatisfiable).SendString("Invalid range")
-    }
-
-    contentLength = end - start + 1
-
-    c.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, fileSize))
-    c.Set("Accept-Ranges", "bytes")
-    c.Set("Content-Length", fmt.Sprintf("%d", contentLength))
-
-    // Set the appropriate status code
-    if rangeHeader != "" {
-        c.Status(fiber.StatusPartialContent)
-    } else {
-        c.Status(fiber.StatusOK)
-    }
-
-    // Set the Content-Type header based on the file extension
-    c.Type(filepath.Ext(filePath))
-
-    // Seek to the start position in the file
-    _, err = file.Seek(start, io.SeekStart)
-    if err != nil {
-        return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to seek file"})
-    }
-
-    // Use io.CopyN to send only the requested range of bytes
-    _, err = io.CopyN(c, file, contentLength)
-    if err != nil && err != io.EOF {
-        return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to send file"})
-    }
-
-    return nil
-}
\ No newline at end of file
+func (s *WebServer) sendObjectWithRangeSupport(c *fiber.Ctx, key string) error {
+	info, err := s.storage.Stat(c.Context(), key)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File Not Found"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to get file info"})
+	}
+
+	fileSize := info.Size
+	start := int64(0)
+	end := fileSize - 1
+
+	rangeHeader := c.Get("Range")
+	if rangeHeader != "" {
+		if strings.HasPrefix(rangeHeader, "bytes=") {
+			rangeHeader = rangeHeader[6:]
+			rangeParts := strings.Split(rangeHeader, "-")
+			if len(rangeParts) == 2 {
+				start, _ = strconv.ParseInt(rangeParts[0], 10, 64)
+				if rangeParts[1] != "" {
+					end, _ = strconv.ParseInt(rangeParts[1], 10, 64)
+				}
+			}
+		}
+	}
+
+	if start >= fileSize || start > end || end >= fileSize {
+		return c.Status(fiber.StatusRequestedRangeNotSatisfiable).SendString("Invalid range")
+	}
+
+	contentLength := end - start + 1
+
+	object, err := s.storage.Open(c.Context(), key)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to open file"})
+	}
+
+	// Seek to the start position in the object
+	if _, err := object.Seek(start, io.SeekStart); err != nil {
+		object.Close()
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to seek file"})
+	}
+
+	c.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, fileSize))
+	c.Set("Accept-Ranges", "bytes")
+
+	// Set the appropriate status code
+	if rangeHeader != "" {
+		c.Status(fiber.StatusPartialContent)
+	} else {
+		c.Status(fiber.StatusOK)
+	}
+
+	// Set the Content-Type header based on the file extension
+	c.Type(filepath.Ext(key))
+
+	// Only send the requested range of bytes. fasthttp closes the stream once it has been sent.
+	c.Context().SetBodyStream(struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(object, contentLength), object}, int(contentLength))
+
+	return nil
+}
@@ -1,3 +1,8 @@
 // Package web contains the implementation of the web server. The web server is responsible
 // for handling/validating HTTP requests and dispatching them to the appropriate handler.
-package web
\ No newline at end of file
+//
+// Routes under /api/v1 have typed, versioned response schemas. Breaking changes to them are only made under a new
+// version prefix, so old clients keep working. Unprefixed routes predate versioning.
+//
+// Timestamps in responses are RFC3339 in UTC. Timestamps in requests may use any offset, and are converted to UTC.
+package web